@@ -77,10 +77,11 @@ func (m *PAMBlockHeader) GetBlobOffset() uint32 {
 }
 
 type PAMBlockIndexEntry struct {
-	FileOffset uint64 `protobuf:"varint,1,opt,name=file_offset,json=fileOffset,proto3" json:"file_offset,omitempty"`
-	NumRecords uint32 `protobuf:"varint,3,opt,name=num_records,json=numRecords,proto3" json:"num_records,omitempty"`
-	StartAddr  Coord  `protobuf:"bytes,4,opt,name=start_addr,json=startAddr,proto3" json:"start_addr"`
-	EndAddr    Coord  `protobuf:"bytes,5,opt,name=end_addr,json=endAddr,proto3" json:"end_addr"`
+	FileOffset uint64         `protobuf:"varint,1,opt,name=file_offset,json=fileOffset,proto3" json:"file_offset,omitempty"`
+	NumRecords uint32         `protobuf:"varint,3,opt,name=num_records,json=numRecords,proto3" json:"num_records,omitempty"`
+	StartAddr  Coord          `protobuf:"bytes,4,opt,name=start_addr,json=startAddr,proto3" json:"start_addr"`
+	EndAddr    Coord          `protobuf:"bytes,5,opt,name=end_addr,json=endAddr,proto3" json:"end_addr"`
+	Stats      *PAMBlockStats `protobuf:"bytes,6,opt,name=stats,proto3" json:"stats,omitempty"`
 }
 
 func (m *PAMBlockIndexEntry) Reset()         { *m = PAMBlockIndexEntry{} }
@@ -144,11 +145,20 @@ func (m *PAMBlockIndexEntry) GetEndAddr() Coord {
 	return Coord{}
 }
 
+func (m *PAMBlockIndexEntry) GetStats() *PAMBlockStats {
+	if m != nil {
+		return m.Stats
+	}
+	return nil
+}
+
 type PAMShardIndex struct {
-	Magic            uint64     `protobuf:"fixed64,1,opt,name=magic,proto3" json:"magic,omitempty"`
-	Version          string     `protobuf:"bytes,3,opt,name=version,proto3" json:"version,omitempty"`
-	Range            CoordRange `protobuf:"bytes,4,opt,name=range,proto3" json:"range"`
-	EncodedBamHeader []byte     `protobuf:"bytes,15,opt,name=encoded_bam_header,json=encodedBamHeader,proto3" json:"encoded_bam_header,omitempty"`
+	Magic            uint64            `protobuf:"fixed64,1,opt,name=magic,proto3" json:"magic,omitempty"`
+	Version          string            `protobuf:"bytes,3,opt,name=version,proto3" json:"version,omitempty"`
+	Range            CoordRange        `protobuf:"bytes,4,opt,name=range,proto3" json:"range"`
+	ReferenceM5      []string          `protobuf:"bytes,5,rep,name=reference_m5,json=referenceM5,proto3" json:"reference_m5,omitempty"`
+	Metadata         map[string]string `protobuf:"bytes,6,rep,name=metadata,proto3" json:"metadata,omitempty" protobuf_key:"bytes,1,opt,name=key,proto3" protobuf_val:"bytes,2,opt,name=value,proto3"`
+	EncodedBamHeader []byte            `protobuf:"bytes,15,opt,name=encoded_bam_header,json=encodedBamHeader,proto3" json:"encoded_bam_header,omitempty"`
 }
 
 func (m *PAMShardIndex) Reset()         { *m = PAMShardIndex{} }
@@ -205,6 +215,20 @@ func (m *PAMShardIndex) GetRange() CoordRange {
 	return CoordRange{}
 }
 
+func (m *PAMShardIndex) GetReferenceM5() []string {
+	if m != nil {
+		return m.ReferenceM5
+	}
+	return nil
+}
+
+func (m *PAMShardIndex) GetMetadata() map[string]string {
+	if m != nil {
+		return m.Metadata
+	}
+	return nil
+}
+
 func (m *PAMShardIndex) GetEncodedBamHeader() []byte {
 	if m != nil {
 		return m.EncodedBamHeader
@@ -280,46 +304,144 @@ func (m *PAMFieldIndex) GetBlocks() []PAMBlockIndexEntry {
 	return nil
 }
 
+type PAMBlockStats struct {
+	MinMapq    uint32 `protobuf:"varint,1,opt,name=min_mapq,json=minMapq,proto3" json:"min_mapq,omitempty"`
+	MaxMapq    uint32 `protobuf:"varint,2,opt,name=max_mapq,json=maxMapq,proto3" json:"max_mapq,omitempty"`
+	FlagsOr    uint32 `protobuf:"varint,3,opt,name=flags_or,json=flagsOr,proto3" json:"flags_or,omitempty"`
+	FlagsAnd   uint32 `protobuf:"varint,4,opt,name=flags_and,json=flagsAnd,proto3" json:"flags_and,omitempty"`
+	MinTempLen int64  `protobuf:"varint,5,opt,name=min_temp_len,json=minTempLen,proto3" json:"min_temp_len,omitempty"`
+	MaxTempLen int64  `protobuf:"varint,6,opt,name=max_temp_len,json=maxTempLen,proto3" json:"max_temp_len,omitempty"`
+}
+
+func (m *PAMBlockStats) Reset()         { *m = PAMBlockStats{} }
+func (m *PAMBlockStats) String() string { return proto.CompactTextString(m) }
+func (*PAMBlockStats) ProtoMessage()    {}
+func (*PAMBlockStats) Descriptor() ([]byte, []int) {
+	return fileDescriptor_5a127e22b7343957, []int{4}
+}
+func (m *PAMBlockStats) XXX_Unmarshal(b []byte) error {
+	return m.Unmarshal(b)
+}
+func (m *PAMBlockStats) XXX_Marshal(b []byte, deterministic bool) ([]byte, error) {
+	if deterministic {
+		return xxx_messageInfo_PAMBlockStats.Marshal(b, m, deterministic)
+	} else {
+		b = b[:cap(b)]
+		n, err := m.MarshalToSizedBuffer(b)
+		if err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	}
+}
+func (m *PAMBlockStats) XXX_Merge(src proto.Message) {
+	xxx_messageInfo_PAMBlockStats.Merge(m, src)
+}
+func (m *PAMBlockStats) XXX_Size() int {
+	return m.Size()
+}
+func (m *PAMBlockStats) XXX_DiscardUnknown() {
+	xxx_messageInfo_PAMBlockStats.DiscardUnknown(m)
+}
+
+var xxx_messageInfo_PAMBlockStats proto.InternalMessageInfo
+
+func (m *PAMBlockStats) GetMinMapq() uint32 {
+	if m != nil {
+		return m.MinMapq
+	}
+	return 0
+}
+
+func (m *PAMBlockStats) GetMaxMapq() uint32 {
+	if m != nil {
+		return m.MaxMapq
+	}
+	return 0
+}
+
+func (m *PAMBlockStats) GetFlagsOr() uint32 {
+	if m != nil {
+		return m.FlagsOr
+	}
+	return 0
+}
+
+func (m *PAMBlockStats) GetFlagsAnd() uint32 {
+	if m != nil {
+		return m.FlagsAnd
+	}
+	return 0
+}
+
+func (m *PAMBlockStats) GetMinTempLen() int64 {
+	if m != nil {
+		return m.MinTempLen
+	}
+	return 0
+}
+
+func (m *PAMBlockStats) GetMaxTempLen() int64 {
+	if m != nil {
+		return m.MaxTempLen
+	}
+	return 0
+}
+
 func init() {
 	proto.RegisterType((*PAMBlockHeader)(nil), "grail.proto.bio.PAMBlockHeader")
 	proto.RegisterType((*PAMBlockIndexEntry)(nil), "grail.proto.bio.PAMBlockIndexEntry")
 	proto.RegisterType((*PAMShardIndex)(nil), "grail.proto.bio.PAMShardIndex")
+	proto.RegisterMapType((map[string]string)(nil), "grail.proto.bio.PAMShardIndex.MetadataEntry")
 	proto.RegisterType((*PAMFieldIndex)(nil), "grail.proto.bio.PAMFieldIndex")
+	proto.RegisterType((*PAMBlockStats)(nil), "grail.proto.bio.PAMBlockStats")
 }
 
 func init() { proto.RegisterFile("proto/bio/pam.proto", fileDescriptor_5a127e22b7343957) }
 
 var fileDescriptor_5a127e22b7343957 = []byte{
-	// 450 bytes of a gzipped FileDescriptorProto
-	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x9c, 0x52, 0x4d, 0x6f, 0xd3, 0x40,
-	0x10, 0xcd, 0xd2, 0x38, 0xa5, 0x13, 0x4a, 0xab, 0xa5, 0x54, 0x56, 0x11, 0xae, 0x15, 0x2e, 0x3e,
-	0x80, 0x23, 0x95, 0x43, 0x0e, 0x9c, 0x12, 0x04, 0xa2, 0x87, 0xaa, 0xd5, 0x72, 0xe3, 0x62, 0xed,
-	0x7a, 0xd7, 0x8e, 0x85, 0xbd, 0x1b, 0xad, 0x1d, 0x04, 0xff, 0x82, 0x23, 0xbf, 0x80, 0xdf, 0xd2,
-	0x03, 0x87, 0x1e, 0x39, 0x21, 0x94, 0xfc, 0x11, 0xb4, 0x1f, 0x01, 0x44, 0x38, 0x20, 0x0e, 0x91,
-	0xf2, 0xde, 0xcc, 0x7b, 0xf3, 0xc6, 0xb3, 0x70, 0x6f, 0xa1, 0x55, 0xa7, 0xc6, 0xac, 0x52, 0xe3,
-	0x05, 0x6d, 0x52, 0x8b, 0xf0, 0x41, 0xa9, 0x69, 0x55, 0x3b, 0x90, 0xb2, 0x4a, 0x9d, 0x3c, 0x29,
-	0xab, 0x6e, 0xbe, 0x64, 0x69, 0xae, 0x9a, 0x71, 0xa9, 0x4a, 0x35, 0xb6, 0x25, 0xb6, 0x2c, 0x2c,
-	0x72, 0x16, 0xe6, 0x9f, 0x93, 0x9c, 0xdc, 0xff, 0x65, 0x9a, 0x2b, 0xa5, 0xb9, 0xa3, 0x47, 0xe7,
-	0x70, 0xf7, 0x6a, 0x7a, 0x31, 0xab, 0x55, 0xfe, 0xf6, 0x95, 0xa0, 0x5c, 0x68, 0x7c, 0x0c, 0x03,
-	0x55, 0x14, 0xad, 0xe8, 0xc2, 0x5b, 0x31, 0x4a, 0xf6, 0x89, 0x47, 0xf8, 0x14, 0x86, 0xac, 0x56,
-	0x2c, 0xf3, 0xc5, 0x1d, 0x5b, 0x04, 0x43, 0x5d, 0x5a, 0x66, 0xf4, 0x05, 0x01, 0xde, 0x78, 0x9d,
-	0x4b, 0x2e, 0xde, 0xbf, 0x90, 0x9d, 0xfe, 0x60, 0x74, 0x45, 0x55, 0x8b, 0x8d, 0x0e, 0xc5, 0x28,
-	0xe9, 0x13, 0x30, 0xd4, 0xe5, 0x4f, 0x63, 0xb9, 0x6c, 0x32, 0x2d, 0x72, 0xa5, 0x79, 0xbb, 0x31,
-	0x96, 0xcb, 0x86, 0x38, 0x06, 0x3f, 0x03, 0x68, 0x3b, 0xaa, 0xbb, 0x8c, 0x72, 0xae, 0xc3, 0x7e,
-	0x8c, 0x92, 0xe1, 0xd9, 0x71, 0xfa, 0xc7, 0xf7, 0x48, 0x9f, 0x9b, 0xad, 0x66, 0xfd, 0xeb, 0x6f,
-	0xa7, 0x3d, 0xb2, 0x67, 0xfb, 0xa7, 0x9c, 0x6b, 0x3c, 0x81, 0xdb, 0x42, 0x72, 0x27, 0x0d, 0xfe,
-	0x41, 0xba, 0x2b, 0x24, 0x37, 0xc2, 0xd1, 0x67, 0x04, 0xfb, 0x57, 0xd3, 0x8b, 0xd7, 0x73, 0xaa,
-	0xb9, 0x5d, 0x07, 0x1f, 0x41, 0xd0, 0xd0, 0xb2, 0xca, 0xed, 0x0e, 0x03, 0xe2, 0x00, 0x0e, 0x61,
-	0xf7, 0x9d, 0xd0, 0x6d, 0xa5, 0xa4, 0x8d, 0xbe, 0x47, 0x36, 0x10, 0x4f, 0x20, 0xd0, 0x54, 0x96,
-	0xc2, 0x47, 0x7e, 0xf0, 0xf7, 0xb9, 0xc4, 0xb4, 0xf8, 0xe1, 0xae, 0x1f, 0x3f, 0x06, 0x2c, 0x64,
-	0xae, 0xb8, 0xe0, 0x19, 0xa3, 0x4d, 0x36, 0xb7, 0x87, 0x09, 0x0f, 0x62, 0x94, 0xdc, 0x21, 0x87,
-	0xbe, 0x32, 0xa3, 0x8d, 0x3b, 0xd8, 0xe8, 0x93, 0x0b, 0xfa, 0xb2, 0x12, 0xf5, 0x7f, 0x06, 0x3d,
-	0x82, 0xa0, 0x30, 0x6a, 0x1b, 0x34, 0x20, 0x0e, 0xe0, 0x29, 0x0c, 0x98, 0xb9, 0x65, 0x1b, 0x1e,
-	0xc6, 0x3b, 0xc9, 0xf0, 0xec, 0xd1, 0x56, 0xfe, 0xed, 0x6b, 0xfb, 0x3d, 0xbc, 0x70, 0x36, 0xb9,
-	0x5e, 0x45, 0xe8, 0x66, 0x15, 0xa1, 0xef, 0xab, 0x08, 0x7d, 0x5c, 0x47, 0xbd, 0x9b, 0x75, 0xd4,
-	0xfb, 0xba, 0x8e, 0x7a, 0x6f, 0x1e, 0xfe, 0xfe, 0x7a, 0x8d, 0xad, 0x79, 0x98, 0xfe, 0xb7, 0x60,
-	0x6c, 0x60, 0x87, 0x3c, 0xfd, 0x11, 0x00, 0x00, 0xff, 0xff, 0xa3, 0x10, 0x55, 0x55, 0x0b, 0x03,
-	0x00, 0x00,
+	// 647 bytes of a gzipped FileDescriptorProto
+	0x1f, 0x8b, 0x08, 0x00, 0x00, 0x00, 0x00, 0x00, 0x02, 0xff, 0x9c, 0x54, 0xcd, 0x4e, 0xdb, 0x4c,
+	0x14, 0x8d, 0x13, 0xec, 0x90, 0x09, 0xf9, 0x40, 0xf3, 0x51, 0xe4, 0x82, 0x6a, 0xdc, 0x74, 0x93,
+	0x05, 0x4d, 0x24, 0x5a, 0x44, 0x55, 0x56, 0x49, 0xd5, 0x0a, 0xa4, 0x46, 0xa0, 0xa1, 0xab, 0x6e,
+	0xac, 0xb1, 0x67, 0x6c, 0x2c, 0x3c, 0x33, 0x66, 0xec, 0xa0, 0xb0, 0xed, 0x13, 0x74, 0xd9, 0xd7,
+	0xe9, 0x8e, 0x25, 0xcb, 0xae, 0xaa, 0x0a, 0x5e, 0xa4, 0x9a, 0x19, 0x27, 0xe9, 0x0f, 0x95, 0xaa,
+	0x2e, 0x22, 0xf9, 0xdc, 0x73, 0xce, 0xcd, 0xbd, 0xc7, 0x57, 0x06, 0xff, 0xe7, 0x52, 0x94, 0x62,
+	0x10, 0xa6, 0x62, 0x90, 0x63, 0xd6, 0xd7, 0x08, 0xae, 0x26, 0x12, 0xa7, 0x99, 0x01, 0xfd, 0x30,
+	0x15, 0x9b, 0x4f, 0x93, 0xb4, 0x3c, 0x9b, 0x84, 0xfd, 0x48, 0xb0, 0x41, 0x22, 0x12, 0x31, 0xd0,
+	0x54, 0x38, 0x89, 0x35, 0x32, 0x2d, 0xd4, 0x93, 0xb1, 0x6c, 0x3e, 0x58, 0x34, 0x8d, 0x84, 0x90,
+	0xc4, 0x94, 0xbb, 0x47, 0xe0, 0xbf, 0x93, 0xe1, 0x78, 0x94, 0x89, 0xe8, 0xfc, 0x90, 0x62, 0x42,
+	0x25, 0xdc, 0x00, 0x8e, 0x88, 0xe3, 0x82, 0x96, 0x6e, 0xdd, 0xb7, 0x7a, 0x1d, 0x54, 0x21, 0xb8,
+	0x0d, 0xda, 0x61, 0x26, 0xc2, 0xa0, 0x22, 0x1b, 0x9a, 0x04, 0xaa, 0x74, 0xac, 0x2b, 0xdd, 0x0f,
+	0x75, 0x00, 0x67, 0xbd, 0x8e, 0x38, 0xa1, 0xd3, 0xd7, 0xbc, 0x94, 0x57, 0xca, 0x17, 0xa7, 0x19,
+	0x9d, 0xf9, 0x2c, 0xdf, 0xea, 0x2d, 0x21, 0xa0, 0x4a, 0xc7, 0xf3, 0xc6, 0x7c, 0xc2, 0x02, 0x49,
+	0x23, 0x21, 0x49, 0x31, 0x6b, 0xcc, 0x27, 0x0c, 0x99, 0x0a, 0x3c, 0x00, 0xa0, 0x28, 0xb1, 0x2c,
+	0x03, 0x4c, 0x88, 0x74, 0x97, 0x7c, 0xab, 0xd7, 0xde, 0xdd, 0xe8, 0xff, 0x92, 0x47, 0xff, 0x95,
+	0xda, 0x6a, 0xb4, 0x74, 0xfd, 0x75, 0xbb, 0x86, 0x5a, 0x5a, 0x3f, 0x24, 0x44, 0xc2, 0x7d, 0xb0,
+	0x4c, 0x39, 0x31, 0x56, 0xfb, 0x2f, 0xac, 0x4d, 0xca, 0x89, 0x36, 0x3e, 0x07, 0x76, 0x51, 0xe2,
+	0xb2, 0x70, 0x1d, 0xed, 0xf2, 0x7e, 0x73, 0xcd, 0x76, 0x3d, 0x55, 0x2a, 0x64, 0xc4, 0xdd, 0x9b,
+	0x3a, 0xe8, 0x9c, 0x0c, 0xc7, 0xa7, 0x67, 0x58, 0x12, 0x1d, 0x02, 0x5c, 0x07, 0x36, 0xc3, 0x49,
+	0x1a, 0xe9, 0xcd, 0x1d, 0x64, 0x00, 0x74, 0x41, 0xf3, 0x92, 0xca, 0x22, 0x15, 0x5c, 0x2f, 0xdc,
+	0x42, 0x33, 0x08, 0xf7, 0x81, 0x2d, 0x31, 0x4f, 0x68, 0xb5, 0xe8, 0xd6, 0xfd, 0xd3, 0x22, 0x25,
+	0xa9, 0x46, 0x36, 0x7a, 0xf8, 0x18, 0xac, 0x48, 0x1a, 0x53, 0x49, 0x79, 0x44, 0x03, 0xb6, 0xe7,
+	0xda, 0x7e, 0xa3, 0xd7, 0x42, 0xed, 0x79, 0x6d, 0xbc, 0x07, 0x0f, 0xc1, 0x32, 0xa3, 0x25, 0x26,
+	0xb8, 0xc4, 0xae, 0xe3, 0x37, 0x7a, 0xed, 0xdd, 0x9d, 0xfb, 0xd6, 0x5a, 0x4c, 0xdf, 0x1f, 0x57,
+	0x72, 0xfd, 0x2e, 0xd1, 0xdc, 0x0d, 0x77, 0x00, 0xa4, 0x3c, 0x12, 0x84, 0x92, 0x20, 0xc4, 0x2c,
+	0x38, 0xd3, 0xb7, 0xe3, 0xae, 0xfa, 0x56, 0x6f, 0x05, 0xad, 0x55, 0xcc, 0x08, 0x33, 0x73, 0x53,
+	0x9b, 0x07, 0xa0, 0xf3, 0x53, 0x23, 0xb8, 0x06, 0x1a, 0xe7, 0xf4, 0x4a, 0x47, 0xd2, 0x42, 0xea,
+	0x51, 0xc5, 0x74, 0x89, 0xb3, 0x09, 0xd5, 0x57, 0xd7, 0x42, 0x06, 0xbc, 0xac, 0xbf, 0xb0, 0xba,
+	0x9f, 0x2c, 0x1d, 0xe9, 0x9b, 0x94, 0x66, 0xff, 0x18, 0xe9, 0x3a, 0xb0, 0x63, 0xe5, 0xd6, 0x91,
+	0xda, 0xc8, 0x00, 0x38, 0x04, 0x4e, 0xa8, 0xde, 0x5f, 0xe1, 0xae, 0xe9, 0x28, 0x9e, 0xfc, 0xf1,
+	0x0d, 0x2f, 0xae, 0xb9, 0x4a, 0xbc, 0x32, 0x76, 0x3f, 0x9b, 0xd1, 0x16, 0x67, 0x00, 0x1f, 0x82,
+	0x65, 0x96, 0xf2, 0x80, 0xe1, 0xfc, 0x42, 0x4f, 0xd7, 0x41, 0x4d, 0x96, 0xf2, 0x31, 0xce, 0x2f,
+	0x34, 0x85, 0xa7, 0x86, 0xaa, 0x57, 0x14, 0x9e, 0xce, 0xa8, 0x38, 0xc3, 0x49, 0x11, 0x08, 0x59,
+	0xdd, 0x7f, 0x53, 0xe3, 0x63, 0x09, 0xb7, 0x40, 0xcb, 0x50, 0x98, 0x9b, 0xf9, 0x3b, 0xc8, 0x68,
+	0x87, 0x9c, 0x40, 0x1f, 0xac, 0xa8, 0x7f, 0x2b, 0x29, 0xcb, 0x83, 0x8c, 0x72, 0x7d, 0xe0, 0x0d,
+	0x04, 0x58, 0xca, 0xdf, 0x51, 0x96, 0xbf, 0xa5, 0x5c, 0x2b, 0xf0, 0x74, 0xa1, 0x70, 0x2a, 0x05,
+	0x9e, 0x56, 0x8a, 0xd1, 0xfe, 0xf5, 0xad, 0x67, 0xdd, 0xdc, 0x7a, 0xd6, 0xb7, 0x5b, 0xcf, 0xfa,
+	0x78, 0xe7, 0xd5, 0x6e, 0xee, 0xbc, 0xda, 0x97, 0x3b, 0xaf, 0xf6, 0xfe, 0xd1, 0x8f, 0x5f, 0x18,
+	0x15, 0x8d, 0xfa, 0x78, 0x54, 0xbf, 0x3c, 0x0c, 0x1d, 0x1d, 0xd4, 0xb3, 0xef, 0x03, 0x00, 0x74,
+	0xcd, 0x2e, 0xdd, 0xaf, 0x04, 0x00, 0x00,
 }
 
 func (m *PAMBlockHeader) Marshal() (dAtA []byte, err error) {
@@ -375,6 +497,18 @@ func (m *PAMBlockIndexEntry) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 	_ = i
 	var l int
 	_ = l
+	if m.Stats != nil {
+		{
+			size, err := m.Stats.MarshalToSizedBuffer(dAtA[:i])
+			if err != nil {
+				return 0, err
+			}
+			i -= size
+			i = encodeVarintPam(dAtA, i, uint64(size))
+		}
+		i--
+		dAtA[i] = 0x32
+	}
 	{
 		size, err := m.EndAddr.MarshalToSizedBuffer(dAtA[:i])
 		if err != nil {
@@ -435,6 +569,34 @@ func (m *PAMShardIndex) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 		i--
 		dAtA[i] = 0x7a
 	}
+	if len(m.Metadata) > 0 {
+		for k := range m.Metadata {
+			v := m.Metadata[k]
+			baseI := i
+			i -= len(v)
+			copy(dAtA[i:], v)
+			i = encodeVarintPam(dAtA, i, uint64(len(v)))
+			i--
+			dAtA[i] = 0x12
+			i -= len(k)
+			copy(dAtA[i:], k)
+			i = encodeVarintPam(dAtA, i, uint64(len(k)))
+			i--
+			dAtA[i] = 0xa
+			i = encodeVarintPam(dAtA, i, uint64(baseI-i))
+			i--
+			dAtA[i] = 0x32
+		}
+	}
+	if len(m.ReferenceM5) > 0 {
+		for iNdEx := len(m.ReferenceM5) - 1; iNdEx >= 0; iNdEx-- {
+			i -= len(m.ReferenceM5[iNdEx])
+			copy(dAtA[i:], m.ReferenceM5[iNdEx])
+			i = encodeVarintPam(dAtA, i, uint64(len(m.ReferenceM5[iNdEx])))
+			i--
+			dAtA[i] = 0x2a
+		}
+	}
 	{
 		size, err := m.Range.MarshalToSizedBuffer(dAtA[:i])
 		if err != nil {
@@ -518,6 +680,59 @@ func (m *PAMFieldIndex) MarshalToSizedBuffer(dAtA []byte) (int, error) {
 	return len(dAtA) - i, nil
 }
 
+func (m *PAMBlockStats) Marshal() (dAtA []byte, err error) {
+	size := m.Size()
+	dAtA = make([]byte, size)
+	n, err := m.MarshalToSizedBuffer(dAtA[:size])
+	if err != nil {
+		return nil, err
+	}
+	return dAtA[:n], nil
+}
+
+func (m *PAMBlockStats) MarshalTo(dAtA []byte) (int, error) {
+	size := m.Size()
+	return m.MarshalToSizedBuffer(dAtA[:size])
+}
+
+func (m *PAMBlockStats) MarshalToSizedBuffer(dAtA []byte) (int, error) {
+	i := len(dAtA)
+	_ = i
+	var l int
+	_ = l
+	if m.MaxTempLen != 0 {
+		i = encodeVarintPam(dAtA, i, uint64(m.MaxTempLen))
+		i--
+		dAtA[i] = 0x30
+	}
+	if m.MinTempLen != 0 {
+		i = encodeVarintPam(dAtA, i, uint64(m.MinTempLen))
+		i--
+		dAtA[i] = 0x28
+	}
+	if m.FlagsAnd != 0 {
+		i = encodeVarintPam(dAtA, i, uint64(m.FlagsAnd))
+		i--
+		dAtA[i] = 0x20
+	}
+	if m.FlagsOr != 0 {
+		i = encodeVarintPam(dAtA, i, uint64(m.FlagsOr))
+		i--
+		dAtA[i] = 0x18
+	}
+	if m.MaxMapq != 0 {
+		i = encodeVarintPam(dAtA, i, uint64(m.MaxMapq))
+		i--
+		dAtA[i] = 0x10
+	}
+	if m.MinMapq != 0 {
+		i = encodeVarintPam(dAtA, i, uint64(m.MinMapq))
+		i--
+		dAtA[i] = 0x8
+	}
+	return len(dAtA) - i, nil
+}
+
 func encodeVarintPam(dAtA []byte, offset int, v uint64) int {
 	offset -= sovPam(v)
 	base := offset
@@ -560,6 +775,10 @@ func (m *PAMBlockIndexEntry) Size() (n int) {
 	n += 1 + l + sovPam(uint64(l))
 	l = m.EndAddr.Size()
 	n += 1 + l + sovPam(uint64(l))
+	if m.Stats != nil {
+		l = m.Stats.Size()
+		n += 1 + l + sovPam(uint64(l))
+	}
 	return n
 }
 
@@ -578,6 +797,20 @@ func (m *PAMShardIndex) Size() (n int) {
 	}
 	l = m.Range.Size()
 	n += 1 + l + sovPam(uint64(l))
+	if len(m.ReferenceM5) > 0 {
+		for _, s := range m.ReferenceM5 {
+			l = len(s)
+			n += 1 + l + sovPam(uint64(l))
+		}
+	}
+	if len(m.Metadata) > 0 {
+		for k, v := range m.Metadata {
+			_ = k
+			_ = v
+			mapEntrySize := 1 + len(k) + sovPam(uint64(len(k))) + 1 + len(v) + sovPam(uint64(len(v)))
+			n += mapEntrySize + 1 + sovPam(uint64(mapEntrySize))
+		}
+	}
 	l = len(m.EncodedBamHeader)
 	if l > 0 {
 		n += 1 + l + sovPam(uint64(l))
@@ -610,6 +843,33 @@ func (m *PAMFieldIndex) Size() (n int) {
 	return n
 }
 
+func (m *PAMBlockStats) Size() (n int) {
+	if m == nil {
+		return 0
+	}
+	var l int
+	_ = l
+	if m.MinMapq != 0 {
+		n += 1 + sovPam(uint64(m.MinMapq))
+	}
+	if m.MaxMapq != 0 {
+		n += 1 + sovPam(uint64(m.MaxMapq))
+	}
+	if m.FlagsOr != 0 {
+		n += 1 + sovPam(uint64(m.FlagsOr))
+	}
+	if m.FlagsAnd != 0 {
+		n += 1 + sovPam(uint64(m.FlagsAnd))
+	}
+	if m.MinTempLen != 0 {
+		n += 1 + sovPam(uint64(m.MinTempLen))
+	}
+	if m.MaxTempLen != 0 {
+		n += 1 + sovPam(uint64(m.MaxTempLen))
+	}
+	return n
+}
+
 func sovPam(x uint64) (n int) {
 	return (math_bits.Len64(x|1) + 6) / 7
 }
@@ -840,6 +1100,42 @@ func (m *PAMBlockIndexEntry) Unmarshal(dAtA []byte) error {
 				return err
 			}
 			iNdEx = postIndex
+		case 6:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Stats", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowPam
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLengthPam
+			}
+			postIndex := iNdEx + msglen
+			if postIndex < 0 {
+				return ErrInvalidLengthPam
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			if m.Stats == nil {
+				m.Stats = &PAMBlockStats{}
+			}
+			if err := m.Stats.Unmarshal(dAtA[iNdEx:postIndex]); err != nil {
+				return err
+			}
+			iNdEx = postIndex
 		default:
 			iNdEx = preIndex
 			skippy, err := skipPam(dAtA[iNdEx:])
@@ -968,6 +1264,165 @@ func (m *PAMShardIndex) Unmarshal(dAtA []byte) error {
 				return err
 			}
 			iNdEx = postIndex
+		case 5:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field ReferenceM5", wireType)
+			}
+			var stringLen uint64
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowPam
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				stringLen |= uint64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			intStringLen := int(stringLen)
+			if intStringLen < 0 {
+				return ErrInvalidLengthPam
+			}
+			postIndex := iNdEx + intStringLen
+			if postIndex < 0 {
+				return ErrInvalidLengthPam
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			m.ReferenceM5 = append(m.ReferenceM5, string(dAtA[iNdEx:postIndex]))
+			iNdEx = postIndex
+		case 6:
+			if wireType != 2 {
+				return fmt.Errorf("proto: wrong wireType = %d for field Metadata", wireType)
+			}
+			var msglen int
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowPam
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				msglen |= int(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+			if msglen < 0 {
+				return ErrInvalidLengthPam
+			}
+			postIndex := iNdEx + msglen
+			if postIndex < 0 {
+				return ErrInvalidLengthPam
+			}
+			if postIndex > l {
+				return io.ErrUnexpectedEOF
+			}
+			if m.Metadata == nil {
+				m.Metadata = make(map[string]string)
+			}
+			var mapkey string
+			var mapvalue string
+			for iNdEx < postIndex {
+				entryPreIndex := iNdEx
+				var wire uint64
+				for shift := uint(0); ; shift += 7 {
+					if shift >= 64 {
+						return ErrIntOverflowPam
+					}
+					if iNdEx >= l {
+						return io.ErrUnexpectedEOF
+					}
+					b := dAtA[iNdEx]
+					iNdEx++
+					wire |= uint64(b&0x7F) << shift
+					if b < 0x80 {
+						break
+					}
+				}
+				fieldNum := int32(wire >> 3)
+				if fieldNum == 1 {
+					var stringLenmapkey uint64
+					for shift := uint(0); ; shift += 7 {
+						if shift >= 64 {
+							return ErrIntOverflowPam
+						}
+						if iNdEx >= l {
+							return io.ErrUnexpectedEOF
+						}
+						b := dAtA[iNdEx]
+						iNdEx++
+						stringLenmapkey |= uint64(b&0x7F) << shift
+						if b < 0x80 {
+							break
+						}
+					}
+					intStringLenmapkey := int(stringLenmapkey)
+					if intStringLenmapkey < 0 {
+						return ErrInvalidLengthPam
+					}
+					postStringIndexmapkey := iNdEx + intStringLenmapkey
+					if postStringIndexmapkey < 0 {
+						return ErrInvalidLengthPam
+					}
+					if postStringIndexmapkey > l {
+						return io.ErrUnexpectedEOF
+					}
+					mapkey = string(dAtA[iNdEx:postStringIndexmapkey])
+					iNdEx = postStringIndexmapkey
+				} else if fieldNum == 2 {
+					var stringLenmapvalue uint64
+					for shift := uint(0); ; shift += 7 {
+						if shift >= 64 {
+							return ErrIntOverflowPam
+						}
+						if iNdEx >= l {
+							return io.ErrUnexpectedEOF
+						}
+						b := dAtA[iNdEx]
+						iNdEx++
+						stringLenmapvalue |= uint64(b&0x7F) << shift
+						if b < 0x80 {
+							break
+						}
+					}
+					intStringLenmapvalue := int(stringLenmapvalue)
+					if intStringLenmapvalue < 0 {
+						return ErrInvalidLengthPam
+					}
+					postStringIndexmapvalue := iNdEx + intStringLenmapvalue
+					if postStringIndexmapvalue < 0 {
+						return ErrInvalidLengthPam
+					}
+					if postStringIndexmapvalue > l {
+						return io.ErrUnexpectedEOF
+					}
+					mapvalue = string(dAtA[iNdEx:postStringIndexmapvalue])
+					iNdEx = postStringIndexmapvalue
+				} else {
+					iNdEx = entryPreIndex
+					skippy, err := skipPam(dAtA[iNdEx:])
+					if err != nil {
+						return err
+					}
+					if skippy < 0 {
+						return ErrInvalidLengthPam
+					}
+					if (iNdEx + skippy) > postIndex {
+						return io.ErrUnexpectedEOF
+					}
+					iNdEx += skippy
+				}
+			}
+			m.Metadata[mapkey] = mapvalue
+			iNdEx = postIndex
 		case 15:
 			if wireType != 2 {
 				return fmt.Errorf("proto: wrong wireType = %d for field EncodedBamHeader", wireType)
@@ -1174,6 +1629,173 @@ func (m *PAMFieldIndex) Unmarshal(dAtA []byte) error {
 	}
 	return nil
 }
+func (m *PAMBlockStats) Unmarshal(dAtA []byte) error {
+	l := len(dAtA)
+	iNdEx := 0
+	for iNdEx < l {
+		preIndex := iNdEx
+		var wire uint64
+		for shift := uint(0); ; shift += 7 {
+			if shift >= 64 {
+				return ErrIntOverflowPam
+			}
+			if iNdEx >= l {
+				return io.ErrUnexpectedEOF
+			}
+			b := dAtA[iNdEx]
+			iNdEx++
+			wire |= uint64(b&0x7F) << shift
+			if b < 0x80 {
+				break
+			}
+		}
+		fieldNum := int32(wire >> 3)
+		wireType := int(wire & 0x7)
+		if wireType == 4 {
+			return fmt.Errorf("proto: PAMBlockStats: wiretype end group for non-group")
+		}
+		if fieldNum <= 0 {
+			return fmt.Errorf("proto: PAMBlockStats: illegal tag %d (wire type %d)", fieldNum, wire)
+		}
+		switch fieldNum {
+		case 1:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field MinMapq", wireType)
+			}
+			m.MinMapq = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowPam
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.MinMapq |= uint32(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 2:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field MaxMapq", wireType)
+			}
+			m.MaxMapq = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowPam
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.MaxMapq |= uint32(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 3:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field FlagsOr", wireType)
+			}
+			m.FlagsOr = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowPam
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.FlagsOr |= uint32(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 4:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field FlagsAnd", wireType)
+			}
+			m.FlagsAnd = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowPam
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.FlagsAnd |= uint32(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 5:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field MinTempLen", wireType)
+			}
+			m.MinTempLen = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowPam
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.MinTempLen |= int64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		case 6:
+			if wireType != 0 {
+				return fmt.Errorf("proto: wrong wireType = %d for field MaxTempLen", wireType)
+			}
+			m.MaxTempLen = 0
+			for shift := uint(0); ; shift += 7 {
+				if shift >= 64 {
+					return ErrIntOverflowPam
+				}
+				if iNdEx >= l {
+					return io.ErrUnexpectedEOF
+				}
+				b := dAtA[iNdEx]
+				iNdEx++
+				m.MaxTempLen |= int64(b&0x7F) << shift
+				if b < 0x80 {
+					break
+				}
+			}
+		default:
+			iNdEx = preIndex
+			skippy, err := skipPam(dAtA[iNdEx:])
+			if err != nil {
+				return err
+			}
+			if skippy < 0 {
+				return ErrInvalidLengthPam
+			}
+			if (iNdEx + skippy) < 0 {
+				return ErrInvalidLengthPam
+			}
+			if (iNdEx + skippy) > l {
+				return io.ErrUnexpectedEOF
+			}
+			iNdEx += skippy
+		}
+	}
+
+	if iNdEx > l {
+		return io.ErrUnexpectedEOF
+	}
+	return nil
+}
 func skipPam(dAtA []byte) (n int, err error) {
 	l := len(dAtA)
 	iNdEx := 0
@@ -0,0 +1,41 @@
+// Copyright 2018 GRAIL, Inc.  All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package biosimd
+
+// ByteLookupTable is the full-byte analogue of NibbleLookupTable: it maps each
+// byte value to a replacement value.  It is typically used to remap base
+// quality scores, which don't fit in a nibble.
+type ByteLookupTable [256]byte
+
+// MakeIdentityByteLookupTable returns a ByteLookupTable that maps each byte to
+// itself.  Callers usually start with it and overwrite the entries to be
+// remapped.
+func MakeIdentityByteLookupTable() (t ByteLookupTable) {
+	for i := range t {
+		t[i] = byte(i)
+	}
+	return
+}
+
+// ByteLookupInplace replaces each main[pos] with table[main[pos]].
+func ByteLookupInplace(main []byte, tablePtr *ByteLookupTable) {
+	// Process eight bytes per iteration; since the table has exactly 256
+	// entries, the lookups don't need bounds checks.
+	n := len(main) &^ 7
+	for pos := 0; pos < n; pos += 8 {
+		s := main[pos : pos+8 : pos+8]
+		s[0] = tablePtr[s[0]]
+		s[1] = tablePtr[s[1]]
+		s[2] = tablePtr[s[2]]
+		s[3] = tablePtr[s[3]]
+		s[4] = tablePtr[s[4]]
+		s[5] = tablePtr[s[5]]
+		s[6] = tablePtr[s[6]]
+		s[7] = tablePtr[s[7]]
+	}
+	for pos := n; pos < len(main); pos++ {
+		main[pos] = tablePtr[main[pos]]
+	}
+}
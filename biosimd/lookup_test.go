@@ -0,0 +1,34 @@
+// Copyright 2018 GRAIL, Inc.  All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package biosimd_test
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/Schaudge/grailbio/biosimd"
+)
+
+func TestByteLookupInplace(t *testing.T) {
+	table := biosimd.MakeIdentityByteLookupTable()
+	for i := range table {
+		table[i] = byte(i / 10 * 10)
+	}
+	for iter := 0; iter < 100; iter++ {
+		n := rand.Intn(100)
+		main := make([]byte, n)
+		rand.Read(main)
+		expected := make([]byte, n)
+		for i, b := range main {
+			expected[i] = b / 10 * 10
+		}
+		biosimd.ByteLookupInplace(main, &table)
+		for i := range main {
+			if main[i] != expected[i] {
+				t.Fatalf("n=%d, pos %d: got %d, want %d", n, i, main[i], expected[i])
+			}
+		}
+	}
+}
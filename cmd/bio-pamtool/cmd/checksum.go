@@ -13,12 +13,15 @@ import (
 	"github.com/Schaudge/grailbase/unsafe"
 	gbam "github.com/Schaudge/grailbio/encoding/bam"
 	"github.com/Schaudge/grailbio/encoding/bamprovider"
+	"github.com/Schaudge/grailbio/encoding/fasta"
 	"github.com/Schaudge/hts/sam"
 )
 
 type checksumOpts struct {
 	// baiPath sets the name of the BAM index file. If empty, bampath+".bai" is used.
 	baiPath string
+	// referencePath is the reference FASTA file used to decode CRAM files.
+	referencePath string
 
 	// all treats all the following bool fields to be true.  If all=true, then the
 	// individual values of the following fields are ignored.
@@ -202,9 +205,9 @@ func checksumBAMShard(opts checksumOpts, ch chan gbam.Shard, provider bamprovide
 	return csum
 }
 
-func checksumFile(bamPath string, opts checksumOpts) fileChecksum {
+func checksumFile(bamPath string, reference fasta.Fasta, opts checksumOpts) fileChecksum {
 	var csum fileChecksum
-	bopts := bamprovider.ProviderOpts{Index: opts.baiPath}
+	bopts := bamprovider.ProviderOpts{Index: opts.baiPath, Reference: reference}
 	if !opts.all && !opts.name {
 		bopts.DropFields = append(bopts.DropFields, gbam.FieldName)
 	}
@@ -256,7 +259,11 @@ func checksumFile(bamPath string, opts checksumOpts) fileChecksum {
 }
 
 func checksum(path string, opts checksumOpts) error {
-	csum := checksumFile(path, opts)
+	reference, err := loadReference(opts.referencePath)
+	if err != nil {
+		return err
+	}
+	csum := checksumFile(path, reference, opts)
 	if csum.err.Err() != nil {
 		return csum.err.Err()
 	}
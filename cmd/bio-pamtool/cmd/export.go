@@ -0,0 +1,38 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+
+	"github.com/Schaudge/grailbase/errors"
+	"github.com/Schaudge/grailbase/file"
+	"github.com/Schaudge/grailbase/vcontext"
+	"github.com/Schaudge/grailbio/encoding/pam/pamarrow"
+)
+
+// exportArrow writes the records of the PAM file at srcPath to destPath as an
+// Arrow IPC stream. If destPath is "-", the stream is written to stdout.
+func exportArrow(opts pamarrow.ExportOpts, srcPath, destPath string, stdout io.Writer) error {
+	if destPath == "-" {
+		w := bufio.NewWriterSize(stdout, 1<<20)
+		if err := pamarrow.Export(opts, w, srcPath); err != nil {
+			return err
+		}
+		return w.Flush()
+	}
+	ctx := vcontext.Background()
+	out, err := file.Create(ctx, destPath)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriterSize(out.Writer(ctx), 1<<20)
+	e := errors.Once{}
+	e.Set(pamarrow.Export(opts, w, srcPath))
+	e.Set(w.Flush())
+	if e.Err() != nil {
+		out.Discard(ctx)
+		return fmt.Errorf("export %s: %v", destPath, e.Err())
+	}
+	return out.Close(ctx)
+}
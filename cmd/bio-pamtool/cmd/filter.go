@@ -16,6 +16,8 @@ import (
 	"regexp"
 	"strconv"
 
+	"github.com/Schaudge/grailbio/biopb"
+	gbam "github.com/Schaudge/grailbio/encoding/bam"
 	"github.com/Schaudge/hts/sam"
 )
 
@@ -500,3 +502,146 @@ func evaluateFilterExpr(expr *filterExpr, rec *sam.Record) bool {
 	doassert(val.vtype == valueTypeBool, val)
 	return val.boolValue
 }
+
+// flagBits maps a flag predicate node to the sam.Flags bit it tests.
+var flagBits = map[nodeType]sam.Flags{
+	nodePaired:        sam.Paired,
+	nodeProperPair:    sam.ProperPair,
+	nodeUnmapped:      sam.Unmapped,
+	nodeMateUnmapped:  sam.MateUnmapped,
+	nodeReverse:       sam.Reverse,
+	nodeMateReverse:   sam.MateReverse,
+	nodeRead1:         sam.Read1,
+	nodeRead2:         sam.Read2,
+	nodeSecondary:     sam.Secondary,
+	nodeQCFail:        sam.QCFail,
+	nodeDuplicate:     sam.Duplicate,
+	nodeSupplementary: sam.Supplementary,
+}
+
+// statsRange returns the range of values of an int field over the records
+// summarized by the stats. It returns false if the stats don't track the field.
+func (expr *filterExpr) statsRange(stats *biopb.PAMBlockStats) (int64, int64, bool) {
+	switch expr.ntype {
+	case nodeIntConst:
+		return expr.intConst, expr.intConst, true
+	case nodeMapq:
+		return int64(stats.MinMapq), int64(stats.MaxMapq), true
+	case nodeTempLen:
+		return stats.MinTempLen, stats.MaxTempLen, true
+	}
+	return 0, 0, false
+}
+
+// evaluateStats computes whether the expression can be true, and whether it
+// can be false, for some record summarized by the stats. The answers are
+// conservative: both are true when the stats cannot tell.
+func (expr *filterExpr) evaluateStats(stats *biopb.PAMBlockStats) (canBeTrue, canBeFalse bool) {
+	if bit, ok := flagBits[expr.ntype]; ok {
+		return uint32(bit)&stats.FlagsOr != 0, uint32(bit)&stats.FlagsAnd == 0
+	}
+	switch expr.ntype {
+	case nodeNOT:
+		t, f := expr.x.evaluateStats(stats)
+		return f, t
+	case nodeLAND:
+		xt, xf := expr.x.evaluateStats(stats)
+		yt, yf := expr.y.evaluateStats(stats)
+		return xt && yt, xf || yf
+	case nodeLOR:
+		xt, xf := expr.x.evaluateStats(stats)
+		yt, yf := expr.y.evaluateStats(stats)
+		return xt || yt, xf && yf
+	case nodeGEQ, nodeLEQ, nodeLSS, nodeGTR, nodeEQL, nodeNEQ:
+		if expr.x.vtype != valueTypeInt {
+			break
+		}
+		xMin, xMax, xOk := expr.x.statsRange(stats)
+		yMin, yMax, yOk := expr.y.statsRange(stats)
+		if !xOk || !yOk {
+			break
+		}
+		switch expr.ntype {
+		case nodeGEQ:
+			return xMax >= yMin, xMin < yMax
+		case nodeLEQ:
+			return xMin <= yMax, xMax > yMin
+		case nodeLSS:
+			return xMin < yMax, xMax >= yMin
+		case nodeGTR:
+			return xMax > yMin, xMin <= yMax
+		case nodeEQL, nodeNEQ:
+			overlap := xMin <= yMax && yMin <= xMax
+			allEqual := xMin == xMax && yMin == yMax && xMin == yMin
+			if expr.ntype == nodeEQL {
+				return overlap, !allEqual
+			}
+			return !allEqual, overlap
+		}
+	}
+	return true, true
+}
+
+// blockFilter creates a function for pam.ReadOpts.BlockFilter. The function
+// rejects a block only if no record in the block can match the expression. It
+// returns nil if expr is nil.
+func blockFilter(expr *filterExpr) func(*biopb.PAMBlockStats) bool {
+	if expr == nil {
+		return nil
+	}
+	return func(stats *biopb.PAMBlockStats) bool {
+		canBeTrue, _ := expr.evaluateStats(stats)
+		return canBeTrue
+	}
+}
+
+// fields returns the list of PAM fields read by the expression.
+func (expr *filterExpr) fields() []gbam.FieldType {
+	var fields []gbam.FieldType
+	var walk func(e *filterExpr)
+	walk = func(e *filterExpr) {
+		if e == nil {
+			return
+		}
+		if _, ok := flagBits[e.ntype]; ok {
+			fields = append(fields, gbam.FieldFlags)
+		}
+		switch e.ntype {
+		case nodeRecName:
+			fields = append(fields, gbam.FieldName)
+		case nodeSeqLength:
+			fields = append(fields, gbam.FieldSeq)
+		case nodeMateRefName, nodeMateRefID:
+			fields = append(fields, gbam.FieldMateRefID)
+		case nodeMatePos:
+			fields = append(fields, gbam.FieldMatePos)
+		case nodeMapq:
+			fields = append(fields, gbam.FieldMapq)
+		case nodeTempLen:
+			fields = append(fields, gbam.FieldTempLen)
+		case nodeChimeric:
+			fields = append(fields, gbam.FieldFlags, gbam.FieldMateRefID)
+		}
+		walk(e.x)
+		walk(e.y)
+	}
+	walk(expr)
+	return fields
+}
+
+// recordFilter creates a function for bamprovider.ProviderOpts.Filter. It
+// returns nil if expr is nil, or if expr reads a field that is not decoded
+// before the PAM reader calls the filter.
+func recordFilter(expr *filterExpr) func(*sam.Record) bool {
+	if expr == nil {
+		return nil
+	}
+	for _, f := range expr.fields() {
+		switch f {
+		case gbam.FieldFlags, gbam.FieldMapq, gbam.FieldMateRefID, gbam.FieldMatePos, gbam.FieldTempLen:
+		default:
+			return nil
+		}
+	}
+	return func(r *sam.Record) bool { return evaluateFilterExpr(expr, r) }
+}
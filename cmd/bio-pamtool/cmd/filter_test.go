@@ -3,6 +3,8 @@ package cmd
 import (
 	"testing"
 
+	"github.com/Schaudge/grailbio/biopb"
+	gbam "github.com/Schaudge/grailbio/encoding/bam"
 	"github.com/Schaudge/hts/sam"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -63,3 +65,61 @@ func TestParser(t *testing.T) {
 	assert.True(t, eval(t, "proper_pair && first_of_pair", rec))
 	assert.False(t, eval(t, "proper_pair && second_of_pair", rec))
 }
+
+func TestBlockFilter(t *testing.T) {
+	mayMatch := func(str string, stats biopb.PAMBlockStats) bool {
+		node, err := parseFilterExpr(str)
+		require.NoError(t, err)
+		return blockFilter(node)(&stats)
+	}
+	// A block whose records have mapq in [20,40], are all paired, and some of
+	// which are duplicates.
+	stats := biopb.PAMBlockStats{
+		MinMapq:    20,
+		MaxMapq:    40,
+		FlagsOr:    uint32(sam.Paired | sam.Duplicate | sam.Read1 | sam.Read2),
+		FlagsAnd:   uint32(sam.Paired),
+		MinTempLen: -300,
+		MaxTempLen: 300,
+	}
+	assert.True(t, mayMatch("mapping_quality >= 40", stats))
+	assert.False(t, mayMatch("mapping_quality >= 41", stats))
+	assert.False(t, mayMatch("60 <= mapping_quality", stats))
+	assert.True(t, mayMatch("mapping_quality < 21", stats))
+	assert.False(t, mayMatch("mapping_quality < 20", stats))
+	assert.False(t, mayMatch("mapping_quality == 10", stats))
+	assert.True(t, mayMatch("mapping_quality != 20", stats))
+	assert.True(t, mayMatch("template_length > 250", stats))
+	assert.False(t, mayMatch("template_length > 300", stats))
+
+	assert.True(t, mayMatch("paired", stats))
+	assert.False(t, mayMatch("!paired", stats))
+	assert.True(t, mayMatch("duplicate", stats))
+	assert.True(t, mayMatch("!duplicate", stats))
+	assert.False(t, mayMatch("secondary_alignment", stats))
+	assert.False(t, mayMatch("mapping_quality >= 60 && !duplicate", stats))
+	assert.True(t, mayMatch("mapping_quality >= 60 || !duplicate", stats))
+	assert.False(t, mayMatch("!(paired || mapping_quality > 60)", stats))
+
+	// Expressions on fields not tracked by the stats never reject a block.
+	assert.True(t, mayMatch("position > 1000000", stats))
+	assert.True(t, mayMatch("re(rec_name, \"foo\") && paired", stats))
+	assert.True(t, mayMatch("!chimeric", stats))
+
+	// All the records are duplicates with mapq 60.
+	stats = biopb.PAMBlockStats{
+		MinMapq:  60,
+		MaxMapq:  60,
+		FlagsOr:  uint32(sam.Duplicate),
+		FlagsAnd: uint32(sam.Duplicate),
+	}
+	assert.False(t, mayMatch("mapping_quality >= 60 && !duplicate", stats))
+	assert.False(t, mayMatch("mapping_quality != 60", stats))
+	assert.True(t, mayMatch("mapping_quality == 60", stats))
+}
+
+func TestFilterFields(t *testing.T) {
+	node, err := parseFilterExpr("mapping_quality >= 60 && !duplicate && re(rec_name, \"x\")")
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []gbam.FieldType{gbam.FieldMapq, gbam.FieldFlags, gbam.FieldName}, node.fields())
+}
@@ -87,18 +87,48 @@ func percent(a int, b int) string {
 	return fmt.Sprintf("%.2f%%", float64(a)*100/float64(b))
 }
 
-func flagstat(path, index string) error {
+// flagstatDropFields lists the fields not needed to compute the stats.
+var flagstatDropFields = []gbam.FieldType{
+	gbam.FieldCigar,
+	gbam.FieldMatePos,
+	gbam.FieldTempLen,
+	gbam.FieldName,
+	gbam.FieldSeq,
+	gbam.FieldQual,
+	gbam.FieldAux,
+}
+
+// flagstat computes the stats of the records in path. If filterStr is nonempty,
+// only the records matching the filter expression are counted.
+func flagstat(path, index, referencePath, filterStr string) error {
+	reference, err := loadReference(referencePath)
+	if err != nil {
+		return err
+	}
+	var filter *filterExpr
+	dropFields := flagstatDropFields
+	if filterStr != "" {
+		if filter, err = parseFilterExpr(filterStr); err != nil {
+			return err
+		}
+		needed := map[gbam.FieldType]bool{}
+		for _, f := range filter.fields() {
+			needed[f] = true
+		}
+		dropFields = nil
+		for _, f := range flagstatDropFields {
+			if !needed[f] {
+				dropFields = append(dropFields, f)
+			}
+		}
+	}
 	provider := bamprovider.NewProvider(path, bamprovider.ProviderOpts{
-		Index: index,
-		DropFields: []gbam.FieldType{
-			gbam.FieldCigar,
-			gbam.FieldMatePos,
-			gbam.FieldTempLen,
-			gbam.FieldName,
-			gbam.FieldSeq,
-			gbam.FieldQual,
-			gbam.FieldAux,
-		}})
+		Index:       index,
+		Reference:   reference,
+		DropFields:  dropFields,
+		BlockFilter: blockFilter(filter),
+		Filter:      recordFilter(filter),
+	})
 	shards, err := provider.GenerateShards(bamprovider.GenerateShardsOpts{
 		IncludeUnmapped:     true,
 		SplitMappedCoords:   true,
@@ -118,6 +148,10 @@ func flagstat(path, index string) error {
 				iter := provider.NewIterator(shard)
 				for iter.Scan() {
 					rec := iter.Record()
+					if filter != nil && !evaluateFilterExpr(filter, rec) {
+						sam.PutInFreePool(rec)
+						continue
+					}
 					stat := &qcStats
 					if (rec.Flags & sam.QCFail) != 0 {
 						stat = &failedStats
@@ -1,14 +1,19 @@
 package cmd
 
 import (
+	"flag"
 	"fmt"
 	"log"
 	"strings"
 
 	"github.com/Schaudge/grailbase/cmdutil"
+	gbam "github.com/Schaudge/grailbio/encoding/bam"
 	"github.com/Schaudge/grailbio/encoding/bamprovider"
 	"github.com/Schaudge/grailbio/encoding/converter"
+	"github.com/Schaudge/grailbio/encoding/fasta"
 	"github.com/Schaudge/grailbio/encoding/pam"
+	"github.com/Schaudge/grailbio/encoding/pam/pamarrow"
+	"github.com/Schaudge/hts/sam"
 	"v.io/x/lib/cmdline"
 )
 
@@ -34,7 +39,8 @@ The second format specifies the (chromosome, position, sequence) range as a
 when multiple reads are aligned at the same (chromosome, position).  For
 example, 'chr1:123:0-chr3:456:10'. An empty 'chr' part means unmapped reads,
 e.g., ':0:1000-:0:2000' will show 1000th to 2000th (0-based) unmapped reads.`),
-		filter: cmd.Flags.String("filter", "", filterHelp),
+		filter:    cmd.Flags.String("filter", "", filterHelp),
+		reference: cmd.Flags.String("reference", "", referenceHelp),
 	}
 	cmd.Runner = cmdutil.RunnerFunc(func(env *cmdline.Env, argv []string) error {
 		if len(argv) != 1 {
@@ -52,19 +58,55 @@ func newCmdFlagstat() *cmdline.Command {
 		ArgsName: "path",
 	}
 	bamIndex := cmd.Flags.String("index", "", "Input BAM index filename. By default set to input bampath + .bai")
+	reference := cmd.Flags.String("reference", "", referenceHelp)
+	filter := cmd.Flags.String("filter", "", "Count only the records matching the expression. "+filterHelp)
 	cmd.Runner = cmdutil.RunnerFunc(func(env *cmdline.Env, argv []string) error {
 		if len(argv) != 1 {
 			return fmt.Errorf("flagstat takes one pathname argument, but got %v", argv)
 		}
-		return flagstat(argv[0], *bamIndex)
+		return flagstat(argv[0], *bamIndex, *reference, *filter)
 	})
 	return cmd
 }
 
+// newQualBinning creates the quality binning specified by the convert flags. It
+// returns nil if no binning is requested.
+func newQualBinning(bins string, dropBelowMapq int) (*gbam.QualBinning, error) {
+	if bins == "" && dropBelowMapq <= 0 {
+		return nil, nil
+	}
+	b := &gbam.QualBinning{DropBelowMapq: dropBelowMapq}
+	if bins != "" {
+		qualBins, err := gbam.ParseQualBins(bins)
+		if err != nil {
+			return nil, err
+		}
+		if b.Table, err = gbam.NewQualBinTable(qualBins); err != nil {
+			return nil, err
+		}
+	}
+	return b, nil
+}
+
+// parseAuxTags parses the value of the -promote-aux-tags flag.
+func parseAuxTags(value string) ([]sam.Tag, error) {
+	if value == "" {
+		return nil, nil
+	}
+	var tags []sam.Tag
+	for _, name := range strings.Split(value, ",") {
+		if len(name) != 2 {
+			return nil, fmt.Errorf("invalid aux tag \"%s\" in -promote-aux-tags", name)
+		}
+		tags = append(tags, sam.NewTag(name))
+	}
+	return tags, nil
+}
+
 func newCmdConvert() *cmdline.Command {
 	cmd := &cmdline.Command{
 		Name:     "convert",
-		Short:    "Convert between BAM and PAM",
+		Short:    "Convert between BAM and PAM, or from SAM or CRAM to BAM or PAM",
 		ArgsName: "srcpath destpath",
 	}
 	baiFlag := cmd.Flags.String("index", "", "Input BAM index filename. By default, set to input bampath + .bai")
@@ -73,15 +115,40 @@ func newCmdConvert() *cmdline.Command {
 	formatFlag := cmd.Flags.String("format", "", `
 Output file format. Value is either \"bam\" or \"pam\".
 If empty, the format is guessed from the input file
-(if the input is bam, output is pam and vice versa).`)
+(if the input is bam, sam or cram, output is pam; if the input is pam, output is bam).`)
+	referenceFlag := cmd.Flags.String("reference", "", referenceHelp)
 	transformersFlag := cmd.Flags.String("transformers", "", `Comma-separated list of transformers to apply during PAM generation.
 For example, "-transform=zstd 20".`)
+	refSeqFlag := cmd.Flags.Bool("reference-seq", false, `Store the seq field of the PAM output as differences from -reference.
+The same reference must be passed to read the seq field.`)
+	qualBinsFlag := cmd.Flags.String("qual-bins", "", `Bin the base qualities of the output. The value is either "illumina8", for
+Illumina's 8-level binning, or a comma-separated list of "min-max:value", e.g.,
+"2-19:10,20-93:30". Qualities outside the bins are unchanged.`)
+	dropQualFlag := cmd.Flags.Int("drop-qual-below-mapq", 0, `If > 0, drop the base qualities of the records whose mapq is below
+the value.`)
+	auxTagsFlag := cmd.Flags.String("promote-aux-tags", "", `Comma-separated list of aux tags to store in their own PAM columns.
+For example, "-promote-aux-tags=RG,MI".`)
+	unsortedFlag := cmd.Flags.Bool("unsorted", false, `Store the records of the PAM output in the order of the input, which then
+need not be sorted by coordinate, e.g., aligner output. The input must be a
+SAM or BAM file, and it need not be indexed. Such a PAM file has one shard,
+and it can only be read sequentially.`)
+	checksumFlag := cmd.Flags.Bool("checksum-inputs", true, `Record the SHA-256 of the source and the reference files in the metadata of
+the PAM output. It requires reading the files once more; pass -checksum-inputs=false to skip it.`)
 	cmd.Runner = cmdutil.RunnerFunc(func(env *cmdline.Env, argv []string) error {
 		if len(argv) != 2 {
 			return fmt.Errorf("convert takes srcpath destpath, but found %v", argv)
 		}
 		srcPath := argv[0]
 		destPath := argv[1]
+		reference, err := loadReference(*referenceFlag)
+		if err != nil {
+			return err
+		}
+		providerOpts := bamprovider.ProviderOpts{Index: *baiFlag, Reference: reference}
+		qualBinning, err := newQualBinning(*qualBinsFlag, *dropQualFlag)
+		if err != nil {
+			return err
+		}
 		destFormat := bamprovider.Unknown
 		if *formatFlag != "" {
 			destFormat = bamprovider.ParseFileType(*formatFlag)
@@ -90,7 +157,7 @@ For example, "-transform=zstd 20".`)
 			}
 		} else {
 			switch bamprovider.GuessFileType(srcPath) {
-			case bamprovider.BAM:
+			case bamprovider.BAM, bamprovider.SAM, bamprovider.CRAM:
 				destFormat = bamprovider.PAM
 			case bamprovider.PAM:
 				destFormat = bamprovider.BAM
@@ -102,13 +169,39 @@ For example, "-transform=zstd 20".`)
 			if *transformersFlag != "" {
 				transformers = strings.Split(*transformersFlag, ",")
 			}
-			return converter.ConvertToPAM(pam.WriteOpts{
+			opts := pam.WriteOpts{
 				MaxBufSize:   *bytesPerBlockFlag,
 				Transformers: transformers,
-			}, destPath, srcPath, *baiFlag, *bytesPerShardFlag)
+				QualBinning:  qualBinning,
+				Unsorted:     *unsortedFlag,
+			}
+			if *refSeqFlag {
+				if reference == nil {
+					return fmt.Errorf("-reference-seq requires -reference")
+				}
+				opts.Reference = reference
+			}
+			if opts.PromotedAuxTags, err = parseAuxTags(*auxTagsFlag); err != nil {
+				return err
+			}
+			if opts.Metadata, err = provenance("convert", []string{srcPath}, *referenceFlag, *checksumFlag); err != nil {
+				return err
+			}
+			if opts.Unsorted {
+				return converter.ConvertUnsortedToPAM(opts, destPath, srcPath)
+			}
+			if srcType := bamprovider.GuessFileType(srcPath); srcType == bamprovider.SAM || srcType == bamprovider.CRAM {
+				p := bamprovider.NewProvider(srcPath, providerOpts)
+				err := converter.ConvertProviderToPAM(opts, destPath, p)
+				if e := p.Close(); e != nil && err == nil {
+					err = e
+				}
+				return err
+			}
+			return converter.ConvertToPAM(opts, destPath, srcPath, *baiFlag, *bytesPerShardFlag)
 		case bamprovider.BAM:
-			p := bamprovider.NewProvider(srcPath, bamprovider.ProviderOpts{Index: *baiFlag})
-			err := converter.ConvertToBAM(destPath, p)
+			p := bamprovider.NewProvider(srcPath, providerOpts)
+			err := converter.ConvertToBinnedBAM(destPath, p, qualBinning)
 			if e := p.Close(); e != nil && err == nil {
 				err = e
 			}
@@ -121,6 +214,211 @@ For example, "-transform=zstd 20".`)
 	return cmd
 }
 
+// pamWriteFlags are the flags that define the encoding of the PAM files
+// written by merge and reshard.
+type pamWriteFlags struct {
+	bytesPerBlock *int
+	transformers  *string
+	refSeq        *bool
+	auxTags       *string
+}
+
+func newPAMWriteFlags(flags *flag.FlagSet) pamWriteFlags {
+	return pamWriteFlags{
+		bytesPerBlock: flags.Int("bytes-per-block", 8<<20, "A goal size of a PAM recordio block"),
+		transformers: flags.String("transformers", "", `Comma-separated list of transformers to apply during PAM generation.
+For example, "-transform=zstd 20".`),
+		refSeq: flags.Bool("reference-seq", false, `Store the seq field of the output as differences from -reference.
+The same reference must be passed to read the seq field.`),
+		auxTags: flags.String("promote-aux-tags", "", `Comma-separated list of aux tags to store in their own PAM columns.
+For example, "-promote-aux-tags=RG,MI".`),
+	}
+}
+
+// writeOpts returns the pam.WriteOpts defined by the flags. Arg reference is
+// the genome loaded from the -reference flag.
+func (f pamWriteFlags) writeOpts(reference fasta.Fasta) (pam.WriteOpts, error) {
+	opts := pam.WriteOpts{MaxBufSize: *f.bytesPerBlock}
+	if *f.transformers != "" {
+		opts.Transformers = strings.Split(*f.transformers, ",")
+	}
+	if *f.refSeq {
+		if reference == nil {
+			return opts, fmt.Errorf("-reference-seq requires -reference")
+		}
+		opts.Reference = reference
+	}
+	var err error
+	opts.PromotedAuxTags, err = parseAuxTags(*f.auxTags)
+	return opts, err
+}
+
+func newCmdMerge() *cmdline.Command {
+	cmd := &cmdline.Command{
+		Name:  "merge",
+		Short: "Merge PAM files into one",
+		Long: `
+Merge combines the source PAM files into a new PAM file. The headers are
+unified, and reference IDs are remapped as needed. If the sources use the same
+references and their records do not overlap, the shard files are copied (or
+hard-linked) without re-encoding. Otherwise, the records are merged by
+coordinate, and the flags below define the encoding of the output.`,
+		ArgsName: "srcpath... destpath",
+	}
+	referenceFlag := cmd.Flags.String("reference", "", referenceHelp)
+	writeFlags := newPAMWriteFlags(&cmd.Flags)
+	cmd.Runner = cmdutil.RunnerFunc(func(env *cmdline.Env, argv []string) error {
+		if len(argv) < 2 {
+			return fmt.Errorf("merge takes srcpath... destpath, but found %v", argv)
+		}
+		srcPaths, destPath := argv[:len(argv)-1], argv[len(argv)-1]
+		reference, err := loadReference(*referenceFlag)
+		if err != nil {
+			return err
+		}
+		opts := pam.MergeOpts{Reference: reference}
+		if opts.WriteOpts, err = writeFlags.writeOpts(reference); err != nil {
+			return err
+		}
+		if opts.WriteOpts.Metadata, err = provenance("merge", srcPaths, *referenceFlag, false); err != nil {
+			return err
+		}
+		return pam.Merge(opts, destPath, srcPaths)
+	})
+	return cmd
+}
+
+func newCmdReshard() *cmdline.Command {
+	cmd := &cmdline.Command{
+		Name:  "reshard",
+		Short: "Rewrite a PAM file into shards of even sizes",
+		Long: `
+Reshard rewrites the source PAM file into a new set of shards, each of which
+is roughly -bytes-per-shard bytes or -records-per-shard records. The flags
+below can also change the encoding of the output.`,
+		ArgsName: "srcpath destpath",
+	}
+	referenceFlag := cmd.Flags.String("reference", "", referenceHelp)
+	bytesPerShardFlag := cmd.Flags.Int64("bytes-per-shard", 4<<30, "A goal size of a PAM file shard, in terms of the input size")
+	recordsPerShardFlag := cmd.Flags.Int64("records-per-shard", 0, `A goal number of records in a PAM file shard.
+If both -bytes-per-shard and -records-per-shard are positive, a shard is closed when either goal is reached.`)
+	dropFieldsFlag := cmd.Flags.String("drop-fields", "", `Comma-separated list of fields not to write to the output.
+For example, "-drop-fields=qual,aux".`)
+	writeFlags := newPAMWriteFlags(&cmd.Flags)
+	cmd.Runner = cmdutil.RunnerFunc(func(env *cmdline.Env, argv []string) error {
+		if len(argv) != 2 {
+			return fmt.Errorf("reshard takes srcpath destpath, but found %v", argv)
+		}
+		reference, err := loadReference(*referenceFlag)
+		if err != nil {
+			return err
+		}
+		opts := pam.ReshardOpts{
+			Reference:       reference,
+			BytesPerShard:   *bytesPerShardFlag,
+			RecordsPerShard: *recordsPerShardFlag,
+		}
+		if opts.WriteOpts, err = writeFlags.writeOpts(reference); err != nil {
+			return err
+		}
+		if opts.WriteOpts.Metadata, err = provenance("reshard", argv[:1], *referenceFlag, false); err != nil {
+			return err
+		}
+		if opts.WriteOpts.DropFields, err = parseFieldTypes(*dropFieldsFlag); err != nil {
+			return err
+		}
+		return pam.Reshard(opts, argv[1], argv[0])
+	})
+	return cmd
+}
+
+// parseFieldTypes parses a comma-separated list of PAM field names, e.g.,
+// "qual,aux".
+func parseFieldTypes(value string) ([]gbam.FieldType, error) {
+	if value == "" {
+		return nil, nil
+	}
+	var fields []gbam.FieldType
+	for _, name := range strings.Split(value, ",") {
+		f, err := gbam.ParseFieldType(name)
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
+
+func newCmdExport() *cmdline.Command {
+	cmd := &cmdline.Command{
+		Name:  "export",
+		Short: "Export a PAM file for dataframe libraries",
+		Long: `
+Export writes the records of the source PAM file to destpath, or to stdout if
+destpath is "-". The only -format is "arrow", an Apache Arrow IPC stream with
+one column per PAM field, which pyarrow, polars etc. can read without parsing
+SAM text. The coord field is split into the refid and pos columns. The aux
+tags promoted to their own PAM columns, and those listed in -aux-tags, are
+stored in their own columns named "aux.XX"; the other aux tags are stored
+BAM-encoded in the aux column. The SAM header and the PAM metadata are stored
+in the metadata of the schema.`,
+		ArgsName: "srcpath destpath",
+	}
+	formatFlag := cmd.Flags.String("format", "arrow", "Output format. The only supported value is \"arrow\".")
+	referenceFlag := cmd.Flags.String("reference", "", referenceHelp)
+	auxTagsFlag := cmd.Flags.String("aux-tags", "", `Comma-separated list of aux tags to store in their own columns, in addition
+to the aux tags promoted in the PAM file. For example, "-aux-tags=NM,MD".`)
+	dropFieldsFlag := cmd.Flags.String("drop-fields", "", `Comma-separated list of fields not to export. A promoted aux tag
+is named "aux.<tag>". For example, "-drop-fields=qual,aux,aux.RG".`)
+	batchSizeFlag := cmd.Flags.Int("batch-size", pamarrow.DefaultBatchSize, "Number of records per Arrow record batch")
+	cmd.Runner = cmdutil.RunnerFunc(func(env *cmdline.Env, argv []string) error {
+		if len(argv) != 2 {
+			return fmt.Errorf("export takes srcpath destpath, but found %v", argv)
+		}
+		if *formatFlag != "arrow" {
+			return fmt.Errorf("unknown export format \"%s\"", *formatFlag)
+		}
+		reference, err := loadReference(*referenceFlag)
+		if err != nil {
+			return err
+		}
+		opts := pamarrow.ExportOpts{Reference: reference}
+		opts.BatchSize = *batchSizeFlag
+		if opts.AuxTags, err = parseAuxTags(*auxTagsFlag); err != nil {
+			return err
+		}
+		if opts.DropFields, err = parseFieldTypes(*dropFieldsFlag); err != nil {
+			return err
+		}
+		return exportArrow(opts, argv[0], argv[1], env.Stdout)
+	})
+	return cmd
+}
+
+func newCmdVerify() *cmdline.Command {
+	cmd := &cmdline.Command{
+		Name:  "verify",
+		Short: "Check the integrity of a PAM file",
+		Long: `
+Verify checks that every shard has all its field files, that the field files
+store the same number of records as the coord field and span the same
+coordinates, that every recordio block can be read and uncompressed, that the
+coordinates are sorted and inside the shard range, and that the shard ranges
+cover the universal range without a gap or an overlap. The number of blocks
+may differ between fields, since each field is flushed by its own size.
+
+Each problem found is printed on its own line.`,
+		ArgsName: "path",
+	}
+	cmd.Runner = cmdutil.RunnerFunc(func(env *cmdline.Env, argv []string) error {
+		if len(argv) != 1 {
+			return fmt.Errorf("verify takes one pathname argument, but got %v", argv)
+		}
+		return verify(argv[0], env.Stdout)
+	})
+	return cmd
+}
+
 func newCmdChecksum() *cmdline.Command {
 	cmd := &cmdline.Command{
 		Name: "checksum",
@@ -130,6 +428,7 @@ The checksum is a JSON string describing the summary of various attributes of th
 	}
 	opts := checksumOpts{}
 	cmd.Flags.StringVar(&opts.baiPath, "index", "", "Input BAM index filename. By default, set to input BAM filename + .bai")
+	cmd.Flags.StringVar(&opts.referencePath, "reference", "", referenceHelp)
 	cmd.Flags.BoolVar(&opts.name, "name", false, "Checksum the name field")
 	cmd.Flags.BoolVar(&opts.tempLen, "templen", false, "Checksum the templen field")
 	cmd.Flags.BoolVar(&opts.seq, "seq", false, "Checksum the seq field")
@@ -162,6 +461,10 @@ func Run() {
 				newCmdFlagstat(),
 				newCmdView(),
 				newCmdChecksum(),
+				newCmdMerge(),
+				newCmdReshard(),
+				newCmdVerify(),
+				newCmdExport(),
 			},
 		})
 }
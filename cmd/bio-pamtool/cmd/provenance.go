@@ -0,0 +1,108 @@
+package cmd
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/Schaudge/grailbase/file"
+	"github.com/Schaudge/grailbase/vcontext"
+	"github.com/Schaudge/grailbio/encoding/pam"
+	"github.com/Schaudge/grailbio/encoding/pam/pamutil"
+)
+
+// toolVersion returns the version of the bio-pamtool binary, as recorded by
+// the go toolchain.
+func toolVersion() string {
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+		return info.Main.Version
+	}
+	return "unknown"
+}
+
+// fileSHA256 computes the hex-encoded SHA-256 of the file at path.
+func fileSHA256(path string) (string, error) {
+	ctx := vcontext.Background()
+	in, err := file.Open(ctx, path)
+	if err != nil {
+		return "", err
+	}
+	h := sha256.New()
+	_, err = io.Copy(h, in.Reader(ctx))
+	if e := in.Close(ctx); e != nil && err == nil {
+		err = e
+	}
+	return hex.EncodeToString(h.Sum(nil)), err
+}
+
+// provenance returns the metadata recorded in the PAM files created by the
+// given subcommand from the given sources. If checksum is true, the SHA-256 of
+// the source and the reference are also recorded; it requires reading the
+// files once more. Arg sources and reference may be empty.
+func provenance(subcmd string, sources []string, reference string, checksum bool) (map[string]string, error) {
+	md := map[string]string{
+		pam.MetadataCreator:      "bio-pamtool " + subcmd + " " + toolVersion(),
+		pam.MetadataCreationTime: time.Now().UTC().Format(time.RFC3339),
+	}
+	if len(sources) > 0 {
+		md[pam.MetadataSource] = strings.Join(sources, ",")
+	}
+	if reference != "" {
+		md[pam.MetadataReference] = reference
+	}
+	if !checksum {
+		return md, nil
+	}
+	if len(sources) == 1 {
+		sum, err := fileSHA256(sources[0])
+		if err != nil {
+			return nil, err
+		}
+		md[pam.MetadataSourceSHA256] = sum
+	}
+	if reference != "" {
+		sum, err := fileSHA256(reference)
+		if err != nil {
+			return nil, err
+		}
+		md[pam.MetadataReferenceSHA256] = sum
+	}
+	return md, nil
+}
+
+// readPAMMetadata reads the metadata stored in the first shard of the PAM file
+// at path.
+func readPAMMetadata(path string) (map[string]string, error) {
+	ctx := vcontext.Background()
+	indexes, err := pamutil.ListIndexes(ctx, path)
+	if err != nil || len(indexes) == 0 {
+		return nil, err
+	}
+	index, err := pamutil.ReadShardIndex(ctx, path, indexes[0].Range)
+	return index.Metadata, err
+}
+
+// metadataEscaper escapes the characters that cannot appear in a SAM header
+// line.
+var metadataEscaper = strings.NewReplacer(`\`, `\\`, "\t", `\t`, "\n", `\n`, "\r", `\r`)
+
+// printMetadata prints the metadata in the "@CO" lines of a SAM header, one
+// line per key, sorted by key. Backslashes, tabs and newlines in the keys and
+// values are escaped as in Go string literals.
+func printMetadata(out io.Writer, md map[string]string) error {
+	keys := make([]string, 0, len(md))
+	for k := range md {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if _, err := io.WriteString(out, "@CO\tPAM:"+metadataEscaper.Replace(k)+"="+metadataEscaper.Replace(md[k])+"\n"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,17 @@
+package cmd
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPrintMetadata(t *testing.T) {
+	var buf bytes.Buffer
+	assert.NoError(t, printMetadata(&buf, map[string]string{
+		"source": "a.bam",
+		"note":   "line1\nline2\tcol2 C:\\dir",
+	}))
+	assert.Equal(t, "@CO\tPAM:note=line1\\nline2\\tcol2 C:\\\\dir\n@CO\tPAM:source=a.bam\n", buf.String())
+}
@@ -0,0 +1,33 @@
+package cmd
+
+import (
+	"github.com/Schaudge/grailbase/file"
+	"github.com/Schaudge/grailbase/vcontext"
+	"github.com/Schaudge/grailbio/encoding/fasta"
+)
+
+const referenceHelp = `Reference FASTA file used to decode CRAM input, and PAM input whose seq field
+is stored as differences from the reference. It is ignored for other input
+formats. If path + ".fai" exists, it is used to speed up loading.`
+
+// loadReference reads the reference FASTA file. It returns nil if path is
+// empty.
+func loadReference(path string) (fasta.Fasta, error) {
+	if path == "" {
+		return nil, nil
+	}
+	ctx := vcontext.Background()
+	var opts []fasta.Opt
+	if index, err := file.ReadFile(ctx, path+".fai"); err == nil {
+		opts = append(opts, fasta.OptIndex(index))
+	}
+	in, err := file.Open(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	fa, err := fasta.New(in.Reader(ctx), opts...)
+	if e := in.Close(ctx); e != nil && err == nil {
+		err = e
+	}
+	return fa, err
+}
@@ -0,0 +1,312 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/Schaudge/grailbase/errors"
+	"github.com/Schaudge/grailbase/file"
+	"github.com/Schaudge/grailbase/traverse"
+	"github.com/Schaudge/grailbase/vcontext"
+	"github.com/Schaudge/grailbio/biopb"
+	gbam "github.com/Schaudge/grailbio/encoding/bam"
+	"github.com/Schaudge/grailbio/encoding/pam/fieldio"
+	"github.com/Schaudge/grailbio/encoding/pam/pamutil"
+)
+
+// shardVerifyResult is the result of verifying one PAM shard.
+type shardVerifyResult struct {
+	problems []string
+	nRecords int64
+}
+
+func (r *shardVerifyResult) addProblem(format string, args ...interface{}) {
+	r.problems = append(r.problems, fmt.Sprintf(format, args...))
+}
+
+// checkShardTiling checks that the shard ranges cover the universal range
+// without a gap or an overlap. The shards must be sorted by range start.
+func checkShardTiling(dir string, shards []pamutil.FileInfo) []string {
+	var problems []string
+	prevLimit := gbam.UniversalRange.Start
+	for _, shard := range shards {
+		switch cmp := shard.Range.Start.Compare(prevLimit); {
+		case cmp > 0:
+			problems = append(problems, fmt.Sprintf("%s: gap in shard ranges: no shard covers [%s, %s)", dir,
+				pamutil.CoordPathString(prevLimit), pamutil.CoordPathString(shard.Range.Start)))
+		case cmp < 0:
+			problems = append(problems, fmt.Sprintf("%s: shard %s overlaps the previous shard, whose limit is %s", dir,
+				pamutil.CoordRangePathString(shard.Range), pamutil.CoordPathString(prevLimit)))
+		}
+		if prevLimit.LT(shard.Range.Limit) {
+			prevLimit = shard.Range.Limit
+		}
+	}
+	if prevLimit.LT(gbam.UniversalRange.Limit) {
+		problems = append(problems, fmt.Sprintf("%s: gap in shard ranges: no shard covers [%s, %s)", dir,
+			pamutil.CoordPathString(prevLimit), pamutil.CoordPathString(gbam.UniversalRange.Limit)))
+	}
+	return problems
+}
+
+// verifyCoords decodes the coordinates stored in the coord field file, and
+// checks that they are sorted and inside the shard range. It returns the number
+// of records.
+func verifyCoords(fr *fieldio.Reader, shardRange biopb.CoordRange, result *shardVerifyResult) (n int64) {
+	defer func() {
+		if e := recover(); e != nil {
+			result.addProblem("%s: decode coordinate of record %d: %v", fr.Label(), n, e)
+		}
+	}()
+	if _, ok := fr.Seek(gbam.UniversalRange); !ok {
+		return 0
+	}
+	var (
+		prev                biopb.Coord
+		nUnsorted, nOutside int
+	)
+	for {
+		coord, ok := fr.ReadCoordField()
+		if !ok {
+			break
+		}
+		if n > 0 && coord.LT(prev) {
+			if nUnsorted == 0 {
+				result.addProblem("%s: record %d at %+v is before the previous record at %+v", fr.Label(), n, coord, prev)
+			}
+			nUnsorted++
+		}
+		if !shardRange.Contains(coord) {
+			if nOutside == 0 {
+				result.addProblem("%s: record %d at %+v is outside the shard range %s", fr.Label(), n, coord,
+					pamutil.CoordRangePathString(shardRange))
+			}
+			nOutside++
+		}
+		prev = coord
+		n++
+	}
+	if nUnsorted > 1 {
+		result.addProblem("%s: %d records in total are out of order", fr.Label(), nUnsorted)
+	}
+	if nOutside > 1 {
+		result.addProblem("%s: %d records in total are outside the shard range", fr.Label(), nOutside)
+	}
+	return n
+}
+
+// fieldVerifier reads one field file.
+type fieldVerifier struct {
+	*fieldio.Reader
+	err errors.Once
+	// failed is set if a problem has already been reported for a block read
+	// error, which is also recorded in err.
+	failed bool
+}
+
+// close closes the reader, and records the errors reported by the reader.
+func (f *fieldVerifier) close(ctx context.Context, result *shardVerifyResult) {
+	f.Close(ctx)
+	if err := f.err.Err(); err != nil && !f.failed {
+		result.addProblem("%s: %v", f.Label(), err)
+	}
+}
+
+// verifyField checks the blocks of one field file. It returns nil if the file
+// cannot be opened. The caller must close the returned object.
+func verifyField(ctx context.Context, shard pamutil.FileInfo, field string, result *shardVerifyResult, opts ...fieldio.ReaderOpt) *fieldVerifier {
+	path := pamutil.FieldDataPath(shard.Dir, shard.Range, field)
+	f := &fieldVerifier{}
+	fr, err := fieldio.NewReader(ctx, path, path, field == gbam.FieldCoord.String(), file.Opts{}, &f.err, opts...)
+	if err != nil || fr == nil {
+		if fr != nil {
+			fr.Close(ctx)
+		}
+		result.addProblem("%s: cannot open: %v", path, err)
+		return nil
+	}
+	f.Reader = fr
+	index := fr.Index()
+	for i, block := range index.Blocks {
+		if block.NumRecords == 0 {
+			result.addProblem("%s: block %d is empty", path, i)
+		}
+		if block.EndAddr.LT(block.StartAddr) {
+			result.addProblem("%s: block %d ends at %+v, before its start %+v", path, i, block.EndAddr, block.StartAddr)
+		}
+		if i > 0 && block.StartAddr.LE(index.Blocks[i-1].EndAddr) {
+			result.addProblem("%s: block %d starts at %+v, before the end of the previous block %+v",
+				path, i, block.StartAddr, index.Blocks[i-1].EndAddr)
+		}
+	}
+	if err := fr.CheckBlocks(); err != nil {
+		result.addProblem("%v", err)
+		f.failed = true
+	}
+	return f
+}
+
+// fieldRecords returns the total number of records in the blocks, and the
+// closed range of their coordinates.
+func fieldRecords(index biopb.PAMFieldIndex) (n int64, start, end biopb.Coord) {
+	for _, block := range index.Blocks {
+		n += int64(block.NumRecords)
+	}
+	if len(index.Blocks) > 0 {
+		start = index.Blocks[0].StartAddr
+		end = index.Blocks[len(index.Blocks)-1].EndAddr
+	}
+	return
+}
+
+// verifyShard checks one shard. Arg fields lists the fields expected in every
+// shard, and present lists the field files found for this shard.
+func verifyShard(ctx context.Context, shard pamutil.FileInfo, fields []string, present map[string]bool) (result shardVerifyResult) {
+	index, err := pamutil.ReadShardIndex(ctx, shard.Dir, shard.Range)
+	if err != nil {
+		result.addProblem("%s: %v", shard.Path, err)
+		return
+	}
+	if !index.Range.EQ(shard.Range) {
+		result.addProblem("%s: range %s stored in the index differs from the filename", shard.Path,
+			pamutil.CoordRangePathString(index.Range))
+	}
+	features, err := pamutil.ParseShardVersion(index.Version)
+	if err != nil {
+		result.addProblem("%s: %v", shard.Path, err)
+		return
+	}
+	var coordOpts []fieldio.ReaderOpt
+	if features.Unsorted {
+		// The coord reader returns the ordinals of the records, which are
+		// checked like the coordinates of a sorted shard.
+		coordOpts = append(coordOpts, fieldio.Unsorted())
+		if !shard.Range.EQ(gbam.UniversalRange) {
+			result.addProblem("%s: the records are not sorted by coordinate, but the shard range is not universal", shard.Path)
+		}
+	}
+	if _, err := gbam.UnmarshalHeader(index.EncodedBamHeader); err != nil {
+		result.addProblem("%s: decode sam.Header: %v", shard.Path, err)
+	}
+	expected := map[string]bool{}
+	for _, field := range fields {
+		expected[field] = true
+	}
+	for _, tag := range features.AuxTags {
+		expected[gbam.AuxTagField(tag).String()] = true
+	}
+	var names []string
+	for field := range expected {
+		if !present[field] {
+			result.addProblem("%s: missing field file", pamutil.FieldDataPath(shard.Dir, shard.Range, field))
+			continue
+		}
+		if field != gbam.FieldCoord.String() {
+			names = append(names, field)
+		}
+	}
+	sort.Strings(names)
+	if !present[gbam.FieldCoord.String()] {
+		return
+	}
+
+	coordReader := verifyField(ctx, shard, gbam.FieldCoord.String(), &result, coordOpts...)
+	if coordReader == nil {
+		return
+	}
+	nCoords, coordStart, coordEnd := fieldRecords(coordReader.Index())
+	for _, field := range names {
+		fr := verifyField(ctx, shard, field, &result)
+		if fr == nil {
+			continue
+		}
+		n, start, end := fieldRecords(fr.Index())
+		if n != nCoords {
+			result.addProblem("%s: %d records, but the coord field has %d records",
+				pamutil.FieldDataPath(shard.Dir, shard.Range, field), n, nCoords)
+		} else if n > 0 && (!start.EQ(coordStart) || !end.EQ(coordEnd)) {
+			result.addProblem("%s: records span [%+v, %+v], but those of the coord field span [%+v, %+v]",
+				pamutil.FieldDataPath(shard.Dir, shard.Range, field), start, end, coordStart, coordEnd)
+		}
+		fr.close(ctx, &result)
+	}
+	result.nRecords = verifyCoords(coordReader.Reader, shard.Range, &result)
+	if result.nRecords != nCoords {
+		result.addProblem("%s: decoded %d records, but the index lists %d records",
+			coordReader.Label(), result.nRecords, nCoords)
+	}
+	coordReader.close(ctx, &result)
+	return
+}
+
+// verify checks the integrity of the PAM file at path. The problems found are
+// printed to out, and an error is returned if there is any.
+func verify(path string, out io.Writer) error {
+	ctx := vcontext.Background()
+	shards, err := pamutil.ListIndexes(ctx, path)
+	if err != nil {
+		return err
+	}
+	if len(shards) == 0 {
+		return fmt.Errorf("verify %s: no shard index found", path)
+	}
+	problems := checkShardTiling(path, shards)
+
+	// present[range][field] is true if the field file exists for the range.
+	present := map[string]map[string]bool{}
+	fieldSet := map[string]bool{gbam.FieldCoord.String(): true}
+	lister := file.List(ctx, path, false)
+	for lister.Scan() {
+		fi, err := pamutil.ParsePath(lister.Path())
+		if err != nil || fi.Type != pamutil.FileTypeFieldData {
+			continue
+		}
+		key := pamutil.CoordRangePathString(fi.Range)
+		if present[key] == nil {
+			present[key] = map[string]bool{}
+		}
+		present[key][fi.Field] = true
+		fieldSet[fi.Field] = true
+	}
+	if err := lister.Err(); err != nil {
+		return err
+	}
+	shardKeys := map[string]bool{}
+	for _, shard := range shards {
+		shardKeys[pamutil.CoordRangePathString(shard.Range)] = true
+	}
+	var orphans []string
+	for key := range present {
+		if !shardKeys[key] {
+			orphans = append(orphans, fmt.Sprintf("%s/%s.*: field files without a shard index", path, key))
+		}
+	}
+	sort.Strings(orphans)
+	problems = append(problems, orphans...)
+
+	// Fields that exist in any shard are expected in every shard.
+	var fields []string
+	for field := range fieldSet {
+		fields = append(fields, field)
+	}
+	results := make([]shardVerifyResult, len(shards))
+	_ = traverse.Each(len(shards), func(i int) error {
+		results[i] = verifyShard(ctx, shards[i], fields, present[pamutil.CoordRangePathString(shards[i].Range)])
+		return nil
+	})
+	var nRecords int64
+	for _, r := range results {
+		problems = append(problems, r.problems...)
+		nRecords += r.nRecords
+	}
+	for _, p := range problems {
+		fmt.Fprintln(out, p)
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("verify %s: found %d problems", path, len(problems))
+	}
+	fmt.Fprintf(out, "%s: OK, %d shards, %d records\n", path, len(shards), nRecords)
+	return nil
+}
@@ -0,0 +1,64 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Schaudge/grailbio/biopb"
+	gbam "github.com/Schaudge/grailbio/encoding/bam"
+	"github.com/Schaudge/grailbio/encoding/pam"
+	"github.com/Schaudge/hts/sam"
+	"github.com/grailbio/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// writeVerifyTestPAM writes a PAM file with two shards, split at position 5000.
+func writeVerifyTestPAM(t *testing.T, dir string) {
+	chr1, err := sam.NewReference("chr1", "", "", 100000, nil, nil)
+	require.NoError(t, err)
+	header, err := sam.NewHeader(nil, []*sam.Reference{chr1})
+	require.NoError(t, err)
+	split := biopb.Coord{RefId: 0, Pos: 5000}
+	for _, rng := range []biopb.CoordRange{
+		{Start: gbam.UniversalRange.Start, Limit: split},
+		{Start: split, Limit: gbam.UniversalRange.Limit},
+	} {
+		w := pam.NewWriter(pam.WriteOpts{MaxBufSize: 1024, Range: rng}, header, dir)
+		for i := 0; i < 1000; i++ {
+			if !rng.Contains(biopb.Coord{RefId: 0, Pos: int32(i * 10)}) {
+				continue
+			}
+			rec, err := sam.NewRecord(fmt.Sprintf("read%d", i), chr1, chr1, i*10, i*10+100, 100, 60,
+				[]sam.CigarOp{sam.NewCigarOp(sam.CigarMatch, 4)},
+				[]byte("ACGT"), []byte{30, 31, 32, 33}, nil)
+			require.NoError(t, err)
+			w.Write(rec)
+		}
+		require.NoError(t, w.Close())
+	}
+}
+
+func TestVerifyPAM(t *testing.T) {
+	tmpDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	dir := filepath.Join(tmpDir, "test.pam")
+	writeVerifyTestPAM(t, dir)
+
+	out := bytes.Buffer{}
+	require.NoError(t, verify(dir, &out))
+	assert.Contains(t, out.String(), "OK, 2 shards, 1000 records")
+
+	// Remove a field file of the first shard, and the index of the second
+	// shard.
+	require.NoError(t, os.Remove(filepath.Join(dir, "0:0,0:5000.name")))
+	require.NoError(t, os.Remove(filepath.Join(dir, "0:5000,-:-.index")))
+	out.Reset()
+	require.Error(t, verify(dir, &out))
+	assert.Contains(t, out.String(), "0:0,0:5000.name: missing field file")
+	assert.Contains(t, out.String(), "gap in shard ranges")
+	assert.Contains(t, out.String(), "0:5000,-:-.*: field files without a shard index")
+}
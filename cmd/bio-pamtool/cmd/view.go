@@ -2,6 +2,7 @@ package cmd
 
 import (
 	"fmt"
+	"os"
 	"regexp"
 	"runtime"
 	"strconv"
@@ -210,6 +211,7 @@ type viewFlags struct {
 	headerOnly *bool
 	regions    *string
 	filter     *string
+	reference  *string
 }
 
 // TODO(saito) Currently this function only dumps the index info.  Add feature
@@ -231,7 +233,16 @@ func view(flags viewFlags, path string) error {
 			return err
 		}
 	}
-	provider := bamprovider.NewProvider(path, bamprovider.ProviderOpts{Index: *flags.bamIndex})
+	reference, err := loadReference(*flags.reference)
+	if err != nil {
+		return err
+	}
+	provider := bamprovider.NewProvider(path, bamprovider.ProviderOpts{
+		Index:       *flags.bamIndex,
+		Reference:   reference,
+		BlockFilter: blockFilter(filter),
+		Filter:      recordFilter(filter),
+	})
 	if *flags.headerOnly || *flags.withHeader {
 		header, err := provider.GetHeader()
 		if err != nil {
@@ -242,6 +253,15 @@ func view(flags viewFlags, path string) error {
 			return err
 		}
 		fmt.Print(string(h))
+		if bamprovider.GuessFileType(path) == bamprovider.PAM {
+			md, err := readPAMMetadata(path)
+			if err != nil {
+				return err
+			}
+			if err := printMetadata(os.Stdout, md); err != nil {
+				return err
+			}
+		}
 		if *flags.headerOnly {
 			return nil
 		}
@@ -13,15 +13,32 @@
 // limitations under the License.
 
 /*
-Given a BAM or PAM, and a BED file describing genomic positions of interest,
-bio-pileup reports the number of reads supporting each allele at each position.
+Given a BAM, PAM, SAM or CRAM, and a BED file describing genomic positions of
+interest, bio-pileup reports the number of reads supporting each allele at each position.
 This command is similar to "bcftools mpileup".
 
 There are options for "collapsing" the two ends of a read-pair together, or
 entire duplicate-sets ("bags") identified by doppelmark.
 
-Only SNPs are currently reported, but indel support is very likely to be added
-in the future.
+SNPs are always reported.  Indels are counted when "indels" is added to the
+-cols column set (e.g. "-cols=+indels"); they are left-aligned against the
+reference and reported at the preceding base, as in VCF, with the same strand,
+base-quality and stitching rules as SNPs.
+
+With "-format=vcf" (or "vcf-bgz" for BGZF output that can be indexed with
+"tabix -p vcf"), one VCF record is written per position with at least one
+observed ALT allele, SNV or indel.  The sample column carries AD, DP and the
+per-strand SB counts, and INFO carries the total depth and the mean base
+quality of each allele.  No genotypes are called.
+
+"-format=mpileup" writes a .mpileup file in the classic "samtools mpileup"
+text format, for scripts which parse it: CHROM, POS and REF, followed by the
+depth, read bases (with the ".,ACGTacgt*^$" markers and "+2AG"/"-2ag" indel
+notation) and base qualities of every sample.  Only positions covered by at
+least one read are written.  The -mapq, -flag-exclude, -min-base-qual and
+-clip filters apply as usual; bases below -min-base-qual are omitted, like
+samtools' -Q.  Unlike samtools, BAQ is only applied with "-baq", and
+read-pairs cannot be stitched.
 
 Sample usage:
 bio-pileup \
@@ -29,5 +46,47 @@ bio-pileup \
     --out output-prefix \
     my.bam \
     ref.fa
+
+Several coordinate-sorted files can be piled up together, without merging them
+first, by passing a comma-separated list of paths, e.g. "lane1.bam,lane2.bam".
+Records from files without read groups are assigned one named after the file.
+
+Several samples can be piled up jointly by passing one path (or
+comma-separated list of paths) per sample before the reference, e.g.
+"bio-pileup --bed my-regions.bed tumor.bam normal.bam ref.fa".  The samples are
+named after the SM tag of their read groups, or after their first file when
+there is no unique SM.  The TSV outputs then have one set of count columns per
+sample, suffixed with "_<sample name>", and the VCF output has one sample
+column per sample.  basestrand-rio output only supports a single sample.
+
+Spliced RNA-seq alignments (e.g. from STAR) are supported with
+"-max-spliced-span", which bounds the reference span of a spliced read
+including its skipped (N) regions; e.g. "-max-spliced-span=1000000".  Only the
+aligned blocks of each read are counted.  When stitching, the two ends of a
+spliced read-pair are only stitched if they start within -max-read-span of
+each other.
+
+When stitching, "-overlap-policy" selects how the two bases of a read-pair at
+a position covered by both ends are combined.  "agree" (the default) requires
+the bases to agree and combines their qualities, counting disagreements as N;
+"sum-qual" does the same, except that the qualities are summed and capped at
+60; "max-qual" keeps the higher-quality base; and "r1" keeps the first read's
+base.  The "discordant" column set reports the number of read-pairs whose ends
+disagree at each position.
+
+With "-umi-tag", read-pairs are grouped into UMI families by their UMI (read
+from the given aux tag, e.g. "RX"), fragment ends and strand, and each family
+contributes a single consensus base per position instead of one base per
+read-pair; this allows error-suppressed counting on BAMs without doppelmark's
+DS tags.  UMIs may differ by up to "-umi-max-mismatches" positions (default 1).
+Families with fewer than "-min-family-size" read-pairs are dropped, and so are
+families whose read-pairs disagree at a position, at that position.  This
+requires -stitch, and does not support indel or per-read columns.
+
+With "-baq", base qualities are capped by their samtools-style BAQ (base
+alignment quality) before they are compared to -min-base-qual, so mismatches
+caused by a misaligned nearby indel are mostly counted as low-quality.  BAQ
+is computed from the base qualities before -clip is applied.  Indel counts
+still use the original base qualities, and spliced reads are left unchanged.
 */
 package main
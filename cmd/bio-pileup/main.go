@@ -31,28 +31,34 @@ import (
 )
 
 var (
-	bedPath      = flag.String("bed", snp.DefaultOpts.BedPath, "Input BED path; this xor -region required")
-	region       = flag.String("region", snp.DefaultOpts.Region, "Restrict pileup computation to the specified region. Format as <contig ID>:<1-based first pos>-<last pos>, <contig ID>:<1-based pos>, or just <contig ID>; this xor -bed required")
-	bamIndexPath = flag.String("index", snp.DefaultOpts.BamIndexPath, "Input BAM index path. Defaults to bampath + .bai")
-	clip         = flag.Int("clip", snp.DefaultOpts.Clip, "Number of bases on end of each read to treat as minimum-quality")
-	cols         = flag.String("cols", snp.DefaultOpts.Cols, "Output TSV column sets. #CHROM/POS/REF(/ALT) are always present. Currently supported optional sets are 'dpref', 'dpalt', 'enddists', 'quals', 'fraglens', 'strands', 'highq', and 'lowq'; default is \"dpref,highq,lowq\"")
-	flagExclude  = flag.Int("flag-exclude", snp.DefaultOpts.FlagExclude, "Reads with a FLAG bit intersecting this value are skipped")
-	format       = flag.String("format", "tsv", "Output format; 'basestrand-rio', 'basestrand-tsv', 'basestrand-tsv-bgz', 'tsv', and 'tsv-bgz' supported")
-	mapq         = flag.Int("mapq", snp.DefaultOpts.Mapq, "Reads with MAPQ below this level are skipped")
-	maxReadLen   = flag.Int("max-read-len", snp.DefaultOpts.MaxReadLen, "Upper bound on individual read length")
-	maxReadSpan  = flag.Int("max-read-span", snp.DefaultOpts.MaxReadSpan, "Upper bound on size of reference-genome region a read maps to")
-	minBagDepth  = flag.Int("min-bag-depth", snp.DefaultOpts.MinBagDepth, "Lower bound on bag depth (DS aux tag value")
-	minBaseQual  = flag.Int("min-base-qual", snp.DefaultOpts.MinBaseQual, "Lower bound on base quality in a single read")
-	outPrefix    = flag.String("out", "bio-pileup", "Output path prefix")
-	parallelism  = flag.Int("parallelism", 0, "Maximum number of simultaneous (local) pileup jobs to launch; 0 = runtime.NumCPU()")
-	perStrand    = flag.Bool("per-strand", snp.DefaultOpts.PerStrand, "Generate two pairs of output files, one for each strand")
-	removeSq     = flag.Bool("remove-sq", snp.DefaultOpts.RemoveSq, "Remove sequencing duplicates (no DL aux tag with value > 1)")
-	stitch       = flag.Bool("stitch", snp.DefaultOpts.Stitch, "Stitch read-pairs")
-	tempDir      = flag.String("temp-dir", snp.DefaultOpts.TempDir, "Directory to write temporary files to (default os.TempDir())")
+	baq              = flag.Bool("baq", snp.DefaultOpts.BAQ, "Cap base qualities by their samtools-style BAQ (base alignment quality), to suppress mismatches caused by misaligned indels")
+	bedPath          = flag.String("bed", snp.DefaultOpts.BedPath, "Input BED path; this xor -region required")
+	region           = flag.String("region", snp.DefaultOpts.Region, "Restrict pileup computation to the specified region. Format as <contig ID>:<1-based first pos>-<last pos>, <contig ID>:<1-based pos>, or just <contig ID>; this xor -bed required")
+	bamIndexPath     = flag.String("index", snp.DefaultOpts.BamIndexPath, "Input BAM index path, or comma-separated list of index paths with one per sample. Defaults to bampath + .bai")
+	clip             = flag.Int("clip", snp.DefaultOpts.Clip, "Number of bases on end of each read to treat as minimum-quality")
+	cols             = flag.String("cols", snp.DefaultOpts.Cols, "Output TSV column sets. #CHROM/POS/REF(/ALT) are always present. Currently supported optional sets are 'dpref', 'dpalt', 'enddists', 'quals', 'fraglens', 'strands', 'highq', 'lowq', and 'indels' (left-aligned indel counts; INS/DEL columns in .ref.tsv and one .alt.tsv row per indel allele, or INS/DEL strand columns and a .indelstrand.tsv file with basestrand-tsv output), and 'discordant' (number of stitched read-pairs whose ends have different bases; requires -stitch); default is \"dpref,highq,lowq\"")
+	flagExclude      = flag.Int("flag-exclude", snp.DefaultOpts.FlagExclude, "Reads with a FLAG bit intersecting this value are skipped")
+	format           = flag.String("format", "tsv", "Output format; 'basestrand-rio', 'basestrand-tsv', 'basestrand-tsv-bgz', 'tsv', 'tsv-bgz', 'vcf', 'vcf-bgz', and 'mpileup' supported")
+	mapq             = flag.Int("mapq", snp.DefaultOpts.Mapq, "Reads with MAPQ below this level are skipped")
+	maxReadLen       = flag.Int("max-read-len", snp.DefaultOpts.MaxReadLen, "Upper bound on individual read length")
+	maxReadSpan      = flag.Int("max-read-span", snp.DefaultOpts.MaxReadSpan, "Upper bound on size of reference-genome region a read maps to, not counting the skipped regions of spliced reads")
+	maxSplicedSpan   = flag.Int("max-spliced-span", snp.DefaultOpts.MaxSplicedSpan, "Upper bound on size of reference-genome region a spliced read (with N CIGAR operations) maps to, including the skipped regions; 0 = spliced reads must fit in -max-read-span")
+	minBagDepth      = flag.Int("min-bag-depth", snp.DefaultOpts.MinBagDepth, "Lower bound on bag depth (DS aux tag value")
+	minBaseQual      = flag.Int("min-base-qual", snp.DefaultOpts.MinBaseQual, "Lower bound on base quality in a single read")
+	minFamilySize    = flag.Int("min-family-size", snp.DefaultOpts.MinFamilySize, "With -umi-tag, UMI families with fewer read-pairs than this are dropped")
+	outPrefix        = flag.String("out", "bio-pileup", "Output path prefix")
+	overlapPolicy    = flag.String("overlap-policy", snp.DefaultOpts.OverlapPolicy, "How the overlapping bases of stitched read-pairs are combined: 'agree' (bases must agree, else N; qualities are combined), 'max-qual' (keep the higher-quality base), 'sum-qual' (bases must agree, else N; qualities are summed and capped at 60), or 'r1' (keep the first read's base)")
+	parallelism      = flag.Int("parallelism", 0, "Maximum number of simultaneous (local) pileup jobs to launch; 0 = runtime.NumCPU()")
+	perStrand        = flag.Bool("per-strand", snp.DefaultOpts.PerStrand, "Generate two pairs of output files, one for each strand")
+	removeSq         = flag.Bool("remove-sq", snp.DefaultOpts.RemoveSq, "Remove sequencing duplicates (no DL aux tag with value > 1)")
+	stitch           = flag.Bool("stitch", snp.DefaultOpts.Stitch, "Stitch read-pairs")
+	tempDir          = flag.String("temp-dir", snp.DefaultOpts.TempDir, "Directory to write temporary files to (default os.TempDir())")
+	umiMaxMismatches = flag.Int("umi-max-mismatches", snp.DefaultOpts.UMIMaxMismatches, "With -umi-tag, maximum number of mismatches between the UMIs of a family")
+	umiTag           = flag.String("umi-tag", snp.DefaultOpts.UMITag, "Aux tag containing the UMI (e.g. 'RX'); when set, read-pairs are grouped into UMI families, and each family contributes a single consensus base per position.  Requires -stitch")
 )
 
 func bioPileupUsage() {
-	fmt.Printf("Usage: %s [OPTIONS] {b,p}ampath fapath\n", os.Args[0])
+	fmt.Printf("Usage: %s [OPTIONS] {b,p}ampath[,{b,p}ampath...] [{b,p}ampath[,{b,p}ampath...]...] fapath\n", os.Args[0])
 	fmt.Printf("Other options:\n")
 	flag.PrintDefaults()
 }
@@ -65,33 +71,35 @@ func main() {
 	allArgs := flag.Args()
 	nPositionalArgs := flag.NArg()
 	positionalArgs := allArgs[len(allArgs)-nPositionalArgs:]
-	if nPositionalArgs != 2 {
-		if nPositionalArgs < 2 {
-			log.Fatalf("Missing positional arguments ({b,p}ampath and fapath required); please check flag syntax: '%s'", strings.Join(positionalArgs, " "))
-		} else {
-			log.Fatalf("Too many positional arguments (only {b,p}ampath and fapath expected); please check flag syntax: '%s'", strings.Join(positionalArgs, " "))
-		}
+	if nPositionalArgs < 2 {
+		log.Fatalf("Missing positional arguments ({b,p}ampath and fapath required); please check flag syntax: '%s'", strings.Join(positionalArgs, " "))
 	}
 	ctx := vcontext.Background()
 	opts := snp.Opts{
-		BedPath:      *bedPath,
-		Region:       *region,
-		BamIndexPath: *bamIndexPath,
-		Clip:         *clip,
-		Cols:         *cols,
-		FlagExclude:  *flagExclude,
-		Mapq:         *mapq,
-		MaxReadLen:   *maxReadLen,
-		MaxReadSpan:  *maxReadSpan,
-		MinBagDepth:  *minBagDepth,
-		MinBaseQual:  *minBaseQual,
-		Parallelism:  *parallelism,
-		PerStrand:    *perStrand,
-		RemoveSq:     *removeSq,
-		Stitch:       *stitch,
-		TempDir:      *tempDir,
+		BedPath:          *bedPath,
+		Region:           *region,
+		BamIndexPath:     *bamIndexPath,
+		BAQ:              *baq,
+		Clip:             *clip,
+		Cols:             *cols,
+		FlagExclude:      *flagExclude,
+		Mapq:             *mapq,
+		MaxReadLen:       *maxReadLen,
+		MaxReadSpan:      *maxReadSpan,
+		MaxSplicedSpan:   *maxSplicedSpan,
+		MinBagDepth:      *minBagDepth,
+		MinBaseQual:      *minBaseQual,
+		OverlapPolicy:    *overlapPolicy,
+		Parallelism:      *parallelism,
+		PerStrand:        *perStrand,
+		RemoveSq:         *removeSq,
+		Stitch:           *stitch,
+		TempDir:          *tempDir,
+		UMITag:           *umiTag,
+		UMIMaxMismatches: *umiMaxMismatches,
+		MinFamilySize:    *minFamilySize,
 	}
-	if err := snp.Pileup(ctx, positionalArgs[0], positionalArgs[1], *format, *outPrefix, &opts, nil); err != nil {
+	if err := snp.PileupSamples(ctx, positionalArgs[:nPositionalArgs-1], positionalArgs[nPositionalArgs-1], *format, *outPrefix, &opts, nil); err != nil {
 		log.Panicf("%v", err)
 	}
 	log.Debug.Printf("exiting")
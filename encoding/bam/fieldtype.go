@@ -6,11 +6,15 @@ package bam
 
 import (
 	"fmt"
+	"strings"
+
+	"github.com/Schaudge/hts/sam"
 )
 
 // FieldType defines a sam.Record field. Each field is stored in a separate
-// file.
-type FieldType uint8
+// file. Besides the Field* constants, AuxTagField creates a FieldType for each
+// aux tag that is stored in its own file.
+type FieldType uint32
 
 const (
 	// FieldCoord combines <sam.Reference.ID(), sam.Record.Pos>. They need to be
@@ -48,22 +52,49 @@ var FieldNames = []string{
 	"aux",
 }
 
+// auxTagFieldBase is ORed with the two bytes of an aux tag to form the
+// FieldType returned by AuxTagField. It keeps such FieldTypes apart from the
+// Field* constants.
+const auxTagFieldBase = 1 << 16
+
+// AuxTagField returns the FieldType of the file that stores the values of the
+// given aux tag, when the PAM writer promotes the tag to its own file
+// (pam.WriteOpts.PromotedAuxTags). Its name is "aux.<tag>", e.g., "aux.RG".
+func AuxTagField(tag sam.Tag) FieldType {
+	return FieldType(auxTagFieldBase | uint32(tag[0])<<8 | uint32(tag[1]))
+}
+
+// AuxTag returns the aux tag of a FieldType created by AuxTagField. It returns
+// false for the other FieldTypes.
+func (f FieldType) AuxTag() (sam.Tag, bool) {
+	if f&^0xffff != auxTagFieldBase {
+		return sam.Tag{}, false
+	}
+	return sam.Tag{byte(f >> 8), byte(f)}, true
+}
+
 // String returns the name of the type.  The name is used as part of the PAM
 // filenames, so it shall not be changed.
 func (f FieldType) String() string {
 	if int(f) < len(FieldNames) {
 		return FieldNames[f]
 	}
+	if tag, ok := f.AuxTag(); ok {
+		return FieldNames[FieldAux] + "." + tag.String()
+	}
 	return fmt.Sprintf("Field%d", f)
 }
 
 // ParseFieldType converts a string to FieldType. For example, "cigar" will
-// return FieldCigar.
+// return FieldCigar, and "aux.RG" will return AuxTagField(sam.NewTag("RG")).
 func ParseFieldType(v string) (FieldType, error) {
 	for f, name := range FieldNames {
 		if name == v {
 			return FieldType(f), nil
 		}
 	}
+	if prefix := FieldNames[FieldAux] + "."; strings.HasPrefix(v, prefix) && len(v) == len(prefix)+2 {
+		return AuxTagField(sam.NewTag(v[len(prefix):])), nil
+	}
 	return FieldAux, fmt.Errorf("%v: invalid PAM field type", v)
 }
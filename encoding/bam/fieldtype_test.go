@@ -0,0 +1,35 @@
+package bam_test
+
+import (
+	"testing"
+
+	gbam "github.com/Schaudge/grailbio/encoding/bam"
+	"github.com/Schaudge/hts/sam"
+	"github.com/grailbio/testutil/assert"
+	"github.com/grailbio/testutil/expect"
+)
+
+func TestFieldType(t *testing.T) {
+	for f := gbam.FieldCoord; f < gbam.FieldInvalid; f++ {
+		_, ok := f.AuxTag()
+		expect.False(t, ok, "field %v", f)
+		parsed, err := gbam.ParseFieldType(f.String())
+		assert.NoError(t, err)
+		expect.EQ(t, parsed, f)
+	}
+
+	rg := gbam.AuxTagField(sam.NewTag("RG"))
+	expect.EQ(t, rg.String(), "aux.RG")
+	tag, ok := rg.AuxTag()
+	expect.True(t, ok)
+	expect.EQ(t, tag, sam.NewTag("RG"))
+	expect.NEQ(t, rg, gbam.AuxTagField(sam.NewTag("MI")))
+	parsed, err := gbam.ParseFieldType("aux.RG")
+	assert.NoError(t, err)
+	expect.EQ(t, parsed, rg)
+
+	for _, v := range []string{"foo", "aux.", "aux.RGX"} {
+		_, err = gbam.ParseFieldType(v)
+		expect.Regexp(t, err, "invalid PAM field type", "field %v", v)
+	}
+}
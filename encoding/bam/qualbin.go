@@ -0,0 +1,118 @@
+package bam
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/Schaudge/grailbio/biosimd"
+	"github.com/Schaudge/hts/sam"
+)
+
+// QualBin maps the base qualities in range [Min, Max] to Value.
+type QualBin struct {
+	Min, Max, Value byte
+}
+
+// Illumina8Bins is Illumina's 8-level quality binning scheme. Qualities 0 and 1
+// (no call) are left as is.
+var Illumina8Bins = []QualBin{
+	{2, 9, 6},
+	{10, 19, 15},
+	{20, 24, 22},
+	{25, 29, 27},
+	{30, 34, 33},
+	{35, 39, 37},
+	{40, 93, 40},
+}
+
+// missingQual is the value of sam.Record.Qual for a record without base
+// qualities. It is printed as "*" in SAM.
+const missingQual = 0xff
+
+// QualBinning defines a lossy transformation of base qualities, applied when
+// records are written. Binned qualities compress several times better than the
+// raw ones.
+type QualBinning struct {
+	// Table maps each quality to its binned value. If nil, qualities are
+	// unchanged.
+	Table *biosimd.ByteLookupTable
+
+	// DropBelowMapq, if > 0, causes the qualities of the records whose mapq is
+	// below the value to be dropped. Such records are written as if they had no
+	// qualities.
+	DropBelowMapq int
+}
+
+// NewQualBinTable creates a table for QualBinning.Table. Qualities not covered
+// by any of the bins are unchanged.
+func NewQualBinTable(bins []QualBin) (*biosimd.ByteLookupTable, error) {
+	table := biosimd.MakeIdentityByteLookupTable()
+	for _, bin := range bins {
+		if bin.Min > bin.Max || bin.Max >= missingQual || bin.Value >= missingQual {
+			return nil, fmt.Errorf("invalid quality bin %+v", bin)
+		}
+		for q := int(bin.Min); q <= int(bin.Max); q++ {
+			table[q] = bin.Value
+		}
+	}
+	return &table, nil
+}
+
+// ParseQualBins parses a list of quality bins. The value is either
+// "illumina8", for Illumina8Bins, or a comma-separated list of "min-max:value",
+// e.g., "2-19:10,20-93:30".
+func ParseQualBins(spec string) ([]QualBin, error) {
+	if spec == "illumina8" {
+		return Illumina8Bins, nil
+	}
+	var bins []QualBin
+	for _, binSpec := range strings.Split(spec, ",") {
+		var bin QualBin
+		colon := strings.IndexByte(binSpec, ':')
+		dash := strings.IndexByte(binSpec, '-')
+		if colon < 0 || dash < 0 || dash > colon {
+			return nil, fmt.Errorf("parsequalbins %s: invalid bin '%s'; expect min-max:value", spec, binSpec)
+		}
+		for i, s := range []string{binSpec[:dash], binSpec[dash+1 : colon], binSpec[colon+1:]} {
+			v, err := strconv.ParseUint(s, 10, 8)
+			if err != nil {
+				return nil, fmt.Errorf("parsequalbins %s: invalid bin '%s': %v", spec, binSpec, err)
+			}
+			switch i {
+			case 0:
+				bin.Min = byte(v)
+			case 1:
+				bin.Max = byte(v)
+			case 2:
+				bin.Value = byte(v)
+			}
+		}
+		bins = append(bins, bin)
+	}
+	return bins, nil
+}
+
+// BinQual returns the qualities of the record after binning. The record itself
+// is not modified; the result is stored in *scratch, which is reused across
+// calls. If b is nil, it returns r.Qual.
+func (b *QualBinning) BinQual(r *sam.Record, scratch *[]byte) []byte {
+	if b == nil || len(r.Qual) == 0 || (b.Table == nil && b.DropBelowMapq <= 0) {
+		return r.Qual
+	}
+	if cap(*scratch) < len(r.Qual) {
+		*scratch = make([]byte, len(r.Qual))
+	}
+	qual := (*scratch)[:len(r.Qual)]
+	if b.DropBelowMapq > 0 && int(r.MapQ) < b.DropBelowMapq {
+		for i := range qual {
+			qual[i] = missingQual
+		}
+		return qual
+	}
+	copy(qual, r.Qual)
+	if b.Table != nil && r.Qual[0] != missingQual {
+		biosimd.ByteLookupInplace(qual, b.Table)
+	}
+	return qual
+}
@@ -0,0 +1,89 @@
+package bam_test
+
+import (
+	"bytes"
+	"testing"
+
+	gbam "github.com/Schaudge/grailbio/encoding/bam"
+	"github.com/Schaudge/hts/bam"
+	"github.com/Schaudge/hts/sam"
+	"github.com/grailbio/testutil/assert"
+	"github.com/grailbio/testutil/expect"
+	"github.com/klauspost/compress/gzip"
+)
+
+func TestParseQualBins(t *testing.T) {
+	bins, err := gbam.ParseQualBins("illumina8")
+	assert.NoError(t, err)
+	expect.EQ(t, bins, gbam.Illumina8Bins)
+
+	bins, err = gbam.ParseQualBins("2-19:10,20-93:30")
+	assert.NoError(t, err)
+	expect.EQ(t, bins, []gbam.QualBin{{Min: 2, Max: 19, Value: 10}, {Min: 20, Max: 93, Value: 30}})
+
+	for _, spec := range []string{"", "2-19", "2:19-3", "2-x:3", "2-300:4"} {
+		_, err = gbam.ParseQualBins(spec)
+		expect.Regexp(t, err, "parsequalbins", "spec %q", spec)
+	}
+	_, err = gbam.NewQualBinTable([]gbam.QualBin{{Min: 10, Max: 2, Value: 5}})
+	expect.Regexp(t, err, "invalid quality bin")
+}
+
+func TestBinQual(t *testing.T) {
+	table, err := gbam.NewQualBinTable(gbam.Illumina8Bins)
+	assert.NoError(t, err)
+	b := &gbam.QualBinning{Table: table, DropBelowMapq: 20}
+
+	qual := []byte{0, 1, 2, 9, 10, 19, 20, 24, 25, 29, 30, 34, 35, 39, 40, 41}
+	r := &sam.Record{MapQ: 60, Qual: append([]byte{}, qual...)}
+	var scratch []byte
+	expect.EQ(t, b.BinQual(r, &scratch),
+		[]byte{0, 1, 6, 6, 15, 15, 22, 22, 27, 27, 33, 33, 37, 37, 40, 40})
+	// The record is not modified.
+	expect.EQ(t, r.Qual, qual)
+
+	r.MapQ = 19
+	expect.EQ(t, b.BinQual(r, &scratch), bytes.Repeat([]byte{0xff}, len(qual)))
+
+	// Missing qualities are kept as is.
+	r = &sam.Record{MapQ: 60, Qual: []byte{0xff, 0xff}}
+	expect.EQ(t, b.BinQual(r, &scratch), []byte{0xff, 0xff})
+
+	var nilBinning *gbam.QualBinning
+	expect.EQ(t, nilBinning.BinQual(r, &scratch), r.Qual)
+}
+
+func TestShardedBAMQualBinning(t *testing.T) {
+	chr1, err := sam.NewReference("chr1", "", "", 1000, nil, nil)
+	assert.NoError(t, err)
+	header, err := sam.NewHeader(nil, []*sam.Reference{chr1})
+	assert.NoError(t, err)
+	cigar := sam.Cigar{sam.NewCigarOp(sam.CigarMatch, 4)}
+	records := []*sam.Record{
+		{Name: "A", Ref: chr1, Pos: 0, MapQ: 60, Cigar: cigar, Seq: sam.NewSeq([]byte("ACGT")), Qual: []byte{2, 12, 22, 41}},
+		{Name: "B", Ref: chr1, Pos: 10, MapQ: 5, Cigar: cigar, Seq: sam.NewSeq([]byte("ACGT")), Qual: []byte{2, 12, 22, 41}},
+	}
+	var buf bytes.Buffer
+	w, err := gbam.NewShardedBAMWriter(&buf, gzip.DefaultCompression, 10, header)
+	assert.NoError(t, err)
+	table, err := gbam.NewQualBinTable(gbam.Illumina8Bins)
+	assert.NoError(t, err)
+	w.SetQualBinning(&gbam.QualBinning{Table: table, DropBelowMapq: 10})
+	c := w.GetCompressor()
+	assert.NoError(t, c.StartShard(0))
+	for _, r := range records {
+		assert.NoError(t, c.AddRecord(r))
+	}
+	assert.NoError(t, c.CloseShard())
+	assert.NoError(t, w.Close())
+	expect.EQ(t, records[0].Qual, []byte{2, 12, 22, 41})
+
+	reader, err := bam.NewReader(&buf, 1)
+	assert.NoError(t, err)
+	r, err := reader.Read()
+	assert.NoError(t, err)
+	expect.EQ(t, r.Qual, []byte{6, 15, 22, 40})
+	r, err = reader.Read()
+	assert.NoError(t, err)
+	expect.EQ(t, r.Qual, []byte{0xff, 0xff, 0xff, 0xff})
+}
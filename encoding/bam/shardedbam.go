@@ -76,10 +76,11 @@ var (
 // ShardedBAMCompressor can exist at once, and they can all compress
 // records in parallel with each other.
 type ShardedBAMCompressor struct {
-	writer *ShardedBAMWriter
-	bgzf   *bgzf.Writer
-	output *shardedBAMBuffer
-	buf    bytes.Buffer
+	writer  *ShardedBAMWriter
+	bgzf    *bgzf.Writer
+	output  *shardedBAMBuffer
+	buf     bytes.Buffer
+	qualBuf []byte // Temp for binning qualities
 }
 
 // StartShard begins a new shard with the specified shard number.  If
@@ -112,10 +113,17 @@ func (c *ShardedBAMCompressor) addHeader(h *sam.Header) error {
 
 // AddRecord adds a sam record to the current in-progress shard.
 func (c *ShardedBAMCompressor) AddRecord(r *sam.Record) error {
-	if err := htsbam.Marshal(r, &c.buf); err != nil {
+	if c.writer.qualBinning != nil {
+		// Marshal the binned qualities without modifying the caller's record.
+		rc := *r
+		rc.Qual = c.writer.qualBinning.BinQual(r, &c.qualBuf)
+		r = &rc
+	}
+	err := htsbam.Marshal(r, &c.buf)
+	if err != nil {
 		return err
 	}
-	_, err := c.buf.WriteTo(c.bgzf)
+	_, err = c.buf.WriteTo(c.bgzf)
 	return err
 }
 
@@ -151,6 +159,8 @@ type ShardedBAMWriter struct {
 	queue     *syncqueue.OrderedQueue
 	waitGroup sync.WaitGroup
 	err       error
+
+	qualBinning *QualBinning
 }
 
 // NewShardedBAMWriter creates a new ShardedBAMWriter that writes the
@@ -182,6 +192,12 @@ func NewShardedBAMWriter(w io.Writer, gzLevel, queueSize int, header *sam.Header
 	return &bw, nil
 }
 
+// SetQualBinning causes the base qualities of the records to be binned when they
+// are added. It must be called before any record is added.
+func (bw *ShardedBAMWriter) SetQualBinning(b *QualBinning) {
+	bw.qualBinning = b
+}
+
 // GetCompressor returns a child ShardedBAMCompressor.
 func (bw *ShardedBAMWriter) GetCompressor() *ShardedBAMCompressor {
 	return &ShardedBAMCompressor{
@@ -43,13 +43,14 @@ type diskMateShard struct {
 	writer       io.WriteCloser
 	m            map[string][]*indexedRecord
 	mateShardIdx int
+	maxRecords   int // max records per name, or 0 for no limit.
 	mutex        sync.Mutex
 	refcount     int
 	buf          bytes.Buffer
 }
 
 // newDiskMateShard returns a new diskMateShard.
-func newDiskMateShard(header *sam.Header, tempDir string, mateShardIdx, numMateShards int) (*diskMateShard, error) {
+func newDiskMateShard(header *sam.Header, tempDir string, mateShardIdx, numMateShards, maxRecords int) (*diskMateShard, error) {
 	filename := path.Join(tempDir, fmt.Sprintf("mates_%04d_of_%04d", mateShardIdx, numMateShards))
 	f, err := os.Create(filename)
 	if err != nil {
@@ -61,6 +62,7 @@ func newDiskMateShard(header *sam.Header, tempDir string, mateShardIdx, numMateS
 		f:            f,
 		writer:       snappy.NewBufferedWriter(f),
 		mateShardIdx: mateShardIdx,
+		maxRecords:   maxRecords,
 	}, nil
 }
 
@@ -170,8 +172,8 @@ func (s *diskMateShard) openReader() error {
 			}
 			// There's no particular order for left and right in a distantMateEntry.
 			s.m[iRecord.r.Name] = append(s.m[iRecord.r.Name], iRecord)
-			if len(s.m[iRecord.r.Name]) > 2 {
-				return fmt.Errorf("Got 3rd read, %v %d", iRecord.r, iRecord.fileIdx)
+			if s.maxRecords > 0 && len(s.m[iRecord.r.Name]) > s.maxRecords {
+				return fmt.Errorf("Got too many reads for %s: %v %d", iRecord.r.Name, iRecord.r, iRecord.fileIdx)
 			}
 		} else {
 			s.m[iRecord.r.Name] = []*indexedRecord{iRecord}
@@ -196,6 +198,10 @@ func (s *diskMateShard) getMate(shardInfo *ShardInfo, r *sam.Record) (*sam.Recor
 	return nil, 0
 }
 
+func (s *diskMateShard) getAll(name string) []*indexedRecord {
+	return s.m[name]
+}
+
 func (s *diskMateShard) closeReader() {
 	s.mutex.Lock()
 	defer s.mutex.Unlock()
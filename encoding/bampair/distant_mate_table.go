@@ -14,11 +14,16 @@ type indexedRecord struct {
 	fileIdx uint64
 }
 
+// mateShardMaxRecords is the max number of distinct records stored
+// under one read name in a DistantMateTable: the two reads of a pair.
+const mateShardMaxRecords = 2
+
 type mateShard interface {
 	add(mate *sam.Record, fileIdx uint64) error
 	closeWriter() error
 	openReader() error
 	getMate(shardInfo *ShardInfo, r *sam.Record) (*sam.Record, uint64)
+	getAll(name string) []*indexedRecord
 	closeReader()
 }
 
@@ -42,6 +47,13 @@ type DistantMateTable struct {
 }
 
 func newDistantMateTable(header *sam.Header, scratchDir string, numMateShards, numShards int) (*DistantMateTable, error) {
+	return newRecordTable(header, scratchDir, numMateShards, numShards, mateShardMaxRecords)
+}
+
+// newRecordTable creates a DistantMateTable that stores up to
+// maxRecords distinct records per read name in each mate shard.  If
+// maxRecords is 0, the number of records per name is unbounded.
+func newRecordTable(header *sam.Header, scratchDir string, numMateShards, numShards, maxRecords int) (*DistantMateTable, error) {
 	d := &DistantMateTable{
 		header:        header,
 		numMateShards: numMateShards,
@@ -57,14 +69,14 @@ func newDistantMateTable(header *sam.Header, scratchDir string, numMateShards, n
 
 		for mateShardIdx := 0; mateShardIdx < numMateShards; mateShardIdx++ {
 			var err error
-			d.entries[mateShardIdx], err = newDiskMateShard(header, d.tempDir, mateShardIdx, numMateShards)
+			d.entries[mateShardIdx], err = newDiskMateShard(header, d.tempDir, mateShardIdx, numMateShards, maxRecords)
 			if err != nil {
 				return nil, err
 			}
 		}
 	} else {
 		d.numMateShards = 1
-		d.entries = []mateShard{newMemMateShard()}
+		d.entries = []mateShard{newMemMateShard(maxRecords)}
 	}
 	return d, nil
 }
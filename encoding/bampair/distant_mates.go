@@ -49,7 +49,7 @@ type shardInfoUpdate struct {
 // through the input file, GetDistantMates also feeds each record to a
 // set of RecordProcessors. createProcessors is a slice of functions
 // that return the RecordProcessesors to be used. For an example of
-// how to use GetDistantMates, see ExampleResolvePairs() in
+// how to use GetDistantMates, see ExampleGetDistantMates() in
 // distant_mates_test.go.
 func GetDistantMates(provider bamprovider.Provider, shardList []bam.Shard, opts *Opts,
 	createProcessors []func() RecordProcessor) (distantMates *DistantMateTable, shardInfo *ShardInfo, returnErr error) {
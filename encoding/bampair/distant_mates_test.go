@@ -233,7 +233,7 @@ func TestGetDistantMates(t *testing.T) {
 	}
 }
 
-func ExampleResolvePairs() {
+func ExampleGetDistantMates() {
 	testRecords := []*sam.Record{
 		newRecord("A:::1:10:1:1", chr1, 0, r1F, 10, chr1, cigar0), // near mates
 		newRecord("A:::1:10:1:1", chr1, 10, r2F, 0, chr1, cigar0),
@@ -21,11 +21,19 @@
   the user encounters the mate.  For a record who's mate is not in the
   same shard, the user can call DistantMateTable.GetMate() right away
   to retrieve the mate.  For an usage example, see
-  ExampleResolvePairs() in distant_mates_test.go.
+  ExampleGetDistantMates() in distant_mates_test.go.
 
   Some applications may need to add padding to beginning and end of
   each shard.  In this case, if R1 and R2 are in the same padded
   shard, then neither will be in distant mates.  If R1 is in the
   padded shard, and R2 is not, then R2 will be in distant mates.
+
+  Package bampair also links chimeric reads to their supplementary
+  alignments.  GetSupplementaryAlignments() scans the shards and
+  returns a SupplementaryTable, which stores each supplementary
+  record under every shard that contains an alignment listed in the
+  record's SA tag.  While processing a shard, the user can call
+  SupplementaryTable.GetSupplementary() on a primary record to
+  retrieve all of its supplementary records, wherever they reside.
 */
 package bampair
@@ -38,7 +38,7 @@ func TestMemMateShard(t *testing.T) {
 	r2 := &sam.Record{Name: "foo", Ref: chr1, Pos: 10, MateRef: chr1, MatePos: 0}
 	shardInfo := createShardInfo()
 
-	shard := newMemMateShard()
+	shard := newMemMateShard(mateShardMaxRecords)
 	shard.add(r1, 123)
 	shard.add(r2, 456)
 	shard.closeWriter()
@@ -58,7 +58,7 @@ func TestDiskMateShard(t *testing.T) {
 	tempDir, cleanup := testutil.TempDir(t, "", "")
 	defer cleanup()
 
-	shard, err := newDiskMateShard(header, tempDir, 0, 1000)
+	shard, err := newDiskMateShard(header, tempDir, 0, 1000, mateShardMaxRecords)
 	assert.NoError(t, err)
 	shard.add(r1, 123)
 	shard.add(r2, 456)
@@ -14,13 +14,15 @@ import (
 // Calls to getMate() should occur only between a call to openReader()
 // and a call to closeReader().
 type memMateShard struct {
-	m     map[string][]*indexedRecord
-	mutex sync.Mutex
+	m          map[string][]*indexedRecord
+	maxRecords int // max records per name, or 0 for no limit.
+	mutex      sync.Mutex
 }
 
-func newMemMateShard() *memMateShard {
+func newMemMateShard(maxRecords int) *memMateShard {
 	return &memMateShard{
-		m: map[string][]*indexedRecord{},
+		m:          map[string][]*indexedRecord{},
+		maxRecords: maxRecords,
 	}
 }
 
@@ -36,8 +38,8 @@ func (s *memMateShard) add(mate *sam.Record, fileIdx uint64) error {
 			}
 		}
 		s.m[mate.Name] = append(s.m[mate.Name], &indexedRecord{mate, fileIdx})
-		if len(e) > 2 {
-			return fmt.Errorf("Got 3rd read, right is not nil! %v %d", mate, fileIdx)
+		if s.maxRecords > 0 && len(e) > s.maxRecords {
+			return fmt.Errorf("Got too many reads for %s: %v %d", mate.Name, mate, fileIdx)
 		}
 	} else {
 		s.m[mate.Name] = []*indexedRecord{&indexedRecord{mate, fileIdx}}
@@ -63,5 +65,9 @@ func (s *memMateShard) getMate(shardInfo *ShardInfo, r *sam.Record) (*sam.Record
 	return nil, 0
 }
 
+func (s *memMateShard) getAll(name string) []*indexedRecord {
+	return s.m[name]
+}
+
 func (s *memMateShard) closeReader() {
 }
@@ -0,0 +1,267 @@
+package bampair
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Schaudge/grailbase/log"
+	"github.com/Schaudge/grailbase/sync/multierror"
+	"github.com/Schaudge/grailbio/biopb"
+	"github.com/Schaudge/grailbio/encoding/bam"
+	"github.com/Schaudge/grailbio/encoding/bamprovider"
+	"github.com/Schaudge/hts/sam"
+)
+
+var saTag = sam.NewTag("SA")
+
+// SAEntry is one alignment listed in the SA (other canonical
+// alignments in a chimeric alignment) aux tag.
+type SAEntry struct {
+	Ref     *sam.Reference
+	Pos     int // Pos is 0-based, unlike the 1-based position in the tag.
+	Reverse bool
+	Cigar   sam.Cigar
+	MapQ    byte
+	NM      int
+}
+
+// ParseSATag parses the SA aux tag of r.  It returns nil if r has no
+// SA tag.  Each entry of the tag has the form
+// "rname,pos,strand,CIGAR,mapQ,NM;".  By convention, the first entry
+// of a supplementary record's SA tag is its primary alignment.
+func ParseSATag(header *sam.Header, r *sam.Record) ([]SAEntry, error) {
+	refs := map[string]*sam.Reference{}
+	for _, ref := range header.Refs() {
+		refs[ref.Name()] = ref
+	}
+	return parseSATag(refs, r)
+}
+
+func parseSATag(refs map[string]*sam.Reference, r *sam.Record) ([]SAEntry, error) {
+	aux := r.AuxFields.Get(saTag)
+	if aux == nil {
+		return nil, nil
+	}
+	value, ok := aux.Value().(string)
+	if !ok {
+		return nil, fmt.Errorf("SA tag of %s has type %c, expected Z", r.Name, aux.Type())
+	}
+	var entries []SAEntry
+	for _, item := range strings.Split(value, ";") {
+		if item == "" {
+			continue
+		}
+		fields := strings.Split(item, ",")
+		if len(fields) != 6 {
+			return nil, fmt.Errorf("malformed SA entry '%s' in %s", item, r.Name)
+		}
+		ref, ok := refs[fields[0]]
+		if !ok {
+			return nil, fmt.Errorf("unknown reference '%s' in SA entry of %s", fields[0], r.Name)
+		}
+		pos, err := strconv.Atoi(fields[1])
+		if err != nil || pos < 1 {
+			return nil, fmt.Errorf("malformed position in SA entry '%s' of %s", item, r.Name)
+		}
+		if fields[2] != "+" && fields[2] != "-" {
+			return nil, fmt.Errorf("malformed strand in SA entry '%s' of %s", item, r.Name)
+		}
+		cigar, err := sam.ParseCigar([]byte(fields[3]))
+		if err != nil {
+			return nil, fmt.Errorf("malformed cigar in SA entry '%s' of %s: %v", item, r.Name, err)
+		}
+		mapq, err := strconv.ParseUint(fields[4], 10, 8)
+		if err != nil {
+			return nil, fmt.Errorf("malformed mapq in SA entry '%s' of %s", item, r.Name)
+		}
+		nm, err := strconv.Atoi(fields[5])
+		if err != nil {
+			return nil, fmt.Errorf("malformed NM in SA entry '%s' of %s", item, r.Name)
+		}
+		entries = append(entries, SAEntry{
+			Ref:     ref,
+			Pos:     pos - 1,
+			Reverse: fields[2] == "-",
+			Cigar:   cigar,
+			MapQ:    byte(mapq),
+			NM:      nm,
+		})
+	}
+	return entries, nil
+}
+
+// SupplementaryTable provides access to the supplementary alignments
+// of chimeric reads, indexed by shardIdx and read name.  It is
+// created by GetSupplementaryAlignments, and it stores its records in
+// memory or on disk in the same way as DistantMateTable.
+//
+// The shard with index shardIdx holds every supplementary record
+// listed in the SA tag of a record in that shard (or its padding),
+// regardless of where the supplementary record itself resides.  Like
+// DistantMateTable, each shard must be opened with OpenShard() before
+// calling GetSupplementary(), and closed with CloseShard() after.
+type SupplementaryTable struct {
+	table *DistantMateTable
+}
+
+// GetSupplementaryAlignments scans the BAM/PAM file given by provider,
+// and returns a SupplementaryTable that links each primary record to
+// the supplementary records named in its SA tag.  When finished with
+// the SupplementaryTable, the caller must call
+// SupplementaryTable.Close() to release its resources.
+func GetSupplementaryAlignments(provider bamprovider.Provider, shardList []bam.Shard, opts *Opts) (*SupplementaryTable, error) {
+	log.Debug.Printf("scanning %d shards for supplementary alignments", len(shardList))
+	header, err := provider.GetHeader()
+	if err != nil {
+		return nil, err
+	}
+	refs := map[string]*sam.Reference{}
+	for _, ref := range header.Refs() {
+		refs[ref.Name()] = ref
+	}
+	shardInfo := newShardInfo()
+	for _, shard := range shardList {
+		shardInfo.add(&shard)
+	}
+	table, err := newRecordTable(header, opts.ScratchDir, opts.DiskShards, len(shardList), 0)
+	if err != nil {
+		return nil, err
+	}
+
+	shardChannel := bam.NewShardChannel(shardList)
+	t0 := time.Now()
+	var wg sync.WaitGroup
+	errs := multierror.NewBuilder(1)
+	for i := 0; i < opts.Parallelism; i++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			errs.Add(findSupplementaryAlignments(provider, worker, refs, shardInfo, shardChannel, table))
+		}(i)
+	}
+	wg.Wait()
+	if err := errs.Err(); err != nil {
+		table.Close() // nolint: errcheck
+		return nil, err
+	}
+	log.Debug.Printf("scanners all done, found %d supplementary alignments in %v", table.len(), time.Since(t0))
+	if err := table.finish(shardInfo); err != nil {
+		return nil, err
+	}
+	return &SupplementaryTable{table: table}, nil
+}
+
+func findSupplementaryAlignments(provider bamprovider.Provider, worker int, refs map[string]*sam.Reference,
+	shardInfo *ShardInfo, channel chan bam.Shard, table *DistantMateTable) error {
+	for shard := range channel {
+		if shard.StartRef == nil {
+			continue
+		}
+		log.Debug.Printf("worker %d scanning shard %v for supplementary alignments", worker, shard)
+		iter := provider.NewIterator(shard)
+		fileIdx := uint64(0)
+		for iter.Scan() {
+			record := iter.Record()
+			if !shard.RecordInShard(record) {
+				sam.PutInFreePool(record)
+				continue
+			}
+			fileIdx++
+			if !bam.IsSupplementary(record) || bam.IsUnmapped(record) {
+				sam.PutInFreePool(record)
+				continue
+			}
+			entries, err := parseSATag(refs, record)
+			if err != nil {
+				iter.Close() // nolint: errcheck
+				return err
+			}
+			// Save the record for every shard that may contain a
+			// record whose SA tag lists it.
+			targets := map[int]bool{}
+			for _, entry := range entries {
+				for _, shardIdx := range shardsContainingCoord(shardInfo, bam.NewCoord(entry.Ref, entry.Pos, 0)) {
+					targets[shardIdx] = true
+				}
+			}
+			for shardIdx := range targets {
+				if err := table.addDistantMate(shardIdx, record, fileIdx-1); err != nil {
+					iter.Close() // nolint: errcheck
+					return err
+				}
+			}
+		}
+		if err := iter.Close(); err != nil {
+			return fmt.Errorf("Close: %v", err)
+		}
+	}
+	return nil
+}
+
+// shardsContainingCoord returns the index of every shard whose padded
+// range contains coord.
+func shardsContainingCoord(shardInfo *ShardInfo, coord biopb.Coord) []int {
+	c := shardInfo.byKey.Floor(key{int(coord.RefId), int(coord.Pos), nil})
+	if c == nil {
+		return nil
+	}
+	start := c.(key).info.Shard.ShardIdx
+	var shards []int
+	for shardIdx := start; shardIdx >= 0; shardIdx-- {
+		info := shardInfo.GetInfoByIdx(shardIdx)
+		if !info.Shard.CoordInShard(info.Shard.Padding, coord) {
+			break
+		}
+		shards = append(shards, shardIdx)
+	}
+	for shardIdx := start + 1; shardIdx < shardInfo.Len(); shardIdx++ {
+		info := shardInfo.GetInfoByIdx(shardIdx)
+		if !info.Shard.CoordInShard(info.Shard.Padding, coord) {
+			break
+		}
+		shards = append(shards, shardIdx)
+	}
+	return shards
+}
+
+// OpenShard prepares the shard, with the given shardIdx, to be
+// queried with GetSupplementary().
+func (s *SupplementaryTable) OpenShard(shardIdx int) error {
+	return s.table.OpenShard(shardIdx)
+}
+
+// GetSupplementary returns the supplementary alignments of the same
+// read as r, sorted by coordinate.  r is typically the primary
+// record, and shardIdx is the index of the shard where r resides.  If
+// r itself is a supplementary record, the result includes the other
+// supplementary records of the read, but not r.
+func (s *SupplementaryTable) GetSupplementary(shardIdx int, r *sam.Record) []*sam.Record {
+	readMask := sam.Read1 | sam.Read2
+	var result []*sam.Record
+	for _, iRecord := range s.table.getShardEntry(shardIdx).getAll(r.Name) {
+		if iRecord.r.Flags&readMask != r.Flags&readMask || recordsEqual(iRecord.r, r) {
+			continue
+		}
+		result = append(result, iRecord.r)
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		ci := bam.CoordFromSAMRecord(result[i], 0)
+		return ci.LT(bam.CoordFromSAMRecord(result[j], 0))
+	})
+	return result
+}
+
+// CloseShard closes the given shard, and frees resources that
+// OpenShard() allocates.
+func (s *SupplementaryTable) CloseShard(shardIdx int) {
+	s.table.CloseShard(shardIdx)
+}
+
+// Close frees resources taken by a SupplementaryTable.
+func (s *SupplementaryTable) Close() error {
+	return s.table.Close()
+}
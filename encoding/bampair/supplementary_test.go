@@ -0,0 +1,101 @@
+package bampair
+
+import (
+	"testing"
+
+	gbam "github.com/Schaudge/grailbio/encoding/bam"
+	"github.com/Schaudge/grailbio/encoding/bamprovider"
+	"github.com/Schaudge/hts/sam"
+	"github.com/grailbio/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newSARecord(name string, ref *sam.Reference, pos int, flags sam.Flags, sa string) *sam.Record {
+	r := newRecord(name, ref, pos, flags, -1, nil, cigar0)
+	if sa != "" {
+		aux, err := sam.NewAux(saTag, sa)
+		if err != nil {
+			panic(err)
+		}
+		r.AuxFields = append(r.AuxFields, aux)
+	}
+	return r
+}
+
+func TestParseSATag(t *testing.T) {
+	r := newSARecord("A", chr1, 10, 0, "chr2,501,-,5S5M,60,1;chr1,201,+,5M5S,13,0;")
+	entries, err := ParseSATag(header, r)
+	require.NoError(t, err)
+	require.Equal(t, 2, len(entries))
+	assert.Equal(t, chr2, entries[0].Ref)
+	assert.Equal(t, 500, entries[0].Pos)
+	assert.True(t, entries[0].Reverse)
+	assert.Equal(t, "5S5M", entries[0].Cigar.String())
+	assert.Equal(t, byte(60), entries[0].MapQ)
+	assert.Equal(t, 1, entries[0].NM)
+	assert.Equal(t, chr1, entries[1].Ref)
+	assert.Equal(t, 200, entries[1].Pos)
+	assert.False(t, entries[1].Reverse)
+
+	entries, err = ParseSATag(header, newSARecord("B", chr1, 10, 0, ""))
+	assert.NoError(t, err)
+	assert.Nil(t, entries)
+
+	for _, bad := range []string{
+		"chr2,501,-,5S5M,60;",
+		"chr3,501,-,5S5M,60,1;",
+		"chr2,0,-,5S5M,60,1;",
+		"chr2,501,?,5S5M,60,1;",
+		"chr2,501,-,5Q,60,1;",
+		"chr2,501,-,5S5M,600,1;",
+	} {
+		_, err := ParseSATag(header, newSARecord("C", chr1, 10, 0, bad))
+		assert.Error(t, err, bad)
+	}
+}
+
+func TestGetSupplementaryAlignments(t *testing.T) {
+	// Read A is split between chr1 and chr2, and R2 of read B has a
+	// supplementary alignment in the same shard as its primary.
+	primaryA := newSARecord("A", chr1, 10, sam.Paired|sam.Read1, "chr2,501,+,5S5M,60,0;chr2,801,+,5M5S,60,0;")
+	primaryB1 := newSARecord("B", chr1, 20, sam.Paired|sam.Read1, "")
+	primaryB2 := newSARecord("B", chr1, 30, sam.Paired|sam.Read2, "chr1,41,+,5S5M,60,0;")
+	suppB2 := newSARecord("B", chr1, 40, sam.Paired|sam.Read2|sam.Supplementary, "chr1,31,+,5M5S,60,0;")
+	suppA1 := newSARecord("A", chr2, 500, sam.Paired|sam.Read1|sam.Supplementary, "chr1,11,+,5M5S,60,0;chr2,801,+,5M5S,60,0;")
+	suppA2 := newSARecord("A", chr2, 800, sam.Paired|sam.Read1|sam.Supplementary, "chr1,11,+,5M5S,60,0;chr2,501,+,5S5M,60,0;")
+	records := []*sam.Record{primaryA, primaryB1, primaryB2, suppB2, suppA1, suppA2}
+
+	for _, diskShards := range []int{0, 10} {
+		tempDir, cleanup := testutil.TempDir(t, "", "")
+		defer cleanup()
+		provider := bamprovider.NewFakeProvider(header, records)
+		shardList, err := gbam.GetPositionBasedShards(header, 100, 5, true)
+		require.NoError(t, err)
+		opts := Opts{Parallelism: 2, DiskShards: diskShards, ScratchDir: tempDir}
+		table, err := GetSupplementaryAlignments(provider, shardList, &opts)
+		require.NoError(t, err)
+
+		require.NoError(t, table.OpenShard(0))
+		supp := table.GetSupplementary(0, primaryA)
+		require.Equal(t, 2, len(supp))
+		assert.Equal(t, suppA1.String(), supp[0].String())
+		assert.Equal(t, suppA2.String(), supp[1].String())
+
+		supp = table.GetSupplementary(0, primaryB2)
+		require.Equal(t, 1, len(supp))
+		assert.Equal(t, suppB2.String(), supp[0].String())
+		assert.Equal(t, 0, len(table.GetSupplementary(0, primaryB1)))
+		table.CloseShard(0)
+
+		// A supplementary record sees the other supplementary records
+		// of the same read.
+		suppShard := 10 + 5
+		require.NoError(t, table.OpenShard(suppShard))
+		supp = table.GetSupplementary(suppShard, suppA1)
+		require.Equal(t, 1, len(supp))
+		assert.Equal(t, suppA2.String(), supp[0].String())
+		table.CloseShard(suppShard)
+		assert.NoError(t, table.Close())
+	}
+}
@@ -34,7 +34,9 @@ type BAMProvider struct {
 	Path string
 	// Index is the pathname of *.bam.bai file. If "", Path + ".bai"
 	Index string
-	err   errors.Once
+	// Filter, if non-nil, drops the records for which it returns false.
+	Filter func(r *sam.Record) bool
+	err    errors.Once
 
 	mu        sync.Mutex
 	nActive   int
@@ -260,6 +262,13 @@ func (b *BAMProvider) GenerateShards(opts GenerateShardsOpts) ([]gbam.Shard, err
 	if opts.MinBasesPerShard <= 0 {
 		opts.MinBasesPerShard = DefaultMinBasesPerShard
 	}
+	if opts.Strategy == TargetBased {
+		var estimate func(ref *sam.Reference, start, limit int) float64
+		if err := b.readIndex(); err == nil && b.bindex != nil {
+			estimate = b.indexWeight
+		}
+		return generateTargetShards(header, opts, estimate)
+	}
 	if opts.Strategy == ByteBased {
 		return gbam.GetByteBasedShards(
 			b.Path, b.indexPath(), opts.BytesPerShard, opts.MinBasesPerShard, opts.Padding, opts.IncludeUnmapped)
@@ -268,6 +277,32 @@ func (b *BAMProvider) GenerateShards(opts GenerateShardsOpts) ([]gbam.Shard, err
 		header, 100000, opts.Padding, opts.IncludeUnmapped)
 }
 
+// bgzfCompressionRatio is the assumed ratio of the uncompressed to compressed
+// size of a BGZF block.
+const bgzfCompressionRatio = 4
+
+// indexWeight estimates the compressed size of the records in range [start,
+// limit) of ref from the *.bai index. It is used as the weight function in
+// TargetBased sharding.
+//
+// REQUIRES: readIndex has succeeded and b.bindex != nil.
+func (b *BAMProvider) indexWeight(ref *sam.Reference, start, limit int) float64 {
+	chunks, err := b.bindex.Chunks(ref, start, limit)
+	if err != nil {
+		return 0
+	}
+	var size float64
+	for _, c := range chunks {
+		if c.End.File > c.Begin.File {
+			size += float64(c.End.File - c.Begin.File)
+		} else if c.End.Block > c.Begin.Block {
+			// The chunk is inside one block.
+			size += float64(c.End.Block-c.Begin.Block) / bgzfCompressionRatio
+		}
+	}
+	return size
+}
+
 // GetFileShards implements the Provider interface.
 func (b *BAMProvider) GetFileShards() ([]gbam.Shard, error) {
 	header, err := b.GetHeader()
@@ -435,7 +470,14 @@ func (i *bamIterator) Scan() bool {
 		if recAddr.LT(i.startAddr) {
 			continue
 		}
-		return recAddr.LT(i.limitAddr)
+		if !recAddr.LT(i.limitAddr) {
+			return false
+		}
+		if i.provider.Filter != nil && !i.provider.Filter(i.next) {
+			sam.PutInFreePool(i.next)
+			continue
+		}
+		return true
 	}
 }
 
@@ -0,0 +1,293 @@
+package bamprovider
+
+import (
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/Schaudge/grailbase/errors"
+	"github.com/Schaudge/grailbase/file"
+	"github.com/Schaudge/grailbase/vcontext"
+	"github.com/Schaudge/grailbio/biopb"
+	gbam "github.com/Schaudge/grailbio/encoding/bam"
+	"github.com/Schaudge/grailbio/encoding/cram"
+	"github.com/Schaudge/grailbio/encoding/fasta"
+	"github.com/Schaudge/hts/sam"
+	"v.io/x/lib/vlog"
+)
+
+// CRAMProvider implements Provider for coordinate-sorted CRAM files. Both the
+// CRAM and the index filenames are allowed to be S3 URLs.
+//
+// The provider uses the index to seek to shard boundaries. If the index does
+// not exist, the provider scans the container headers of the file once to
+// build an in-memory index.
+type CRAMProvider struct {
+	// Path of the CRAM file. Must be nonempty.
+	Path string
+	// Index is the pathname of the CRAM index. If "", Path + ".crai" is used
+	// if it exists.
+	Index string
+	// Reference is the genome that the file was written against. It must be
+	// ASCII-encoded, and may be nil if every slice embeds its reference.
+	Reference fasta.Fasta
+	// Filter, if non-nil, drops the records for which it returns false.
+	Filter func(r *sam.Record) bool
+	err    errors.Once
+
+	infoOnce sync.Once
+	header   *sam.Header
+	info     FileInfo
+
+	indexOnce sync.Once
+	index     []cram.IndexEntry
+}
+
+// cramFile is an open CRAM file.
+type cramFile struct {
+	in     file.File
+	reader *cram.Reader
+}
+
+func (s *CRAMProvider) open() (*cramFile, error) {
+	ctx := vcontext.Background()
+	in, err := file.Open(ctx, s.Path)
+	if err != nil {
+		return nil, err
+	}
+	r, err := cram.NewReader(in.Reader(ctx), s.Reference)
+	if err != nil {
+		in.Close(ctx) // nolint: errcheck
+		return nil, fmt.Errorf("%s: %v", s.Path, err)
+	}
+	return &cramFile{in: in, reader: r}, nil
+}
+
+func (f *cramFile) close() error {
+	return f.in.Close(vcontext.Background())
+}
+
+// initInfo reads the CRAM header and sets s.info and s.header.
+func (s *CRAMProvider) initInfo() {
+	s.infoOnce.Do(func() {
+		info, err := file.Stat(vcontext.Background(), s.Path)
+		if err != nil {
+			s.err.Set(err)
+			return
+		}
+		s.info = FileInfo{ModTime: info.ModTime(), Size: info.Size()}
+		f, err := s.open()
+		if err != nil {
+			s.err.Set(err)
+			return
+		}
+		s.header = f.reader.Header()
+		s.err.Set(f.close())
+	})
+}
+
+// FileInfo implements the Provider interface.
+func (s *CRAMProvider) FileInfo() (FileInfo, error) {
+	s.initInfo()
+	if err := s.err.Err(); err != nil {
+		return FileInfo{}, err
+	}
+	return s.info, nil
+}
+
+// GetHeader implements the Provider interface.
+func (s *CRAMProvider) GetHeader() (*sam.Header, error) {
+	s.initInfo()
+	if err := s.err.Err(); err != nil {
+		return nil, err
+	}
+	return s.header, nil
+}
+
+// readIndex reads the CRAM index if one exists. Otherwise it builds the index
+// by scanning the file.
+func (s *CRAMProvider) readIndex() error {
+	s.initInfo()
+	s.indexOnce.Do(func() {
+		if s.err.Err() != nil {
+			return
+		}
+		ctx := vcontext.Background()
+		path := s.Index
+		if path == "" {
+			path = s.Path + ".crai"
+			if _, err := file.Stat(ctx, path); err != nil {
+				s.err.Set(s.buildIndex())
+				return
+			}
+		}
+		in, err := file.Open(ctx, path)
+		if err != nil {
+			s.err.Set(err)
+			return
+		}
+		defer in.Close(ctx) // nolint: errcheck
+		if s.index, err = cram.ReadIndex(in.Reader(ctx)); err != nil {
+			s.err.Set(fmt.Errorf("%s: %v", path, err))
+		}
+	})
+	return s.err.Err()
+}
+
+// buildIndex sets s.index by scanning the container headers of the file.
+func (s *CRAMProvider) buildIndex() error {
+	vlog.VI(1).Infof("%s: no index found, scanning the file", s.Path)
+	ctx := vcontext.Background()
+	in, err := file.Open(ctx, s.Path)
+	if err != nil {
+		return err
+	}
+	defer in.Close(ctx) // nolint: errcheck
+	if s.index, err = cram.BuildIndex(in.Reader(ctx)); err != nil {
+		return fmt.Errorf("%s: %v", s.Path, err)
+	}
+	return nil
+}
+
+// seekOffset finds the offset of the first container that may contain
+// records at or after addr. It returns -1 if no such container exists.
+func (s *CRAMProvider) seekOffset(addr biopb.Coord) int64 {
+	off := int64(-1)
+	for _, e := range s.index {
+		end := biopb.Coord{RefId: int32(e.RefID), Pos: int32(e.Start - 1 + e.Span)}
+		if e.RefID < 0 {
+			end = biopb.Coord{RefId: biopb.UnmappedRefID}
+		}
+		if end.LT(addr) {
+			continue
+		}
+		if off < 0 || e.ContainerOffset < off {
+			off = e.ContainerOffset
+		}
+	}
+	return off
+}
+
+// GenerateShards implements the Provider interface.  The shards are position
+// based unless the TargetBased strategy is requested.
+func (s *CRAMProvider) GenerateShards(opts GenerateShardsOpts) ([]gbam.Shard, error) {
+	header, err := s.GetHeader()
+	if err != nil {
+		return nil, err
+	}
+	if opts.Strategy == TargetBased {
+		return generateTargetShards(header, opts, nil)
+	}
+	if opts.Strategy == ByteBased {
+		vlog.VI(1).Infof("%s: ByteBased sharding is not supported for CRAM, using PositionBased", s.Path)
+	}
+	return gbam.GetPositionBasedShards(header, 100000, opts.Padding, opts.IncludeUnmapped)
+}
+
+// GetFileShards implements the Provider interface.
+func (s *CRAMProvider) GetFileShards() ([]gbam.Shard, error) {
+	header, err := s.GetHeader()
+	if err != nil {
+		return nil, err
+	}
+	return []gbam.Shard{gbam.UniversalShard(header)}, nil
+}
+
+// NewIterator implements the Provider interface.
+func (s *CRAMProvider) NewIterator(shard gbam.Shard) Iterator {
+	if err := s.readIndex(); err != nil {
+		return NewErrorIterator(err)
+	}
+	iter := &cramIterator{
+		provider:  s,
+		startAddr: biopb.Coord{RefId: int32(shard.StartRef.ID()), Pos: int32(shard.PaddedStart())},
+		limitAddr: biopb.Coord{RefId: int32(shard.EndRef.ID()), Pos: int32(shard.PaddedEnd())},
+	}
+	if iter.startAddr.GE(iter.limitAddr) {
+		iter.err = fmt.Errorf("start coord (%v) not before limit coord (%v)", iter.startAddr, iter.limitAddr)
+		return iter
+	}
+	off := s.seekOffset(iter.startAddr)
+	if off < 0 {
+		iter.err = io.EOF
+		return iter
+	}
+	if iter.file, iter.err = s.open(); iter.err != nil {
+		return iter
+	}
+	if off > 0 {
+		iter.err = iter.file.reader.SeekContainer(off)
+	}
+	return iter
+}
+
+// Close implements the Provider interface.
+func (s *CRAMProvider) Close() error {
+	return s.err.Err()
+}
+
+// cramIterator implements the Iterator interface for CRAMProvider.
+type cramIterator struct {
+	provider *CRAMProvider
+	file     *cramFile
+	// Half-open coordinate range to read.
+	startAddr, limitAddr biopb.Coord
+
+	err  error
+	next *sam.Record
+}
+
+// Scan implements the Iterator interface.
+func (i *cramIterator) Scan() bool {
+	if i.err != nil {
+		return false
+	}
+	for {
+		var rec *sam.Record
+		if rec, i.err = i.file.reader.Read(); i.err != nil {
+			if i.err != io.EOF {
+				i.err = fmt.Errorf("%s: %v", i.provider.Path, i.err)
+			}
+			return false
+		}
+		recAddr := gbam.CoordFromSAMRecord(rec, 0)
+		if recAddr.LT(i.startAddr) {
+			continue
+		}
+		if !recAddr.LT(i.limitAddr) {
+			i.err = io.EOF
+			return false
+		}
+		if i.provider.Filter != nil && !i.provider.Filter(rec) {
+			continue
+		}
+		i.next = rec
+		return true
+	}
+}
+
+// Record implements the Iterator interface.
+func (i *cramIterator) Record() *sam.Record {
+	return i.next
+}
+
+// Err implements the Iterator interface.
+func (i *cramIterator) Err() error {
+	if i.err == io.EOF {
+		return nil
+	}
+	return i.err
+}
+
+// Close implements the Iterator interface.
+func (i *cramIterator) Close() error {
+	if i.file != nil {
+		if err := i.file.close(); err != nil && i.Err() == nil {
+			i.err = err
+		}
+		i.file = nil
+	}
+	err := i.Err()
+	i.provider.err.Set(err)
+	return err
+}
@@ -2,6 +2,9 @@
 // parallel.
 //
 // The Provider is an interface for reading BAM or PAM file in parallel.
+// SAMProvider implements it for plain and bgzipped SAM text files, and
+// CRAMProvider for CRAM files. MergedProvider presents several sorted files as
+// one.
 //
 // PairIterator is implemented on top of Provider to combine read pairs (R1+R2).
 package bamprovider
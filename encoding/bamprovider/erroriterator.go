@@ -1,6 +1,7 @@
 package bamprovider
 
 import (
+	gbam "github.com/Schaudge/grailbio/encoding/bam"
 	"github.com/Schaudge/hts/sam"
 )
 
@@ -18,3 +19,21 @@ func (i *errorIterator) Close() error        { return i.err }
 func NewErrorIterator(err error) Iterator {
 	return &errorIterator{err: err}
 }
+
+type errorProvider struct {
+	err error
+}
+
+func (p *errorProvider) FileInfo() (FileInfo, error)     { return FileInfo{}, p.err }
+func (p *errorProvider) GetHeader() (*sam.Header, error) { return nil, p.err }
+func (p *errorProvider) GenerateShards(GenerateShardsOpts) ([]gbam.Shard, error) {
+	return nil, p.err
+}
+func (p *errorProvider) GetFileShards() ([]gbam.Shard, error)  { return nil, p.err }
+func (p *errorProvider) NewIterator(shard gbam.Shard) Iterator { return NewErrorIterator(p.err) }
+func (p *errorProvider) Close() error                          { return p.err }
+
+// NewErrorProvider creates a Provider that fails every operation with "err".
+func NewErrorProvider(err error) Provider {
+	return &errorProvider{err: err}
+}
@@ -0,0 +1,434 @@
+package bamprovider
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Schaudge/grailbase/errors"
+	"github.com/Schaudge/grailbio/biopb"
+	gbam "github.com/Schaudge/grailbio/encoding/bam"
+	"github.com/Schaudge/hts/sam"
+	"github.com/biogo/store/llrb"
+	"v.io/x/lib/vlog"
+)
+
+// MergedProvider implements Provider for a set of coordinate-sorted files. It
+// presents the files as one sorted stream, as if they had been merged by
+// "samtools merge".
+//
+// The header is the union of the input headers. Records are rewritten so that
+// their Ref and MateRef point to the merged header. Read groups whose IDs
+// collide with a different read group of another input are renamed, and the
+// RG tags of the affected records are rewritten. An input without any read
+// group is assigned a new read group named after its file, and the RG tag is
+// set on each of its records.
+type MergedProvider struct {
+	// Paths of the input files.
+	Paths []string
+	// Providers reads the input files. Providers[i] reads Paths[i].
+	Providers []Provider
+	// Filter, if non-nil, drops the records for which it returns false. It is
+	// applied after the records are translated to the merged header.
+	Filter func(r *sam.Record) bool
+	err    errors.Once
+
+	headerOnce sync.Once
+	header     *sam.Header
+	// refMaps[i][id] is the merged reference for reference id of input i.
+	refMaps [][]*sam.Reference
+	// inputRefs[i][id] is the reference of input i for merged reference id,
+	// or nil if input i does not have it.
+	inputRefs [][]*sam.Reference
+	// rgNames[i] maps the read group IDs of input i to the merged IDs. It is
+	// nil if no read group of input i is renamed.
+	rgNames []map[string]string
+	// rgTags[i] is the RG tag to set on every record of input i, or nil.
+	rgTags []sam.Aux
+}
+
+// NewMergedProvider creates a MergedProvider that reads the given
+// coordinate-sorted files. The file types are autodetected as in NewProvider.
+// ProviderOpts.Index is ignored, since each file has its own index.
+// ProviderOpts.Filter is applied to the merged records, so it sees the
+// references and read groups of the merged header.
+func NewMergedProvider(paths []string, optList ...ProviderOpts) Provider {
+	opts := mergeOpts(optList)
+	opts.Index = ""
+	p := &MergedProvider{Paths: paths, Filter: opts.Filter}
+	opts.Filter = nil
+	for _, path := range paths {
+		p.Providers = append(p.Providers, NewProvider(path, opts))
+	}
+	return p
+}
+
+// readGroupName derives a read group ID from a pathname.
+func readGroupName(path string) string {
+	name := filepath.Base(path)
+	for _, ext := range []string{".gz", ".bgz", ".bam", ".pam", ".sam", ".cram"} {
+		name = strings.TrimSuffix(name, ext)
+	}
+	return name
+}
+
+// initHeader merges the input headers.
+func (m *MergedProvider) initHeader() {
+	m.headerOnce.Do(func() {
+		if len(m.Providers) == 0 || len(m.Providers) != len(m.Paths) {
+			m.err.Set(fmt.Errorf("MergedProvider: got %d providers for %d paths", len(m.Providers), len(m.Paths)))
+			return
+		}
+		headers := make([]*sam.Header, len(m.Providers))
+		for i, p := range m.Providers {
+			var err error
+			if headers[i], err = p.GetHeader(); err != nil {
+				m.err.Set(err)
+				return
+			}
+		}
+		var err error
+		if m.header, m.refMaps, err = sam.MergeHeaders(headers); err != nil {
+			m.err.Set(err)
+			return
+		}
+		if len(headers) == 1 {
+			m.header = headers[0].Clone()
+			m.refMaps = [][]*sam.Reference{m.header.Refs()}
+		}
+		m.header.SortOrder = sam.Coordinate
+		if err := m.checkRefOrder(headers); err != nil {
+			m.err.Set(err)
+			return
+		}
+		m.err.Set(m.mergeReadGroups(headers))
+	})
+}
+
+// checkRefOrder verifies that the references shared by the inputs appear in
+// the same order in every input, and fills m.inputRefs.
+func (m *MergedProvider) checkRefOrder(headers []*sam.Header) error {
+	nRefs := len(m.header.Refs())
+	m.inputRefs = make([][]*sam.Reference, len(headers))
+	for i, h := range headers {
+		m.inputRefs[i] = make([]*sam.Reference, nRefs)
+		last := -1
+		for id, ref := range h.Refs() {
+			merged := m.refMaps[i][id]
+			if merged.ID() <= last {
+				return fmt.Errorf("%s: reference %s appears in a different order than in %s",
+					m.Paths[i], ref.Name(), m.Paths[0])
+			}
+			last = merged.ID()
+			m.inputRefs[i][merged.ID()] = ref
+		}
+	}
+	return nil
+}
+
+// mergeReadGroups adds the read groups of all the inputs to m.header.
+func (m *MergedProvider) mergeReadGroups(headers []*sam.Header) error {
+	m.rgNames = make([]map[string]string, len(headers))
+	m.rgTags = make([]sam.Aux, len(headers))
+	existing := map[string]*sam.ReadGroup{}
+	for _, rg := range m.header.RGs() {
+		existing[rg.Name()] = rg
+	}
+	// uniqueName returns a read group ID not used by any input.
+	uniqueName := func(name string, i int) string {
+		for k := i; ; k++ {
+			n := fmt.Sprintf("%s.%d", name, k)
+			if _, ok := existing[n]; !ok {
+				return n
+			}
+		}
+	}
+	for i, h := range headers {
+		if len(h.RGs()) == 0 {
+			name := readGroupName(m.Paths[i])
+			if _, ok := existing[name]; ok {
+				name = uniqueName(name, i)
+			}
+			rg, err := sam.NewReadGroup(name, "", "", "", "", "", "", "", "", "", time.Time{}, 0)
+			if err != nil {
+				return err
+			}
+			if err := m.header.AddReadGroup(rg); err != nil {
+				return err
+			}
+			existing[name] = rg
+			if m.rgTags[i], err = sam.NewAux(sam.NewTag("RG"), name); err != nil {
+				return err
+			}
+			vlog.VI(1).Infof("%s: assigned read group %s", m.Paths[i], name)
+			continue
+		}
+		if i == 0 {
+			// The read groups of the first input are already in m.header.
+			continue
+		}
+		for _, rg := range h.RGs() {
+			name := rg.Name()
+			if e, ok := existing[name]; ok {
+				if e.String() == rg.String() {
+					// The same read group appears in multiple inputs.
+					continue
+				}
+				name = uniqueName(name, i)
+				if m.rgNames[i] == nil {
+					m.rgNames[i] = map[string]string{}
+				}
+				m.rgNames[i][rg.Name()] = name
+				vlog.VI(1).Infof("%s: renamed read group %s to %s", m.Paths[i], rg.Name(), name)
+			}
+			newRG := rg.Clone()
+			if err := newRG.SetName(name); err != nil {
+				return err
+			}
+			if err := m.header.AddReadGroup(newRG); err != nil {
+				return err
+			}
+			existing[name] = newRG
+		}
+	}
+	return nil
+}
+
+// remap rewrites a record read from input i to use the merged header.
+func (m *MergedProvider) remap(i int, r *sam.Record) {
+	if r.Ref != nil {
+		r.Ref = m.refMaps[i][r.Ref.ID()]
+	}
+	if r.MateRef != nil {
+		r.MateRef = m.refMaps[i][r.MateRef.ID()]
+	}
+	if tag := m.rgTags[i]; tag != nil {
+		for k, aux := range r.AuxFields {
+			if aux.Tag() == tag.Tag() {
+				r.AuxFields[k] = tag
+				return
+			}
+		}
+		r.AuxFields = append(r.AuxFields, tag)
+		return
+	}
+	if names := m.rgNames[i]; names != nil {
+		for k, aux := range r.AuxFields {
+			if aux.Tag() != sam.NewTag("RG") {
+				continue
+			}
+			old, ok := aux.Value().(string)
+			if !ok {
+				continue
+			}
+			if name, ok := names[old]; ok {
+				if newAux, err := sam.NewAux(aux.Tag(), name); err == nil {
+					r.AuxFields[k] = newAux
+				}
+			}
+		}
+	}
+}
+
+// FileInfo implements the Provider interface. ModTime is the latest modtime
+// of the inputs, and Size is the sum of their sizes.
+func (m *MergedProvider) FileInfo() (FileInfo, error) {
+	var info FileInfo
+	for _, p := range m.Providers {
+		i, err := p.FileInfo()
+		if err != nil {
+			return FileInfo{}, err
+		}
+		if i.ModTime.After(info.ModTime) {
+			info.ModTime = i.ModTime
+		}
+		info.Size += i.Size
+	}
+	return info, nil
+}
+
+// GetHeader implements the Provider interface.
+func (m *MergedProvider) GetHeader() (*sam.Header, error) {
+	m.initHeader()
+	if err := m.err.Err(); err != nil {
+		return nil, err
+	}
+	return m.header, nil
+}
+
+// GenerateShards implements the Provider interface.  The shards are position
+// based unless the TargetBased strategy is requested.
+func (m *MergedProvider) GenerateShards(opts GenerateShardsOpts) ([]gbam.Shard, error) {
+	header, err := m.GetHeader()
+	if err != nil {
+		return nil, err
+	}
+	if opts.Strategy == TargetBased {
+		return generateTargetShards(header, opts, nil)
+	}
+	if opts.Strategy == ByteBased {
+		vlog.VI(1).Infof("ByteBased sharding is not supported for merged files, using PositionBased")
+	}
+	return gbam.GetPositionBasedShards(header, 100000, opts.Padding, opts.IncludeUnmapped)
+}
+
+// GetFileShards implements the Provider interface.
+func (m *MergedProvider) GetFileShards() ([]gbam.Shard, error) {
+	header, err := m.GetHeader()
+	if err != nil {
+		return nil, err
+	}
+	return []gbam.Shard{gbam.UniversalShard(header)}, nil
+}
+
+// inputPos translates a position in the merged header to a position in input
+// i. If input i does not have the reference, the position is moved to the
+// start of the next reference that it has, or to the unmapped reads.
+func (m *MergedProvider) inputPos(i int, ref *sam.Reference, pos int) (*sam.Reference, int, bool) {
+	if ref == nil {
+		return nil, pos, true
+	}
+	refs := m.inputRefs[i]
+	if r := refs[ref.ID()]; r != nil {
+		return r, pos, true
+	}
+	for id := ref.ID() + 1; id < len(refs); id++ {
+		if refs[id] != nil {
+			return refs[id], 0, false
+		}
+	}
+	return nil, 0, false
+}
+
+// inputShard translates a shard of the merged header to a shard of input i.
+// It returns false if the shard is empty in input i.
+func (m *MergedProvider) inputShard(i int, shard gbam.Shard) (gbam.Shard, bool) {
+	s := gbam.Shard{ShardIdx: shard.ShardIdx}
+	var exact bool
+	if s.StartRef, s.Start, exact = m.inputPos(i, shard.StartRef, shard.PaddedStart()); exact {
+		s.StartSeq = shard.StartSeq
+	}
+	if s.EndRef, s.End, exact = m.inputPos(i, shard.EndRef, shard.PaddedEnd()); exact {
+		s.EndSeq = shard.EndSeq
+	}
+	start := biopb.Coord{RefId: int32(s.StartRef.ID()), Pos: int32(s.Start), Seq: int32(s.StartSeq)}
+	end := biopb.Coord{RefId: int32(s.EndRef.ID()), Pos: int32(s.End), Seq: int32(s.EndSeq)}
+	return s, start.LT(end)
+}
+
+// NewIterator implements the Provider interface.
+func (m *MergedProvider) NewIterator(shard gbam.Shard) Iterator {
+	if _, err := m.GetHeader(); err != nil {
+		return NewErrorIterator(err)
+	}
+	iter := &mergedIterator{provider: m}
+	for i, p := range m.Providers {
+		s, ok := m.inputShard(i, shard)
+		if !ok {
+			continue
+		}
+		in := &mergedInput{idx: i, iter: p.NewIterator(s)}
+		iter.inputs = append(iter.inputs, in)
+		if iter.advance(in) {
+			iter.tree.Insert(in)
+		}
+	}
+	return iter
+}
+
+// Close implements the Provider interface.
+func (m *MergedProvider) Close() error {
+	for _, p := range m.Providers {
+		m.err.Set(p.Close())
+	}
+	return m.err.Err()
+}
+
+// mergedInput is an iterator over one input of a MergedProvider.
+type mergedInput struct {
+	idx   int
+	iter  Iterator
+	rec   *sam.Record
+	coord biopb.Coord
+}
+
+// Compare implements llrb.Comparable. Records at the same coordinate are
+// ordered by the input index.
+func (in *mergedInput) Compare(c llrb.Comparable) int {
+	in1 := c.(*mergedInput)
+	if c := in.coord.Compare(in1.coord); c != 0 {
+		return c
+	}
+	return in.idx - in1.idx
+}
+
+// mergedIterator implements the Iterator interface for MergedProvider. It
+// merges the inputs using a binary tree keyed by the coordinate of the next
+// record of each input.
+type mergedIterator struct {
+	provider *MergedProvider
+	inputs   []*mergedInput
+	tree     llrb.Tree
+	cur      *mergedInput // the input that produced the current record.
+	err      error
+}
+
+// advance reads the next record of the input. It returns false at the end of
+// the input or on error.
+func (i *mergedIterator) advance(in *mergedInput) bool {
+	for {
+		if !in.iter.Scan() {
+			if err := in.iter.Err(); err != nil && i.err == nil {
+				i.err = err
+			}
+			return false
+		}
+		in.rec = in.iter.Record()
+		i.provider.remap(in.idx, in.rec)
+		if i.provider.Filter != nil && !i.provider.Filter(in.rec) {
+			continue
+		}
+		in.coord = gbam.CoordFromSAMRecord(in.rec, 0)
+		return true
+	}
+}
+
+// Scan implements the Iterator interface.
+func (i *mergedIterator) Scan() bool {
+	if i.cur != nil {
+		if i.advance(i.cur) {
+			i.tree.Insert(i.cur)
+		}
+		i.cur = nil
+	}
+	if i.err != nil || i.tree.Len() == 0 {
+		return false
+	}
+	i.cur = i.tree.Min().(*mergedInput)
+	i.tree.DeleteMin()
+	return true
+}
+
+// Record implements the Iterator interface.
+func (i *mergedIterator) Record() *sam.Record {
+	return i.cur.rec
+}
+
+// Err implements the Iterator interface.
+func (i *mergedIterator) Err() error {
+	return i.err
+}
+
+// Close implements the Iterator interface.
+func (i *mergedIterator) Close() error {
+	for _, in := range i.inputs {
+		if err := in.iter.Close(); err != nil && i.err == nil {
+			i.err = err
+		}
+	}
+	i.inputs = nil
+	i.provider.err.Set(i.err)
+	return i.err
+}
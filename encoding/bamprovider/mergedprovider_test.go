@@ -0,0 +1,139 @@
+package bamprovider_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+
+	gbam "github.com/Schaudge/grailbio/encoding/bam"
+	"github.com/Schaudge/grailbio/encoding/bamprovider"
+	"github.com/Schaudge/hts/sam"
+	"github.com/grailbio/testutil"
+	"github.com/grailbio/testutil/assert"
+	"github.com/grailbio/testutil/expect"
+)
+
+type mergeTestRead struct {
+	name string
+	ref  string // "" for unmapped
+	pos  int
+}
+
+// writeMergeTestSAM writes a sorted SAM file with the given references and
+// reads. If rgLib is nonempty, the file has a read group "rg1" with the given
+// library, and each read is tagged with it.
+func writeMergeTestSAM(t *testing.T, path string, refNames []string, rgLib string, reads []mergeTestRead) {
+	refs := map[string]*sam.Reference{}
+	var refList []*sam.Reference
+	for _, name := range refNames {
+		ref, err := sam.NewReference(name, "", "", 1000000, nil, nil)
+		assert.NoError(t, err)
+		refs[name] = ref
+		refList = append(refList, ref)
+	}
+	header, err := sam.NewHeader(nil, refList)
+	assert.NoError(t, err)
+	header.SortOrder = sam.Coordinate
+	if rgLib != "" {
+		rg, err := sam.NewReadGroup("rg1", "", "", rgLib, "", "", "", "", "", "", time.Time{}, 0)
+		assert.NoError(t, err)
+		assert.NoError(t, header.AddReadGroup(rg))
+	}
+	text, err := header.MarshalText()
+	assert.NoError(t, err)
+	lines := [][]byte{text}
+	for _, read := range reads {
+		ref := refs[read.ref]
+		r := newRecord(read.name, ref, read.pos, ref, read.pos, 0)
+		if ref == nil {
+			r.Pos, r.MatePos, r.Flags = -1, -1, sam.Unmapped
+		}
+		if rgLib != "" {
+			aux, err := sam.NewAux(sam.NewTag("RG"), "rg1")
+			assert.NoError(t, err)
+			r.AuxFields = append(r.AuxFields, aux)
+		}
+		line, err := r.MarshalText()
+		assert.NoError(t, err)
+		lines = append(lines, append(line, '\n'))
+	}
+	assert.NoError(t, ioutil.WriteFile(path, bytes.Join(lines, nil), 0644))
+}
+
+func TestMergedProvider(t *testing.T) {
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+
+	pathA := filepath.Join(tempDir, "a.sam")
+	writeMergeTestSAM(t, pathA, []string{"chr8", "chr9"}, "libA", []mergeTestRead{
+		{"a0", "chr8", 100}, {"a1", "chr8", 300}, {"a2", "chr9", 50}, {"a3", "", 0}})
+	// b.sam has a read group with the same ID as a.sam, but a different
+	// library, and an extra reference.
+	pathB := filepath.Join(tempDir, "b.sam")
+	writeMergeTestSAM(t, pathB, []string{"chr9", "chr10"}, "libB", []mergeTestRead{
+		{"b0", "chr9", 50}, {"b1", "chr9", 200}, {"b2", "chr10", 10}})
+	// c.sam has no read group.
+	pathC := filepath.Join(tempDir, "c.sam")
+	writeMergeTestSAM(t, pathC, []string{"chr8"}, "", []mergeTestRead{
+		{"c0", "chr8", 200}})
+
+	p := bamprovider.NewMergedProvider([]string{pathA, pathB, pathC})
+	header, err := p.GetHeader()
+	assert.NoError(t, err)
+	var refNames []string
+	for _, ref := range header.Refs() {
+		refNames = append(refNames, ref.Name())
+	}
+	expect.EQ(t, refNames, []string{"chr8", "chr9", "chr10"})
+	rgs := map[string]string{}
+	for _, rg := range header.RGs() {
+		rgs[rg.Name()] = rg.Get(sam.NewTag("LB"))
+	}
+	expect.EQ(t, rgs, map[string]string{"rg1": "libA", "rg1.1": "libB", "c": ""})
+
+	expected := []string{"a0", "c0", "a1", "a2", "b0", "b1", "b2", "a3"}
+	expect.EQ(t, readAllShards(t, p), expected)
+
+	iter := bamprovider.NewRefIterator(p, "chr9", 0, 100)
+	expect.EQ(t, readIterator(iter), []string{"a2", "b0"})
+	assert.NoError(t, iter.Close())
+	// chr10 exists only in b.sam.
+	iter = bamprovider.NewRefIterator(p, "chr10", 0, 1000)
+	expect.EQ(t, readIterator(iter), []string{"b2"})
+	assert.NoError(t, iter.Close())
+
+	// Check that the records refer to the merged header, and that their read
+	// groups are rewritten.
+	iter = p.NewIterator(gbam.UniversalShard(header))
+	rgTag := sam.NewTag("RG")
+	for iter.Scan() {
+		r := iter.Record()
+		if r.Ref != nil {
+			expect.EQ(t, header.Refs()[r.Ref.ID()], r.Ref, "record %s", r.Name)
+			expect.EQ(t, header.Refs()[r.MateRef.ID()], r.MateRef, "record %s", r.Name)
+		}
+		rg := r.AuxFields.Get(rgTag)
+		assert.NotNil(t, rg, "record %s", r.Name)
+		expectedRG := map[byte]string{'a': "rg1", 'b': "rg1.1", 'c': "c"}[r.Name[0]]
+		expect.EQ(t, rg.Value(), expectedRG, "record %s", r.Name)
+	}
+	assert.NoError(t, iter.Close())
+	assert.NoError(t, p.Close())
+}
+
+func TestMergedProviderConflictingRefOrder(t *testing.T) {
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+
+	pathA := filepath.Join(tempDir, "a.sam")
+	writeMergeTestSAM(t, pathA, []string{"chr8", "chr9"}, "", []mergeTestRead{{"a0", "chr8", 100}})
+	pathB := filepath.Join(tempDir, "b.sam")
+	writeMergeTestSAM(t, pathB, []string{"chr9", "chr8"}, "", []mergeTestRead{{"b0", "chr9", 100}})
+
+	p := bamprovider.NewMergedProvider([]string{pathA, pathB})
+	_, err := p.GetHeader()
+	expect.HasSubstr(t, err.Error(), "different order")
+	expect.NotNil(t, p.Close())
+}
@@ -28,6 +28,9 @@ type PAMProvider struct {
 	header  *sam.Header        // extracted from <dir>/<range>.index.
 	info    FileInfo           // extracted from <dir>/<range>.index.
 	indexes []pamutil.FileInfo // files found in the pam directory.
+	// unsorted is set if the records are not sorted by coordinate
+	// (pam.WriteOpts.Unsorted). Such a file can only be read as a whole.
+	unsorted bool
 }
 
 // pamIterator implements the Iterator interface.
@@ -74,6 +77,12 @@ func (p *PAMProvider) initInfo() {
 		p.err.Set(err)
 		return
 	}
+	features, err := pamutil.ParseShardVersion(index.Version)
+	if err != nil {
+		p.err.Set(err)
+		return
+	}
+	p.unsorted = features.Unsorted
 	p.header, err = gbam.UnmarshalHeader(index.EncodedBamHeader)
 	if err != nil {
 		p.err.Set(err)
@@ -102,6 +111,22 @@ func (p *PAMProvider) Close() error {
 
 // GenerateShards implements the Provider interface.
 func (p *PAMProvider) GenerateShards(opts GenerateShardsOpts) ([]gbam.Shard, error) {
+	if header, err := p.GetHeader(); err != nil {
+		return nil, err
+	} else if p.unsorted {
+		// p.unsorted is constant after initInfo, so it's ok to read it unlocked.
+		if opts.Strategy == TargetBased || !opts.IncludeUnmapped {
+			return nil, fmt.Errorf("GenerateShards %s: the records are not sorted by coordinate, so the file can only be read as a whole", p.Path)
+		}
+		return []gbam.Shard{gbam.UniversalShard(header)}, nil
+	}
+	if opts.Strategy == TargetBased {
+		header, err := p.GetHeader()
+		if err != nil {
+			return nil, err
+		}
+		return generateTargetShards(header, opts, nil)
+	}
 	if opts.Strategy != Automatic && opts.Strategy != ByteBased {
 		return nil, fmt.Errorf("GenerateShards: strategy %v not supported", opts.Strategy)
 	}
@@ -174,6 +199,10 @@ func (p *PAMProvider) NewIterator(shard gbam.Shard) Iterator {
 	// specified.
 	opts.Range.Start = biopb.Coord{int32(shard.StartRef.ID()), int32(shard.PaddedStart()), int32(shard.StartSeq)}
 	opts.Range.Limit = biopb.Coord{int32(shard.EndRef.ID()), int32(shard.PaddedEnd()), int32(shard.EndSeq)}
+	if p.initInfo(); p.unsorted {
+		// The file has a single shard, which can only be read as a whole.
+		opts.Range = biopb.CoordRange{}
+	}
 	return &pamIterator{
 		provider: p,
 		reader:   pam.NewReader(opts, p.Path),
@@ -5,9 +5,12 @@ import (
 	"time"
 
 	"github.com/Schaudge/grailbase/vcontext"
+	"github.com/Schaudge/grailbio/biopb"
 	gbam "github.com/Schaudge/grailbio/encoding/bam"
+	"github.com/Schaudge/grailbio/encoding/fasta"
 	"github.com/Schaudge/grailbio/encoding/pam"
 	"github.com/Schaudge/grailbio/encoding/pam/pamutil"
+	"github.com/Schaudge/grailbio/interval"
 	"github.com/Schaudge/hts/sam"
 	"v.io/x/lib/vlog"
 )
@@ -15,12 +18,33 @@ import (
 // ProviderOpts defines options for NewProvider.
 type ProviderOpts struct {
 	// Index specifies the name of the BAM inde file. This field is meaningful
-	// only for BAM files. If Index=="", it defaults to path + ".bai".
+	// only for BAM, SAM and CRAM files. If Index=="", it defaults to path +
+	// ".bai" for BAM, path + ".tbi" for bgzipped SAM, and path + ".crai" for
+	// CRAM.
 	Index string
 
 	// DropFields causes the listed fields not to be filled in sam.Record. This
 	// option is recognized only by the PAM reader.
 	DropFields []gbam.FieldType
+
+	// Reference is the genome used to decode CRAM files, and PAM files whose
+	// seq field is encoded with a reference (pam.WriteOpts.Reference). It must
+	// be ASCII-encoded (the default of fasta.New). It is ignored for other file
+	// types.
+	Reference fasta.Fasta
+
+	// BlockFilter is passed to pam.ReadOpts.BlockFilter. It lets the PAM reader
+	// skip blocks that cannot contain interesting records. Records are not
+	// filtered individually, so the caller must still check each record. This
+	// option is recognized only by the PAM reader.
+	BlockFilter func(stats *biopb.PAMBlockStats) bool
+
+	// Filter, if non-nil, is called for each record read. Records for which it
+	// returns false are not returned by Iterator.Scan. The PAM reader calls the
+	// filter before decoding the variable-length fields; see
+	// pam.ReadOpts.Filter for the fields visible to it. The other readers call
+	// it after decoding the whole record.
+	Filter func(r *sam.Record) bool
 }
 
 // ShardingStrategy defines algorithms used by Provider.GenerateShards.
@@ -38,6 +62,10 @@ const (
 	// uniform width - i.e., value of (limitpos - startpos) is uniform across
 	// shards.
 	PositionBased
+	// TargetBased strategy creates shards that cover only the regions listed in
+	// GenerateShardsOpts.Targets, such that each shard has roughly equal amount
+	// of work. Untargeted regions are skipped.
+	TargetBased
 )
 
 // GenerateShardsOpts defines behavior of Provider.GenerateShards.
@@ -77,6 +105,16 @@ type GenerateShardsOpts struct {
 	// MinBasesPerShard defines the nimimum number of bases in each shard. This is
 	// consulted only in ByteBased sharding strategy.
 	MinBasesPerShard int
+
+	// Targets lists the regions to be covered by the shards. It is required by,
+	// and consulted only in, TargetBased sharding strategy.
+	Targets *interval.BEDUnion
+
+	// TargetWeight estimates the amount of work needed to process the range
+	// [start, limit) of ref. It is consulted only in TargetBased sharding
+	// strategy. If nil, the weight is estimated from the BAM index when one is
+	// available, and is the length of the range otherwise.
+	TargetWeight func(ref *sam.Reference, start, limit int) float64
 }
 
 // Provider allows reading BAM or PAM file in parallel. Thread safe.
@@ -175,6 +213,10 @@ const (
 	BAM
 	// PAM file
 	PAM
+	// SAM file, either plain text or bgzipped.
+	SAM
+	// CRAM file
+	CRAM
 )
 
 // ParseFileType parses the file type string. "bam" returns bamprovider.BAM, for
@@ -185,6 +227,10 @@ func ParseFileType(name string) FileType {
 		return BAM
 	case "pam":
 		return PAM
+	case "sam":
+		return SAM
+	case "cram":
+		return CRAM
 	default:
 		return Unknown
 	}
@@ -196,6 +242,12 @@ func GuessFileType(path string) FileType {
 	if strings.HasSuffix(path, ".bam") {
 		return BAM
 	}
+	if isSAMPath(path) {
+		return SAM
+	}
+	if strings.HasSuffix(path, ".cram") {
+		return CRAM
+	}
 	if strings.Contains(path, ".pam") {
 		return PAM
 	}
@@ -214,19 +266,39 @@ func mergeOpts(optList []ProviderOpts) ProviderOpts {
 			opts.Index = o.Index
 		}
 		opts.DropFields = append(opts.DropFields, o.DropFields...)
+		if o.Reference != nil {
+			opts.Reference = o.Reference
+		}
+		if o.BlockFilter != nil {
+			opts.BlockFilter = o.BlockFilter
+		}
+		if o.Filter != nil {
+			opts.Filter = o.Filter
+		}
 	}
 	return opts
 }
 
-// NewProvider creates a Provider object that can handle BAM or PAM file of
+// NewProvider creates a Provider object that can handle BAM, PAM, SAM or CRAM file of
 // "path". The file type is autodetected from the path.
 func NewProvider(path string, optList ...ProviderOpts) Provider {
 	opts := mergeOpts(optList)
 	switch GuessFileType(path) {
 	case BAM, Unknown:
-		return &BAMProvider{Path: path, Index: opts.Index}
+		return &BAMProvider{Path: path, Index: opts.Index, Filter: opts.Filter}
 	case PAM:
-		return &PAMProvider{Path: path, Opts: pam.ReadOpts{DropFields: opts.DropFields}}
+		return &PAMProvider{Path: path, Opts: pam.ReadOpts{
+			DropFields:  opts.DropFields,
+			Reference:   opts.Reference,
+			BlockFilter: opts.BlockFilter,
+			Filter:      opts.Filter,
+			// Shared by the readers of all the shards of the provider.
+			ReferenceM5Cache: pamutil.NewReferenceM5Cache(),
+		}}
+	case SAM:
+		return &SAMProvider{Path: path, Index: opts.Index, Filter: opts.Filter}
+	case CRAM:
+		return &CRAMProvider{Path: path, Index: opts.Index, Reference: opts.Reference, Filter: opts.Filter}
 	}
 	panic("shouldn't reach here")
 }
@@ -13,7 +13,6 @@ import (
 	"sync"
 	"testing"
 
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/Schaudge/grailbase/file"
 	"github.com/Schaudge/grailbase/file/s3file"
 	"github.com/Schaudge/grailbase/grail"
@@ -33,7 +32,7 @@ import (
 func TestMain(m *testing.M) {
 	shutdown := grail.Init()
 	file.RegisterImplementation("s3", func() file.Implementation {
-		return s3file.NewImplementation(s3file.NewDefaultProvider(session.Options{}), s3file.Options{})
+		return s3file.NewImplementation(s3file.NewDefaultProvider(), s3file.Options{})
 	})
 	status := m.Run()
 	shutdown()
@@ -0,0 +1,566 @@
+package bamprovider
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/Schaudge/grailbase/errors"
+	"github.com/Schaudge/grailbase/file"
+	"github.com/Schaudge/grailbase/vcontext"
+	"github.com/Schaudge/grailbio/biopb"
+	gbam "github.com/Schaudge/grailbio/encoding/bam"
+	"github.com/Schaudge/hts/bgzf"
+	"github.com/Schaudge/hts/bgzf/index"
+	"github.com/Schaudge/hts/sam"
+	"github.com/Schaudge/hts/tabix"
+	"v.io/x/lib/vlog"
+)
+
+const (
+	// samCheckpointInterval is the number of records between two
+	// consecutive entries of the in-memory index built by scanning a SAM
+	// file.
+	samCheckpointInterval = 4096
+	// samPlainChunkSize is the size of reads issued against a plain-text
+	// SAM file.
+	samPlainChunkSize = 1 << 20
+)
+
+// SAMProvider implements Provider for coordinate-sorted SAM text files.  The
+// file may be either plain text or compressed with bgzip (*.sam.gz).  Both the
+// SAM and the index filenames are allowed to be S3 URLs.
+//
+// If Index names a tabix index, or if Path is bgzipped and Path + ".tbi"
+// exists, the provider uses the index to seek to shard boundaries. Otherwise
+// it scans the whole file once, when the first iterator is created, and builds
+// an in-memory index of record offsets.
+type SAMProvider struct {
+	// Path of the SAM file. Must be nonempty.
+	Path string
+	// Index is the pathname of the tabix index. If "", Path + ".tbi" is used
+	// if it exists.
+	Index string
+	// Filter, if non-nil, drops the records for which it returns false.
+	Filter func(r *sam.Record) bool
+	err    errors.Once
+
+	infoOnce  sync.Once
+	header    *sam.Header
+	info      FileInfo
+	bgzipped  bool
+	firstLine bgzf.Offset // offset of the first alignment line.
+
+	indexOnce   sync.Once
+	tindex      *tabix.Index
+	checkpoints []samCheckpoint
+}
+
+// samCheckpoint is an entry of the index built by scanning the SAM file.
+type samCheckpoint struct {
+	coord biopb.Coord // coordinate of the record that starts at off.
+	off   bgzf.Offset
+}
+
+// samLineReader reads lines from a plain or bgzipped SAM file, and reports the
+// offset of the start of each line. For a plain file, offsets have Block=0 and
+// File set to the byte offset in the file.
+type samLineReader struct {
+	in  file.File
+	rs  io.ReadSeeker
+	bg  *bgzf.Reader // nil for a plain file.
+	buf []byte
+
+	cur    []byte      // unread part of the current chunk.
+	curOff bgzf.Offset // offset of cur[0].
+	line   []byte      // holds a line that spans chunks.
+}
+
+func newSAMLineReader(path string, bgzipped bool) (*samLineReader, error) {
+	ctx := vcontext.Background()
+	in, err := file.Open(ctx, path)
+	if err != nil {
+		return nil, err
+	}
+	r := &samLineReader{in: in, rs: in.Reader(ctx)}
+	if bgzipped {
+		if r.bg, err = bgzf.NewReader(r.rs, 1); err != nil {
+			in.Close(ctx) // nolint: errcheck
+			return nil, err
+		}
+		// Make Read stop at block boundaries so that offsets of lines can be
+		// computed within each block.
+		r.bg.Blocked = true
+		r.buf = make([]byte, 1<<16)
+	} else {
+		r.buf = make([]byte, samPlainChunkSize)
+	}
+	return r, nil
+}
+
+// nextChunk reads the next chunk of data into r.cur.
+func (r *samLineReader) nextChunk() error {
+	if r.bg == nil {
+		n, err := r.rs.Read(r.buf)
+		r.cur = r.buf[:n]
+		if n > 0 {
+			return nil
+		}
+		if err == nil {
+			err = io.ErrNoProgress
+		}
+		return err
+	}
+	// Read returns io.EOF at the end of each block since bg.Blocked is set.
+	n, err := r.bg.Read(r.buf)
+	if n == 0 {
+		if err == nil {
+			err = io.ErrNoProgress
+		}
+		return err
+	}
+	r.cur = r.buf[:n]
+	r.curOff = r.bg.LastChunk().Begin
+	return nil
+}
+
+func (r *samLineReader) advance(n int) {
+	r.cur = r.cur[n:]
+	if r.bg == nil {
+		r.curOff.File += int64(n)
+	} else {
+		r.curOff.Block += uint16(n)
+	}
+}
+
+// readLine reads the next line, without the trailing newline. The returned
+// slice is valid until the next call to readLine. It returns io.EOF at the end
+// of the file.
+func (r *samLineReader) readLine() ([]byte, bgzf.Offset, error) {
+	if len(r.cur) == 0 {
+		if err := r.nextChunk(); err != nil {
+			return nil, bgzf.Offset{}, err
+		}
+	}
+	off := r.curOff
+	if i := bytes.IndexByte(r.cur, '\n'); i >= 0 {
+		line := r.cur[:i]
+		r.advance(i + 1)
+		return line, off, nil
+	}
+	r.line = append(r.line[:0], r.cur...)
+	r.advance(len(r.cur))
+	for {
+		if err := r.nextChunk(); err != nil {
+			if err == io.EOF && len(r.line) > 0 {
+				return r.line, off, nil
+			}
+			return nil, bgzf.Offset{}, err
+		}
+		if i := bytes.IndexByte(r.cur, '\n'); i >= 0 {
+			r.line = append(r.line, r.cur[:i]...)
+			r.advance(i + 1)
+			return r.line, off, nil
+		}
+		r.line = append(r.line, r.cur...)
+		r.advance(len(r.cur))
+	}
+}
+
+// seek moves the reader to the given offset.
+func (r *samLineReader) seek(off bgzf.Offset) error {
+	r.cur = nil
+	if r.bg == nil {
+		r.curOff = bgzf.Offset{File: off.File}
+		_, err := r.rs.Seek(off.File, io.SeekStart)
+		return err
+	}
+	r.curOff = off
+	return r.bg.Seek(off)
+}
+
+func (r *samLineReader) close() error {
+	var err error
+	if r.bg != nil {
+		err = r.bg.Close()
+	}
+	if e := r.in.Close(vcontext.Background()); e != nil && err == nil {
+		err = e
+	}
+	return err
+}
+
+// isBGZF checks if the file starts with the gzip magic.
+func isBGZF(path string) (bool, error) {
+	ctx := vcontext.Background()
+	in, err := file.Open(ctx, path)
+	if err != nil {
+		return false, err
+	}
+	defer in.Close(ctx) // nolint: errcheck
+	var magic [2]byte
+	n, err := io.ReadFull(in.Reader(ctx), magic[:])
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return false, err
+	}
+	return n == 2 && magic[0] == 0x1f && magic[1] == 0x8b, nil
+}
+
+// initInfo reads the SAM header and sets s.info and s.header.
+func (s *SAMProvider) initInfo() {
+	s.infoOnce.Do(func() {
+		ctx := vcontext.Background()
+		info, err := file.Stat(ctx, s.Path)
+		if err != nil {
+			s.err.Set(err)
+			return
+		}
+		s.info = FileInfo{ModTime: info.ModTime(), Size: info.Size()}
+		if s.bgzipped, err = isBGZF(s.Path); err != nil {
+			s.err.Set(err)
+			return
+		}
+		r, err := newSAMLineReader(s.Path, s.bgzipped)
+		if err != nil {
+			s.err.Set(err)
+			return
+		}
+		defer func() {
+			if err := r.close(); err != nil {
+				s.err.Set(err)
+			}
+		}()
+		var text []byte
+		for {
+			line, off, err := r.readLine()
+			if err == io.EOF || (err == nil && !bytes.HasPrefix(line, []byte("@"))) {
+				s.firstLine = off
+				if err == io.EOF {
+					s.firstLine = r.curOff
+				}
+				break
+			}
+			if err != nil {
+				s.err.Set(err)
+				return
+			}
+			text = append(text, line...)
+			text = append(text, '\n')
+		}
+		if s.header, err = sam.NewHeader(text, nil); err != nil {
+			s.err.Set(fmt.Errorf("%s: failed to parse SAM header: %v", s.Path, err))
+		}
+	})
+}
+
+// FileInfo implements the Provider interface.
+func (s *SAMProvider) FileInfo() (FileInfo, error) {
+	s.initInfo()
+	if err := s.err.Err(); err != nil {
+		return FileInfo{}, err
+	}
+	return s.info, nil
+}
+
+// GetHeader implements the Provider interface.
+func (s *SAMProvider) GetHeader() (*sam.Header, error) {
+	s.initInfo()
+	if err := s.err.Err(); err != nil {
+		return nil, err
+	}
+	return s.header, nil
+}
+
+func (s *SAMProvider) indexPath() string {
+	if s.Index != "" {
+		return s.Index
+	}
+	if !s.bgzipped {
+		return ""
+	}
+	index := s.Path + ".tbi"
+	if _, err := file.Stat(vcontext.Background(), index); err != nil {
+		return ""
+	}
+	return index
+}
+
+// readIndex reads the tabix index if one exists. Otherwise it scans the whole
+// file and builds s.checkpoints.
+func (s *SAMProvider) readIndex() error {
+	s.initInfo()
+	s.indexOnce.Do(func() {
+		if s.err.Err() != nil {
+			return
+		}
+		if path := s.indexPath(); path != "" {
+			s.err.Set(s.readTabixIndex(path))
+			return
+		}
+		s.err.Set(s.buildCheckpoints())
+	})
+	return s.err.Err()
+}
+
+func (s *SAMProvider) readTabixIndex(path string) error {
+	ctx := vcontext.Background()
+	in, err := file.Open(ctx, path)
+	if err != nil {
+		return err
+	}
+	defer in.Close(ctx) // nolint: errcheck
+	// The tabix index itself is bgzf-compressed.
+	bg, err := bgzf.NewReader(in.Reader(ctx), 1)
+	if err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	if s.tindex, err = tabix.ReadFrom(bg); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	return bg.Close()
+}
+
+func (s *SAMProvider) buildCheckpoints() error {
+	vlog.VI(1).Infof("%s: no index found, scanning the file", s.Path)
+	r, err := newSAMLineReader(s.Path, s.bgzipped)
+	if err != nil {
+		return err
+	}
+	if err = r.seek(s.firstLine); err != nil {
+		r.close() // nolint: errcheck
+		return err
+	}
+	var (
+		rec  sam.Record
+		last = biopb.Coord{RefId: 0, Pos: -1}
+		n    int
+	)
+	for {
+		line, off, err := r.readLine()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			r.close() // nolint: errcheck
+			return err
+		}
+		if len(line) == 0 {
+			continue
+		}
+		if err := rec.UnmarshalSAM(s.header, line); err != nil {
+			r.close() // nolint: errcheck
+			return fmt.Errorf("%s: %v", s.Path, err)
+		}
+		coord := gbam.CoordFromSAMRecord(&rec, 0)
+		if coord.LT(last) {
+			r.close() // nolint: errcheck
+			return fmt.Errorf("%s: SAM file is not coordinate-sorted: %v appears after %v", s.Path, coord, last)
+		}
+		if n%samCheckpointInterval == 0 || (coord.RefId != last.RefId) {
+			s.checkpoints = append(s.checkpoints, samCheckpoint{coord: coord, off: off})
+		}
+		last = coord
+		n++
+	}
+	return r.close()
+}
+
+// seekOffset finds the offset from which to read records at or after addr.
+// The result is conservative: it may point to a record before addr.
+func (s *SAMProvider) seekOffset(ref *sam.Reference, addr biopb.Coord) (bgzf.Offset, error) {
+	if s.tindex == nil {
+		// Find the last checkpoint strictly before addr. Records at the
+		// checkpoint's coordinate may also appear before it.
+		i := sort.Search(len(s.checkpoints), func(i int) bool {
+			return s.checkpoints[i].coord.GE(addr)
+		})
+		if i == 0 {
+			return s.firstLine, nil
+		}
+		return s.checkpoints[i-1].off, nil
+	}
+
+	refs := s.header.Refs()
+	if ref != nil {
+		for id := ref.ID(); id < len(refs); id++ {
+			start := 0
+			if id == ref.ID() {
+				start = int(addr.Pos)
+			}
+			chunks, err := s.tindex.Chunks(refs[id].Name(), start, refs[id].Len())
+			if err == index.ErrInvalid || err == index.ErrNoReference || (err == nil && len(chunks) == 0) {
+				// No record at or after start on this ref. Try the next ref.
+				continue
+			}
+			if err != nil {
+				return bgzf.Offset{}, err
+			}
+			return chunks[0].Begin, nil
+		}
+	}
+	// Find the first unmapped record, which is stored after the end of the
+	// last chunk of any reference.
+	var unmappedOff bgzf.Offset
+	found := false
+	for _, r := range refs {
+		chunks, err := s.tindex.Chunks(r.Name(), 0, r.Len())
+		if err == index.ErrInvalid || err == index.ErrNoReference || (err == nil && len(chunks) == 0) {
+			continue
+		}
+		if err != nil {
+			return bgzf.Offset{}, err
+		}
+		found = true
+		end := chunks[len(chunks)-1].End
+		if end.File > unmappedOff.File || (end.File == unmappedOff.File && end.Block > unmappedOff.Block) {
+			unmappedOff = end
+		}
+	}
+	if !found {
+		return s.firstLine, nil
+	}
+	return unmappedOff, nil
+}
+
+// GenerateShards implements the Provider interface.  The shards are position
+// based unless the TargetBased strategy is requested.
+func (s *SAMProvider) GenerateShards(opts GenerateShardsOpts) ([]gbam.Shard, error) {
+	header, err := s.GetHeader()
+	if err != nil {
+		return nil, err
+	}
+	if opts.Strategy == TargetBased {
+		return generateTargetShards(header, opts, nil)
+	}
+	if opts.Strategy == ByteBased {
+		vlog.VI(1).Infof("%s: ByteBased sharding is not supported for SAM, using PositionBased", s.Path)
+	}
+	return gbam.GetPositionBasedShards(header, 100000, opts.Padding, opts.IncludeUnmapped)
+}
+
+// GetFileShards implements the Provider interface.
+func (s *SAMProvider) GetFileShards() ([]gbam.Shard, error) {
+	header, err := s.GetHeader()
+	if err != nil {
+		return nil, err
+	}
+	return []gbam.Shard{gbam.UniversalShard(header)}, nil
+}
+
+// NewIterator implements the Provider interface.
+func (s *SAMProvider) NewIterator(shard gbam.Shard) Iterator {
+	if err := s.readIndex(); err != nil {
+		return NewErrorIterator(err)
+	}
+	iter := &samIterator{
+		provider:  s,
+		startAddr: biopb.Coord{RefId: int32(shard.StartRef.ID()), Pos: int32(shard.PaddedStart())},
+		limitAddr: biopb.Coord{RefId: int32(shard.EndRef.ID()), Pos: int32(shard.PaddedEnd())},
+	}
+	if iter.startAddr.GE(iter.limitAddr) {
+		iter.err = fmt.Errorf("start coord (%v) not before limit coord (%v)", iter.startAddr, iter.limitAddr)
+		return iter
+	}
+	off, err := s.seekOffset(shard.StartRef, iter.startAddr)
+	if err != nil {
+		iter.err = err
+		return iter
+	}
+	if iter.reader, iter.err = newSAMLineReader(s.Path, s.bgzipped); iter.err != nil {
+		return iter
+	}
+	iter.err = iter.reader.seek(off)
+	return iter
+}
+
+// Close implements the Provider interface.
+func (s *SAMProvider) Close() error {
+	return s.err.Err()
+}
+
+// samIterator implements the Iterator interface for SAMProvider.
+type samIterator struct {
+	provider *SAMProvider
+	reader   *samLineReader
+	// Half-open coordinate range to read.
+	startAddr, limitAddr biopb.Coord
+
+	err  error
+	next *sam.Record
+}
+
+// Scan implements the Iterator interface.
+func (i *samIterator) Scan() bool {
+	if i.err != nil {
+		return false
+	}
+	for {
+		var line []byte
+		if line, _, i.err = i.reader.readLine(); i.err != nil {
+			return false
+		}
+		if len(line) == 0 || line[0] == '@' {
+			continue
+		}
+		rec := sam.GetFromFreePool()
+		if i.err = rec.UnmarshalSAM(i.provider.header, line); i.err != nil {
+			i.err = fmt.Errorf("%s: %v", i.provider.Path, i.err)
+			return false
+		}
+		recAddr := gbam.CoordFromSAMRecord(rec, 0)
+		if recAddr.LT(i.startAddr) {
+			sam.PutInFreePool(rec)
+			continue
+		}
+		if !recAddr.LT(i.limitAddr) {
+			sam.PutInFreePool(rec)
+			i.err = io.EOF
+			return false
+		}
+		if i.provider.Filter != nil && !i.provider.Filter(rec) {
+			sam.PutInFreePool(rec)
+			continue
+		}
+		i.next = rec
+		return true
+	}
+}
+
+// Record implements the Iterator interface.
+func (i *samIterator) Record() *sam.Record {
+	return i.next
+}
+
+// Err implements the Iterator interface.
+func (i *samIterator) Err() error {
+	if i.err == io.EOF {
+		return nil
+	}
+	return i.err
+}
+
+// Close implements the Iterator interface.
+func (i *samIterator) Close() error {
+	if i.reader != nil {
+		if err := i.reader.close(); err != nil && i.Err() == nil {
+			i.err = err
+		}
+		i.reader = nil
+	}
+	err := i.Err()
+	i.provider.err.Set(err)
+	return err
+}
+
+// isSAMPath checks if the path has a SAM filename extension.
+func isSAMPath(path string) bool {
+	for _, suffix := range []string{".sam", ".sam.gz", ".sam.bgz"} {
+		if strings.HasSuffix(path, suffix) {
+			return true
+		}
+	}
+	return false
+}
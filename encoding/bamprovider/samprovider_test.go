@@ -0,0 +1,179 @@
+package bamprovider_test
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	gbam "github.com/Schaudge/grailbio/encoding/bam"
+	"github.com/Schaudge/grailbio/encoding/bamprovider"
+	"github.com/Schaudge/grailbio/encoding/converter"
+	"github.com/Schaudge/grailbio/encoding/pam"
+	"github.com/Schaudge/hts/bgzf"
+	"github.com/Schaudge/hts/sam"
+	"github.com/grailbio/testutil"
+	"github.com/grailbio/testutil/assert"
+	"github.com/grailbio/testutil/expect"
+)
+
+// generateSAM creates a sorted SAM file with n reads on each of chr8 and chr9,
+// and n unmapped reads. It returns the file contents and the read names in
+// file order.
+func generateSAM(t *testing.T, n int) ([][]byte, []string) {
+	refs := []*sam.Reference{}
+	for _, name := range []string{"chr8", "chr9"} {
+		ref, err := sam.NewReference(name, "", "", 2000000, nil, nil)
+		assert.NoError(t, err)
+		refs = append(refs, ref)
+	}
+	header, err := sam.NewHeader(nil, refs)
+	assert.NoError(t, err)
+	header.SortOrder = sam.Coordinate
+	text, err := header.MarshalText()
+	assert.NoError(t, err)
+
+	lines := [][]byte{text}
+	var names []string
+	addRecord := func(name string, ref *sam.Reference, pos int) {
+		r := newRecord(name, ref, pos, ref, pos, 0)
+		if ref == nil {
+			r.Flags = sam.Unmapped
+		}
+		line, err := r.MarshalText()
+		assert.NoError(t, err)
+		lines = append(lines, append(line, '\n'))
+		names = append(names, name)
+	}
+	for _, ref := range refs {
+		for i := 0; i < n; i++ {
+			addRecord(fmt.Sprintf("%s_%d", ref.Name(), i), ref, i*1000)
+		}
+	}
+	for i := 0; i < n; i++ {
+		addRecord(fmt.Sprintf("unmapped_%d", i), nil, -1)
+	}
+	return lines, names
+}
+
+func readAllShards(t *testing.T, p bamprovider.Provider) []string {
+	shards, err := p.GenerateShards(bamprovider.GenerateShardsOpts{IncludeUnmapped: true})
+	assert.NoError(t, err)
+	var names []string
+	for _, shard := range shards {
+		iter := p.NewIterator(shard)
+		names = append(names, readIterator(iter)...)
+		assert.NoError(t, iter.Close())
+	}
+	return names
+}
+
+func TestSAMProvider(t *testing.T) {
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	lines, names := generateSAM(t, 500)
+
+	plainPath := filepath.Join(tempDir, "test.sam")
+	assert.NoError(t, ioutil.WriteFile(plainPath, bytes.Join(lines, nil), 0644))
+
+	// Write a bgzipped SAM file with many small blocks, so that lines span
+	// block boundaries.
+	bgzPath := filepath.Join(tempDir, "test.sam.gz")
+	var buf bytes.Buffer
+	w := bgzf.NewWriter(&buf, 1)
+	for i, line := range lines {
+		_, err := w.Write(line)
+		assert.NoError(t, err)
+		if i%7 == 0 {
+			assert.NoError(t, w.Flush())
+		}
+	}
+	assert.NoError(t, w.Close())
+	assert.NoError(t, ioutil.WriteFile(bgzPath, buf.Bytes(), 0644))
+
+	for _, path := range []string{plainPath, bgzPath} {
+		expect.EQ(t, bamprovider.GuessFileType(path), bamprovider.SAM)
+		p := bamprovider.NewProvider(path)
+		header, err := p.GetHeader()
+		assert.NoError(t, err)
+		expect.EQ(t, len(header.Refs()), 2)
+
+		expect.EQ(t, readAllShards(t, p), names)
+
+		iter := bamprovider.NewRefIterator(p, "chr9", 1000, 4000)
+		expect.EQ(t, readIterator(iter), []string{"chr9_1", "chr9_2", "chr9_3"})
+		assert.NoError(t, iter.Close())
+
+		// Read the last mapped read, and all the unmapped reads.
+		iter = p.NewIterator(gbam.Shard{StartRef: header.Refs()[1], Start: 499000, EndRef: nil, End: 1})
+		expect.EQ(t, readIterator(iter), append([]string{"chr9_499"}, names[1000:]...))
+		assert.NoError(t, iter.Close())
+		assert.NoError(t, p.Close())
+	}
+}
+
+func TestSAMProviderUnsorted(t *testing.T) {
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	lines, _ := generateSAM(t, 10)
+	lines[1], lines[2] = lines[2], lines[1]
+	path := filepath.Join(tempDir, "unsorted.sam")
+	assert.NoError(t, ioutil.WriteFile(path, bytes.Join(lines, nil), 0644))
+
+	p := bamprovider.NewProvider(path)
+	header, err := p.GetHeader()
+	assert.NoError(t, err)
+	iter := p.NewIterator(gbam.UniversalShard(header))
+	expect.False(t, iter.Scan())
+	expect.HasSubstr(t, iter.Close().Error(), "not coordinate-sorted")
+	expect.NotNil(t, p.Close())
+}
+
+func TestProviderFilter(t *testing.T) {
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	lines, names := generateSAM(t, 100)
+	samPath := filepath.Join(tempDir, "test.sam")
+	assert.NoError(t, ioutil.WriteFile(samPath, bytes.Join(lines, nil), 0644))
+	pamPath := filepath.Join(tempDir, "test.pam")
+	p := bamprovider.NewProvider(samPath)
+	assert.NoError(t, converter.ConvertProviderToPAM(pam.WriteOpts{MaxBufSize: 1024}, pamPath, p))
+	assert.NoError(t, p.Close())
+
+	// Keep the mapped reads at even multiples of 1000.
+	var expected []string
+	for i, name := range names[:200] {
+		if i%2 == 0 {
+			expected = append(expected, name)
+		}
+	}
+	var sawName bool
+	filter := func(r *sam.Record) bool {
+		if r.Name != "" {
+			sawName = true
+		}
+		return r.Flags&sam.Unmapped == 0 && r.Pos%2000 == 0
+	}
+	opts := bamprovider.ProviderOpts{Filter: filter}
+
+	p = bamprovider.NewProvider(samPath, opts)
+	expect.EQ(t, readAllShards(t, p), expected)
+	expect.True(t, sawName)
+	assert.NoError(t, p.Close())
+
+	// The PAM reader calls the filter before decoding the name.
+	sawName = false
+	p = bamprovider.NewProvider(pamPath, opts)
+	expect.EQ(t, readAllShards(t, p), expected)
+	expect.False(t, sawName)
+	assert.NoError(t, p.Close())
+
+	var merged []string
+	for _, name := range expected {
+		merged = append(merged, name, name)
+	}
+	p = bamprovider.NewMergedProvider([]string{samPath, pamPath}, opts)
+	expect.EQ(t, readAllShards(t, p), merged)
+	assert.NoError(t, p.Close())
+}
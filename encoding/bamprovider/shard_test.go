@@ -1,14 +1,20 @@
 package bamprovider_test
 
 import (
+	"bytes"
 	"fmt"
+	"io/ioutil"
+	"path/filepath"
 	"testing"
 
 	"github.com/Schaudge/grailbio/biopb"
 	"github.com/Schaudge/grailbio/encoding/bam"
 	"github.com/Schaudge/grailbio/encoding/bamprovider"
+	"github.com/Schaudge/grailbio/interval"
+	"github.com/Schaudge/hts/sam"
 	"github.com/grailbio/testutil"
 	"github.com/grailbio/testutil/assert"
+	"github.com/grailbio/testutil/expect"
 )
 
 func validateShards(t *testing.T, p bamprovider.Provider, shards []bam.Shard, includeUnmapped bool) {
@@ -95,3 +101,98 @@ func TestGenerateShards(t *testing.T) {
 	})
 	assert.NoError(t, p.Close())
 }
+
+func TestGenerateTargetShards(t *testing.T) {
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	lines, _ := generateSAM(t, 500)
+	path := filepath.Join(tempDir, "test.sam")
+	assert.NoError(t, ioutil.WriteFile(path, bytes.Join(lines, nil), 0644))
+	p := bamprovider.NewProvider(path)
+	defer func() { assert.NoError(t, p.Close()) }()
+	header, err := p.GetHeader()
+	assert.NoError(t, err)
+
+	targets, err := interval.NewBEDUnionFromEntries([]interval.Entry{
+		{RefName: "chr8", Start0: 10000, End: 20000},
+		{RefName: "chr8", Start0: 20500, End: 30000},
+		{RefName: "chr8", Start0: 200000, End: 300000},
+		{RefName: "chr9", Start0: 0, End: 5000},
+	}, interval.NewBEDOpts{SAMHeader: header})
+	assert.NoError(t, err)
+
+	_, err = p.GenerateShards(bamprovider.GenerateShardsOpts{Strategy: bamprovider.TargetBased})
+	expect.HasSubstr(t, err.Error(), "requires Targets")
+
+	shards, err := p.GenerateShards(bamprovider.GenerateShardsOpts{
+		Strategy:  bamprovider.TargetBased,
+		Targets:   &targets,
+		NumShards: 10,
+	})
+	assert.NoError(t, err)
+	// The total target length is 124500, so each shard should cover at most
+	// about 12450 targeted bases.
+	expect.GE(t, len(shards), 10)
+	covered := 0
+	for i, shard := range shards {
+		expect.EQ(t, shard.ShardIdx, i)
+		expect.EQ(t, shard.StartRef, shard.EndRef)
+		// No shard spans the gap between the targets.
+		if shard.StartRef.Name() == "chr8" {
+			expect.True(t, shard.End <= 30000 || shard.Start >= 200000, "shard %+v", shard)
+		}
+		size := 0
+		endpoints := targets.IntersectionByID(shard.StartRef.ID(), interval.PosType(shard.Start), interval.PosType(shard.End))
+		for j := 0; j < len(endpoints); j += 2 {
+			size += int(endpoints[j+1] - endpoints[j])
+		}
+		expect.LE(t, size, 12451, "shard %+v", shard)
+		covered += size
+	}
+	expect.EQ(t, covered, 124500)
+	expect.EQ(t, shards[0].Start, 10000)
+	expect.EQ(t, shards[len(shards)-1].StartRef.Name(), "chr9")
+	expect.EQ(t, shards[len(shards)-1].End, 5000)
+
+	var names []string
+	for _, shard := range shards {
+		iter := p.NewIterator(shard)
+		names = append(names, readIterator(iter)...)
+		assert.NoError(t, iter.Close())
+	}
+	var expected []string
+	for i := 10; i < 30; i++ {
+		expected = append(expected, fmt.Sprintf("chr8_%d", i))
+	}
+	for i := 200; i < 300; i++ {
+		expected = append(expected, fmt.Sprintf("chr8_%d", i))
+	}
+	for i := 0; i < 5; i++ {
+		expected = append(expected, fmt.Sprintf("chr9_%d", i))
+	}
+	expect.EQ(t, names, expected)
+
+	// All the work is on chr9.
+	shards, err = p.GenerateShards(bamprovider.GenerateShardsOpts{
+		Strategy:        bamprovider.TargetBased,
+		Targets:         &targets,
+		NumShards:       5,
+		IncludeUnmapped: true,
+		TargetWeight: func(ref *sam.Reference, start, limit int) float64 {
+			if ref.Name() == "chr9" {
+				return float64(limit - start)
+			}
+			return 0
+		},
+	})
+	assert.NoError(t, err)
+	var starts []int
+	for _, shard := range shards[:len(shards)-1] {
+		if shard.StartRef.Name() == "chr9" {
+			starts = append(starts, shard.Start)
+		}
+	}
+	expect.EQ(t, starts, []int{0, 1000, 2000, 3000, 4000})
+	expect.EQ(t, len(shards), 8)
+	expect.True(t, shards[len(shards)-1].StartRef == nil)
+}
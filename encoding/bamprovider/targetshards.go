@@ -0,0 +1,172 @@
+package bamprovider
+
+import (
+	"fmt"
+	"math"
+
+	gbam "github.com/Schaudge/grailbio/encoding/bam"
+	"github.com/Schaudge/grailbio/interval"
+	"github.com/Schaudge/hts/sam"
+)
+
+const (
+	// DefaultNumTargetShards is the default value for
+	// GenerateShardsOpts.NumShards in TargetBased sharding strategy.
+	DefaultNumTargetShards = 128
+
+	// targetMergeGap is the max distance between two targets, in addition to
+	// twice the padding, that are put in the same region. A shard never spans
+	// two regions, so that the reads in the gap between them are not read.
+	targetMergeGap = 1000
+)
+
+// targetRange is one interval of GenerateShardsOpts.Targets.
+type targetRange struct {
+	start, limit int
+	weight       float64
+}
+
+// targetRegion is a sequence of nearby targets on one reference.
+type targetRegion struct {
+	ref     *sam.Reference
+	targets []targetRange
+	weight  float64
+}
+
+func (r *targetRegion) start() int { return r.targets[0].start }
+func (r *targetRegion) limit() int { return r.targets[len(r.targets)-1].limit }
+
+// targetLength is the default weight function for TargetBased sharding.
+func targetLength(ref *sam.Reference, start, limit int) float64 {
+	return float64(limit - start)
+}
+
+// newTargetRegions groups the targets into regions. Targets are clipped to the
+// reference boundaries.
+func newTargetRegions(header *sam.Header, targets *interval.BEDUnion, padding int) []targetRegion {
+	maxGap := targetMergeGap + 2*padding
+	var regions []targetRegion
+	for _, ref := range header.Refs() {
+		endpoints := targets.EndpointsByName(ref.Name())
+		cur := -1
+		for k := 0; k+1 < len(endpoints); k += 2 {
+			start, limit := int(endpoints[k]), int(endpoints[k+1])
+			if start < 0 {
+				start = 0
+			}
+			if limit > ref.Len() {
+				limit = ref.Len()
+			}
+			if start >= limit {
+				continue
+			}
+			if cur < 0 || start-regions[cur].limit() > maxGap {
+				regions = append(regions, targetRegion{ref: ref})
+				cur = len(regions) - 1
+			}
+			regions[cur].targets = append(regions[cur].targets, targetRange{start: start, limit: limit})
+		}
+	}
+	return regions
+}
+
+// assignWeights computes the weights of the targets and the regions. It
+// returns the total weight.
+func assignWeights(regions []targetRegion, weight func(ref *sam.Reference, start, limit int) float64) float64 {
+	var total float64
+	for i := range regions {
+		r := &regions[i]
+		r.weight = 0
+		for j := range r.targets {
+			t := &r.targets[j]
+			if t.weight = weight(r.ref, t.start, t.limit); t.weight < 0 || math.IsNaN(t.weight) {
+				t.weight = 0
+			}
+			r.weight += t.weight
+		}
+		total += r.weight
+	}
+	return total
+}
+
+// split divides the region into pieces whose weights are at most about goal.
+// It returns the boundaries of the pieces, including the region start and
+// limit. The weight of each target is assumed to be uniformly distributed over
+// its bases.
+func (r *targetRegion) split(goal float64) []int {
+	n := 1
+	if goal > 0 {
+		n = int(math.Ceil(r.weight / goal))
+	}
+	bounds := []int{r.start()}
+	if n > 1 {
+		step := r.weight / float64(n)
+		next := step
+		var cum float64
+		for _, t := range r.targets {
+			for len(bounds) < n && t.weight > 0 && next < cum+t.weight {
+				pos := t.start + int(float64(t.limit-t.start)*(next-cum)/t.weight)
+				if pos > bounds[len(bounds)-1] && pos < r.limit() {
+					bounds = append(bounds, pos)
+				}
+				next += step
+			}
+			cum += t.weight
+		}
+	}
+	return append(bounds, r.limit())
+}
+
+// generateTargetShards implements the TargetBased sharding strategy. Arg
+// estimate, if non-nil, is used as the weight function when
+// opts.TargetWeight is nil.
+func generateTargetShards(header *sam.Header, opts GenerateShardsOpts, estimate func(ref *sam.Reference, start, limit int) float64) ([]gbam.Shard, error) {
+	if opts.Targets == nil {
+		return nil, fmt.Errorf("GenerateShards: TargetBased strategy requires Targets")
+	}
+	weight := opts.TargetWeight
+	if weight == nil {
+		weight = estimate
+	}
+	if weight == nil {
+		weight = targetLength
+	}
+	regions := newTargetRegions(header, opts.Targets, opts.Padding)
+	total := assignWeights(regions, weight)
+	if total <= 0 && opts.TargetWeight == nil {
+		// The estimate is useless, e.g., the index has no data in the targets.
+		total = assignWeights(regions, targetLength)
+	}
+	numShards := opts.NumShards
+	if numShards <= 0 {
+		numShards = DefaultNumTargetShards
+	}
+	goal := total / float64(numShards)
+
+	var shards []gbam.Shard
+	for i := range regions {
+		r := &regions[i]
+		bounds := r.split(goal)
+		for j := 0; j+1 < len(bounds); j++ {
+			shards = append(shards, gbam.Shard{
+				StartRef: r.ref,
+				EndRef:   r.ref,
+				Start:    bounds[j],
+				End:      bounds[j+1],
+				Padding:  opts.Padding,
+				ShardIdx: len(shards),
+			})
+		}
+	}
+	if opts.IncludeUnmapped {
+		shards = append(shards, gbam.Shard{
+			StartRef: nil,
+			EndRef:   nil,
+			Start:    0,
+			End:      math.MaxInt32,
+			ShardIdx: len(shards),
+		})
+	}
+	gbam.ValidateShardList(header, shards, opts.Padding)
+	return shards, nil
+}
@@ -4,6 +4,7 @@ package converter
 
 import (
 	"fmt"
+	"io"
 	"math"
 	"runtime"
 	"sort"
@@ -207,6 +208,126 @@ func ConvertToPAM(opts pam.WriteOpts, pamPath, bamPath, baiPath string, bytesPer
 	return err
 }
 
+// ConvertProviderToPAM copies all the records of "provider" to a PAM file with
+// a single shard. It is used for inputs that cannot be sharded by file
+// offsets, such as SAM. Existing contents of "pamPath", if any, are destroyed.
+func ConvertProviderToPAM(opts pam.WriteOpts, pamPath string, provider bamprovider.Provider) error {
+	if pamPath == "" {
+		return fmt.Errorf("Empty pam path")
+	}
+	if e := pamutil.ValidateCoordRange(&opts.Range); e != nil {
+		return e
+	}
+	if !opts.Range.EQ(gbam.UniversalRange) {
+		return fmt.Errorf("WriteOpts.Range to ConvertProviderToPAM must be a universal range, but found %+v", opts)
+	}
+	if e := pamutil.Remove(pamPath); e != nil {
+		return e
+	}
+	start := bamShardBound{rec: biopb.Coord{RefId: 0, Pos: 0}}
+	limit := bamShardBound{rec: biopb.Coord{RefId: biopb.InfinityRefID, Pos: biopb.InfinityPos}}
+	nRecs, err := convertShard(opts, pamPath, provider, start, limit)
+	vlog.Infof("%v: Finished converting, written %d records, error %v", pamPath, nRecs, err)
+	return err
+}
+
+// ConvertUnsortedToPAM copies all the records of a SAM or BAM file to a PAM
+// file with a single shard, in the order they are stored in the source file.
+// The source file need not be sorted or indexed. A SAM file may be gzipped.
+// opts.Unsorted must be set. Existing contents of "pamPath", if any, are
+// destroyed.
+func ConvertUnsortedToPAM(opts pam.WriteOpts, pamPath, srcPath string) (err error) {
+	if pamPath == "" {
+		return fmt.Errorf("Empty pam path")
+	}
+	if !opts.Unsorted {
+		return fmt.Errorf("ConvertUnsortedToPAM %s: WriteOpts.Unsorted must be set", srcPath)
+	}
+	ctx := vcontext.Background()
+	in, err := file.Open(ctx, srcPath)
+	if err != nil {
+		return err
+	}
+	defer in.Close(ctx) // nolint: errcheck
+	e := errors.Once{}
+	// The readers below are closed by deferred calls that set e, so e is
+	// checked once more after they have run.
+	defer func() {
+		if err == nil {
+			err = e.Err()
+		}
+	}()
+	var src unsortedReader
+	switch bamprovider.GuessFileType(srcPath) {
+	case bamprovider.BAM:
+		bamr, err := bam.NewReader(in.Reader(ctx), runtime.NumCPU())
+		if err != nil {
+			return err
+		}
+		defer func() { e.Set(bamr.Close()) }()
+		src = bamr
+	case bamprovider.SAM:
+		r := io.Reader(in.Reader(ctx))
+		if gz, err := isGzipped(srcPath); err != nil {
+			return err
+		} else if gz {
+			gzr, err := gzip.NewReader(r)
+			if err != nil {
+				return fmt.Errorf("%s: %v", srcPath, err)
+			}
+			defer func() { e.Set(gzr.Close()) }()
+			r = gzr
+		}
+		if src, err = sam.NewReader(r); err != nil {
+			return fmt.Errorf("%s: %v", srcPath, err)
+		}
+	default:
+		return fmt.Errorf("ConvertUnsortedToPAM %s: only SAM and BAM files are supported", srcPath)
+	}
+	if err := pamutil.Remove(pamPath); err != nil {
+		return err
+	}
+	w := pam.NewWriter(opts, src.Header(), pamPath)
+	var nRecs int64
+	for w.Err() == nil {
+		rec, err := src.Read()
+		if err != nil {
+			if err != io.EOF {
+				e.Set(fmt.Errorf("%s: %v", srcPath, err))
+			}
+			break
+		}
+		w.Write(rec)
+		sam.PutInFreePool(rec)
+		nRecs++
+	}
+	e.Set(w.Close())
+	vlog.Infof("%v: Finished converting, written %d records, error %v", pamPath, nRecs, e.Err())
+	return e.Err()
+}
+
+// unsortedReader is implemented by sam.Reader and bam.Reader.
+type unsortedReader interface {
+	Header() *sam.Header
+	Read() (*sam.Record, error)
+}
+
+// isGzipped checks if the file starts with the gzip magic.
+func isGzipped(path string) (bool, error) {
+	ctx := vcontext.Background()
+	in, err := file.Open(ctx, path)
+	if err != nil {
+		return false, err
+	}
+	defer in.Close(ctx) // nolint: errcheck
+	var magic [2]byte
+	n, err := io.ReadFull(in.Reader(ctx), magic[:])
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return false, err
+	}
+	return n == 2 && magic[0] == 0x1f && magic[1] == 0x8b, nil
+}
+
 type convertRequest struct {
 	shardIdx int
 	records  []*sam.Record
@@ -215,6 +336,12 @@ type convertRequest struct {
 // ConvertToBAM copies "provider" to a BAM file. Existing contents of "bamPath",
 // if any, are destroyed.
 func ConvertToBAM(bamPath string, provider bamprovider.Provider) error {
+	return ConvertToBinnedBAM(bamPath, provider, nil)
+}
+
+// ConvertToBinnedBAM is similar to ConvertToBAM, but it bins the base
+// qualities of the records. If qualBinning is nil, the qualities are unchanged.
+func ConvertToBinnedBAM(bamPath string, provider bamprovider.Provider, qualBinning *gbam.QualBinning) error {
 	const recordsPerShard = 128 << 10
 	parallelism := runtime.NumCPU()
 
@@ -231,6 +358,7 @@ func ConvertToBAM(bamPath string, provider bamprovider.Provider) error {
 	if e != nil {
 		return e
 	}
+	w.SetQualBinning(qualBinning)
 
 	wg := sync.WaitGroup{}
 	reqCh := make(chan convertRequest, parallelism)
@@ -0,0 +1,80 @@
+package cram
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+)
+
+// Block compression methods.
+const (
+	methodRaw   = 0
+	methodGzip  = 1
+	methodBzip2 = 2
+	methodLZMA  = 3
+	methodRANS  = 4
+)
+
+// Block content types.
+const (
+	contentFileHeader        = 0
+	contentCompressionHeader = 1
+	contentSliceHeader       = 2
+	contentExternal          = 4
+	contentCore              = 5
+)
+
+// block is a decompressed CRAM block.
+type block struct {
+	contentType byte
+	contentID   int32
+	data        []byte
+}
+
+// readBlock reads one block from r and decompresses its payload.
+func readBlock(r *byteReader) (*block, error) {
+	start := r.off
+	method := r.byte()
+	b := &block{contentType: r.byte()}
+	b.contentID = r.itf8()
+	compSize := r.itf8()
+	rawSize := r.itf8()
+	data := r.bytes(int(compSize))
+	end := r.off
+	crc := r.bytes(4)
+	if r.err != nil {
+		return nil, r.err
+	}
+	if got := crc32.ChecksumIEEE(r.buf[start:end]); got != binary.LittleEndian.Uint32(crc) {
+		return nil, fmt.Errorf("cram: block CRC32 mismatch: got %08x, expect %08x", got, binary.LittleEndian.Uint32(crc))
+	}
+	var err error
+	switch method {
+	case methodRaw:
+		b.data = data
+	case methodGzip:
+		var gz *gzip.Reader
+		if gz, err = gzip.NewReader(bytes.NewReader(data)); err == nil {
+			b.data, err = ioutil.ReadAll(gz)
+		}
+	case methodBzip2:
+		b.data, err = ioutil.ReadAll(bzip2.NewReader(bytes.NewReader(data)))
+	case methodRANS:
+		b.data, err = ransDecode(data)
+	case methodLZMA:
+		err = fmt.Errorf("cram: LZMA block compression is not supported")
+	default:
+		err = fmt.Errorf("cram: unknown block compression method %d", method)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(b.data) != int(rawSize) {
+		return nil, fmt.Errorf("cram: block size mismatch: got %d bytes, expect %d", len(b.data), rawSize)
+	}
+	return b, nil
+}
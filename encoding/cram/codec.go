@@ -0,0 +1,325 @@
+package cram
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Encoding identifiers.
+const (
+	encodingNull          = 0
+	encodingExternal      = 1
+	encodingHuffman       = 3
+	encodingByteArrayLen  = 4
+	encodingByteArrayStop = 5
+	encodingBeta          = 6
+	encodingSubexp        = 7
+	encodingGamma         = 9
+)
+
+// sliceData holds the blocks of a slice that encodings read from.
+type sliceData struct {
+	core     []byte
+	bitPos   int // next bit to read from core.
+	external map[int32]*byteReader
+	err      error
+}
+
+func (d *sliceData) setErr(err error) {
+	if d.err == nil {
+		d.err = err
+	}
+}
+
+func (d *sliceData) readBit() uint32 {
+	if d.bitPos >= len(d.core)*8 {
+		d.setErr(errShort)
+		return 0
+	}
+	b := d.core[d.bitPos>>3] >> (7 - uint(d.bitPos&7)) & 1
+	d.bitPos++
+	return uint32(b)
+}
+
+func (d *sliceData) readBits(n int) uint32 {
+	var v uint32
+	for i := 0; i < n; i++ {
+		v = v<<1 | d.readBit()
+	}
+	return v
+}
+
+func (d *sliceData) externalBlock(id int32) *byteReader {
+	r := d.external[id]
+	if r == nil {
+		d.setErr(fmt.Errorf("cram: missing external block %d", id))
+		return newByteReader(nil)
+	}
+	return r
+}
+
+// codec decodes values of one data series. Errors are recorded in
+// sliceData.err.
+type codec interface {
+	readInt(d *sliceData) int32
+	readByte(d *sliceData) byte
+	readArray(d *sliceData) []byte
+}
+
+// parseEncoding reads an encoding descriptor: the encoding id, the length of
+// the parameters, and the parameters.
+func parseEncoding(r *byteReader) (codec, error) {
+	id := r.itf8()
+	n := r.itf8()
+	p := newByteReader(r.bytes(int(n)))
+	if r.err != nil {
+		return nil, r.err
+	}
+	var c codec
+	switch id {
+	case encodingNull:
+		c = nullCodec{}
+	case encodingExternal:
+		c = externalCodec{id: p.itf8()}
+	case encodingHuffman:
+		c = newHuffmanCodec(p.itf8Array(), p.itf8Array())
+	case encodingByteArrayLen:
+		lenCodec, err := parseEncoding(p)
+		if err != nil {
+			return nil, err
+		}
+		valCodec, err := parseEncoding(p)
+		if err != nil {
+			return nil, err
+		}
+		c = byteArrayLenCodec{lenCodec: lenCodec, valCodec: valCodec}
+	case encodingByteArrayStop:
+		c = byteArrayStopCodec{stop: p.byte(), id: p.itf8()}
+	case encodingBeta:
+		c = betaCodec{offset: p.itf8(), nbits: int(p.itf8())}
+	case encodingSubexp:
+		c = subexpCodec{offset: p.itf8(), k: int(p.itf8())}
+	case encodingGamma:
+		c = gammaCodec{offset: p.itf8()}
+	default:
+		return nil, fmt.Errorf("cram: unsupported encoding %d", id)
+	}
+	if p.err != nil {
+		return nil, fmt.Errorf("cram: malformed parameters for encoding %d", id)
+	}
+	return c, nil
+}
+
+// intCodec implements readByte and readArray for codecs that produce
+// integers.
+type intCodec struct{}
+
+func (intCodec) readArray(d *sliceData) []byte {
+	d.setErr(fmt.Errorf("cram: integer encoding used for a byte array"))
+	return nil
+}
+
+type nullCodec struct{ intCodec }
+
+func (nullCodec) readInt(d *sliceData) int32 { return 0 }
+func (nullCodec) readByte(d *sliceData) byte { return 0 }
+
+type externalCodec struct{ id int32 }
+
+func (c externalCodec) readInt(d *sliceData) int32 {
+	r := d.externalBlock(c.id)
+	v := r.itf8()
+	if r.err != nil {
+		d.setErr(r.err)
+	}
+	return v
+}
+
+func (c externalCodec) readByte(d *sliceData) byte {
+	r := d.externalBlock(c.id)
+	v := r.byte()
+	if r.err != nil {
+		d.setErr(r.err)
+	}
+	return v
+}
+
+func (c externalCodec) readArray(d *sliceData) []byte {
+	d.setErr(fmt.Errorf("cram: external encoding used for a byte array"))
+	return nil
+}
+
+// huffmanCodec implements the canonical Huffman encoding.
+type huffmanCodec struct {
+	intCodec
+	symbols []int32
+	lens    []int
+	codes   []uint32
+}
+
+func newHuffmanCodec(alphabet, bitLens []int32) codec {
+	c := &huffmanCodec{}
+	n := len(alphabet)
+	if len(bitLens) < n {
+		n = len(bitLens)
+	}
+	idx := make([]int, n)
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.Slice(idx, func(i, j int) bool {
+		a, b := idx[i], idx[j]
+		if bitLens[a] != bitLens[b] {
+			return bitLens[a] < bitLens[b]
+		}
+		return alphabet[a] < alphabet[b]
+	})
+	var code uint32
+	for i, k := range idx {
+		l := int(bitLens[k])
+		if i > 0 {
+			code = (code + 1) << uint(l-c.lens[i-1])
+		}
+		c.symbols = append(c.symbols, alphabet[k])
+		c.lens = append(c.lens, l)
+		c.codes = append(c.codes, code)
+	}
+	return c
+}
+
+func (c *huffmanCodec) readInt(d *sliceData) int32 {
+	if len(c.symbols) == 1 && c.lens[0] == 0 {
+		return c.symbols[0]
+	}
+	var (
+		code uint32
+		n    int
+	)
+	for i, l := range c.lens {
+		for n < l {
+			code = code<<1 | d.readBit()
+			n++
+		}
+		if d.err != nil {
+			return 0
+		}
+		if code == c.codes[i] {
+			return c.symbols[i]
+		}
+	}
+	d.setErr(fmt.Errorf("cram: invalid huffman code"))
+	return 0
+}
+
+func (c *huffmanCodec) readByte(d *sliceData) byte { return byte(c.readInt(d)) }
+
+type byteArrayLenCodec struct {
+	lenCodec, valCodec codec
+}
+
+func (c byteArrayLenCodec) readInt(d *sliceData) int32 {
+	d.setErr(fmt.Errorf("cram: byte array encoding used for an integer"))
+	return 0
+}
+
+func (c byteArrayLenCodec) readByte(d *sliceData) byte {
+	d.setErr(fmt.Errorf("cram: byte array encoding used for a byte"))
+	return 0
+}
+
+func (c byteArrayLenCodec) readArray(d *sliceData) []byte {
+	n := c.lenCodec.readInt(d)
+	if n < 0 || d.err != nil {
+		d.setErr(fmt.Errorf("cram: invalid byte array length %d", n))
+		return nil
+	}
+	if ext, ok := c.valCodec.(externalCodec); ok {
+		r := d.externalBlock(ext.id)
+		v := r.bytes(int(n))
+		if r.err != nil {
+			d.setErr(r.err)
+		}
+		return v
+	}
+	v := make([]byte, n)
+	for i := range v {
+		v[i] = c.valCodec.readByte(d)
+	}
+	return v
+}
+
+type byteArrayStopCodec struct {
+	stop byte
+	id   int32
+}
+
+func (c byteArrayStopCodec) readInt(d *sliceData) int32 {
+	d.setErr(fmt.Errorf("cram: byte array encoding used for an integer"))
+	return 0
+}
+
+func (c byteArrayStopCodec) readByte(d *sliceData) byte {
+	d.setErr(fmt.Errorf("cram: byte array encoding used for a byte"))
+	return 0
+}
+
+func (c byteArrayStopCodec) readArray(d *sliceData) []byte {
+	r := d.externalBlock(c.id)
+	rest := r.buf[r.off:]
+	for i, b := range rest {
+		if b == c.stop {
+			r.off += i + 1
+			return rest[:i]
+		}
+	}
+	d.setErr(errShort)
+	return nil
+}
+
+type betaCodec struct {
+	intCodec
+	offset int32
+	nbits  int
+}
+
+func (c betaCodec) readInt(d *sliceData) int32 { return int32(d.readBits(c.nbits)) - c.offset }
+func (c betaCodec) readByte(d *sliceData) byte { return byte(c.readInt(d)) }
+
+type subexpCodec struct {
+	intCodec
+	offset int32
+	k      int
+}
+
+func (c subexpCodec) readInt(d *sliceData) int32 {
+	i := 0
+	for d.readBit() == 1 && d.err == nil {
+		i++
+	}
+	var v uint32
+	if i == 0 {
+		v = d.readBits(c.k)
+	} else {
+		b := i + c.k - 1
+		v = 1<<uint(b) | d.readBits(b)
+	}
+	return int32(v) - c.offset
+}
+
+func (c subexpCodec) readByte(d *sliceData) byte { return byte(c.readInt(d)) }
+
+type gammaCodec struct {
+	intCodec
+	offset int32
+}
+
+func (c gammaCodec) readInt(d *sliceData) int32 {
+	n := 0
+	for d.readBit() == 0 && d.err == nil {
+		n++
+	}
+	v := 1<<uint(n) | d.readBits(n)
+	return int32(v) - c.offset
+}
+
+func (c gammaCodec) readByte(d *sliceData) byte { return byte(c.readInt(d)) }
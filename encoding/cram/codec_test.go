@@ -0,0 +1,177 @@
+package cram
+
+import (
+	"bytes"
+	"math"
+	"testing"
+
+	"github.com/grailbio/testutil/assert"
+	"github.com/grailbio/testutil/expect"
+)
+
+func encodeITF8(v int32) []byte {
+	u := uint32(v)
+	switch {
+	case u < 0x80:
+		return []byte{byte(u)}
+	case u < 0x4000:
+		return []byte{0x80 | byte(u>>8), byte(u)}
+	case u < 0x200000:
+		return []byte{0xc0 | byte(u>>16), byte(u >> 8), byte(u)}
+	case u < 0x10000000:
+		return []byte{0xe0 | byte(u>>24), byte(u >> 16), byte(u >> 8), byte(u)}
+	default:
+		return []byte{0xf0 | byte(u>>28), byte(u >> 20), byte(u >> 12), byte(u >> 4), byte(u & 0xf)}
+	}
+}
+
+func encodeLTF8(v int64) []byte {
+	u := uint64(v)
+	n := 0
+	for n < 8 && u >= 1<<uint(7*(n+1)) {
+		n++
+	}
+	var b0 byte
+	switch {
+	case n == 8:
+		b0 = 0xff
+	case n == 7:
+		b0 = 0xfe
+	default:
+		b0 = ^byte(0xff>>uint(n)) | byte(u>>uint(8*n))
+	}
+	out := []byte{b0}
+	for i := n - 1; i >= 0; i-- {
+		out = append(out, byte(u>>uint(8*i)))
+	}
+	return out
+}
+
+func encodeITF8Array(a []int32) []byte {
+	out := encodeITF8(int32(len(a)))
+	for _, v := range a {
+		out = append(out, encodeITF8(v)...)
+	}
+	return out
+}
+
+// encodeEncoding serializes an encoding descriptor.
+func encodeEncoding(id int32, params ...[]byte) []byte {
+	p := bytes.Join(params, nil)
+	return append(append(encodeITF8(id), encodeITF8(int32(len(p)))...), p...)
+}
+
+// bitWriter writes bits to the core block, most significant bit first.
+type bitWriter struct {
+	buf []byte
+	n   int
+}
+
+func (w *bitWriter) write(v uint32, nbits int) {
+	for i := nbits - 1; i >= 0; i-- {
+		if w.n%8 == 0 {
+			w.buf = append(w.buf, 0)
+		}
+		if v>>uint(i)&1 != 0 {
+			w.buf[len(w.buf)-1] |= 0x80 >> uint(w.n%8)
+		}
+		w.n++
+	}
+}
+
+func TestITF8(t *testing.T) {
+	values := []int32{0, 1, 0x7f, 0x80, 0x3fff, 0x4000, 0x1fffff, 0x200000, 0xfffffff, 0x10000000, math.MaxInt32, -1, math.MinInt32}
+	var buf []byte
+	for _, v := range values {
+		buf = append(buf, encodeITF8(v)...)
+	}
+	r := newByteReader(buf)
+	br := bytes.NewReader(buf)
+	for _, v := range values {
+		expect.EQ(t, r.itf8(), v)
+		got, err := readITF8(br)
+		assert.NoError(t, err)
+		expect.EQ(t, got, v)
+	}
+	assert.NoError(t, r.err)
+	expect.EQ(t, r.remaining(), 0)
+	r.itf8()
+	expect.EQ(t, r.err, errShort)
+}
+
+func TestLTF8(t *testing.T) {
+	values := []int64{0, 1, 0x7f, 0x80, 0x3fff, 0x4000, 1 << 30, 1 << 40, 1<<49 - 1, 1 << 49, 1<<56 - 1, 1 << 56, math.MaxInt64, -1}
+	var buf []byte
+	for _, v := range values {
+		buf = append(buf, encodeLTF8(v)...)
+	}
+	r := newByteReader(buf)
+	br := bytes.NewReader(buf)
+	for _, v := range values {
+		expect.EQ(t, r.ltf8(), v)
+		got, err := readLTF8(br)
+		assert.NoError(t, err)
+		expect.EQ(t, got, v)
+	}
+	assert.NoError(t, r.err)
+}
+
+func TestCoreCodecs(t *testing.T) {
+	var w bitWriter
+	// beta, offset 1, 5 bits: value 9.
+	w.write(10, 5)
+	// gamma, offset 0: value 5 = 0b101.
+	w.write(0, 2)
+	w.write(5, 3)
+	// subexp, offset 0, k=2: value 3 (i=0) and value 13 (i=2, b=3).
+	w.write(0, 1)
+	w.write(3, 2)
+	w.write(6, 3)
+	w.write(5, 3)
+	// huffman over {10:1, 20:2, 30:3, 40:3}; codes 0, 10, 110, 111.
+	w.write(6, 3)
+	w.write(0, 1)
+	w.write(2, 2)
+	w.write(7, 3)
+
+	d := &sliceData{core: w.buf, external: map[int32]*byteReader{
+		1: newByteReader(append(encodeITF8(300), 'x')),
+		2: newByteReader([]byte("abc\tdef\t")),
+		3: newByteReader(encodeITF8(4)),
+		4: newByteReader([]byte("wxyz")),
+	}}
+	parse := func(id int32, params ...[]byte) codec {
+		c, err := parseEncoding(newByteReader(encodeEncoding(id, params...)))
+		assert.NoError(t, err)
+		return c
+	}
+	expect.EQ(t, parse(encodingBeta, encodeITF8(1), encodeITF8(5)).readInt(d), int32(9))
+	expect.EQ(t, parse(encodingGamma, encodeITF8(0)).readInt(d), int32(5))
+	subexp := parse(encodingSubexp, encodeITF8(0), encodeITF8(2))
+	expect.EQ(t, subexp.readInt(d), int32(3))
+	expect.EQ(t, subexp.readInt(d), int32(13))
+	huffman := parse(encodingHuffman, encodeITF8Array([]int32{40, 30, 20, 10}), encodeITF8Array([]int32{3, 3, 2, 1}))
+	for _, v := range []int32{30, 10, 20, 40} {
+		expect.EQ(t, huffman.readInt(d), v)
+	}
+	// A single-symbol Huffman code reads no bits.
+	expect.EQ(t, parse(encodingHuffman, encodeITF8Array([]int32{7}), encodeITF8Array([]int32{0})).readInt(d), int32(7))
+	assert.NoError(t, d.err)
+
+	external := parse(encodingExternal, encodeITF8(1))
+	expect.EQ(t, external.readInt(d), int32(300))
+	expect.EQ(t, external.readByte(d), byte('x'))
+	stop := parse(encodingByteArrayStop, []byte{'\t'}, encodeITF8(2))
+	expect.EQ(t, string(stop.readArray(d)), "abc")
+	expect.EQ(t, string(stop.readArray(d)), "def")
+	byteArrayLen := parse(encodingByteArrayLen, encodeEncoding(encodingExternal, encodeITF8(3)), encodeEncoding(encodingExternal, encodeITF8(4)))
+	expect.EQ(t, string(byteArrayLen.readArray(d)), "wxyz")
+	assert.NoError(t, d.err)
+
+	// Reading past the end of a block is an error.
+	external.readByte(d)
+	expect.EQ(t, d.err, errShort)
+
+	_, err := parseEncoding(newByteReader(encodeEncoding(2, encodeITF8(1))))
+	expect.HasSubstr(t, err.Error(), "unsupported encoding 2")
+}
@@ -0,0 +1,17 @@
+// Package cram implements a reader for CRAM 3.0 files.  See
+// https://samtools.github.io/hts-specs/CRAMv3.pdf for the format.
+//
+// A CRAM file stores alignments as differences against a reference genome, so
+// reading one generally requires the reference that the file was written
+// against.  The reference is supplied as a fasta.Fasta.  Slices that embed
+// their reference, and records that store their bases verbatim, can be
+// decoded without it.  The reader checks the CRC32s of the containers and
+// blocks, and checks the reference against the MD5 recorded in each slice.
+//
+// The reader supports the core, external, Huffman, beta, gamma, subexp,
+// byte-array-len and byte-array-stop encodings, and raw, gzip, bzip2 and
+// rANS 4x8 block compression.  LZMA and the CRAM 3.1 codecs are not
+// supported.  Random access uses the ".crai" index; see ReadIndex.  For files
+// without one, BuildIndex builds an equivalent index from the container
+// headers.
+package cram
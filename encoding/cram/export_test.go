@@ -0,0 +1,19 @@
+package cram
+
+import (
+	"testing"
+
+	"github.com/Schaudge/hts/sam"
+)
+
+// GenerateTestFiles returns a CRAM file, its index, the reference in FASTA
+// format, and the records stored in the file.
+func GenerateTestFiles(t *testing.T, recordsPerContainer int) (data, index []byte, fa string, recs []*sam.Record) {
+	header, ref, recs := testData(t)
+	w := newTestCRAMWriter(header, ref, testWriterOpts{recordsPerContainer: recordsPerContainer})
+	w.writeRecords(recs)
+	for _, name := range []string{"chr1", "chr2"} {
+		fa += ">" + name + "\n" + ref[name] + "\n"
+	}
+	return w.buf.Bytes(), encodeIndex(w.index), fa, recs
+}
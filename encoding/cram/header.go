@@ -0,0 +1,238 @@
+package cram
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+)
+
+// containerHeader is the header of a CRAM 3 container.
+type containerHeader struct {
+	length    int32 // byte length of the container body.
+	refID     int32
+	start     int32 // 1-based alignment start.
+	span      int32
+	nRecords  int32
+	counter   int64
+	bases     int64
+	nBlocks   int32
+	landmarks []int32
+}
+
+// readContainerHeader reads a container header from r. It returns io.EOF if r
+// is at the end of the stream.
+func readContainerHeader(r *bufio.Reader) (*containerHeader, error) {
+	var buf [4]byte
+	if _, err := io.ReadFull(r, buf[:]); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = errShort
+		}
+		return nil, err
+	}
+	h := &containerHeader{length: newByteReader(buf[:]).int32()}
+	cr := &crcByteReader{r: r, crc: crc32.ChecksumIEEE(buf[:])}
+	var err error
+	readInt := func() int32 {
+		var v int32
+		if err == nil {
+			v, err = readITF8(cr)
+		}
+		return v
+	}
+	readLong := func() int64 {
+		var v int64
+		if err == nil {
+			v, err = readLTF8(cr)
+		}
+		return v
+	}
+	h.refID = readInt()
+	h.start = readInt()
+	h.span = readInt()
+	h.nRecords = readInt()
+	h.counter = readLong()
+	h.bases = readLong()
+	h.nBlocks = readInt()
+	n := readInt()
+	if n < 0 {
+		return nil, fmt.Errorf("cram: invalid landmark count %d", n)
+	}
+	for i := int32(0); i < n && err == nil; i++ {
+		h.landmarks = append(h.landmarks, readInt())
+	}
+	if err == nil {
+		_, err = io.ReadFull(r, buf[:])
+	}
+	if err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			err = errShort
+		}
+		return nil, err
+	}
+	if crc := binary.LittleEndian.Uint32(buf[:]); crc != cr.crc {
+		return nil, fmt.Errorf("cram: container header CRC32 mismatch: got %08x, expect %08x", cr.crc, crc)
+	}
+	return h, nil
+}
+
+// crcByteReader computes the CRC32 of the bytes read through it.
+type crcByteReader struct {
+	r   io.ByteReader
+	crc uint32
+}
+
+func (c *crcByteReader) ReadByte() (byte, error) {
+	b, err := c.r.ReadByte()
+	if err == nil {
+		c.crc = crc32.Update(c.crc, crc32.IEEETable, []byte{b})
+	}
+	return b, err
+}
+
+// compressionHeader describes how the records of a container are encoded.
+type compressionHeader struct {
+	readNamesIncluded bool // RN
+	apDelta           bool // AP
+	refRequired       bool // RR
+	// subst[r][code] is the read base for reference base r (in "ACGTN" order)
+	// and the substitution code.
+	subst [5][4]byte
+	// tagLines are the tag-id dictionary. Each tag id consists of two
+	// characters and the BAM type.
+	tagLines   [][][3]byte
+	dataSeries map[string]codec
+	tags       map[int32]codec
+}
+
+const substBases = "ACGTN"
+
+func parseCompressionHeader(data []byte) (*compressionHeader, error) {
+	h := &compressionHeader{
+		readNamesIncluded: true,
+		apDelta:           true,
+		refRequired:       true,
+		dataSeries:        map[string]codec{},
+		tags:              map[int32]codec{},
+	}
+	// Default substitution matrix, used if SM is missing.
+	for r := range h.subst {
+		k := 0
+		for _, b := range []byte(substBases) {
+			if b != substBases[r] {
+				h.subst[r][k] = b
+				k++
+			}
+		}
+	}
+
+	r := newByteReader(data)
+	// Preservation map.
+	r.itf8() // byte size
+	n := r.itf8()
+	for i := int32(0); i < n && r.err == nil; i++ {
+		key := string(r.bytes(2))
+		switch key {
+		case "RN":
+			h.readNamesIncluded = r.byte() != 0
+		case "AP":
+			h.apDelta = r.byte() != 0
+		case "RR":
+			h.refRequired = r.byte() != 0
+		case "SM":
+			sm := r.bytes(5)
+			if sm == nil {
+				break
+			}
+			for ri := range h.subst {
+				k := 0
+				for _, b := range []byte(substBases) {
+					if b == substBases[ri] {
+						continue
+					}
+					code := sm[ri] >> uint(6-2*k) & 3
+					h.subst[ri][code] = b
+					k++
+				}
+			}
+		case "TD":
+			td := r.bytes(int(r.itf8()))
+			var line [][3]byte
+			for i := 0; i < len(td); {
+				if td[i] == 0 {
+					h.tagLines = append(h.tagLines, line)
+					line = nil
+					i++
+					continue
+				}
+				if i+3 > len(td) {
+					return nil, fmt.Errorf("cram: malformed tag dictionary")
+				}
+				line = append(line, [3]byte{td[i], td[i+1], td[i+2]})
+				i += 3
+			}
+		default:
+			return nil, fmt.Errorf("cram: unknown preservation map key %q", key)
+		}
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	// Data series encoding map.
+	r.itf8()
+	n = r.itf8()
+	for i := int32(0); i < n && r.err == nil; i++ {
+		key := string(r.bytes(2))
+		c, err := parseEncoding(r)
+		if err != nil {
+			return nil, fmt.Errorf("cram: data series %s: %v", key, err)
+		}
+		h.dataSeries[key] = c
+	}
+
+	// Tag encoding map.
+	r.itf8()
+	n = r.itf8()
+	for i := int32(0); i < n && r.err == nil; i++ {
+		key := r.itf8()
+		c, err := parseEncoding(r)
+		if err != nil {
+			return nil, fmt.Errorf("cram: tag %c%c: %v", byte(key>>16), byte(key>>8), err)
+		}
+		h.tags[key] = c
+	}
+	return h, r.err
+}
+
+// sliceHeader is the header of a slice.
+type sliceHeader struct {
+	refID      int32 // -1 for unmapped, -2 for multiple references.
+	start      int32 // 1-based alignment start.
+	span       int32
+	nRecords   int32
+	counter    int64
+	nBlocks    int32
+	blockIDs   []int32
+	embeddedID int32 // content id of the embedded reference, or -1.
+	// refMD5 is the MD5 of the reference bases in [start, start+span), or all
+	// zeros if the slice is not on a single reference.
+	refMD5 [16]byte
+}
+
+func parseSliceHeader(data []byte) (*sliceHeader, error) {
+	r := newByteReader(data)
+	h := &sliceHeader{
+		refID:    r.itf8(),
+		start:    r.itf8(),
+		span:     r.itf8(),
+		nRecords: r.itf8(),
+		counter:  r.ltf8(),
+		nBlocks:  r.itf8(),
+	}
+	h.blockIDs = r.itf8Array()
+	h.embeddedID = r.itf8()
+	copy(h.refMD5[:], r.bytes(16))
+	return h, r.err
+}
@@ -0,0 +1,120 @@
+package cram
+
+import (
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// IndexEntry is one line of a CRAM index (*.crai). It describes a slice, or
+// the part of a multi-reference slice that is aligned to one reference.
+type IndexEntry struct {
+	// RefID is the reference id, or -1 for unmapped reads.
+	RefID int
+	// Start is the 1-based alignment start, and Span is the number of
+	// reference bases covered by the slice.
+	Start, Span int
+	// ContainerOffset is the byte offset of the container in the file.
+	ContainerOffset int64
+	// SliceOffset is the byte offset of the slice from the end of the
+	// container header, and SliceSize is its size in bytes.
+	SliceOffset, SliceSize int64
+}
+
+// ReadIndex parses a gzipped CRAM index.
+func ReadIndex(r io.Reader) ([]IndexEntry, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("cram: failed to read index: %v", err)
+	}
+	var entries []IndexEntry
+	scanner := bufio.NewScanner(gz)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 6 {
+			return nil, fmt.Errorf("cram: index line %d: expect 6 fields, found %d", n, len(fields))
+		}
+		var v [6]int64
+		for i, f := range fields {
+			if v[i], err = strconv.ParseInt(f, 10, 64); err != nil {
+				return nil, fmt.Errorf("cram: index line %d: %v", n, err)
+			}
+		}
+		entries = append(entries, IndexEntry{
+			RefID:           int(v[0]),
+			Start:           int(v[1]),
+			Span:            int(v[2]),
+			ContainerOffset: v[3],
+			SliceOffset:     v[4],
+			SliceSize:       v[5],
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return entries, gz.Close()
+}
+
+// countingReader counts the bytes read from r.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// BuildIndex scans the container headers of a CRAM file and returns one
+// IndexEntry per container that holds records, for use when the file has no
+// index. The container bodies are not decoded, so a container that holds
+// records of more than one reference is reported with RefID -2, and a container
+// with more than one slice is reported as a single slice.
+func BuildIndex(r io.Reader) ([]IndexEntry, error) {
+	cr := &countingReader{r: r}
+	br := bufio.NewReader(cr)
+	if _, err := br.Discard(fileDefinitionSize); err != nil {
+		return nil, fmt.Errorf("cram: failed to read the file definition: %v", err)
+	}
+	var entries []IndexEntry
+	for first := true; ; first = false {
+		off := cr.n - int64(br.Buffered())
+		h, err := readContainerHeader(br)
+		if err == io.EOF {
+			return entries, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if h.length < 0 {
+			return nil, fmt.Errorf("cram: invalid container length %d", h.length)
+		}
+		if _, err := br.Discard(int(h.length)); err != nil {
+			return nil, errShort
+		}
+		// The first container holds the SAM header.
+		if first || h.nRecords == 0 {
+			continue
+		}
+		e := IndexEntry{
+			RefID:           int(h.refID),
+			Start:           int(h.start),
+			Span:            int(h.span),
+			ContainerOffset: off,
+		}
+		if len(h.landmarks) > 0 {
+			e.SliceOffset = int64(h.landmarks[0])
+			e.SliceSize = int64(h.length) - e.SliceOffset
+		}
+		entries = append(entries, e)
+	}
+}
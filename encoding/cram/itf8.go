@@ -0,0 +1,144 @@
+package cram
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+// errShort is returned when a CRAM structure ends before all of its fields
+// are read.
+var errShort = errors.New("cram: truncated data")
+
+// byteReader reads the CRAM primitive types from an in-memory buffer.
+type byteReader struct {
+	buf []byte
+	off int
+	err error
+}
+
+func newByteReader(buf []byte) *byteReader {
+	return &byteReader{buf: buf}
+}
+
+func (r *byteReader) remaining() int { return len(r.buf) - r.off }
+
+func (r *byteReader) byte() byte {
+	if r.off >= len(r.buf) {
+		r.err = errShort
+		return 0
+	}
+	b := r.buf[r.off]
+	r.off++
+	return b
+}
+
+func (r *byteReader) bytes(n int) []byte {
+	if n < 0 || r.off+n > len(r.buf) {
+		r.err = errShort
+		r.off = len(r.buf)
+		return nil
+	}
+	b := r.buf[r.off : r.off+n]
+	r.off += n
+	return b
+}
+
+func (r *byteReader) int32() int32 {
+	b := r.bytes(4)
+	if b == nil {
+		return 0
+	}
+	return int32(binary.LittleEndian.Uint32(b))
+}
+
+// itf8 reads an ITF-8 encoded integer.
+func (r *byteReader) itf8() int32 {
+	b0 := r.byte()
+	switch {
+	case b0&0x80 == 0:
+		return int32(b0)
+	case b0&0x40 == 0:
+		return int32(b0&0x3f)<<8 | int32(r.byte())
+	case b0&0x20 == 0:
+		return int32(b0&0x1f)<<16 | int32(r.byte())<<8 | int32(r.byte())
+	case b0&0x10 == 0:
+		return int32(b0&0x0f)<<24 | int32(r.byte())<<16 | int32(r.byte())<<8 | int32(r.byte())
+	default:
+		v := uint32(b0&0x0f)<<28 | uint32(r.byte())<<20 | uint32(r.byte())<<12 | uint32(r.byte())<<4
+		return int32(v | uint32(r.byte()&0x0f))
+	}
+}
+
+// ltf8 reads an LTF-8 encoded integer.
+func (r *byteReader) ltf8() int64 {
+	b0 := r.byte()
+	n := 0 // number of bytes that follow b0.
+	for n < 8 && b0&(0x80>>uint(n)) != 0 {
+		n++
+	}
+	var v uint64
+	if n < 7 {
+		v = uint64(b0 & (0x7f >> uint(n)))
+	}
+	for i := 0; i < n; i++ {
+		v = v<<8 | uint64(r.byte())
+	}
+	return int64(v)
+}
+
+// itf8Array reads an ITF-8 count followed by that many ITF-8 integers.
+func (r *byteReader) itf8Array() []int32 {
+	n := r.itf8()
+	if n < 0 || int(n) > r.remaining() {
+		r.err = errShort
+		return nil
+	}
+	a := make([]int32, n)
+	for i := range a {
+		a[i] = r.itf8()
+	}
+	return a
+}
+
+// readITF8 reads an ITF-8 encoded integer from a stream.
+func readITF8(r io.ByteReader) (int32, error) {
+	var buf [5]byte
+	b0, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	buf[0] = b0
+	n := 0
+	for n < 4 && b0&(0x80>>uint(n)) != 0 {
+		n++
+	}
+	for i := 1; i <= n; i++ {
+		if buf[i], err = r.ReadByte(); err != nil {
+			return 0, errShort
+		}
+	}
+	br := newByteReader(buf[:n+1])
+	return br.itf8(), nil
+}
+
+// readLTF8 reads an LTF-8 encoded integer from a stream.
+func readLTF8(r io.ByteReader) (int64, error) {
+	var buf [9]byte
+	b0, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	buf[0] = b0
+	n := 0
+	for n < 8 && b0&(0x80>>uint(n)) != 0 {
+		n++
+	}
+	for i := 1; i <= n; i++ {
+		if buf[i], err = r.ReadByte(); err != nil {
+			return 0, errShort
+		}
+	}
+	br := newByteReader(buf[:n+1])
+	return br.ltf8(), nil
+}
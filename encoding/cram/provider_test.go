@@ -0,0 +1,83 @@
+package cram_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Schaudge/grailbio/encoding/bamprovider"
+	"github.com/Schaudge/grailbio/encoding/cram"
+	"github.com/Schaudge/grailbio/encoding/fasta"
+	"github.com/grailbio/testutil"
+	"github.com/grailbio/testutil/assert"
+	"github.com/grailbio/testutil/expect"
+)
+
+func readNames(t *testing.T, iter bamprovider.Iterator) []string {
+	var names []string
+	for iter.Scan() {
+		names = append(names, iter.Record().Name)
+	}
+	assert.NoError(t, iter.Close())
+	return names
+}
+
+func TestCRAMProvider(t *testing.T) {
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	data, index, faText, recs := cram.GenerateTestFiles(t, 4)
+	path := filepath.Join(tempDir, "test.cram")
+	assert.NoError(t, ioutil.WriteFile(path, data, 0644))
+	var allNames, chr2Names []string
+	for _, rec := range recs {
+		allNames = append(allNames, rec.Name)
+		if rec.Ref != nil && rec.Ref.Name() == "chr2" && rec.Pos >= 300 && rec.Pos < 700 {
+			chr2Names = append(chr2Names, rec.Name)
+		}
+	}
+
+	for _, encoding := range []fasta.Encoding{fasta.RawASCII, fasta.CleanASCII} {
+		for _, indexed := range []bool{false, true} {
+			if indexed {
+				assert.NoError(t, ioutil.WriteFile(path+".crai", index, 0644))
+			} else {
+				os.Remove(path + ".crai") // nolint: errcheck
+			}
+			fa, err := fasta.New(strings.NewReader(faText), fasta.OptEncoding(encoding))
+			assert.NoError(t, err)
+			expect.EQ(t, bamprovider.GuessFileType(path), bamprovider.CRAM)
+			p := bamprovider.NewProvider(path, bamprovider.ProviderOpts{Reference: fa})
+			header, err := p.GetHeader()
+			assert.NoError(t, err)
+			expect.EQ(t, len(header.Refs()), 2)
+
+			shards, err := p.GenerateShards(bamprovider.GenerateShardsOpts{IncludeUnmapped: true})
+			assert.NoError(t, err)
+			var names []string
+			for _, shard := range shards {
+				names = append(names, readNames(t, p.NewIterator(shard))...)
+			}
+			expect.EQ(t, names, allNames)
+			expect.EQ(t, readNames(t, bamprovider.NewRefIterator(p, "chr2", 300, 700)), chr2Names)
+			assert.NoError(t, p.Close())
+		}
+	}
+
+	// A Seq8-encoded reference is rejected.
+	fa, err := fasta.New(strings.NewReader(faText), fasta.OptEncoding(fasta.Seq8))
+	assert.NoError(t, err)
+	p := bamprovider.NewProvider(path, bamprovider.ProviderOpts{Reference: fa})
+	iter := bamprovider.NewRefIterator(p, "chr1", 0, 1000)
+	expect.False(t, iter.Scan())
+	expect.HasSubstr(t, iter.Close().Error(), "not ASCII-encoded")
+	expect.NotNil(t, p.Close())
+
+	// Without the reference, mapped reads cannot be decoded.
+	p = bamprovider.NewProvider(path)
+	iter = bamprovider.NewRefIterator(p, "chr1", 0, 1000)
+	expect.False(t, iter.Scan())
+	expect.HasSubstr(t, iter.Close().Error(), "reference sequence is required")
+	expect.NotNil(t, p.Close())
+}
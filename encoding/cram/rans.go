@@ -0,0 +1,197 @@
+package cram
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+const (
+	ransTotFreqBits = 12
+	ransTotFreq     = 1 << ransTotFreqBits
+	ransLowerBound  = 1 << 23
+)
+
+var errRANSCorrupt = errors.New("cram: corrupt rANS data")
+
+// ransTable is the decoding table for one rANS context.
+type ransTable struct {
+	freq [256]uint32
+	cum  [256]uint32
+	sym  []byte // maps a slot in [0,ransTotFreq) to the symbol.
+}
+
+// readRANSTable reads a run-length encoded frequency table into t.
+func readRANSTable(r *byteReader, t *ransTable) error {
+	t.sym = make([]byte, ransTotFreq)
+	var (
+		x   uint32
+		rle int
+	)
+	j := int(r.byte())
+	for {
+		f := uint32(r.byte())
+		if f >= 128 {
+			f = (f&0x7f)<<8 | uint32(r.byte())
+		}
+		if r.err != nil {
+			return r.err
+		}
+		if x+f > ransTotFreq {
+			return errRANSCorrupt
+		}
+		t.freq[j] = f
+		t.cum[j] = x
+		for k := x; k < x+f; k++ {
+			t.sym[k] = byte(j)
+		}
+		x += f
+
+		switch {
+		case rle == 0 && r.remaining() > 0 && int(r.buf[r.off]) == j+1:
+			j = int(r.byte())
+			rle = int(r.byte())
+		case rle > 0:
+			rle--
+			j++
+		default:
+			j = int(r.byte())
+		}
+		if j == 0 || j > 255 {
+			break
+		}
+	}
+	if x > ransTotFreq {
+		return errRANSCorrupt
+	}
+	return r.err
+}
+
+// ransState is one of the four interleaved rANS decoders.
+type ransState struct {
+	x uint32
+	r *byteReader
+}
+
+func (s *ransState) peek() uint32 { return s.x & (ransTotFreq - 1) }
+
+func (s *ransState) advance(t *ransTable, c byte) {
+	s.x = t.freq[c]*(s.x>>ransTotFreqBits) + s.peek() - t.cum[c]
+	for s.x < ransLowerBound && s.r.err == nil {
+		s.x = s.x<<8 | uint32(s.r.byte())
+	}
+}
+
+// ransDecode decompresses a block compressed with the rANS 4x8 codec.
+func ransDecode(in []byte) ([]byte, error) {
+	if len(in) < 9 {
+		return nil, errRANSCorrupt
+	}
+	order := in[0]
+	compSize := binary.LittleEndian.Uint32(in[1:5])
+	rawSize := binary.LittleEndian.Uint32(in[5:9])
+	if int(compSize) > len(in)-9 {
+		return nil, errRANSCorrupt
+	}
+	r := newByteReader(in[9 : 9+compSize])
+	out := make([]byte, rawSize)
+	var err error
+	switch order {
+	case 0:
+		err = ransDecode0(r, out)
+	case 1:
+		err = ransDecode1(r, out)
+	default:
+		err = fmt.Errorf("cram: unsupported rANS order %d", order)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func readRANSStates(r *byteReader) [4]ransState {
+	var s [4]ransState
+	for i := range s {
+		s[i] = ransState{x: uint32(r.int32()), r: r}
+	}
+	return s
+}
+
+func ransDecode0(r *byteReader, out []byte) error {
+	var t ransTable
+	if err := readRANSTable(r, &t); err != nil {
+		return err
+	}
+	s := readRANSStates(r)
+	end := len(out) &^ 3
+	for i := 0; i < end; i += 4 {
+		for j := range s {
+			c := t.sym[s[j].peek()]
+			out[i+j] = c
+			s[j].advance(&t, c)
+		}
+	}
+	// The trailing symbols are decoded without advancing the states.
+	for j := 0; end+j < len(out); j++ {
+		out[end+j] = t.sym[s[j].peek()]
+	}
+	return r.err
+}
+
+func ransDecode1(r *byteReader, out []byte) error {
+	var tables [256]*ransTable
+	var rle int
+	i := int(r.byte())
+	for {
+		t := &ransTable{}
+		if err := readRANSTable(r, t); err != nil {
+			return err
+		}
+		tables[i] = t
+		switch {
+		case rle == 0 && r.remaining() > 0 && int(r.buf[r.off]) == i+1:
+			i = int(r.byte())
+			rle = int(r.byte())
+		case rle > 0:
+			rle--
+			i++
+		default:
+			i = int(r.byte())
+		}
+		if i == 0 || i > 255 || r.err != nil {
+			break
+		}
+	}
+	if r.err != nil {
+		return r.err
+	}
+	s := readRANSStates(r)
+	quarter := len(out) >> 2
+	var ctx [4]byte
+	decode := func(j, pos int) error {
+		t := tables[ctx[j]]
+		if t == nil {
+			return errRANSCorrupt
+		}
+		c := t.sym[s[j].peek()]
+		out[pos] = c
+		s[j].advance(t, c)
+		ctx[j] = c
+		return nil
+	}
+	for i := 0; i < quarter; i++ {
+		for j := range s {
+			if err := decode(j, j*quarter+i); err != nil {
+				return err
+			}
+		}
+	}
+	// The remainder is decoded by the last state.
+	for pos := 4 * quarter; pos < len(out); pos++ {
+		if err := decode(3, pos); err != nil {
+			return err
+		}
+	}
+	return r.err
+}
@@ -0,0 +1,227 @@
+package cram
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"testing"
+
+	"github.com/grailbio/testutil/assert"
+	"github.com/grailbio/testutil/expect"
+)
+
+// ransEncTable is a normalized frequency table used by the test encoder.
+type ransEncTable struct {
+	freq, cum [256]uint32
+}
+
+func normalizeRANSFreqs(counts *[256]int) *ransEncTable {
+	t := &ransEncTable{}
+	total, maxSym := 0, 0
+	for s, c := range counts {
+		total += c
+		if c > counts[maxSym] {
+			maxSym = s
+		}
+	}
+	assigned := uint32(0)
+	for s, c := range counts {
+		if c == 0 {
+			continue
+		}
+		f := uint32(c * ransTotFreq / total)
+		if f == 0 {
+			f = 1
+		}
+		t.freq[s] = f
+		assigned += f
+	}
+	t.freq[maxSym] += ransTotFreq - assigned
+	x := uint32(0)
+	for s := range t.freq {
+		t.cum[s] = x
+		x += t.freq[s]
+	}
+	return t
+}
+
+// writeRANSTable writes a frequency table in the run-length encoded format
+// read by readRANSTable.
+func writeRANSTable(out []byte, t *ransEncTable) []byte {
+	rle := 0
+	for j := 0; j < 256; j++ {
+		if t.freq[j] == 0 {
+			continue
+		}
+		if rle > 0 {
+			rle--
+		} else {
+			out = append(out, byte(j))
+			if j > 0 && t.freq[j-1] > 0 {
+				for rle = j + 1; rle < 256 && t.freq[rle] > 0; rle++ {
+				}
+				rle -= j + 1
+				out = append(out, byte(rle))
+			}
+		}
+		if f := t.freq[j]; f < 128 {
+			out = append(out, byte(f))
+		} else {
+			out = append(out, byte(0x80|f>>8), byte(f))
+		}
+	}
+	return append(out, 0)
+}
+
+// ransOp is one symbol coded by one of the four states, listed in decoding
+// order.
+type ransOp struct {
+	state int
+	table *ransEncTable
+	sym   byte
+}
+
+// ransEncodeOps encodes ops, and returns the initial states followed by the
+// renormalization bytes.
+func ransEncodeOps(ops []ransOp) []byte {
+	var (
+		x   [4]uint32
+		rev []byte // output, in reverse.
+	)
+	for i := range x {
+		x[i] = ransLowerBound
+	}
+	for i := len(ops) - 1; i >= 0; i-- {
+		op := ops[i]
+		f, c := op.table.freq[op.sym], op.table.cum[op.sym]
+		s := &x[op.state]
+		xmax := ((ransLowerBound >> ransTotFreqBits) << 8) * f
+		for *s >= xmax {
+			rev = append(rev, byte(*s))
+			*s >>= 8
+		}
+		*s = (*s/f)<<ransTotFreqBits + *s%f + c
+	}
+	for j := 3; j >= 0; j-- {
+		rev = append(rev, byte(x[j]>>24), byte(x[j]>>16), byte(x[j]>>8), byte(x[j]))
+	}
+	out := make([]byte, len(rev))
+	for i, b := range rev {
+		out[len(rev)-1-i] = b
+	}
+	return out
+}
+
+func ransFrame(order byte, payload []byte, rawSize int) []byte {
+	out := []byte{order, 0, 0, 0, 0, 0, 0, 0, 0}
+	binary.LittleEndian.PutUint32(out[1:], uint32(len(payload)))
+	binary.LittleEndian.PutUint32(out[5:], uint32(rawSize))
+	return append(out, payload...)
+}
+
+// ransEncode0 compresses data with the order-0 rANS 4x8 codec.
+func ransEncode0(data []byte) []byte {
+	var counts [256]int
+	for _, b := range data {
+		counts[b]++
+	}
+	t := normalizeRANSFreqs(&counts)
+	var ops []ransOp
+	end := len(data) &^ 3
+	for i := 0; i < end; i += 4 {
+		for j := 0; j < 4; j++ {
+			ops = append(ops, ransOp{j, t, data[i+j]})
+		}
+	}
+	for j := 0; end+j < len(data); j++ {
+		ops = append(ops, ransOp{j, t, data[end+j]})
+	}
+	payload := writeRANSTable(nil, t)
+	return ransFrame(0, append(payload, ransEncodeOps(ops)...), len(data))
+}
+
+// ransEncode1 compresses data with the order-1 rANS 4x8 codec.
+func ransEncode1(data []byte) []byte {
+	type ctxSym struct{ ctx, sym byte }
+	var seq []struct {
+		state int
+		cs    ctxSym
+	}
+	quarter := len(data) >> 2
+	var ctx [4]byte
+	add := func(j, pos int) {
+		seq = append(seq, struct {
+			state int
+			cs    ctxSym
+		}{j, ctxSym{ctx[j], data[pos]}})
+		ctx[j] = data[pos]
+	}
+	for i := 0; i < quarter; i++ {
+		for j := 0; j < 4; j++ {
+			add(j, j*quarter+i)
+		}
+	}
+	for pos := 4 * quarter; pos < len(data); pos++ {
+		add(3, pos)
+	}
+	var counts [256][256]int
+	var used [256]bool
+	for _, s := range seq {
+		counts[s.cs.ctx][s.cs.sym]++
+		used[s.cs.ctx] = true
+	}
+	var tables [256]*ransEncTable
+	var payload []byte
+	rle := 0
+	for i := 0; i < 256; i++ {
+		if !used[i] {
+			continue
+		}
+		tables[i] = normalizeRANSFreqs(&counts[i])
+		if rle > 0 {
+			rle--
+		} else {
+			payload = append(payload, byte(i))
+			if i > 0 && used[i-1] {
+				for rle = i + 1; rle < 256 && used[rle]; rle++ {
+				}
+				rle -= i + 1
+				payload = append(payload, byte(rle))
+			}
+		}
+		payload = writeRANSTable(payload, tables[i])
+	}
+	payload = append(payload, 0)
+	ops := make([]ransOp, len(seq))
+	for i, s := range seq {
+		ops[i] = ransOp{s.state, tables[s.cs.ctx], s.cs.sym}
+	}
+	return ransFrame(1, append(payload, ransEncodeOps(ops)...), len(data))
+}
+
+func TestRANS(t *testing.T) {
+	r := rand.New(rand.NewSource(0))
+	for _, n := range []int{1, 2, 3, 4, 5, 7, 64, 1001, 100003} {
+		for _, alphabet := range []int{1, 4, 40, 256} {
+			data := make([]byte, n)
+			for i := range data {
+				// Skew the distribution so that the frequencies differ.
+				data[i] = byte(r.Intn(alphabet) * r.Intn(alphabet) / alphabet)
+			}
+			for order, encode := range []func([]byte) []byte{ransEncode0, ransEncode1} {
+				got, err := ransDecode(encode(data))
+				assert.NoError(t, err, "n=%d alphabet=%d order=%d", n, alphabet, order)
+				expect.EQ(t, got, data, "n=%d alphabet=%d order=%d", n, alphabet, order)
+			}
+		}
+	}
+}
+
+func TestRANSCorrupt(t *testing.T) {
+	_, err := ransDecode([]byte{0, 1})
+	expect.NotNil(t, err)
+	_, err = ransDecode(ransFrame(2, []byte{0}, 1))
+	expect.HasSubstr(t, err.Error(), "unsupported rANS order")
+	data := ransEncode0([]byte("ACGTACGTTT"))
+	_, err = ransDecode(data[:len(data)-6])
+	expect.NotNil(t, err)
+}
@@ -0,0 +1,180 @@
+package cram
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+
+	"github.com/Schaudge/grailbio/encoding/fasta"
+	"github.com/Schaudge/hts/sam"
+)
+
+// fileDefinitionSize is the size of the CRAM file definition: the "CRAM"
+// magic, the major and minor versions, and a 20-byte file id.
+const fileDefinitionSize = 26
+
+// Reader reads records from a CRAM file.
+type Reader struct {
+	r      io.Reader
+	br     *bufio.Reader
+	ref    fasta.Fasta
+	header *sam.Header
+	recs   []*sam.Record
+}
+
+// NewReader reads the file definition and the SAM header from r and returns a
+// Reader positioned at the first record. ref is used to reconstruct read
+// sequences. It must be ASCII-encoded (fasta.RawASCII or fasta.CleanASCII),
+// and may be nil if the file does not depend on an external reference. r must implement io.Seeker for Reader.SeekContainer to work.
+func NewReader(r io.Reader, ref fasta.Fasta) (*Reader, error) {
+	cr := &Reader{r: r, br: bufio.NewReader(r), ref: ref}
+	var def [fileDefinitionSize]byte
+	if _, err := io.ReadFull(cr.br, def[:]); err != nil {
+		return nil, fmt.Errorf("cram: failed to read the file definition: %v", err)
+	}
+	if string(def[:4]) != "CRAM" {
+		return nil, fmt.Errorf("cram: not a CRAM file")
+	}
+	if def[4] != 3 {
+		return nil, fmt.Errorf("cram: unsupported CRAM version %d.%d", def[4], def[5])
+	}
+	body, _, err := cr.readContainer()
+	if err != nil {
+		return nil, fmt.Errorf("cram: failed to read the header container: %v", err)
+	}
+	b, err := readBlock(newByteReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if b.contentType != contentFileHeader {
+		return nil, fmt.Errorf("cram: expect a file header block, found content type %d", b.contentType)
+	}
+	br := newByteReader(b.data)
+	n := br.int32()
+	text := br.bytes(int(n))
+	if br.err != nil {
+		return nil, fmt.Errorf("cram: truncated SAM header")
+	}
+	if cr.header, err = sam.NewHeader(text, nil); err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// Header returns the SAM header. The caller must not modify it.
+func (r *Reader) Header() *sam.Header {
+	return r.header
+}
+
+// SeekContainer moves the reader to the container that starts at the given byte
+// offset, as found in IndexEntry.ContainerOffset.
+func (r *Reader) SeekContainer(off int64) error {
+	s, ok := r.r.(io.Seeker)
+	if !ok {
+		return fmt.Errorf("cram: reader is not seekable")
+	}
+	if _, err := s.Seek(off, io.SeekStart); err != nil {
+		return err
+	}
+	r.br.Reset(r.r)
+	r.recs = nil
+	return nil
+}
+
+// Read returns the next record. It returns io.EOF at the end of the file.
+func (r *Reader) Read() (*sam.Record, error) {
+	for len(r.recs) == 0 {
+		body, h, err := r.readContainer()
+		if err != nil {
+			return nil, err
+		}
+		if h.nRecords == 0 {
+			continue
+		}
+		if r.recs, err = r.decodeContainer(body, h); err != nil {
+			return nil, err
+		}
+	}
+	rec := r.recs[0]
+	r.recs = r.recs[1:]
+	return rec, nil
+}
+
+// readContainer reads the next container and returns its body.
+func (r *Reader) readContainer() ([]byte, *containerHeader, error) {
+	h, err := readContainerHeader(r.br)
+	if err != nil {
+		return nil, nil, err
+	}
+	if h.length < 0 {
+		return nil, nil, fmt.Errorf("cram: invalid container length %d", h.length)
+	}
+	body := make([]byte, h.length)
+	if _, err := io.ReadFull(r.br, body); err != nil {
+		return nil, nil, errShort
+	}
+	return body, h, nil
+}
+
+// decodeContainer decodes all the records in a container.
+func (r *Reader) decodeContainer(body []byte, h *containerHeader) ([]*sam.Record, error) {
+	br := newByteReader(body)
+	b, err := readBlock(br)
+	if err != nil {
+		return nil, err
+	}
+	if b.contentType != contentCompressionHeader {
+		return nil, fmt.Errorf("cram: expect a compression header block, found content type %d", b.contentType)
+	}
+	comp, err := parseCompressionHeader(b.data)
+	if err != nil {
+		return nil, err
+	}
+	var recs []*sam.Record
+	for _, landmark := range h.landmarks {
+		if landmark < 0 || int(landmark) >= len(body) {
+			return nil, fmt.Errorf("cram: invalid slice offset %d", landmark)
+		}
+		br.off = int(landmark)
+		if b, err = readBlock(br); err != nil {
+			return nil, err
+		}
+		if b.contentType != contentSliceHeader {
+			return nil, fmt.Errorf("cram: expect a slice header block, found content type %d", b.contentType)
+		}
+		sh, err := parseSliceHeader(b.data)
+		if err != nil {
+			return nil, err
+		}
+		s := &sliceDecoder{
+			header: r.header,
+			ref:    r.ref,
+			comp:   comp,
+			slice:  sh,
+			data:   &sliceData{external: map[int32]*byteReader{}},
+		}
+		for i := int32(0); i < sh.nBlocks; i++ {
+			if b, err = readBlock(br); err != nil {
+				return nil, err
+			}
+			switch b.contentType {
+			case contentCore:
+				s.data.core = b.data
+			case contentExternal:
+				s.data.external[b.contentID] = newByteReader(b.data)
+				if b.contentID == sh.embeddedID {
+					s.embedded = b.data
+				}
+			}
+		}
+		if err := s.checkReference(); err != nil {
+			return nil, err
+		}
+		slice, err := s.decode()
+		if err != nil {
+			return nil, err
+		}
+		recs = append(recs, slice...)
+	}
+	return recs, nil
+}
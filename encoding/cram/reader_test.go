@@ -0,0 +1,876 @@
+package cram
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/Schaudge/grailbio/encoding/fasta"
+	"github.com/Schaudge/hts/bam"
+	"github.com/Schaudge/hts/sam"
+	"github.com/grailbio/testutil/assert"
+	"github.com/grailbio/testutil/expect"
+)
+
+const testHeader = "@HD\tVN:1.6\tSO:coordinate\n" +
+	"@SQ\tSN:chr1\tLN:2000\n" +
+	"@SQ\tSN:chr2\tLN:1500\n" +
+	"@RG\tID:rg0\tSM:s0\n" +
+	"@RG\tID:rg1\tSM:s1\n"
+
+// testSM is the substitution matrix written by the test writer. Alternative k
+// of each reference base gets code 3-k.
+const testSM = 0xe4
+
+// Data series stored in external blocks, and their content ids.
+var testSeries = []string{
+	"BF", "CF", "RI", "RL", "AP", "RG", "RN", "MF", "NS", "NP", "TS", "NF",
+	"FN", "FC", "FP", "BA", "QS", "BS", "IN", "SC", "DL", "RS", "HC", "PD",
+	"BB", "QQ",
+}
+
+func testSeriesID(key string) int32 {
+	for i, k := range testSeries {
+		if k == key {
+			return int32(i + 1)
+		}
+	}
+	panic(key)
+}
+
+// testWriterOpts controls the output of testCRAMWriter.
+type testWriterOpts struct {
+	recordsPerContainer int
+	// embedRef causes slices to embed their reference. Slices are then
+	// split at reference boundaries.
+	embedRef bool
+}
+
+// testCRAMWriter writes a CRAM file with the structure that the reader
+// expects. All data series except MQ and TL use the external encoding.
+type testCRAMWriter struct {
+	opts   testWriterOpts
+	header *sam.Header
+	ref    map[string]string
+	buf    bytes.Buffer
+	index  []IndexEntry
+	// starts[i] is the number of records before the i'th index entry.
+	starts []int
+	nBlock int // used to vary the block compression methods.
+}
+
+func (w *testCRAMWriter) encodeBlock(contentType byte, id int32, raw []byte) []byte {
+	method := byte(methodRaw)
+	data := raw
+	if len(raw) > 0 && contentType != contentCore {
+		w.nBlock++
+		method = byte(w.nBlock % 5)
+	}
+	switch method {
+	case methodGzip:
+		var b bytes.Buffer
+		gz := gzip.NewWriter(&b)
+		gz.Write(raw) // nolint: errcheck
+		gz.Close()    // nolint: errcheck
+		data = b.Bytes()
+	case methodBzip2, methodLZMA:
+		// Not supported by the writer.
+		method, data = methodRANS, ransEncode1(raw)
+	case methodRANS:
+		data = ransEncode0(raw)
+	}
+	out := []byte{method, contentType}
+	out = append(out, encodeITF8(id)...)
+	out = append(out, encodeITF8(int32(len(data)))...)
+	out = append(out, encodeITF8(int32(len(raw)))...)
+	out = append(out, data...)
+	var crc [4]byte
+	binary.LittleEndian.PutUint32(crc[:], crc32.ChecksumIEEE(out))
+	return append(out, crc[:]...)
+}
+
+func (w *testCRAMWriter) writeContainer(refID, start, span, nRecords int32, counter int64, blocks [][]byte, landmarks []int32) {
+	body := bytes.Join(blocks, nil)
+	var hdr []byte
+	var length [4]byte
+	binary.LittleEndian.PutUint32(length[:], uint32(len(body)))
+	hdr = append(hdr, length[:]...)
+	for _, v := range []int32{refID, start, span, nRecords} {
+		hdr = append(hdr, encodeITF8(v)...)
+	}
+	hdr = append(hdr, encodeLTF8(counter)...)
+	hdr = append(hdr, encodeLTF8(0)...)
+	hdr = append(hdr, encodeITF8(int32(len(blocks)))...)
+	hdr = append(hdr, encodeITF8Array(landmarks)...)
+	var crc [4]byte
+	binary.LittleEndian.PutUint32(crc[:], crc32.ChecksumIEEE(hdr))
+	hdr = append(hdr, crc[:]...)
+	w.buf.Write(hdr)
+	w.buf.Write(body)
+}
+
+func newTestCRAMWriter(header *sam.Header, ref map[string]string, opts testWriterOpts) *testCRAMWriter {
+	w := &testCRAMWriter{opts: opts, header: header, ref: ref}
+	w.buf.WriteString("CRAM")
+	w.buf.Write([]byte{3, 0})
+	w.buf.Write(make([]byte, 20))
+	text, err := header.MarshalText()
+	if err != nil {
+		panic(err)
+	}
+	var n [4]byte
+	binary.LittleEndian.PutUint32(n[:], uint32(len(text)))
+	w.writeContainer(0, 0, 0, 0, 0, [][]byte{w.encodeBlock(contentFileHeader, 0, append(n[:], text...))}, nil)
+	return w
+}
+
+// sliceEncoder accumulates the data series of one slice.
+type sliceEncoder struct {
+	w        *testCRAMWriter
+	core     bitWriter
+	external map[int32]*bytes.Buffer
+	tagIDs   map[int32]int32
+	tagLines []string
+}
+
+func (e *sliceEncoder) ext(id int32) *bytes.Buffer {
+	b := e.external[id]
+	if b == nil {
+		b = &bytes.Buffer{}
+		e.external[id] = b
+	}
+	return b
+}
+
+func (e *sliceEncoder) putInt(key string, v int) {
+	e.ext(testSeriesID(key)).Write(encodeITF8(int32(v)))
+}
+
+func (e *sliceEncoder) putByte(key string, v byte) {
+	e.ext(testSeriesID(key)).WriteByte(v)
+}
+
+func (e *sliceEncoder) putArray(key string, v []byte) {
+	id := testSeriesID(key)
+	if key == "RN" {
+		e.ext(id).Write(v)
+		e.ext(id).WriteByte('\t')
+		return
+	}
+	// Lengths use content id + 100.
+	e.ext(id + 100).Write(encodeITF8(int32(len(v))))
+	e.ext(id).Write(v)
+}
+
+func substCode(refBase, base byte) (int, bool) {
+	ri := strings.IndexByte(substBases, refBase)
+	if ri < 0 || strings.IndexByte(substBases, base) < 0 || refBase == base {
+		return 0, false
+	}
+	k := 0
+	for _, b := range []byte(substBases) {
+		if b == refBase {
+			continue
+		}
+		if b == base {
+			return 3 - k, true
+		}
+		k++
+	}
+	panic("unreachable")
+}
+
+type testFeature struct {
+	code byte
+	pos  int
+	data func()
+}
+
+func (e *sliceEncoder) encodeRecord(recs []*sam.Record, i int, prevPos *int, multiRef bool, mates map[int]int) {
+	rec := recs[i]
+	var aux []sam.Aux
+	rg := -1
+	for _, a := range rec.AuxFields {
+		if a.Tag() == sam.NewTag("RG") {
+			for k, g := range e.w.header.RGs() {
+				if g.Name() == a.Value().(string) {
+					rg = k
+				}
+			}
+			continue
+		}
+		aux = append(aux, a)
+	}
+	cf := 0
+	seq := rec.Seq.Expand()
+	if len(seq) > 0 && len(rec.Qual) > 0 && rec.Qual[0] != 0xff {
+		cf |= cfQualArray
+	}
+	if len(seq) == 0 {
+		cf |= cfUnknownBases
+	}
+	mate, attached := mates[i]
+	_, isMate := func() (int, bool) {
+		for a, b := range mates {
+			if b == i {
+				return a, true
+			}
+		}
+		return 0, false
+	}()
+	if attached {
+		cf |= cfMateDown
+	} else if !isMate && rec.Flags&sam.Paired != 0 {
+		// Unpaired reads are not detached, so their mate fields are not
+		// stored.
+		cf |= cfDetached
+	}
+	e.putInt("BF", int(rec.Flags))
+	e.putInt("CF", cf)
+	if multiRef {
+		e.putInt("RI", rec.Ref.ID())
+	}
+	readLen := len(seq)
+	if readLen == 0 {
+		readLen = len(rec.Qual)
+	}
+	e.putInt("RL", readLen)
+	e.putInt("AP", rec.Pos+1-*prevPos)
+	*prevPos = rec.Pos + 1
+	e.putInt("RG", rg)
+	e.putArray("RN", []byte(rec.Name))
+	if cf&cfDetached != 0 {
+		mf := 0
+		if rec.Flags&sam.MateReverse != 0 {
+			mf |= mfMateReverse
+		}
+		if rec.Flags&sam.MateUnmapped != 0 {
+			mf |= mfMateUnmapped
+		}
+		e.putInt("MF", mf)
+		e.putInt("NS", rec.MateRef.ID())
+		e.putInt("NP", rec.MatePos+1)
+		e.putInt("TS", rec.TempLen)
+	} else if attached {
+		e.putInt("NF", mate-i-1)
+	}
+
+	var line []byte
+	for _, a := range aux {
+		line = append(line, a[:3]...)
+	}
+	tl := -1
+	for k, l := range e.tagLines {
+		if l == string(line) {
+			tl = k
+		}
+	}
+	if tl < 0 {
+		tl = len(e.tagLines)
+		e.tagLines = append(e.tagLines, string(line))
+	}
+	// TL uses a 3-bit Huffman code in the core block.
+	e.core.write(uint32(tl), 3)
+	for _, a := range aux {
+		key := int32(a[0])<<16 | int32(a[1])<<8 | int32(a[2])
+		if _, ok := e.tagIDs[key]; !ok {
+			e.tagIDs[key] = int32(1000 + len(e.tagIDs))
+		}
+		val := []byte(a[3:])
+		if a[2] == 'Z' || a[2] == 'H' {
+			val = append(append([]byte{}, val...), 0)
+		}
+		e.ext(e.tagIDs[key] + 100).Write(encodeITF8(int32(len(val))))
+		e.ext(e.tagIDs[key]).Write(val)
+	}
+
+	if rec.Flags&sam.Unmapped != 0 {
+		if cf&cfUnknownBases == 0 {
+			for _, b := range seq {
+				e.putByte("BA", b)
+			}
+		}
+	} else {
+		ref := e.w.ref[rec.Ref.Name()]
+		var features []testFeature
+		readPos, refPos := 0, rec.Pos
+		for _, op := range rec.Cigar {
+			n := op.Len()
+			pos := readPos + 1
+			switch op.Type() {
+			case sam.CigarMatch, sam.CigarEqual, sam.CigarMismatch:
+				for k := 0; k < n; k++ {
+					refBase := byte('N')
+					if refPos < len(ref) {
+						refBase = ref[refPos]
+					}
+					base, q := seq[readPos], rec.Qual[readPos]
+					if code, ok := substCode(refBase, base); ok {
+						features = append(features, testFeature{'X', readPos + 1, func() { e.putByte("BS", byte(code)) }})
+					} else if base != refBase {
+						features = append(features, testFeature{'B', readPos + 1, func() {
+							e.putByte("BA", base)
+							e.putByte("QS", q)
+						}})
+					}
+					readPos++
+					refPos++
+				}
+			case sam.CigarInsertion:
+				bases := seq[pos-1 : pos-1+n]
+				if n == 1 {
+					features = append(features, testFeature{'i', pos, func() { e.putByte("BA", bases[0]) }})
+				} else {
+					features = append(features, testFeature{'I', pos, func() { e.putArray("IN", bases) }})
+				}
+				readPos += n
+			case sam.CigarSoftClipped:
+				bases := seq[pos-1 : pos-1+n]
+				features = append(features, testFeature{'S', pos, func() { e.putArray("SC", bases) }})
+				readPos += n
+			case sam.CigarDeletion:
+				features = append(features, testFeature{'D', pos, func() { e.putInt("DL", n) }})
+				refPos += n
+			case sam.CigarSkipped:
+				features = append(features, testFeature{'N', pos, func() { e.putInt("RS", n) }})
+				refPos += n
+			case sam.CigarHardClipped:
+				features = append(features, testFeature{'H', pos, func() { e.putInt("HC", n) }})
+			case sam.CigarPadded:
+				features = append(features, testFeature{'P', pos, func() { e.putInt("PD", n) }})
+			}
+		}
+		e.putInt("FN", len(features))
+		prev := 0
+		for _, f := range features {
+			e.putByte("FC", f.code)
+			e.putInt("FP", f.pos-prev)
+			prev = f.pos
+			f.data()
+		}
+		// MQ uses the beta encoding in the core block.
+		e.core.write(uint32(rec.MapQ), 8)
+	}
+	if cf&cfQualArray != 0 {
+		for _, q := range rec.Qual {
+			e.putByte("QS", q)
+		}
+	}
+}
+
+// writeRecords writes recs, which must be sorted by coordinate, into
+// containers of one slice each.
+func (w *testCRAMWriter) writeRecords(recs []*sam.Record) {
+	var counter int64
+	for len(recs) > 0 {
+		n := w.opts.recordsPerContainer
+		if n > len(recs) {
+			n = len(recs)
+		}
+		// Keep mapped and unmapped reads in separate containers.
+		for k := 1; k < n; k++ {
+			if (recs[k].Ref == nil) != (recs[0].Ref == nil) || (w.opts.embedRef && recs[k].Ref != recs[0].Ref) {
+				n = k
+				break
+			}
+		}
+		w.starts = append(w.starts, int(counter))
+		w.writeSlice(recs[:n], counter)
+		counter += int64(n)
+		recs = recs[n:]
+	}
+	// EOF container.
+	w.writeContainer(-1, 4542278, 0, 0, 0, nil, nil)
+}
+
+func (w *testCRAMWriter) writeSlice(recs []*sam.Record, counter int64) {
+	refID, start, end := int32(-1), 0, 0
+	if recs[0].Ref != nil {
+		refID = int32(recs[0].Ref.ID())
+		start, end = recs[0].Pos+1, recs[0].Pos+1
+		for _, r := range recs {
+			if r.Ref.ID() != int(refID) {
+				refID = -2
+			}
+			if e := r.End(); e > end {
+				end = e
+			}
+		}
+	}
+	span := end - start + 1
+	if refID < 0 {
+		start, span = 0, 0
+	}
+	// Pair up adjacent mates whose flags are consistent.
+	mates := map[int]int{}
+	for i := range recs {
+		for j := i + 1; j < len(recs); j++ {
+			if recs[i].Name == recs[j].Name && recs[i].Flags&sam.Paired != 0 && recs[j].Flags&sam.Paired != 0 {
+				mates[i] = j
+				break
+			}
+		}
+	}
+	e := &sliceEncoder{w: w, external: map[int32]*bytes.Buffer{}, tagIDs: map[int32]int32{}}
+	prevPos := start
+	for i := range recs {
+		e.encodeRecord(recs, i, &prevPos, refID == -2, mates)
+	}
+
+	// Compression header.
+	var td []byte
+	for _, l := range e.tagLines {
+		td = append(append(td, l...), 0)
+	}
+	var pm []byte
+	pm = append(pm, "RN\x01AP\x01RR\x01SM"...)
+	pm = append(pm, testSM, testSM, testSM, testSM, testSM)
+	pm = append(pm, "TD"...)
+	pm = append(pm, encodeITF8(int32(len(td)))...)
+	pm = append(pm, td...)
+	writeMap := func(out []byte, n int, entries []byte) []byte {
+		content := append(encodeITF8(int32(n)), entries...)
+		return append(append(out, encodeITF8(int32(len(content)))...), content...)
+	}
+	comp := writeMap(nil, 5, pm)
+	var ds []byte
+	for _, key := range testSeries {
+		id := testSeriesID(key)
+		ds = append(ds, key...)
+		switch key {
+		case "RN":
+			ds = append(ds, encodeEncoding(encodingByteArrayStop, []byte{'\t'}, encodeITF8(id))...)
+		case "IN", "SC", "BB", "QQ":
+			ds = append(ds, encodeEncoding(encodingByteArrayLen,
+				encodeEncoding(encodingExternal, encodeITF8(id+100)),
+				encodeEncoding(encodingExternal, encodeITF8(id)))...)
+		default:
+			ds = append(ds, encodeEncoding(encodingExternal, encodeITF8(id))...)
+		}
+	}
+	ds = append(ds, "MQ"...)
+	ds = append(ds, encodeEncoding(encodingBeta, encodeITF8(0), encodeITF8(8))...)
+	ds = append(ds, "TL"...)
+	alphabet, lens := []int32{}, []int32{}
+	for i := 0; i < 8; i++ {
+		alphabet, lens = append(alphabet, int32(i)), append(lens, 3)
+	}
+	ds = append(ds, encodeEncoding(encodingHuffman, encodeITF8Array(alphabet), encodeITF8Array(lens))...)
+	comp = writeMap(comp, len(testSeries)+2, ds)
+	var tags []byte
+	for key, id := range e.tagIDs {
+		tags = append(tags, encodeITF8(key)...)
+		tags = append(tags, encodeEncoding(encodingByteArrayLen,
+			encodeEncoding(encodingExternal, encodeITF8(id+100)),
+			encodeEncoding(encodingExternal, encodeITF8(id)))...)
+	}
+	comp = writeMap(comp, len(e.tagIDs), tags)
+
+	// Slice.
+	var ids []int32
+	for id := range e.external {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	embeddedID := int32(-1)
+	if w.opts.embedRef && refID >= 0 {
+		embeddedID = 999
+		ref := w.ref[recs[0].Ref.Name()]
+		end := start - 1 + span
+		if end > len(ref) {
+			end = len(ref)
+		}
+		e.ext(embeddedID).WriteString(ref[start-1 : end])
+		ids = append(ids, embeddedID)
+	}
+	blocks := [][]byte{w.encodeBlock(contentCore, 0, e.core.buf)}
+	for _, id := range ids {
+		blocks = append(blocks, w.encodeBlock(contentExternal, id, e.external[id].Bytes()))
+	}
+	var sh []byte
+	for _, v := range []int32{refID, int32(start), int32(span), int32(len(recs))} {
+		sh = append(sh, encodeITF8(v)...)
+	}
+	sh = append(sh, encodeLTF8(counter)...)
+	sh = append(sh, encodeITF8(int32(len(blocks)))...)
+	sh = append(sh, encodeITF8Array(append([]int32{0}, ids...))...)
+	sh = append(sh, encodeITF8(embeddedID)...)
+	var refMD5 [16]byte
+	if refID >= 0 {
+		ref := strings.ToUpper(w.ref[recs[0].Ref.Name()])
+		end := start - 1 + span
+		if end > len(ref) {
+			end = len(ref)
+		}
+		refMD5 = md5.Sum([]byte(ref[start-1 : end]))
+	}
+	sh = append(sh, refMD5[:]...)
+
+	compBlock := w.encodeBlock(contentCompressionHeader, 0, comp)
+	sliceBlock := w.encodeBlock(contentSliceHeader, 0, sh)
+	sliceSize := len(sliceBlock)
+	for _, b := range blocks {
+		sliceSize += len(b)
+	}
+	w.index = append(w.index, IndexEntry{
+		RefID:           int(refID),
+		Start:           start,
+		Span:            span,
+		ContainerOffset: int64(w.buf.Len()),
+		SliceOffset:     int64(len(compBlock)),
+		SliceSize:       int64(sliceSize),
+	})
+	w.writeContainer(refID, int32(start), int32(span), int32(len(recs)), counter,
+		append([][]byte{compBlock, sliceBlock}, blocks...), []int32{int32(len(compBlock))})
+}
+
+// encodeIndex returns the gzipped CRAI file for the index entries.
+func encodeIndex(entries []IndexEntry) []byte {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	for _, e := range entries {
+		fmt.Fprintf(gz, "%d\t%d\t%d\t%d\t%d\t%d\n", e.RefID, e.Start, e.Span, e.ContainerOffset, e.SliceOffset, e.SliceSize)
+	}
+	gz.Close() // nolint: errcheck
+	return buf.Bytes()
+}
+
+// testData generates a reference and a sorted list of reads, including paired,
+// spliced, clipped, unmapped and tagged reads.
+func testData(t *testing.T) (*sam.Header, map[string]string, []*sam.Record) {
+	header, err := sam.NewHeader([]byte(testHeader), nil)
+	assert.NoError(t, err)
+	r := rand.New(rand.NewSource(1))
+	ref := map[string]string{}
+	for _, sq := range header.Refs() {
+		b := make([]byte, sq.Len())
+		for i := range b {
+			b[i] = "ACGT"[r.Intn(4)]
+		}
+		// Lower-case and ambiguous reference bases.
+		b[10] = 'N'
+		b[11] = 'a'
+		ref[sq.Name()] = string(b)
+	}
+	cigars := []string{"50M", "5S40M2I3M", "10M1I20M3D19M", "2H20M100N30M", "30M5S", "20M1P1I29M"}
+	var recs []*sam.Record
+	newRead := func(name string, refID, pos int, cigar string, flags sam.Flags) *sam.Record {
+		rec := &sam.Record{Name: name, Pos: pos, MatePos: -1, MapQ: byte(r.Intn(61)), Flags: flags}
+		if refID >= 0 {
+			rec.Ref = header.Refs()[refID]
+		}
+		readLen := 50
+		if cigar != "" {
+			rec.Cigar, err = sam.ParseCigar([]byte(cigar))
+			assert.NoError(t, err)
+			_, readLen = rec.Cigar.Lengths()
+		}
+		// Mostly reference bases, with some mismatches and Ns.
+		seq := make([]byte, readLen)
+		refSeq := strings.ToUpper(ref[header.Refs()[0].Name()])
+		if rec.Ref != nil {
+			refSeq = strings.ToUpper(ref[rec.Ref.Name()])
+		}
+		for i := range seq {
+			switch k := r.Intn(20); {
+			case k == 0:
+				seq[i] = 'N'
+			case k < 3:
+				seq[i] = "ACGT"[r.Intn(4)]
+			default:
+				seq[i] = refSeq[(pos+1+i)%len(refSeq)]
+			}
+		}
+		rec.Seq = sam.NewSeq(seq)
+		rec.Qual = make([]byte, readLen)
+		for i := range rec.Qual {
+			rec.Qual[i] = byte(r.Intn(41))
+		}
+		return rec
+	}
+	for refID := range header.Refs() {
+		for i := 0; i < 20; i++ {
+			pos := 5 + i*60
+			cigar := cigars[i%len(cigars)]
+			if i%3 == 0 {
+				// A pair.
+				r1 := newRead(fmt.Sprintf("pair%d_%d", refID, i), refID, pos, cigar, sam.Paired|sam.ProperPair|sam.Read1)
+				r2 := newRead(r1.Name, refID, pos+30, "50M", sam.Paired|sam.ProperPair|sam.Read2|sam.Reverse)
+				r1.MateRef, r1.MatePos, r1.Flags = r2.Ref, r2.Pos, r1.Flags|sam.MateReverse
+				r2.MateRef, r2.MatePos = r1.Ref, r1.Pos
+				tlen := r2.End() - r1.Pos
+				if e := r1.End(); e > r2.End() {
+					tlen = e - r1.Pos
+				}
+				r1.TempLen, r2.TempLen = tlen, -tlen
+				recs = append(recs, r1, r2)
+				continue
+			}
+			rec := newRead(fmt.Sprintf("read%d_%d", refID, i), refID, pos, cigar, 0)
+			if i%4 == 1 {
+				rec.Flags |= sam.Reverse | sam.Paired | sam.MateUnmapped
+				rec.MateRef, rec.MatePos = rec.Ref, rec.Pos
+			}
+			if i%5 == 2 {
+				nm, _ := sam.NewAux(sam.NewTag("NM"), i)
+				xs, _ := sam.NewAux(sam.NewTag("XS"), fmt.Sprintf("tag%d", i))
+				rec.AuxFields = append(rec.AuxFields, nm, xs)
+			}
+			if i%2 == 0 {
+				rg, _ := sam.NewAux(sam.NewTag("RG"), fmt.Sprintf("rg%d", i%4/2))
+				rec.AuxFields = append(rec.AuxFields, rg)
+			}
+			recs = append(recs, rec)
+		}
+	}
+	// The last read overhangs the end of chr2.
+	recs = append(recs, newRead("overhang", 1, 1480, "50M", 0))
+	for i := 0; i < 5; i++ {
+		rec := newRead(fmt.Sprintf("unmapped%d", i), -1, -1, "", sam.Unmapped)
+		rec.MapQ = 0
+		if i == 3 {
+			rec.Seq, rec.Qual = sam.Seq{}, nil
+		}
+		recs = append(recs, rec)
+	}
+	sort.SliceStable(recs, func(i, j int) bool {
+		ri, rj := recs[i].Ref.ID(), recs[j].Ref.ID()
+		if ri < 0 || rj < 0 {
+			return ri >= 0 && rj < 0
+		}
+		if ri != rj {
+			return ri < rj
+		}
+		return recs[i].Pos < recs[j].Pos
+	})
+	return header, ref, recs
+}
+
+func testFasta(t *testing.T, ref map[string]string) fasta.Fasta {
+	var text string
+	for _, name := range []string{"chr1", "chr2"} {
+		text += ">" + name + "\n" + ref[name] + "\n"
+	}
+	fa, err := fasta.New(strings.NewReader(text))
+	assert.NoError(t, err)
+	return fa
+}
+
+func readAll(t *testing.T, r *Reader) []string {
+	var lines []string
+	for {
+		rec, err := r.Read()
+		if err == io.EOF {
+			return lines
+		}
+		assert.NoError(t, err)
+		line, err := rec.MarshalText()
+		assert.NoError(t, err)
+		lines = append(lines, string(line))
+	}
+}
+
+func samLines(t *testing.T, recs []*sam.Record) []string {
+	var lines []string
+	for _, rec := range recs {
+		line, err := rec.MarshalText()
+		assert.NoError(t, err)
+		lines = append(lines, string(line))
+	}
+	return lines
+}
+
+func TestReader(t *testing.T) {
+	header, ref, recs := testData(t)
+	fa := testFasta(t, ref)
+	for _, n := range []int{1, 7, 1000} {
+		w := newTestCRAMWriter(header, ref, testWriterOpts{recordsPerContainer: n})
+		w.writeRecords(recs)
+		r, err := NewReader(bytes.NewReader(w.buf.Bytes()), fa)
+		assert.NoError(t, err)
+		expect.EQ(t, len(r.Header().Refs()), 2)
+		expect.EQ(t, len(r.Header().RGs()), 2)
+		expect.EQ(t, readAll(t, r), samLines(t, recs), "records per container: %d", n)
+
+		// Decoding mapped reads requires the reference.
+		r, err = NewReader(bytes.NewReader(w.buf.Bytes()), nil)
+		assert.NoError(t, err)
+		_, err = r.Read()
+		expect.HasSubstr(t, err.Error(), "reference sequence is required")
+	}
+}
+
+func TestReaderEmbeddedReference(t *testing.T) {
+	header, ref, recs := testData(t)
+	w := newTestCRAMWriter(header, ref, testWriterOpts{recordsPerContainer: 5, embedRef: true})
+	w.writeRecords(recs)
+	r, err := NewReader(bytes.NewReader(w.buf.Bytes()), nil)
+	assert.NoError(t, err)
+	expect.EQ(t, readAll(t, r), samLines(t, recs))
+}
+
+func TestReaderSeek(t *testing.T) {
+	header, ref, recs := testData(t)
+	w := newTestCRAMWriter(header, ref, testWriterOpts{recordsPerContainer: 6})
+	w.writeRecords(recs)
+	index, err := ReadIndex(bytes.NewReader(encodeIndex(w.index)))
+	assert.NoError(t, err)
+	expect.EQ(t, index, w.index)
+
+	r, err := NewReader(bytes.NewReader(w.buf.Bytes()), testFasta(t, ref))
+	assert.NoError(t, err)
+	expected := samLines(t, recs)
+	for _, k := range []int{3, 0, len(index) - 1} {
+		assert.NoError(t, r.SeekContainer(index[k].ContainerOffset))
+		expect.EQ(t, readAll(t, r), expected[w.starts[k]:])
+	}
+}
+
+func TestReaderChecksums(t *testing.T) {
+	header, ref, recs := testData(t)
+	w := newTestCRAMWriter(header, ref, testWriterOpts{recordsPerContainer: 6})
+	w.writeRecords(recs)
+	data := w.buf.Bytes()
+	readErr := func(data []byte, ref map[string]string) error {
+		r, err := NewReader(bytes.NewReader(data), testFasta(t, ref))
+		assert.NoError(t, err)
+		for {
+			if _, err = r.Read(); err != nil {
+				return err
+			}
+		}
+	}
+	expect.EQ(t, readErr(data, ref), io.EOF)
+
+	// The reference ID of the first data container.
+	corrupt := append([]byte{}, data...)
+	corrupt[w.index[0].ContainerOffset+4]++
+	expect.HasSubstr(t, readErr(corrupt, ref).Error(), "container header CRC32 mismatch")
+
+	// The CRC32 of the last block of the first data container.
+	corrupt = append([]byte{}, data...)
+	corrupt[w.index[1].ContainerOffset-1]++
+	expect.HasSubstr(t, readErr(corrupt, ref).Error(), "block CRC32 mismatch")
+
+	// A reference that differs from the one used to write the file.
+	badRef := map[string]string{}
+	for name, seq := range ref {
+		badRef[name] = seq
+	}
+	badRef["chr2"] = ref["chr2"][:500] + "x" + ref["chr2"][501:]
+	expect.HasSubstr(t, readErr(data, badRef).Error(), "MD5 of reference chr2")
+}
+
+func TestBuildIndex(t *testing.T) {
+	header, ref, recs := testData(t)
+	w := newTestCRAMWriter(header, ref, testWriterOpts{recordsPerContainer: 6})
+	w.writeRecords(recs)
+	index, err := BuildIndex(bytes.NewReader(w.buf.Bytes()))
+	assert.NoError(t, err)
+	expect.EQ(t, index, w.index)
+
+	_, err = BuildIndex(bytes.NewReader(w.buf.Bytes()[:w.buf.Len()-10]))
+	expect.NotNil(t, err)
+}
+
+// htslibEOF is the EOF container that htslib appends to CRAM 3.0 files.
+const htslibEOF = "\x0f\x00\x00\x00\xff\xff\xff\xff\x0f\xe0\x45\x4f\x46\x00\x00\x00\x00\x01\x00\x05\xbd\xd9\x4f" +
+	"\x00\x01\x00\x06\x06\x01\x00\x01\x00\x01\x00\xee\x63\x01\x4b"
+
+func TestHTSlibEOF(t *testing.T) {
+	header, ref, _ := testData(t)
+	w := newTestCRAMWriter(header, ref, testWriterOpts{})
+	w.buf.WriteString(htslibEOF)
+	r, err := NewReader(bytes.NewReader(w.buf.Bytes()), nil)
+	assert.NoError(t, err)
+	_, err = r.Read()
+	expect.EQ(t, err, io.EOF)
+	index, err := BuildIndex(bytes.NewReader(w.buf.Bytes()))
+	assert.NoError(t, err)
+	expect.EQ(t, len(index), 0)
+}
+
+// TestHTSlibFixture decodes a CRAM file written by samtools, so that the
+// reader is not only tested against testCRAMWriter, and compares it record by
+// record to the BAM file written from the same SAM file. See testdata/gen.sh.
+func TestHTSlibFixture(t *testing.T) {
+	cramPath := filepath.Join("testdata", "htslib.cram")
+	if _, err := os.Stat(cramPath); err != nil {
+		t.Fatalf("%s not found; run testdata/gen.sh to generate it", cramPath)
+	}
+	faFile, err := os.Open(filepath.Join("testdata", "htslib.fa"))
+	assert.NoError(t, err)
+	defer faFile.Close() // nolint: errcheck
+	fa, err := fasta.New(faFile)
+	assert.NoError(t, err)
+
+	bamFile, err := os.Open(filepath.Join("testdata", "htslib.bam"))
+	assert.NoError(t, err)
+	defer bamFile.Close() // nolint: errcheck
+	br, err := bam.NewReader(bamFile, 1)
+	assert.NoError(t, err)
+	var expected []string
+	for {
+		rec, err := br.Read()
+		if err == io.EOF {
+			break
+		}
+		assert.NoError(t, err)
+		line, err := rec.MarshalText()
+		assert.NoError(t, err)
+		expected = append(expected, string(line))
+	}
+	assert.NoError(t, br.Close())
+
+	data, err := ioutil.ReadFile(cramPath)
+	assert.NoError(t, err)
+	r, err := NewReader(bytes.NewReader(data), fa)
+	assert.NoError(t, err)
+	expect.EQ(t, len(r.Header().Refs()), 2)
+	got := readAll(t, r)
+	assert.EQ(t, len(got), len(expected))
+	for i := range expected {
+		expect.EQ(t, got[i], expected[i], "record %d", i)
+	}
+
+	// Every container listed in the samtools index is found by BuildIndex, and
+	// seeking to it yields the remaining records.
+	craiFile, err := os.Open(cramPath + ".crai")
+	assert.NoError(t, err)
+	defer craiFile.Close() // nolint: errcheck
+	index, err := ReadIndex(craiFile)
+	assert.NoError(t, err)
+	built, err := BuildIndex(bytes.NewReader(data))
+	assert.NoError(t, err)
+	offsets := map[int64]bool{}
+	for _, e := range built {
+		offsets[e.ContainerOffset] = true
+	}
+	assert.GT(t, len(index), 1)
+	for _, e := range index {
+		expect.True(t, offsets[e.ContainerOffset], "container at %d", e.ContainerOffset)
+		assert.NoError(t, r.SeekContainer(e.ContainerOffset))
+		tail := readAll(t, r)
+		expect.EQ(t, tail, expected[len(expected)-len(tail):], "container at %d", e.ContainerOffset)
+	}
+}
+
+func TestNewReaderErrors(t *testing.T) {
+	_, err := NewReader(strings.NewReader("BAM\x01"), nil)
+	expect.NotNil(t, err)
+	_, err = NewReader(strings.NewReader("CRAM\x02\x01"+strings.Repeat("\x00", 20)), nil)
+	expect.HasSubstr(t, err.Error(), "unsupported CRAM version 2.1")
+	_, err = NewReader(strings.NewReader("CRAM\x03\x00"+strings.Repeat("\x00", 20)), nil)
+	expect.HasSubstr(t, err.Error(), "header container")
+}
@@ -0,0 +1,587 @@
+package cram
+
+import (
+	"crypto/md5"
+	"fmt"
+	"strconv"
+
+	"github.com/Schaudge/grailbio/encoding/fasta"
+	"github.com/Schaudge/hts/sam"
+)
+
+// CRAM record flags (the CF data series).
+const (
+	cfQualArray    = 1 // quality scores are stored as an array.
+	cfDetached     = 2 // mate information is stored explicitly.
+	cfMateDown     = 4 // the mate is a later record in the same slice.
+	cfUnknownBases = 8 // the sequence is '*'.
+)
+
+// Mate flags (the MF data series).
+const (
+	mfMateReverse  = 1
+	mfMateUnmapped = 2
+)
+
+// missingCodec is used for data series that the compression header does not
+// define.
+type missingCodec struct{ key string }
+
+func (c missingCodec) fail(d *sliceData) {
+	d.setErr(fmt.Errorf("cram: data series %s is not defined", c.key))
+}
+
+func (c missingCodec) readInt(d *sliceData) int32    { c.fail(d); return 0 }
+func (c missingCodec) readByte(d *sliceData) byte    { c.fail(d); return 0 }
+func (c missingCodec) readArray(d *sliceData) []byte { c.fail(d); return nil }
+
+// feature is a read feature: a difference between the read and the
+// reference.
+type feature struct {
+	code  byte
+	pos   int // 1-based position in the read.
+	base  byte
+	qual  byte
+	bases []byte // I, S, b, and the quality scores for q.
+	n     int    // D, N, H, P, and the substitution code for X.
+}
+
+// sliceRecord is a record being decoded, with the information needed to
+// resolve its mate.
+type sliceRecord struct {
+	rec      *sam.Record
+	cf       int32
+	nextFrag int // index of the next fragment in the slice, or -1.
+	hasPrev  bool
+}
+
+// sliceDecoder decodes the records of one slice.
+type sliceDecoder struct {
+	header *sam.Header
+	ref    fasta.Fasta
+	comp   *compressionHeader
+	slice  *sliceHeader
+	data   *sliceData
+
+	embedded []byte // embedded reference, if any.
+
+	// Cached reference bases.
+	cacheRef   int32
+	cacheStart int
+	cache      []byte
+}
+
+func (s *sliceDecoder) series(key string) codec {
+	if c := s.comp.dataSeries[key]; c != nil {
+		return c
+	}
+	return missingCodec{key}
+}
+
+// reference returns the reference bases in [start,end) of refID, in upper
+// case. Positions past the end of the reference are filled with 'N'.
+func (s *sliceDecoder) reference(refID int32, start, end int) ([]byte, error) {
+	if s.cache != nil && refID == s.cacheRef && start >= s.cacheStart && end <= s.cacheStart+len(s.cache) {
+		return s.cache[start-s.cacheStart : end-s.cacheStart], nil
+	}
+	sliceStart := int(s.slice.start) - 1
+	sliceEnd := sliceStart + int(s.slice.span)
+	if s.embedded != nil && refID == s.slice.refID && start >= sliceStart {
+		bases := make([]byte, end-start)
+		for i := range bases {
+			bases[i] = 'N'
+			if k := start - sliceStart + i; k < len(s.embedded) {
+				bases[i] = upper(s.embedded[k])
+			}
+		}
+		return bases, nil
+	}
+	refs := s.header.Refs()
+	if refID < 0 || int(refID) >= len(refs) {
+		return nil, fmt.Errorf("cram: invalid reference id %d", refID)
+	}
+	name := refs[refID].Name()
+	if s.ref == nil {
+		return nil, fmt.Errorf("cram: a reference sequence is required to decode reads on %s", name)
+	}
+	// Fetch the whole slice range at once if possible.
+	fetchStart, fetchEnd := start, end
+	if refID == s.slice.refID {
+		if sliceStart < fetchStart {
+			fetchStart = sliceStart
+		}
+		if sliceEnd > fetchEnd {
+			fetchEnd = sliceEnd
+		}
+	}
+	if fetchStart < 0 {
+		fetchStart = 0
+	}
+	refLen, err := s.ref.Len(name)
+	if err != nil {
+		return nil, err
+	}
+	bases := make([]byte, 0, fetchEnd-fetchStart)
+	if limit := int(refLen); fetchStart < limit {
+		if fetchEnd < limit {
+			limit = fetchEnd
+		}
+		seq, err := s.ref.Get(name, uint64(fetchStart), uint64(limit))
+		if err != nil {
+			return nil, err
+		}
+		bases = append(bases, seq...)
+	}
+	for i, b := range bases {
+		if b < ' ' {
+			return nil, fmt.Errorf("cram: reference %s is not ASCII-encoded", name)
+		}
+		bases[i] = upper(b)
+	}
+	for len(bases) < fetchEnd-fetchStart {
+		bases = append(bases, 'N')
+	}
+	s.cacheRef, s.cacheStart, s.cache = refID, fetchStart, bases
+	return s.cache[start-fetchStart : end-fetchStart], nil
+}
+
+// checkReference checks that the reference matches the MD5 recorded in the
+// slice header. The check is skipped if the slice does not record an MD5, does
+// not depend on an external reference, or if no reference is set, in which
+// case decoding fails later only if the reference is actually needed.
+func (s *sliceDecoder) checkReference() error {
+	if s.slice.refMD5 == ([16]byte{}) || s.slice.refID < 0 || !s.comp.refRequired || s.embedded != nil || s.ref == nil {
+		return nil
+	}
+	refs := s.header.Refs()
+	if int(s.slice.refID) >= len(refs) {
+		return fmt.Errorf("cram: invalid reference id %d", s.slice.refID)
+	}
+	name := refs[s.slice.refID].Name()
+	refLen, err := s.ref.Len(name)
+	if err != nil {
+		return err
+	}
+	// Like htslib, exclude the part of the slice past the end of the reference.
+	start := int(s.slice.start) - 1
+	end := start + int(s.slice.span)
+	if end > int(refLen) {
+		end = int(refLen)
+	}
+	var bases []byte
+	if start < end {
+		if bases, err = s.reference(s.slice.refID, start, end); err != nil {
+			return err
+		}
+	}
+	if got := md5.Sum(bases); got != s.slice.refMD5 {
+		return fmt.Errorf("cram: MD5 of reference %s:%d-%d is %x; expect %x", name, start, end, got, s.slice.refMD5)
+	}
+	return nil
+}
+
+// upper converts an ASCII reference base to upper case.
+func upper(b byte) byte {
+	if 'a' <= b && b <= 'z' {
+		return b - 'a' + 'A'
+	}
+	return b
+}
+
+// substitute returns the read base for the reference base and the
+// substitution code.
+func (s *sliceDecoder) substitute(refBase byte, code int) byte {
+	i := 4
+	switch refBase {
+	case 'A':
+		i = 0
+	case 'C':
+		i = 1
+	case 'G':
+		i = 2
+	case 'T':
+		i = 3
+	}
+	return s.comp.subst[i][code&3]
+}
+
+// decode decodes all the records in the slice.
+func (s *sliceDecoder) decode() ([]*sam.Record, error) {
+	var (
+		d       = s.data
+		recs    = make([]sliceRecord, s.slice.nRecords)
+		prevPos = s.slice.start
+		rgs     = s.header.RGs()
+		refs    = s.header.Refs()
+	)
+	for i := range recs {
+		sr := &recs[i]
+		sr.nextFrag = -1
+		rec := &sam.Record{MatePos: -1}
+		sr.rec = rec
+		rec.Flags = sam.Flags(s.series("BF").readInt(d))
+		sr.cf = s.series("CF").readInt(d)
+		refID := s.slice.refID
+		if refID == -2 {
+			refID = s.series("RI").readInt(d)
+		}
+		readLen := int(s.series("RL").readInt(d))
+		pos := s.series("AP").readInt(d)
+		if s.comp.apDelta {
+			pos += prevPos
+			prevPos = pos
+		}
+		rg := s.series("RG").readInt(d)
+		if s.comp.readNamesIncluded {
+			rec.Name = string(s.series("RN").readArray(d))
+		}
+		if sr.cf&cfDetached != 0 {
+			mf := s.series("MF").readInt(d)
+			if !s.comp.readNamesIncluded {
+				rec.Name = string(s.series("RN").readArray(d))
+			}
+			mateRef := s.series("NS").readInt(d)
+			rec.MatePos = int(s.series("NP").readInt(d)) - 1
+			rec.TempLen = int(s.series("TS").readInt(d))
+			if mateRef >= 0 && int(mateRef) < len(refs) {
+				rec.MateRef = refs[mateRef]
+			}
+			if mf&mfMateReverse != 0 {
+				rec.Flags |= sam.MateReverse
+			}
+			if mf&mfMateUnmapped != 0 {
+				rec.Flags |= sam.MateUnmapped
+			}
+		} else if sr.cf&cfMateDown != 0 {
+			sr.nextFrag = i + int(s.series("NF").readInt(d)) + 1
+		}
+
+		tl := int(s.series("TL").readInt(d))
+		if d.err != nil {
+			return nil, d.err
+		}
+		if tl < 0 || tl >= len(s.comp.tagLines) {
+			return nil, fmt.Errorf("cram: invalid tag line %d", tl)
+		}
+		for _, tag := range s.comp.tagLines[tl] {
+			key := int32(tag[0])<<16 | int32(tag[1])<<8 | int32(tag[2])
+			c := s.comp.tags[key]
+			if c == nil {
+				return nil, fmt.Errorf("cram: no encoding for tag %c%c:%c", tag[0], tag[1], tag[2])
+			}
+			val := c.readArray(d)
+			if (tag[2] == 'Z' || tag[2] == 'H') && len(val) > 0 && val[len(val)-1] == 0 {
+				val = val[:len(val)-1]
+			}
+			aux := make(sam.Aux, 3, 3+len(val))
+			copy(aux, tag[:])
+			rec.AuxFields = append(rec.AuxFields, append(aux, val...))
+		}
+		if rg >= 0 && int(rg) < len(rgs) {
+			aux, err := sam.NewAux(sam.NewTag("RG"), rgs[rg].Name())
+			if err != nil {
+				return nil, err
+			}
+			rec.AuxFields = append(rec.AuxFields, aux)
+		}
+
+		if refID >= 0 && int(refID) < len(refs) {
+			rec.Ref = refs[refID]
+		}
+		rec.Pos = int(pos) - 1
+		var (
+			seq  []byte
+			qual []byte
+		)
+		if rec.Flags&sam.Unmapped == 0 {
+			var err error
+			if seq, qual, err = s.decodeMapped(rec, refID, readLen); err != nil {
+				return nil, err
+			}
+			rec.MapQ = byte(s.series("MQ").readInt(d))
+		} else if sr.cf&cfUnknownBases == 0 {
+			seq = make([]byte, readLen)
+			for k := range seq {
+				seq[k] = s.series("BA").readByte(d)
+			}
+		}
+		if sr.cf&cfUnknownBases != 0 {
+			seq = nil
+		}
+		if sr.cf&cfQualArray != 0 {
+			qual = make([]byte, readLen)
+			for k := range qual {
+				qual[k] = s.series("QS").readByte(d)
+			}
+		}
+		if d.err != nil {
+			return nil, d.err
+		}
+		if seq != nil {
+			rec.Seq = sam.NewSeq(seq)
+			if qual == nil {
+				qual = make([]byte, readLen)
+				for k := range qual {
+					qual[k] = 0xff
+				}
+			}
+			rec.Qual = qual
+		}
+	}
+	s.resolveMates(recs)
+	out := make([]*sam.Record, len(recs))
+	for i := range recs {
+		out[i] = recs[i].rec
+	}
+	return out, nil
+}
+
+// decodeMapped reads the read features of a mapped record and reconstructs
+// its sequence, quality scores and cigar.
+func (s *sliceDecoder) decodeMapped(rec *sam.Record, refID int32, readLen int) (seq, qual []byte, err error) {
+	d := s.data
+	n := int(s.series("FN").readInt(d))
+	if n < 0 || d.err != nil {
+		return nil, nil, fmt.Errorf("cram: invalid feature count %d", n)
+	}
+	features := make([]feature, n)
+	prevPos := 0
+	refSpan := readLen
+	for i := range features {
+		f := &features[i]
+		f.code = s.series("FC").readByte(d)
+		f.pos = prevPos + int(s.series("FP").readInt(d))
+		prevPos = f.pos
+		switch f.code {
+		case 'B':
+			f.base = s.series("BA").readByte(d)
+			f.qual = s.series("QS").readByte(d)
+		case 'X':
+			f.n = int(s.series("BS").readByte(d))
+		case 'I':
+			f.bases = s.series("IN").readArray(d)
+			refSpan -= len(f.bases)
+		case 'i':
+			f.base = s.series("BA").readByte(d)
+			refSpan--
+		case 'S':
+			f.bases = s.series("SC").readArray(d)
+			refSpan -= len(f.bases)
+		case 'D':
+			f.n = int(s.series("DL").readInt(d))
+			refSpan += f.n
+		case 'N':
+			f.n = int(s.series("RS").readInt(d))
+			refSpan += f.n
+		case 'H':
+			f.n = int(s.series("HC").readInt(d))
+		case 'P':
+			f.n = int(s.series("PD").readInt(d))
+		case 'b':
+			f.bases = s.series("BB").readArray(d)
+		case 'q':
+			f.bases = s.series("QQ").readArray(d)
+		case 'Q':
+			f.qual = s.series("QS").readByte(d)
+		default:
+			return nil, nil, fmt.Errorf("cram: unknown read feature %q", f.code)
+		}
+		if d.err != nil {
+			return nil, nil, d.err
+		}
+	}
+	if refSpan < 0 {
+		refSpan = 0
+	}
+
+	var ref []byte
+	// The reference is not needed if the features cover every base.
+	needRef := false
+	covered := 0
+	for _, f := range features {
+		if f.pos-1 > covered || f.code == 'X' {
+			needRef = true
+			break
+		}
+		switch f.code {
+		case 'B', 'i':
+			covered = f.pos
+		case 'I', 'S', 'b':
+			covered = f.pos - 1 + len(f.bases)
+		}
+	}
+	if covered < readLen {
+		needRef = true
+	}
+	if needRef && refSpan > 0 {
+		if ref, err = s.reference(refID, rec.Pos, rec.Pos+refSpan); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	seq = make([]byte, readLen)
+	qual = make([]byte, readLen)
+	for i := range qual {
+		qual[i] = 0xff
+	}
+	var (
+		cigar   []sam.CigarOp
+		readPos int // 0-based position in seq.
+		refPos  int // 0-based position in ref.
+	)
+	addOp := func(t sam.CigarOpType, n int) {
+		if n <= 0 {
+			return
+		}
+		if k := len(cigar) - 1; k >= 0 && cigar[k].Type() == t {
+			cigar[k] = sam.NewCigarOp(t, cigar[k].Len()+n)
+			return
+		}
+		cigar = append(cigar, sam.NewCigarOp(t, n))
+	}
+	refBase := func() byte {
+		if refPos < len(ref) {
+			return ref[refPos]
+		}
+		return 'N'
+	}
+	match := func(end int) {
+		if end > readLen {
+			end = readLen
+		}
+		addOp(sam.CigarMatch, end-readPos)
+		for ; readPos < end; readPos++ {
+			seq[readPos] = refBase()
+			refPos++
+		}
+	}
+	copyBases := func(bases []byte) {
+		n := copy(seq[readPos:], bases)
+		readPos += n
+	}
+	for _, f := range features {
+		match(f.pos - 1)
+		switch f.code {
+		case 'B':
+			addOp(sam.CigarMatch, 1)
+			if readPos < readLen {
+				seq[readPos] = f.base
+				qual[readPos] = f.qual
+			}
+			readPos++
+			refPos++
+		case 'X':
+			addOp(sam.CigarMatch, 1)
+			if readPos < readLen {
+				seq[readPos] = s.substitute(refBase(), f.n)
+			}
+			readPos++
+			refPos++
+		case 'I':
+			addOp(sam.CigarInsertion, len(f.bases))
+			copyBases(f.bases)
+		case 'i':
+			addOp(sam.CigarInsertion, 1)
+			copyBases([]byte{f.base})
+		case 'S':
+			addOp(sam.CigarSoftClipped, len(f.bases))
+			copyBases(f.bases)
+		case 'b':
+			addOp(sam.CigarMatch, len(f.bases))
+			copyBases(f.bases)
+			refPos += len(f.bases)
+		case 'D':
+			addOp(sam.CigarDeletion, f.n)
+			refPos += f.n
+		case 'N':
+			addOp(sam.CigarSkipped, f.n)
+			refPos += f.n
+		case 'H':
+			addOp(sam.CigarHardClipped, f.n)
+		case 'P':
+			addOp(sam.CigarPadded, f.n)
+		case 'q':
+			if f.pos-1 < readLen {
+				copy(qual[f.pos-1:], f.bases)
+			}
+		case 'Q':
+			if f.pos-1 < readLen {
+				qual[f.pos-1] = f.qual
+			}
+		}
+	}
+	match(readLen)
+	rec.Cigar = cigar
+	return seq, qual, nil
+}
+
+// resolveMates fills the mate fields of records whose mates are stored in the
+// same slice. Such records form chains linked by nextFrag; the last record of
+// a chain points back to the first.
+func (s *sliceDecoder) resolveMates(recs []sliceRecord) {
+	for i := range recs {
+		if j := recs[i].nextFrag; j >= 0 && j < len(recs) {
+			recs[j].hasPrev = true
+		}
+	}
+	for i := range recs {
+		if recs[i].hasPrev || recs[i].cf&cfDetached != 0 {
+			continue
+		}
+		chain := []int{i}
+		for j := recs[i].nextFrag; j > i && j < len(recs); j = recs[j].nextFrag {
+			chain = append(chain, j)
+		}
+		if !s.comp.readNamesIncluded && recs[i].rec.Name == "" {
+			name := strconv.FormatInt(s.slice.counter+int64(i)+1, 10)
+			for _, k := range chain {
+				recs[k].rec.Name = name
+			}
+		}
+		if len(chain) < 2 {
+			continue
+		}
+		for k, idx := range chain {
+			rec := recs[idx].rec
+			mate := recs[chain[(k+1)%len(chain)]].rec
+			rec.MateRef = mate.Ref
+			rec.MatePos = mate.Pos
+			rec.Flags &^= sam.MateUnmapped | sam.MateReverse
+			if mate.Flags&sam.Unmapped != 0 {
+				rec.Flags |= sam.MateUnmapped
+			}
+			if mate.Flags&sam.Reverse != 0 {
+				rec.Flags |= sam.MateReverse
+			}
+		}
+		// Template length spans all the mapped fragments on the same reference.
+		first := recs[i].rec
+		left, right := -1, -1
+		for _, idx := range chain {
+			rec := recs[idx].rec
+			if rec.Flags&sam.Unmapped != 0 || rec.Ref != first.Ref {
+				left = -1
+				break
+			}
+			if left < 0 || rec.Pos < left {
+				left = rec.Pos
+			}
+			if end := rec.End(); end > right {
+				right = end
+			}
+		}
+		leftmostSeen := false
+		for _, idx := range chain {
+			rec := recs[idx].rec
+			switch {
+			case left < 0:
+				rec.TempLen = 0
+			case rec.Pos == left && !leftmostSeen:
+				rec.TempLen = right - left
+				leftmostSeen = true
+			default:
+				rec.TempLen = -(right - left)
+			}
+		}
+	}
+}
@@ -0,0 +1,13 @@
+#!/bin/sh
+# Regenerates the htslib.* fixtures from htslib.sam and htslib.fa with
+# samtools, so that the CRAM reader is tested against files it did not write.
+# The CRAM file uses version 3.0, since the 3.1 codecs are not supported, and
+# small slices, so that it has several containers.
+set -e
+cd "$(dirname "$0")"
+samtools view -b -o htslib.bam htslib.sam
+samtools view -C -T htslib.fa \
+  --output-fmt-option version=3.0 \
+  --output-fmt-option seqs_per_slice=4 \
+  -o htslib.cram htslib.sam
+samtools index htslib.cram
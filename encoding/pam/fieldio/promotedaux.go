@@ -0,0 +1,63 @@
+package fieldio
+
+import (
+	"github.com/Schaudge/grailbio/biopb"
+	"github.com/Schaudge/hts/sam"
+)
+
+// Encoding of a promoted aux tag, i.e., an aux tag stored in its own column.
+//
+// The values are encoded as in PutAuxField, followed by the AuxPos of each
+// value in the default subfield, so that the reader can put the values back
+// in their original place among the record's aux fields.
+
+// AuxPos is the position of a promoted aux field among the aux fields of its
+// record.
+type AuxPos struct {
+	// Index is the index of the field in sam.Record.AuxFields.
+	Index int
+	// Rest is the number of fields before it that are not promoted, i.e., that
+	// are stored in the aux column.
+	Rest int
+}
+
+// PutPromotedAuxField adds the values of a promoted aux tag and their positions
+// in the record. len(pos) must be len(aa).
+func (fw *Writer) PutPromotedAuxField(addr biopb.Coord, aa []sam.Aux, pos []AuxPos) {
+	fw.PutAuxField(addr, aa)
+	wb := fw.buf
+	for _, p := range pos {
+		wb.defaultBuf.PutUvarint64(uint64(p.Index))
+		wb.defaultBuf.PutUvarint64(uint64(p.Rest))
+	}
+}
+
+// ReadPromotedAuxField reads the next field written by PutPromotedAuxField.
+// Arg "md" must be the value reported by ReadAuxMetadata. The positions are
+// appended to "pos".
+func (fr *Reader) ReadPromotedAuxField(md AuxMetadata, arena *UnsafeArena, pos []AuxPos) ([]sam.Aux, []AuxPos) {
+	rb := &fr.fb
+	for range md.Tags {
+		pos = append(pos, AuxPos{
+			Index: int(rb.defaultBuf.Uvarint64()),
+			Rest:  int(rb.defaultBuf.Uvarint64()),
+		})
+	}
+	return fr.ReadAuxField(md, arena), pos
+}
+
+// SkipPromotedAuxField skips the next field written by PutPromotedAuxField.
+// It panics on EOF or any error.
+func (fr *Reader) SkipPromotedAuxField() {
+	md, ok := fr.ReadAuxMetadata()
+	if !ok {
+		panic(fr)
+	}
+	rb := &fr.fb
+	rb.remaining--
+	for _, tag := range md.Tags {
+		rb.defaultBuf.Uvarint64()
+		rb.defaultBuf.Uvarint64()
+		rb.blobBuf.RawBytes(tag.Len)
+	}
+}
@@ -37,10 +37,22 @@ type Reader struct {
 
 	coordField    bool                // True if the field is gbam.FieldCoord.
 	addrGenerator gbam.CoordGenerator // Computes biopb.Coord.Seq. Used only when coordField=true.
+
+	// unsorted is set by the Unsorted option. nextUnsorted is then the
+	// address of the next record to be read.
+	unsorted     bool
+	nextUnsorted biopb.Coord
+	// The reference ID and position read by the last call to ReadCoordField.
+	lastRefID, lastPos int32
+
+	// If non-nil, blocks whose stats are rejected by the filter are not read.
+	blockFilter func(*biopb.PAMBlockStats) bool
 }
 
 type readerOpts struct {
-	bufSize int
+	bufSize     int
+	blockFilter func(*biopb.PAMBlockStats) bool
+	unsorted    bool
 }
 
 // ReaderOpt is an option to pass to NewReader.
@@ -54,6 +66,15 @@ func BufSize(size int) ReaderOpt {
 	}
 }
 
+// BlockFilter constructs a ReaderOpt that causes Seek to drop the blocks whose
+// stats are rejected by the given function. Blocks without stats are always
+// read. Use Covers to check whether a record was stored in a dropped block.
+func BlockFilter(filter func(stats *biopb.PAMBlockStats) bool) ReaderOpt {
+	return func(opts *readerOpts) {
+		opts.blockFilter = filter
+	}
+}
+
 // NewReader creates a new Reader that reads from the given path. Label is shown
 // in log messages. coordField should be true if the file stores the genomic
 // coordinate. Setting setting coordField=true enables the codepath that
@@ -65,9 +86,11 @@ func NewReader(ctx context.Context, path, label string, coordField bool, fileOpt
 		opt(&ropts)
 	}
 	fr := &Reader{
-		coordField: coordField,
-		label:      label,
-		err:        errp,
+		coordField:  coordField,
+		label:       label,
+		err:         errp,
+		blockFilter: ropts.blockFilter,
+		unsorted:    ropts.unsorted,
 	}
 	in, err := file.Open(ctx, path, fileOpts)
 	if err != nil {
@@ -104,6 +127,7 @@ type fieldReadBuf struct {
 	prevInt64Value1     int64
 	prevString          []byte // for decoding prefix-delta-encoded string.
 	tmpAuxMd            AuxMetadata
+	tmpRefSeq           []byte // for decoding reference-encoded seq.
 }
 
 func (rb *fieldReadBuf) reset(index biopb.PAMBlockIndexEntry, buf []byte, blob []byte) {
@@ -139,12 +163,17 @@ func (fr *Reader) ReadStringDeltaMetadata() (StringDeltaMetadata, bool) {
 // SkipStringDeltaField skips a delta-encoded string.
 // It panics on EOF or any error.
 func (fr *Reader) SkipStringDeltaField() {
-	rb := &fr.fb
-	rb.remaining--
 	md, ok := fr.ReadStringDeltaMetadata()
 	if !ok {
 		panic(fr)
 	}
+	// remaining must be decremented after reading the metadata, which loads
+	// the next block when remaining is zero. Otherwise, skipping the last
+	// value of a block would read the metadata from the next block. This
+	// happens when the records rejected by ReadOpts.Filter or
+	// ReadOpts.BlockFilter are skipped.
+	rb := &fr.fb
+	rb.remaining--
 	prefix := rb.prevString[:md.PrefixLen]
 	resizeBuf(&rb.prevString, md.PrefixLen+md.DeltaLen)
 	copy(rb.prevString, prefix)
@@ -302,6 +331,7 @@ func (fr *Reader) readNextBlock() bool {
 	if fr.coordField {
 		start := fr.fb.index.StartAddr
 		fr.addrGenerator.LastRec = biopb.Coord{start.RefId, start.Pos, start.Seq - 1}
+		fr.nextUnsorted = start
 	}
 	log.Debug.Printf("%v: Read block %+v, %d remaining", fr.label, addr, len(fr.blocks))
 	return true
@@ -309,12 +339,13 @@ func (fr *Reader) readNextBlock() bool {
 
 // SkipCigarField skips the next cigar field.
 func (fr *Reader) SkipCigarField() {
-	rb := &fr.fb
-	rb.remaining--
 	nOps, ok := fr.ReadCigarMetadata()
 	if !ok {
 		panic(fr)
 	}
+	// Decrement after reading the metadata; see SkipStringDeltaField.
+	rb := &fr.fb
+	rb.remaining--
 	for i := 0; i < nOps; i++ {
 		rb.defaultBuf.Uvarint32()
 	}
@@ -343,9 +374,12 @@ func (fr *Reader) ReadCigarField(nOp int, arena *UnsafeArena) sam.Cigar {
 // SkipSeqField skips the next seq field.
 // It panics on EOF or any error.
 func (fr *Reader) SkipSeqField() {
+	nBases, ok := fr.ReadSeqMetadata()
+	if !ok {
+		panic(fr)
+	}
 	rb := &fr.fb
 	rb.remaining--
-	nBases := int(fr.fb.defaultBuf.Uvarint32())
 	bytes := SeqBytes(nBases)
 	rb.blobBuf.RawBytes(bytes)
 }
@@ -381,9 +415,12 @@ func (fr *Reader) ReadSeqField(nBases int, arena *UnsafeArena) sam.Seq {
 // SkipBytesField skips the next variable-length byteslice field.
 // It panics on EOF or any error.
 func (fr *Reader) SkipBytesField() {
+	nBases, ok := fr.ReadBytesMetadata()
+	if !ok {
+		panic(fr)
+	}
 	rb := &fr.fb
 	rb.remaining--
-	nBases := int(rb.defaultBuf.Uvarint32())
 	rb.blobBuf.RawBytes(nBases)
 }
 
@@ -408,9 +445,12 @@ func (fr *Reader) ReadBytesField(n int, arena *UnsafeArena) []byte {
 // SkipVarint32sField skips the next varint slice field.  It panics on EOF or
 // any error.
 func (fr *Reader) SkipVarint32sField() {
+	nBases, ok := fr.ReadVarint32sMetadata()
+	if !ok {
+		panic(fr)
+	}
 	rb := &fr.fb
 	rb.remaining--
-	nBases := int(rb.defaultBuf.Uvarint64())
 	for i := 0; i < nBases; i++ {
 		_ = rb.blobBuf.Varint64()
 	}
@@ -482,12 +522,13 @@ func (fr *Reader) ReadAuxMetadata() (AuxMetadata, bool) {
 // SkipAuxField skips the next aux field.
 // It panics on EOF or any error.
 func (fr *Reader) SkipAuxField() {
-	rb := &fr.fb
-	rb.remaining--
 	md, ok := fr.ReadAuxMetadata()
 	if !ok {
 		panic(fr)
 	}
+	// Decrement after reading the metadata; see SkipStringDeltaField.
+	rb := &fr.fb
+	rb.remaining--
 	for _, tag := range md.Tags {
 		rb.blobBuf.RawBytes(tag.Len)
 	}
@@ -501,21 +542,7 @@ const SizeofSliceHeader = int(unsafe.Sizeof(reflect.SliceHeader{}))
 func (fr *Reader) ReadAuxField(md AuxMetadata, arena *UnsafeArena) []sam.Aux {
 	rb := &fr.fb
 	rb.remaining--
-	var aux []sam.Aux
-	// Allocate the backing space for aux.
-	arena.Align()
-	auxBuf := arena.Alloc(len(md.Tags) * SizeofSliceHeader)
-	// Clear the array before updating rec.AuxFields. GC will be
-	// confused otherwise.
-	for i := range auxBuf {
-		auxBuf[i] = 0
-	}
-	auxBufHdr := (*reflect.SliceHeader)(unsafe.Pointer(&auxBuf))
-	auxHdr := (*reflect.SliceHeader)(unsafe.Pointer(&aux))
-	auxHdr.Data = auxBufHdr.Data
-	auxHdr.Len = len(md.Tags)
-	auxHdr.Cap = auxHdr.Len
-
+	aux := arena.AllocAux(len(md.Tags))
 	for i, tag := range md.Tags {
 		tagBuf := arena.Alloc(len(tag.Name) + tag.Len)
 		copy(tagBuf, tag.Name[:])
@@ -537,15 +564,32 @@ func (fr *Reader) ReadCoordField() (biopb.Coord, bool) {
 	rb.prevInt64Value0 = refID
 	pos := rb.prevInt64Value1 + rb.blobBuf.Varint64()
 	rb.prevInt64Value1 = pos
+	fr.lastRefID, fr.lastPos = int32(refID), int32(pos)
+	if fr.unsorted {
+		addr := fr.nextUnsorted
+		fr.nextUnsorted = NextUnsortedCoord(addr)
+		return addr, true
+	}
 	return fr.addrGenerator.Generate(int32(refID), int32(pos)), true
 }
 
+// Position returns the reference ID and the position stored for the record
+// last read by ReadCoordField. Unlike the coordinate returned by
+// ReadCoordField, they are not normalized for unmapped records, and they are
+// the only location of a record in an unsorted shard.
+func (fr *Reader) Position() (refID, pos int32) {
+	return fr.lastRefID, fr.lastPos
+}
+
 // PeekCoordField reads the next coordinate value without advancing the read
 // pointer. It returns false on EOF or any error.
 func (fr *Reader) PeekCoordField() (biopb.Coord, bool) {
 	if fr.fb.remaining <= 0 && !fr.readNextBlock() {
 		return biopb.Coord{}, false
 	}
+	if fr.unsorted {
+		return fr.nextUnsorted, true
+	}
 	rb := &fr.fb
 	s0 := rb.defaultBuf
 	s1 := rb.blobBuf
@@ -560,6 +604,18 @@ func (fr *Reader) PeekCoordField() (biopb.Coord, bool) {
 	return coord, true
 }
 
+// Covers checks if the next value to be read by the reader belongs to the
+// record at the given coordinate. It returns false if the record was stored in
+// a block dropped by the BlockFilter option. In such case, the caller must not
+// read a value for the record. The caller must call Covers for each record in
+// coordinate order.
+func (fr *Reader) Covers(coord biopb.Coord) bool {
+	if fr.fb.remaining <= 0 && !fr.readNextBlock() {
+		return false
+	}
+	return !coord.LT(fr.fb.index.StartAddr)
+}
+
 func readBlockHeader(buf *[]byte) (biopb.PAMBlockHeader, error) {
 	headerSize, n := binary.Varint(*buf)
 	if n <= 0 {
@@ -568,21 +624,42 @@ func readBlockHeader(buf *[]byte) (biopb.PAMBlockHeader, error) {
 		return biopb.PAMBlockHeader{}, err
 	}
 	*buf = (*buf)[n:]
-	// TODO(saito): range check
+	if headerSize < 0 || headerSize > int64(len(*buf)) {
+		return biopb.PAMBlockHeader{}, fmt.Errorf("invalid block header size %d", headerSize)
+	}
 	headerBytes := (*buf)[:headerSize]
 	*buf = (*buf)[headerSize:]
 
 	bh := biopb.PAMBlockHeader{}
 	err := bh.Unmarshal(headerBytes)
-	if err != nil {
-		panic(err)
-	}
-	return bh, nil
+	return bh, err
 }
 
 // Label returns the diagnostic label of the reader object.
 func (fr *Reader) Label() string { return fr.label }
 
+// Index returns the block index stored in the trailer of the file.
+func (fr *Reader) Index() biopb.PAMFieldIndex { return fr.index }
+
+// CheckBlocks reads and uncompresses every block listed in the index, and
+// checks that the block headers are valid. It is used to detect corrupt or
+// truncated files.
+//
+// REQUIRES: Seek has not been called.
+func (fr *Reader) CheckBlocks() error {
+	for i, b := range fr.index.Blocks {
+		if err := fr.readBlock(int64(b.FileOffset)); err != nil {
+			return errors.E(err, fmt.Sprintf("%s: block %d at offset %d", fr.label, i, b.FileOffset))
+		}
+		h := fr.fb.header
+		if h.Offset > h.BlobOffset || int(h.BlobOffset) > len(fr.fb.buf) {
+			return fmt.Errorf("%s: block %d at offset %d: corrupt header %+v (block size %d)",
+				fr.label, i, b.FileOffset, h, len(fr.fb.buf))
+		}
+	}
+	return nil
+}
+
 // Close closes the reader.  Errors are reported through fr.err.
 func (fr *Reader) Close(ctx context.Context) {
 	if fr.rio != nil { // fr.rio =nil on error
@@ -603,9 +680,14 @@ func (fr *Reader) Close(ctx context.Context) {
 func (fr *Reader) Seek(requestedRange biopb.CoordRange) (biopb.Coord, bool) {
 	fr.blocks = nil
 	for _, b := range fr.index.Blocks {
-		if pamutil.BlockIntersectsRange(b.StartAddr, b.EndAddr, requestedRange) {
-			fr.blocks = append(fr.blocks, b)
+		if !pamutil.BlockIntersectsRange(b.StartAddr, b.EndAddr, requestedRange) {
+			continue
+		}
+		if fr.blockFilter != nil && b.Stats != nil && !fr.blockFilter(b.Stats) {
+			log.Debug.Printf("%v: Skipping block %+v", fr.label, b)
+			continue
 		}
+		fr.blocks = append(fr.blocks, b)
 	}
 	if len(fr.blocks) == 0 {
 		// There's no record to be read in the range.  We'll report EOF when
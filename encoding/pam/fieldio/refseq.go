@@ -0,0 +1,192 @@
+package fieldio
+
+import (
+	"github.com/Schaudge/grailbio/biopb"
+	gbam "github.com/Schaudge/grailbio/encoding/bam"
+	"github.com/Schaudge/hts/sam"
+)
+
+// Reference-based encoding of the seq field.
+//
+// The base at each read position is predicted from the CIGAR and the reference
+// bases that the record is aligned to. Positions consumed by M, = or X ops are
+// predicted to be the reference base, and the other positions (I and S ops) are
+// predicted to be 'N'. Only the positions where the read differs from the
+// prediction are stored.
+//
+// - default subfield: sequence length, then the number of differences plus one.
+//   The second value is zero if the sequence is stored verbatim, as in
+//   PutSeqField. For each difference, the distance from the previous difference
+//   (or from the start of the read) is stored.
+// - blob subfield: for each difference, the 4-bit base code, as one byte.
+
+// literalRefSeq is the value of RefSeqMetadata.NDiffs for a sequence stored
+// verbatim.
+const literalRefSeq = -1
+
+// unknownBase is the 4-bit code for 'N'.
+const unknownBase = 0xf
+
+// baseCodes maps an ASCII base to its 4-bit code used in sam.Seq.
+var baseCodes = func() (t [256]byte) {
+	for i := range t {
+		t[i] = unknownBase
+	}
+	for i, b := range []byte("=ACMGRSVTWYHKDBN") {
+		t[b] = byte(i)
+		t[b|0x20] = byte(i) // lowercase
+	}
+	return t
+}()
+
+// RefSeqMetadata is the length information of a reference-encoded seq field.
+type RefSeqMetadata struct {
+	// Length is the number of bases.
+	Length int
+	// NDiffs is the number of bases that differ from the reference, or -1 if
+	// the sequence is stored verbatim.
+	NDiffs int
+}
+
+// predictRefSeq fills "dest" with the 4-bit base codes predicted from the cigar
+// and the reference bases. dest[i] is for the i'th base of the read. It returns
+// false if the cigar doesn't match the length of dest.
+func predictRefSeq(dest []byte, cigar sam.Cigar, ref string) bool {
+	qpos, rpos := 0, 0
+	for _, op := range cigar {
+		con := op.Type().Consumes()
+		n := op.Len()
+		if con.Query == 0 {
+			rpos += n * con.Reference
+			continue
+		}
+		if qpos+n > len(dest) {
+			return false
+		}
+		for i := 0; i < n; i++ {
+			base := byte(unknownBase)
+			if con.Reference != 0 && rpos < len(ref) {
+				base = baseCodes[ref[rpos]]
+			}
+			dest[qpos] = base
+			qpos++
+			rpos += con.Reference
+		}
+	}
+	return qpos == len(dest)
+}
+
+// seqBase returns the 4-bit code of the i'th base in seq.
+func seqBase(seq []sam.Doublet, i int) byte {
+	if i%2 == 0 {
+		return byte(seq[i/2]) >> 4
+	}
+	return byte(seq[i/2]) & 0xf
+}
+
+// PutRefSeqField adds the seq field, encoded as differences from the
+// reference. Arg "ref" must store the reference bases starting at the
+// alignment position of the record, and it must cover the span of the cigar,
+// unless the reference sequence ends earlier. If ref is empty, the sequence is
+// stored verbatim.
+func (fw *Writer) PutRefSeqField(addr biopb.Coord, seq sam.Seq, cigar sam.Cigar, ref string) {
+	wb := fw.buf
+	wb.updateAddrBounds(addr)
+	wb.defaultBuf.PutUvarint64(uint64(seq.Length))
+	predicted := fw.refSeqScratch(seq.Length)
+	if ref == "" || !predictRefSeq(predicted, cigar, ref) {
+		wb.defaultBuf.PutUvarint64(0)
+		wb.blobBuf.PutBytes(gbam.UnsafeDoubletsToBytes(seq.Seq))
+		return
+	}
+	nDiffs := 0
+	for i, p := range predicted {
+		if seqBase(seq.Seq, i) != p {
+			nDiffs++
+		}
+	}
+	wb.defaultBuf.PutUvarint64(uint64(nDiffs + 1))
+	prev := 0
+	for i, p := range predicted {
+		if base := seqBase(seq.Seq, i); base != p {
+			wb.defaultBuf.PutUvarint64(uint64(i - prev))
+			wb.blobBuf.PutUint8(base)
+			prev = i
+		}
+	}
+}
+
+func (fw *Writer) refSeqScratch(n int) []byte {
+	if cap(fw.tmpRefSeq) < n {
+		fw.tmpRefSeq = make([]byte, n)
+	}
+	fw.tmpRefSeq = fw.tmpRefSeq[:n]
+	return fw.tmpRefSeq
+}
+
+// ReadRefSeqMetadata returns the length information of the next
+// reference-encoded seq field.
+func (fr *Reader) ReadRefSeqMetadata() (RefSeqMetadata, bool) {
+	if fr.fb.remaining <= 0 && !fr.readNextBlock() {
+		return RefSeqMetadata{}, false
+	}
+	rb := &fr.fb
+	md := RefSeqMetadata{Length: int(rb.defaultBuf.Uvarint32())}
+	md.NDiffs = int(rb.defaultBuf.Uvarint32()) - 1
+	return md, true
+}
+
+// SkipRefSeqField skips the next reference-encoded seq field.
+// It panics on EOF or any error.
+func (fr *Reader) SkipRefSeqField() {
+	md, ok := fr.ReadRefSeqMetadata()
+	if !ok {
+		panic(fr)
+	}
+	rb := &fr.fb
+	rb.remaining--
+	if md.NDiffs == literalRefSeq {
+		rb.blobBuf.RawBytes(SeqBytes(md.Length))
+		return
+	}
+	for i := 0; i < md.NDiffs; i++ {
+		rb.defaultBuf.Uvarint32()
+	}
+	rb.blobBuf.RawBytes(md.NDiffs)
+}
+
+// ReadRefSeqField reads the reference-encoded seq field. Arg "md" must be
+// obtained by calling ReadRefSeqMetadata. Args "cigar" and "ref" must be the
+// same as the ones passed to PutRefSeqField.
+func (fr *Reader) ReadRefSeqField(md RefSeqMetadata, cigar sam.Cigar, ref string, arena *UnsafeArena) sam.Seq {
+	rb := &fr.fb
+	rb.remaining--
+	destBuf := arena.Alloc(SeqBytes(md.Length))
+	if md.NDiffs == literalRefSeq {
+		copy(destBuf, rb.blobBuf.RawBytes(len(destBuf)))
+	} else {
+		if cap(rb.tmpRefSeq) < md.Length {
+			rb.tmpRefSeq = make([]byte, md.Length)
+		}
+		bases := rb.tmpRefSeq[:md.Length]
+		if !predictRefSeq(bases, cigar, ref) {
+			panic(fr)
+		}
+		pos := 0
+		diffs := rb.blobBuf.RawBytes(md.NDiffs)
+		for _, base := range diffs {
+			pos += int(rb.defaultBuf.Uvarint32())
+			bases[pos] = base
+		}
+		for i := range destBuf {
+			destBuf[i] = bases[2*i] << 4
+			if 2*i+1 < len(bases) {
+				destBuf[i] |= bases[2*i+1]
+			}
+		}
+	}
+	return sam.Seq{
+		Length: md.Length,
+		Seq:    gbam.UnsafeBytesToDoublets(destBuf),
+	}
+}
@@ -4,6 +4,13 @@
 
 package fieldio
 
+import (
+	"reflect"
+	"unsafe"
+
+	"github.com/Schaudge/hts/sam"
+)
+
 // UnsafeArena is an arena allocator. It supports allocating []bytes quickly.
 type UnsafeArena struct {
 	buf []byte
@@ -34,3 +41,23 @@ func (ub *UnsafeArena) Alloc(size int) []byte {
 	ub.n += size
 	return a
 }
+
+// AllocAux allocates a []sam.Aux of n nil elements. The arena needs
+// n*SizeofSliceHeader bytes, plus up to 7 bytes for alignment.
+func (ub *UnsafeArena) AllocAux(n int) []sam.Aux {
+	var aux []sam.Aux
+	// Allocate the backing space for aux.
+	ub.Align()
+	auxBuf := ub.Alloc(n * SizeofSliceHeader)
+	// Clear the array before updating rec.AuxFields. GC will be
+	// confused otherwise.
+	for i := range auxBuf {
+		auxBuf[i] = 0
+	}
+	auxBufHdr := (*reflect.SliceHeader)(unsafe.Pointer(&auxBuf))
+	auxHdr := (*reflect.SliceHeader)(unsafe.Pointer(&aux))
+	auxHdr.Data = auxBufHdr.Data
+	auxHdr.Len = n
+	auxHdr.Cap = n
+	return aux
+}
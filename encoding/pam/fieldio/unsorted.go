@@ -0,0 +1,37 @@
+package fieldio
+
+import (
+	"math"
+
+	"github.com/Schaudge/grailbio/biopb"
+)
+
+// In a PAM shard whose records are not sorted by coordinate
+// (pamutil.ShardFeatures.Unsorted), the addresses of the records, recorded in
+// the block headers and the field indexes, are the ordinals of the records,
+// starting at FirstUnsortedCoord. The coordinate field still stores the
+// reference ID and position of each record. Addresses are needed only to align
+// the blocks of different fields, so an unsorted shard can be scanned
+// sequentially like a sorted one.
+
+// FirstUnsortedCoord is the address of the first record of an unsorted shard.
+var FirstUnsortedCoord = biopb.Coord{RefId: 0, Pos: 0, Seq: 0}
+
+// NextUnsortedCoord returns the address of the record that follows the record
+// at the given address in an unsorted shard. Seq counts the records, and Pos
+// is incremented when Seq overflows.
+func NextUnsortedCoord(c biopb.Coord) biopb.Coord {
+	if c.Seq == math.MaxInt32 {
+		return biopb.Coord{RefId: c.RefId, Pos: c.Pos + 1, Seq: 0}
+	}
+	return biopb.Coord{RefId: c.RefId, Pos: c.Pos, Seq: c.Seq + 1}
+}
+
+// Unsorted constructs a ReaderOpt for reading the coordinate field of an
+// unsorted shard. ReadCoordField and PeekCoordField then return the addresses
+// of the records, and Position returns the stored reference ID and position.
+func Unsorted() ReaderOpt {
+	return func(opts *readerOpts) {
+		opts.unsorted = true
+	}
+}
@@ -42,6 +42,8 @@ type Writer struct {
 
 	err *errors.Once // Any error encountered so far.
 
+	tmpRefSeq []byte // Temp for PutRefSeqField.
+
 	// The following fields are used by async buf flusher.
 	mu   *sync.Mutex
 	cond *sync.Cond
@@ -60,6 +62,11 @@ type fieldWriteBuf struct {
 	startAddr  biopb.Coord // addr of the first record stored in this buf.
 	endAddr    biopb.Coord // addr of the last record stored in this buf.
 
+	// Summary of the records stored in this buf. It is recorded in the block
+	// index so that readers can skip blocks that cannot match a predicate.
+	stats    biopb.PAMBlockStats
+	numStats int // # of records folded into stats.
+
 	defaultBuf byteBuffer // for storing numeric values
 	blobBuf    byteBuffer // for storing string and bytes.
 
@@ -90,6 +97,8 @@ func (wb *fieldWriteBuf) reset(seq int, label string) {
 	wb.startAddr = biopb.Coord{biopb.InvalidRefID, biopb.InvalidPos, 0}
 	wb.endAddr = biopb.Coord{biopb.InvalidRefID, biopb.InvalidPos, 0}
 	wb.numRecords = 0
+	wb.stats = biopb.PAMBlockStats{}
+	wb.numStats = 0
 }
 
 func (wb *fieldWriteBuf) updateAddrBounds(addr biopb.Coord) {
@@ -104,6 +113,40 @@ func (wb *fieldWriteBuf) updateAddrBounds(addr biopb.Coord) {
 	wb.numRecords++
 }
 
+// UpdateStats folds the record into the statistics of the current block. It
+// should be called once for every record added to the buffer.
+func (fw *Writer) UpdateStats(r *sam.Record) {
+	wb := fw.buf
+	s := &wb.stats
+	mapq, flags, tempLen := uint32(r.MapQ), uint32(r.Flags), int64(r.TempLen)
+	if wb.numStats == 0 {
+		*s = biopb.PAMBlockStats{
+			MinMapq:    mapq,
+			MaxMapq:    mapq,
+			FlagsOr:    flags,
+			FlagsAnd:   flags,
+			MinTempLen: tempLen,
+			MaxTempLen: tempLen,
+		}
+	} else {
+		if mapq < s.MinMapq {
+			s.MinMapq = mapq
+		}
+		if mapq > s.MaxMapq {
+			s.MaxMapq = mapq
+		}
+		s.FlagsOr |= flags
+		s.FlagsAnd &= flags
+		if tempLen < s.MinTempLen {
+			s.MinTempLen = tempLen
+		}
+		if tempLen > s.MaxTempLen {
+			s.MaxTempLen = tempLen
+		}
+	}
+	wb.numStats++
+}
+
 // PutCoordField adds a coordinate field to the buffer.
 //
 // TODO(saito) we don't need (refid, pos). They can be derived from coord.
@@ -315,6 +358,13 @@ func (fw *Writer) indexCallback(loc recordio.ItemLocation, v interface{}) error
 		EndAddr:    wb.endAddr,
 		FileOffset: loc.Block,
 	}
+	if wb.numStats > 0 {
+		if wb.numStats != wb.numRecords {
+			log.Panicf("%v: stats cover %d records, but the block has %d", wb.label, wb.numStats, wb.numRecords)
+		}
+		stats := wb.stats
+		index.Stats = &stats
+	}
 	if index.StartAddr.RefId == biopb.InvalidRefID || index.StartAddr.Pos == biopb.InvalidPos ||
 		index.EndAddr.RefId == biopb.InvalidRefID || index.EndAddr.Pos == biopb.InvalidPos {
 		log.Panic(index)
@@ -0,0 +1,555 @@
+// Copyright 2018 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package pam
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync/atomic"
+
+	"github.com/Schaudge/grailbase/errors"
+	"github.com/Schaudge/grailbase/file"
+	"github.com/Schaudge/grailbase/traverse"
+	"github.com/Schaudge/grailbase/vcontext"
+	"github.com/Schaudge/grailbio/biopb"
+	gbam "github.com/Schaudge/grailbio/encoding/bam"
+	"github.com/Schaudge/grailbio/encoding/fasta"
+	"github.com/Schaudge/grailbio/encoding/pam/pamutil"
+	"github.com/Schaudge/hts/bam"
+	"github.com/Schaudge/hts/sam"
+	"v.io/x/lib/vlog"
+)
+
+// MergeOpts defines options for Merge.
+type MergeOpts struct {
+	// WriteOpts is used to write the output when the inputs must be merged
+	// record by record. WriteOpts.Range must be empty.
+	WriteOpts WriteOpts
+
+	// Reference is passed to ReadOpts.Reference when the inputs are merged
+	// record by record. It is needed only if some of the inputs were written
+	// with WriteOpts.Reference.
+	Reference fasta.Fasta
+}
+
+// mergeSource is one of the inputs to Merge.
+type mergeSource struct {
+	dir     string
+	header  *sam.Header        // Header stored in the first shard.
+	indexes []pamutil.FileInfo // *.index files, sorted by range.
+	// Field data files, keyed by CoordRangePathString of the shard range.
+	fields map[string][]pamutil.FileInfo
+	// refIDs[i] is the ID, in the merged header, of the i'th reference of
+	// header. It is sorted in increasing order.
+	refIDs []int32
+	// rgNames maps the IDs of the read groups of header that are renamed in the
+	// merged header to their new IDs. nil if no read group is renamed.
+	rgNames map[string]string
+}
+
+// mergedCoord translates a coordinate of the source to the merged header.
+func (s *mergeSource) mergedCoord(c biopb.Coord) biopb.Coord {
+	if c.RefId >= 0 && int(c.RefId) < len(s.refIDs) {
+		c.RefId = s.refIDs[c.RefId]
+	}
+	return c
+}
+
+// sourceCoord translates a coordinate of the merged header to the smallest
+// coordinate of the source that is not less than it.
+func (s *mergeSource) sourceCoord(c biopb.Coord) biopb.Coord {
+	if c.RefId < 0 {
+		return c
+	}
+	i := sort.Search(len(s.refIDs), func(i int) bool { return s.refIDs[i] >= c.RefId })
+	switch {
+	case i == len(s.refIDs):
+		return biopb.Coord{RefId: biopb.UnmappedRefID}
+	case s.refIDs[i] > c.RefId:
+		return biopb.Coord{RefId: int32(i)}
+	}
+	return biopb.Coord{RefId: int32(i), Pos: c.Pos, Seq: c.Seq}
+}
+
+func openMergeSource(ctx context.Context, dir string) (*mergeSource, error) {
+	s := &mergeSource{dir: dir, fields: map[string][]pamutil.FileInfo{}}
+	lister := file.List(ctx, dir, false)
+	for lister.Scan() {
+		fi, err := pamutil.ParsePath(lister.Path())
+		if err != nil {
+			continue
+		}
+		switch fi.Type {
+		case pamutil.FileTypeShardIndex:
+			s.indexes = append(s.indexes, fi)
+		case pamutil.FileTypeFieldData:
+			key := pamutil.CoordRangePathString(fi.Range)
+			s.fields[key] = append(s.fields[key], fi)
+		}
+	}
+	if err := lister.Err(); err != nil {
+		return nil, errors.E(err, fmt.Sprintf("merge: list %s", dir))
+	}
+	if len(s.indexes) == 0 {
+		return nil, fmt.Errorf("merge: no pam file found in %s", dir)
+	}
+	sort.SliceStable(s.indexes, func(i, j int) bool {
+		return s.indexes[i].Range.Start.LT(s.indexes[j].Range.Start)
+	})
+	var err error
+	if s.header, err = readShardHeader(ctx, dir, s.indexes[0].Range); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// readShardHeader reads the sam.Header stored in the index of the given shard.
+// It fails if the records of the shard are not sorted by coordinate, since
+// Merge and Reshard read their inputs by coordinate.
+func readShardHeader(ctx context.Context, dir string, shardRange biopb.CoordRange) (*sam.Header, error) {
+	index, err := pamutil.ReadShardIndex(ctx, dir, shardRange)
+	if err != nil {
+		return nil, err
+	}
+	features, err := pamutil.ParseShardVersion(index.Version)
+	if err != nil {
+		return nil, errors.E(err, dir)
+	}
+	if features.Unsorted {
+		return nil, fmt.Errorf("%s: the records are not sorted by coordinate", dir)
+	}
+	header, err := gbam.UnmarshalHeader(index.EncodedBamHeader)
+	if err != nil {
+		return nil, errors.E(err, fmt.Sprintf("%s: decode sam.Header in index", dir))
+	}
+	return header, nil
+}
+
+// mergeHeaders creates the header of the merged PAM, and fills the refIDs and
+// rgNames of the sources. References with the same name and length are
+// unified. The read groups, programs and comments of all the sources are kept.
+// A read group whose ID is used by a different read group of an earlier source
+// is renamed, like in bamprovider.MergedProvider.
+//
+// Merging by coordinate requires that the references of each source appear in
+// the same order in the merged header.
+func mergeHeaders(sources []*mergeSource) (*sam.Header, error) {
+	headers := make([]*sam.Header, len(sources))
+	for i, s := range sources {
+		headers[i] = s.header
+	}
+	h, links, err := sam.MergeHeaders(headers)
+	if err != nil {
+		return nil, errors.E(err, "merge: unify references")
+	}
+	if len(sources) == 1 {
+		links = [][]*sam.Reference{h.Refs()}
+	}
+	// MergeHeaders resets the sort order, but the merged PAM is still sorted
+	// by coordinate.
+	h.SortOrder = headers[0].SortOrder
+
+	rgs := map[string]*sam.ReadGroup{}
+	for _, rg := range h.RGs() {
+		rgs[rg.Name()] = rg
+	}
+	// uniqueName returns a read group ID not used by any source.
+	uniqueName := func(name string, i int) string {
+		for k := i; ; k++ {
+			n := fmt.Sprintf("%s.%d", name, k)
+			if _, ok := rgs[n]; !ok {
+				return n
+			}
+		}
+	}
+	progs := map[string]bool{}
+	for _, p := range h.Progs() {
+		progs[p.UID()] = true
+	}
+	comments := map[string]bool{}
+	for _, co := range h.Comments {
+		comments[co] = true
+	}
+	for i, add := range headers {
+		if i == 0 {
+			// The read groups of the first source are already in h.
+			continue
+		}
+		for _, rg := range add.RGs() {
+			name := rg.Name()
+			if e, ok := rgs[name]; ok {
+				if e.String() == rg.String() {
+					// The same read group appears in multiple sources.
+					continue
+				}
+				name = uniqueName(name, i)
+				if sources[i].rgNames == nil {
+					sources[i].rgNames = map[string]string{}
+				}
+				sources[i].rgNames[rg.Name()] = name
+				vlog.VI(1).Infof("merge %s: renamed read group %s to %s", sources[i].dir, rg.Name(), name)
+			}
+			newRG := rg.Clone()
+			if err := newRG.SetName(name); err != nil {
+				return nil, errors.E(err, fmt.Sprintf("merge: rename read group %s", rg.Name()))
+			}
+			if err := h.AddReadGroup(newRG); err != nil {
+				return nil, errors.E(err, fmt.Sprintf("merge: add read group %s", name))
+			}
+			rgs[name] = newRG
+		}
+	}
+	for _, add := range headers[1:] {
+		for _, p := range add.Progs() {
+			if !progs[p.UID()] {
+				progs[p.UID()] = true
+				if err := h.AddProgram(p.Clone()); err != nil {
+					return nil, errors.E(err, fmt.Sprintf("merge: add program %s", p.UID()))
+				}
+			}
+		}
+		for _, co := range add.Comments {
+			if !comments[co] {
+				comments[co] = true
+				h.Comments = append(h.Comments, co)
+			}
+		}
+	}
+
+	for i, s := range sources {
+		s.refIDs = make([]int32, len(links[i]))
+		for j, ref := range links[i] {
+			s.refIDs[j] = int32(ref.ID())
+			if j > 0 && s.refIDs[j] <= s.refIDs[j-1] {
+				return nil, fmt.Errorf("merge %s: reference %s is out of order with respect to the other inputs",
+					s.dir, ref.Name())
+			}
+		}
+	}
+	return h, nil
+}
+
+// copyShard is a shard of a source that is copied verbatim to the output.
+type copyShard struct {
+	src   *mergeSource
+	index pamutil.FileInfo
+	// Closed range of the coordinates of the records in the shard.
+	start, end biopb.Coord
+}
+
+// listCopyShards lists the nonempty shards of the sources, sorted by
+// coordinate. It returns false if the shards cannot be copied verbatim, either
+// because the reference IDs or read groups must be remapped or because the
+// records of different shards overlap.
+func listCopyShards(ctx context.Context, sources []*mergeSource) ([]copyShard, bool, error) {
+	var shards []copyShard
+	for _, s := range sources {
+		if len(s.rgNames) > 0 {
+			return nil, false, nil
+		}
+		for j, id := range s.refIDs {
+			if id != int32(j) {
+				return nil, false, nil
+			}
+		}
+		for _, fi := range s.indexes {
+			index, err := pamutil.ReadFieldIndex(ctx, s.dir, fi.Range, gbam.FieldCoord.String())
+			if err != nil {
+				return nil, false, err
+			}
+			if len(index.Blocks) == 0 {
+				continue
+			}
+			shards = append(shards, copyShard{
+				src:   s,
+				index: fi,
+				start: index.Blocks[0].StartAddr,
+				end:   index.Blocks[len(index.Blocks)-1].EndAddr,
+			})
+		}
+	}
+	sort.SliceStable(shards, func(i, j int) bool { return shards[i].start.LT(shards[j].start) })
+	for i := 1; i < len(shards); i++ {
+		if shards[i].start.LE(shards[i-1].end) {
+			return nil, false, nil
+		}
+	}
+	return shards, true, nil
+}
+
+// copyFile copies the file at src to dst. Local files are hard-linked when
+// possible.
+func copyFile(ctx context.Context, dst, src string) (err error) {
+	if isLocalPath(src) && isLocalPath(dst) {
+		if err := os.MkdirAll(file.Dir(dst), 0777); err == nil {
+			if err := os.Link(src, dst); err == nil {
+				return nil
+			}
+		}
+	}
+	in, err := file.Open(ctx, src)
+	if err != nil {
+		return err
+	}
+	defer file.CloseAndReport(ctx, in, &err)
+	out, err := file.Create(ctx, dst)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out.Writer(ctx), in.Reader(ctx)); err != nil {
+		out.Discard(ctx)
+		return errors.E(err, fmt.Sprintf("copy %s to %s", src, dst))
+	}
+	return out.Close(ctx)
+}
+
+func isLocalPath(path string) bool {
+	scheme, _, err := file.ParsePath(path)
+	return err == nil && scheme == ""
+}
+
+// copyShards copies the shards verbatim to dir. The shard ranges are extended
+// so that they fill the universal range, and the shard indexes are rewritten
+// with the merged header. The entries of metadata are added to the metadata of
+// each shard.
+func copyShards(ctx context.Context, dir string, header *sam.Header, metadata map[string]string, shards []copyShard) error {
+	encodedHeader, err := bam.MarshalHeader(header)
+	if err != nil {
+		return err
+	}
+	return traverse.Each(len(shards), func(i int) error {
+		shard := shards[i]
+		newRange := biopb.CoordRange{Start: shard.start, Limit: gbam.UniversalRange.Limit}
+		if i == 0 {
+			newRange.Start = gbam.UniversalRange.Start
+		}
+		if i < len(shards)-1 {
+			newRange.Limit = shards[i+1].start
+		}
+		for _, fi := range shard.src.fields[pamutil.CoordRangePathString(shard.index.Range)] {
+			if err := copyFile(ctx, pamutil.FieldDataPath(dir, newRange, fi.Field), fi.Path); err != nil {
+				return err
+			}
+		}
+		index, err := pamutil.ReadShardIndex(ctx, shard.src.dir, shard.index.Range)
+		if err != nil {
+			return err
+		}
+		index.Range = newRange
+		index.EncodedBamHeader = encodedHeader
+		if len(metadata) > 0 && index.Metadata == nil {
+			index.Metadata = map[string]string{}
+		}
+		for k, v := range metadata {
+			index.Metadata[k] = v
+		}
+		vlog.VI(1).Infof("merge: copied %s:%s as %s", shard.src.dir,
+			pamutil.CoordRangePathString(shard.index.Range), pamutil.CoordRangePathString(newRange))
+		return pamutil.WriteShardIndex(ctx, dir, newRange, &index)
+	})
+}
+
+// mergeShardRanges returns the ranges of the shards created by merging the
+// sources record by record. The ranges are split at the shard boundaries of
+// the sources.
+func mergeShardRanges(sources []*mergeSource) []biopb.CoordRange {
+	bounds := []biopb.Coord{gbam.UniversalRange.Start}
+	for _, s := range sources {
+		for _, fi := range s.indexes {
+			c := s.mergedCoord(fi.Range.Start)
+			// A shard of the output must start at the first record of a
+			// position, since the sequence numbers of records at the same
+			// position are not comparable across the sources.
+			c.Seq = 0
+			if c.LT(gbam.UniversalRange.Limit) {
+				bounds = append(bounds, c)
+			}
+		}
+	}
+	sort.SliceStable(bounds, func(i, j int) bool { return bounds[i].LT(bounds[j]) })
+	var ranges []biopb.CoordRange
+	for i, c := range bounds {
+		if i > 0 && c.EQ(bounds[i-1]) {
+			continue
+		}
+		if n := len(ranges); n > 0 {
+			ranges[n-1].Limit = c
+		}
+		ranges = append(ranges, biopb.CoordRange{Start: c, Limit: gbam.UniversalRange.Limit})
+	}
+	return ranges
+}
+
+// mergeInput is the state of reading one source in mergeShard.
+type mergeInput struct {
+	r     *Reader
+	refs  []*sam.Reference   // refs[i] is the merged reference for source reference i.
+	rgs   map[string]sam.Aux // RG aux fields of the renamed read groups, keyed by old ID.
+	rec   *sam.Record        // Next record, or nil on EOF.
+	coord biopb.Coord        // Coordinate of rec in the merged header.
+}
+
+func (in *mergeInput) next() {
+	if !in.r.Scan() {
+		in.rec = nil
+		return
+	}
+	in.rec = in.r.Record()
+	if id := in.rec.Ref.ID(); id >= 0 {
+		in.rec.Ref = in.refs[id]
+	}
+	if id := in.rec.MateRef.ID(); id >= 0 {
+		in.rec.MateRef = in.refs[id]
+	}
+	if len(in.rgs) > 0 {
+		for i, aux := range in.rec.AuxFields {
+			if aux.Tag() != sam.NewTag("RG") {
+				continue
+			}
+			if name, ok := aux.Value().(string); ok {
+				if newAux, ok := in.rgs[name]; ok {
+					in.rec.AuxFields[i] = newAux
+				}
+			}
+		}
+	}
+	in.coord = gbam.CoordFromSAMRecord(in.rec, 0)
+}
+
+// mergeShard merges the records of the sources in range rng, and writes them
+// to a shard of the output. Records at the same coordinate are written in the
+// order of the sources. It returns the number of records written.
+func mergeShard(opts MergeOpts, dir string, header *sam.Header, sources []*mergeSource, rng biopb.CoordRange) (int64, error) {
+	rgAuxes := map[*mergeSource]map[string]sam.Aux{}
+	for _, s := range sources {
+		for old, name := range s.rgNames {
+			aux, err := sam.NewAux(sam.NewTag("RG"), name)
+			if err != nil {
+				return 0, errors.E(err, fmt.Sprintf("merge: read group %s", name))
+			}
+			if rgAuxes[s] == nil {
+				rgAuxes[s] = map[string]sam.Aux{}
+			}
+			rgAuxes[s][old] = aux
+		}
+	}
+	var inputs []*mergeInput
+	for _, s := range sources {
+		srcRange := biopb.CoordRange{Start: s.sourceCoord(rng.Start), Limit: s.sourceCoord(rng.Limit)}
+		if !srcRange.Start.LT(srcRange.Limit) {
+			continue
+		}
+		if files, _ := pamutil.ChooseIndexFilesInRange(s.indexes, srcRange); len(files) == 0 {
+			continue
+		}
+		in := &mergeInput{
+			r:    NewReader(ReadOpts{Range: srcRange, Reference: opts.Reference, ReferenceM5Cache: opts.WriteOpts.ReferenceM5Cache}, s.dir),
+			refs: make([]*sam.Reference, len(s.refIDs)),
+			rgs:  rgAuxes[s],
+		}
+		for i, id := range s.refIDs {
+			in.refs[i] = header.Refs()[id]
+		}
+		inputs = append(inputs, in)
+	}
+
+	wopts := opts.WriteOpts
+	wopts.Range = rng
+	w := NewWriter(wopts, header, dir)
+	for _, in := range inputs {
+		in.next()
+	}
+	var nRecs int64
+	for w.Err() == nil {
+		var min *mergeInput
+		for _, in := range inputs {
+			if in.rec != nil && (min == nil || in.coord.LT(min.coord)) {
+				min = in
+			}
+		}
+		if min == nil {
+			break
+		}
+		w.Write(min.rec)
+		sam.PutInFreePool(min.rec)
+		nRecs++
+		min.next()
+	}
+	err := errors.Once{}
+	for _, in := range inputs {
+		err.Set(in.r.Close())
+	}
+	err.Set(w.Close())
+	return nRecs, err.Err()
+}
+
+// Merge combines the PAM files in srcDirs into a new PAM file in dir. Existing
+// contents of dir, if any, are deleted.
+//
+// The headers of the inputs are unified, and reference IDs are remapped as
+// needed. A read group whose ID is already used by a different read group of
+// an earlier input is renamed, and the RG aux fields of its records are
+// rewritten. If the inputs use the same reference IDs, no read group is
+// renamed, and the records of their shards do not overlap, the shard files are copied verbatim (or hard-linked
+// when possible) and only the shard indexes are rewritten; the entries of
+// opts.WriteOpts.Metadata are added to the metadata of the copies. Otherwise, the
+// records are merged by coordinate and written using opts.WriteOpts, in
+// parallel over ranges split at the shard boundaries of the inputs.
+func Merge(opts MergeOpts, dir string, srcDirs []string) error {
+	ctx := vcontext.Background()
+	if len(srcDirs) == 0 {
+		return fmt.Errorf("merge %s: no input", dir)
+	}
+	if err := pamutil.ValidateCoordRange(&opts.WriteOpts.Range); err != nil {
+		return err
+	}
+	if !opts.WriteOpts.Range.EQ(gbam.UniversalRange) {
+		return fmt.Errorf("merge %s: WriteOpts.Range must be a universal range, but found %+v", dir, opts.WriteOpts.Range)
+	}
+	sources := make([]*mergeSource, len(srcDirs))
+	for i, srcDir := range srcDirs {
+		if srcDir == dir {
+			return fmt.Errorf("merge %s: the output is also an input", dir)
+		}
+		var err error
+		if sources[i], err = openMergeSource(ctx, srcDir); err != nil {
+			return err
+		}
+	}
+	header, err := mergeHeaders(sources)
+	if err != nil {
+		return err
+	}
+	shards, canCopy, err := listCopyShards(ctx, sources)
+	if err != nil {
+		return err
+	}
+	// Delete existing files to avoid mixing up files from multiple generations.
+	if err := pamutil.Remove(dir); err != nil {
+		return err
+	}
+	if canCopy && len(shards) > 0 {
+		vlog.Infof("merge %s: copying %d shards from %v", dir, len(shards), srcDirs)
+		return copyShards(ctx, dir, header, opts.WriteOpts.Metadata, shards)
+	}
+
+	ranges := mergeShardRanges(sources)
+	vlog.Infof("merge %s: merging %v by coordinate into %d shards", dir, srcDirs, len(ranges))
+	if opts.WriteOpts.ReferenceM5Cache == nil {
+		// Shared by the readers and writers of all the shards.
+		opts.WriteOpts.ReferenceM5Cache = pamutil.NewReferenceM5Cache()
+	}
+	var totalRecs int64
+	err = traverse.Each(len(ranges), func(i int) error {
+		nRecs, err := mergeShard(opts, dir, header, sources, ranges[i])
+		atomic.AddInt64(&totalRecs, nRecs)
+		return err
+	})
+	vlog.Infof("merge %s: written %d records, error %v", dir, totalRecs, err)
+	return err
+}
@@ -0,0 +1,76 @@
+// Copyright 2018 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package pam
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Well-known keys of WriteOpts.Metadata. Applications may use other keys as
+// well. Values are free-form strings.
+const (
+	// MetadataCreator is the tool, and its version, that created the file,
+	// e.g., "bio-pamtool convert v1.2.3".
+	MetadataCreator = "creator"
+	// MetadataCreationTime is the time the file was created, in RFC3339 format.
+	MetadataCreationTime = "creation_time"
+	// MetadataSource is the path of the file the PAM file was created from.
+	MetadataSource = "source"
+	// MetadataSourceSHA256 is the hex-encoded SHA-256 of the source file.
+	MetadataSourceSHA256 = "source_sha256"
+	// MetadataReference is the path of the reference FASTA file used to create
+	// the file.
+	MetadataReference = "reference"
+	// MetadataReferenceSHA256 is the hex-encoded SHA-256 of the reference
+	// FASTA file. The M5s of the reference sequences used to encode the seq
+	// field are stored separately, in PAMShardIndex.ReferenceM5.
+	MetadataReferenceSHA256 = "reference_sha256"
+	// MetadataWriteOpts describes the WriteOpts the file was written with. It
+	// is set by the Writer.
+	MetadataWriteOpts = "write_opts"
+)
+
+// describeWriteOpts returns the value of MetadataWriteOpts. It lists the
+// options that affect the encoding of the file.
+//
+// REQUIRES: validateWriteOpts has been called on o.
+func describeWriteOpts(o WriteOpts) string {
+	parts := []string{
+		fmt.Sprintf("max_buf_size=%d", o.MaxBufSize),
+		fmt.Sprintf("transformers=%s", strings.Join(o.Transformers, ",")),
+	}
+	if len(o.DropFields) > 0 {
+		var fields []string
+		for _, f := range o.DropFields {
+			fields = append(fields, f.String())
+		}
+		sort.Strings(fields)
+		parts = append(parts, "drop_fields="+strings.Join(fields, ","))
+	}
+	if len(o.PromotedAuxTags) > 0 {
+		var tags []string
+		for _, tag := range o.PromotedAuxTags {
+			tags = append(tags, tag.String())
+		}
+		parts = append(parts, "promoted_aux_tags="+strings.Join(tags, ","))
+	}
+	if o.Reference != nil {
+		parts = append(parts, "reference_seq=true")
+	}
+	if o.Unsorted {
+		parts = append(parts, "unsorted=true")
+	}
+	if b := o.QualBinning; b != nil {
+		if b.Table != nil {
+			parts = append(parts, "qual_binning=true")
+		}
+		if b.DropBelowMapq > 0 {
+			parts = append(parts, fmt.Sprintf("drop_qual_below_mapq=%d", b.DropBelowMapq))
+		}
+	}
+	return strings.Join(parts, " ")
+}
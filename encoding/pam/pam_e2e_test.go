@@ -13,6 +13,7 @@ import (
 	"os"
 	"path/filepath"
 	"runtime"
+	"sort"
 	"strings"
 	"sync/atomic"
 	"testing"
@@ -25,6 +26,7 @@ import (
 	gbam "github.com/Schaudge/grailbio/encoding/bam"
 	"github.com/Schaudge/grailbio/encoding/bamprovider"
 	"github.com/Schaudge/grailbio/encoding/converter"
+	"github.com/Schaudge/grailbio/encoding/fasta"
 	"github.com/Schaudge/grailbio/encoding/pam"
 	"github.com/Schaudge/grailbio/encoding/pam/pamutil"
 	"github.com/Schaudge/hts/bam"
@@ -735,6 +737,848 @@ func BenchmarkReadBAM(b *testing.B) {
 	}
 }
 
+// mapqRunsAt is the mapq of the i'th record written by generateMapqRunsPAM.
+func mapqRunsAt(i int) byte {
+	if (i/500)%2 == 1 {
+		return 10
+	}
+	return 60
+}
+
+// generateMapqRunsPAM creates a PAM file with n records whose mapq alternates
+// between 60 and 10 in runs of 500 records. Every third record is a duplicate.
+// It returns the records.
+func generateMapqRunsPAM(t *testing.T, pamPath string, n int) []*sam.Record {
+	ref, err := sam.NewReference("chr1", "", "", 1000000, nil, nil)
+	assert.NoError(t, err)
+	header, err := sam.NewHeader(nil, []*sam.Reference{ref})
+	assert.NoError(t, err)
+
+	w := pam.NewWriter(pam.WriteOpts{MaxBufSize: 1024}, header, pamPath)
+	seq := []byte(strings.Repeat("ACGT", 25))
+	qual := []byte(strings.Repeat("I", 100))
+	cigar := sam.Cigar{sam.NewCigarOp(sam.CigarMatch, len(seq))}
+	var recs []*sam.Record
+	for i := 0; i < n; i++ {
+		rec, err := sam.NewRecord(fmt.Sprintf("seq%06d", i), ref, ref,
+			i, i+100, 200, mapqRunsAt(i), cigar, seq, qual, nil)
+		assert.NoError(t, err)
+		if i%3 == 0 {
+			rec.Flags |= sam.Duplicate
+		}
+		w.Write(rec)
+		recs = append(recs, rec)
+	}
+	assert.NoError(t, w.Close())
+	return recs
+}
+
+// Check that BlockFilter drops only the blocks without interesting records.
+func TestBlockFilter(t *testing.T) {
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+
+	const nRecords = 5000
+	pamPath := filepath.Join(tempDir, "test.pam")
+	expected := map[string]string{}
+	for _, rec := range generateMapqRunsPAM(t, pamPath, nRecords) {
+		if rec.MapQ >= 60 && rec.Flags&sam.Duplicate == 0 {
+			expected[rec.Name] = rec.String()
+		}
+	}
+
+	// Every block should be annotated with stats.
+	indexes, err := pamutil.ReadIndexes(vcontext.Background(), pamPath, gbam.UniversalRange, gbam.FieldNames)
+	assert.NoError(t, err)
+	for _, index := range indexes {
+		for _, block := range index.Blocks {
+			assert.True(t, block.Stats != nil, "block %+v", block)
+			assert.True(t, block.Stats.MinMapq <= block.Stats.MaxMapq, "block %+v", block)
+			expect.EQ(t, block.Stats.MinTempLen, int64(200))
+		}
+	}
+
+	read := func(opts pam.ReadOpts) (nRead, nMatched int) {
+		r := pam.NewReader(opts, pamPath)
+		for r.Scan() {
+			rec := r.Record()
+			nRead++
+			if rec.MapQ >= 60 && rec.Flags&sam.Duplicate == 0 {
+				want, ok := expected[rec.Name]
+				expect.True(t, ok, "unexpected record %v", rec)
+				if len(opts.DropFields) == 0 {
+					expect.EQ(t, rec.String(), want)
+				}
+				nMatched++
+			}
+		}
+		assert.NoError(t, r.Close())
+		return nRead, nMatched
+	}
+	filter := func(stats *biopb.PAMBlockStats) bool {
+		return stats.MaxMapq >= 60 && stats.FlagsAnd&uint32(sam.Duplicate) == 0
+	}
+	nRead, nMatched := read(pam.ReadOpts{})
+	expect.EQ(t, nRead, nRecords)
+	expect.EQ(t, nMatched, len(expected))
+
+	nRead, nMatched = read(pam.ReadOpts{BlockFilter: filter})
+	expect.EQ(t, nMatched, len(expected))
+	expect.True(t, nRead < nRecords*3/4, "read %d records", nRead)
+
+	nRead, nMatched = read(pam.ReadOpts{
+		BlockFilter: filter,
+		DropFields:  []gbam.FieldType{gbam.FieldSeq, gbam.FieldQual, gbam.FieldAux},
+	})
+	expect.EQ(t, nMatched, len(expected))
+	expect.True(t, nRead < nRecords*3/4, "read %d records", nRead)
+
+	// Read a subrange that starts in a run of low-mapq records.
+	nRead, nMatched = read(pam.ReadOpts{
+		BlockFilter: filter,
+		Range:       newRange(0, 700, 0, 2100),
+	})
+	nExpected := 0
+	for i := 700; i < 2100; i++ {
+		if mapqRunsAt(i) >= 60 && i%3 != 0 {
+			nExpected++
+		}
+	}
+	expect.EQ(t, nMatched, nExpected)
+	expect.True(t, nRead < 1400*3/4, "read %d records", nRead)
+
+	// A filter that rejects everything.
+	nRead, _ = read(pam.ReadOpts{BlockFilter: func(*biopb.PAMBlockStats) bool { return false }})
+	expect.EQ(t, nRead, 0)
+}
+
+func TestReadFilter(t *testing.T) {
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+
+	pamPath := filepath.Join(tempDir, "test.pam")
+	var expected []string
+	for _, rec := range generateMapqRunsPAM(t, pamPath, 5000) {
+		if rec.MapQ >= 60 && rec.Flags&sam.Duplicate == 0 && rec.Pos >= 700 && rec.Pos < 2100 {
+			expected = append(expected, rec.String())
+		}
+	}
+	filter := func(r *sam.Record) bool {
+		expect.EQ(t, r.Name, "")
+		expect.EQ(t, len(r.Seq.Seq), 0)
+		return r.MapQ >= 60 && r.Flags&sam.Duplicate == 0
+	}
+	blockFilter := func(stats *biopb.PAMBlockStats) bool {
+		return stats.MaxMapq >= 60
+	}
+	for _, opts := range []pam.ReadOpts{
+		{Filter: filter},
+		{Filter: filter, BlockFilter: blockFilter},
+	} {
+		opts.Range = newRange(0, 700, 0, 2100)
+		r := pam.NewReader(opts, pamPath)
+		var got []string
+		for r.Scan() {
+			got = append(got, r.Record().String())
+		}
+		assert.NoError(t, r.Close())
+		expect.EQ(t, got, expected)
+	}
+}
+
+// Check that a value can be skipped when it is the last one of its block. The
+// filter rejects exactly the last record of each block of the name, cigar and
+// aux fields, whose values are then skipped without being decoded.
+func TestReadFilterSkipLastOfBlock(t *testing.T) {
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+
+	ref, err := sam.NewReference("chr1", "", "", 1000000, nil, nil)
+	assert.NoError(t, err)
+	header, err := sam.NewHeader(nil, []*sam.Reference{ref})
+	assert.NoError(t, err)
+	pamPath := filepath.Join(tempDir, "test.pam")
+	w := pam.NewWriter(pam.WriteOpts{MaxBufSize: 512}, header, pamPath)
+	var recs []*sam.Record
+	for i := 0; i < 2000; i++ {
+		seq := []byte(strings.Repeat("ACGT", 5))
+		qual := []byte(strings.Repeat("I", len(seq)))
+		cigar := sam.Cigar{sam.NewCigarOp(sam.CigarSoftClipped, i%5), sam.NewCigarOp(sam.CigarMatch, len(seq)-i%5)}
+		rec, err := sam.NewRecord(fmt.Sprintf("seq%06d", i), ref, nil, i, -1, 0, 60, cigar, seq, qual,
+			[]sam.Aux{newAux(t, "XI", i), newAux(t, "XZ", fmt.Sprintf("value%d", i))})
+		assert.NoError(t, err)
+		w.Write(rec)
+		recs = append(recs, rec)
+	}
+	assert.NoError(t, w.Close())
+
+	rejected := map[int]bool{}
+	for _, field := range []gbam.FieldType{gbam.FieldName, gbam.FieldCigar, gbam.FieldAux} {
+		index, err := pamutil.ReadFieldIndex(vcontext.Background(), pamPath, gbam.UniversalRange, field.String())
+		assert.NoError(t, err)
+		assert.GT(t, len(index.Blocks), 2, "field %v", field)
+		for _, block := range index.Blocks {
+			rejected[int(block.EndAddr.Pos)] = true
+		}
+	}
+	var expected []string
+	for _, rec := range recs {
+		if !rejected[rec.Pos] {
+			expected = append(expected, rec.String())
+		}
+	}
+	r := pam.NewReader(pam.ReadOpts{Filter: func(r *sam.Record) bool { return !rejected[r.Pos] }}, pamPath)
+	var got []string
+	for r.Scan() {
+		got = append(got, r.Record().String())
+	}
+	assert.NoError(t, r.Close())
+	expect.EQ(t, got, expected)
+}
+
+// auxString returns the aux fields of the record as a sorted, space-separated
+// string.
+func auxString(r *sam.Record) string {
+	var tags []string
+	for _, a := range r.AuxFields {
+		tags = append(tags, a.String())
+	}
+	sort.Strings(tags)
+	return strings.Join(tags, " ")
+}
+
+func TestPromotedAuxTags(t *testing.T) {
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+
+	ref, err := sam.NewReference("chr1", "", "", 1000000, nil, nil)
+	assert.NoError(t, err)
+	header, err := sam.NewHeader(nil, []*sam.Reference{ref})
+	assert.NoError(t, err)
+
+	pamPath := filepath.Join(tempDir, "test.pam")
+	rg, mi := sam.NewTag("RG"), sam.NewTag("MI")
+	w := pam.NewWriter(pam.WriteOpts{
+		MaxBufSize:      1024,
+		PromotedAuxTags: []sam.Tag{rg, mi, sam.NewTag("CB")},
+	}, header, pamPath)
+	const nRecords = 3000
+	seq := []byte("ACGTACGTAC")
+	qual := []byte("IIIIIIIIII")
+	cigar := sam.Cigar{sam.NewCigarOp(sam.CigarMatch, len(seq))}
+	var recs []*sam.Record
+	for i := 0; i < nRecords; i++ {
+		// Promoted tags are mixed with the other tags in various orders.
+		var aux []sam.Aux
+		if i%2 == 0 {
+			aux = append(aux, newAux(t, "RG", fmt.Sprintf("rg%d", i%4)))
+		}
+		if i%3 != 0 {
+			aux = append(aux, newAux(t, "NM", i%5))
+		}
+		if i%7 == 0 {
+			aux = append(aux, newAux(t, "MI", fmt.Sprintf("mi%d", i)))
+		}
+		if i%2 == 1 {
+			aux = append(aux, newAux(t, "RG", fmt.Sprintf("rg%d", i%4)))
+		}
+		if i%5 == 0 {
+			aux = append(aux, newAux(t, "XS", fmt.Sprintf("xs%d", i)))
+		}
+		rec, err := sam.NewRecord(fmt.Sprintf("seq%06d", i), ref, ref,
+			i, i+100, 200, 60, cigar, seq, qual, aux)
+		assert.NoError(t, err)
+		w.Write(rec)
+		recs = append(recs, rec)
+	}
+	assert.NoError(t, w.Close())
+
+	index, err := pamutil.ReadShardIndex(vcontext.Background(), pamPath, gbam.UniversalRange)
+	assert.NoError(t, err)
+	expect.EQ(t, index.Version, "PAM2+aux:RG,MI,CB")
+
+	// The aux fields are read back in the order they were written.
+	auxOrderString := func(r *sam.Record) string {
+		var tags []string
+		for _, a := range r.AuxFields {
+			tags = append(tags, a.String())
+		}
+		return strings.Join(tags, " ")
+	}
+	for _, test := range []struct {
+		opts pam.ReadOpts
+		keep func(a sam.Aux) bool
+	}{
+		{pam.ReadOpts{}, func(a sam.Aux) bool { return true }},
+		{pam.ReadOpts{DropFields: []gbam.FieldType{gbam.FieldAux}},
+			func(a sam.Aux) bool { return a.Tag() == rg || a.Tag() == mi }},
+		{pam.ReadOpts{DropFields: []gbam.FieldType{gbam.FieldAux, gbam.AuxTagField(mi)}},
+			func(a sam.Aux) bool { return a.Tag() == rg }},
+		{pam.ReadOpts{DropFields: []gbam.FieldType{gbam.AuxTagField(rg), gbam.AuxTagField(mi)}},
+			func(a sam.Aux) bool { return a.Tag() != rg && a.Tag() != mi }},
+		// Tags that are not promoted are not dropped individually.
+		{pam.ReadOpts{DropFields: []gbam.FieldType{gbam.AuxTagField(sam.NewTag("XX"))}},
+			func(a sam.Aux) bool { return true }},
+		{pam.ReadOpts{Range: newRange(0, 1000, 0, 2000)}, func(a sam.Aux) bool { return true }},
+	} {
+		var expected []string
+		for _, rec := range recs {
+			if !test.opts.Range.Contains(gbam.CoordFromSAMRecord(rec, 0)) && test.opts.Range != (biopb.CoordRange{}) {
+				continue
+			}
+			r := *rec
+			r.AuxFields = nil
+			for _, a := range rec.AuxFields {
+				if test.keep(a) {
+					r.AuxFields = append(r.AuxFields, a)
+				}
+			}
+			expected = append(expected, auxOrderString(&r))
+		}
+		r := pam.NewReader(test.opts, pamPath)
+		var got []string
+		for r.Scan() {
+			got = append(got, auxOrderString(r.Record()))
+		}
+		assert.NoError(t, r.Close())
+		expect.EQ(t, got, expected, "opts %+v", test.opts)
+	}
+
+	// The writer stores a tag in its own column only if it is promoted.
+	w = pam.NewWriter(pam.WriteOpts{
+		DropFields: []gbam.FieldType{gbam.AuxTagField(rg)},
+	}, header, filepath.Join(tempDir, "bad.pam"))
+	expect.Regexp(t, w.Err(), "PromotedAuxTags")
+}
+
+func TestReferenceSeq(t *testing.T) {
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+
+	refSeq := strings.Repeat("ACGTTGCAAGGCTTAC", 100)
+	newFasta := func(seq string) fasta.Fasta {
+		fa, err := fasta.New(strings.NewReader(">chr1\n" + seq + "\n"))
+		assert.NoError(t, err)
+		return fa
+	}
+	fa := newFasta(refSeq)
+	ref, err := sam.NewReference("chr1", "", "", len(refSeq), nil, nil)
+	assert.NoError(t, err)
+	header, err := sam.NewHeader(nil, []*sam.Reference{ref})
+	assert.NoError(t, err)
+
+	pamPath := filepath.Join(tempDir, "test.pam")
+	w := pam.NewWriter(pam.WriteOpts{MaxBufSize: 256, Reference: fa}, header, pamPath)
+	var (
+		expected     []string
+		expectedSeqs []string
+		unmapped     []*sam.Record
+	)
+	for i := 0; i <= 1000; i++ {
+		pos := i
+		seq := []byte(refSeq[pos : pos+20])
+		var cigar sam.Cigar
+		switch {
+		case i == 1000: // Runs past the end of the reference
+			pos = len(refSeq) - 10
+			cigar = sam.Cigar{sam.NewCigarOp(sam.CigarMatch, 20)}
+		case i%3 == 0: // Exact match
+			cigar = sam.Cigar{sam.NewCigarOp(sam.CigarMatch, 20)}
+		case i%3 == 1: // Mismatch and soft clip
+			seq[3] = 'N'
+			seq[0], seq[1] = 'T', 'T'
+			cigar = sam.Cigar{sam.NewCigarOp(sam.CigarSoftClipped, 2), sam.NewCigarOp(sam.CigarMatch, 18)}
+		default: // Insertion and deletion
+			cigar = sam.Cigar{sam.NewCigarOp(sam.CigarMatch, 5), sam.NewCigarOp(sam.CigarInsertion, 2),
+				sam.NewCigarOp(sam.CigarDeletion, 3), sam.NewCigarOp(sam.CigarMatch, 13)}
+		}
+		qual := []byte(strings.Repeat("I", len(seq)))
+		rec, err := sam.NewRecord(fmt.Sprintf("seq%06d", i), ref, nil, pos, -1, 0, 60, cigar, seq, qual, nil)
+		assert.NoError(t, err)
+		w.Write(rec)
+		expected = append(expected, rec.String())
+		expectedSeqs = append(expectedSeqs, string(rec.Seq.Expand()))
+		if i%10 == 0 {
+			rec, err = sam.NewRecord(fmt.Sprintf("unmapped%06d", i), nil, nil, -1, -1, 0, 0, nil, seq, qual, nil)
+			assert.NoError(t, err)
+			rec.Flags = sam.Unmapped
+			unmapped = append(unmapped, rec)
+		}
+	}
+	for _, rec := range unmapped {
+		w.Write(rec)
+		expected = append(expected, rec.String())
+		expectedSeqs = append(expectedSeqs, string(rec.Seq.Expand()))
+	}
+	assert.NoError(t, w.Close())
+
+	index, err := pamutil.ReadShardIndex(vcontext.Background(), pamPath, gbam.UniversalRange)
+	assert.NoError(t, err)
+	expect.EQ(t, index.Version, "PAM2+refseq")
+	expect.EQ(t, len(index.ReferenceM5), 1)
+
+	readAll := func(opts pam.ReadOpts) ([]string, error) {
+		r := pam.NewReader(opts, pamPath)
+		var got []string
+		for r.Scan() {
+			got = append(got, r.Record().String())
+		}
+		return got, r.Close()
+	}
+	got, err := readAll(pam.ReadOpts{Reference: fa})
+	assert.NoError(t, err)
+	expect.EQ(t, got, expected)
+
+	// The seq field can't be decoded without the reference.
+	_, err = readAll(pam.ReadOpts{})
+	expect.Regexp(t, err, "ReadOpts.Reference must be set")
+	_, err = readAll(pam.ReadOpts{Reference: newFasta(strings.Repeat("A", len(refSeq)))})
+	expect.Regexp(t, err, "M5 of reference chr1")
+
+	// The reference is not needed if the seq field is dropped.
+	got, err = readAll(pam.ReadOpts{DropFields: []gbam.FieldType{gbam.FieldSeq, gbam.FieldQual}})
+	assert.NoError(t, err)
+	expect.EQ(t, len(got), len(expected))
+
+	// The cigar is used to decode the seq field even when it is dropped.
+	r := pam.NewReader(pam.ReadOpts{Reference: fa, DropFields: []gbam.FieldType{gbam.FieldCigar}}, pamPath)
+	n := 0
+	for r.Scan() {
+		rec := r.Record()
+		expect.EQ(t, len(rec.Cigar), 0)
+		expect.EQ(t, string(rec.Seq.Expand()), expectedSeqs[n])
+		n++
+	}
+	assert.NoError(t, r.Close())
+	expect.EQ(t, n, len(expected))
+
+	// The reference is ignored when the cigar is dropped by the writer.
+	pamPath = filepath.Join(tempDir, "nocigar.pam")
+	w = pam.NewWriter(pam.WriteOpts{Reference: fa, DropFields: []gbam.FieldType{gbam.FieldCigar}}, header, pamPath)
+	for i := 0; i < 100; i++ {
+		seq := []byte(refSeq[i : i+20])
+		qual := []byte(strings.Repeat("I", len(seq)))
+		cigar := sam.Cigar{sam.NewCigarOp(sam.CigarMatch, 20)}
+		rec, err := sam.NewRecord(fmt.Sprintf("seq%06d", i), ref, nil, i, -1, 0, 60, cigar, seq, qual, nil)
+		assert.NoError(t, err)
+		w.Write(rec)
+	}
+	assert.NoError(t, w.Close())
+	index, err = pamutil.ReadShardIndex(vcontext.Background(), pamPath, gbam.UniversalRange)
+	assert.NoError(t, err)
+	expect.EQ(t, index.Version, "PAM2")
+	r = pam.NewReader(pam.ReadOpts{DropFields: []gbam.FieldType{gbam.FieldCigar}}, pamPath)
+	n = 0
+	for r.Scan() {
+		rec := r.Record()
+		expect.EQ(t, len(rec.Cigar), 0)
+		expect.EQ(t, string(rec.Seq.Expand()), refSeq[n:n+20])
+		n++
+	}
+	assert.NoError(t, r.Close())
+	expect.EQ(t, n, 100)
+}
+
+func TestQualBinning(t *testing.T) {
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+
+	ref, err := sam.NewReference("chr1", "", "", 1000, nil, nil)
+	assert.NoError(t, err)
+	header, err := sam.NewHeader(nil, []*sam.Reference{ref})
+	assert.NoError(t, err)
+	table, err := gbam.NewQualBinTable(gbam.Illumina8Bins)
+	assert.NoError(t, err)
+
+	pamPath := filepath.Join(tempDir, "test.pam")
+	w := pam.NewWriter(pam.WriteOpts{QualBinning: &gbam.QualBinning{Table: table, DropBelowMapq: 10}}, header, pamPath)
+	cigar := sam.Cigar{sam.NewCigarOp(sam.CigarMatch, 4)}
+	for i, mapq := range []byte{60, 5} {
+		rec, err := sam.NewRecord(fmt.Sprintf("seq%d", i), ref, nil, i, -1, 0, mapq, cigar,
+			[]byte("ACGT"), []byte{2, 12, 22, 41}, nil)
+		assert.NoError(t, err)
+		w.Write(rec)
+	}
+	assert.NoError(t, w.Close())
+
+	r := pam.NewReader(pam.ReadOpts{}, pamPath)
+	var quals [][]byte
+	for r.Scan() {
+		quals = append(quals, append([]byte{}, r.Record().Qual...))
+	}
+	assert.NoError(t, r.Close())
+	expect.EQ(t, quals, [][]byte{{6, 15, 22, 40}, {0xff, 0xff, 0xff, 0xff}})
+}
+
+// mergeTestRecord describes a record written by writeMergeTestPAM.
+type mergeTestRecord struct {
+	ref  *sam.Reference // nil for unmapped
+	pos  int
+	name string
+}
+
+// writeMergeTestPAM writes the records to a PAM file, one shard for each of the
+// ranges.
+func writeMergeTestPAM(t *testing.T, pamPath string, header *sam.Header, ranges []biopb.CoordRange, recs []mergeTestRecord) {
+	seq := []byte("ACGTACGTAC")
+	qual := []byte("IIIIIIIIII")
+	cigar := sam.Cigar{sam.NewCigarOp(sam.CigarMatch, len(seq))}
+	for _, rng := range ranges {
+		w := pam.NewWriter(pam.WriteOpts{MaxBufSize: 1024, Range: rng}, header, pamPath)
+		for _, r := range recs {
+			pos := r.pos
+			if r.ref == nil {
+				pos = -1
+			}
+			rec, err := sam.NewRecord(r.name, r.ref, nil, pos, -1, 0, 60, cigar, seq, qual, nil)
+			assert.NoError(t, err)
+			if rng.Contains(gbam.CoordFromSAMRecord(rec, 0)) {
+				w.Write(rec)
+			}
+		}
+		assert.NoError(t, w.Close())
+	}
+}
+
+func readMergeTestPAM(t *testing.T, pamPath string) []string {
+	r := pam.NewReader(pam.ReadOpts{}, pamPath)
+	var got []string
+	for r.Scan() {
+		rec := r.Record()
+		got = append(got, fmt.Sprintf("%s:%d:%s", rec.Ref.Name(), rec.Pos, rec.Name))
+	}
+	assert.NoError(t, r.Close())
+	return got
+}
+
+func TestMerge(t *testing.T) {
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	ctx := vcontext.Background()
+
+	newHeader := func(rg string, names ...string) *sam.Header {
+		var refs []*sam.Reference
+		for _, name := range names {
+			ref, err := sam.NewReference(name, "", "", 1000000, nil, nil)
+			assert.NoError(t, err)
+			refs = append(refs, ref)
+		}
+		header, err := sam.NewHeader(nil, refs)
+		assert.NoError(t, err)
+		readGroup, err := sam.NewReadGroup(rg, "", "", "", "", "", "", "", "", "", time.Time{}, 0)
+		assert.NoError(t, err)
+		assert.NoError(t, header.AddReadGroup(readGroup))
+		return header
+	}
+	headerA := newHeader("a", "chr1")
+	headerB := newHeader("b", "chr1")
+	headerC := newHeader("c", "chr1", "chr2")
+	chr1, chr2 := headerC.Refs()[0], headerC.Refs()[1]
+
+	var recsA, recsB, recsC []mergeTestRecord
+	for i := 0; i < 1000; i++ {
+		recsA = append(recsA, mergeTestRecord{headerA.Refs()[0], 2 * i, fmt.Sprintf("a%d", i)})
+		recsB = append(recsB, mergeTestRecord{headerB.Refs()[0], 5000 + i, fmt.Sprintf("b%d", i)})
+		recsC = append(recsC, mergeTestRecord{chr1, 2*i + 1, fmt.Sprintf("c%d", i)})
+	}
+	for i := 0; i < 100; i++ {
+		recsC = append(recsC, mergeTestRecord{chr2, i, fmt.Sprintf("c2_%d", i)})
+	}
+	recsC = append(recsC, mergeTestRecord{nil, 0, "cu"})
+
+	pathA := filepath.Join(tempDir, "a.pam")
+	pathB := filepath.Join(tempDir, "b.pam")
+	pathC := filepath.Join(tempDir, "c.pam")
+	writeMergeTestPAM(t, pathA, headerA, []biopb.CoordRange{gbam.UniversalRange}, recsA)
+	writeMergeTestPAM(t, pathB, headerB, []biopb.CoordRange{gbam.UniversalRange}, recsB)
+	writeMergeTestPAM(t, pathC, headerC, []biopb.CoordRange{
+		{Start: biopb.Coord{RefId: 0, Pos: 0}, Limit: biopb.Coord{RefId: 0, Pos: 1000}},
+		{Start: biopb.Coord{RefId: 0, Pos: 1000}, Limit: gbam.UniversalRange.Limit},
+	}, recsC)
+
+	// The records of A and B don't overlap, so the shards are copied.
+	pathAB := filepath.Join(tempDir, "ab.pam")
+	assert.NoError(t, pam.Merge(pam.MergeOpts{}, pathAB, []string{pathB, pathA}))
+	indexes, err := pamutil.ListIndexes(ctx, pathAB)
+	assert.NoError(t, err)
+	assert.EQ(t, len(indexes), 2)
+	expect.EQ(t, indexes[0].Range, biopb.CoordRange{Start: gbam.UniversalRange.Start, Limit: biopb.Coord{RefId: 0, Pos: 5000}})
+	expect.EQ(t, indexes[1].Range, biopb.CoordRange{Start: biopb.Coord{RefId: 0, Pos: 5000}, Limit: gbam.UniversalRange.Limit})
+	var expected []string
+	for _, r := range append(recsA, recsB...) {
+		expected = append(expected, fmt.Sprintf("%s:%d:%s", r.ref.Name(), r.pos, r.name))
+	}
+	expect.EQ(t, readMergeTestPAM(t, pathAB), expected)
+
+	// The records of A and C overlap, and the references of C are added to
+	// the merged header.
+	pathAC := filepath.Join(tempDir, "ac.pam")
+	assert.NoError(t, pam.Merge(pam.MergeOpts{}, pathAC, []string{pathA, pathC}))
+	expected = nil
+	for i := 0; i < 1000; i++ {
+		expected = append(expected, fmt.Sprintf("chr1:%d:a%d", 2*i, i), fmt.Sprintf("chr1:%d:c%d", 2*i+1, i))
+	}
+	for i := 0; i < 100; i++ {
+		expected = append(expected, fmt.Sprintf("chr2:%d:c2_%d", i, i))
+	}
+	expected = append(expected, "*:-1:cu")
+	expect.EQ(t, readMergeTestPAM(t, pathAC), expected)
+	indexes, err = pamutil.ListIndexes(ctx, pathAC)
+	assert.NoError(t, err)
+	expect.EQ(t, len(indexes), 2)
+	index, err := pamutil.ReadShardIndex(ctx, pathAC, indexes[0].Range)
+	assert.NoError(t, err)
+	header, err := gbam.UnmarshalHeader(index.EncodedBamHeader)
+	assert.NoError(t, err)
+	expect.EQ(t, len(header.Refs()), 2)
+	expect.EQ(t, len(header.RGs()), 2)
+
+	// References that appear in different orders cannot be merged.
+	pathD := filepath.Join(tempDir, "d.pam")
+	writeMergeTestPAM(t, pathD, newHeader("d", "chr2", "chr1"), []biopb.CoordRange{gbam.UniversalRange}, nil)
+	expect.Regexp(t, pam.Merge(pam.MergeOpts{}, filepath.Join(tempDir, "cd.pam"), []string{pathC, pathD}), "out of order")
+}
+
+func TestMergeReadGroups(t *testing.T) {
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	ctx := vcontext.Background()
+
+	rgTag := sam.NewTag("RG")
+	// writePAM writes a PAM file with read groups "rg" (of the given sample) and
+	// "common", and a record in each read group.
+	writePAM := func(path, sample string, pos int) {
+		ref, err := sam.NewReference("chr1", "", "", 1000000, nil, nil)
+		assert.NoError(t, err)
+		header, err := sam.NewHeader(nil, []*sam.Reference{ref})
+		assert.NoError(t, err)
+		for _, name := range []string{"rg", "common"} {
+			sm := sample
+			if name == "common" {
+				sm = "common"
+			}
+			rg, err := sam.NewReadGroup(name, "", "", "", "", "", "", sm, "", "", time.Time{}, 0)
+			assert.NoError(t, err)
+			assert.NoError(t, header.AddReadGroup(rg))
+		}
+		w := pam.NewWriter(pam.WriteOpts{}, header, path)
+		for i, name := range []string{"rg", "common"} {
+			aux, err := sam.NewAux(rgTag, name)
+			assert.NoError(t, err)
+			rec, err := sam.NewRecord(fmt.Sprintf("%s%d", sample, i), header.Refs()[0], nil, pos+i, -1, 0, 60,
+				sam.Cigar{sam.NewCigarOp(sam.CigarMatch, 4)}, []byte("ACGT"), []byte("IIII"), []sam.Aux{aux})
+			assert.NoError(t, err)
+			w.Write(rec)
+		}
+		assert.NoError(t, w.Close())
+	}
+	pathA := filepath.Join(tempDir, "a.pam")
+	pathB := filepath.Join(tempDir, "b.pam")
+	writePAM(pathA, "a", 0)
+	writePAM(pathB, "b", 100)
+
+	// The records don't overlap, but the shards are not copied since read group
+	// "rg" of B must be renamed.
+	pathAB := filepath.Join(tempDir, "ab.pam")
+	assert.NoError(t, pam.Merge(pam.MergeOpts{}, pathAB, []string{pathA, pathB}))
+	indexes, err := pamutil.ListIndexes(ctx, pathAB)
+	assert.NoError(t, err)
+	index, err := pamutil.ReadShardIndex(ctx, pathAB, indexes[0].Range)
+	assert.NoError(t, err)
+	header, err := gbam.UnmarshalHeader(index.EncodedBamHeader)
+	assert.NoError(t, err)
+	samples := map[string]string{}
+	for _, rg := range header.RGs() {
+		samples[rg.Name()] = rg.Get(sam.NewTag("SM"))
+	}
+	expect.EQ(t, samples, map[string]string{"rg": "a", "common": "common", "rg.1": "b"})
+
+	r := pam.NewReader(pam.ReadOpts{}, pathAB)
+	var got []string
+	for r.Scan() {
+		rec := r.Record()
+		got = append(got, fmt.Sprintf("%s:%v", rec.Name, rec.AuxFields.Get(rgTag).Value()))
+	}
+	assert.NoError(t, r.Close())
+	expect.EQ(t, got, []string{"a0:rg", "a1:common", "b0:rg.1", "b1:common"})
+}
+
+func TestReshard(t *testing.T) {
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+	ctx := vcontext.Background()
+
+	srcPath := filepath.Join(tempDir, "src.pam")
+	recs := generateMapqRunsPAM(t, srcPath, 10000)
+	var expected []string
+	for _, rec := range recs {
+		expected = append(expected, rec.String())
+	}
+
+	for _, test := range []struct {
+		opts    pam.ReshardOpts
+		nShards int
+	}{
+		{pam.ReshardOpts{}, 1},
+		{pam.ReshardOpts{RecordsPerShard: 1000}, 10},
+		{pam.ReshardOpts{RecordsPerShard: 1000, WriteOpts: pam.WriteOpts{Transformers: []string{"zstd 1"}}}, 10},
+		{pam.ReshardOpts{RecordsPerShard: 4000, BytesPerShard: 1 << 40}, 3},
+	} {
+		dstPath := filepath.Join(tempDir, "dst.pam")
+		assert.NoError(t, pam.Reshard(test.opts, dstPath, srcPath))
+		indexes, err := pamutil.ListIndexes(ctx, dstPath)
+		assert.NoError(t, err)
+		// The block boundaries don't fall exactly at RecordsPerShard, so the
+		// last shard may be tiny.
+		expect.True(t, len(indexes) == test.nShards || len(indexes) == test.nShards+1,
+			"opts %+v: %d shards", test.opts, len(indexes))
+		expect.EQ(t, indexes[0].Range.Start, gbam.UniversalRange.Start)
+		expect.EQ(t, indexes[len(indexes)-1].Range.Limit, gbam.UniversalRange.Limit)
+		for i := 1; i < len(indexes); i++ {
+			expect.EQ(t, indexes[i].Range.Start, indexes[i-1].Range.Limit)
+		}
+
+		r := pam.NewReader(pam.ReadOpts{}, dstPath)
+		var got []string
+		for r.Scan() {
+			got = append(got, r.Record().String())
+		}
+		assert.NoError(t, r.Close())
+		expect.EQ(t, got, expected, "opts %+v", test.opts)
+	}
+	expect.Regexp(t, pam.Reshard(pam.ReshardOpts{}, srcPath, srcPath), "output is also the input")
+}
+
+func TestMetadata(t *testing.T) {
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+
+	readMetadata := func(path string, dropFields ...gbam.FieldType) map[string]string {
+		r := pam.NewReader(pam.ReadOpts{DropFields: dropFields}, path)
+		md := r.Metadata()
+		assert.NoError(t, r.Close())
+		return md
+	}
+	ref, err := sam.NewReference("chr1", "", "", 1000000, nil, nil)
+	assert.NoError(t, err)
+	header, err := sam.NewHeader(nil, []*sam.Reference{ref})
+	assert.NoError(t, err)
+	srcPath := filepath.Join(tempDir, "src.pam")
+	w := pam.NewWriter(pam.WriteOpts{
+		MaxBufSize:      1024,
+		PromotedAuxTags: []sam.Tag{{'R', 'G'}},
+		Metadata:        map[string]string{pam.MetadataSource: "src.bam", "sample": "s1"},
+	}, header, srcPath)
+	rec, err := sam.NewRecord("r0", ref, nil, 10, -1, 0, 60,
+		sam.Cigar{sam.NewCigarOp(sam.CigarMatch, 4)}, []byte("ACGT"), []byte("IIII"), nil)
+	assert.NoError(t, err)
+	w.Write(rec)
+	assert.NoError(t, w.Close())
+	expect.EQ(t, readMetadata(srcPath), map[string]string{
+		pam.MetadataSource:    "src.bam",
+		"sample":              "s1",
+		pam.MetadataWriteOpts: "max_buf_size=1024 transformers=zstd promoted_aux_tags=RG",
+	})
+
+	// Reshard records the new options, and the given metadata.
+	dstPath := filepath.Join(tempDir, "dst.pam")
+	assert.NoError(t, pam.Reshard(pam.ReshardOpts{WriteOpts: pam.WriteOpts{
+		DropFields: []gbam.FieldType{gbam.FieldQual},
+		Metadata:   map[string]string{pam.MetadataSource: srcPath},
+	}}, dstPath, srcPath))
+	expect.EQ(t, readMetadata(dstPath, gbam.FieldQual), map[string]string{
+		pam.MetadataSource:    srcPath,
+		pam.MetadataWriteOpts: "max_buf_size=8388608 transformers=zstd drop_fields=qual",
+	})
+
+	// Merge copies the shard of the only source, and adds the given metadata
+	// to that of the source.
+	mergedPath := filepath.Join(tempDir, "merged.pam")
+	assert.NoError(t, pam.Merge(pam.MergeOpts{WriteOpts: pam.WriteOpts{
+		Metadata: map[string]string{pam.MetadataCreator: "test"},
+	}}, mergedPath, []string{srcPath}))
+	expect.EQ(t, readMetadata(mergedPath), map[string]string{
+		pam.MetadataCreator:   "test",
+		pam.MetadataSource:    "src.bam",
+		"sample":              "s1",
+		pam.MetadataWriteOpts: "max_buf_size=1024 transformers=zstd promoted_aux_tags=RG",
+	})
+}
+
+func TestUnsorted(t *testing.T) {
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+
+	chr0, err := sam.NewReference("chr0", "", "", 1000000, nil, nil)
+	assert.NoError(t, err)
+	chr1, err := sam.NewReference("chr1", "", "", 1000000, nil, nil)
+	assert.NoError(t, err)
+	header, err := sam.NewHeader(nil, []*sam.Reference{chr0, chr1})
+	assert.NoError(t, err)
+	refs := []*sam.Reference{chr1, chr0, nil}
+
+	// Write records in an order unrelated to their coordinates, including
+	// unmapped records.
+	pamPath := filepath.Join(tempDir, "unsorted.pam")
+	w := pam.NewWriter(pam.WriteOpts{
+		MaxBufSize:      1024,
+		PromotedAuxTags: []sam.Tag{{'R', 'G'}},
+		Unsorted:        true,
+	}, header, pamPath)
+	const nRecords = 1000
+	for i := 0; i < nRecords; i++ {
+		ref := refs[i%len(refs)]
+		pos := (i * 7919) % 10000
+		if ref == nil {
+			pos = -1
+		}
+		rec, err := sam.NewRecord(fmt.Sprintf("r%d", i), ref, nil, pos, -1, 0, 60,
+			sam.Cigar{sam.NewCigarOp(sam.CigarMatch, 4)}, []byte("ACGT"), []byte("IIII"),
+			[]sam.Aux{newAux(t, "RG", fmt.Sprintf("rg%d", i%3))})
+		assert.NoError(t, err)
+		w.Write(rec)
+	}
+	assert.NoError(t, w.Close())
+
+	// The records are read in the order they were written.
+	r := pam.NewReader(pam.ReadOpts{}, pamPath)
+	n := 0
+	for r.Scan() {
+		rec := r.Record()
+		ref := refs[n%len(refs)]
+		pos := (n * 7919) % 10000
+		if ref == nil {
+			pos = -1
+		}
+		expect.EQ(t, rec.Name, fmt.Sprintf("r%d", n))
+		expect.EQ(t, rec.Ref.Name(), ref.Name())
+		expect.EQ(t, rec.Pos, pos)
+		expect.EQ(t, rec.AuxFields.Get(sam.NewTag("RG")).Value(), fmt.Sprintf("rg%d", n%3))
+		n++
+	}
+	assert.NoError(t, r.Close())
+	expect.EQ(t, n, nRecords)
+
+	// Reading a coordinate range is not supported.
+	r = pam.NewReader(pam.ReadOpts{Range: gbam.MappedRange}, pamPath)
+	expect.False(t, r.Scan())
+	expect.HasSubstr(t, r.Close().Error(), "not sorted by coordinate")
+
+	// Nor is resharding.
+	err = pam.Reshard(pam.ReshardOpts{}, filepath.Join(tempDir, "resharded.pam"), pamPath)
+	expect.HasSubstr(t, err.Error(), "not sorted by coordinate")
+
+	// An unsorted file has a single shard.
+	w = pam.NewWriter(pam.WriteOpts{Unsorted: true, Range: gbam.MappedRange}, header, filepath.Join(tempDir, "bad.pam"))
+	expect.HasSubstr(t, w.Err().Error(), "Range")
+}
+
+func newAux(t *testing.T, name string, value interface{}) sam.Aux {
+	aux, err := sam.NewAux(sam.NewTag(name), value)
+	assert.NoError(t, err)
+	return aux
+}
+
 func mustCreate(t *testing.T, path string) {
 	fd, err := os.Create(path)
 	assert.NoError(t, err)
@@ -0,0 +1,99 @@
+package pamarrow
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/Schaudge/grailbase/errors"
+	"github.com/Schaudge/grailbase/vcontext"
+	"github.com/Schaudge/grailbio/biopb"
+	gbam "github.com/Schaudge/grailbio/encoding/bam"
+	"github.com/Schaudge/grailbio/encoding/fasta"
+	"github.com/Schaudge/grailbio/encoding/pam"
+	"github.com/Schaudge/grailbio/encoding/pam/pamutil"
+	"github.com/Schaudge/hts/sam"
+)
+
+// ExportOpts defines options for Export.
+type ExportOpts struct {
+	WriteOpts
+
+	// Range limits the records exported. If empty, all the records are
+	// exported. See pam.ReadOpts.Range.
+	Range biopb.CoordRange
+
+	// Reference is needed if the seq field of the PAM file is stored as
+	// differences from a reference. See pam.ReadOpts.Reference.
+	Reference fasta.Fasta
+}
+
+// Export writes the records of the PAM file at pamPath to out, as an Arrow IPC
+// stream. The aux tags promoted to their own columns in the PAM file
+// (pam.WriteOpts.PromotedAuxTags) are added to opts.AuxTags, and the metadata
+// of the PAM file is added to opts.Metadata.
+func Export(opts ExportOpts, out io.Writer, pamPath string) error {
+	ctx := vcontext.Background()
+	indexes, err := pamutil.ListIndexes(ctx, pamPath)
+	if err != nil {
+		return err
+	}
+	if len(indexes) == 0 {
+		return fmt.Errorf("export %s: no PAM shard found", pamPath)
+	}
+	var header *sam.Header
+	for _, shard := range indexes {
+		index, err := pamutil.ReadShardIndex(ctx, pamPath, shard.Range)
+		if err != nil {
+			return err
+		}
+		if header == nil {
+			if header, err = gbam.UnmarshalHeader(index.EncodedBamHeader); err != nil {
+				return fmt.Errorf("export %s: %v", shard.Path, err)
+			}
+		}
+		features, err := pamutil.ParseShardVersion(index.Version)
+		if err != nil {
+			return fmt.Errorf("export %s: %v", shard.Path, err)
+		}
+		opts.AuxTags = addTags(opts.AuxTags, features.AuxTags)
+	}
+
+	r := pam.NewReader(pam.ReadOpts{
+		DropFields: opts.DropFields,
+		Range:      opts.Range,
+		Reference:  opts.Reference,
+	}, pamPath)
+	metadata := map[string]string{}
+	for k, v := range r.Metadata() {
+		metadata[k] = v
+	}
+	for k, v := range opts.Metadata {
+		metadata[k] = v
+	}
+	opts.Metadata = metadata
+	w := NewWriter(out, header, opts.WriteOpts)
+	for r.Scan() && w.Err() == nil {
+		w.Write(r.Record())
+	}
+	e := errors.Once{}
+	e.Set(r.Close())
+	e.Set(w.Close())
+	return e.Err()
+}
+
+// addTags appends to tags those of newTags that are not in tags.
+func addTags(tags, newTags []sam.Tag) []sam.Tag {
+	for _, tag := range newTags {
+		found := false
+		for _, t := range tags {
+			if t == tag {
+				found = true
+				break
+			}
+		}
+		if !found {
+			tags = append(tags, tag)
+		}
+	}
+	return tags
+}
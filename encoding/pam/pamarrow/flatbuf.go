@@ -0,0 +1,278 @@
+package pamarrow
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// This file implements the subset of the flatbuffers encoding needed for the
+// metadata of Arrow IPC messages. See
+// https://google.github.io/flatbuffers/flatbuffers_internals.html.
+//
+// The builder lays out objects front to back: a table is followed by the
+// objects it references, so that every uoffset is positive. Each object is
+// aligned relative to the start of the buffer.
+
+// fbObject is an object that can be referenced by a table field or a vector.
+type fbObject interface {
+	// write appends the object to b, and returns its position.
+	write(b *fbBuilder) int
+}
+
+// fbField is one field of a table. A zero fbField is absent.
+type fbField struct {
+	size int      // 1, 2, 4 or 8 for scalars, 4 for references.
+	val  uint64   // value of a scalar.
+	ref  fbObject // referenced object.
+}
+
+func fbBool(v bool) fbField {
+	if v {
+		return fbField{size: 1, val: 1}
+	}
+	return fbField{size: 1}
+}
+
+func fbUint8(v uint8) fbField  { return fbField{size: 1, val: uint64(v)} }
+func fbInt16(v int16) fbField  { return fbField{size: 2, val: uint64(uint16(v))} }
+func fbInt32(v int32) fbField  { return fbField{size: 4, val: uint64(uint32(v))} }
+func fbInt64(v int64) fbField  { return fbField{size: 8, val: uint64(v)} }
+func fbRef(v fbObject) fbField { return fbField{size: 4, ref: v} }
+
+// fbTable is a table. The index of a field is its ID in the schema.
+type fbTable []fbField
+
+// fbString is a string.
+type fbString string
+
+// fbTables is a vector of tables.
+type fbTables []fbTable
+
+// fbInt64Structs is a vector of structs whose members are all int64s.
+type fbInt64Structs struct {
+	nMembers int     // number of int64s in each struct.
+	vals     []int64 // members of the structs, concatenated.
+}
+
+type fbBuilder struct {
+	buf []byte
+}
+
+func (b *fbBuilder) pad(align int) {
+	for len(b.buf)%align != 0 {
+		b.buf = append(b.buf, 0)
+	}
+}
+
+func (b *fbBuilder) putUint32(pos int, v uint32) {
+	binary.LittleEndian.PutUint32(b.buf[pos:], v)
+}
+
+// putRef stores at pos the uoffset of the object at target.
+func (b *fbBuilder) putRef(pos, target int) {
+	b.putUint32(pos, uint32(target-pos))
+}
+
+func (t fbTable) write(b *fbBuilder) int {
+	// The table starts with the soffset to its vtable, followed by the fields
+	// in the order of their IDs, each aligned by its size.
+	offsets := make([]int, len(t))
+	size := 4
+	for i, f := range t {
+		if f.size == 0 {
+			continue
+		}
+		size = (size + f.size - 1) / f.size * f.size
+		offsets[i] = size
+		size += f.size
+	}
+	b.pad(2)
+	vtable := len(b.buf)
+	for _, v := range append([]int{4 + 2*len(t), size}, offsets...) {
+		b.buf = append(b.buf, byte(v), byte(v>>8))
+	}
+	b.pad(8)
+	pos := len(b.buf)
+	b.buf = append(b.buf, make([]byte, size)...)
+	b.putUint32(pos, uint32(pos-vtable))
+	for i, f := range t {
+		if f.size == 0 || f.ref != nil {
+			continue
+		}
+		for j := 0; j < f.size; j++ {
+			b.buf[pos+offsets[i]+j] = byte(f.val >> (8 * uint(j)))
+		}
+	}
+	for i, f := range t {
+		if f.ref != nil {
+			b.putRef(pos+offsets[i], f.ref.write(b))
+		}
+	}
+	return pos
+}
+
+func (s fbString) write(b *fbBuilder) int {
+	b.pad(4)
+	pos := len(b.buf)
+	b.buf = append(b.buf, 0, 0, 0, 0)
+	b.putUint32(pos, uint32(len(s)))
+	b.buf = append(b.buf, s...)
+	b.buf = append(b.buf, 0)
+	return pos
+}
+
+func (v fbTables) write(b *fbBuilder) int {
+	b.pad(4)
+	pos := len(b.buf)
+	b.buf = append(b.buf, make([]byte, 4+4*len(v))...)
+	b.putUint32(pos, uint32(len(v)))
+	for i, t := range v {
+		b.putRef(pos+4+4*i, t.write(b))
+	}
+	return pos
+}
+
+func (v fbInt64Structs) write(b *fbBuilder) int {
+	// The structs must be 8-byte aligned, and they follow the 4-byte length.
+	for len(b.buf)%8 != 4 {
+		b.buf = append(b.buf, 0)
+	}
+	pos := len(b.buf)
+	b.buf = append(b.buf, make([]byte, 4+8*len(v.vals))...)
+	b.putUint32(pos, uint32(len(v.vals)/v.nMembers))
+	for i, val := range v.vals {
+		binary.LittleEndian.PutUint64(b.buf[pos+4+8*i:], uint64(val))
+	}
+	return pos
+}
+
+// fbFinish serializes the flatbuffer whose root is the given table.
+func fbFinish(root fbTable) []byte {
+	b := &fbBuilder{buf: make([]byte, 4)}
+	b.putRef(0, root.write(b))
+	return b.buf
+}
+
+// fbView reads a table of a serialized flatbuffer. Out-of-range offsets cause
+// a panic of type fbError.
+type fbView struct {
+	buf []byte
+	pos int
+}
+
+// fbError is the panic value of fbView when the buffer is malformed.
+type fbError struct{ err error }
+
+func (v fbView) check(pos, n int) {
+	if pos < 0 || n < 0 || pos+n > len(v.buf) {
+		panic(fbError{fmt.Errorf("flatbuffer offset %d+%d out of range [0,%d)", pos, n, len(v.buf))})
+	}
+}
+
+func (v fbView) uint32At(pos int) uint32 {
+	v.check(pos, 4)
+	return binary.LittleEndian.Uint32(v.buf[pos:])
+}
+
+// fbRoot returns the root table of the flatbuffer.
+func fbRoot(buf []byte) fbView {
+	v := fbView{buf: buf}
+	v.pos = int(v.uint32At(0))
+	return v
+}
+
+// field returns the position of the field with the given ID, or -1 if the
+// field is absent.
+func (v fbView) field(id int) int {
+	vtable := v.pos - int(int32(v.uint32At(v.pos)))
+	v.check(vtable, 4)
+	vtableSize := int(binary.LittleEndian.Uint16(v.buf[vtable:]))
+	if 4+2*id+2 > vtableSize {
+		return -1
+	}
+	v.check(vtable+4+2*id, 2)
+	off := int(binary.LittleEndian.Uint16(v.buf[vtable+4+2*id:]))
+	if off == 0 {
+		return -1
+	}
+	return v.pos + off
+}
+
+func (v fbView) scalar(id, size int, def uint64) uint64 {
+	pos := v.field(id)
+	if pos < 0 {
+		return def
+	}
+	v.check(pos, size)
+	var val uint64
+	for j := 0; j < size; j++ {
+		val |= uint64(v.buf[pos+j]) << (8 * uint(j))
+	}
+	return val
+}
+
+func (v fbView) bool(id int) bool              { return v.scalar(id, 1, 0) != 0 }
+func (v fbView) uint8(id int) uint8            { return uint8(v.scalar(id, 1, 0)) }
+func (v fbView) int16(id int, def int16) int16 { return int16(v.scalar(id, 2, uint64(uint16(def)))) }
+func (v fbView) int32(id int) int32            { return int32(v.scalar(id, 4, 0)) }
+func (v fbView) int64(id int) int64            { return int64(v.scalar(id, 8, 0)) }
+
+// deref returns the position of the object referenced by the uoffset at pos.
+func (v fbView) deref(pos int) int {
+	return pos + int(v.uint32At(pos))
+}
+
+// table returns the table referenced by the given field.
+func (v fbView) table(id int) (fbView, bool) {
+	pos := v.field(id)
+	if pos < 0 {
+		return fbView{}, false
+	}
+	return fbView{buf: v.buf, pos: v.deref(pos)}, true
+}
+
+// string returns the string referenced by the given field.
+func (v fbView) string(id int) string {
+	pos := v.field(id)
+	if pos < 0 {
+		return ""
+	}
+	pos = v.deref(pos)
+	n := int(v.uint32At(pos))
+	v.check(pos+4, n)
+	return string(v.buf[pos+4 : pos+4+n])
+}
+
+// vector returns the position of the first element, and the length, of the
+// vector referenced by the given field.
+func (v fbView) vector(id int) (start, n int) {
+	pos := v.field(id)
+	if pos < 0 {
+		return 0, 0
+	}
+	pos = v.deref(pos)
+	return pos + 4, int(v.uint32At(pos))
+}
+
+// tables returns the tables of the vector referenced by the given field.
+func (v fbView) tables(id int) []fbView {
+	start, n := v.vector(id)
+	v.check(start, 4*n)
+	tables := make([]fbView, n)
+	for i := range tables {
+		tables[i] = fbView{buf: v.buf, pos: v.deref(start + 4*i)}
+	}
+	return tables
+}
+
+// int64Structs returns the members of the structs of the vector referenced by
+// the given field. Each struct has nMembers int64s.
+func (v fbView) int64Structs(id, nMembers int) []int64 {
+	start, n := v.vector(id)
+	v.check(start, 8*nMembers*n)
+	vals := make([]int64, nMembers*n)
+	for i := range vals {
+		vals[i] = int64(binary.LittleEndian.Uint64(v.buf[start+8*i:]))
+	}
+	return vals
+}
@@ -0,0 +1,558 @@
+package pamarrow
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"sort"
+)
+
+// This file implements the Arrow IPC streaming format, for the column types
+// used by this package. See
+// https://arrow.apache.org/docs/format/Columnar.html#serialization-and-interprocess-communication-ipc.
+
+// Values of the MessageHeader union (Message.fbs).
+const (
+	messageSchema          = 1
+	messageDictionaryBatch = 2
+	messageRecordBatch     = 3
+)
+
+// metadataVersionV5 is the value of Message.version written. Readers accept
+// V4 or later.
+const (
+	metadataVersionV4 = 3
+	metadataVersionV5 = 4
+)
+
+// continuationMarker precedes the metadata length of each message.
+const continuationMarker = 0xffffffff
+
+// Values of the Type union (Schema.fbs).
+const (
+	arrowInt    = 2
+	arrowFloat  = 3
+	arrowBinary = 4
+	arrowUtf8   = 5
+)
+
+// arrowType is the type of a column.
+type arrowType struct {
+	id       uint8
+	bitWidth int  // for arrowInt and arrowFloat.
+	signed   bool // for arrowInt.
+}
+
+var (
+	uint8Type   = arrowType{id: arrowInt, bitWidth: 8}
+	uint16Type  = arrowType{id: arrowInt, bitWidth: 16}
+	int32Type   = arrowType{id: arrowInt, bitWidth: 32, signed: true}
+	int64Type   = arrowType{id: arrowInt, bitWidth: 64, signed: true}
+	float32Type = arrowType{id: arrowFloat, bitWidth: 32}
+	binaryType  = arrowType{id: arrowBinary}
+	utf8Type    = arrowType{id: arrowUtf8}
+)
+
+func (t arrowType) String() string {
+	switch t.id {
+	case arrowInt:
+		if t.signed {
+			return fmt.Sprintf("int%d", t.bitWidth)
+		}
+		return fmt.Sprintf("uint%d", t.bitWidth)
+	case arrowFloat:
+		return fmt.Sprintf("float%d", t.bitWidth)
+	case arrowBinary:
+		return "binary"
+	case arrowUtf8:
+		return "utf8"
+	}
+	return fmt.Sprintf("type%d", t.id)
+}
+
+// variableWidth checks if the values of the type are stored with an offsets
+// buffer.
+func (t arrowType) variableWidth() bool {
+	return t.id == arrowBinary || t.id == arrowUtf8
+}
+
+// Values of FloatingPoint.precision.
+var floatPrecisions = map[int]int16{16: 0, 32: 1, 64: 2}
+
+func (t arrowType) table() fbTable {
+	switch t.id {
+	case arrowInt:
+		return fbTable{fbInt32(int32(t.bitWidth)), fbBool(t.signed)}
+	case arrowFloat:
+		return fbTable{fbInt16(floatPrecisions[t.bitWidth])}
+	}
+	return fbTable{}
+}
+
+// arrowField describes one column of a schema.
+type arrowField struct {
+	name     string
+	typ      arrowType
+	nullable bool
+	metadata map[string]string
+}
+
+// keyValues encodes a custom_metadata vector, sorted by key.
+func keyValues(md map[string]string) fbTables {
+	keys := make([]string, 0, len(md))
+	for k := range md {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	kvs := make(fbTables, len(keys))
+	for i, k := range keys {
+		kvs[i] = fbTable{fbRef(fbString(k)), fbRef(fbString(md[k]))}
+	}
+	return kvs
+}
+
+func decodeKeyValues(v fbView, id int) map[string]string {
+	md := map[string]string{}
+	for _, kv := range v.tables(id) {
+		md[kv.string(0)] = kv.string(1)
+	}
+	return md
+}
+
+// encodeMessage encodes a Message flatbuffer.
+func encodeMessage(headerType uint8, header fbTable, bodyLength int64) []byte {
+	return fbFinish(fbTable{
+		fbInt16(metadataVersionV5),
+		fbUint8(headerType),
+		fbRef(header),
+		fbInt64(bodyLength),
+	})
+}
+
+// encodeSchema encodes a Message whose header is a Schema.
+func encodeSchema(fields []arrowField, metadata map[string]string) []byte {
+	fieldTables := make(fbTables, len(fields))
+	for i, f := range fields {
+		t := fbTable{
+			0: fbRef(fbString(f.name)),
+			1: fbBool(f.nullable),
+			2: fbUint8(f.typ.id),
+			3: fbRef(f.typ.table()),
+			5: fbRef(fbTables{}), // children
+		}
+		if len(f.metadata) > 0 {
+			t = append(t, fbRef(keyValues(f.metadata)))
+		}
+		fieldTables[i] = t
+	}
+	schema := fbTable{
+		1: fbRef(fieldTables),
+	}
+	if len(metadata) > 0 {
+		schema = append(schema, fbRef(keyValues(metadata)))
+	}
+	return encodeMessage(messageSchema, schema, 0)
+}
+
+// decodeSchema decodes a Schema table.
+func decodeSchema(v fbView) (fields []arrowField, metadata map[string]string, err error) {
+	if endianness := v.int16(0, 0); endianness != 0 {
+		return nil, nil, fmt.Errorf("big-endian data is not supported")
+	}
+	for _, fv := range v.tables(1) {
+		f := arrowField{
+			name:     fv.string(0),
+			nullable: fv.bool(1),
+			metadata: decodeKeyValues(fv, 6),
+		}
+		if _, ok := fv.table(4); ok {
+			return nil, nil, fmt.Errorf("column %s: dictionary encoding is not supported", f.name)
+		}
+		f.typ.id = fv.uint8(2)
+		tv, ok := fv.table(3)
+		if !ok {
+			return nil, nil, fmt.Errorf("column %s: missing type", f.name)
+		}
+		switch f.typ.id {
+		case arrowInt:
+			f.typ.bitWidth = int(tv.int32(0))
+			f.typ.signed = tv.bool(1)
+			if w := f.typ.bitWidth; w != 8 && w != 16 && w != 32 && w != 64 {
+				return nil, nil, fmt.Errorf("column %s: invalid integer width %d", f.name, w)
+			}
+		case arrowFloat:
+			precision := tv.int16(0, 0)
+			for w, p := range floatPrecisions {
+				if p == precision {
+					f.typ.bitWidth = w
+				}
+			}
+			if w := f.typ.bitWidth; w != 32 && w != 64 {
+				return nil, nil, fmt.Errorf("column %s: unsupported floating-point precision %d", f.name, precision)
+			}
+		case arrowBinary, arrowUtf8:
+		default:
+			return nil, nil, fmt.Errorf("column %s: unsupported type %v", f.name, f.typ)
+		}
+		fields = append(fields, f)
+	}
+	return fields, decodeKeyValues(v, 2), nil
+}
+
+// columnBuilder accumulates the values of one column of a record batch.
+type columnBuilder struct {
+	arrowField
+	n       int
+	nNulls  int
+	valid   []byte // validity bitmap.
+	offsets []byte // int32 offsets, for variable-width types.
+	values  []byte
+}
+
+func newColumnBuilder(f arrowField) *columnBuilder {
+	c := &columnBuilder{arrowField: f}
+	c.reset()
+	return c
+}
+
+func (c *columnBuilder) reset() {
+	c.n, c.nNulls = 0, 0
+	c.valid = c.valid[:0]
+	c.values = c.values[:0]
+	c.offsets = c.offsets[:0]
+	if c.typ.variableWidth() {
+		c.offsets = append(c.offsets, 0, 0, 0, 0)
+	}
+}
+
+func (c *columnBuilder) appendValidity(valid bool) {
+	if c.n%8 == 0 {
+		c.valid = append(c.valid, 0)
+	}
+	if valid {
+		c.valid[c.n/8] |= 1 << uint(c.n%8)
+	} else {
+		c.nNulls++
+	}
+	c.n++
+}
+
+func (c *columnBuilder) appendOffset() {
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], uint32(len(c.values)))
+	c.offsets = append(c.offsets, buf[:]...)
+}
+
+// appendNull appends a null value.
+func (c *columnBuilder) appendNull() {
+	c.appendValidity(false)
+	if c.typ.variableWidth() {
+		c.appendOffset()
+	} else {
+		c.values = append(c.values, make([]byte, c.typ.bitWidth/8)...)
+	}
+}
+
+// appendInt appends a value to an integer column.
+func (c *columnBuilder) appendInt(v int64) {
+	c.appendValidity(true)
+	for i := 0; i < c.typ.bitWidth/8; i++ {
+		c.values = append(c.values, byte(v>>(8*uint(i))))
+	}
+}
+
+// appendFloat32 appends a value to a float32 column.
+func (c *columnBuilder) appendFloat32(v float32) {
+	c.appendValidity(true)
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], math.Float32bits(v))
+	c.values = append(c.values, buf[:]...)
+}
+
+// appendBytes appends a value to a binary or utf8 column.
+func (c *columnBuilder) appendBytes(v []byte) {
+	c.appendValidity(true)
+	c.values = append(c.values, v...)
+	c.appendOffset()
+}
+
+// buffers returns the buffers of the column, in the order of the Arrow
+// layout. The validity bitmap is omitted if there is no null.
+func (c *columnBuilder) buffers() [][]byte {
+	valid := c.valid
+	if c.nNulls == 0 {
+		valid = nil
+	}
+	if c.typ.variableWidth() {
+		return [][]byte{valid, c.offsets, c.values}
+	}
+	return [][]byte{valid, c.values}
+}
+
+// pad8 rounds n up to a multiple of 8.
+func pad8(n int) int {
+	return (n + 7) &^ 7
+}
+
+// encodeRecordBatch encodes a Message whose header is a RecordBatch of the
+// given columns. It returns the message and the buffers of its body.
+func encodeRecordBatch(columns []*columnBuilder, n int) ([]byte, [][]byte, error) {
+	var (
+		nodes   []int64
+		buffers []int64
+		body    [][]byte
+		offset  int
+	)
+	for _, c := range columns {
+		if len(c.values) > math.MaxInt32 {
+			return nil, nil, fmt.Errorf("column %s: %d bytes in a record batch, more than the int32 offsets can address", c.name, len(c.values))
+		}
+		nodes = append(nodes, int64(c.n), int64(c.nNulls))
+		for _, buf := range c.buffers() {
+			buffers = append(buffers, int64(offset), int64(len(buf)))
+			body = append(body, buf)
+			offset += pad8(len(buf))
+		}
+	}
+	batch := fbTable{
+		fbInt64(int64(n)),
+		fbRef(fbInt64Structs{nMembers: 2, vals: nodes}),
+		fbRef(fbInt64Structs{nMembers: 2, vals: buffers}),
+	}
+	return encodeMessage(messageRecordBatch, batch, int64(offset)), body, nil
+}
+
+// writeMessage writes an encapsulated message: the continuation marker, the
+// metadata length, the metadata padded to 8 bytes, and the body, each buffer
+// of which is padded to 8 bytes.
+func writeMessage(out io.Writer, meta []byte, body [][]byte) error {
+	var zeros [8]byte
+	var prefix [8]byte
+	metaLen := pad8(len(meta))
+	binary.LittleEndian.PutUint32(prefix[:], continuationMarker)
+	binary.LittleEndian.PutUint32(prefix[4:], uint32(metaLen))
+	if _, err := out.Write(prefix[:]); err != nil {
+		return err
+	}
+	if _, err := out.Write(meta); err != nil {
+		return err
+	}
+	if _, err := out.Write(zeros[:metaLen-len(meta)]); err != nil {
+		return err
+	}
+	for _, buf := range body {
+		if _, err := out.Write(buf); err != nil {
+			return err
+		}
+		if _, err := out.Write(zeros[:pad8(len(buf))-len(buf)]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// writeEndOfStream writes the end-of-stream marker.
+func writeEndOfStream(out io.Writer) error {
+	var buf [8]byte
+	binary.LittleEndian.PutUint32(buf[:], continuationMarker)
+	_, err := out.Write(buf[:])
+	return err
+}
+
+// message is a decoded encapsulated message.
+type message struct {
+	headerType uint8
+	header     fbView
+	body       []byte
+}
+
+// readMessage reads the next encapsulated message. It returns io.EOF at the
+// end of the stream.
+func readMessage(in io.Reader) (m message, err error) {
+	var buf [4]byte
+	if _, err = io.ReadFull(in, buf[:]); err != nil {
+		return
+	}
+	metaLen := binary.LittleEndian.Uint32(buf[:])
+	if metaLen == continuationMarker {
+		if _, err = io.ReadFull(in, buf[:]); err != nil {
+			return m, unexpectedEOF(err)
+		}
+		metaLen = binary.LittleEndian.Uint32(buf[:])
+	}
+	if metaLen == 0 {
+		return m, io.EOF
+	}
+	if metaLen > math.MaxInt32 {
+		return m, fmt.Errorf("invalid message metadata length %d", metaLen)
+	}
+	meta := make([]byte, metaLen)
+	if _, err = io.ReadFull(in, meta); err != nil {
+		return m, unexpectedEOF(err)
+	}
+	defer func() {
+		if e := recover(); e != nil {
+			fe, ok := e.(fbError)
+			if !ok {
+				panic(e)
+			}
+			err = fmt.Errorf("corrupt message: %v", fe.err)
+		}
+	}()
+	root := fbRoot(meta)
+	if version := root.int16(0, 0); version < metadataVersionV4 {
+		return m, fmt.Errorf("unsupported metadata version V%d", version+1)
+	}
+	m.headerType = root.uint8(1)
+	var ok bool
+	if m.header, ok = root.table(2); !ok {
+		return m, fmt.Errorf("message without a header")
+	}
+	bodyLen := root.int64(3)
+	if bodyLen < 0 || bodyLen > math.MaxInt32 {
+		return m, fmt.Errorf("invalid message body length %d", bodyLen)
+	}
+	m.body = make([]byte, bodyLen)
+	if _, err = io.ReadFull(in, m.body); err != nil {
+		return m, unexpectedEOF(err)
+	}
+	return m, nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// column is one column of a decoded record batch.
+type column struct {
+	typ     arrowType
+	n       int
+	nNulls  int
+	valid   []byte
+	offsets []byte
+	values  []byte
+}
+
+// decodeRecordBatch decodes the columns of a RecordBatch with the given
+// schema.
+func decodeRecordBatch(v fbView, body []byte, fields []arrowField) (n int, columns []column, err error) {
+	n = int(v.int64(0))
+	if _, ok := v.table(3); ok {
+		return 0, nil, fmt.Errorf("compressed record batches are not supported")
+	}
+	nodes := v.int64Structs(1, 2)
+	buffers := v.int64Structs(2, 2)
+	if len(nodes) != 2*len(fields) {
+		return 0, nil, fmt.Errorf("record batch has %d columns, but the schema has %d", len(nodes)/2, len(fields))
+	}
+	nextBuffer := func() ([]byte, error) {
+		if len(buffers) < 2 {
+			return nil, fmt.Errorf("record batch has too few buffers")
+		}
+		off, size := buffers[0], buffers[1]
+		buffers = buffers[2:]
+		if off < 0 || size < 0 || off+size > int64(len(body)) {
+			return nil, fmt.Errorf("buffer [%d,+%d) out of the body of %d bytes", off, size, len(body))
+		}
+		return body[off : off+size], nil
+	}
+	columns = make([]column, len(fields))
+	for i, f := range fields {
+		c := &columns[i]
+		c.typ = f.typ
+		c.n, c.nNulls = int(nodes[2*i]), int(nodes[2*i+1])
+		if c.n != n || c.nNulls < 0 || c.nNulls > c.n {
+			return 0, nil, fmt.Errorf("column %s: invalid length %d or null count %d", f.name, c.n, c.nNulls)
+		}
+		if c.valid, err = nextBuffer(); err != nil {
+			return 0, nil, err
+		}
+		if c.nNulls > 0 && len(c.valid) < (n+7)/8 {
+			return 0, nil, fmt.Errorf("column %s: validity bitmap too short", f.name)
+		}
+		if c.typ.variableWidth() {
+			if c.offsets, err = nextBuffer(); err != nil {
+				return 0, nil, err
+			}
+		}
+		if c.values, err = nextBuffer(); err != nil {
+			return 0, nil, err
+		}
+		if err = c.validate(); err != nil {
+			return 0, nil, fmt.Errorf("column %s: %v", f.name, err)
+		}
+	}
+	return n, columns, nil
+}
+
+// validate checks that the buffers are large enough for c.n values.
+func (c *column) validate() error {
+	if !c.typ.variableWidth() {
+		if len(c.values) < c.n*c.typ.bitWidth/8 {
+			return fmt.Errorf("values buffer too short")
+		}
+		return nil
+	}
+	if c.n == 0 {
+		return nil
+	}
+	if len(c.offsets) < 4*(c.n+1) {
+		return fmt.Errorf("offsets buffer too short")
+	}
+	prev := int32(0)
+	for i := 0; i <= c.n; i++ {
+		off := int32(binary.LittleEndian.Uint32(c.offsets[4*i:]))
+		if off < prev || int(off) > len(c.values) || (i == 0 && off < 0) {
+			return fmt.Errorf("invalid offset %d of value %d", off, i)
+		}
+		prev = off
+	}
+	return nil
+}
+
+func (c *column) null(i int) bool {
+	return c.nNulls > 0 && c.valid[i/8]&(1<<uint(i%8)) == 0
+}
+
+// int returns the i'th value of an integer column.
+func (c *column) int(i int) int64 {
+	switch c.typ.bitWidth {
+	case 8:
+		if c.typ.signed {
+			return int64(int8(c.values[i]))
+		}
+		return int64(c.values[i])
+	case 16:
+		v := binary.LittleEndian.Uint16(c.values[2*i:])
+		if c.typ.signed {
+			return int64(int16(v))
+		}
+		return int64(v)
+	case 32:
+		v := binary.LittleEndian.Uint32(c.values[4*i:])
+		if c.typ.signed {
+			return int64(int32(v))
+		}
+		return int64(v)
+	}
+	return int64(binary.LittleEndian.Uint64(c.values[8*i:]))
+}
+
+// float returns the i'th value of a floating-point column.
+func (c *column) float(i int) float64 {
+	if c.typ.bitWidth == 32 {
+		return float64(math.Float32frombits(binary.LittleEndian.Uint32(c.values[4*i:])))
+	}
+	return math.Float64frombits(binary.LittleEndian.Uint64(c.values[8*i:]))
+}
+
+// bytes returns the i'th value of a binary or utf8 column.
+func (c *column) bytes(i int) []byte {
+	start := binary.LittleEndian.Uint32(c.offsets[4*i:])
+	limit := binary.LittleEndian.Uint32(c.offsets[4*(i+1):])
+	return c.values[start:limit]
+}
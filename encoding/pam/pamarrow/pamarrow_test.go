@@ -0,0 +1,363 @@
+package pamarrow_test
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	gbam "github.com/Schaudge/grailbio/encoding/bam"
+	"github.com/Schaudge/grailbio/encoding/pam"
+	"github.com/Schaudge/grailbio/encoding/pam/pamarrow"
+	"github.com/Schaudge/hts/sam"
+	"github.com/grailbio/testutil"
+	"github.com/grailbio/testutil/assert"
+	"github.com/grailbio/testutil/expect"
+)
+
+var updateGoldenFlag = flag.Bool("update-golden", false, "Update testdata/pamarrow.arrows instead of comparing it.")
+
+func newAux(t *testing.T, tag string, value interface{}) sam.Aux {
+	a, err := sam.NewAux(sam.NewTag(tag), value)
+	assert.NoError(t, err)
+	return a
+}
+
+func newTestHeader(t *testing.T) (*sam.Header, []*sam.Reference) {
+	chr1, err := sam.NewReference("chr1", "", "", 1000000, nil, nil)
+	assert.NoError(t, err)
+	chr2, err := sam.NewReference("chr2", "", "", 1000000, nil, nil)
+	assert.NoError(t, err)
+	header, err := sam.NewHeader(nil, []*sam.Reference{chr1, chr2})
+	assert.NoError(t, err)
+	return header, []*sam.Reference{chr1, chr2}
+}
+
+// newTestRecords creates records with a mix of aux types. NM is an integer,
+// except in the last record, where it is a string.
+func newTestRecords(t *testing.T, refs []*sam.Reference, n int) []*sam.Record {
+	var recs []*sam.Record
+	for i := 0; i < n; i++ {
+		ref, pos := refs[i%2], i*10
+		var cigar []sam.CigarOp
+		if i%10 == 9 {
+			ref, pos = nil, -1
+		} else {
+			cigar = []sam.CigarOp{sam.NewCigarOp(sam.CigarMatch, 3), sam.NewCigarOp(sam.CigarInsertion, 1)}
+		}
+		aux := []sam.Aux{newAux(t, "RG", fmt.Sprintf("rg%d", i%3))}
+		if i%2 == 0 {
+			aux = append(aux, newAux(t, "NM", i%300))
+		}
+		if i%3 == 0 {
+			aux = append(aux, newAux(t, "XS", float32(i)/4))
+		}
+		if i%5 == 0 {
+			aux = append(aux, newAux(t, "XA", sam.ASCII('q')), newAux(t, "BC", []int16{1, -2, int16(i)}))
+		}
+		if i == n-1 {
+			aux = append(aux, newAux(t, "NM", "notanint"))
+		}
+		rec, err := sam.NewRecord(fmt.Sprintf("read%d", i), ref, refs[0], pos, 100, 150, byte(i%61),
+			cigar, []byte("ACGT"), []byte{30, 31, 32, byte(i % 40)}, aux)
+		assert.NoError(t, err)
+		rec.Flags = sam.Flags(i % 4096)
+		recs = append(recs, rec)
+	}
+	return recs
+}
+
+// auxStrings returns the aux fields as sorted strings. Integer aux fields are
+// printed with kind 'i' regardless of their width.
+func auxStrings(aa []sam.Aux) []string {
+	var s []string
+	for _, a := range aa {
+		s = append(s, a.String())
+	}
+	sort.Strings(s)
+	return s
+}
+
+func readAll(t *testing.T, r *pamarrow.Reader) []*sam.Record {
+	var recs []*sam.Record
+	for r.Scan() {
+		recs = append(recs, r.Record())
+	}
+	assert.NoError(t, r.Err())
+	return recs
+}
+
+func TestRoundTrip(t *testing.T) {
+	header, refs := newTestHeader(t)
+	recs := newTestRecords(t, refs, 100)
+	buf := bytes.Buffer{}
+	w := pamarrow.NewWriter(&buf, header, pamarrow.WriteOpts{
+		AuxTags:   []sam.Tag{{'N', 'M'}, {'X', 'S'}, {'R', 'G'}, {'X', 'A'}, {'Z', 'Z'}},
+		BatchSize: 16,
+		Metadata:  map[string]string{"sample": "s1"},
+	})
+	for _, rec := range recs {
+		w.Write(rec)
+	}
+	assert.NoError(t, w.Close())
+
+	r := pamarrow.NewReader(&buf)
+	assert.NoError(t, r.Err())
+	expect.EQ(t, len(r.Header().Refs()), 2)
+	expect.EQ(t, r.Metadata(), map[string]string{"sample": "s1"})
+	got := readAll(t, r)
+	assert.EQ(t, len(got), len(recs))
+	for i, rec := range recs {
+		g := got[i]
+		expect.EQ(t, g.Name, rec.Name)
+		expect.EQ(t, g.Ref.Name(), rec.Ref.Name())
+		expect.EQ(t, g.Pos, rec.Pos)
+		expect.EQ(t, g.MapQ, rec.MapQ)
+		expect.EQ(t, g.Cigar.String(), rec.Cigar.String())
+		expect.EQ(t, g.Flags, rec.Flags)
+		expect.EQ(t, g.MateRef.Name(), rec.MateRef.Name())
+		expect.EQ(t, g.MatePos, rec.MatePos)
+		expect.EQ(t, g.TempLen, rec.TempLen)
+		expect.EQ(t, g.Seq.Expand(), rec.Seq.Expand())
+		expect.EQ(t, g.Qual, rec.Qual)
+		expect.EQ(t, auxStrings(g.AuxFields), auxStrings(rec.AuxFields))
+	}
+}
+
+// newGoldenRecords creates the records stored in testdata/*.arrows. They must
+// match those of testdata/gen/main.go.
+func newGoldenRecords(t *testing.T) (*sam.Header, []*sam.Record) {
+	chr1, err := sam.NewReference("chr1", "", "", 1000, nil, nil)
+	assert.NoError(t, err)
+	chr2, err := sam.NewReference("chr2", "", "", 2000, nil, nil)
+	assert.NoError(t, err)
+	header, err := sam.NewHeader(nil, []*sam.Reference{chr1, chr2})
+	assert.NoError(t, err)
+	rg, err := sam.NewReadGroup("rg1", "", "", "", "", "", "", "s1", "", "", time.Time{}, 0)
+	assert.NoError(t, err)
+	assert.NoError(t, header.AddReadGroup(rg))
+
+	newRecord := func(name string, ref *sam.Reference, pos int, flags sam.Flags, mapq byte, cigar string,
+		mateRef *sam.Reference, matePos, tempLen int, seq string, qual []byte, aux ...sam.Aux) *sam.Record {
+		var c sam.Cigar
+		if cigar != "*" {
+			c, err = sam.ParseCigar([]byte(cigar))
+			assert.NoError(t, err)
+		}
+		rec, err := sam.NewRecord(name, ref, mateRef, pos, matePos, tempLen, mapq, c, []byte(seq), qual, aux)
+		assert.NoError(t, err)
+		rec.Flags = flags
+		return rec
+	}
+	rgAux := newAux(t, "RG", "rg1")
+	return header, []*sam.Record{
+		newRecord("read0", chr1, 99, 99, 60, "4M", chr1, 299, 204, "ACGT", []byte{30, 31, 32, 33},
+			rgAux, newAux(t, "NM", 1), newAux(t, "XS", float32(1.5)), newAux(t, "XA", sam.ASCII('q'))),
+		newRecord("read1", chr1, 299, 147, 0, "2S2M", chr1, 99, -204, "ACGN", []byte{20, 20, 2, 2},
+			newAux(t, "NM", 300), rgAux),
+		newRecord("read2", nil, -1, 4, 0, "*", nil, -1, 0, "ACGT", []byte{10, 11, 12, 13}, rgAux),
+		newRecord("read3", chr2, 4, 0, 37, "1M1I2M", nil, -1, 0, "AACC", []byte{40, 40, 40, 40},
+			newAux(t, "NM", "notanint"), newAux(t, "XS", float32(-2.25)), newAux(t, "BC", []int16{1, -2}), rgAux),
+	}
+}
+
+// TestGolden checks the interoperability with the Arrow Go library, using
+// the files generated by testdata/gen: testdata/arrowgo.arrows is written by
+// Arrow Go, and testdata/pamarrow.arrows, written by Writer, is checked by the
+// Arrow Go reader.
+func TestGolden(t *testing.T) {
+	header, recs := newGoldenRecords(t)
+	buf := bytes.Buffer{}
+	w := pamarrow.NewWriter(&buf, header, pamarrow.WriteOpts{
+		AuxTags:   []sam.Tag{{'N', 'M'}, {'X', 'S'}, {'R', 'G'}},
+		BatchSize: 3,
+		Metadata:  map[string]string{"sample": "s1"},
+	})
+	for _, rec := range recs {
+		w.Write(rec)
+	}
+	assert.NoError(t, w.Close())
+	const goldenPath = "testdata/pamarrow.arrows"
+	if *updateGoldenFlag {
+		assert.NoError(t, ioutil.WriteFile(goldenPath, buf.Bytes(), 0644))
+	}
+	golden, err := ioutil.ReadFile(goldenPath)
+	assert.NoError(t, err)
+	expect.True(t, bytes.Equal(buf.Bytes(), golden),
+		"%s differs from the output of Writer; see testdata/gen/main.go", goldenPath)
+
+	data, err := ioutil.ReadFile("testdata/arrowgo.arrows")
+	assert.NoError(t, err)
+	r := pamarrow.NewReader(bytes.NewReader(data))
+	assert.NoError(t, r.Err())
+	gotText, err := r.Header().MarshalText()
+	assert.NoError(t, err)
+	text, err := header.MarshalText()
+	assert.NoError(t, err)
+	expect.EQ(t, string(gotText), string(text))
+	expect.EQ(t, r.Metadata(), map[string]string{"sample": "s1"})
+	got := readAll(t, r)
+	assert.EQ(t, len(got), len(recs))
+	for i, rec := range recs {
+		// The aux fields of the aux columns follow those of the aux column.
+		expect.EQ(t, auxStrings(got[i].AuxFields), auxStrings(rec.AuxFields))
+		got[i].AuxFields, rec.AuxFields = nil, nil
+		expect.EQ(t, got[i].String(), rec.String())
+	}
+}
+
+func TestDropFields(t *testing.T) {
+	header, refs := newTestHeader(t)
+	recs := newTestRecords(t, refs, 10)
+	buf := bytes.Buffer{}
+	w := pamarrow.NewWriter(&buf, header, pamarrow.WriteOpts{
+		AuxTags:    []sam.Tag{{'R', 'G'}},
+		DropFields: []gbam.FieldType{gbam.FieldQual, gbam.FieldAux, gbam.FieldCoord},
+	})
+	for _, rec := range recs {
+		w.Write(rec)
+	}
+	assert.NoError(t, w.Close())
+
+	got := readAll(t, pamarrow.NewReader(&buf))
+	assert.EQ(t, len(got), len(recs))
+	for i, rec := range recs {
+		g := got[i]
+		expect.EQ(t, g.Name, rec.Name)
+		expect.True(t, g.Ref == nil)
+		expect.EQ(t, g.Pos, -1)
+		expect.EQ(t, len(g.Qual), 0)
+		// Only the aux tags in their own columns are kept.
+		expect.EQ(t, auxStrings(g.AuxFields), []string{rec.AuxFields.Get(sam.Tag{'R', 'G'}).String()})
+	}
+
+	w = pamarrow.NewWriter(&buf, header, pamarrow.WriteOpts{DropFields: []gbam.FieldType{gbam.FieldInvalid}})
+	expect.Regexp(t, w.Err(), "invalid DropField")
+	expect.Regexp(t, w.Close(), "invalid DropField")
+}
+
+func TestEmpty(t *testing.T) {
+	header, _ := newTestHeader(t)
+	buf := bytes.Buffer{}
+	w := pamarrow.NewWriter(&buf, header, pamarrow.WriteOpts{AuxTags: []sam.Tag{{'R', 'G'}}})
+	assert.NoError(t, w.Close())
+	r := pamarrow.NewReader(&buf)
+	expect.EQ(t, len(readAll(t, r)), 0)
+	expect.EQ(t, len(r.Header().Refs()), 2)
+}
+
+func TestCorrupt(t *testing.T) {
+	header, refs := newTestHeader(t)
+	buf := bytes.Buffer{}
+	w := pamarrow.NewWriter(&buf, header, pamarrow.WriteOpts{})
+	for _, rec := range newTestRecords(t, refs, 10) {
+		w.Write(rec)
+	}
+	assert.NoError(t, w.Close())
+	data := buf.Bytes()
+
+	// Truncate the stream in the middle of the record batch.
+	r := pamarrow.NewReader(bytes.NewReader(data[:len(data)-100]))
+	for r.Scan() {
+	}
+	expect.HasSubstr(t, r.Err().Error(), "unexpected EOF")
+
+	// Corrupt the metadata of the schema. The reader must not panic, and it
+	// must report an error unless the flipped byte is one it ignores, e.g.,
+	// padding or a flatbuffer field it does not use, in which case the records
+	// are read unchanged. The exception is the name of the first column, or
+	// its length: the column then has an unknown name, and it is ignored.
+	recordStrings := func(r *pamarrow.Reader) []string {
+		var s []string
+		for r.Scan() {
+			s = append(s, r.Record().String())
+		}
+		return s
+	}
+	expected := recordStrings(pamarrow.NewReader(bytes.NewReader(data)))
+	nameStart := bytes.Index(data, []byte("refid")) - 4
+	assert.True(t, nameStart > 0)
+	nameLimit := nameStart + 4 + len("refid")
+	for i := 8; i < 200; i++ {
+		corrupt := append([]byte(nil), data...)
+		corrupt[i] ^= 0xff
+		r := pamarrow.NewReader(bytes.NewReader(corrupt))
+		got := recordStrings(r)
+		if r.Err() == nil && (i < nameStart || i >= nameLimit) {
+			expect.EQ(t, got, expected, "byte %d flipped", i)
+		}
+	}
+
+	r = pamarrow.NewReader(bytes.NewReader(nil))
+	expect.HasSubstr(t, r.Err().Error(), "empty stream")
+}
+
+func TestExport(t *testing.T) {
+	tempDir, cleanup := testutil.TempDir(t, "", "")
+	defer cleanup()
+
+	header, refs := newTestHeader(t)
+	var recs []*sam.Record
+	for _, rec := range newTestRecords(t, refs, 100) {
+		// PAM does not support aux arrays, and requires sorted records.
+		var aux []sam.Aux
+		for _, a := range rec.AuxFields {
+			if a.Type() != 'B' {
+				aux = append(aux, a)
+			}
+		}
+		rec.AuxFields = aux
+		recs = append(recs, rec)
+	}
+	sort.SliceStable(recs, func(i, j int) bool {
+		ri, rj := recs[i].Ref.ID(), recs[j].Ref.ID()
+		if ri == -1 || rj == -1 {
+			return ri != -1 && rj == -1
+		}
+		return ri < rj || (ri == rj && recs[i].Pos < recs[j].Pos)
+	})
+	pamPath := filepath.Join(tempDir, "test.pam")
+	pw := pam.NewWriter(pam.WriteOpts{
+		PromotedAuxTags: []sam.Tag{{'R', 'G'}},
+		Metadata:        map[string]string{pam.MetadataSource: "test.bam"},
+	}, header, pamPath)
+	for _, rec := range recs {
+		pw.Write(rec)
+	}
+	assert.NoError(t, pw.Close())
+
+	buf := bytes.Buffer{}
+	assert.NoError(t, pamarrow.Export(pamarrow.ExportOpts{
+		WriteOpts: pamarrow.WriteOpts{AuxTags: []sam.Tag{{'N', 'M'}}},
+	}, &buf, pamPath))
+	r := pamarrow.NewReader(&buf)
+	got := readAll(t, r)
+	expect.EQ(t, r.Metadata()[pam.MetadataSource], "test.bam")
+	assert.EQ(t, len(got), len(recs))
+	for i, rec := range recs {
+		expect.EQ(t, got[i].Name, rec.Name)
+		expect.EQ(t, got[i].Pos, rec.Pos)
+		expect.EQ(t, auxStrings(got[i].AuxFields), auxStrings(rec.AuxFields))
+	}
+
+	// Dropping the promoted tag removes it from the records and the columns.
+	buf.Reset()
+	assert.NoError(t, pamarrow.Export(pamarrow.ExportOpts{
+		WriteOpts: pamarrow.WriteOpts{DropFields: []gbam.FieldType{gbam.AuxTagField(sam.Tag{'R', 'G'})}},
+	}, &buf, pamPath))
+	got = readAll(t, pamarrow.NewReader(&buf))
+	assert.EQ(t, len(got), len(recs))
+	for i, rec := range recs {
+		var aux []sam.Aux
+		for _, a := range rec.AuxFields {
+			if a.Tag() != (sam.Tag{'R', 'G'}) {
+				aux = append(aux, a)
+			}
+		}
+		expect.EQ(t, auxStrings(got[i].AuxFields), auxStrings(aux))
+	}
+}
@@ -0,0 +1,374 @@
+package pamarrow
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"strings"
+
+	"github.com/Schaudge/grailbase/errors"
+	gbam "github.com/Schaudge/grailbio/encoding/bam"
+	"github.com/Schaudge/hts/sam"
+)
+
+// Reader reads sam.Records from an Arrow IPC stream written by Writer. Columns
+// missing from the stream, e.g., those of dropped fields, leave the
+// corresponding sam.Record fields empty. Unknown columns are ignored. The aux
+// fields stored in their own columns follow those of the aux column. Integer
+// and binary columns may have been rewritten by other Arrow tools with
+// different integer widths, or as utf8.
+//
+// Example:
+//
+//	r := pamarrow.NewReader(in)
+//	for r.Scan() {
+//	   rec := r.Record()
+//	   ... use the rec ...
+//	}
+//	err := r.Err()
+type Reader struct {
+	in       io.Reader
+	header   *sam.Header
+	metadata map[string]string
+	err      errors.Once
+
+	fields []arrowField
+	// fixed[i] is the index of fixedColumns[i] in fields, or -1.
+	fixed [numFixedColumns]int
+	// auxColumns lists the columns of the exploded aux tags.
+	auxColumns []auxColumn
+
+	columns []column // of the current record batch.
+	nRows   int      // number of rows in the current record batch.
+	row     int      // next row to read.
+	rec     *sam.Record
+}
+
+// auxColumn is a column that stores one aux tag.
+type auxColumn struct {
+	index   int // in Reader.fields.
+	tag     sam.Tag
+	samType byte
+}
+
+// NewReader creates a Reader. It reads the schema from in. Errors are reported
+// by Err.
+func NewReader(in io.Reader) *Reader {
+	r := &Reader{in: in}
+	r.err.Set(r.readSchema())
+	return r
+}
+
+func (r *Reader) readSchema() error {
+	m, err := readMessage(r.in)
+	if err == io.EOF {
+		return fmt.Errorf("pamarrow: empty stream")
+	}
+	if err != nil {
+		return fmt.Errorf("pamarrow: read schema: %v", err)
+	}
+	if m.headerType != messageSchema {
+		return fmt.Errorf("pamarrow: the stream starts with message type %d, not a schema", m.headerType)
+	}
+	if err = catchFlatbufferError(func() error {
+		r.fields, r.metadata, err = decodeSchema(m.header)
+		return err
+	}); err != nil {
+		return fmt.Errorf("pamarrow: read schema: %v", err)
+	}
+	text, ok := r.metadata[HeaderMetadataKey]
+	if !ok {
+		return fmt.Errorf("pamarrow: the schema has no %s metadata", HeaderMetadataKey)
+	}
+	delete(r.metadata, HeaderMetadataKey)
+	if r.header, err = sam.NewHeader([]byte(text), nil); err != nil {
+		return fmt.Errorf("pamarrow: parse %s: %v", HeaderMetadataKey, err)
+	}
+
+	for i := range r.fixed {
+		r.fixed[i] = -1
+	}
+	for i, f := range r.fields {
+		if err := r.addColumn(i, f); err != nil {
+			return fmt.Errorf("pamarrow: column %s: %v", f.name, err)
+		}
+	}
+	return nil
+}
+
+// addColumn finds the use of the i'th column of the schema.
+func (r *Reader) addColumn(i int, f arrowField) error {
+	for j, c := range fixedColumns {
+		if f.name != c.name {
+			continue
+		}
+		if !compatible(f.typ, c.typ) {
+			return fmt.Errorf("type is %v, but expect %v", f.typ, c.typ)
+		}
+		r.fixed[j] = i
+		return nil
+	}
+	auxPrefix := gbam.FieldAux.String() + "."
+	if !strings.HasPrefix(f.name, auxPrefix) || len(f.name) != len(auxPrefix)+2 {
+		return nil
+	}
+	c := auxColumn{index: i, tag: sam.NewTag(f.name[len(auxPrefix):])}
+	if t := f.metadata[samTypeMetadataKey]; len(t) == 1 {
+		c.samType = t[0]
+	} else {
+		switch f.typ.id {
+		case arrowInt:
+			c.samType = 'i'
+		case arrowFloat:
+			c.samType = 'f'
+		default:
+			c.samType = 'Z'
+		}
+	}
+	var typ arrowType
+	switch c.samType {
+	case 'i':
+		typ = int64Type
+	case 'f':
+		typ = float32Type
+	case 'Z', 'A', 'H':
+		typ = utf8Type
+	default:
+		return fmt.Errorf("invalid SAM type %c", c.samType)
+	}
+	if !compatible(f.typ, typ) {
+		return fmt.Errorf("type is %v, but expect %v for SAM type %c", f.typ, typ, c.samType)
+	}
+	r.auxColumns = append(r.auxColumns, c)
+	return nil
+}
+
+// compatible checks if a column of type t can be read as a column of type
+// expected. Integers of any width are interchangeable, and so are binary and
+// utf8.
+func compatible(t, expected arrowType) bool {
+	if t.variableWidth() {
+		return expected.variableWidth()
+	}
+	return t.id == expected.id
+}
+
+// catchFlatbufferError calls fn, and converts a panic caused by a malformed
+// flatbuffer to an error.
+func catchFlatbufferError(fn func() error) (err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			fe, ok := e.(fbError)
+			if !ok {
+				panic(e)
+			}
+			err = fe.err
+		}
+	}()
+	return fn()
+}
+
+// Header returns the SAM header stored in the stream.
+func (r *Reader) Header() *sam.Header {
+	return r.header
+}
+
+// Metadata returns the metadata of the schema, other than the SAM header.
+func (r *Reader) Metadata() map[string]string {
+	return r.metadata
+}
+
+// readBatch reads the next record batch. It returns false at the end of the
+// stream or on error.
+func (r *Reader) readBatch() bool {
+	for {
+		m, err := readMessage(r.in)
+		if err == io.EOF {
+			return false
+		}
+		if err != nil {
+			r.err.Set(fmt.Errorf("pamarrow: %v", err))
+			return false
+		}
+		switch m.headerType {
+		case messageRecordBatch:
+		case messageDictionaryBatch:
+			r.err.Set(fmt.Errorf("pamarrow: dictionary batches are not supported"))
+			return false
+		default:
+			// Ignore other messages, e.g., tensors.
+			continue
+		}
+		if err = catchFlatbufferError(func() error {
+			r.nRows, r.columns, err = decodeRecordBatch(m.header, m.body, r.fields)
+			return err
+		}); err != nil {
+			r.err.Set(fmt.Errorf("pamarrow: %v", err))
+			return false
+		}
+		r.row = 0
+		if r.nRows > 0 {
+			return true
+		}
+	}
+}
+
+// Scan reads the next record. It returns false at the end of the stream or on
+// error.
+func (r *Reader) Scan() bool {
+	if r.err.Err() != nil {
+		return false
+	}
+	if r.row >= r.nRows && !r.readBatch() {
+		return false
+	}
+	rec, err := r.record(r.row)
+	if err != nil {
+		r.err.Set(fmt.Errorf("pamarrow: record %d of a record batch: %v", r.row, err))
+		return false
+	}
+	r.rec = rec
+	r.row++
+	return true
+}
+
+// Record returns the most recent record read by Scan.
+//
+// REQUIRES: Scan() returned true.
+func (r *Reader) Record() *sam.Record {
+	return r.rec
+}
+
+// Err returns any error encountered so far.
+func (r *Reader) Err() error {
+	return r.err.Err()
+}
+
+func (r *Reader) ref(id int64) (*sam.Reference, error) {
+	if id == -1 {
+		return nil, nil
+	}
+	refs := r.header.Refs()
+	if id < 0 || id >= int64(len(refs)) {
+		return nil, fmt.Errorf("reference ID %d out of range [-1,%d)", id, len(refs))
+	}
+	return refs[id], nil
+}
+
+// record builds the record stored in the given row.
+func (r *Reader) record(row int) (*sam.Record, error) {
+	rec := &sam.Record{Pos: -1, MatePos: -1}
+	var err error
+	for i, index := range r.fixed {
+		if index < 0 {
+			continue
+		}
+		c := &r.columns[index]
+		if c.null(row) {
+			continue
+		}
+		switch i {
+		case colRefID:
+			rec.Ref, err = r.ref(c.int(row))
+		case colPos:
+			rec.Pos = int(c.int(row))
+		case colFlags:
+			rec.Flags = sam.Flags(c.int(row))
+		case colMapq:
+			rec.MapQ = byte(c.int(row))
+		case colCigar:
+			rec.Cigar, err = sam.ParseCigar(c.bytes(row))
+		case colMateRefID:
+			rec.MateRef, err = r.ref(c.int(row))
+		case colMatePos:
+			rec.MatePos = int(c.int(row))
+		case colTempLen:
+			rec.TempLen = int(c.int(row))
+		case colName:
+			rec.Name = string(c.bytes(row))
+		case colSeq:
+			rec.Seq = sam.NewSeq(c.bytes(row))
+		case colQual:
+			rec.Qual = append([]byte(nil), c.bytes(row)...)
+		case colAux:
+			rec.AuxFields, err = parseAuxFields(c.bytes(row))
+		}
+		if err != nil {
+			return nil, fmt.Errorf("column %s: %v", fixedColumns[i].name, err)
+		}
+	}
+	for _, ac := range r.auxColumns {
+		c := &r.columns[ac.index]
+		if c.null(row) {
+			continue
+		}
+		var a sam.Aux
+		switch ac.samType {
+		case 'i':
+			if v := c.int(row); v < 0 || v <= math.MaxInt32 {
+				a, err = sam.NewAux(ac.tag, int(v))
+			} else {
+				a, err = sam.NewAux(ac.tag, uint(v))
+			}
+		case 'f':
+			a, err = sam.NewAux(ac.tag, float32(c.float(row)))
+		default:
+			a = append(sam.Aux{ac.tag[0], ac.tag[1], ac.samType}, c.bytes(row)...)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("column %s: %v", r.fields[ac.index].name, err)
+		}
+		rec.AuxFields = append(rec.AuxFields, a)
+	}
+	return rec, nil
+}
+
+// auxSizes is the size of the value of the fixed-size aux types.
+var auxSizes = [256]int{
+	'A': 1,
+	'c': 1, 'C': 1,
+	's': 2, 'S': 2,
+	'i': 4, 'I': 4,
+	'f': 4,
+}
+
+// parseAuxFields parses the BAM encoding of aux fields.
+func parseAuxFields(b []byte) ([]sam.Aux, error) {
+	var aa []sam.Aux
+	for len(b) > 0 {
+		if len(b) < 3 {
+			return nil, fmt.Errorf("truncated aux field")
+		}
+		var n int // size of the aux field, including the terminating NUL, if any.
+		switch t := b[2]; t {
+		case 'Z', 'H':
+			i := 3
+			for i < len(b) && b[i] != 0 {
+				i++
+			}
+			if i == len(b) {
+				return nil, fmt.Errorf("aux field %s not NUL-terminated", b[:2])
+			}
+			aa = append(aa, sam.Aux(append([]byte(nil), b[:i]...)))
+			b = b[i+1:]
+			continue
+		case 'B':
+			if len(b) < 8 || auxSizes[b[3]] == 0 || b[3] == 'A' {
+				return nil, fmt.Errorf("invalid aux array %s", b[:2])
+			}
+			n = 8 + auxSizes[b[3]]*int(binary.LittleEndian.Uint32(b[4:8]))
+		default:
+			if auxSizes[t] == 0 {
+				return nil, fmt.Errorf("invalid aux type %q", t)
+			}
+			n = 3 + auxSizes[t]
+		}
+		if n > len(b) {
+			return nil, fmt.Errorf("truncated aux field %s", b[:2])
+		}
+		aa = append(aa, sam.Aux(append([]byte(nil), b[:n]...)))
+		b = b[n:]
+	}
+	return aa, nil
+}
@@ -0,0 +1,29 @@
+module github.com/Schaudge/grailbio/encoding/pam/pamarrow/testdata/gen
+
+go 1.20
+
+require (
+	github.com/Schaudge/hts v0.0.0-20240223063651-737b4d69d68c
+	github.com/apache/arrow/go/v12 v12.0.1
+)
+
+require (
+	github.com/Schaudge/grailbase v0.0.0-20240223061707-44c758a471c0 // indirect
+	github.com/Schaudge/grailbio v0.0.0-20240223024842-cff4bfc6ee22 // indirect
+	github.com/andybalholm/brotli v1.0.4 // indirect
+	github.com/apache/thrift v0.16.0 // indirect
+	github.com/goccy/go-json v0.9.11 // indirect
+	github.com/golang/snappy v0.0.4 // indirect
+	github.com/google/flatbuffers v2.0.8+incompatible // indirect
+	github.com/klauspost/asmfmt v1.3.2 // indirect
+	github.com/klauspost/compress v1.15.9 // indirect
+	github.com/klauspost/cpuid/v2 v2.0.9 // indirect
+	github.com/minio/asm2plan9s v0.0.0-20200509001527-cdd76441f9d8 // indirect
+	github.com/minio/c2goasm v0.0.0-20190812172519-36a3d3bbc4f3 // indirect
+	github.com/pierrec/lz4/v4 v4.1.15 // indirect
+	github.com/zeebo/xxh3 v1.0.2 // indirect
+	golang.org/x/mod v0.8.0 // indirect
+	golang.org/x/sys v0.15.0 // indirect
+	golang.org/x/tools v0.6.0 // indirect
+	golang.org/x/xerrors v0.0.0-20220609144429-65e65417b02f // indirect
+)
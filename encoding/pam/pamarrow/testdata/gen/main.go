@@ -0,0 +1,247 @@
+// Command gen checks the Arrow IPC support of package pamarrow against the
+// Apache Arrow Go library. It
+//
+//   - writes ../arrowgo.arrows with the Arrow Go IPC writer, and
+//   - reads ../pamarrow.arrows, written by pamarrow.Writer, with the Arrow Go
+//     IPC reader, and fails unless its schema and records match those of
+//     ../arrowgo.arrows.
+//
+// Both files store the records of newGoldenRecords in pamarrow_test.go, with
+// WriteOpts{AuxTags: NM,XS,RG, BatchSize: 3, Metadata: sample=s1}.
+// TestGolden reads ../arrowgo.arrows with pamarrow.Reader, and checks that
+// pamarrow.Writer still writes ../pamarrow.arrows byte for byte. After a
+// change of the format, run
+//
+//	go test -run TestGolden -update-golden
+//	cd testdata/gen && go run .
+//
+// from the pamarrow directory. This command has its own go.mod, so that
+// pamarrow does not depend on Arrow Go.
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/Schaudge/hts/sam"
+	"github.com/apache/arrow/go/v12/arrow"
+	"github.com/apache/arrow/go/v12/arrow/array"
+	"github.com/apache/arrow/go/v12/arrow/ipc"
+	"github.com/apache/arrow/go/v12/arrow/memory"
+)
+
+const (
+	arrowGoPath  = "../arrowgo.arrows"
+	pamArrowPath = "../pamarrow.arrows"
+	batchSize    = 3
+)
+
+// row is one record, as stored in the columns of the stream. A nil aux column
+// value is null.
+type row struct {
+	refID, pos         int32
+	flags              uint16
+	mapq               uint8
+	cigar              string
+	mateRefID, matePos int32
+	tempLen            int32
+	name, seq          string
+	qual               []byte
+	aux                []sam.Aux // fields stored in the aux column.
+	nm                 interface{}
+	xs                 interface{}
+	rg                 interface{}
+}
+
+func newAux(tag string, value interface{}) sam.Aux {
+	a, err := sam.NewAux(sam.NewTag(tag), value)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return a
+}
+
+// samHeader returns the text of the SAM header of newGoldenRecords.
+func samHeader() string {
+	chr1, err := sam.NewReference("chr1", "", "", 1000, nil, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	chr2, err := sam.NewReference("chr2", "", "", 2000, nil, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	header, err := sam.NewHeader(nil, []*sam.Reference{chr1, chr2})
+	if err != nil {
+		log.Fatal(err)
+	}
+	rg, err := sam.NewReadGroup("rg1", "", "", "", "", "", "", "s1", "", "", time.Time{}, 0)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := header.AddReadGroup(rg); err != nil {
+		log.Fatal(err)
+	}
+	text, err := header.MarshalText()
+	if err != nil {
+		log.Fatal(err)
+	}
+	return string(text)
+}
+
+var rows = []row{
+	{0, 99, 99, 60, "4M", 0, 299, 204, "read0", "ACGT", []byte{30, 31, 32, 33},
+		[]sam.Aux{newAux("XA", sam.ASCII('q'))}, int64(1), float32(1.5), "rg1"},
+	{0, 299, 147, 0, "2S2M", 0, 99, -204, "read1", "ACGN", []byte{20, 20, 2, 2},
+		nil, int64(300), nil, "rg1"},
+	{-1, -1, 4, 0, "*", -1, -1, 0, "read2", "ACGT", []byte{10, 11, 12, 13},
+		nil, nil, nil, "rg1"},
+	{1, 4, 0, 37, "1M1I2M", -1, -1, 0, "read3", "AACC", []byte{40, 40, 40, 40},
+		[]sam.Aux{newAux("NM", "notanint"), newAux("BC", []int16{1, -2})}, nil, float32(-2.25), "rg1"},
+}
+
+// encodeAux returns the BAM encoding of the aux fields.
+func encodeAux(aa []sam.Aux) []byte {
+	var b []byte
+	for _, a := range aa {
+		b = append(b, a...)
+		if t := a.Type(); t == 'Z' || t == 'H' {
+			b = append(b, 0)
+		}
+	}
+	return b
+}
+
+func schema() *arrow.Schema {
+	auxField := func(name, samType string, typ arrow.DataType) arrow.Field {
+		return arrow.Field{
+			Name:     name,
+			Type:     typ,
+			Nullable: true,
+			Metadata: arrow.NewMetadata([]string{"sam_type"}, []string{samType}),
+		}
+	}
+	md := arrow.NewMetadata([]string{"sam_header", "sample"}, []string{samHeader(), "s1"})
+	return arrow.NewSchema([]arrow.Field{
+		{Name: "refid", Type: arrow.PrimitiveTypes.Int32},
+		{Name: "pos", Type: arrow.PrimitiveTypes.Int32},
+		{Name: "flags", Type: arrow.PrimitiveTypes.Uint16},
+		{Name: "mapq", Type: arrow.PrimitiveTypes.Uint8},
+		{Name: "cigar", Type: arrow.BinaryTypes.String},
+		{Name: "materefid", Type: arrow.PrimitiveTypes.Int32},
+		{Name: "matepos", Type: arrow.PrimitiveTypes.Int32},
+		{Name: "templen", Type: arrow.PrimitiveTypes.Int32},
+		{Name: "name", Type: arrow.BinaryTypes.String},
+		{Name: "seq", Type: arrow.BinaryTypes.String},
+		{Name: "qual", Type: arrow.BinaryTypes.Binary},
+		{Name: "aux", Type: arrow.BinaryTypes.Binary},
+		auxField("aux.NM", "i", arrow.PrimitiveTypes.Int64),
+		auxField("aux.XS", "f", arrow.PrimitiveTypes.Float32),
+		auxField("aux.RG", "Z", arrow.BinaryTypes.String),
+	}, &md)
+}
+
+// records returns the record batches of rows.
+func records(mem memory.Allocator, sc *arrow.Schema) []arrow.Record {
+	b := array.NewRecordBuilder(mem, sc)
+	defer b.Release()
+	var recs []arrow.Record
+	for i, r := range rows {
+		b.Field(0).(*array.Int32Builder).Append(r.refID)
+		b.Field(1).(*array.Int32Builder).Append(r.pos)
+		b.Field(2).(*array.Uint16Builder).Append(r.flags)
+		b.Field(3).(*array.Uint8Builder).Append(r.mapq)
+		b.Field(4).(*array.StringBuilder).Append(r.cigar)
+		b.Field(5).(*array.Int32Builder).Append(r.mateRefID)
+		b.Field(6).(*array.Int32Builder).Append(r.matePos)
+		b.Field(7).(*array.Int32Builder).Append(r.tempLen)
+		b.Field(8).(*array.StringBuilder).Append(r.name)
+		b.Field(9).(*array.StringBuilder).Append(r.seq)
+		b.Field(10).(*array.BinaryBuilder).Append(r.qual)
+		b.Field(11).(*array.BinaryBuilder).Append(encodeAux(r.aux))
+		if r.nm == nil {
+			b.Field(12).AppendNull()
+		} else {
+			b.Field(12).(*array.Int64Builder).Append(r.nm.(int64))
+		}
+		if r.xs == nil {
+			b.Field(13).AppendNull()
+		} else {
+			b.Field(13).(*array.Float32Builder).Append(r.xs.(float32))
+		}
+		if r.rg == nil {
+			b.Field(14).AppendNull()
+		} else {
+			b.Field(14).(*array.StringBuilder).Append(r.rg.(string))
+		}
+		if (i+1)%batchSize == 0 || i == len(rows)-1 {
+			recs = append(recs, b.NewRecord())
+		}
+	}
+	return recs
+}
+
+func writeArrowGo(sc *arrow.Schema, recs []arrow.Record) error {
+	out, err := os.Create(arrowGoPath)
+	if err != nil {
+		return err
+	}
+	w := ipc.NewWriter(out, ipc.WithSchema(sc))
+	for _, rec := range recs {
+		if err := w.Write(rec); err != nil {
+			return err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+func checkPAMArrow(sc *arrow.Schema, recs []arrow.Record) error {
+	in, err := os.Open(pamArrowPath)
+	if err != nil {
+		return err
+	}
+	defer in.Close() // nolint: errcheck
+	r, err := ipc.NewReader(in)
+	if err != nil {
+		return err
+	}
+	defer r.Release()
+	if !r.Schema().Equal(sc) || !r.Schema().Metadata().Equal(sc.Metadata()) {
+		return fmt.Errorf("%s: schema is\n%v\nexpect\n%v", pamArrowPath, r.Schema(), sc)
+	}
+	n := 0
+	for r.Next() {
+		if n >= len(recs) {
+			return fmt.Errorf("%s: more than %d record batches", pamArrowPath, len(recs))
+		}
+		if got := r.Record(); !array.RecordEqual(got, recs[n]) {
+			return fmt.Errorf("%s: record batch %d is\n%v\nexpect\n%v", pamArrowPath, n, got, recs[n])
+		}
+		n++
+	}
+	if err := r.Err(); err != nil {
+		return err
+	}
+	if n != len(recs) {
+		return fmt.Errorf("%s: %d record batches, expect %d", pamArrowPath, n, len(recs))
+	}
+	return nil
+}
+
+func main() {
+	mem := memory.NewGoAllocator()
+	sc := schema()
+	recs := records(mem, sc)
+	if err := writeArrowGo(sc, recs); err != nil {
+		log.Fatal(err)
+	}
+	if err := checkPAMArrow(sc, recs); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("wrote %s; %s matches", arrowGoPath, pamArrowPath)
+}
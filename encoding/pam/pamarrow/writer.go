@@ -0,0 +1,385 @@
+// Package pamarrow converts sam.Records to and from Apache Arrow IPC streams,
+// so that the reads in a PAM file can be queried by dataframe libraries, e.g.,
+// pyarrow or polars, without going through SAM text.
+//
+// The stream has one column per PAM field, except that the coord field is
+// split into "refid" and "pos":
+//
+//	refid, pos, materefid, matepos, templen: int32
+//	flags: uint16
+//	mapq: uint8
+//	cigar, name, seq: utf8, in the SAM text format. An empty cigar is "*", and
+//	  an empty seq is "".
+//	qual: binary, the phred scores without the +33 offset.
+//	aux: binary, the BAM encoding of the aux fields not stored in their own
+//	  columns.
+//
+// In addition, each aux tag listed in WriteOpts.AuxTags is stored in its own,
+// nullable column "aux.XX", where XX is the tag. Its type is int64, float32 or
+// utf8, chosen from the first value of the tag in the first record batch; the
+// SAM type (i, f, Z, A or H) is recorded in the "sam_type" metadata of the
+// column. Values of a different type are stored in the aux column instead.
+// Integer values lose their BAM width, so Reader re-encodes them with the
+// smallest width that fits.
+//
+// The SAM header is stored, in text, in the "sam_header" metadata of the
+// schema. Columns of dropped PAM fields are omitted.
+package pamarrow
+
+import (
+	"fmt"
+	"io"
+	"math"
+
+	"github.com/Schaudge/grailbase/errors"
+	gbam "github.com/Schaudge/grailbio/encoding/bam"
+	"github.com/Schaudge/hts/sam"
+)
+
+const (
+	// DefaultBatchSize is the default value of WriteOpts.BatchSize.
+	DefaultBatchSize = 16384
+
+	// HeaderMetadataKey is the key of the schema metadata that stores the SAM
+	// header.
+	HeaderMetadataKey = "sam_header"
+
+	// samTypeMetadataKey is the key of the column metadata that stores the SAM
+	// type of an aux column.
+	samTypeMetadataKey = "sam_type"
+)
+
+// Indexes of fixedColumns.
+const (
+	colRefID = iota
+	colPos
+	colFlags
+	colMapq
+	colCigar
+	colMateRefID
+	colMatePos
+	colTempLen
+	colName
+	colSeq
+	colQual
+	colAux
+	numFixedColumns
+)
+
+// fixedColumns lists the columns other than those of the exploded aux tags, in
+// the order of the schema.
+var fixedColumns = [numFixedColumns]struct {
+	name  string
+	field gbam.FieldType
+	typ   arrowType
+}{
+	{"refid", gbam.FieldCoord, int32Type},
+	{"pos", gbam.FieldCoord, int32Type},
+	{"flags", gbam.FieldFlags, uint16Type},
+	{"mapq", gbam.FieldMapq, uint8Type},
+	{"cigar", gbam.FieldCigar, utf8Type},
+	{"materefid", gbam.FieldMateRefID, int32Type},
+	{"matepos", gbam.FieldMatePos, int32Type},
+	{"templen", gbam.FieldTempLen, int32Type},
+	{"name", gbam.FieldName, utf8Type},
+	{"seq", gbam.FieldSeq, utf8Type},
+	{"qual", gbam.FieldQual, binaryType},
+	{"aux", gbam.FieldAux, binaryType},
+}
+
+// WriteOpts defines options for NewWriter.
+type WriteOpts struct {
+	// AuxTags lists the aux tags stored in their own columns.
+	AuxTags []sam.Tag
+
+	// DropFields lists the PAM fields not to store. Dropping FieldAux drops
+	// only the aux tags not listed in AuxTags, like pam.ReadOpts.DropFields.
+	// gbam.AuxTagField(tag) removes the tag from AuxTags.
+	DropFields []gbam.FieldType
+
+	// BatchSize is the number of records per record batch. If <= 0,
+	// DefaultBatchSize is used.
+	BatchSize int
+
+	// Metadata is added to the metadata of the schema.
+	Metadata map[string]string
+}
+
+// Writer writes sam.Records to an Arrow IPC stream.
+type Writer struct {
+	out    io.Writer
+	header *sam.Header
+	opts   WriteOpts
+	err    errors.Once
+
+	// fixed[i] accumulates fixedColumns[i]. It is nil if the field is dropped.
+	fixed [numFixedColumns]*columnBuilder
+	// auxColumns[i] accumulates opts.AuxTags[i]. They are created when the
+	// first record batch is written.
+	auxColumns []*columnBuilder
+	// aux stores copies of the aux fields of the records in the current batch.
+	// They are encoded when the batch is written, since the types of
+	// auxColumns are chosen from the first batch.
+	aux           [][]sam.Aux
+	n             int // number of records in the current batch.
+	schemaWritten bool
+}
+
+// NewWriter creates a Writer that writes to out. The records are described by
+// the given header. The caller must call Close, which does not close out.
+func NewWriter(out io.Writer, header *sam.Header, opts WriteOpts) *Writer {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = DefaultBatchSize
+	}
+	w := &Writer{out: out, header: header}
+	dropped := [gbam.NumFields]bool{}
+	droppedAuxTag := map[sam.Tag]bool{}
+	for _, f := range opts.DropFields {
+		if tag, ok := f.AuxTag(); ok {
+			droppedAuxTag[tag] = true
+			continue
+		}
+		if int(f) >= gbam.NumFields {
+			w.err.Set(fmt.Errorf("invalid DropField %v", f))
+			continue
+		}
+		dropped[f] = true
+	}
+	if len(droppedAuxTag) > 0 {
+		var auxTags []sam.Tag
+		for _, tag := range opts.AuxTags {
+			if !droppedAuxTag[tag] {
+				auxTags = append(auxTags, tag)
+			}
+		}
+		opts.AuxTags = auxTags
+	}
+	w.opts = opts
+	for i, c := range fixedColumns {
+		if !dropped[c.field] {
+			w.fixed[i] = newColumnBuilder(arrowField{name: c.name, typ: c.typ})
+		}
+	}
+	return w
+}
+
+// Write appends a record. Errors are reported by Err and Close.
+func (w *Writer) Write(r *sam.Record) {
+	if w.err.Err() != nil {
+		return
+	}
+	for i, c := range w.fixed {
+		if c == nil {
+			continue
+		}
+		switch i {
+		case colRefID:
+			c.appendInt(int64(r.Ref.ID()))
+		case colPos:
+			c.appendInt(int64(r.Pos))
+		case colFlags:
+			c.appendInt(int64(r.Flags))
+		case colMapq:
+			c.appendInt(int64(r.MapQ))
+		case colCigar:
+			c.appendBytes([]byte(r.Cigar.String()))
+		case colMateRefID:
+			c.appendInt(int64(r.MateRef.ID()))
+		case colMatePos:
+			c.appendInt(int64(r.MatePos))
+		case colTempLen:
+			c.appendInt(int64(r.TempLen))
+		case colName:
+			c.appendBytes([]byte(r.Name))
+		case colSeq:
+			c.appendBytes(r.Seq.Expand())
+		case colQual:
+			c.appendBytes(r.Qual)
+		}
+	}
+	if w.fixed[colAux] != nil || len(w.opts.AuxTags) > 0 {
+		aa := make([]sam.Aux, len(r.AuxFields))
+		for i, a := range r.AuxFields {
+			aa[i] = append(sam.Aux(nil), a...)
+		}
+		w.aux = append(w.aux, aa)
+	}
+	if w.n++; w.n >= w.opts.BatchSize {
+		w.flush()
+	}
+}
+
+// auxValueType returns the SAM type of the aux value, and the type of the
+// column that stores it. It returns false if the value cannot be stored in its
+// own column.
+func auxValueType(a sam.Aux) (byte, arrowType, bool) {
+	switch kind := a.Kind(); kind {
+	case 'i':
+		return kind, int64Type, true
+	case 'f':
+		return kind, float32Type, true
+	case 'Z', 'A', 'H':
+		return kind, utf8Type, true
+	}
+	return 0, arrowType{}, false
+}
+
+// writeSchema creates auxColumns and writes the schema. The type of an aux
+// column is chosen from the first value of the tag in the current batch.
+func (w *Writer) writeSchema() {
+	w.schemaWritten = true
+	for _, tag := range w.opts.AuxTags {
+		samType, typ := byte('Z'), utf8Type
+	L:
+		for _, aa := range w.aux {
+			for _, a := range aa {
+				if a.Tag() != tag {
+					continue
+				}
+				if t, at, ok := auxValueType(a); ok {
+					samType, typ = t, at
+					break L
+				}
+			}
+		}
+		w.auxColumns = append(w.auxColumns, newColumnBuilder(arrowField{
+			name:     gbam.AuxTagField(tag).String(),
+			typ:      typ,
+			nullable: true,
+			metadata: map[string]string{samTypeMetadataKey: string(samType)},
+		}))
+	}
+	var fields []arrowField
+	for _, c := range w.columns() {
+		fields = append(fields, c.arrowField)
+	}
+	metadata := map[string]string{}
+	for k, v := range w.opts.Metadata {
+		metadata[k] = v
+	}
+	text, err := w.header.MarshalText()
+	if err != nil {
+		w.err.Set(err)
+		return
+	}
+	metadata[HeaderMetadataKey] = string(text)
+	w.err.Set(writeMessage(w.out, encodeSchema(fields, metadata), nil))
+}
+
+// columns returns the columns written, in the order of the schema.
+func (w *Writer) columns() []*columnBuilder {
+	var columns []*columnBuilder
+	for _, c := range w.fixed {
+		if c != nil {
+			columns = append(columns, c)
+		}
+	}
+	return append(columns, w.auxColumns...)
+}
+
+// putAuxFields encodes the aux fields of the current batch.
+func (w *Writer) putAuxFields() {
+	set := make([]bool, len(w.auxColumns))
+	var rest []byte
+	for _, aa := range w.aux {
+		for i := range set {
+			set[i] = false
+		}
+		rest = rest[:0]
+	nextAux:
+		for _, a := range aa {
+			for i, tag := range w.opts.AuxTags {
+				if a.Tag() != tag || set[i] {
+					continue
+				}
+				c := w.auxColumns[i]
+				samType, _, ok := auxValueType(a)
+				if !ok || samType != c.metadata[samTypeMetadataKey][0] {
+					break
+				}
+				switch samType {
+				case 'i':
+					c.appendInt(auxInt(a))
+				case 'f':
+					c.appendFloat32(a.Value().(float32))
+				default:
+					c.appendBytes(a[3:])
+				}
+				set[i] = true
+				continue nextAux
+			}
+			rest = append(rest, a...)
+			if t := a.Type(); t == 'Z' || t == 'H' {
+				// The BAM encoding of a string is NUL-terminated.
+				rest = append(rest, 0)
+			}
+		}
+		for i, c := range w.auxColumns {
+			if !set[i] {
+				c.appendNull()
+			}
+		}
+		if c := w.fixed[colAux]; c != nil {
+			c.appendBytes(rest)
+		}
+	}
+}
+
+// auxInt returns the value of an integer aux field.
+func auxInt(a sam.Aux) int64 {
+	switch v := a.Value().(type) {
+	case int8:
+		return int64(v)
+	case uint8:
+		return int64(v)
+	case int16:
+		return int64(v)
+	case uint16:
+		return int64(v)
+	case int32:
+		return int64(v)
+	case uint32:
+		return int64(v)
+	}
+	return math.MinInt64
+}
+
+// flush writes the current batch, if any. It writes the schema first if it
+// hasn't been written.
+func (w *Writer) flush() {
+	if !w.schemaWritten {
+		w.writeSchema()
+	}
+	if w.n == 0 || w.err.Err() != nil {
+		return
+	}
+	if len(w.aux) > 0 {
+		w.putAuxFields()
+	}
+	columns := w.columns()
+	meta, body, err := encodeRecordBatch(columns, w.n)
+	if err == nil {
+		err = writeMessage(w.out, meta, body)
+	}
+	w.err.Set(err)
+	for _, c := range columns {
+		c.reset()
+	}
+	w.aux = w.aux[:0]
+	w.n = 0
+}
+
+// Err returns any error encountered so far.
+func (w *Writer) Err() error {
+	return w.err.Err()
+}
+
+// Close writes the remaining records and the end-of-stream marker. It must be
+// called exactly once.
+func (w *Writer) Close() error {
+	w.flush()
+	if w.err.Err() == nil {
+		w.err.Set(writeEndOfStream(w.out))
+	}
+	return w.err.Err()
+}
@@ -17,6 +17,7 @@ import (
 	"github.com/Schaudge/grailbase/vcontext"
 	"github.com/Schaudge/grailbio/biopb"
 	gbam "github.com/Schaudge/grailbio/encoding/bam"
+	"github.com/Schaudge/grailbio/encoding/fasta"
 	"github.com/Schaudge/grailbio/encoding/pam/fieldio"
 	"github.com/Schaudge/grailbio/encoding/pam/pamutil"
 	"github.com/Schaudge/hts/sam"
@@ -26,6 +27,10 @@ import (
 // ReadOpts defines configuration parameters for PAM readers.
 type ReadOpts struct {
 	// DropFields causes the listed fields not to be filled in Read().
+	// Dropping FieldAux drops only the aux tags that are not promoted to their
+	// own columns (WriteOpts.PromotedAuxTags). A promoted tag is dropped by
+	// listing gbam.AuxTagField(tag); such fields are ignored if the tag is not
+	// promoted in the PAM file.
 	DropFields []gbam.FieldType
 
 	// Optional row shard range. Only records in this range will be returned
@@ -41,6 +46,38 @@ type ReadOpts struct {
 	// reported as not found.  This flag is passed to file.Opts. See file.Opts for
 	// more details.
 	RetryWhenNotFound bool
+
+	// Reference is the genome used to decode the seq field of PAM files
+	// written with WriteOpts.Reference. It must have the same sequences as the
+	// reference used to write the file. It is not needed if FieldSeq is
+	// dropped.
+	Reference fasta.Fasta
+
+	// ReferenceM5Cache, if non-nil, caches the M5 of the Reference sequences,
+	// which are checked against those recorded in each shard. NewReader
+	// creates one for its shards if it is nil; set it to share the cache
+	// between readers of the same Reference.
+	ReferenceM5Cache *pamutil.ReferenceM5Cache
+
+	// BlockFilter, if non-nil, is called with the stats of each recordio block
+	// of the fields to be read. If it returns false, the block is not read, and
+	// none of the records stored in the block are returned. The filter must
+	// return true if any record summarized by the stats may be needed. Since it
+	// cannot reject individual records, the caller still needs to check each
+	// record returned by the reader.
+	//
+	// Blocks in PAM files written before the stats were introduced are always
+	// read.
+	BlockFilter func(stats *biopb.PAMBlockStats) bool
+
+	// Filter, if non-nil, is called for each record in the range. Records for
+	// which it returns false are not returned by Scan(). The filter is called
+	// before the variable-length fields are decoded: only Ref, Pos, Flags,
+	// MapQ, MateRef, MatePos and TempLen are filled in the record passed to it,
+	// and the record must not be retained after the call. Fields listed in
+	// DropFields are not filled either. The Name, Cigar, Seq, Qual and
+	// AuxFields of the rejected records are skipped without being decoded.
+	Filter func(r *sam.Record) bool
 }
 
 // ShardReader is for reading one PAM rowshard. This class is generally hidden
@@ -65,6 +102,30 @@ type ShardReader struct {
 	shardRange   biopb.CoordRange // row range parsed out of the filename.
 	nRecords     int              // # records read so far
 	err          *errors.Once     // Points to Reader.err
+
+	// Readers for the promoted aux tags, minus the ones in ReadOpts.DropFields.
+	auxReaders []*fieldio.Reader
+	// Readers of all the fields other than FieldCoord.
+	columns []fieldSeeker
+
+	// Copies of ReadOpts.BlockFilter and ReadOpts.Filter.
+	blockFilter func(stats *biopb.PAMBlockStats) bool
+	filter      func(r *sam.Record) bool
+
+	auxMds    []fieldio.AuxMetadata // Temp for reading auxReaders
+	auxValues []sam.Aux             // Temp for reading auxReaders
+	auxPos    []fieldio.AuxPos      // Temp for reading auxReaders
+
+	// Reference used to decode the seq field. nil unless the seq field is
+	// encoded with a reference. It is a copy of ReadOpts.Reference.
+	reference fasta.Fasta
+	// dropCigar is set if the cigar field is read only for decoding the seq
+	// field.
+	dropCigar bool
+	// unsorted is set if the records of the shard are not sorted by
+	// coordinate. The coordinates read from the coord field are then the
+	// ordinals of the records; see fieldio.NextUnsortedCoord.
+	unsorted bool
 }
 
 var (
@@ -108,19 +169,111 @@ func GetDummySeq(length int) sam.Seq {
 	return sam.Seq{Length: length, Seq: newBuf[:n]}
 }
 
+// fieldSkippers lists the functions for skipping one value of each field other
+// than FieldCoord.
+var fieldSkippers = []struct {
+	field gbam.FieldType
+	skip  func(*fieldio.Reader)
+}{
+	{gbam.FieldFlags, (*fieldio.Reader).SkipUint16Field},
+	{gbam.FieldMapq, (*fieldio.Reader).SkipUint8Field},
+	{gbam.FieldMateRefID, func(fr *fieldio.Reader) { fr.ReadVarintDeltaField() }},
+	{gbam.FieldMatePos, func(fr *fieldio.Reader) { fr.ReadVarintDeltaField() }},
+	{gbam.FieldTempLen, func(fr *fieldio.Reader) { fr.ReadVarintField() }},
+	{gbam.FieldCigar, (*fieldio.Reader).SkipCigarField},
+	{gbam.FieldName, (*fieldio.Reader).SkipStringDeltaField},
+	{gbam.FieldSeq, (*fieldio.Reader).SkipSeqField},
+	{gbam.FieldQual, (*fieldio.Reader).SkipBytesField},
+	{gbam.FieldAux, (*fieldio.Reader).SkipAuxField},
+}
+
+// readCoveredCoord reads the coordinate of the next record whose fields are
+// stored in blocks that passed ReadOpts.BlockFilter. Values of the records
+// stored in dropped blocks are skipped.
+func (r *ShardReader) readCoveredCoord() (biopb.Coord, bool) {
+	for {
+		coord, ok := r.fieldReaders[gbam.FieldCoord].ReadCoordField()
+		if !ok || r.blockFilter == nil {
+			return coord, ok
+		}
+		covered := true
+		for _, c := range r.columns {
+			if !c.r.Covers(coord) {
+				covered = false
+				break
+			}
+		}
+		if covered {
+			return coord, true
+		}
+		if coord.GE(r.requestedRange.Limit) {
+			return coord, true
+		}
+		for _, c := range r.columns {
+			if c.r.Covers(coord) {
+				c.Skip()
+			}
+		}
+	}
+}
+
 // Read one record from the buffer "rb". prevRec is used to delta-decode some
 // fields.
 func (r *ShardReader) readRecord() *sam.Record {
+	for {
+		rec, coord, ok := r.readFixedFields()
+		if !ok {
+			return nil
+		}
+		if r.filter == nil || r.filter(rec) {
+			return r.readVariableFields(rec, coord)
+		}
+		sam.PutInFreePool(rec)
+		if coord.GE(r.requestedRange.Limit) {
+			return nil
+		}
+		for _, c := range r.columns {
+			if c.variable {
+				c.Skip()
+			}
+		}
+	}
+}
+
+// isVariableField checks if the field is read by readVariableFields.
+func isVariableField(f gbam.FieldType) bool {
+	switch f {
+	case gbam.FieldCigar, gbam.FieldName, gbam.FieldSeq, gbam.FieldQual, gbam.FieldAux:
+		return true
+	}
+	return false
+}
+
+// readFixedFields reads the coordinate, flags, mapq, mate and templen fields of
+// the next record. These are the fields visible to ReadOpts.Filter.
+func (r *ShardReader) readFixedFields() (*sam.Record, biopb.Coord, bool) {
 	refs := r.header.Refs()
-	rec := sam.GetFromFreePool()
 
-	coord, ok := r.fieldReaders[gbam.FieldCoord].ReadCoordField()
+	coord, ok := r.readCoveredCoord()
 	if !ok {
-		return nil
+		return nil, coord, false
 	}
-	if coord.RefId >= 0 {
-		rec.Ref = refs[coord.RefId]
-		rec.Pos = int(coord.Pos)
+	if r.blockFilter != nil && coord.GE(r.requestedRange.Limit) {
+		return nil, coord, false
+	}
+	rec := sam.GetFromFreePool()
+	refID, pos := coord.RefId, coord.Pos
+	if r.unsorted {
+		refID, pos = r.fieldReaders[gbam.FieldCoord].Position()
+	}
+	if refID >= 0 {
+		if int(refID) >= len(refs) {
+			sam.PutInFreePool(rec)
+			r.err.Set(fmt.Errorf("%s: record %+v has invalid reference ID %d", r.label, coord, refID))
+			return nil, coord, false
+		}
+		rec.Ref = refs[refID]
+		rec.Pos = int(pos)
 	} else {
 		rec.Ref = nil
 		rec.Pos = -1
@@ -129,20 +282,23 @@ func (r *ShardReader) readRecord() *sam.Record {
 	if r.needField[gbam.FieldFlags] {
 		flags, ok := r.fieldReaders[gbam.FieldFlags].ReadUint16Field()
 		if !ok {
-			return nil
+			sam.PutInFreePool(rec)
+			return nil, coord, false
 		}
 		rec.Flags = sam.Flags(flags)
 	}
 	if r.needField[gbam.FieldMapq] {
 		rec.MapQ, ok = r.fieldReaders[gbam.FieldMapq].ReadUint8Field()
 		if !ok {
-			return nil
+			sam.PutInFreePool(rec)
+			return nil, coord, false
 		}
 	}
 	if r.needField[gbam.FieldMateRefID] {
 		mateRefID, ok := r.fieldReaders[gbam.FieldMateRefID].ReadVarintDeltaField()
 		if !ok {
-			return nil
+			sam.PutInFreePool(rec)
+			return nil, coord, false
 		}
 		rec.MateRef = nil
 		if mateRefID >= 0 {
@@ -152,18 +308,26 @@ func (r *ShardReader) readRecord() *sam.Record {
 	if r.needField[gbam.FieldMatePos] {
 		matePos, ok := r.fieldReaders[gbam.FieldMatePos].ReadVarintDeltaField()
 		if !ok {
-			return nil
+			sam.PutInFreePool(rec)
+			return nil, coord, false
 		}
 		rec.MatePos = int(matePos)
 	}
 	if r.needField[gbam.FieldTempLen] {
 		tempLen, ok := r.fieldReaders[gbam.FieldTempLen].ReadVarintField()
 		if !ok {
-			return nil
+			sam.PutInFreePool(rec)
+			return nil, coord, false
 		}
 		rec.TempLen = int(tempLen)
 	}
+	return rec, coord, true
+}
 
+// readVariableFields reads the rest of the fields of the record whose fixed
+// fields were read by readFixedFields.
+func (r *ShardReader) readVariableFields(rec *sam.Record, coord biopb.Coord) *sam.Record {
+	var ok bool
 	// Collect the length info for variable-length fields.
 	arenaBytes := 0
 	nCigarOps := 0
@@ -182,8 +346,14 @@ func (r *ShardReader) readRecord() *sam.Record {
 		arenaBytes += nameMd.PrefixLen + nameMd.DeltaLen
 	}
 	rec.Seq.Length = 0
+	refSeqMd := fieldio.RefSeqMetadata{}
 	if r.needField[gbam.FieldSeq] {
-		if rec.Seq.Length, ok = r.fieldReaders[gbam.FieldSeq].ReadSeqMetadata(); !ok {
+		if r.reference != nil {
+			if refSeqMd, ok = r.fieldReaders[gbam.FieldSeq].ReadRefSeqMetadata(); !ok {
+				return nil
+			}
+			rec.Seq.Length = refSeqMd.Length
+		} else if rec.Seq.Length, ok = r.fieldReaders[gbam.FieldSeq].ReadSeqMetadata(); !ok {
 			return nil
 		}
 		arenaBytes += fieldio.SeqBytes(rec.Seq.Length)
@@ -201,13 +371,24 @@ func (r *ShardReader) readRecord() *sam.Record {
 		if auxMd, ok = r.fieldReaders[gbam.FieldAux].ReadAuxMetadata(); !ok {
 			return nil
 		}
-		// Round up to the next CPU word boundary, since we will store
-		// pointers in the arena.
-		const pointerSize = int(unsafe.Sizeof(uintptr(0)))
-		arenaBytes += len(auxMd.Tags)*fieldio.SizeofSliceHeader + pointerSize
-		for _, tag := range auxMd.Tags {
-			arenaBytes += len(tag.Name) + tag.Len
+		arenaBytes += auxArenaBytes(auxMd)
+	}
+	r.auxMds = r.auxMds[:0]
+	for _, fr := range r.auxReaders {
+		md, ok := fr.ReadAuxMetadata()
+		if !ok {
+			return nil
 		}
+		arenaBytes += auxArenaBytes(md)
+		r.auxMds = append(r.auxMds, md)
+	}
+	if len(r.auxReaders) > 0 {
+		// The merged aux fields; see readPromotedAuxFields.
+		n := len(auxMd.Tags)
+		for _, md := range r.auxMds {
+			n += len(md.Tags)
+		}
+		arenaBytes += n*fieldio.SizeofSliceHeader + int(unsafe.Sizeof(uintptr(0)))
 	}
 	sam.ResizeScratch(&rec.Scratch, arenaBytes)
 	arena := fieldio.NewUnsafeArena(rec.Scratch)
@@ -223,11 +404,15 @@ func (r *ShardReader) readRecord() *sam.Record {
 	switch {
 	case r.needField[gbam.FieldSeq] && r.needField[gbam.FieldQual]:
 		// Common case
-		rec.Seq = r.fieldReaders[gbam.FieldSeq].ReadSeqField(rec.Seq.Length, &arena)
+		if rec.Seq, ok = r.readSeqField(rec, refSeqMd, &arena); !ok {
+			return nil
+		}
 		rec.Qual = r.fieldReaders[gbam.FieldQual].ReadBytesField(qualLen, &arena)
 	case r.needField[gbam.FieldSeq] && !r.needField[gbam.FieldQual]:
 		// Fill qual with garbage data w/ the same length as seq
-		rec.Seq = r.fieldReaders[gbam.FieldSeq].ReadSeqField(rec.Seq.Length, &arena)
+		if rec.Seq, ok = r.readSeqField(rec, refSeqMd, &arena); !ok {
+			return nil
+		}
 		rec.Qual = GetDummyQual(rec.Seq.Length)
 	case !r.needField[gbam.FieldSeq] && r.needField[gbam.FieldQual]:
 		// Fill seq with garbage data w/ the same length as qual
@@ -235,9 +420,16 @@ func (r *ShardReader) readRecord() *sam.Record {
 		rec.Seq = GetDummySeq(len(rec.Qual))
 	}
 
+	if r.dropCigar {
+		rec.Cigar = nil
+	}
+	rec.AuxFields = nil
 	if r.needField[gbam.FieldAux] {
 		rec.AuxFields = r.fieldReaders[gbam.FieldAux].ReadAuxField(auxMd, &arena)
 	}
+	if len(r.auxReaders) > 0 {
+		rec.AuxFields = r.readPromotedAuxFields(rec.AuxFields, &arena)
+	}
 	r.nRecords++
 	if coord.LT(r.requestedRange.Start) {
 		// This can't happen; seek() should have moved the read pointer >=
@@ -250,9 +442,77 @@ func (r *ShardReader) readRecord() *sam.Record {
 	return rec
 }
 
+// readSeqField reads the seq field of the record. The location and the cigar of
+// the record must have been read already. Arg md is used only when the seq
+// field is encoded with a reference.
+func (r *ShardReader) readSeqField(rec *sam.Record, md fieldio.RefSeqMetadata, arena *fieldio.UnsafeArena) (sam.Seq, bool) {
+	fr := r.fieldReaders[gbam.FieldSeq]
+	if r.reference == nil {
+		return fr.ReadSeqField(rec.Seq.Length, arena), true
+	}
+	loc := gbam.CoordFromSAMRecord(rec, 0)
+	ref, err := referenceBases(r.reference, r.header.Refs(), loc, rec.Cigar)
+	if err != nil {
+		r.err.Set(errors.E(err, fmt.Sprintf("%s: read reference at %+v", r.label, loc)))
+		return sam.Seq{}, false
+	}
+	return fr.ReadRefSeqField(md, rec.Cigar, ref, arena), true
+}
+
+// auxArenaBytes computes the arena space needed to read an aux field.
+func auxArenaBytes(md fieldio.AuxMetadata) int {
+	// Round up to the next CPU word boundary, since we will store
+	// pointers in the arena.
+	const pointerSize = int(unsafe.Sizeof(uintptr(0)))
+	n := len(md.Tags)*fieldio.SizeofSliceHeader + pointerSize
+	for _, tag := range md.Tags {
+		n += len(tag.Name) + tag.Len
+	}
+	return n
+}
+
+// readPromotedAuxFields reads the values of the promoted aux tags, and merges
+// them with aux, the other aux fields of the record, so that the fields are in
+// the order they were written.
+func (r *ShardReader) readPromotedAuxFields(aux []sam.Aux, arena *fieldio.UnsafeArena) []sam.Aux {
+	values, pos := r.auxValues[:0], r.auxPos[:0]
+	for i, fr := range r.auxReaders {
+		var v []sam.Aux
+		v, pos = fr.ReadPromotedAuxField(r.auxMds[i], arena, pos)
+		values = append(values, v...)
+	}
+	// Sort the values by their original index. There are only a few of them.
+	for i := 1; i < len(values); i++ {
+		for j := i; j > 0 && pos[j].Index < pos[j-1].Index; j-- {
+			values[j], values[j-1] = values[j-1], values[j]
+			pos[j], pos[j-1] = pos[j-1], pos[j]
+		}
+	}
+	merged := arena.AllocAux(len(aux) + len(values))
+	n, nRest := 0, 0
+	for i, v := range values {
+		for ; nRest < pos[i].Rest && nRest < len(aux); nRest++ {
+			merged[n] = aux[nRest]
+			n++
+		}
+		merged[n] = v
+		n++
+	}
+	copy(merged[n:], aux[nRest:])
+	// Don't keep the record's arena alive.
+	for i := range values {
+		values[i] = nil
+	}
+	r.auxValues, r.auxPos = values[:0], pos[:0]
+	return merged
+}
+
 func validateReadOpts(o *ReadOpts) error {
 	for _, fi := range o.DropFields {
-		if int(fi) < 0 || int(fi) >= gbam.NumFields {
+		if _, ok := fi.AuxTag(); ok {
+			continue
+		}
+		if int(fi) >= gbam.NumFields {
 			return fmt.Errorf("invalid DropField %v in %+v", fi, *o)
 		}
 		if fi == gbam.FieldCoord {
@@ -266,6 +526,8 @@ func validateReadOpts(o *ReadOpts) error {
 type fieldSeeker struct {
 	r    *fieldio.Reader
 	skip func(*fieldio.Reader)
+	// variable is true if the field is read by readVariableFields.
+	variable bool
 }
 
 func (f *fieldSeeker) Seek(requestedRange biopb.CoordRange) (biopb.Coord, bool) {
@@ -279,26 +541,9 @@ func (f *fieldSeeker) Skip() {
 // Set up the reader so that next call to readRecord() will read the first
 // record at or after requestedRange.Start.
 func (r *ShardReader) seek(requestedRange biopb.CoordRange) {
-	var readers []fieldio.ColumnSeeker
-	fields := []struct {
-		field gbam.FieldType
-		skip  func(*fieldio.Reader)
-	}{
-		{gbam.FieldFlags, (*fieldio.Reader).SkipUint16Field},
-		{gbam.FieldMapq, (*fieldio.Reader).SkipUint8Field},
-		{gbam.FieldMateRefID, func(fr *fieldio.Reader) { fr.ReadVarintDeltaField() }},
-		{gbam.FieldMatePos, func(fr *fieldio.Reader) { fr.ReadVarintDeltaField() }},
-		{gbam.FieldTempLen, func(fr *fieldio.Reader) { fr.ReadVarintField() }},
-		{gbam.FieldCigar, (*fieldio.Reader).SkipCigarField},
-		{gbam.FieldName, (*fieldio.Reader).SkipStringDeltaField},
-		{gbam.FieldSeq, (*fieldio.Reader).SkipSeqField},
-		{gbam.FieldQual, (*fieldio.Reader).SkipBytesField},
-		{gbam.FieldAux, (*fieldio.Reader).SkipAuxField},
-	}
-	for _, d := range fields {
-		if fr := r.fieldReaders[d.field]; fr != nil {
-			readers = append(readers, &fieldSeeker{fr, d.skip})
-		}
+	readers := make([]fieldio.ColumnSeeker, len(r.columns))
+	for i := range r.columns {
+		readers[i] = &r.columns[i]
 	}
 	r.err.Set(fieldio.SeekReaders(requestedRange, r.fieldReaders[gbam.FieldCoord], readers))
 }
@@ -319,13 +564,20 @@ func NewShardReader(
 		path:           pamIndex.Dir,
 		shardRange:     pamIndex.Range,
 		requestedRange: opts.Range,
+		blockFilter:    opts.BlockFilter,
+		filter:         opts.Filter,
 		err:            errp,
 	}
 	vlog.VI(1).Infof("%v: NewShardReader", r.label)
 	for i := range r.needField {
 		r.needField[i] = true
 	}
+	dropAuxTag := map[sam.Tag]bool{}
 	for _, f := range opts.DropFields {
+		if tag, ok := f.AuxTag(); ok {
+			dropAuxTag[tag] = true
+			continue
+		}
 		r.needField[f] = false
 	}
 	var err error
@@ -343,6 +595,30 @@ func NewShardReader(
 	if !r.requestedRange.Intersects(r.shardRange) {
 		vlog.Panicf("%v: Range doesn't intersect", r.label)
 	}
+	features, err := pamutil.ParseShardVersion(r.index.Version)
+	if err != nil {
+		r.err.Set(errors.E(err, fmt.Sprintf("newshardreader %s", r.path)))
+		return r
+	}
+	if features.Unsorted {
+		if !r.requestedRange.EQ(gbam.UniversalRange) {
+			r.err.Set(fmt.Errorf("newshardreader %s: the records are not sorted by coordinate, so ReadOpts.Range must be empty, but found %+v",
+				r.path, r.requestedRange))
+			return r
+		}
+		r.unsorted = true
+	}
+	if features.RefSeq && r.needField[gbam.FieldSeq] {
+		if err := r.setReference(opts.Reference, opts.ReferenceM5Cache); err != nil {
+			r.err.Set(err)
+			return r
+		}
+		// The cigar is needed to decode the seq field.
+		if !r.needField[gbam.FieldCigar] {
+			r.needField[gbam.FieldCigar] = true
+			r.dropCigar = true
+		}
+	}
 
 	for f := range r.needField {
 		if r.needField[f] {
@@ -353,7 +629,14 @@ func NewShardReader(
 				pamutil.CoordRangePathString(r.requestedRange),
 				gbam.FieldType(f))
 			fileOpts := file.Opts{RetryWhenNotFound: opts.RetryWhenNotFound}
-			r.fieldReaders[f], err = fieldio.NewReader(ctx, path, label, f == int(gbam.FieldCoord), fileOpts, errp)
+			var readerOpts []fieldio.ReaderOpt
+			if f != int(gbam.FieldCoord) && opts.BlockFilter != nil {
+				readerOpts = append(readerOpts, fieldio.BlockFilter(opts.BlockFilter))
+			}
+			if f == int(gbam.FieldCoord) && r.unsorted {
+				readerOpts = append(readerOpts, fieldio.Unsorted())
+			}
+			r.fieldReaders[f], err = fieldio.NewReader(ctx, path, label, f == int(gbam.FieldCoord), fileOpts, errp, readerOpts...)
 			if err != nil {
 				r.err.Set(err)
 				return r
@@ -363,10 +646,71 @@ func NewShardReader(
 			}
 		}
 	}
+	for _, tag := range features.AuxTags {
+		if dropAuxTag[tag] {
+			continue
+		}
+		field := gbam.AuxTagField(tag).String()
+		path := pamutil.FieldDataPath(pamIndex.Dir, pamIndex.Range, field)
+		label := fmt.Sprintf("%s:s%s:u%s(%s)",
+			file.Base(pamIndex.Dir),
+			pamutil.CoordRangePathString(pamIndex.Range),
+			pamutil.CoordRangePathString(r.requestedRange),
+			field)
+		fileOpts := file.Opts{RetryWhenNotFound: opts.RetryWhenNotFound}
+		var readerOpts []fieldio.ReaderOpt
+		if opts.BlockFilter != nil {
+			readerOpts = append(readerOpts, fieldio.BlockFilter(opts.BlockFilter))
+		}
+		fr, err := fieldio.NewReader(ctx, path, label, false, fileOpts, errp, readerOpts...)
+		if err != nil {
+			r.err.Set(err)
+			return r
+		} else if fr == nil {
+			r.err.Set(fmt.Errorf("missing file for %s: %s", label, path))
+			return r
+		}
+		r.auxReaders = append(r.auxReaders, fr)
+	}
+	for _, d := range fieldSkippers {
+		if fr := r.fieldReaders[d.field]; fr != nil {
+			skip := d.skip
+			if d.field == gbam.FieldSeq && features.RefSeq {
+				skip = (*fieldio.Reader).SkipRefSeqField
+			}
+			r.columns = append(r.columns, fieldSeeker{fr, skip, isVariableField(d.field)})
+		}
+	}
+	for _, fr := range r.auxReaders {
+		r.columns = append(r.columns, fieldSeeker{fr, (*fieldio.Reader).SkipPromotedAuxField, true})
+	}
 	r.seek(r.requestedRange)
 	return r
 }
 
+// setReference checks that the reference matches the one used to encode the
+// seq field of the shard.
+func (r *ShardReader) setReference(fa fasta.Fasta, m5Cache *pamutil.ReferenceM5Cache) error {
+	if fa == nil {
+		return fmt.Errorf("newshardreader %s: the seq field is encoded with a reference; ReadOpts.Reference must be set", r.path)
+	}
+	refs := r.header.Refs()
+	for i, m5 := range r.index.ReferenceM5 {
+		if m5 == "" || i >= len(refs) {
+			continue
+		}
+		got, err := m5Cache.ReferenceM5(fa, refs[i].Name())
+		if err != nil {
+			return errors.E(err, fmt.Sprintf("newshardreader %s: reference %s", r.path, refs[i].Name()))
+		}
+		if got != m5 {
+			return fmt.Errorf("newshardreader %s: M5 of reference %s is %s; expect %s", r.path, refs[i].Name(), got, m5)
+		}
+	}
+	r.reference = fa
+	return nil
+}
+
 // Close must be called exactly once. After close, no method may be called.
 func (r *ShardReader) Close(ctx context.Context) {
 	for f := range r.fieldReaders {
@@ -374,6 +718,9 @@ func (r *ShardReader) Close(ctx context.Context) {
 			fr.Close(ctx)
 		}
 	}
+	for _, fr := range r.auxReaders {
+		fr.Close(ctx)
+	}
 }
 
 // Reader is the main PAM reader class. It can read across multiple rowshard
@@ -390,6 +737,9 @@ type Reader struct {
 	// Current rowshard reader.
 	r *ShardReader
 
+	// Metadata stored in the index of the first shard.
+	metadata map[string]string
+
 	// Object returned by Record().
 	rec *sam.Record
 
@@ -407,6 +757,9 @@ func NewReader(opts ReadOpts, dir string) *Reader {
 	if r.err.Err() != nil {
 		return r
 	}
+	if r.opts.ReferenceM5Cache == nil {
+		r.opts.ReferenceM5Cache = pamutil.NewReferenceM5Cache()
+	}
 	r.label = fmt.Sprintf("%s:u%s", file.Base(dir), pamutil.CoordRangePathString(r.opts.Range))
 	var err error
 	if r.indexFiles, err = pamutil.FindIndexFilesInRange(r.ctx, dir, r.opts.Range); err != nil {
@@ -419,6 +772,7 @@ func NewReader(opts ReadOpts, dir string) *Reader {
 	}
 	vlog.VI(1).Infof("Found index files in range %+v: %+v", r.opts.Range, r.indexFiles)
 	r.r = NewShardReader(r.ctx, r.opts, r.indexFiles[0], &r.err)
+	r.metadata = r.r.index.Metadata
 	r.indexFiles = r.indexFiles[1:]
 	return r
 }
@@ -468,6 +822,13 @@ func (r *Reader) Scan() bool {
 	}
 }
 
+// Metadata returns the key/value metadata stored in the first shard read by
+// the reader. Shards written by a single Writer configuration carry the same
+// metadata. The caller must not modify the returned map.
+func (r *Reader) Metadata() map[string]string {
+	return r.metadata
+}
+
 // Err returns any error encountered so far.
 //
 // Note: Err never returns io.EOF. On EOF, Scan() returns false, and Err()
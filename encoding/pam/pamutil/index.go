@@ -34,8 +34,8 @@ func ReadShardIndex(ctx context.Context, dir string, recRange biopb.CoordRange)
 	if index.Magic != ShardIndexMagic {
 		return index, fmt.Errorf("readshardindex %s: wrong index version '%v'; expect '%v'", dir, index.Magic, ShardIndexMagic)
 	}
-	if index.Version != DefaultVersion {
-		return index, fmt.Errorf("readshardindex %s: wrong PAM version '%v'; expect '%v'", dir, index.Version, DefaultVersion)
+	if _, err = ParseShardVersion(index.Version); err != nil {
+		return index, fmt.Errorf("readshardindex %s: %v", dir, err)
 	}
 	return index, rio.Err()
 }
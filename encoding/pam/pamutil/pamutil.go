@@ -2,16 +2,88 @@ package pamutil
 
 import (
 	"fmt"
+	"strings"
 
 	"github.com/Schaudge/grailbase/backgroundcontext"
 	"github.com/Schaudge/grailbase/file"
 	"github.com/Schaudge/grailbio/biopb"
 	gbam "github.com/Schaudge/grailbio/encoding/bam"
+	"github.com/Schaudge/hts/sam"
 )
 
 // DefaultVersion is the string embedded in ShardIndex.version.
 const DefaultVersion = "PAM2"
 
+// ShardFeatures lists the optional encodings used by a PAM shard. They are
+// recorded in ShardIndex.version as "+"-separated suffixes of DefaultVersion,
+// e.g., "PAM2+aux:RG,MI+refseq". Readers that predate a feature reject such a
+// version.
+type ShardFeatures struct {
+	// AuxTags lists the aux tags that are stored in their own column files.
+	AuxTags []sam.Tag
+	// RefSeq is true if the seq field is encoded as differences from the
+	// reference.
+	RefSeq bool
+	// Unsorted is true if the records are stored in the order they were
+	// written, not in coordinate order. The block addresses of such a shard
+	// are record ordinals; see fieldio.NextUnsortedCoord.
+	Unsorted bool
+}
+
+const (
+	auxTagsFeature  = "aux:"
+	refSeqFeature   = "refseq"
+	unsortedFeature = "unsorted"
+)
+
+// ShardVersion returns the value of ShardIndex.version for a shard that uses
+// the given features. It returns DefaultVersion if no feature is used.
+func ShardVersion(features ShardFeatures) string {
+	version := DefaultVersion
+	if len(features.AuxTags) > 0 {
+		names := make([]string, len(features.AuxTags))
+		for i, tag := range features.AuxTags {
+			names[i] = tag.String()
+		}
+		version += "+" + auxTagsFeature + strings.Join(names, ",")
+	}
+	if features.RefSeq {
+		version += "+" + refSeqFeature
+	}
+	if features.Unsorted {
+		version += "+" + unsortedFeature
+	}
+	return version
+}
+
+// ParseShardVersion parses a ShardIndex.version string and returns the
+// features used by the shard.
+func ParseShardVersion(version string) (ShardFeatures, error) {
+	var features ShardFeatures
+	parts := strings.Split(version, "+")
+	if parts[0] != DefaultVersion {
+		return features, fmt.Errorf("wrong PAM version '%v'; expect '%v'", version, DefaultVersion)
+	}
+	for _, part := range parts[1:] {
+		switch {
+		case strings.HasPrefix(part, auxTagsFeature):
+			for _, name := range strings.Split(part[len(auxTagsFeature):], ",") {
+				if len(name) != 2 {
+					return features, fmt.Errorf("wrong PAM version '%v': invalid aux tag '%v'", version, name)
+				}
+				features.AuxTags = append(features.AuxTags, sam.NewTag(name))
+			}
+		case part == refSeqFeature:
+			features.RefSeq = true
+		case part == unsortedFeature:
+			features.Unsorted = true
+		default:
+			return features, fmt.Errorf("wrong PAM version '%v': unknown feature '%v'", version, part)
+		}
+	}
+	return features, nil
+}
+
 // ShardIndexMagic is the value of ShardIndex.Magic.
 const ShardIndexMagic = uint64(0x725c7226be794c60)
 
@@ -1,11 +1,17 @@
 package pamutil_test
 
 import (
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 
 	"github.com/Schaudge/grailbio/biopb"
 	gbam "github.com/Schaudge/grailbio/encoding/bam"
+	"github.com/Schaudge/grailbio/encoding/fasta"
 	"github.com/Schaudge/grailbio/encoding/pam/pamutil"
+	"github.com/Schaudge/hts/sam"
+	"github.com/grailbio/testutil/assert"
 	"github.com/grailbio/testutil/expect"
 )
 
@@ -113,6 +119,35 @@ func TestFieldType(t *testing.T) {
 	expect.EQ(t, gbam.FieldCoord, f)
 }
 
+func TestShardVersion(t *testing.T) {
+	expect.EQ(t, pamutil.ShardVersion(pamutil.ShardFeatures{}), pamutil.DefaultVersion)
+	features, err := pamutil.ParseShardVersion(pamutil.DefaultVersion)
+	expect.NoError(t, err)
+	expect.EQ(t, features, pamutil.ShardFeatures{})
+
+	for _, test := range []struct {
+		features pamutil.ShardFeatures
+		version  string
+	}{
+		{pamutil.ShardFeatures{AuxTags: []sam.Tag{sam.NewTag("RG"), sam.NewTag("MI")}}, "PAM2+aux:RG,MI"},
+		{pamutil.ShardFeatures{RefSeq: true}, "PAM2+refseq"},
+		{pamutil.ShardFeatures{AuxTags: []sam.Tag{sam.NewTag("RG")}, RefSeq: true}, "PAM2+aux:RG+refseq"},
+		{pamutil.ShardFeatures{Unsorted: true}, "PAM2+unsorted"},
+		{pamutil.ShardFeatures{RefSeq: true, Unsorted: true}, "PAM2+refseq+unsorted"},
+	} {
+		version := pamutil.ShardVersion(test.features)
+		expect.EQ(t, version, test.version)
+		features, err = pamutil.ParseShardVersion(version)
+		expect.NoError(t, err)
+		expect.EQ(t, features, test.features)
+	}
+
+	for _, v := range []string{"PAM1", "PAM2+aux:", "PAM2+aux:RGX", "PAM2+foo"} {
+		_, err = pamutil.ParseShardVersion(v)
+		expect.Regexp(t, err, "wrong PAM version", "version %v", v)
+	}
+}
+
 func TestCoord(t *testing.T) {
 	tests := []struct {
 		r0, r1 biopb.Coord
@@ -131,3 +166,69 @@ func TestCoord(t *testing.T) {
 		expect.EQ(t, test.ge, test.r0.GE(test.r1), "GE: %+v", test)
 	}
 }
+
+// countingFasta counts the calls to Get and Len.
+type countingFasta struct {
+	fasta.Fasta
+	n, lenCalls int32
+}
+
+func (f *countingFasta) Len(name string) (uint64, error) {
+	atomic.AddInt32(&f.lenCalls, 1)
+	return f.Fasta.Len(name)
+}
+
+func (f *countingFasta) Get(name string, start, end uint64) (string, error) {
+	atomic.AddInt32(&f.n, 1)
+	return f.Fasta.Get(name, start, end)
+}
+
+func TestReferenceM5(t *testing.T) {
+	newFasta := func(seq string) *countingFasta {
+		fa, err := fasta.New(strings.NewReader(">chr1\n" + seq + "\n"))
+		assert.NoError(t, err)
+		return &countingFasta{Fasta: fa}
+	}
+	fa := newFasta("acgtN")
+	cache := pamutil.NewReferenceM5Cache()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m5, err := cache.ReferenceM5(fa, "chr1")
+			expect.NoError(t, err)
+			// MD5 of "ACGTN".
+			expect.EQ(t, m5, "252fe4e1c9aa67ce660443056dfa3799")
+		}()
+	}
+	wg.Wait()
+	// The sequence is read once, and the cache is keyed by the Fasta instance.
+	expect.EQ(t, fa.n, int32(1))
+	other := newFasta("ACGTA")
+	m5, err := cache.ReferenceM5(fa, "chr1")
+	assert.NoError(t, err)
+	otherM5, err := cache.ReferenceM5(other, "chr1")
+	assert.NoError(t, err)
+	expect.NEQ(t, otherM5, m5)
+	uncached, err := pamutil.ReferenceM5(other, "chr1")
+	assert.NoError(t, err)
+	expect.EQ(t, uncached, otherM5)
+
+	// Errors are not cached.
+	_, err = cache.ReferenceM5(fa, "chr2")
+	expect.NotNil(t, err)
+	_, err = cache.ReferenceM5(fa, "chr2")
+	expect.NotNil(t, err)
+	// One call for the cached chr1, and one for each call for chr2.
+	expect.EQ(t, fa.lenCalls, int32(3))
+
+	// A nil cache computes the M5 on every call.
+	var nilCache *pamutil.ReferenceM5Cache
+	for i := 0; i < 2; i++ {
+		m5, err := nilCache.ReferenceM5(fa, "chr1")
+		assert.NoError(t, err)
+		expect.EQ(t, m5, "252fe4e1c9aa67ce660443056dfa3799")
+	}
+	expect.EQ(t, fa.n, int32(3))
+}
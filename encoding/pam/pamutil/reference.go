@@ -0,0 +1,101 @@
+package pamutil
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"reflect"
+	"sync"
+
+	"github.com/Schaudge/grailbio/encoding/fasta"
+)
+
+// ReferenceM5Cache caches the M5 of reference sequences, by Fasta instance and
+// sequence name, so that each sequence is read once even when many PAM shards
+// are read or written concurrently. It is scoped to its owner, e.g., a
+// pam.Reader or a bamprovider.Provider, and keeps a reference to each Fasta
+// passed to it until it is garbage collected. Errors are not cached.
+//
+// A nil *ReferenceM5Cache is valid, and caches nothing.
+type ReferenceM5Cache struct {
+	mu      sync.Mutex
+	entries map[referenceM5Key]*referenceM5Entry
+}
+
+type referenceM5Key struct {
+	fa   fasta.Fasta
+	name string
+}
+
+type referenceM5Entry struct {
+	done chan struct{} // closed once m5 and err are set.
+	m5   string
+	err  error
+}
+
+// NewReferenceM5Cache creates an empty cache.
+func NewReferenceM5Cache() *ReferenceM5Cache {
+	return &ReferenceM5Cache{entries: map[referenceM5Key]*referenceM5Entry{}}
+}
+
+// ReferenceM5 returns pamutil.ReferenceM5(fa, name). It is computed once per
+// sequence, and concurrent calls for the sequence wait for the result. If the
+// computation fails, the next call computes it again.
+func (c *ReferenceM5Cache) ReferenceM5(fa fasta.Fasta, name string) (string, error) {
+	if c == nil || fa == nil || !reflect.TypeOf(fa).Comparable() {
+		return ReferenceM5(fa, name)
+	}
+	key := referenceM5Key{fa, name}
+	c.mu.Lock()
+	if e := c.entries[key]; e != nil {
+		c.mu.Unlock()
+		<-e.done
+		return e.m5, e.err
+	}
+	e := &referenceM5Entry{done: make(chan struct{})}
+	c.entries[key] = e
+	c.mu.Unlock()
+
+	e.m5, e.err = ReferenceM5(fa, name)
+	if e.err != nil {
+		// Drop the entry, so that later calls retry.
+		c.mu.Lock()
+		delete(c.entries, key)
+		c.mu.Unlock()
+	}
+	close(e.done)
+	return e.m5, e.err
+}
+
+// ReferenceM5 computes the M5 of the named sequence in the reference, as
+// defined for the M5 tag of SAM @SQ lines: the MD5 of the sequence in upper
+// case, as a hex string. The reference must be ASCII encoded (the default of
+// fasta.New).
+func ReferenceM5(fa fasta.Fasta, name string) (string, error) {
+	length, err := fa.Len(name)
+	if err != nil {
+		return "", err
+	}
+	const chunkSize = 1 << 20
+	h := md5.New()
+	buf := make([]byte, 0, chunkSize)
+	for start := uint64(0); start < length; start += chunkSize {
+		end := start + chunkSize
+		if end > length {
+			end = length
+		}
+		bases, err := fa.Get(name, start, end)
+		if err != nil {
+			return "", err
+		}
+		buf = buf[:0]
+		for i := 0; i < len(bases); i++ {
+			b := bases[i]
+			if b >= 'a' && b <= 'z' {
+				b -= 'a' - 'A'
+			}
+			buf = append(buf, b)
+		}
+		h.Write(buf) // nolint: errcheck
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -48,8 +48,9 @@ func fieldFileSize(ctx context.Context, dir string, recRange biopb.CoordRange, f
 	return stat.Size()
 }
 
-// readFieldIndex reads the index for, "dir/recRange.field".
-func readFieldIndex(ctx context.Context, dir string, recRange biopb.CoordRange, field string) (index biopb.PAMFieldIndex, err error) {
+// ReadFieldIndex reads the index stored in the trailer of the field file,
+// "dir/recRange.field".
+func ReadFieldIndex(ctx context.Context, dir string, recRange biopb.CoordRange, field string) (index biopb.PAMFieldIndex, err error) {
 	path := FieldDataPath(dir, recRange, field)
 	in, err := file.Open(ctx, path)
 	if err != nil {
@@ -106,7 +107,7 @@ func readAndSubsetIndexes(ctx context.Context, files []FileInfo, recRange biopb.
 			}
 			totalFileBytes += size
 		}
-		index, err := readFieldIndex(ctx, indexFile.Dir, indexFile.Range, sampledField)
+		index, err := ReadFieldIndex(ctx, indexFile.Dir, indexFile.Range, sampledField)
 		if err != nil {
 			log.Panicf("%+v: failed to read index: %v", indexFile, err)
 			return nil, err
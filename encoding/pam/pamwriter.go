@@ -14,6 +14,7 @@ import (
 	"github.com/Schaudge/grailbase/vcontext"
 	"github.com/Schaudge/grailbio/biopb"
 	gbam "github.com/Schaudge/grailbio/encoding/bam"
+	"github.com/Schaudge/grailbio/encoding/fasta"
 	"github.com/Schaudge/grailbio/encoding/pam/fieldio"
 	"github.com/Schaudge/grailbio/encoding/pam/pamutil"
 	"github.com/Schaudge/hts/sam"
@@ -39,6 +40,42 @@ type WriteOpts struct {
 	// DropFields causes the writer not to write the specified fields to file.
 	DropFields []gbam.FieldType
 
+	// PromotedAuxTags lists the aux tags, e.g., RG or UB, that are stored in
+	// their own column files instead of the aux field file. Each tag can then
+	// be read, or dropped, without decoding the other aux tags. The list is
+	// recorded in the shard index, so readers that predate this option fail to
+	// open the shard.
+	PromotedAuxTags []sam.Tag
+
+	// Reference, if non-nil, causes the seq field to be stored as differences
+	// from the reference, using the cigar of each record. The M5 of each
+	// reference sequence used is recorded in the shard index, and the same
+	// reference must be passed in ReadOpts.Reference to read the seq field.
+	// Reference is ignored if the seq or cigar field is dropped.
+	Reference fasta.Fasta
+
+	// ReferenceM5Cache, if non-nil, caches the M5 of the Reference sequences
+	// across writers, e.g., the shards written concurrently by one job.
+	ReferenceM5Cache *pamutil.ReferenceM5Cache
+
+	// QualBinning, if non-nil, causes base qualities to be binned before they
+	// are written. The binning is lossy.
+	QualBinning *gbam.QualBinning
+
+	// Unsorted allows records to be written in any order, e.g., in the order
+	// produced by an aligner, or grouped by query name or UMI. The records are
+	// stored in the order they are written, and the shard is marked as
+	// unsorted in its index. Such a PAM file can only be read sequentially:
+	// ReadOpts.Range must be empty, and the file has only one shard, so Range
+	// must be empty too. The sort order should also be declared in the
+	// SortOrder of the sam.Header passed to NewWriter.
+	Unsorted bool
+
+	// Metadata is stored in the index of every shard, e.g., to record the
+	// provenance of the file. See MetadataCreator etc. for well-known keys. The
+	// writer sets MetadataWriteOpts itself.
+	Metadata map[string]string
+
 	// Transformers defines the recordio block transformers. It can be used to
 	// change the compression algorithm, for example. The value is passed to
 	// recordio.WriteOpts.Transformers. If empty, {"zstd"} is used.
@@ -90,7 +127,28 @@ func validateWriteOpts(o *WriteOpts) error {
 	if len(o.Transformers) == 0 {
 		o.Transformers = []string{"zstd"}
 	}
-	return pamutil.ValidateCoordRange(&o.Range)
+	for _, f := range o.DropFields {
+		if _, ok := f.AuxTag(); ok {
+			return fmt.Errorf("DropFields can't list %v; remove the tag from PromotedAuxTags instead", f)
+		}
+		if int(f) >= gbam.NumFields {
+			return fmt.Errorf("invalid DropField %v", f)
+		}
+	}
+	seen := map[sam.Tag]bool{}
+	for _, tag := range o.PromotedAuxTags {
+		if seen[tag] {
+			return fmt.Errorf("duplicate promoted aux tag %v", tag)
+		}
+		seen[tag] = true
+	}
+	if err := pamutil.ValidateCoordRange(&o.Range); err != nil {
+		return err
+	}
+	if o.Unsorted && !o.Range.EQ(gbam.UniversalRange) {
+		return fmt.Errorf("WriteOpts.Range must be empty for an unsorted PAM file, but found %+v", o.Range)
+	}
+	return nil
 }
 
 // Writer is a class for generating a PAM rowshard.
@@ -104,6 +162,14 @@ type Writer struct {
 
 	bufPool      *fieldio.WriteBufPool
 	fieldWriters [gbam.NumFields]*fieldio.Writer // Writer for each field
+	auxWriters   []*fieldio.Writer               // Writer for each of opts.PromotedAuxTags
+	auxScratch   []sam.Aux                       // Temp for splitting the aux fields
+	auxPos       []fieldio.AuxPos                // Temp for the positions of promoted aux fields
+	refs         []*sam.Reference                // References in the header
+	qualScratch  []byte                          // Temp for binning qualities
+
+	// Address of the next record, if opts.Unsorted.
+	nextUnsorted biopb.Coord
 
 	// Value to be assigned to the "seq" field of a new recBlockWriteBuf.
 	nextBlockSeq int
@@ -114,7 +180,8 @@ type Writer struct {
 // record becomes stable only after a successful Close call. "r" can be recycled
 // after Write returns. This function is thread compatible.
 //
-// REQUIRES: records must be added in increasing position order (Cf. RecAddr).
+// REQUIRES: records must be added in increasing position order (Cf. RecAddr),
+// unless WriteOpts.Unsorted is set.
 func (w *Writer) Write(r *sam.Record) {
 	if w.err.Err() != nil {
 		return
@@ -124,7 +191,17 @@ func (w *Writer) Write(r *sam.Record) {
 		w.err.Set(err)
 		return
 	}
-	addr := w.addrGenerator.GenerateFromRecord(r)
+	// addr is the address of the record in the blocks, and loc is its
+	// location. They differ in an unsorted file.
+	var addr, loc biopb.Coord
+	if w.opts.Unsorted {
+		addr = w.nextUnsorted
+		w.nextUnsorted = fieldio.NextUnsortedCoord(addr)
+		loc = gbam.CoordFromSAMRecord(r, 0)
+	} else {
+		addr = w.addrGenerator.GenerateFromRecord(r)
+		loc = addr
+	}
 	if w.fieldWriters[gbam.FieldCoord] != nil {
 		w.fieldWriters[gbam.FieldCoord].PutCoordField(addr, r.Ref.ID(), r.Pos)
 	}
@@ -150,20 +227,104 @@ func (w *Writer) Write(r *sam.Record) {
 		w.fieldWriters[gbam.FieldName].PutStringDeltaField(addr, r.Name)
 	}
 	if w.fieldWriters[gbam.FieldSeq] != nil {
-		w.fieldWriters[gbam.FieldSeq].PutSeqField(addr, r.Seq)
+		if w.opts.Reference != nil {
+			ref, err := w.referenceBases(loc, r.Cigar)
+			if err != nil {
+				w.err.Set(err)
+				return
+			}
+			w.fieldWriters[gbam.FieldSeq].PutRefSeqField(addr, r.Seq, r.Cigar, ref)
+		} else {
+			w.fieldWriters[gbam.FieldSeq].PutSeqField(addr, r.Seq)
+		}
 	}
 	if w.fieldWriters[gbam.FieldQual] != nil {
-		w.fieldWriters[gbam.FieldQual].PutBytesField(addr, r.Qual)
+		w.fieldWriters[gbam.FieldQual].PutBytesField(addr, w.opts.QualBinning.BinQual(r, &w.qualScratch))
 	}
-	if w.fieldWriters[gbam.FieldAux] != nil {
+	if len(w.auxWriters) > 0 {
+		w.putPromotedAuxFields(addr, r.AuxFields)
+	} else if w.fieldWriters[gbam.FieldAux] != nil {
 		w.fieldWriters[gbam.FieldAux].PutAuxField(addr, r.AuxFields)
 	}
+	for _, fw := range w.fieldWriters {
+		if fw != nil {
+			fw.UpdateStats(r)
+		}
+	}
+	for _, fw := range w.auxWriters {
+		fw.UpdateStats(r)
+	}
 	for _, fw := range w.fieldWriters {
 		if fw != nil && fw.BufLen() >= w.opts.MaxBufSize {
 			fw.FlushBuf()
 			fw.NewBuf()
 		}
 	}
+	for _, fw := range w.auxWriters {
+		if fw.BufLen() >= w.opts.MaxBufSize {
+			fw.FlushBuf()
+			fw.NewBuf()
+		}
+	}
+}
+
+// referenceBases returns the reference bases spanned by the record at loc, and
+// records the M5 of the reference sequence in the shard index.
+func (w *Writer) referenceBases(loc biopb.Coord, cigar sam.Cigar) (string, error) {
+	if loc.RefId >= 0 && int(loc.RefId) < len(w.refs) && w.index.ReferenceM5[loc.RefId] == "" {
+		name := w.refs[loc.RefId].Name()
+		m5, err := w.opts.ReferenceM5Cache.ReferenceM5(w.opts.Reference, name)
+		if err != nil {
+			return "", errors.E(err, fmt.Sprintf("pam writer %s: reference %s", w.label, name))
+		}
+		w.index.ReferenceM5[loc.RefId] = m5
+	}
+	ref, err := referenceBases(w.opts.Reference, w.refs, loc, cigar)
+	if err != nil {
+		return "", errors.E(err, fmt.Sprintf("pam writer %s: read reference at %+v", w.label, loc))
+	}
+	return ref, nil
+}
+
+// putPromotedAuxFields writes the values of each of opts.PromotedAuxTags to its
+// own column, along with their positions in aa, and the rest of the aux fields
+// to the aux field.
+func (w *Writer) putPromotedAuxFields(addr biopb.Coord, aa []sam.Aux) {
+	rest := w.auxScratch[:0]
+	for _, a := range aa {
+		if !w.isPromotedAuxTag(a.Tag()) {
+			rest = append(rest, a)
+		}
+	}
+	if w.fieldWriters[gbam.FieldAux] != nil {
+		w.fieldWriters[gbam.FieldAux].PutAuxField(addr, rest)
+	}
+	for i, tag := range w.opts.PromotedAuxTags {
+		// The values are stored in auxScratch, after the elements of rest.
+		values := rest[len(rest):]
+		pos := w.auxPos[:0]
+		nRest := 0
+		for k, a := range aa {
+			if a.Tag() == tag {
+				values = append(values, a)
+				pos = append(pos, fieldio.AuxPos{Index: k, Rest: nRest})
+			} else if !w.isPromotedAuxTag(a.Tag()) {
+				nRest++
+			}
+		}
+		w.auxWriters[i].PutPromotedAuxField(addr, values, pos)
+		w.auxPos = pos[:0]
+	}
+	w.auxScratch = rest[:0]
+}
+
+func (w *Writer) isPromotedAuxTag(tag sam.Tag) bool {
+	for _, t := range w.opts.PromotedAuxTags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
 }
 
 // Close must be called exactly once. After close, no operation other than Err()
@@ -176,6 +337,10 @@ func (w *Writer) Close() error {
 		}
 		return nil
 	})
+	traverse.Each(len(w.auxWriters), func(i int) error { // nolint: errcheck
+		w.auxWriters[i].Close()
+		return nil
+	})
 	w.bufPool.Finish()
 	if w.err.Err() != nil {
 		return w.err.Err()
@@ -207,10 +372,31 @@ func NewWriter(wo WriteOpts, samHeader *sam.Header, dir string) *Writer {
 			nWrittenFields++
 		}
 	}
+	nWrittenFields += len(w.opts.PromotedAuxTags)
 
 	w.label = fmt.Sprintf("%s:%s", dir, pamutil.CoordRangePathString(w.opts.Range))
 	w.bufPool = fieldio.NewBufPool(w.opts.WriteParallelism * nWrittenFields)
 	w.index = pamutil.NewShardIndex(w.opts.Range, samHeader)
+	if dropField[gbam.FieldSeq] || dropField[gbam.FieldCigar] {
+		// The seq field is decoded using the cigar, so it can be encoded with
+		// the reference only if both are written.
+		w.opts.Reference = nil
+	}
+	if w.opts.Reference != nil {
+		w.refs = samHeader.Refs()
+		w.index.ReferenceM5 = make([]string, len(w.refs))
+	}
+	w.index.Metadata = map[string]string{}
+	for k, v := range w.opts.Metadata {
+		w.index.Metadata[k] = v
+	}
+	w.index.Metadata[MetadataWriteOpts] = describeWriteOpts(w.opts)
+	w.index.Version = pamutil.ShardVersion(pamutil.ShardFeatures{
+		AuxTags:  w.opts.PromotedAuxTags,
+		RefSeq:   w.opts.Reference != nil,
+		Unsorted: w.opts.Unsorted,
+	})
+	w.nextUnsorted = fieldio.FirstUnsortedCoord
 	for f := range w.fieldWriters {
 		if dropField[f] {
 			continue
@@ -221,6 +407,13 @@ func NewWriter(wo WriteOpts, samHeader *sam.Header, dir string) *Writer {
 		fw := fieldio.NewWriter(path, label, w.opts.Transformers, w.bufPool, file.Opts{IgnoreNoSuchUpload: wo.IgnoreNoSuchUpload}, &w.err)
 		w.fieldWriters[f] = fw
 	}
+	for _, tag := range w.opts.PromotedAuxTags {
+		field := gbam.AuxTagField(tag).String()
+		path := pamutil.FieldDataPath(dir, w.opts.Range, field)
+		label := fmt.Sprintf("%s:%s:%s", file.Base(dir), pamutil.CoordRangePathString(w.opts.Range), field)
+		w.auxWriters = append(w.auxWriters,
+			fieldio.NewWriter(path, label, w.opts.Transformers, w.bufPool, file.Opts{IgnoreNoSuchUpload: wo.IgnoreNoSuchUpload}, &w.err))
+	}
 	return w
 }
 
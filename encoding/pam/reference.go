@@ -0,0 +1,35 @@
+// Copyright 2018 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package pam
+
+import (
+	"github.com/Schaudge/grailbio/biopb"
+	"github.com/Schaudge/grailbio/encoding/fasta"
+	"github.com/Schaudge/hts/sam"
+)
+
+// referenceBases returns the reference bases spanned by a record at the given
+// coordinate with the given cigar. The bases are used to encode and decode the
+// seq field relative to the reference. It returns "" if the record is not
+// aligned.
+func referenceBases(fa fasta.Fasta, refs []*sam.Reference, coord biopb.Coord, cigar sam.Cigar) (string, error) {
+	if coord.RefId < 0 || int(coord.RefId) >= len(refs) || len(cigar) == 0 {
+		return "", nil
+	}
+	name := refs[coord.RefId].Name()
+	length, err := fa.Len(name)
+	if err != nil {
+		return "", err
+	}
+	refLen, _ := cigar.Lengths()
+	start, end := uint64(coord.Pos), uint64(coord.Pos)+uint64(refLen)
+	if end > length {
+		end = length
+	}
+	if start >= end {
+		return "", nil
+	}
+	return fa.Get(name, start, end)
+}
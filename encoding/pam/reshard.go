@@ -0,0 +1,160 @@
+// Copyright 2018 GRAIL, Inc. All rights reserved.
+// Use of this source code is governed by the Apache 2.0
+// license that can be found in the LICENSE file.
+
+package pam
+
+import (
+	"fmt"
+	"sync/atomic"
+
+	"github.com/Schaudge/grailbase/errors"
+	"github.com/Schaudge/grailbase/traverse"
+	"github.com/Schaudge/grailbase/vcontext"
+	"github.com/Schaudge/grailbio/biopb"
+	gbam "github.com/Schaudge/grailbio/encoding/bam"
+	"github.com/Schaudge/grailbio/encoding/fasta"
+	"github.com/Schaudge/grailbio/encoding/pam/pamutil"
+	"github.com/Schaudge/hts/sam"
+	"v.io/x/lib/vlog"
+)
+
+// ReshardOpts defines options for Reshard.
+type ReshardOpts struct {
+	// WriteOpts is used to write the new shards. It can change the block size,
+	// the transformers, the dropped fields, and the other encodings of the
+	// input. WriteOpts.Range must be empty.
+	WriteOpts WriteOpts
+
+	// Reference is passed to ReadOpts.Reference. It is needed only if the input
+	// was written with WriteOpts.Reference.
+	Reference fasta.Fasta
+
+	// BytesPerShard is the goal size of each new shard, in terms of the bytes
+	// of the input, across all fields.
+	BytesPerShard int64
+
+	// RecordsPerShard is the goal number of records in each new shard. If both
+	// BytesPerShard and RecordsPerShard are set, a shard is closed when either
+	// goal is reached. If neither is set, a single shard is created.
+	RecordsPerShard int64
+}
+
+// samePosition checks if the two coordinates differ only in Seq.
+func samePosition(c0, c1 biopb.Coord) bool {
+	return c0.RefId == c1.RefId && c0.Pos == c1.Pos
+}
+
+// reshardRanges computes the ranges of the new shards from the block indexes
+// of the input. Shards are split only at block boundaries that are also
+// position boundaries, so records at the same position stay in one shard. The
+// ranges fill the universal range.
+func reshardRanges(opts ReshardOpts, indexes []pamutil.ShardIndex) []biopb.CoordRange {
+	ranges := []biopb.CoordRange{gbam.UniversalRange}
+	var (
+		nBytes, nRecords int64
+		prevEnd          *biopb.Coord
+	)
+	for _, index := range indexes {
+		if len(index.Blocks) == 0 {
+			continue
+		}
+		blockBytes := index.ApproxFileBytes / int64(len(index.Blocks))
+		for i := range index.Blocks {
+			block := &index.Blocks[i]
+			full := (opts.BytesPerShard > 0 && nBytes >= opts.BytesPerShard) ||
+				(opts.RecordsPerShard > 0 && nRecords >= opts.RecordsPerShard)
+			last := &ranges[len(ranges)-1]
+			if full && prevEnd != nil && !samePosition(*prevEnd, block.StartAddr) {
+				limit := biopb.Coord{RefId: block.StartAddr.RefId, Pos: block.StartAddr.Pos}
+				if last.Start.LT(limit) {
+					ranges = append(ranges, biopb.CoordRange{Start: limit, Limit: last.Limit})
+					ranges[len(ranges)-2].Limit = limit
+					nBytes, nRecords = 0, 0
+				}
+			}
+			nBytes += blockBytes
+			nRecords += int64(block.NumRecords)
+			prevEnd = &block.EndAddr
+		}
+	}
+	return ranges
+}
+
+// reshardShard copies the records in range rng of srcDir to a new shard in
+// dir. It returns the number of records copied.
+func reshardShard(opts ReshardOpts, dir, srcDir string, header *sam.Header, indexFiles []pamutil.FileInfo, rng biopb.CoordRange) (int64, error) {
+	wopts := opts.WriteOpts
+	wopts.Range = rng
+	w := NewWriter(wopts, header, dir)
+	err := errors.Once{}
+	var nRecs int64
+	// The input may not cover rng if its shards have gaps.
+	if files, _ := pamutil.ChooseIndexFilesInRange(indexFiles, rng); len(files) > 0 {
+		r := NewReader(ReadOpts{Range: rng, Reference: opts.Reference, ReferenceM5Cache: opts.WriteOpts.ReferenceM5Cache}, srcDir)
+		for w.Err() == nil && r.Scan() {
+			rec := r.Record()
+			w.Write(rec)
+			sam.PutInFreePool(rec)
+			nRecs++
+		}
+		err.Set(r.Close())
+	}
+	err.Set(w.Close())
+	return nRecs, err.Err()
+}
+
+// Reshard rewrites the PAM file in srcDir into a new set of shards in dir,
+// whose sizes are set by opts.BytesPerShard or opts.RecordsPerShard. It is
+// used to even out the shards, e.g., of PAM files created from many sorted
+// runs, or to re-encode a PAM file with different WriteOpts. Existing contents
+// of dir, if any, are deleted. The new shards are written in parallel.
+func Reshard(opts ReshardOpts, dir, srcDir string) error {
+	ctx := vcontext.Background()
+	if dir == srcDir {
+		return fmt.Errorf("reshard %s: the output is also the input", dir)
+	}
+	if err := pamutil.ValidateCoordRange(&opts.WriteOpts.Range); err != nil {
+		return err
+	}
+	if !opts.WriteOpts.Range.EQ(gbam.UniversalRange) {
+		return fmt.Errorf("reshard %s: WriteOpts.Range must be a universal range, but found %+v", dir, opts.WriteOpts.Range)
+	}
+	indexFiles, err := pamutil.ListIndexes(ctx, srcDir)
+	if err != nil {
+		return err
+	}
+	if len(indexFiles) == 0 {
+		return fmt.Errorf("reshard: no pam file found in %s", srcDir)
+	}
+	header, err := readShardHeader(ctx, srcDir, indexFiles[0].Range)
+	if err != nil {
+		return err
+	}
+	var fields []string
+	for f := 0; f < gbam.NumFields; f++ {
+		fields = append(fields, gbam.FieldType(f).String())
+	}
+	indexes, err := pamutil.ReadIndexes(ctx, srcDir, gbam.UniversalRange, fields)
+	if err != nil {
+		return err
+	}
+	ranges := reshardRanges(opts, indexes)
+	vlog.Infof("reshard %s: rewriting %d shards of %s into %d shards", dir, len(indexFiles), srcDir, len(ranges))
+	// Delete existing files to avoid mixing up files from multiple generations.
+	if err := pamutil.Remove(dir); err != nil {
+		return err
+	}
+	if opts.WriteOpts.ReferenceM5Cache == nil {
+		// Shared by the readers and writers of all the shards.
+		opts.WriteOpts.ReferenceM5Cache = pamutil.NewReferenceM5Cache()
+	}
+	var totalRecs int64
+	err = traverse.Each(len(ranges), func(i int) error {
+		nRecs, err := reshardShard(opts, dir, srcDir, header, indexFiles, ranges[i])
+		atomic.AddInt64(&totalRecs, nRecs)
+		return err
+	})
+	vlog.Infof("reshard %s: written %d records, error %v", dir, totalRecs, err)
+	return err
+}
@@ -0,0 +1,397 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"math"
+
+	"github.com/Schaudge/grailbio/pileup"
+	"github.com/Schaudge/hts/sam"
+)
+
+// BAQ (base alignment quality) is computed as in samtools: each read is
+// realigned against the local reference with a profile HMM, and the quality
+// of each aligned base is capped by the posterior probability that the base
+// is aligned where the CIGAR says it is.  Bases whose most likely alignment
+// disagrees with the CIGAR, which mostly happens next to indels, get quality
+// 0.  Soft-clipped and inserted bases are left alone, and so are spliced
+// reads.
+//
+// This is a port of htslib's probaln_glocal() and sam_prob_realn(), without
+// the "extended BAQ" mode.  BAQ only affects SNV counting; indels are counted
+// with the original base qualities.  Like in samtools, BAQ is computed from
+// the base qualities before -clip is applied.
+
+const (
+	baqGapOpen      = 0.001 // probability of opening a gap
+	baqGapExt       = 0.1   // probability of extending a gap
+	baqInsEmit      = 0.25  // emission probability of an inserted base
+	baqMismatchEmit = 1.0 / 3
+	// baqMinBandwidth is the minimum half-width of the band around the
+	// diagonal that the realignment explores.
+	baqMinBandwidth = 7
+)
+
+// baqQualToProb maps phred base-qualities to error probabilities.
+var baqQualToProb [256]float64
+
+func init() {
+	for i := range baqQualToProb {
+		baqQualToProb[i] = math.Pow(10, -float64(i)/10)
+	}
+}
+
+// baqAligner contains the buffers used by the BAQ computation, so that they
+// can be reused across reads.
+type baqAligner struct {
+	f     []float64 // forward matrix, (len(query) + 1) rows
+	b     []float64 // backward matrix, same shape as f
+	s     []float64 // per-row scaling factors
+	qual  []float64 // base-error probabilities
+	state []int     // MAP state of each query base: (refPos << 2) | (0=match, 1=ins)
+	q     []byte    // MAP phred quality of each query base
+	ref   []byte    // reference window, A/C/G/T/X enum
+	query []byte    // read sequence, A/C/G/T/X enum
+}
+
+// resizeFloat64s returns a zeroed slice of length n, reusing buf's memory when
+// possible.
+func resizeFloat64s(buf []float64, n int) []float64 {
+	if cap(buf) < n {
+		return make([]float64, n)
+	}
+	buf = buf[:n]
+	for i := range buf {
+		buf[i] = 0
+	}
+	return buf
+}
+
+func baqEmit(refBase, queryBase byte, errProb float64) float64 {
+	if (refBase == pileup.BaseX) || (queryBase == pileup.BaseX) {
+		return 1
+	}
+	if refBase == queryBase {
+		return 1 - errProb
+	}
+	return errProb * baqMismatchEmit
+}
+
+// probalnGlocal aligns query (with the given base-qualities) to ref, allowing
+// the query to start and end anywhere in ref, and fills in ba.state and ba.q.
+// bw is the band half-width.  It returns false if the alignment failed.
+func (ba *baqAligner) probalnGlocal(ref, query, iqual []byte, bw int) bool {
+	lRef := len(ref)
+	lQuery := len(query)
+	if (lRef == 0) || (lQuery == 0) {
+		return false
+	}
+	lDiff := lRef - lQuery
+	if lDiff < 0 {
+		lDiff = -lDiff
+	}
+	if lRef > lQuery {
+		bw = minInt(bw, lRef)
+	} else {
+		bw = minInt(bw, lQuery)
+	}
+	if bw < lDiff {
+		bw = lDiff
+	}
+	bw2 := bw*2 + 1
+	rowLen := bw2*3 + 6
+	ba.f = resizeFloat64s(ba.f, (lQuery+1)*rowLen)
+	ba.b = resizeFloat64s(ba.b, (lQuery+1)*rowLen)
+	ba.s = resizeFloat64s(ba.s, lQuery+2)
+	ba.qual = resizeFloat64s(ba.qual, lQuery)
+	for i := 0; i < lQuery; i++ {
+		ba.qual[i] = baqQualToProb[iqual[i]]
+	}
+	row := func(m []float64, i int) []float64 {
+		return m[i*rowLen : (i+1)*rowLen]
+	}
+	// setU returns the offset of (query position i, ref position k), both
+	// 1-based, within a banded row.
+	setU := func(i, k int) int {
+		x := i - bw
+		if x < 0 {
+			x = 0
+		}
+		return (k - x + 1) * 3
+	}
+	bandBeg := func(i int) int {
+		if i-bw > 1 {
+			return i - bw
+		}
+		return 1
+	}
+	bandEnd := func(i int) int {
+		return minInt(lRef, i+bw)
+	}
+	s := ba.s
+	qual := ba.qual
+
+	// Transition probabilities between the match (0), insertion (1) and
+	// deletion (2) states.
+	sM := 1 / float64(2*lQuery+2)
+	sI := sM
+	var m [9]float64
+	m[0*3+0] = (1 - 2*baqGapOpen) * (1 - sM)
+	m[0*3+1] = baqGapOpen * (1 - sM)
+	m[0*3+2] = m[0*3+1]
+	m[1*3+0] = (1 - baqGapExt) * (1 - sI)
+	m[1*3+1] = baqGapExt * (1 - sI)
+	m[2*3+0] = 1 - baqGapExt
+	m[2*3+2] = baqGapExt
+	bM := (1 - baqGapOpen) / float64(lRef)
+	bI := baqGapOpen / float64(lRef)
+
+	// Forward.
+	row(ba.f, 0)[setU(0, 0)] = 1
+	s[0] = 1
+	{
+		fi := row(ba.f, 1)
+		end := minInt(lRef, bw+1)
+		sum := 0.0
+		for k := 1; k <= end; k++ {
+			e := baqEmit(ref[k-1], query[0], qual[0])
+			u := setU(1, k)
+			fi[u] = e * bM
+			fi[u+1] = baqInsEmit * bI
+			sum += fi[u] + fi[u+1]
+		}
+		if sum == 0 {
+			return false
+		}
+		s[1] = sum
+		for k := setU(1, 1); k <= setU(1, end)+2; k++ {
+			fi[k] /= sum
+		}
+	}
+	for i := 2; i <= lQuery; i++ {
+		fi := row(ba.f, i)
+		fi1 := row(ba.f, i-1)
+		qli := qual[i-1]
+		qyi := query[i-1]
+		beg := bandBeg(i)
+		end := bandEnd(i)
+		sum := 0.0
+		for k := beg; k <= end; k++ {
+			e := baqEmit(ref[k-1], qyi, qli)
+			u := setU(i, k)
+			v11 := setU(i-1, k-1)
+			v10 := setU(i-1, k)
+			v01 := setU(i, k-1)
+			fi[u] = e * (m[0]*fi1[v11] + m[3]*fi1[v11+1] + m[6]*fi1[v11+2])
+			fi[u+1] = baqInsEmit * (m[1]*fi1[v10] + m[4]*fi1[v10+1])
+			fi[u+2] = m[2]*fi[v01] + m[8]*fi[v01+2]
+			sum += fi[u] + fi[u+1] + fi[u+2]
+		}
+		if sum == 0 {
+			return false
+		}
+		s[i] = sum
+		invSum := 1 / sum
+		for k := setU(i, beg); k <= setU(i, end)+2; k++ {
+			fi[k] *= invSum
+		}
+	}
+	{
+		fl := row(ba.f, lQuery)
+		sum := 0.0
+		for k := 1; k <= lRef; k++ {
+			u := setU(lQuery, k)
+			if (u < 3) || (u >= bw2*3+3) {
+				continue
+			}
+			sum += fl[u]*sM + fl[u+1]*sI
+		}
+		if sum == 0 {
+			return false
+		}
+		s[lQuery+1] = sum
+	}
+
+	// Backward.
+	{
+		bl := row(ba.b, lQuery)
+		for k := 1; k <= lRef; k++ {
+			u := setU(lQuery, k)
+			if (u < 3) || (u >= bw2*3+3) {
+				continue
+			}
+			bl[u] = sM / s[lQuery] / s[lQuery+1]
+			bl[u+1] = sI / s[lQuery] / s[lQuery+1]
+		}
+	}
+	for i := lQuery - 1; i >= 1; i-- {
+		bi := row(ba.b, i)
+		bi1 := row(ba.b, i+1)
+		y := 0.0
+		if i > 1 {
+			y = 1
+		}
+		qli1 := qual[i]
+		qyi1 := query[i]
+		beg := bandBeg(i)
+		end := bandEnd(i)
+		for k := end; k >= beg; k-- {
+			u := setU(i, k)
+			v11 := setU(i+1, k+1)
+			v10 := setU(i+1, k)
+			v01 := setU(i, k+1)
+			e := 0.0
+			if k < lRef {
+				e = baqEmit(ref[k], qyi1, qli1) * bi1[v11]
+			}
+			bi[u] = e*m[0] + baqInsEmit*m[1]*bi1[v10+1] + m[2]*bi[v01+2]
+			bi[u+1] = e*m[3] + baqInsEmit*m[4]*bi1[v10+1]
+			bi[u+2] = (e*m[6] + m[8]*bi[v01+2]) * y
+		}
+		invS := 1 / s[i]
+		for k := setU(i, beg); k <= setU(i, end)+2; k++ {
+			bi[k] *= invS
+		}
+	}
+
+	// Maximum a posteriori alignment.
+	ba.state = ba.state[:0]
+	ba.q = ba.q[:0]
+	for i := 1; i <= lQuery; i++ {
+		fi := row(ba.f, i)
+		bi := row(ba.b, i)
+		sum := 0.0
+		maxZ := 0.0
+		maxK := -1
+		for k := bandBeg(i); k <= bandEnd(i); k++ {
+			u := setU(i, k)
+			z := fi[u] * bi[u]
+			if z > maxZ {
+				maxZ = z
+				maxK = (k - 1) << 2
+			}
+			sum += z
+			z = fi[u+1] * bi[u+1]
+			if z > maxZ {
+				maxZ = z
+				maxK = ((k - 1) << 2) | 1
+			}
+			sum += z
+		}
+		q := 99
+		if sum != 0 {
+			if errProb := 1 - maxZ/sum; errProb > 0 {
+				if q = int(-4.343*math.Log(errProb) + 0.499); q > 100 {
+					q = 99
+				}
+			}
+		}
+		ba.state = append(ba.state, maxK)
+		ba.q = append(ba.q, byte(q))
+	}
+	return true
+}
+
+// apply caps the base-qualities in qual by their BAQ.  qual must initially
+// contain samr's base-qualities; it may be samr.Qual itself.  seq8 is the
+// read's sequence in .bam seq8 encoding, and refSeq8 is the reference
+// sequence, in the same encoding.
+func (ba *baqAligner) apply(samr *sam.Record, seq8 []byte, refSeq8 string, qual []byte) {
+	// Find the aligned part of the read.
+	x := samr.Pos
+	y := 0
+	xb, xe, yb, ye := -1, -1, -1, -1
+	for _, co := range samr.Cigar {
+		l := co.Len()
+		switch co.Type() {
+		case sam.CigarMatch, sam.CigarEqual, sam.CigarMismatch:
+			if yb < 0 {
+				yb = y
+			}
+			if xb < 0 {
+				xb = x
+			}
+			ye = y + l
+			xe = x + l
+			x += l
+			y += l
+		case sam.CigarSoftClipped, sam.CigarInsertion:
+			y += l
+		case sam.CigarDeletion:
+			x += l
+		case sam.CigarSkipped:
+			return
+		}
+	}
+	if yb < 0 {
+		return
+	}
+	lQseq := len(qual)
+
+	// Choose the band width and the reference window.
+	bw := baqMinBandwidth
+	lDiff := (xe - xb) - (ye - yb)
+	if lDiff < 0 {
+		lDiff = -lDiff
+	}
+	if lDiff > bw {
+		bw = lDiff + 3
+	}
+	xb -= yb + bw/2
+	if xb < 0 {
+		xb = 0
+	}
+	xe += lQseq - ye + bw/2
+	if xe-xb-lQseq > bw {
+		xb += (xe - xb - lQseq - bw) / 2
+		xe -= (xe - xb - lQseq - bw) / 2
+	}
+	if xe > len(refSeq8) {
+		xe = len(refSeq8)
+	}
+	ba.ref = ba.ref[:0]
+	for i := xb; i < xe; i++ {
+		ba.ref = append(ba.ref, pileup.Seq8ToEnumTable[refSeq8[i]])
+	}
+	ba.query = ba.query[:0]
+	for i := 0; i < lQseq; i++ {
+		ba.query = append(ba.query, pileup.Seq8ToEnumTable[seq8[i]])
+	}
+	if !ba.probalnGlocal(ba.ref, ba.query, qual, bw) {
+		return
+	}
+
+	// Cap the qualities of the aligned bases.
+	x = samr.Pos
+	y = 0
+	for _, co := range samr.Cigar {
+		l := co.Len()
+		switch co.Type() {
+		case sam.CigarMatch, sam.CigarEqual, sam.CigarMismatch:
+			for i := y; i < y+l; i++ {
+				if ((ba.state[i] & 3) != 0) || (ba.state[i]>>2 != x-xb+(i-y)) {
+					qual[i] = 0
+				} else if ba.q[i] < qual[i] {
+					qual[i] = ba.q[i]
+				}
+			}
+			x += l
+			y += l
+		case sam.CigarSoftClipped, sam.CigarInsertion:
+			y += l
+		case sam.CigarDeletion:
+			x += l
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package snp
+
+import (
+	"testing"
+
+	"github.com/Schaudge/hts/sam"
+	"github.com/grailbio/testutil/assert"
+)
+
+func TestBAQ(t *testing.T) {
+	const left = "GATTACAGGCTTACCGATGA"
+	const right = "TGCAGTCAAGCTTGGAC"
+	refSeq8 := asciiToSeq8(left + "AGTC" + right)
+	ref, _ := sam.NewReference("chr1", "", "", len(refSeq8), nil, nil)
+	tests := []struct {
+		name  string
+		seq   string
+		cigar sam.Cigar
+		want  []byte
+	}{
+		{
+			// The read matches the reference; nothing changes.
+			name:  "match",
+			seq:   left + "AGTC" + right[:6],
+			cigar: []sam.CigarOp{sam.NewCigarOp(sam.CigarMatch, 30)},
+			want:  []byte{30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30},
+		},
+		{
+			// The aligner missed a 4-base deletion, so the bases after it look like
+			// mismatches.  Their BAQ is 0, and the qualities of the bases right
+			// before them are reduced a bit.
+			name:  "missed_deletion",
+			seq:   left + right[:6],
+			cigar: []sam.CigarOp{sam.NewCigarOp(sam.CigarMatch, 26)},
+			want:  []byte{30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 29, 28, 0, 0, 0, 0, 0, 0},
+		},
+		{
+			// Spliced reads are left alone.
+			name: "spliced",
+			seq:  left + right[:6],
+			cigar: []sam.CigarOp{
+				sam.NewCigarOp(sam.CigarMatch, 20),
+				sam.NewCigarOp(sam.CigarSkipped, 4),
+				sam.NewCigarOp(sam.CigarMatch, 6),
+			},
+			want: []byte{30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30},
+		},
+	}
+	var ba baqAligner
+	for _, tt := range tests {
+		qual := make([]byte, len(tt.seq))
+		for i := range qual {
+			qual[i] = 30
+		}
+		samr := &sam.Record{
+			Ref:   ref,
+			Pos:   0,
+			Cigar: tt.cigar,
+			Seq:   sam.NewSeq([]byte(tt.seq)),
+			Qual:  qual,
+		}
+		ba.apply(samr, []byte(asciiToSeq8(tt.seq)), refSeq8, samr.Qual)
+		assert.EQ(t, samr.Qual, tt.want, tt.name)
+	}
+}
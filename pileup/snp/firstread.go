@@ -177,7 +177,9 @@ func (frt *firstreadSNPTable) addOrRemove(readPair *[2]readSNP, samr *sam.Record
 	matePos := PosType(samr.MatePos)
 	pos := PosType(samr.Pos)
 	mapEnd := readPair[0].mapEnd
-	if (strand == pileup.StrandNone) || (matePos >= mapEnd) || (matePos+PosType(maxReadSpan) <= pos) {
+	// Spliced read-pairs whose ends start more than maxReadSpan apart are not
+	// stitched.
+	if (strand == pileup.StrandNone) || (matePos >= mapEnd) || (matePos+PosType(maxReadSpan) <= pos) || (matePos >= pos+PosType(maxReadSpan)) {
 		convertSamr(&(readPair[0]), samr)
 		return 1
 	}
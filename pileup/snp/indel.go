@@ -0,0 +1,272 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"fmt"
+
+	"github.com/Schaudge/grailbio/interval"
+	"github.com/Schaudge/grailbio/pileup"
+	"github.com/Schaudge/hts/sam"
+)
+
+// Indels are reported at their "anchor" position, i.e. the reference position
+// immediately preceding the inserted or deleted bases, following the VCF
+// convention.  Before counting, each indel is left-aligned against the
+// reference, so that equivalent alignments of the same event in a
+// homopolymer or tandem repeat are counted together.  Left-alignment is
+// limited to the span of the read, since the pileup results for positions
+// before the read start may already have been written; this only makes a
+// difference for reads starting inside the repeat.
+//
+// Counting follows the SNP semantics:
+// - An indel is counted when its quality, defined as the minimum base-quality
+//   of the inserted bases and the two read bases flanking the event, is at
+//   least -min-base-qual.
+// - When stitching, an indel in the overlapping part of a read-pair is
+//   counted once if both ends agree, using the stitched quality; if only one
+//   end has it, the ends disagree and it isn't counted (just like a
+//   base-mismatch, which is counted as N).
+// - Indels at the very beginning or end of an alignment, which have no
+//   aligned base on one side, are ignored.
+
+// indelEvent is an indel observed in a single read.
+type indelEvent struct {
+	// anchor is the 0-based reference position of the base preceding the
+	// indel, after left-alignment.
+	anchor PosType
+	// ins is the inserted sequence.  It is in .bam seq8 encoding (one base per
+	// byte) during left-alignment, and ASCII afterwards.  It is empty for a
+	// deletion.
+	ins []byte
+	// delLen is the number of deleted reference bases.  It is zero for an
+	// insertion.
+	delLen PosType
+	// qual is the minimum base-quality of the inserted bases and the read bases
+	// flanking the indel.
+	qual byte
+}
+
+// isAmbiguousSeq8 returns true if b is not one of A/C/G/T.  Indels are not
+// left-aligned past ambiguous bases.
+func isAmbiguousSeq8(b byte) bool {
+	return pileup.Seq8ToEnumTable[b] == pileup.BaseX
+}
+
+// leftAlignDeletion shifts the deletion to the leftmost equivalent position,
+// without moving the anchor before minAnchor.
+func leftAlignDeletion(ev *indelEvent, refSeq8 string, minAnchor PosType) {
+	anchor := ev.anchor
+	// The deleted bases are [anchor + 1, anchor + 1 + delLen).  Shifting the
+	// deletion left by one position is equivalent iff the newly deleted base
+	// equals the newly retained one.
+	for (anchor > minAnchor) && (refSeq8[anchor] == refSeq8[anchor+ev.delLen]) && !isAmbiguousSeq8(refSeq8[anchor]) {
+		anchor--
+	}
+	ev.anchor = anchor
+}
+
+// leftAlignInsertion shifts the insertion to the leftmost equivalent position,
+// rotating the inserted sequence as necessary, without moving the anchor
+// before minAnchor.
+func leftAlignInsertion(ev *indelEvent, refSeq8 string, minAnchor PosType) {
+	ins := ev.ins
+	last := len(ins) - 1
+	anchor := ev.anchor
+	for (anchor > minAnchor) && (refSeq8[anchor] == ins[last]) && !isAmbiguousSeq8(ins[last]) {
+		copy(ins[1:], ins[:last])
+		ins[0] = refSeq8[anchor]
+		anchor--
+	}
+	ev.anchor = anchor
+}
+
+func minQualIn(qual []byte) byte {
+	q := qual[0]
+	for _, x := range qual[1:] {
+		if x < q {
+			q = x
+		}
+	}
+	return q
+}
+
+// alignRelevantIndels 'returns' the read's indels whose (left-aligned)
+// anchors are in loaded BED intervals.  Inserted sequences are converted to
+// ASCII.
+func alignRelevantIndels(result *[]indelEvent, read readSNP, refSeq8 string, bedPart *interval.BEDUnion) (err error) {
+	*result = (*result)[:0]
+	if int(read.mapEnd) > len(refSeq8) {
+		return fmt.Errorf("alignRelevantIndels: reference sequence for %s is missing or too short", read.samr.Ref.Name())
+	}
+	refID := read.samr.Ref.ID()
+	readStart := PosType(read.samr.Pos)
+	cigar := read.samr.Cigar
+	qual := read.samr.Qual
+	// Indels are only reported between two CIGAR-match operations.
+	firstMatch, lastMatch := -1, -1
+	for i, co := range cigar {
+		if co.Type() == sam.CigarMatch {
+			if firstMatch == -1 {
+				firstMatch = i
+			}
+			lastMatch = i
+		}
+	}
+	posInRef := readStart
+	posInRead := PosType(0)
+	for i, co := range cigar {
+		cLen := PosType(co.Len())
+		reportable := (firstMatch < i) && (i < lastMatch)
+		switch co.Type() {
+		case sam.CigarMatch:
+			posInRef += cLen
+			posInRead += cLen
+		case sam.CigarInsertion:
+			if reportable {
+				ev := indelEvent{
+					anchor: posInRef - 1,
+					ins:    append([]byte(nil), read.seq8[posInRead:posInRead+cLen]...),
+					qual:   minQualIn(qual[posInRead-1 : posInRead+cLen+1]),
+				}
+				leftAlignInsertion(&ev, refSeq8, readStart)
+				if bedPart.ContainsByID(refID, ev.anchor) {
+					for j, b := range ev.ins {
+						ev.ins[j] = pileup.Seq8ToASCIITable[b]
+					}
+					*result = append(*result, ev)
+				}
+			}
+			posInRead += cLen
+		case sam.CigarDeletion:
+			if reportable {
+				ev := indelEvent{
+					anchor: posInRef - 1,
+					delLen: cLen,
+					qual:   minQualIn(qual[posInRead-1 : posInRead+1]),
+				}
+				leftAlignDeletion(&ev, refSeq8, readStart)
+				if bedPart.ContainsByID(refID, ev.anchor) {
+					*result = append(*result, ev)
+				}
+			}
+			posInRef += cLen
+		case sam.CigarSkipped:
+			// A skipped region is an intron, not a deletion.
+			posInRef += cLen
+		case sam.CigarSoftClipped:
+			posInRead += cLen
+		case sam.CigarHardClipped:
+			// do nothing
+		default:
+			return fmt.Errorf("alignRelevantIndels: unexpected CIGAR code %v", co)
+		}
+	}
+	return
+}
+
+// spans returns true if the read covers the anchor and the reference base
+// following the indel, so that it can confirm or contradict the indel.
+func (read *readSNP) spans(ev *indelEvent) bool {
+	return (PosType(read.samr.Pos) <= ev.anchor) && (ev.anchor+ev.delLen+1 < read.mapEnd)
+}
+
+// findIndel returns the index of the event in evs with the same anchor and
+// allele as ev, or -1 if there is none.
+func findIndel(evs []indelEvent, ev *indelEvent) int {
+	for i := range evs {
+		if (evs[i].anchor == ev.anchor) && (evs[i].delLen == ev.delLen) && (string(evs[i].ins) == string(ev.ins)) {
+			return i
+		}
+	}
+	return -1
+}
+
+// addIndel increments the count of the indel's allele at its anchor.
+func (pm *pileupMutable) addIndel(ev *indelEvent, isMinus PosType) {
+	row := pm.rowAt(ev.anchor)
+	delLen := uint32(ev.delLen)
+	idx := -1
+	for i := range row.Indels {
+		if (row.Indels[i].DelLen == delLen) && (row.Indels[i].Ins == string(ev.ins)) {
+			idx = i
+			break
+		}
+	}
+	if idx == -1 {
+		idx = len(row.Indels)
+		row.Indels = append(row.Indels, IndelCounts{
+			Ins:    string(ev.ins),
+			DelLen: delLen,
+		})
+	}
+	row.Indels[idx].Counts[isMinus]++
+	row.Indels[idx].QualSum += uint32(ev.qual)
+	if pm.endMax <= ev.anchor {
+		pm.endMax = ev.anchor + 1
+	}
+}
+
+// addIndels adds the indels of a single read or read-pair to the pileup.
+func (pm *pileupMutable) addIndels(reads []readSNP, isMinus PosType, pCtx *pileupContext) (err error) {
+	refSeq8 := pCtx.refSeqs[reads[0].samr.Ref.ID()]
+	for i, r := range reads {
+		if err = alignRelevantIndels(&(pm.indelBufs[i]), r, refSeq8, &pCtx.bedPart); err != nil {
+			return
+		}
+	}
+	minBaseQual := pCtx.minBaseQual
+	evs0 := pm.indelBufs[0]
+	if len(reads) == 1 {
+		for i := range evs0 {
+			if evs0[i].qual >= minBaseQual {
+				pm.addIndel(&evs0[i], isMinus)
+			}
+		}
+		return
+	}
+	evs1 := pm.indelBufs[1]
+	for i := range evs0 {
+		ev := &evs0[i]
+		if !reads[1].spans(ev) {
+			if ev.qual >= minBaseQual {
+				pm.addIndel(ev, isMinus)
+			}
+			continue
+		}
+		// Both ends cover the indel; it is only counted if they agree.
+		if j := findIndel(evs1, ev); (j != -1) && pCtx.qpt.lookup2(ev.qual, evs1[j].qual) {
+			ev.qual = qualSumTable[ev.qual][evs1[j].qual]
+			pm.addIndel(ev, isMinus)
+		}
+	}
+	for i := range evs1 {
+		// Indels covered by both ends were handled above.
+		if ev := &evs1[i]; !reads[0].spans(ev) && (ev.qual >= minBaseQual) {
+			pm.addIndel(ev, isMinus)
+		}
+	}
+	return
+}
+
+// appendIndelAlleles appends the VCF-style REF and ALT alleles of an indel
+// anchored at pos to refAllele and altAllele, respectively.
+func appendIndelAlleles(refAllele, altAllele []byte, refSeq8 string, pos uint32, c *IndelCounts) ([]byte, []byte) {
+	for i := pos; i <= pos+c.DelLen; i++ {
+		refAllele = append(refAllele, pileup.Seq8ToASCIITable[refSeq8[i]])
+	}
+	altAllele = append(altAllele, pileup.Seq8ToASCIITable[refSeq8[pos]])
+	altAllele = append(altAllele, c.Ins...)
+	return refAllele, altAllele
+}
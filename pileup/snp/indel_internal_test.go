@@ -0,0 +1,148 @@
+package snp
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/Schaudge/grailbio/interval"
+	"github.com/Schaudge/hts/sam"
+	"github.com/grailbio/testutil/assert"
+)
+
+// asciiToSeq8 converts an ASCII sequence to .bam seq8 encoding.
+func asciiToSeq8(s string) string {
+	seq8 := make([]byte, len(s))
+	for i := range s {
+		seq8[i] = byte(strings.IndexByte("=ACMGRSVTWYHKDBN", s[i]))
+	}
+	return string(seq8)
+}
+
+func TestAlignRelevantIndels(t *testing.T) {
+	// 0-based positions:   0123456789012345678
+	const refSeq = "ACGTTTTAGCAGCAGCTNN"
+	refSeq8 := asciiToSeq8(refSeq)
+	ref1, _ := sam.NewReference("chr1", "", "", len(refSeq), nil, nil)
+	samHeader, _ := sam.NewHeader(nil, []*sam.Reference{ref1})
+	bedPart, err := interval.NewBEDUnionFromEntries([]interval.Entry{
+		{
+			RefName: "chr1",
+			Start0:  0,
+			End:     14,
+		},
+	}, interval.NewBEDOpts{SAMHeader: samHeader})
+	assert.NoError(t, err)
+	tests := []struct {
+		name  string
+		pos   int
+		cigar sam.Cigar
+		seq   string
+		qual  []byte
+		want  []indelEvent
+	}{
+		{
+			// The deleted T is shifted to the start of the homopolymer.
+			name:  "homopolymer_deletion",
+			pos:   0,
+			cigar: []sam.CigarOp{sam.NewCigarOp(sam.CigarMatch, 5), sam.NewCigarOp(sam.CigarDeletion, 1), sam.NewCigarOp(sam.CigarMatch, 4)},
+			seq:   "ACGTTTAGC",
+			qual:  []byte{30, 30, 30, 30, 20, 25, 30, 30, 30},
+			want:  []indelEvent{{anchor: 2, delLen: 1, qual: 20}},
+		},
+		{
+			// The inserted CAG repeat unit is shifted, and rotated, to the start of
+			// the repeat.
+			name:  "repeat_insertion",
+			pos:   5,
+			cigar: []sam.CigarOp{sam.NewCigarOp(sam.CigarMatch, 8), sam.NewCigarOp(sam.CigarInsertion, 3), sam.NewCigarOp(sam.CigarMatch, 3)},
+			seq:   "TTAGCAGCAGCAGC",
+			qual:  []byte{30, 30, 30, 30, 30, 30, 30, 30, 30, 12, 30, 30, 30, 30},
+			want:  []indelEvent{{anchor: 6, ins: []byte("AGC"), qual: 12}},
+		},
+		{
+			// Left-alignment stops at the read start.
+			name:  "read_start",
+			pos:   8,
+			cigar: []sam.CigarOp{sam.NewCigarOp(sam.CigarMatch, 5), sam.NewCigarOp(sam.CigarInsertion, 3), sam.NewCigarOp(sam.CigarMatch, 3)},
+			seq:   "GCAGCAGCAGC",
+			qual:  []byte{30, 30, 30, 30, 30, 30, 30, 30, 30, 30, 30},
+			want:  []indelEvent{{anchor: 8, ins: []byte("CAG"), qual: 30}},
+		},
+		{
+			// Indels without an aligned base on both sides are ignored, and so are
+			// indels whose anchors are outside the BED intervals.
+			name: "ignored",
+			pos:  12,
+			cigar: []sam.CigarOp{
+				sam.NewCigarOp(sam.CigarSoftClipped, 1),
+				sam.NewCigarOp(sam.CigarInsertion, 1),
+				sam.NewCigarOp(sam.CigarMatch, 3),
+				sam.NewCigarOp(sam.CigarDeletion, 1),
+				sam.NewCigarOp(sam.CigarMatch, 1),
+				sam.NewCigarOp(sam.CigarDeletion, 1),
+			},
+			seq:  "AACAGT",
+			qual: []byte{30, 30, 30, 30, 30, 30},
+		},
+	}
+	var result []indelEvent
+	for _, tt := range tests {
+		var read readSNP
+		read.seq8 = make([]byte, 0, 32)
+		read.samr = &sam.Record{
+			Ref:   ref1,
+			Pos:   tt.pos,
+			Cigar: tt.cigar,
+			Seq:   sam.NewSeq([]byte(tt.seq)),
+			Qual:  tt.qual,
+		}
+		convertSamr(&read, read.samr)
+		span, _ := tt.cigar.Lengths()
+		read.mapEnd = PosType(tt.pos + span)
+		err = alignRelevantIndels(&result, read, refSeq8, &bedPart)
+		assert.NoError(t, err)
+		if len(result) == 0 && len(tt.want) == 0 {
+			continue
+		}
+		if !reflect.DeepEqual(result, tt.want) {
+			t.Errorf("%s: wanted: %v  got: %v", tt.name, tt.want, result)
+		}
+	}
+
+	// The reference must cover the read.
+	var read readSNP
+	read.seq8 = make([]byte, 0, 32)
+	read.samr = &sam.Record{
+		Ref:   ref1,
+		Pos:   10,
+		Cigar: []sam.CigarOp{sam.NewCigarOp(sam.CigarMatch, 10)},
+		Seq:   sam.NewSeq([]byte("AAAAAAAAAA")),
+		Qual:  make([]byte, 10),
+	}
+	convertSamr(&read, read.samr)
+	read.mapEnd = 20
+	assert.NotNil(t, alignRelevantIndels(&result, read, refSeq8, &bedPart))
+}
+
+func TestMarshalPileupRowIndels(t *testing.T) {
+	pr := &PileupRow{
+		FieldsPresent: FieldCounts | FieldIndels | FieldQualSums,
+		RefID:         1,
+		Pos:           100,
+		Payload: PileupPayload{
+			Depth: 7,
+			Indels: []IndelCounts{
+				{DelLen: 3, Counts: [2]uint32{1, 2}, QualSum: 90},
+				{Ins: "ACGT", Counts: [2]uint32{3, 0}, QualSum: 75},
+			},
+		},
+	}
+	pr.Payload.Counts[1][0] = 4
+	pr.Payload.QualSums[1] = 120
+	b, err := MarshalPileupRow(nil, pr)
+	assert.NoError(t, err)
+	got, err := unmarshalPileupRow(b)
+	assert.NoError(t, err)
+	assert.EQ(t, got.(*PileupRow), pr)
+}
@@ -0,0 +1,246 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"context"
+	"os"
+	"strconv"
+
+	"github.com/Schaudge/grailbase/file"
+	"github.com/Schaudge/grailbase/log"
+	"github.com/Schaudge/grailbase/tsv"
+	"github.com/Schaudge/grailbio/pileup"
+	"github.com/Schaudge/hts/sam"
+)
+
+// The mpileup output follows "samtools mpileup" (without -B, -a or -s): one
+// line per position covered by at least one read, with the read-bases and
+// base-qualities columns repeated for every sample.
+// - Bases below -min-base-qual are omitted, along with their markers; they do
+//   not count toward the depth column.  Like samtools, deletions ('*') and
+//   skipped regions ('>'/'<') use the quality of the next base in the read.
+// - Reads are listed in BAM order.  Read-pairs are not stitched, and BAQ is
+//   only applied when -baq is set.
+// - Indels are reported as they appear in the CIGAR, without left-alignment.
+// Unlike the other formats, the read-bases and base-qualities strings are
+// built during the main loop, since they depend on the order and the CIGARs of
+// the reads.
+
+// mpileupMaxQualChar is the largest base-quality or MAPQ character samtools
+// writes.
+const mpileupMaxQualChar = 126
+
+func mpileupQualChar(q byte) byte {
+	if q > mpileupMaxQualChar-33 {
+		return mpileupMaxQualChar
+	}
+	return q + 33
+}
+
+// addMpileupEntry appends a single read's read-bases entry and base-quality
+// to the pileup row for (0-based) position pos.
+func (pm *pileupMutable) addMpileupEntry(pos PosType, entry []byte, q byte) {
+	row := pm.rowAt(pos)
+	row.Depth++
+	row.ReadBases = append(row.ReadBases, entry...)
+	row.ReadQuals = append(row.ReadQuals, mpileupQualChar(q))
+	if pm.endMax <= pos {
+		pm.endMax = pos + 1
+	}
+}
+
+// addMpileupRead adds a read's mpileup entries at all the BED positions it
+// covers.
+func (pm *pileupMutable) addMpileupRead(read *readSNP, pCtx *pileupContext) {
+	samr := read.samr
+	refID := samr.Ref.ID()
+	refSeq8 := pCtx.refSeqs[refID]
+	isRev := (samr.Flags & sam.Reverse) != 0
+	seq8 := read.seq8
+	qual := samr.Qual
+	minBaseQual := pCtx.minBaseQual
+	startPos := PosType(samr.Pos)
+	lastPos := read.mapEnd - 1
+
+	// bedIdx is the index of the first interval in bed which ends after the
+	// current position.  Positions only increase while we iterate over the
+	// CIGAR.
+	bed := pCtx.bedPart.OverlapByID(refID, startPos, read.mapEnd)
+	bedIdx := 0
+	inBED := func(pos PosType) bool {
+		for (bedIdx != len(bed)) && (bed[bedIdx+1] <= pos) {
+			bedIdx += 2
+		}
+		return (bedIdx != len(bed)) && (bed[bedIdx] <= pos)
+	}
+
+	entry := pm.mpileupBuf[:0]
+	posInRef := startPos
+	posInRead := 0
+	cigar := samr.Cigar
+	for i, co := range cigar {
+		cLen := co.Len()
+		switch co.Type() {
+		case sam.CigarMatch:
+			for k := 0; k != cLen; k++ {
+				pos := posInRef + PosType(k)
+				q := qual[posInRead+k]
+				if !inBED(pos) || (q < minBaseQual) {
+					continue
+				}
+				entry = entry[:0]
+				if pos == startPos {
+					entry = append(entry, '^', mpileupQualChar(samr.MapQ))
+				}
+				readBase8 := seq8[posInRead+k]
+				if readBase8 == refSeq8[pos] {
+					if isRev {
+						entry = append(entry, ',')
+					} else {
+						entry = append(entry, '.')
+					}
+				} else {
+					entry = appendMpileupBases(entry, seq8[posInRead+k:posInRead+k+1], isRev)
+				}
+				if (k == cLen-1) && (i+1 != len(cigar)) {
+					// Indels are reported after the base preceding them.
+					next := cigar[i+1]
+					switch next.Type() {
+					case sam.CigarInsertion:
+						entry = append(entry, '+')
+						entry = strconv.AppendInt(entry, int64(next.Len()), 10)
+						entry = appendMpileupBases(entry, seq8[posInRead+cLen:posInRead+cLen+next.Len()], isRev)
+					case sam.CigarDeletion:
+						entry = append(entry, '-')
+						entry = strconv.AppendInt(entry, int64(next.Len()), 10)
+						entry = appendMpileupBases(entry, []byte(refSeq8[pos+1:pos+1+PosType(next.Len())]), isRev)
+					}
+				}
+				if pos == lastPos {
+					entry = append(entry, '$')
+				}
+				pm.addMpileupEntry(pos, entry, q)
+			}
+			posInRef += PosType(cLen)
+			posInRead += cLen
+		case sam.CigarDeletion, sam.CigarSkipped:
+			var marker byte
+			if co.Type() == sam.CigarDeletion {
+				marker = '*'
+			} else if isRev {
+				marker = '<'
+			} else {
+				marker = '>'
+			}
+			var q byte
+			if posInRead < len(qual) {
+				q = qual[posInRead]
+			}
+			endPos := posInRef + PosType(cLen)
+			if q >= minBaseQual {
+				for pos := posInRef; pos < endPos; pos++ {
+					if !inBED(pos) {
+						if bedIdx == len(bed) {
+							break
+						}
+						// Skip to the start of the next BED interval.
+						pos = bed[bedIdx] - 1
+						continue
+					}
+					entry = append(entry[:0], marker)
+					if pos == lastPos {
+						entry = append(entry, '$')
+					}
+					pm.addMpileupEntry(pos, entry, q)
+				}
+			}
+			posInRef = endPos
+		case sam.CigarInsertion, sam.CigarSoftClipped:
+			posInRead += cLen
+		}
+	}
+	pm.mpileupBuf = entry
+}
+
+// appendMpileupBases appends the ASCII form of the given .bam seq8 bases to
+// dst, in lowercase for reverse-strand reads.
+func appendMpileupBases(dst, seq8 []byte, isRev bool) []byte {
+	for _, b := range seq8 {
+		c := pileup.Seq8ToASCIITable[b]
+		if isRev && (c >= 'A') && (c <= 'Z') {
+			c += 'a' - 'A'
+		}
+		dst = append(dst, c)
+	}
+	return dst
+}
+
+// ConvertPileupRowsToMpileup writes the .mpileup file.  tmpFiles is indexed by
+// [sample][job].
+func ConvertPileupRowsToMpileup(ctx context.Context, tmpFiles [][]*os.File, mainPath string, refNames []string, refSeqs []string) (err error) {
+	fullPath := mainPath + ".mpileup"
+	var dst file.File
+	if dst, err = file.Create(ctx, fullPath); err != nil {
+		return
+	}
+	defer file.CloseAndReport(ctx, dst, &err)
+
+	w := tsv.NewWriter(dst.Writer(ctx))
+	lastRefID := uint32(0)
+	curRefName := refNames[0]
+	curRefSeq8 := refSeqs[0]
+	scanner := newSampleRowScanner(tmpFiles)
+	for scanner.Scan() {
+		rows := scanner.Rows()
+		covered := false
+		for _, pr := range rows {
+			if pr.Payload.Depth != 0 {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			continue
+		}
+		refID := rows[0].RefID
+		if refID != lastRefID {
+			curRefName = refNames[refID]
+			curRefSeq8 = refSeqs[refID]
+			lastRefID = refID
+		}
+		pos := rows[0].Pos
+		writeChromPosRef(w, curRefName, PosType(pos), pileup.Seq8ToASCIITable[curRefSeq8[pos]])
+		for _, pr := range rows {
+			w.WriteUint32(pr.Payload.Depth)
+			if pr.Payload.Depth == 0 {
+				w.WriteString("*\t*")
+				continue
+			}
+			w.WriteBytes(pr.Payload.ReadBases)
+			w.WriteBytes(pr.Payload.ReadQuals)
+		}
+		if err = w.EndLine(); err != nil {
+			return
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return
+	}
+	if err = w.Flush(); err != nil {
+		return
+	}
+	log.Printf("ConvertPileupRowsToMpileup: done, final results written to %s", fullPath)
+	return
+}
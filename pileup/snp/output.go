@@ -39,7 +39,101 @@ func writeChromPosRef(tsvw *tsv.Writer, refName string, pos PosType, refChar byt
 	tsvw.WriteByte(refChar)
 }
 
+// writeIndelChromPosRefAlt appends the CHROM/POS/REF/ALT columns of an indel
+// allele, using VCF-style REF and ALT alleles which include the anchor base.
+func writeIndelChromPosRefAlt(tsvw *tsv.Writer, refName string, pos uint32, refSeq8 string, c *IndelCounts) {
+	refAllele, altAllele := appendIndelAlleles(nil, nil, refSeq8, pos, c)
+	tsvw.WriteString(refName)
+	tsvw.WriteUint32(pos + 1)
+	tsvw.WriteBytes(refAllele)
+	tsvw.WriteBytes(altAllele)
+}
+
+// sumIndelCounts returns the number of reads supporting insertions and
+// deletions in indels, for each strand.
+func sumIndelCounts(indels []IndelCounts) (ins, del [2]uint32) {
+	for _, c := range indels {
+		if c.DelLen == 0 {
+			ins[0] += c.Counts[0]
+			ins[1] += c.Counts[1]
+		} else {
+			del[0] += c.Counts[0]
+			del[1] += c.Counts[1]
+		}
+	}
+	return
+}
+
+// writePerReadCols appends the comma-separated per-read stats of a single
+// allele in a single sample.
+func writePerReadCols(w *tsv.Writer, features []PerReadFeatures, colBitset int, emptyPerReadStats []byte) {
+	if len(features) == 0 {
+		w.WritePartialBytes(emptyPerReadStats)
+		return
+	}
+	if (colBitset & colBitEndDists) != 0 {
+		for _, f := range features {
+			w.WriteCsvUint32(uint32(f.Dist5p))
+		}
+		w.EndCsv()
+		for _, f := range features {
+			w.WriteCsvUint32(uint32(f.Fraglen - 1 - f.Dist5p))
+		}
+		w.EndCsv()
+	}
+	if (colBitset & colBitQuals) != 0 {
+		for _, f := range features {
+			w.WriteCsvUint32(uint32(f.Qual))
+		}
+		w.EndCsv()
+	}
+	if (colBitset & colBitFraglens) != 0 {
+		for _, f := range features {
+			w.WriteCsvUint32(uint32(f.Fraglen))
+		}
+		w.EndCsv()
+	}
+	if (colBitset & colBitStrands) != 0 {
+		for _, f := range features {
+			w.WriteCsvByte(pileup.StrandTypeToASCIITable[f.Strand])
+		}
+		w.EndCsv()
+	}
+}
+
+// writeTSVSampleCols appends a single sample's .ref.tsv or .alt.tsv columns
+// for the given base.
+func writeTSVSampleCols(w *tsv.Writer, pr *PileupRow, base PosType, dp bool, colBitset int, emptyPerReadStats []byte) {
+	if dp {
+		w.WriteUint32(pr.Payload.Depth)
+	}
+	if (colBitset & colPerReadMask) != 0 {
+		if base == PosType(pileup.BaseX) {
+			w.WritePartialBytes(emptyPerReadStats)
+		} else {
+			writePerReadCols(w, pr.Payload.PerRead[base], colBitset, emptyPerReadStats)
+		}
+	}
+	if (colBitset & colBitHighQ) != 0 {
+		counts := &pr.Payload.Counts
+		w.WriteUint32(counts[base][0] + counts[base][1])
+	}
+	if (colBitset & colBitLowQ) != 0 {
+		w.WriteByte('0')
+	}
+}
+
+// ConvertPileupRowsToTSV writes the .ref.tsv and .alt.tsv files of a single
+// sample.  See ConvertPileupRowsToTSVSamples() for details.
 func ConvertPileupRowsToTSV(ctx context.Context, tmpFiles []*os.File, mainPath string, colBitset int, bgzip bool, parallelism int, refNames []string, refSeqs []string) (err error) {
+	return ConvertPileupRowsToTSVSamples(ctx, [][]*os.File{tmpFiles}, mainPath, colBitset, bgzip, parallelism, refNames, refSeqs, []string{""})
+}
+
+// ConvertPileupRowsToTSVSamples writes the .ref.tsv and .alt.tsv files.
+// tmpFiles is indexed by [sample][job]; when there are multiple samples, each
+// non-key column is repeated for every sample, with the sample name appended
+// to the column name.
+func ConvertPileupRowsToTSVSamples(ctx context.Context, tmpFiles [][]*os.File, mainPath string, colBitset int, bgzip bool, parallelism int, refNames []string, refSeqs []string, sampleNames []string) (err error) {
 	refPath := mainPath + ".ref.tsv"
 	if bgzip {
 		refPath = refPath + ".gz"
@@ -82,46 +176,65 @@ func ConvertPileupRowsToTSV(ctx context.Context, tmpFiles []*os.File, mainPath s
 	}
 	refTSV.WriteString("#CHROM\tPOS\tREF")
 	altTSV.WriteString("#CHROM\tPOS\tREF\tALT")
-	if (colBitset & colBitDpRef) != 0 {
-		refTSV.WriteString("DP")
-	}
-	if (colBitset & colBitDpAlt) != 0 {
-		altTSV.WriteString("DP")
-	}
 	perReadStats := ((colBitset & colPerReadMask) != 0)
 	var emptyPerReadStats []byte
 	if perReadStats {
 		if (colBitset & colBitEndDists) != 0 {
-			refTSV.WriteString("5P_DISTS\t3P_DISTS")
-			altTSV.WriteString("5P_DISTS\t3P_DISTS")
 			emptyPerReadStats = append(emptyPerReadStats, ".\t.\t"...)
 		}
 		if (colBitset & colBitQuals) != 0 {
-			refTSV.WriteString("QUALS")
-			altTSV.WriteString("QUALS")
 			emptyPerReadStats = append(emptyPerReadStats, ".\t"...)
 		}
 		if (colBitset & colBitFraglens) != 0 {
-			refTSV.WriteString("FRAGLENS")
-			altTSV.WriteString("FRAGLENS")
 			emptyPerReadStats = append(emptyPerReadStats, ".\t"...)
 		}
 		if (colBitset & colBitStrands) != 0 {
-			refTSV.WriteString("STRANDS")
-			altTSV.WriteString("STRANDS")
 			emptyPerReadStats = append(emptyPerReadStats, ".\t"...)
 		}
 	}
-	// These two columns will be renamed once we've removed
-	// targeted_to_tsv_snp2.py (used to create Conta-readable files) from the
-	// pipeline.  The basestrand format should be *more* convenient for Conta...
-	if (colBitset & colBitHighQ) != 0 {
-		refTSV.WriteString("ref_depth_tier1")
-		altTSV.WriteString("alt_depth_tier1")
-	}
-	if (colBitset & colBitLowQ) != 0 {
-		refTSV.WriteString("ref_depth_tier2")
-		altTSV.WriteString("alt_depth_tier2")
+	for _, suffix := range sampleColSuffixes(sampleNames) {
+		if (colBitset & colBitDpRef) != 0 {
+			writeHeaderCols(refTSV, "DP", suffix)
+		}
+		if (colBitset & colBitDpAlt) != 0 {
+			writeHeaderCols(altTSV, "DP", suffix)
+		}
+		if perReadStats {
+			if (colBitset & colBitEndDists) != 0 {
+				writeHeaderCols(refTSV, "5P_DISTS\t3P_DISTS", suffix)
+				writeHeaderCols(altTSV, "5P_DISTS\t3P_DISTS", suffix)
+			}
+			if (colBitset & colBitQuals) != 0 {
+				writeHeaderCols(refTSV, "QUALS", suffix)
+				writeHeaderCols(altTSV, "QUALS", suffix)
+			}
+			if (colBitset & colBitFraglens) != 0 {
+				writeHeaderCols(refTSV, "FRAGLENS", suffix)
+				writeHeaderCols(altTSV, "FRAGLENS", suffix)
+			}
+			if (colBitset & colBitStrands) != 0 {
+				writeHeaderCols(refTSV, "STRANDS", suffix)
+				writeHeaderCols(altTSV, "STRANDS", suffix)
+			}
+		}
+		// These two columns will be renamed once we've removed
+		// targeted_to_tsv_snp2.py (used to create Conta-readable files) from the
+		// pipeline.  The basestrand format should be *more* convenient for
+		// Conta...
+		if (colBitset & colBitHighQ) != 0 {
+			writeHeaderCols(refTSV, "ref_depth_tier1", suffix)
+			writeHeaderCols(altTSV, "alt_depth_tier1", suffix)
+		}
+		if (colBitset & colBitLowQ) != 0 {
+			writeHeaderCols(refTSV, "ref_depth_tier2", suffix)
+			writeHeaderCols(altTSV, "alt_depth_tier2", suffix)
+		}
+		if (colBitset & colBitIndels) != 0 {
+			writeHeaderCols(refTSV, "INS\tDEL", suffix)
+		}
+		if (colBitset & colBitDiscordant) != 0 {
+			writeHeaderCols(refTSV, "DISCORDANT", suffix)
+		}
 	}
 	if err = refTSV.EndLine(); err != nil {
 		return
@@ -133,157 +246,95 @@ func ConvertPileupRowsToTSV(ctx context.Context, tmpFiles []*os.File, mainPath s
 	lastRefID := uint32(0)
 	curRefName := refNames[0]
 	curRefSeq8 := refSeqs[0]
-	for i, f := range tmpFiles {
-		if _, err = f.Seek(0, 0); err != nil {
-			return
+	var indelAlleles []IndelCounts
+	// Possible todo: parallelize PileupRow -> final-output-format rendering.
+	// This intermediate-recordio design causes wall-clock time for the entire
+	// run to increase by up to ~35% over the old
+	// intermediate-TSVs-which-can-be-concatenated design.  (The design change
+	// was still made because, if performance is an issue, you should be
+	// requesting recordio final output instead of TSV anyway.)
+	scanner := newSampleRowScanner(tmpFiles)
+	for scanner.Scan() {
+		rows := scanner.Rows()
+		refID := rows[0].RefID
+		if refID != lastRefID {
+			curRefName = refNames[refID]
+			curRefSeq8 = refSeqs[refID]
+			lastRefID = refID
 		}
-		scanner := recordio.NewScanner(f, recordio.ScannerOpts{
-			Unmarshal: unmarshalPileupRow,
-		})
-		// Possible todo: parallelize PileupRow -> final-output-format rendering.
-		// This intermediate-recordio design causes wall-clock time for the entire
-		// run to increase by up to ~35% over the old
-		// intermediate-TSVs-which-can-be-concatenated design.  (The design change
-		// was still made because, if performance is an issue, you should be
-		// requesting recordio final output instead of TSV anyway.)
-		for scanner.Scan() {
-			pr := scanner.Get().(*PileupRow)
-			refID := pr.RefID
-			if refID != lastRefID {
-				curRefName = refNames[refID]
-				curRefSeq8 = refSeqs[refID]
-				lastRefID = refID
+		pos := rows[0].Pos
+		refBase8 := curRefSeq8[pos]
+		refChar := pileup.Seq8ToASCIITable[refBase8]
+		writeChromPosRef(refTSV, curRefName, PosType(pos), refChar)
+		refBase := PosType(pileup.Seq8ToEnumTable[refBase8])
+		for _, pr := range rows {
+			writeTSVSampleCols(refTSV, pr, refBase, (colBitset&colBitDpRef) != 0, colBitset, emptyPerReadStats)
+			if (colBitset & colBitIndels) != 0 {
+				insCounts, delCounts := sumIndelCounts(pr.Payload.Indels)
+				refTSV.WriteUint32(insCounts[0] + insCounts[1])
+				refTSV.WriteUint32(delCounts[0] + delCounts[1])
 			}
-			pos := pr.Pos
-			refBase8 := curRefSeq8[pos]
-			refChar := pileup.Seq8ToASCIITable[refBase8]
-			writeChromPosRef(refTSV, curRefName, PosType(pos), refChar)
-			refBase := PosType(pileup.Seq8ToEnumTable[refBase8])
-			if (colBitset & colBitDpRef) != 0 {
-				refTSV.WriteUint32(pr.Payload.Depth)
+			if (colBitset & colBitDiscordant) != 0 {
+				refTSV.WriteUint32(pr.Payload.Discordant[0] + pr.Payload.Discordant[1])
 			}
-			if perReadStats {
-				if refBase == PosType(pileup.BaseX) {
-					refTSV.WritePartialBytes(emptyPerReadStats)
-				} else {
-					refFeatures := pr.Payload.PerRead[refBase]
-					if len(refFeatures) == 0 {
-						refTSV.WritePartialBytes(emptyPerReadStats)
-					} else {
-						if (colBitset & colBitEndDists) != 0 {
-							for _, f := range refFeatures {
-								refTSV.WriteCsvUint32(uint32(f.Dist5p))
-							}
-							refTSV.EndCsv()
-							for _, f := range refFeatures {
-								refTSV.WriteCsvUint32(uint32(f.Fraglen - 1 - f.Dist5p))
-							}
-							refTSV.EndCsv()
-						}
-						if (colBitset & colBitQuals) != 0 {
-							for _, f := range refFeatures {
-								refTSV.WriteCsvUint32(uint32(f.Qual))
-							}
-							refTSV.EndCsv()
-						}
-						if (colBitset & colBitFraglens) != 0 {
-							for _, f := range refFeatures {
-								refTSV.WriteCsvUint32(uint32(f.Fraglen))
-							}
-							refTSV.EndCsv()
-						}
-						if (colBitset & colBitStrands) != 0 {
-							for _, f := range refFeatures {
-								refTSV.WriteCsvByte(pileup.StrandTypeToASCIITable[f.Strand])
-							}
-							refTSV.EndCsv()
-						}
-					}
-				}
+		}
+		if err = refTSV.EndLine(); err != nil {
+			return
+		}
+		// Do we want to report ALT=N?  Probably want to make this configurable,
+		// since this was handled inconsistently in the past...
+		// Current choice is to report counts, but nothing else, for Ns.
+		// Note that, when stitch=true, mismatch between the two read-sides is
+		// treated as N.
+		for altBase := PosType(0); altBase < pileup.NBaseEnum; altBase++ {
+			if altBase == refBase {
+				continue
 			}
-			counts := &pr.Payload.Counts
-			if (colBitset & colBitHighQ) != 0 {
-				refTSV.WriteUint32(counts[refBase][0] + counts[refBase][1])
+			altCount := uint32(0)
+			for _, pr := range rows {
+				altCount += pr.Payload.Counts[altBase][0] + pr.Payload.Counts[altBase][1]
+			}
+			if altCount == 0 {
+				continue
 			}
-			if (colBitset & colBitLowQ) != 0 {
-				refTSV.WriteByte('0')
+			writeChromPosRef(altTSV, curRefName, PosType(pos), refChar)
+			altTSV.WriteByte(pileup.EnumToASCIITable[altBase])
+			for _, pr := range rows {
+				writeTSVSampleCols(altTSV, pr, altBase, (colBitset&colBitDpAlt) != 0, colBitset, emptyPerReadStats)
 			}
-			if err = refTSV.EndLine(); err != nil {
+			if err = altTSV.EndLine(); err != nil {
 				return
 			}
-			// Do we want to report ALT=N?  Probably want to make this configurable,
-			// since this was handled inconsistently in the past...
-			// Current choice is to report counts, but nothing else, for Ns.
-			// Note that, when stitch=true, mismatch between the two read-sides is
-			// treated as N.
-			for altBase := PosType(0); altBase < pileup.NBaseEnum; altBase++ {
-				if altBase == refBase {
-					continue
+		}
+		indelAlleles = unionIndelAlleles(indelAlleles, rows)
+		for j := range indelAlleles {
+			allele := &indelAlleles[j]
+			writeIndelChromPosRefAlt(altTSV, curRefName, pos, curRefSeq8, allele)
+			for _, pr := range rows {
+				if (colBitset & colBitDpAlt) != 0 {
+					altTSV.WriteUint32(pr.Payload.Depth)
 				}
-				altCount := counts[altBase][0] + counts[altBase][1]
-				if altCount != 0 {
-					writeChromPosRef(altTSV, curRefName, PosType(pos), refChar)
-					altTSV.WriteByte(pileup.EnumToASCIITable[altBase])
-					if (colBitset & colBitDpAlt) != 0 {
-						altTSV.WriteUint32(pr.Payload.Depth)
-					}
-					if perReadStats {
-						if altBase == PosType(pileup.BaseX) {
-							altTSV.WritePartialBytes(emptyPerReadStats)
-						} else {
-							altFeatures := pr.Payload.PerRead[altBase]
-							if (colBitset & colBitEndDists) != 0 {
-								for _, f := range altFeatures {
-									altTSV.WriteCsvUint32(uint32(f.Dist5p))
-								}
-								altTSV.EndCsv()
-								for _, f := range altFeatures {
-									altTSV.WriteCsvUint32(uint32(f.Fraglen - 1 - f.Dist5p))
-								}
-								altTSV.EndCsv()
-							}
-							if (colBitset & colBitQuals) != 0 {
-								for _, f := range altFeatures {
-									altTSV.WriteCsvUint32(uint32(f.Qual))
-								}
-								altTSV.EndCsv()
-							}
-							if (colBitset & colBitFraglens) != 0 {
-								for _, f := range altFeatures {
-									altTSV.WriteCsvUint32(uint32(f.Fraglen))
-								}
-								altTSV.EndCsv()
-							}
-							if (colBitset & colBitStrands) != 0 {
-								for _, f := range altFeatures {
-									altTSV.WriteCsvByte(pileup.StrandTypeToASCIITable[f.Strand])
-								}
-								altTSV.EndCsv()
-							}
-						}
-					}
-					if (colBitset & colBitHighQ) != 0 {
-						altTSV.WriteUint32(altCount)
-					}
-					if (colBitset & colBitLowQ) != 0 {
-						altTSV.WriteByte('0')
-					}
-					if err = altTSV.EndLine(); err != nil {
-						return
+				if perReadStats {
+					altTSV.WritePartialBytes(emptyPerReadStats)
+				}
+				if (colBitset & colBitHighQ) != 0 {
+					count := uint32(0)
+					if c := findIndelCounts(pr.Payload.Indels, allele); c != nil {
+						count = c.Counts[0] + c.Counts[1]
 					}
+					altTSV.WriteUint32(count)
+				}
+				if (colBitset & colBitLowQ) != 0 {
+					altTSV.WriteByte('0')
 				}
 			}
+			if err = altTSV.EndLine(); err != nil {
+				return
+			}
 		}
-		if err = scanner.Err(); err != nil {
-			return
-		}
-		curPath := f.Name()
-		if err = f.Close(); err != nil {
-			return
-		}
-		tmpFiles[i] = nil
-		// os.Remove returns an error if we try to remove a file that isn't there.
-		_ = os.Remove(curPath)
+	}
+	if err = scanner.Err(); err != nil {
+		return
 	}
 	if err = refTSV.Flush(); err != nil {
 		return
@@ -373,7 +424,125 @@ func flushPlusAndMinusBuf(w *tsv.Writer, plusBufPtr, minusBufPtr *[]byte) {
 	}
 }
 
+// writeBasestrandPerReadCols appends a single sample's comma-separated
+// per-read stats, split by base and strand.
+func writeBasestrandPerReadCols(w *tsv.Writer, pr *PileupRow, colBitset int, emptyPerReadStats []byte, plusBufPtr, minusBufPtr *[]byte) {
+	if pr.Payload.Depth == 0 {
+		w.WritePartialBytes(emptyPerReadStats)
+		return
+	}
+	plusBuf := *plusBufPtr
+	minusBuf := *minusBufPtr
+	curPerRead := &pr.Payload.PerRead
+	// Note that this code would be simpler if we added a strand dimension to
+	// perRead.  But that has the drawback of significantly increasing the base
+	// size of pileupPayload everywhere, just for a currently-rare use case.
+	if (colBitset & colBitEndDists) != 0 {
+		for _, baseFeatures := range curPerRead {
+			if len(baseFeatures) == 0 {
+				w.WriteString(".\t.")
+			} else {
+				for _, f := range baseFeatures {
+					curDist5p := uint64(f.Dist5p)
+					if f.Strand == byte(pileup.StrandFwd) {
+						plusBuf = strconv.AppendUint(plusBuf, curDist5p, 10)
+						plusBuf = append(plusBuf, ',')
+					} else {
+						minusBuf = strconv.AppendUint(minusBuf, curDist5p, 10)
+						minusBuf = append(minusBuf, ',')
+					}
+				}
+				flushPlusAndMinusBuf(w, &plusBuf, &minusBuf)
+			}
+		}
+		for _, baseFeatures := range curPerRead {
+			if len(baseFeatures) == 0 {
+				w.WriteString(".\t.")
+			} else {
+				for _, f := range baseFeatures {
+					curDist3p := uint64(f.Fraglen - 1 - f.Dist5p)
+					if f.Strand == byte(pileup.StrandFwd) {
+						plusBuf = strconv.AppendUint(plusBuf, curDist3p, 10)
+						plusBuf = append(plusBuf, ',')
+					} else {
+						minusBuf = strconv.AppendUint(minusBuf, curDist3p, 10)
+						minusBuf = append(minusBuf, ',')
+					}
+				}
+				flushPlusAndMinusBuf(w, &plusBuf, &minusBuf)
+			}
+		}
+	}
+	if (colBitset & colBitQuals) != 0 {
+		for _, baseFeatures := range curPerRead {
+			if len(baseFeatures) == 0 {
+				w.WriteString(".\t.")
+			} else {
+				for _, f := range baseFeatures {
+					curQual := uint64(f.Qual)
+					if f.Strand == byte(pileup.StrandFwd) {
+						plusBuf = strconv.AppendUint(plusBuf, curQual, 10)
+						plusBuf = append(plusBuf, ',')
+					} else {
+						minusBuf = strconv.AppendUint(minusBuf, curQual, 10)
+						minusBuf = append(minusBuf, ',')
+					}
+				}
+				flushPlusAndMinusBuf(w, &plusBuf, &minusBuf)
+			}
+		}
+	}
+	if (colBitset & colBitFraglens) != 0 {
+		for _, baseFeatures := range curPerRead {
+			if len(baseFeatures) == 0 {
+				w.WriteString(".\t.")
+			} else {
+				for _, f := range baseFeatures {
+					curFraglen := uint64(f.Fraglen)
+					if f.Strand == byte(pileup.StrandFwd) {
+						plusBuf = strconv.AppendUint(plusBuf, curFraglen, 10)
+						plusBuf = append(plusBuf, ',')
+					} else {
+						minusBuf = strconv.AppendUint(minusBuf, curFraglen, 10)
+						minusBuf = append(minusBuf, ',')
+					}
+				}
+				flushPlusAndMinusBuf(w, &plusBuf, &minusBuf)
+			}
+		}
+	}
+	if (colBitset & colBitStrands) != 0 {
+		for _, baseFeatures := range curPerRead {
+			if len(baseFeatures) == 0 {
+				w.WriteString(".\t.")
+			} else {
+				for _, f := range baseFeatures {
+					if f.Strand == byte(pileup.StrandFwd) {
+						plusBuf = append(plusBuf, "+,"...)
+					} else {
+						minusBuf = append(minusBuf, "-,"...)
+					}
+				}
+				flushPlusAndMinusBuf(w, &plusBuf, &minusBuf)
+			}
+		}
+	}
+	*plusBufPtr = plusBuf
+	*minusBufPtr = minusBuf
+}
+
+// ConvertPileupRowsToBasestrandTSV writes the .basestrand.tsv file, and the
+// .indelstrand.tsv file when indels are requested, of a single sample.  See
+// ConvertPileupRowsToBasestrandTSVSamples() for details.
 func ConvertPileupRowsToBasestrandTSV(ctx context.Context, tmpFiles []*os.File, mainPath string, colBitset int, bgzip bool, parallelism int, refNames []string, refSeqs []string) (err error) {
+	return ConvertPileupRowsToBasestrandTSVSamples(ctx, [][]*os.File{tmpFiles}, mainPath, colBitset, bgzip, parallelism, refNames, refSeqs, []string{""})
+}
+
+// ConvertPileupRowsToBasestrandTSVSamples writes the .basestrand.tsv file, and
+// the .indelstrand.tsv file when indels are requested.  tmpFiles is indexed by
+// [sample][job]; when there are multiple samples, each non-key column is
+// repeated for every sample, with the sample name appended to the column name.
+func ConvertPileupRowsToBasestrandTSVSamples(ctx context.Context, tmpFiles [][]*os.File, mainPath string, colBitset int, bgzip bool, parallelism int, refNames []string, refSeqs []string, sampleNames []string) (err error) {
 	fullPath := mainPath + ".basestrand.tsv"
 	if bgzip {
 		fullPath = fullPath + ".gz"
@@ -397,179 +566,158 @@ func ConvertPileupRowsToBasestrandTSV(ctx context.Context, tmpFiles []*os.File,
 		}()
 	}
 	// Note that the recordio format does not include REF.
-	w.WriteString("#CHROM\tPOS\tREF\tA+\tA-\tC+\tC-\tG+\tG-\tT+\tT-")
+	w.WriteString("#CHROM\tPOS\tREF")
 	perReadStats := ((colBitset & colPerReadMask) != 0)
 	var emptyPerReadStats []byte
 	if perReadStats {
 		if (colBitset & colBitEndDists) != 0 {
-			w.WriteString("\t5P_DISTS_A+\t5P_DISTS_A-\t5P_DISTS_C+\t5P_DISTS_C-\t5P_DISTS_G+\t5P_DISTS_G-\t5P_DISTS_T+\t5P_DISTS_T-\t3P_DISTS_A+\t3P_DISTS_A-\t3P_DISTS_C+\t3P_DISTS_C-\t3P_DISTS_G+\t3P_DISTS_G-\t3P_DISTS_T+\t3P_DISTS_T-")
 			emptyPerReadStats = append(emptyPerReadStats, ".\t.\t.\t.\t.\t.\t.\t.\t.\t.\t.\t.\t.\t.\t.\t.\t"...)
 		}
 		if (colBitset & colBitQuals) != 0 {
-			w.WriteString("\tQUALS_A+\tQUALS_A-\tQUALS_C+\tQUALS_C-\tQUALS_G+\tQUALS_G-\tQUALS_T+\tQUALS_T-")
 			emptyPerReadStats = append(emptyPerReadStats, ".\t.\t.\t.\t.\t.\t.\t.\t"...)
 		}
 		if (colBitset & colBitFraglens) != 0 {
-			w.WriteString("\tFRAGLENS_A+\tFRAGLENS_A-\tFRAGLENS_C+\tFRAGLENS_C-\tFRAGLENS_G+\tFRAGLENS_G-\tFRAGLENS_T+\tFRAGLENS_T-")
 			emptyPerReadStats = append(emptyPerReadStats, ".\t.\t.\t.\t.\t.\t.\t.\t"...)
 		}
 		if (colBitset & colBitStrands) != 0 {
-			w.WriteString("\tSTRANDS_A+\tSTRANDS_A-\tSTRANDS_C+\tSTRANDS_C-\tSTRANDS_G+\tSTRANDS_G-\tSTRANDS_T+\tSTRANDS_T-")
 			emptyPerReadStats = append(emptyPerReadStats, ".\t.\t.\t.\t.\t.\t.\t.\t"...)
 		}
 	}
+	indels := (colBitset & colBitIndels) != 0
+	discordant := (colBitset & colBitDiscordant) != 0
+	suffixes := sampleColSuffixes(sampleNames)
+	for _, suffix := range suffixes {
+		writeHeaderCols(w, "A+\tA-\tC+\tC-\tG+\tG-\tT+\tT-", suffix)
+		if perReadStats {
+			if (colBitset & colBitEndDists) != 0 {
+				writeHeaderCols(w, "5P_DISTS_A+\t5P_DISTS_A-\t5P_DISTS_C+\t5P_DISTS_C-\t5P_DISTS_G+\t5P_DISTS_G-\t5P_DISTS_T+\t5P_DISTS_T-\t3P_DISTS_A+\t3P_DISTS_A-\t3P_DISTS_C+\t3P_DISTS_C-\t3P_DISTS_G+\t3P_DISTS_G-\t3P_DISTS_T+\t3P_DISTS_T-", suffix)
+			}
+			if (colBitset & colBitQuals) != 0 {
+				writeHeaderCols(w, "QUALS_A+\tQUALS_A-\tQUALS_C+\tQUALS_C-\tQUALS_G+\tQUALS_G-\tQUALS_T+\tQUALS_T-", suffix)
+			}
+			if (colBitset & colBitFraglens) != 0 {
+				writeHeaderCols(w, "FRAGLENS_A+\tFRAGLENS_A-\tFRAGLENS_C+\tFRAGLENS_C-\tFRAGLENS_G+\tFRAGLENS_G-\tFRAGLENS_T+\tFRAGLENS_T-", suffix)
+			}
+			if (colBitset & colBitStrands) != 0 {
+				writeHeaderCols(w, "STRANDS_A+\tSTRANDS_A-\tSTRANDS_C+\tSTRANDS_C-\tSTRANDS_G+\tSTRANDS_G-\tSTRANDS_T+\tSTRANDS_T-", suffix)
+			}
+		}
+		if indels {
+			writeHeaderCols(w, "INS+\tINS-\tDEL+\tDEL-", suffix)
+		}
+		if discordant {
+			writeHeaderCols(w, "DISCORDANT+\tDISCORDANT-", suffix)
+		}
+	}
 	if err = w.EndLine(); err != nil {
 		return
 	}
+	// The per-strand counts of each indel allele are written to a separate
+	// .indelstrand.tsv file, since the number of alleles varies by position.
+	var indelTSV *tsv.Writer
+	if indels {
+		indelPath := mainPath + ".indelstrand.tsv"
+		if bgzip {
+			indelPath = indelPath + ".gz"
+		}
+		var dstIndel file.File
+		if dstIndel, err = file.Create(ctx, indelPath); err != nil {
+			return
+		}
+		defer file.CloseAndReport(ctx, dstIndel, &err)
+		if !bgzip {
+			indelTSV = tsv.NewWriter(dstIndel.Writer(ctx))
+		} else {
+			bgzfIndelWriter := bgzf.NewWriter(dstIndel.Writer(ctx), parallelism)
+			indelTSV = tsv.NewWriter(bgzfIndelWriter)
+			defer func() {
+				if e := bgzfIndelWriter.Close(); e != nil && err == nil {
+					err = e
+				}
+			}()
+		}
+		indelTSV.WriteString("#CHROM\tPOS\tREF\tALT")
+		for _, suffix := range suffixes {
+			writeHeaderCols(indelTSV, "ALT+\tALT-", suffix)
+		}
+		if err = indelTSV.EndLine(); err != nil {
+			return
+		}
+	}
 	lastRefID := uint32(0)
 	curRefName := refNames[0]
 	curRefSeq8 := refSeqs[0]
 	plusBuf := make([]byte, 0, 256)
 	minusBuf := make([]byte, 0, 256)
-	for i := range tmpFiles {
-		f := tmpFiles[i]
-		if _, err = f.Seek(0, 0); err != nil {
-			return
+	var indelAlleles []IndelCounts
+	scanner := newSampleRowScanner(tmpFiles)
+	for scanner.Scan() {
+		rows := scanner.Rows()
+		refID := rows[0].RefID
+		if refID != lastRefID {
+			curRefName = refNames[refID]
+			curRefSeq8 = refSeqs[refID]
+			lastRefID = refID
 		}
-		scanner := recordio.NewScanner(f, recordio.ScannerOpts{
-			Unmarshal: unmarshalPileupRow,
-		})
-		for scanner.Scan() {
-			pr := scanner.Get().(*PileupRow)
-			refID := pr.RefID
-			if refID != lastRefID {
-				curRefName = refNames[refID]
-				curRefSeq8 = refSeqs[refID]
-				lastRefID = refID
-			}
-			pos := pr.Pos
-			refBase8 := curRefSeq8[pos]
-			refChar := pileup.Seq8ToASCIITable[refBase8]
-			writeChromPosRef(w, curRefName, PosType(pos), refChar)
+		pos := rows[0].Pos
+		refBase8 := curRefSeq8[pos]
+		refChar := pileup.Seq8ToASCIITable[refBase8]
+		writeChromPosRef(w, curRefName, PosType(pos), refChar)
+		for _, pr := range rows {
 			for _, perStrandCounts := range pr.Payload.Counts[:4] {
 				for _, c := range perStrandCounts {
 					w.WriteUint32(c)
 				}
 			}
 			if perReadStats {
-				if pr.Payload.Depth == 0 {
-					w.WritePartialBytes(emptyPerReadStats)
-				} else {
-					curPerRead := &pr.Payload.PerRead
-					// Note that this code would be simpler if we added a strand
-					// dimension to perRead.  But that has the drawback of significantly
-					// increasing the base size of pileupPayload everywhere, just for a
-					// currently-rare use case.
-					if (colBitset & colBitEndDists) != 0 {
-						for _, baseFeatures := range curPerRead {
-							if len(baseFeatures) == 0 {
-								w.WriteString(".\t.")
-							} else {
-								for _, f := range baseFeatures {
-									curDist5p := uint64(f.Dist5p)
-									if f.Strand == byte(pileup.StrandFwd) {
-										plusBuf = strconv.AppendUint(plusBuf, curDist5p, 10)
-										plusBuf = append(plusBuf, ',')
-									} else {
-										minusBuf = strconv.AppendUint(minusBuf, curDist5p, 10)
-										minusBuf = append(minusBuf, ',')
-									}
-								}
-								flushPlusAndMinusBuf(w, &plusBuf, &minusBuf)
-							}
-						}
-						for _, baseFeatures := range curPerRead {
-							if len(baseFeatures) == 0 {
-								w.WriteString(".\t.")
-							} else {
-								for _, f := range baseFeatures {
-									curDist3p := uint64(f.Fraglen - 1 - f.Dist5p)
-									if f.Strand == byte(pileup.StrandFwd) {
-										plusBuf = strconv.AppendUint(plusBuf, curDist3p, 10)
-										plusBuf = append(plusBuf, ',')
-									} else {
-										minusBuf = strconv.AppendUint(minusBuf, curDist3p, 10)
-										minusBuf = append(minusBuf, ',')
-									}
-								}
-								flushPlusAndMinusBuf(w, &plusBuf, &minusBuf)
-							}
-						}
-					}
-					if (colBitset & colBitQuals) != 0 {
-						for _, baseFeatures := range curPerRead {
-							if len(baseFeatures) == 0 {
-								w.WriteString(".\t.")
-							} else {
-								for _, f := range baseFeatures {
-									curQual := uint64(f.Qual)
-									if f.Strand == byte(pileup.StrandFwd) {
-										plusBuf = strconv.AppendUint(plusBuf, curQual, 10)
-										plusBuf = append(plusBuf, ',')
-									} else {
-										minusBuf = strconv.AppendUint(minusBuf, curQual, 10)
-										minusBuf = append(minusBuf, ',')
-									}
-								}
-								flushPlusAndMinusBuf(w, &plusBuf, &minusBuf)
-							}
-						}
-					}
-					if (colBitset & colBitFraglens) != 0 {
-						for _, baseFeatures := range curPerRead {
-							if len(baseFeatures) == 0 {
-								w.WriteString(".\t.")
-							} else {
-								for _, f := range baseFeatures {
-									curFraglen := uint64(f.Fraglen)
-									if f.Strand == byte(pileup.StrandFwd) {
-										plusBuf = strconv.AppendUint(plusBuf, curFraglen, 10)
-										plusBuf = append(plusBuf, ',')
-									} else {
-										minusBuf = strconv.AppendUint(minusBuf, curFraglen, 10)
-										minusBuf = append(minusBuf, ',')
-									}
-								}
-								flushPlusAndMinusBuf(w, &plusBuf, &minusBuf)
-							}
-						}
-					}
-					if (colBitset & colBitStrands) != 0 {
-						for _, baseFeatures := range curPerRead {
-							if len(baseFeatures) == 0 {
-								w.WriteString(".\t.")
-							} else {
-								for _, f := range baseFeatures {
-									if f.Strand == byte(pileup.StrandFwd) {
-										plusBuf = append(plusBuf, "+,"...)
-									} else {
-										minusBuf = append(minusBuf, "-,"...)
-									}
-								}
-								flushPlusAndMinusBuf(w, &plusBuf, &minusBuf)
-							}
-						}
-					}
-				}
+				writeBasestrandPerReadCols(w, pr, colBitset, emptyPerReadStats, &plusBuf, &minusBuf)
 			}
-			if err = w.EndLine(); err != nil {
-				return
+			if indels {
+				insCounts, delCounts := sumIndelCounts(pr.Payload.Indels)
+				w.WriteUint32(insCounts[0])
+				w.WriteUint32(insCounts[1])
+				w.WriteUint32(delCounts[0])
+				w.WriteUint32(delCounts[1])
+			}
+			if discordant {
+				w.WriteUint32(pr.Payload.Discordant[0])
+				w.WriteUint32(pr.Payload.Discordant[1])
 			}
 		}
-		if err = scanner.Err(); err != nil {
+		if err = w.EndLine(); err != nil {
 			return
 		}
-		curPath := f.Name()
-		if err = f.Close(); err != nil {
-			return
+		if !indels {
+			continue
+		}
+		indelAlleles = unionIndelAlleles(indelAlleles, rows)
+		for j := range indelAlleles {
+			allele := &indelAlleles[j]
+			writeIndelChromPosRefAlt(indelTSV, curRefName, pos, curRefSeq8, allele)
+			for _, pr := range rows {
+				var counts [2]uint32
+				if c := findIndelCounts(pr.Payload.Indels, allele); c != nil {
+					counts = c.Counts
+				}
+				indelTSV.WriteUint32(counts[0])
+				indelTSV.WriteUint32(counts[1])
+			}
+			if err = indelTSV.EndLine(); err != nil {
+				return
+			}
 		}
-		tmpFiles[i] = nil
-		// os.Remove returns an error if we try to remove a file that isn't there.
-		_ = os.Remove(curPath)
+	}
+	if err = scanner.Err(); err != nil {
+		return
 	}
 	if err = w.Flush(); err != nil {
 		return
 	}
+	if indels {
+		if err = indelTSV.Flush(); err != nil {
+			return
+		}
+	}
 	log.Printf("ConvertPileupRowsToBasestrandTSV: done, final results written to %s", fullPath)
 	return
 }
@@ -0,0 +1,102 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"fmt"
+
+	"github.com/Schaudge/grailbio/pileup"
+)
+
+// When stitching, the two bases a read-pair has at each position covered by
+// both ends are combined into a single observation.  overlapPolicy determines
+// how:
+//   agree    = The bases must agree; their error probabilities are then
+//              combined as described in qual.go.  Disagreements are counted as
+//              N.  This is the default, and suits simplex assays.
+//   max-qual = The base with the higher quality is kept, with its own quality.
+//              Disagreements with equal qualities are counted as N.
+//   sum-qual = The bases must agree; their qualities are then added, and
+//              capped at overlapSumQualCap.  Disagreements are counted as N.
+//   r1       = The first read's base is kept, with its own quality.
+// Like all other Ns, the Ns resulting from disagreements are counted
+// regardless of base quality.  Indels covered by both ends are not affected
+// by the policy; they must always agree.
+type overlapPolicy int
+
+const (
+	overlapAgree overlapPolicy = iota
+	overlapMaxQual
+	overlapSumQual
+	overlapR1
+)
+
+// overlapSumQualCap is the highest quality the sum-qual policy can assign.
+const overlapSumQualCap = 60
+
+var overlapPolicyNameMap = map[string]overlapPolicy{
+	"agree":    overlapAgree,
+	"max-qual": overlapMaxQual,
+	"sum-qual": overlapSumQual,
+	"r1":       overlapR1,
+}
+
+// parseOverlapPolicy converts an Opts.OverlapPolicy value to an
+// overlapPolicy.  The empty string is treated as "agree".
+func parseOverlapPolicy(name string) (overlapPolicy, error) {
+	if name == "" {
+		return overlapAgree, nil
+	}
+	policy, ok := overlapPolicyNameMap[name]
+	if !ok {
+		return overlapAgree, fmt.Errorf("parseOverlapPolicy: unrecognized overlap policy '%s'", name)
+	}
+	return policy, nil
+}
+
+// stitchBase combines the bases (.bam seq8 encoding) and qualities of the two
+// ends of a read-pair at a single position.  r1 is the index (0 or 1) of the
+// pair's first read.  It returns the combined base (pileup enum encoding) and
+// its quality; disagreements which are masked out are returned as
+// (pileup.BaseX, 0).
+func (p overlapPolicy) stitchBase(seq0, qual0, seq1, qual1 byte, r1 int) (base, qual byte) {
+	switch p {
+	case overlapMaxQual:
+		if qual0 > qual1 {
+			return pileup.Seq8ToEnumTable[seq0], qual0
+		}
+		if (qual1 > qual0) || (seq0 == seq1) {
+			return pileup.Seq8ToEnumTable[seq1], qual1
+		}
+	case overlapSumQual:
+		if seq0 == seq1 {
+			// Add in int, since the sum of two byte qualities can wrap around.
+			sum := int(qual0) + int(qual1)
+			if sum > overlapSumQualCap {
+				sum = overlapSumQualCap
+			}
+			return pileup.Seq8ToEnumTable[seq0], byte(sum)
+		}
+	case overlapR1:
+		if r1 == 0 {
+			return pileup.Seq8ToEnumTable[seq0], qual0
+		}
+		return pileup.Seq8ToEnumTable[seq1], qual1
+	default:
+		if seq0 == seq1 {
+			return pileup.Seq8ToEnumTable[seq0], qualSumTable[qual0][qual1]
+		}
+	}
+	return pileup.BaseX, 0
+}
@@ -0,0 +1,29 @@
+package snp
+
+import (
+	"testing"
+
+	"github.com/Schaudge/grailbio/pileup"
+)
+
+func TestStitchBaseSumQual(t *testing.T) {
+	const seqA, seqC = 1, 2
+	baseA := pileup.Seq8ToEnumTable[seqA]
+	for _, tc := range []struct {
+		seq1, qual0, qual1 byte
+		wantBase, wantQual byte
+	}{
+		{seqA, 20, 30, baseA, 50},
+		{seqA, 40, 30, baseA, overlapSumQualCap},
+		// The sum would wrap around in a byte.
+		{seqA, 0xff, 30, baseA, overlapSumQualCap},
+		{seqA, 200, 200, baseA, overlapSumQualCap},
+		{seqC, 20, 30, pileup.BaseX, 0},
+	} {
+		base, qual := overlapSumQual.stitchBase(seqA, tc.qual0, tc.seq1, tc.qual1, 0)
+		if base != tc.wantBase || qual != tc.wantQual {
+			t.Errorf("stitchBase(%d, %d, %d, %d): got (%d, %d), want (%d, %d)",
+				seqA, tc.qual0, tc.seq1, tc.qual1, base, qual, tc.wantBase, tc.wantQual)
+		}
+	}
+}
@@ -20,6 +20,7 @@ import (
 	"os"
 	"runtime"
 	"strconv"
+	"strings"
 
 	"github.com/Schaudge/grailbase/log"
 	"github.com/Schaudge/grailbase/recordio"
@@ -38,33 +39,60 @@ type Opts struct {
 	BedPath      string
 	Region       string
 	BamIndexPath string
-	Clip         int
-	Cols         string
-	FlagExclude  int
-	Mapq         int
-	MaxReadLen   int
-	MaxReadSpan  int
-	MinBagDepth  int
-	MinBaseQual  int
-	Parallelism  int
-	PerStrand    bool
-	RemoveSq     bool
-	Stitch       bool
-	TempDir      string
+	// BAQ enables samtools-style base alignment quality capping; see baq.go.
+	BAQ         bool
+	Clip        int
+	Cols        string
+	FlagExclude int
+	Mapq        int
+	MaxReadLen  int
+	MaxReadSpan int
+	// MaxSplicedSpan is the upper bound on the reference span of a spliced read
+	// (one with N CIGAR operations), skipped regions included.  When it is 0,
+	// spliced reads are subject to MaxReadSpan like any other read.
+	MaxSplicedSpan int
+	MinBagDepth    int
+	MinBaseQual    int
+	// OverlapPolicy determines how the overlapping bases of stitched
+	// read-pairs are combined: "agree" (the default), "max-qual", "sum-qual",
+	// or "r1".  See overlap.go.
+	OverlapPolicy string
+	Parallelism   int
+	PerStrand     bool
+	RemoveSq      bool
+	Stitch        bool
+	TempDir       string
+	// UMITag enables UMI-family consensus, using the UMIs in the given aux tag
+	// (usually "RX"); see umi.go.  It requires Stitch.  UMIMaxMismatches is
+	// the number of mismatches tolerated between the UMIs of a family, and
+	// families with fewer than MinFamilySize read-pairs are dropped.
+	UMITag           string
+	UMIMaxMismatches int
+	MinFamilySize    int
+
+	// Reference is the ASCII-encoded reference (the default encoding of
+	// fasta.New) used to decode CRAM inputs, and PAM inputs written with
+	// pam.WriteOpts.Reference.  The Seq8-encoded reference passed to Pileup()
+	// cannot be used for this.  If Reference is nil, it is loaded from the
+	// fapath argument of Pileup() when some input is a CRAM or PAM file.
+	Reference fasta.Fasta
 }
 
 var DefaultOpts = Opts{
-	Clip:        0,
-	FlagExclude: 0xf00,
-	Mapq:        60,
-	MaxReadLen:  500,
-	MaxReadSpan: 511,
-	MinBagDepth: 0,
-	MinBaseQual: 0,
-	Parallelism: 0,
-	PerStrand:   false,
-	RemoveSq:    false,
-	Stitch:      false,
+	Clip:             0,
+	FlagExclude:      0xf00,
+	Mapq:             60,
+	MaxReadLen:       500,
+	MaxReadSpan:      511,
+	MinBagDepth:      0,
+	MinBaseQual:      0,
+	OverlapPolicy:    "agree",
+	Parallelism:      0,
+	PerStrand:        false,
+	RemoveSq:         false,
+	Stitch:           false,
+	UMIMaxMismatches: 1,
+	MinFamilySize:    1,
 }
 
 // Problem:
@@ -79,9 +107,12 @@ var DefaultOpts = Opts{
 // complexity:
 // 1. No read is longer than -max-read-len (default 500) bases.
 // 2. No read is mapped to a reference-genome interval longer than
-//    -max-read-span (default 511) bases.  Note that this is incompatible with
-//    RNAseq data.
+//    -max-read-span (default 511) bases, not counting the skipped regions
+//    (N CIGAR operations) of spliced reads.
 // These allow us to use fixed-size buffers for most of our computation.
+// Spliced RNAseq reads can still reach positions far beyond the circular
+// buffer; those positions' stats are kept in a sparse overflow map until the
+// buffer catches up with them (see pileupMutable.rowAt()).
 //
 // More precisely, suppose we are processing a read starting at (0-based)
 // position 1000, and we aren't stitching read-pairs together.  Then, we might
@@ -131,6 +162,10 @@ var DefaultOpts = Opts{
 //              Slated for renaming.
 //   LowQ     = Currently an all-zero column existing for backward
 //              compatibility.  Will be removed.
+//   Indels   = INS/DEL counts in .ref.tsv, and one .alt.tsv row per indel
+//              allele.  Also enables indel counting; see indel.go.
+//   Discordant = Number of stitched read-pairs whose two ends have different
+//                bases, in .ref.tsv.  Requires stitching.
 const (
 	colBitDpRef = 1 << iota
 	colBitDpAlt
@@ -141,19 +176,23 @@ const (
 
 	colBitHighQ
 	colBitLowQ
+	colBitIndels
+	colBitDiscordant
 )
 
 const colPerReadMask = (colBitEndDists | colBitQuals | colBitFraglens | colBitStrands)
 
 var colNameMap = map[string]int{
-	"dpref":    colBitDpRef,
-	"dpalt":    colBitDpAlt,
-	"enddists": colBitEndDists,
-	"quals":    colBitQuals,
-	"fraglens": colBitFraglens,
-	"strands":  colBitStrands,
-	"highq":    colBitHighQ,
-	"lowq":     colBitLowQ,
+	"dpref":      colBitDpRef,
+	"dpalt":      colBitDpAlt,
+	"enddists":   colBitEndDists,
+	"quals":      colBitQuals,
+	"fraglens":   colBitFraglens,
+	"strands":    colBitStrands,
+	"highq":      colBitHighQ,
+	"lowq":       colBitLowQ,
+	"indels":     colBitIndels,
+	"discordant": colBitDiscordant,
 }
 
 // Immutable (within each ref) background info needed for both the inner
@@ -180,13 +219,34 @@ type pileupMutable struct {
 	resultRingBuffer []PileupPayload // main ring buffer
 	seq8Buf          []byte          // preallocated buffer to simplify stitchedPileStragglerFirstreads
 	alignedBaseBufs  [2][]alignedPos // preallocated buffers for alignRelevantBases
+	indelBufs        [2][]indelEvent // preallocated buffers for alignRelevantIndels
+	mpileupBuf       []byte          // preallocated buffer for mpileup read-bases entries
+	baqQualBufs      [2][]byte       // preallocated buffers for BAQ-capped base-qualities
+	baq              baqAligner
 	firstReads       firstreadSNPTable
 	endMax           PosType // 1 + <last position that has a pileup entry>
-	w                recordio.Writer
-	writePosScanner  interval.UnionScanner
+	// overflow contains the stats of positions too far ahead of the write
+	// position to fit in resultRingBuffer.  Only spliced reads can reach them.
+	overflow map[PosType]*PileupPayload
+	// families contains the incomplete UMI families; it is nil unless UMI-family
+	// consensus is enabled.
+	families        *umiFamilyTable
+	qualSumsNeeded  bool // are per-allele base-quality sums reported in the output?
+	w               pileupRowWriter
+	writePosScanner interval.UnionScanner
+}
+
+// pileupRowWriter receives the PileupRows generated by a pileupMutable, in
+// position order.  recordio.Writer implements it.
+type pileupRowWriter interface {
+	Append(v interface{})
+	// Err returns the first error encountered, if any; the pileup stops as soon
+	// as it sees one.
+	Err() error
+	Finish() error
 }
 
-func newPileupMutable(nCirc PosType, maxReadLen int, stitch bool, w *os.File) (pm pileupMutable) {
+func newPileupMutable(nCirc PosType, maxReadLen int, stitch bool, w pileupRowWriter) (pm pileupMutable) {
 	pm = pileupMutable{
 		resultRingBuffer: make([]PileupPayload, nCirc),
 		seq8Buf:          make([]byte, 0, maxReadLen),
@@ -194,52 +254,108 @@ func newPileupMutable(nCirc PosType, maxReadLen int, stitch bool, w *os.File) (p
 			make([]alignedPos, 0, maxReadLen),
 			nil,
 		},
+		w: w,
 	}
 	if stitch {
 		pm.firstReads = newFirstreadSNPTable(nCirc)
 		pm.alignedBaseBufs[1] = make([]alignedPos, 0, maxReadLen)
 	}
-	if w != nil {
-		pm.w = recordio.NewWriter(w, recordio.WriterOpts{
-			Marshal:      MarshalPileupRow,
-			Transformers: []string{"zstd 1"},
-		})
-	}
 	return
 }
 
 // pileupContext contains immutable data needed by the main pileup routine.
 type pileupContext struct {
+	baq           bool              // are base-qualities capped by BAQ?
 	bedPart       interval.BEDUnion // per-thread BED subset
 	clip          int               // number of bases on ends of each read to treat as min-qual
 	ignoreStrand  bool              // are we reporting strand in the output?
+	indels        bool              // are we counting indels?
 	minBaseQual   byte
+	mpileup       bool           // are we building mpileup read-bases strings instead of counting?
+	overlapPolicy overlapPolicy  // how the overlapping bases of stitched read-pairs are combined
 	perReadNeeded bool           // are we reporting comma-separated per-read stats in the output, or are counts enough?
 	qpt           *qualPassTable // (R1 base-qual, R2 base-qual) good enough? lookup table
+	refSeqs       []string       // reference sequences in .bam seq8 encoding, needed for indel left-alignment
 	stitch        bool
 }
 
+// rowAt returns the pileup row for (0-based) position pos.  Positions in
+// [writePos, writePos + nCirc) live in resultRingBuffer; positions further
+// ahead, which can only be reached by the later blocks of a spliced read, live
+// in the overflow map until they are flushed.
+func (pm *pileupMutable) rowAt(pos PosType) *PileupPayload {
+	nCirc := pm.nCirc()
+	if pos-pm.writePosScanner.Pos() < nCirc {
+		return &pm.resultRingBuffer[pos&(nCirc-1)]
+	}
+	if pm.overflow == nil {
+		pm.overflow = make(map[PosType]*PileupPayload)
+	}
+	row := pm.overflow[pos]
+	if row == nil {
+		row = &PileupPayload{}
+		pm.overflow[pos] = row
+	}
+	return row
+}
+
+// mergeOverflow moves the overflow stats of position pos, if any, into row,
+// which must be pos's resultRingBuffer row.
+func (pm *pileupMutable) mergeOverflow(pos PosType, row *PileupPayload) {
+	src := pm.overflow[pos]
+	if src == nil {
+		return
+	}
+	delete(pm.overflow, pos)
+	row.Depth += src.Depth
+	for i := range row.Counts {
+		for j := range row.Counts[i] {
+			row.Counts[i][j] += src.Counts[i][j]
+		}
+		row.QualSums[i] += src.QualSums[i]
+	}
+	row.Discordant[0] += src.Discordant[0]
+	row.Discordant[1] += src.Discordant[1]
+	row.ReadBases = append(row.ReadBases, src.ReadBases...)
+	row.ReadQuals = append(row.ReadQuals, src.ReadQuals...)
+	for i := range row.PerRead {
+		row.PerRead[i] = append(row.PerRead[i], src.PerRead[i]...)
+	}
+	for i := range src.Indels {
+		if c := findIndelCounts(row.Indels, &src.Indels[i]); c != nil {
+			c.Counts[0] += src.Indels[i].Counts[0]
+			c.Counts[1] += src.Indels[i].Counts[1]
+			c.QualSum += src.Indels[i].QualSum
+		} else {
+			row.Indels = append(row.Indels, src.Indels[i])
+		}
+	}
+}
+
 // addBase performs a pileup update that only requires count-increments.
-func (pm *pileupMutable) addBase(circPos, posInRead, isMinus PosType, seq, qual []byte, minBaseQual byte) {
-	row := &pm.resultRingBuffer[circPos]
+func (pm *pileupMutable) addBase(pos, posInRead, isMinus PosType, seq, qual []byte, minBaseQual byte) {
+	row := pm.rowAt(pos)
 	row.Depth++
 	base := pileup.Seq8ToEnumTable[seq[posInRead]]
 	// Always count Ns, to preserve tsv-snp2 compatibility.
 	if (qual[posInRead] >= minBaseQual) || (base == pileup.BaseX) {
 		row.Counts[base][isMinus]++
+		row.QualSums[base] += uint32(qual[posInRead])
 	}
 }
 
 // appendBase performs a more-expensive pileup update that appends a bunch of
 // per-read stats.
-func (pm *pileupMutable) appendBase(circPos, posInRead, isMinus PosType, seq, qual []byte, minBaseQual, strandByte byte) {
-	row := &pm.resultRingBuffer[circPos]
+func (pm *pileupMutable) appendBase(pos, posInRead, isMinus PosType, seq, qual []byte, minBaseQual, strandByte byte) {
+	row := pm.rowAt(pos)
 	row.Depth++
 	base := pileup.Seq8ToEnumTable[seq[posInRead]]
 	if base == pileup.BaseX {
 		row.Counts[base][isMinus]++
+		row.QualSums[base] += uint32(qual[posInRead])
 	} else if qual[posInRead] >= minBaseQual {
 		row.Counts[base][isMinus]++
+		row.QualSums[base] += uint32(qual[posInRead])
 		row.PerRead[base] = append(row.PerRead[base], PerReadFeatures{
 			Dist5p:  uint16(posInRead),
 			Fraglen: uint16(len(qual)),
@@ -252,16 +368,15 @@ func (pm *pileupMutable) appendBase(circPos, posInRead, isMinus PosType, seq, qu
 // addUnstitchedSegment adds an unpaired portion of a single read to the
 // pileup.
 func (pm *pileupMutable) addUnstitchedSegment(read *readSNP, isMinus PosType, alignedBases []alignedPos, minBaseQual byte, perReadNeeded bool) {
-	mask := pm.nCirc() - 1
 	qual := read.samr.Qual
 	if !perReadNeeded {
 		for _, ab := range alignedBases {
-			pm.addBase(ab.posInRef&mask, ab.posInRead, isMinus, read.seq8, qual, minBaseQual)
+			pm.addBase(ab.posInRef, ab.posInRead, isMinus, read.seq8, qual, minBaseQual)
 		}
 	} else {
 		strandByte := byte(pileup.GetStrand(read.samr))
 		for _, ab := range alignedBases {
-			pm.appendBase(ab.posInRef&mask, ab.posInRead, isMinus, read.seq8, qual, minBaseQual, strandByte)
+			pm.appendBase(ab.posInRef, ab.posInRead, isMinus, read.seq8, qual, minBaseQual, strandByte)
 		}
 	}
 }
@@ -368,8 +483,38 @@ func (pm *pileupMutable) addReadPair(reads []readSNP, isMinus PosType, pCtx *pil
 		if err = alignRelevantBases(&(pm.alignedBaseBufs[i]), r, &pCtx.bedPart); err != nil {
 			return
 		}
+		if pCtx.baq {
+			// Like samtools, BAQ is computed from the unclipped base-qualities.  The
+			// capped qualities are only used after the indels are counted.
+			pm.baqQualBufs[i] = append(pm.baqQualBufs[i][:0], r.samr.Qual...)
+			pm.baq.apply(r.samr, r.seq8, pCtx.refSeqs[r.samr.Ref.ID()], pm.baqQualBufs[i])
+		}
 		clipQuals(r.samr, pCtx.clip)
 	}
+	if pCtx.indels {
+		if err = pm.addIndels(reads, isMinus, pCtx); err != nil {
+			return
+		}
+	}
+	if pCtx.baq {
+		for i := range reads {
+			qual := reads[i].samr.Qual
+			for j, q := range pm.baqQualBufs[i] {
+				if q < qual[j] {
+					qual[j] = q
+				}
+			}
+		}
+	}
+	if pCtx.mpileup {
+		// Read-pairs are never stitched in this case.
+		pm.addMpileupRead(&reads[0], pCtx)
+		return
+	}
+	if pm.families != nil {
+		pm.families.add(reads, isMinus, pm.alignedBaseBufs[0], pm.alignedBaseBufs[1], pCtx.overlapPolicy)
+		return
+	}
 	abb0 := pm.alignedBaseBufs[0]
 	abb1 := pm.alignedBaseBufs[1]
 	minBaseQual := pCtx.minBaseQual
@@ -394,11 +539,14 @@ func (pm *pileupMutable) addReadPair(reads []readSNP, isMinus PosType, pCtx *pil
 		}
 		return
 	}
-	mask := pm.nCirc() - 1
 	seq0 := reads[0].seq8
 	seq1 := reads[1].seq8
 	qual0 := reads[0].samr.Qual
 	qual1 := reads[1].samr.Qual
+	r1 := 0
+	if (reads[1].samr.Flags & sam.Read1) != 0 {
+		r1 = 1
+	}
 	idx0 := 0
 	idx1 := 0
 	// Loop over all relevant positions, stitching shared bases when possible,
@@ -407,37 +555,37 @@ func (pm *pileupMutable) addReadPair(reads []readSNP, isMinus PosType, pCtx *pil
 		posInRef0 := abb0[idx0].posInRef
 		posInRef1 := abb1[idx1].posInRef
 		if posInRef0 == posInRef1 {
-			row := &pm.resultRingBuffer[posInRef0&mask]
+			row := pm.rowAt(posInRef0)
 			row.Depth++
 			posInRead0 := abb0[idx0].posInRead
 			curSeq0 := seq0[posInRead0] // 'Seq0' instead of 'Base0' since this still uses BAM encoding
 			posInRead1 := abb1[idx1].posInRead
 			curSeq1 := seq1[posInRead1]
-			if curSeq0 == curSeq1 {
-				base := pileup.Seq8ToEnumTable[curSeq0]
-				if !perReadNeeded {
-					if pCtx.qpt.lookup2(qual0[posInRead0], qual1[posInRead1]) || (base == pileup.BaseX) {
-						row.Counts[base][isMinus]++
-					}
-				} else {
-					// dist5p/fraglen are a bit complicated in this case.  Punt for now.
-					panic("stitched per-read features not yet supported")
-				}
-			} else {
-				row.Counts[pileup.BaseX][isMinus]++
+			if curSeq0 != curSeq1 {
+				row.Discordant[isMinus]++
+			}
+			base, qual := pCtx.overlapPolicy.stitchBase(curSeq0, qual0[posInRead0], curSeq1, qual1[posInRead1], r1)
+			if perReadNeeded && (base != pileup.BaseX) {
+				// dist5p/fraglen are a bit complicated in this case.  Punt for now.
+				panic("stitched per-read features not yet supported")
+			}
+			// Always count Ns, including masked disagreements.
+			if (qual >= minBaseQual) || (base == pileup.BaseX) {
+				row.Counts[base][isMinus]++
+				row.QualSums[base] += uint32(qual)
 			}
 			idx0++
 			idx1++
 		} else if posInRef0 < posInRef1 {
 			if !perReadNeeded {
-				pm.addBase(posInRef0&mask, abb0[idx0].posInRead, isMinus, seq0, qual0, minBaseQual)
+				pm.addBase(posInRef0, abb0[idx0].posInRead, isMinus, seq0, qual0, minBaseQual)
 			} else {
 				panic("stitched per-read features not yet supported")
 			}
 			idx0++
 		} else {
 			if !perReadNeeded {
-				pm.addBase(posInRef1&mask, abb1[idx1].posInRead, isMinus, seq1, qual1, minBaseQual)
+				pm.addBase(posInRef1, abb1[idx1].posInRead, isMinus, seq1, qual1, minBaseQual)
 			} else {
 				panic("stitched per-read features not yet supported")
 			}
@@ -518,7 +666,10 @@ func (pm *pileupMutable) flushToInternal(rCtx *refContext, perReadNeeded bool, w
 	for pm.writePosScanner.Scan(&start, &end, writeEnd) {
 		for pos := start; pos != end; pos++ {
 			row := &pm.resultRingBuffer[pos&mask]
-			if row.Depth == 0 {
+			if len(pm.overflow) != 0 {
+				pm.mergeOverflow(pos, row)
+			}
+			if (row.Depth == 0) && (len(row.Indels) == 0) {
 				// It isn't strictly necessary to separate out this case, but it's a
 				// significant performance win when zero-depth is common.
 				pm.w.Append(&PileupRow{
@@ -527,15 +678,40 @@ func (pm *pileupMutable) flushToInternal(rCtx *refContext, perReadNeeded bool, w
 				})
 			} else {
 				fieldsPresent := uint32(FieldCounts)
+				// Like perRead, indels must be deep-copied before the ring-buffer row
+				// is cleared.
+				var indelsCopy []IndelCounts
+				if len(row.Indels) != 0 {
+					fieldsPresent |= FieldIndels
+					indelsCopy = append([]IndelCounts(nil), row.Indels...)
+					row.Indels = row.Indels[:0]
+				}
+				if pm.qualSumsNeeded {
+					fieldsPresent |= FieldQualSums
+				}
+				if (row.Discordant[0] | row.Discordant[1]) != 0 {
+					fieldsPresent |= FieldDiscordant
+				}
+				var readBasesCopy, readQualsCopy []byte
+				if len(row.ReadQuals) != 0 {
+					fieldsPresent |= FieldReadBases
+					readBasesCopy = append([]byte(nil), row.ReadBases...)
+					readQualsCopy = append([]byte(nil), row.ReadQuals...)
+					row.ReadBases = row.ReadBases[:0]
+					row.ReadQuals = row.ReadQuals[:0]
+				}
 				if !perReadNeeded {
+					payload := *row
+					payload.Indels = indelsCopy
+					payload.ReadBases = readBasesCopy
+					payload.ReadQuals = readQualsCopy
 					pm.w.Append(&PileupRow{
 						FieldsPresent: fieldsPresent,
 						RefID:         uint32(refID),
 						Pos:           uint32(pos),
-						Payload:       *row,
+						Payload:       payload,
 					})
 				} else {
-					fieldsPresent := FieldCounts
 					// perRead contains regular slices instead of just arrays, so we need
 					// to deep-copy it before clearing the ring-buffer copy.
 					var perReadCopy [pileup.NBase][]PerReadFeatures
@@ -550,9 +726,14 @@ func (pm *pileupMutable) flushToInternal(rCtx *refContext, perReadNeeded bool, w
 						RefID:         uint32(refID),
 						Pos:           uint32(pos),
 						Payload: PileupPayload{
-							Depth:   row.Depth,
-							Counts:  row.Counts,
-							PerRead: perReadCopy,
+							Depth:      row.Depth,
+							Counts:     row.Counts,
+							PerRead:    perReadCopy,
+							Indels:     indelsCopy,
+							QualSums:   row.QualSums,
+							Discordant: row.Discordant,
+							ReadBases:  readBasesCopy,
+							ReadQuals:  readQualsCopy,
 						},
 					})
 					for i := range row.PerRead {
@@ -563,12 +744,14 @@ func (pm *pileupMutable) flushToInternal(rCtx *refContext, perReadNeeded bool, w
 					for j := range row.Counts[i] {
 						row.Counts[i][j] = 0
 					}
+					row.QualSums[i] = 0
 				}
 				row.Depth = 0
+				row.Discordant = [2]uint32{}
 			}
 		}
 	}
-	return
+	return pm.w.Err()
 }
 
 // flushTo is the main writer function.  flushEnd is
@@ -581,7 +764,7 @@ func (pm *pileupMutable) flushTo(rCtx *refContext, perReadNeeded bool, flushEnd
 			return
 		}
 	}
-	return writeEmptyEntries(&pm.w, rCtx, flushEnd, &pm.writePosScanner)
+	return writeEmptyEntries(pm.w, rCtx, flushEnd, &pm.writePosScanner)
 }
 
 type outputFormat int
@@ -592,33 +775,49 @@ const (
 	formatBasestrandTSVBgz
 	formatTSV
 	formatTSVBgz
+	formatVCF
+	formatVCFBgz
+	formatMpileup
 )
 
+// targetShardsPerJob is the number of shards generated per job when a BED file
+// is given.
+const targetShardsPerJob = 8
+
 type pileupSNPOpts struct {
+	baq              bool
 	bedUnion         interval.BEDUnion
 	clip             int
 	colBitset        int
 	fapath           string
 	flagExclude      int
 	format           outputFormat
+	jobBounds        []int
 	linearConsensus  int
 	linearNosplit    bool
 	mapq             int
 	maxLinearBagSpan int
 	maxReadLen       int
 	maxReadSpan      int
+	maxSplicedSpan   int
 	minBagDepth      int
 	minBaseQual      int
 	minBaseQualSum   int
+	minFamilySize    int
 	outPrefix        string
+	overlapPolicy    overlapPolicy
 	padding          int
 	parallelism      int
-	provider         bamprovider.Provider
+	providers        []bamprovider.Provider // one per sample
+	qualSums         bool                   // are per-allele base-quality sums needed?
 	refSeqs          []string
 	removeSq         bool
+	sampleNames      []string
 	shards           []gbam.Shard
 	stitch           bool
 	tempDir          string
+	umiMaxMismatches int
+	umiTag           string
 }
 
 func (pm *pileupMutable) finishRef(refIdxEnd int, rCtx *refContext, pCtx *pileupContext) (err error) {
@@ -626,6 +825,7 @@ func (pm *pileupMutable) finishRef(refIdxEnd int, rCtx *refContext, pCtx *pileup
 		if err = pm.addOrphanReads(pCtx, PosTypeMax); err != nil {
 			return
 		}
+		pm.flushFamilies(pCtx, PosTypeMax)
 		if err = pm.flushTo(rCtx, pCtx.perReadNeeded, PosTypeMax); err != nil {
 			return
 		}
@@ -658,8 +858,15 @@ type pileupShardContext struct {
 	readPair     [2]readSNP
 }
 
-func (pm *pileupMutable) processShard(shard gbam.Shard, opts *pileupSNPOpts, rCtx *refContext, pCtx *pileupContext, psCtx *pileupShardContext) (err error) {
-	iter := opts.provider.NewIterator(shard)
+// pileupSampleState contains a single sample's pileup state within a job.
+type pileupSampleState struct {
+	results pileupMutable
+	rCtx    refContext
+	psCtx   pileupShardContext
+}
+
+func (pm *pileupMutable) processShard(shard gbam.Shard, provider bamprovider.Provider, opts *pileupSNPOpts, rCtx *refContext, pCtx *pileupContext, psCtx *pileupShardContext) (err error) {
+	iter := provider.NewIterator(shard)
 	defer func() {
 		if e := iter.Close(); e != nil && err == nil {
 			err = e
@@ -755,6 +962,7 @@ func (pm *pileupMutable) processShard(shard gbam.Shard, opts *pileupSNPOpts, rCt
 			if err = pm.addOrphanReads(pCtx, flushEnd); err != nil {
 				return
 			}
+			pm.flushFamilies(pCtx, flushEnd)
 			if err = pm.flushTo(rCtx, pCtx.perReadNeeded, flushEnd); err != nil {
 				return
 			}
@@ -768,7 +976,14 @@ func (pm *pileupMutable) processShard(shard gbam.Shard, opts *pileupSNPOpts, rCt
 		}
 		span, _ := curRead.Cigar.Lengths()
 		if span > opts.maxReadSpan {
-			return fmt.Errorf("pileupMutable.processShard: maxReadSpan is %d, but read %s at %s:%d has span %d", opts.maxReadSpan, curRead.Name, rCtx.refName, curRead.Pos, span)
+			// Spliced reads may exceed maxReadSpan by the length of their skipped
+			// regions, up to maxSplicedSpan.
+			if (opts.maxSplicedSpan == 0) || (span-skippedLen(curRead.Cigar) > opts.maxReadSpan) {
+				return fmt.Errorf("pileupMutable.processShard: maxReadSpan is %d, but read %s at %s:%d has span %d", opts.maxReadSpan, curRead.Name, rCtx.refName, curRead.Pos, span)
+			}
+			if span > opts.maxSplicedSpan {
+				return fmt.Errorf("pileupMutable.processShard: maxSplicedSpan is %d, but read %s at %s:%d has span %d", opts.maxSplicedSpan, curRead.Name, rCtx.refName, curRead.Pos, span)
+			}
 		}
 		mapEnd := PosType(curRead.Pos + span)
 		if !pCtx.bedPart.IntersectsByID(rCtx.refID, PosType(curRead.Pos), mapEnd) {
@@ -809,14 +1024,9 @@ func (pm *pileupMutable) processShard(shard gbam.Shard, opts *pileupSNPOpts, rCt
 	return
 }
 
-func pileupSNPMain(ctx context.Context, opts *pileupSNPOpts, strandReq pileup.StrandType) (err error) {
-	if (opts.format != formatTSV) && (opts.format != formatTSVBgz) && (strandReq != pileup.StrandNone) {
-		err = fmt.Errorf("pileupSNPMain: single-strand mode not supported with basestrand output (strands are already tracked separately)")
-		return
-	}
-	nShard := len(opts.shards)
-	parallelism := minInt(opts.parallelism, nShard)
-
+// runPileupJob piles up the given contiguous shards, for all samples at once,
+// and sends each sample's PileupRows to the corresponding writer.
+func runPileupJob(ctx context.Context, opts *pileupSNPOpts, strandReq pileup.StrandType, qpt *qualPassTable, shardSlice []gbam.Shard, writers []pileupRowWriter) error {
 	// When we aren't stitching, it is always safe to flush final pileup results
 	// for all positions before the current read-start; we only need to keep
 	// track of the maxReadSpan positions past that point.
@@ -828,6 +1038,112 @@ func pileupSNPMain(ctx context.Context, opts *pileupSNPOpts, strandReq pileup.St
 	if opts.stitch {
 		nCirc = nCirc * 2
 	}
+	maxReadLen := opts.maxReadLen
+	samples := make([]pileupSampleState, len(writers))
+	for i := range samples {
+		ss := &samples[i]
+		ss.rCtx = refContext{
+			refID: -1,
+		}
+		ss.results = newPileupMutable(nCirc, maxReadLen, opts.stitch, writers[i])
+		ss.results.qualSumsNeeded = opts.qualSums
+		if opts.umiTag != "" {
+			ss.results.families = newUMIFamilyTable(opts.umiTag, opts.umiMaxMismatches, opts.minFamilySize)
+		}
+		// This contains context only needed by the top-level processShard
+		// function.
+		ss.psCtx = pileupShardContext{
+			strandReq:   strandReq,
+			prevLimitID: -1,
+		}
+		ss.psCtx.readPair[0].seq8 = make([]byte, 0, maxReadLen)
+		ss.psCtx.readPair[1].seq8 = make([]byte, 0, maxReadLen)
+	}
+
+	// We already got the header before, so it shouldn't be possible for this
+	// call to generate a new error.
+	header, _ := opts.providers[0].GetHeader()
+	headerRefs := header.Refs()
+	padding := PosType(opts.padding)
+
+	// This contains information needed by some functions called by
+	// pileupMutable.processShard.
+	// Probable todo: set ignoreStrand to false when per-strand TSV output is
+	// requested, and move the per-strand-reporting logic to the final
+	// internal-format -> final format conversion; this lets up stop executing
+	// the main loop twice.
+	pCtx := pileupContext{
+		baq:           opts.baq,
+		clip:          opts.clip,
+		ignoreStrand:  (opts.format == formatTSV) || (opts.format == formatTSVBgz) || (opts.format == formatMpileup),
+		indels:        ((opts.colBitset & colBitIndels) != 0),
+		perReadNeeded: ((opts.colBitset & (colBitEndDists | colBitQuals | colBitFraglens | colBitStrands)) != 0),
+		minBaseQual:   byte(opts.minBaseQual),
+		mpileup:       opts.format == formatMpileup,
+		overlapPolicy: opts.overlapPolicy,
+		stitch:        opts.stitch,
+		qpt:           qpt,
+		refSeqs:       opts.refSeqs,
+	}
+	// The final concatenation step does not currently deduplicate records in
+	// the overlapping region, so it's necessary to precisely split the
+	// BEDUnion here.
+	{
+		firstCoordRange := gbam.ShardToCoordRange(shardSlice[0])
+		startRefID := int(firstCoordRange.Start.RefId)
+		startPos := PosType(firstCoordRange.Start.Pos)
+
+		lastCoordRange := gbam.ShardToCoordRange(shardSlice[len(shardSlice)-1])
+		limitRefID := int(lastCoordRange.Limit.RefId)
+		limitPos := PosType(lastCoordRange.Limit.Pos)
+		if limitRefID < 0 {
+			limitRefID = len(headerRefs) - 1
+			limitPos = PosType(headerRefs[limitRefID].Len())
+		}
+		pCtx.bedPart = opts.bedUnion.Subset(startRefID, startPos, limitRefID, limitPos)
+	}
+
+	// Every shard is piled up for all samples before moving on to the next
+	// one.
+	for _, shard := range shardSlice {
+		if e := ctx.Err(); e != nil {
+			return e
+		}
+		// May as well skip completely-nonoverlapping shards.
+		if intersectionIsEmpty(&shard, headerRefs, &pCtx.bedPart) {
+			continue
+		}
+		coordRange := gbam.ShardToCoordRange(shard)
+		for i := range samples {
+			ss := &samples[i]
+			if e := ss.results.processShard(shard, opts.providers[i], opts, &ss.rCtx, &pCtx, &ss.psCtx); e != nil {
+				return e
+			}
+			ss.psCtx.shardOverlap = true
+			ss.psCtx.prevLimitID = int(coordRange.Limit.RefId)
+			ss.psCtx.prevLimitPos = int(coordRange.Limit.Pos) + int(padding)
+		}
+	}
+	for i := range samples {
+		ss := &samples[i]
+		// Flush last entries, unless there were no entries at all.
+		if e := ss.results.finishRef(len(headerRefs), &ss.rCtx, &pCtx); e != nil {
+			return e
+		}
+		if e := ss.results.w.Finish(); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+func pileupSNPMain(ctx context.Context, opts *pileupSNPOpts, strandReq pileup.StrandType) (err error) {
+	if (opts.format != formatTSV) && (opts.format != formatTSVBgz) && (strandReq != pileup.StrandNone) {
+		err = fmt.Errorf("pileupSNPMain: single-strand mode not supported with basestrand, VCF, or mpileup output (strands are already tracked separately)")
+		return
+	}
+	nShard := len(opts.shards)
+	parallelism := minInt(opts.parallelism, nShard)
 
 	var qpt qualPassTable
 	if qpt, err = newQualPassTable(byte(opts.minBaseQual)); err != nil {
@@ -842,100 +1158,47 @@ func pileupSNPMain(ctx context.Context, opts *pileupSNPOpts, strandReq pileup.St
 		}
 	}
 
-	tmpFiles := make([]*os.File, parallelism)
+	// tmpFiles is indexed by [sample][job].
+	nSample := len(opts.providers)
+	tmpFiles := make([][]*os.File, nSample)
 	defer func() {
-		for _, f := range tmpFiles {
-			if f != nil {
-				if e := f.Close(); e != nil && err == nil {
-					err = e
+		for _, sampleFiles := range tmpFiles {
+			for _, f := range sampleFiles {
+				if f != nil {
+					if e := f.Close(); e != nil && err == nil {
+						err = e
+					}
 				}
 			}
 		}
 	}()
-	for jobIdx := range tmpFiles {
-		if tmpFiles[jobIdx], err = ioutil.TempFile(opts.tempDir, "pileup_tmp"+strconv.Itoa(jobIdx)+"_*.rio"); err != nil {
-			return
+	for sampleIdx := range tmpFiles {
+		tmpFiles[sampleIdx] = make([]*os.File, parallelism)
+		for jobIdx := range tmpFiles[sampleIdx] {
+			if tmpFiles[sampleIdx][jobIdx], err = ioutil.TempFile(opts.tempDir, "pileup_tmp"+strconv.Itoa(jobIdx)+"_"+strconv.Itoa(sampleIdx)+"_*.rio"); err != nil {
+				return
+			}
 		}
 	}
 
+	// Balance the jobs by the number of BED positions they cover, since the
+	// shards may have very different sizes.
+	{
+		header, _ := opts.providers[0].GetHeader()
+		opts.jobBounds = partitionShards(opts.shards, parallelism, header.Refs(), &opts.bedUnion)
+	}
+
 	log.Printf("pileupSNPMain: starting main loop (%d jobs)\n", parallelism)
 	err = traverse.Each(parallelism, func(jobIdx int) error {
-		startIdx := (jobIdx * nShard) / parallelism
-		endIdx := ((jobIdx + 1) * nShard) / parallelism
-		shardSlice := opts.shards[startIdx:endIdx]
-
-		rCtx := refContext{
-			refID: -1,
+		shardSlice := opts.shards[opts.jobBounds[jobIdx]:opts.jobBounds[jobIdx+1]]
+		writers := make([]pileupRowWriter, nSample)
+		for i := range writers {
+			writers[i] = recordio.NewWriter(tmpFiles[i][jobIdx], recordio.WriterOpts{
+				Marshal:      MarshalPileupRow,
+				Transformers: []string{"zstd 1"},
+			})
 		}
-		maxReadLen := opts.maxReadLen
-		results := newPileupMutable(nCirc, maxReadLen, opts.stitch, tmpFiles[jobIdx])
-
-		// We already got the header before, so it shouldn't be possible for this
-		// call to generate a new error.
-		header, _ := opts.provider.GetHeader()
-		headerRefs := header.Refs()
-		padding := PosType(opts.padding)
-
-		// This contains information needed by some functions called by
-		// pileupMutable.processShard.
-		// Probable todo: set ignoreStrand to false when per-strand TSV output is
-		// requested, and move the per-strand-reporting logic to the final
-		// internal-format -> final format conversion; this lets up stop executing
-		// the main loop twice.
-		pCtx := pileupContext{
-			clip:          opts.clip,
-			ignoreStrand:  (opts.format == formatTSV) || (opts.format == formatTSVBgz),
-			perReadNeeded: ((opts.colBitset & (colBitEndDists | colBitQuals | colBitFraglens | colBitStrands)) != 0),
-			minBaseQual:   byte(opts.minBaseQual),
-			stitch:        opts.stitch,
-			qpt:           &qpt,
-		}
-		// The final concatenation step does not currently deduplicate records in
-		// the overlapping region, so it's necessary to precisely split the
-		// BEDUnion here.
-		{
-			firstCoordRange := gbam.ShardToCoordRange(shardSlice[0])
-			startRefID := int(firstCoordRange.Start.RefId)
-			startPos := PosType(firstCoordRange.Start.Pos)
-
-			lastCoordRange := gbam.ShardToCoordRange(shardSlice[len(shardSlice)-1])
-			limitRefID := int(lastCoordRange.Limit.RefId)
-			limitPos := PosType(lastCoordRange.Limit.Pos)
-			if limitRefID < 0 {
-				limitRefID = len(headerRefs) - 1
-				limitPos = PosType(headerRefs[limitRefID].Len())
-			}
-			pCtx.bedPart = opts.bedUnion.Subset(startRefID, startPos, limitRefID, limitPos)
-		}
-
-		// This contains context only needed by the top-level processShard
-		// function.
-		psCtx := pileupShardContext{
-			strandReq:   strandReq,
-			prevLimitID: -1,
-		}
-		psCtx.readPair[0].seq8 = make([]byte, 0, maxReadLen)
-		psCtx.readPair[1].seq8 = make([]byte, 0, maxReadLen)
-
-		for _, shard := range shardSlice {
-			// May as well skip completely-nonoverlapping shards.
-			if intersectionIsEmpty(&shard, headerRefs, &pCtx.bedPart) {
-				continue
-			}
-			if e := results.processShard(shard, opts, &rCtx, &pCtx, &psCtx); e != nil {
-				return e
-			}
-			psCtx.shardOverlap = true
-			coordRange := gbam.ShardToCoordRange(shard)
-			psCtx.prevLimitID = int(coordRange.Limit.RefId)
-			psCtx.prevLimitPos = int(coordRange.Limit.Pos) + int(padding)
-		}
-		// Flush last entries, unless there were no entries at all.
-		if e := results.finishRef(len(headerRefs), &rCtx, &pCtx); e != nil {
-			return e
-		}
-
-		return results.w.Finish()
+		return runPileupJob(ctx, opts, strandReq, &qpt, shardSlice, writers)
 	})
 	if err != nil {
 		return
@@ -947,37 +1210,93 @@ func pileupSNPMain(ctx context.Context, opts *pileupSNPOpts, strandReq pileup.St
 	} else if strandReq == pileup.StrandRev {
 		mainPath = mainPath + ".strand.rev"
 	}
-	header, _ := opts.provider.GetHeader()
+	header, _ := opts.providers[0].GetHeader()
 	var refNames []string
 	for _, ref := range header.Refs() {
 		refNames = append(refNames, ref.Name())
 	}
 	switch opts.format {
 	case formatTSV:
-		err = ConvertPileupRowsToTSV(ctx, tmpFiles, mainPath, opts.colBitset, false, opts.parallelism, refNames, opts.refSeqs)
+		err = ConvertPileupRowsToTSVSamples(ctx, tmpFiles, mainPath, opts.colBitset, false, opts.parallelism, refNames, opts.refSeqs, opts.sampleNames)
 	case formatTSVBgz:
-		err = ConvertPileupRowsToTSV(ctx, tmpFiles, mainPath, opts.colBitset, true, opts.parallelism, refNames, opts.refSeqs)
+		err = ConvertPileupRowsToTSVSamples(ctx, tmpFiles, mainPath, opts.colBitset, true, opts.parallelism, refNames, opts.refSeqs, opts.sampleNames)
 	case formatBasestrandRio:
-		err = ConvertPileupRowsToBasestrandRio(ctx, tmpFiles, mainPath, refNames)
+		// Multiple samples are rejected by PileupSamples().
+		err = ConvertPileupRowsToBasestrandRio(ctx, tmpFiles[0], mainPath, refNames)
 	case formatBasestrandTSV:
-		err = ConvertPileupRowsToBasestrandTSV(ctx, tmpFiles, mainPath, opts.colBitset, false, opts.parallelism, refNames, opts.refSeqs)
+		err = ConvertPileupRowsToBasestrandTSVSamples(ctx, tmpFiles, mainPath, opts.colBitset, false, opts.parallelism, refNames, opts.refSeqs, opts.sampleNames)
 	case formatBasestrandTSVBgz:
-		err = ConvertPileupRowsToBasestrandTSV(ctx, tmpFiles, mainPath, opts.colBitset, true, opts.parallelism, refNames, opts.refSeqs)
+		err = ConvertPileupRowsToBasestrandTSVSamples(ctx, tmpFiles, mainPath, opts.colBitset, true, opts.parallelism, refNames, opts.refSeqs, opts.sampleNames)
+	case formatVCF:
+		err = ConvertPileupRowsToVCFSamples(ctx, tmpFiles, mainPath, false, opts.parallelism, header, opts.fapath, opts.refSeqs, opts.sampleNames)
+	case formatVCFBgz:
+		err = ConvertPileupRowsToVCFSamples(ctx, tmpFiles, mainPath, true, opts.parallelism, header, opts.fapath, opts.refSeqs, opts.sampleNames)
+	case formatMpileup:
+		err = ConvertPileupRowsToMpileup(ctx, tmpFiles, mainPath, refNames, opts.refSeqs)
 	}
 	return
 }
 
+// Pileup generates a pileup of a single sample.  See PileupSamples() for
+// details.
 func Pileup(ctx context.Context, xampath, fapath, format, outPrefix string, rawOpts *Opts, fa fasta.Fasta) (err error) {
+	return PileupSamples(ctx, []string{xampath}, fapath, format, outPrefix, rawOpts, fa)
+}
+
+// PileupSamples generates a joint pileup of one or more samples: every sample
+// is piled up separately, but over the same positions, and the output has one
+// set of count columns (or one VCF sample column) per sample.  Each xampath
+// may be a comma-separated list of coordinate-sorted BAM/PAM files, which are
+// piled up together as a single sample.  All inputs must have the same
+// references.
+func PileupSamples(ctx context.Context, xampaths []string, fapath, format, outPrefix string, rawOpts *Opts, fa fasta.Fasta) (err error) {
+	var opts pileupSNPOpts
+	defer opts.closeProviders(&err)
+	if err = initPileupSNPOpts(ctx, &opts, xampaths, fapath, format, outPrefix, rawOpts, fa); err != nil {
+		return
+	}
+	if rawOpts.PerStrand {
+		// special case: run twice, filtering on different strand each time
+		if err = pileupSNPMain(ctx, &opts, pileup.StrandFwd); err != nil {
+			return
+		}
+		if err = pileupSNPMain(ctx, &opts, pileup.StrandRev); err != nil {
+			return
+		}
+	} else {
+		err = pileupSNPMain(ctx, &opts, pileup.StrandNone)
+	}
+	return
+}
+
+// inputsNeedReference returns true if some of the inputs may need a reference
+// to be decoded: CRAM files, and PAM files written with
+// pam.WriteOpts.Reference.  Each xampath may be a comma-separated list.
+func inputsNeedReference(xampaths []string) bool {
+	for _, xampath := range xampaths {
+		for _, path := range strings.Split(xampath, ",") {
+			if t := bamprovider.GuessFileType(path); (t == bamprovider.CRAM) || (t == bamprovider.PAM) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// initPileupSNPOpts validates the Pileup() arguments and fills in opts: it
+// creates the providers, and loads the BED, the reference and the shards.
+// opts.closeProviders() must be called afterwards, even on error.
+func initPileupSNPOpts(ctx context.Context, opts *pileupSNPOpts, xampaths []string, fapath, format, outPrefix string, rawOpts *Opts, fa fasta.Fasta) (err error) {
 	// 1. Parse and validate command-line parameters
 	// 2. Read .bam header, BED, .fa
 	// 3. Construct disjoint shards with necessary padding
-	var opts pileupSNPOpts
 	opts.clip = rawOpts.Clip
 	opts.maxReadLen = rawOpts.MaxReadLen
 	if (opts.clip < 0) || (opts.clip*2 >= opts.maxReadLen) {
 		return fmt.Errorf("Pileup: invalid clip= argument")
 	}
 
+	opts.baq = rawOpts.BAQ
 	opts.fapath = fapath
 	opts.flagExclude = rawOpts.FlagExclude
 	opts.mapq = rawOpts.Mapq
@@ -986,10 +1305,17 @@ func Pileup(ctx context.Context, xampath, fapath, format, outPrefix string, rawO
 	if opts.maxReadLen > opts.maxReadSpan {
 		return fmt.Errorf("Pileup: max-read-len= argument cannot be larger than max-read-span= argument")
 	}
+	opts.maxSplicedSpan = rawOpts.MaxSplicedSpan
+	if (opts.maxSplicedSpan != 0) && (opts.maxSplicedSpan < opts.maxReadSpan) {
+		return fmt.Errorf("Pileup: max-spliced-span= argument cannot be smaller than max-read-span= argument")
+	}
 
 	opts.minBagDepth = rawOpts.MinBagDepth
 	opts.minBaseQual = rawOpts.MinBaseQual
 	opts.outPrefix = outPrefix
+	if opts.overlapPolicy, err = parseOverlapPolicy(rawOpts.OverlapPolicy); err != nil {
+		return
+	}
 
 	opts.parallelism = rawOpts.Parallelism
 	if opts.parallelism <= 0 {
@@ -998,6 +1324,24 @@ func Pileup(ctx context.Context, xampath, fapath, format, outPrefix string, rawO
 
 	opts.removeSq = rawOpts.RemoveSq
 	opts.tempDir = rawOpts.TempDir
+
+	opts.umiTag = rawOpts.UMITag
+	opts.umiMaxMismatches = rawOpts.UMIMaxMismatches
+	opts.minFamilySize = rawOpts.MinFamilySize
+	if opts.umiTag != "" {
+		if len(opts.umiTag) != 2 {
+			return fmt.Errorf("Pileup: invalid umi-tag= argument")
+		}
+		if !rawOpts.Stitch {
+			return fmt.Errorf("Pileup: umi-tag= requires stitch=true")
+		}
+		if opts.umiMaxMismatches < 0 {
+			return fmt.Errorf("Pileup: invalid umi-max-mismatches= argument")
+		}
+		if opts.minFamilySize < 1 {
+			return fmt.Errorf("Pileup: invalid min-family-size= argument")
+		}
+	}
 	// can look up a map instead
 	if format == "basestrand-rio" {
 		opts.format = formatBasestrandRio
@@ -1009,42 +1353,137 @@ func Pileup(ctx context.Context, xampath, fapath, format, outPrefix string, rawO
 		opts.format = formatTSV
 	} else if format == "tsv-bgz" {
 		opts.format = formatTSVBgz
+	} else if format == "vcf" {
+		opts.format = formatVCF
+	} else if format == "vcf-bgz" {
+		opts.format = formatVCFBgz
+	} else if format == "mpileup" {
+		opts.format = formatMpileup
 	} else {
 		return fmt.Errorf("Pileup: unrecognized format= argument")
 	}
+	opts.qualSums = (opts.format == formatVCF) || (opts.format == formatVCFBgz)
 	colBitsetDefault := colBitDpRef | colBitHighQ | colBitLowQ
+	if (opts.format == formatVCF) || (opts.format == formatVCFBgz) {
+		// The VCF columns are fixed, and always include indels.
+		colBitsetDefault = colBitIndels
+	} else if opts.format == formatMpileup {
+		// Indels are part of the read-bases column.
+		colBitsetDefault = 0
+	}
 	if rawOpts.Cols != "" {
 		if opts.format == formatBasestrandRio {
 			return fmt.Errorf("Pileup: -cols cannot be used with basestrand-rio output")
 		}
+		if (opts.format == formatVCF) || (opts.format == formatVCFBgz) {
+			return fmt.Errorf("Pileup: -cols cannot be used with VCF output")
+		}
+		if opts.format == formatMpileup {
+			return fmt.Errorf("Pileup: -cols cannot be used with mpileup output")
+		}
 		if opts.colBitset, err = pileup.ParseCols(rawOpts.Cols, colNameMap, colBitsetDefault); err != nil {
 			return err
 		}
+		if ((opts.colBitset & colBitDiscordant) != 0) && !rawOpts.Stitch {
+			return fmt.Errorf("Pileup: discordant columns require stitch=true")
+		}
 	} else {
 		opts.colBitset = colBitsetDefault
 	}
+	if opts.umiTag != "" {
+		// Family consensus is only computed for bases.
+		if (opts.colBitset & (colBitIndels | colPerReadMask | colBitDiscordant)) != 0 {
+			return fmt.Errorf("Pileup: umi-tag= does not support the indels, discordant, or per-read column sets (or VCF output)")
+		}
+	}
 
 	dropFields := []gbam.FieldType{
 		gbam.FieldTempLen,
 	}
-	if opts.minBagDepth == 0 {
+	if (opts.minBagDepth == 0) && (opts.umiTag == "") {
 		dropFields = append(dropFields, gbam.FieldAux)
 	}
-	opts.provider = bamprovider.NewProvider(xampath, bamprovider.ProviderOpts{
+	if fa == nil {
+		if fa, err = pileup.LoadFa(ctx, fapath, FaEncoding); err != nil {
+			return
+		}
+	}
+	// The providers need their own ASCII-encoded reference to decode CRAM and
+	// reference-encoded PAM inputs, since fa is Seq8-encoded.
+	providerFa := rawOpts.Reference
+	if (providerFa == nil) && (fapath != "") && inputsNeedReference(xampaths) {
+		if providerFa, err = pileup.LoadFa(ctx, fapath, fasta.RawASCII); err != nil {
+			return
+		}
+	}
+	// The -flag-exclude and -mapq filters are pushed down to the reader, so that
+	// the PAM reader can skip decoding the rejected reads. processShard still
+	// checks them, since they are cheap.
+	flagExclude, minMapq := opts.flagExclude, opts.mapq
+	providerOpts := bamprovider.ProviderOpts{
 		Index:      rawOpts.BamIndexPath,
-		DropFields: dropFields})
-	defer func() {
-		if e := opts.provider.Close(); e != nil && err == nil {
-			err = e
+		DropFields: dropFields,
+		Reference:  providerFa,
+		Filter: func(r *sam.Record) bool {
+			return flagExclude&int(r.Flags) == 0 && int(r.MapQ) >= minMapq
+		}}
+	if len(xampaths) == 0 {
+		return fmt.Errorf("Pileup: no BAM/PAM input")
+	}
+	if (len(xampaths) > 1) && (opts.format == formatBasestrandRio) {
+		return fmt.Errorf("Pileup: basestrand-rio output does not support multiple samples")
+	}
+	// With multiple samples, BamIndexPath is a comma-separated list with one
+	// index path per sample.
+	indexPaths := []string{rawOpts.BamIndexPath}
+	if len(xampaths) > 1 {
+		indexPaths = make([]string, len(xampaths))
+		if rawOpts.BamIndexPath != "" {
+			if indexPaths = strings.Split(rawOpts.BamIndexPath, ","); len(indexPaths) != len(xampaths) {
+				return fmt.Errorf("Pileup: got %d index paths for %d samples", len(indexPaths), len(xampaths))
+			}
 		}
-	}()
+	}
+	// The providers are closed by closeProviders().
+	opts.providers = make([]bamprovider.Provider, 0, len(xampaths))
+	for i, xampath := range xampaths {
+		providerOpts.Index = indexPaths[i]
+		// A comma-separated xampath lists coordinate-sorted files that are piled
+		// up together, as if they had been merged first.
+		if paths := strings.Split(xampath, ","); len(paths) > 1 {
+			opts.providers = append(opts.providers, bamprovider.NewMergedProvider(paths, providerOpts))
+		} else {
+			opts.providers = append(opts.providers, bamprovider.NewProvider(xampath, providerOpts))
+		}
+	}
 
+	// The first input's header determines the shards and the BED positions;
+	// the others only need to agree with it.
 	var header *sam.Header
+	if header, err = opts.providers[0].GetHeader(); err != nil {
+		return
+	}
+	opts.sampleNames = make([]string, len(xampaths))
+	for i, xampath := range xampaths {
+		sampleHeader := header
+		if i > 0 {
+			if sampleHeader, err = opts.providers[i].GetHeader(); err != nil {
+				return
+			}
+			if err = checkSameRefs(header, sampleHeader); err != nil {
+				return
+			}
+		}
+		opts.sampleNames[i] = sampleName(sampleHeader, xampath)
+		for j := 0; j < i; j++ {
+			if opts.sampleNames[j] == opts.sampleNames[i] {
+				return fmt.Errorf("Pileup: duplicate sample name %s", opts.sampleNames[i])
+			}
+		}
+	}
+
 	var regionEntry interval.Entry
 	if (rawOpts.Region != "") || (rawOpts.BedPath != "") {
-		if header, err = opts.provider.GetHeader(); err != nil {
-			return
-		}
 		if rawOpts.Region != "" {
 			if regionEntry, err = interval.ParseRegionString(rawOpts.Region); err != nil {
 				return
@@ -1071,17 +1510,26 @@ func Pileup(ctx context.Context, xampath, fapath, format, outPrefix string, rawO
 
 	// padding requirement increases if we need to keep track of fragment lengths
 	opts.padding = rawOpts.MaxReadSpan
+	// Spliced reads may start much earlier than the shard positions they cover.
+	if opts.maxSplicedSpan > opts.padding {
+		opts.padding = opts.maxSplicedSpan
+	}
 
 	if regionEntry.RefName == "" {
-		// Easiest to join the results at the end if we have each job process huge
-		// disjoint (up to padding) chunks of the genome, so let's start with that
-		// strategy.  Can experiment with finer-grained parallelism later.
-		if opts.shards, err = opts.provider.GenerateShards(bamprovider.GenerateShardsOpts{
+		// Generate shards that cover only the BED regions, with roughly equal
+		// amounts of work.  Several shards are created per job so that
+		// partitionShards() can balance the jobs.
+		if opts.shards, err = opts.providers[0].GenerateShards(bamprovider.GenerateShardsOpts{
+			Strategy:  bamprovider.TargetBased,
 			Padding:   opts.padding,
-			NumShards: opts.parallelism,
+			NumShards: opts.parallelism * targetShardsPerJob,
+			Targets:   &opts.bedUnion,
 		}); err != nil {
 			return
 		}
+		if len(opts.shards) == 0 {
+			return fmt.Errorf("Pileup: BED file does not overlap any BAM/PAM reference")
+		}
 	} else {
 		// todo: add automatic sub-sharder to bamprovider
 		found := false
@@ -1104,27 +1552,23 @@ func Pileup(ctx context.Context, xampath, fapath, format, outPrefix string, rawO
 		}
 	}
 
-	if fa == nil {
-		if fa, err = pileup.LoadFa(ctx, fapath, FaEncoding); err != nil {
-			return
-		}
-	}
 	if opts.refSeqs, err = pileup.FaToStringSlice(fa, headerRefs); err != nil {
 		return
 	}
 
 	opts.stitch = rawOpts.Stitch
+	if opts.stitch && (opts.format == formatMpileup) {
+		return fmt.Errorf("Pileup: mpileup output does not support stitch=true")
+	}
+	return
+}
 
-	if rawOpts.PerStrand {
-		// special case: run twice, filtering on different strand each time
-		if err = pileupSNPMain(ctx, &opts, pileup.StrandFwd); err != nil {
-			return
+// closeProviders closes all providers created by initPileupSNPOpts().  It
+// stores the first error in *err, unless *err is already set.
+func (opts *pileupSNPOpts) closeProviders(err *error) {
+	for _, provider := range opts.providers {
+		if e := provider.Close(); e != nil && *err == nil {
+			*err = e
 		}
-		if err = pileupSNPMain(ctx, &opts, pileup.StrandRev); err != nil {
-			return
-		}
-	} else {
-		err = pileupSNPMain(ctx, &opts, pileup.StrandNone)
 	}
-	return
 }
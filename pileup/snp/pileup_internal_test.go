@@ -6,6 +6,7 @@ import (
 	"strconv"
 	"testing"
 
+	gbam "github.com/Schaudge/grailbio/encoding/bam"
 	"github.com/Schaudge/grailbio/interval"
 	"github.com/Schaudge/grailbio/pileup"
 	"github.com/Schaudge/hts/sam"
@@ -295,3 +296,26 @@ func TestAddOrphanReads(t *testing.T) {
 		}
 	}
 }
+
+func TestPartitionShards(t *testing.T) {
+	ref1, _ := sam.NewReference("chr1", "", "", 1000000, nil, nil)
+	samHeader, _ := sam.NewHeader(nil, []*sam.Reference{ref1})
+	bedUnion, err := interval.NewBEDUnionFromEntries([]interval.Entry{
+		{RefName: "chr1", Start0: 0, End: 1000},
+		{RefName: "chr1", Start0: 5000, End: 5100},
+		{RefName: "chr1", Start0: 6000, End: 6100},
+		{RefName: "chr1", Start0: 7000, End: 7100},
+		{RefName: "chr1", Start0: 8000, End: 9000},
+	}, interval.NewBEDOpts{SAMHeader: samHeader})
+	assert.NoError(t, err)
+	var shards []gbam.Shard
+	for _, bounds := range [][2]int{{0, 1000}, {5000, 5100}, {6000, 6100}, {7000, 7100}, {8000, 9000}} {
+		shards = append(shards, gbam.Shard{StartRef: ref1, EndRef: ref1, Start: bounds[0], End: bounds[1]})
+	}
+	headerRefs := samHeader.Refs()
+	assert.EQ(t, partitionShards(shards, 1, headerRefs, &bedUnion), []int{0, 5})
+	// The small shards in the middle are used to balance the big ones.
+	assert.EQ(t, partitionShards(shards, 2, headerRefs, &bedUnion), []int{0, 3, 5})
+	assert.EQ(t, partitionShards(shards, 3, headerRefs, &bedUnion), []int{0, 1, 4, 5})
+	assert.EQ(t, partitionShards(shards, 5, headerRefs, &bedUnion), []int{0, 1, 2, 3, 4, 5})
+}
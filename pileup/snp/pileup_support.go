@@ -14,7 +14,6 @@
 package snp
 
 import (
-	"github.com/Schaudge/grailbase/recordio"
 	gbam "github.com/Schaudge/grailbio/encoding/bam"
 	"github.com/Schaudge/grailbio/interval"
 	"github.com/Schaudge/hts/sam"
@@ -84,21 +83,21 @@ func intersectionIsEmpty(shardp *gbam.Shard, headerRefs []*sam.Reference, bedPar
 	return !bedPart.Intersects(startRefID, startPos, limitRefID, limitPos)
 }
 
-// writeEmptyEntries appends empty entries to the intermediate recordio file,
-// up to flushEnd.
-func writeEmptyEntries(w *recordio.Writer, rCtx *refContext, flushEnd PosType, writePosScanner *interval.UnionScanner) (err error) {
+// writeEmptyEntries appends empty entries to the intermediate recordio file
+// (or other row writer), up to flushEnd.
+func writeEmptyEntries(w pileupRowWriter, rCtx *refContext, flushEnd PosType, writePosScanner *interval.UnionScanner) (err error) {
 	refID := rCtx.refID
 	var start PosType
 	var end PosType
 	for writePosScanner.Scan(&start, &end, flushEnd) {
 		for pos := start; pos != end; pos++ {
-			(*w).Append(&PileupRow{
+			w.Append(&PileupRow{
 				RefID: uint32(refID),
 				Pos:   uint32(pos),
 			})
 		}
 	}
-	return
+	return w.Err()
 }
 
 // nCirc() returns the common size of the position-based circular buffers.  It
@@ -121,3 +120,88 @@ func (pm *pileupMutable) flushEmptyContigs(rCtx *refContext, bedPart *interval.B
 	}
 	return
 }
+
+// shardBEDSize returns the number of BED-covered positions in the shard.
+func shardBEDSize(shard *gbam.Shard, headerRefs []*sam.Reference, bedUnion *interval.BEDUnion) int {
+	coordRange := gbam.ShardToCoordRange(*shard)
+	startRefID := int(coordRange.Start.RefId)
+	limitRefID := int(coordRange.Limit.RefId)
+	limitPos := PosType(coordRange.Limit.Pos)
+	if startRefID < 0 {
+		return 0
+	}
+	if limitRefID < 0 {
+		limitRefID = len(headerRefs) - 1
+		limitPos = PosType(headerRefs[limitRefID].Len())
+	}
+	size := 0
+	for refID := startRefID; refID <= limitRefID; refID++ {
+		startPos := PosType(0)
+		if refID == startRefID {
+			startPos = PosType(coordRange.Start.Pos)
+		}
+		endPos := PosType(headerRefs[refID].Len())
+		if refID == limitRefID {
+			endPos = limitPos
+		}
+		endpoints := bedUnion.IntersectionByID(refID, startPos, endPos)
+		for i := 0; i+1 < len(endpoints); i += 2 {
+			size += int(endpoints[i+1] - endpoints[i])
+		}
+	}
+	return size
+}
+
+// partitionShards splits shards into nJob contiguous nonempty slices with
+// roughly equal numbers of BED-covered positions.  It returns the nJob+1 slice
+// boundaries.
+//
+// REQUIRES: 0 < nJob <= len(shards).
+func partitionShards(shards []gbam.Shard, nJob int, headerRefs []*sam.Reference, bedUnion *interval.BEDUnion) []int {
+	nShard := len(shards)
+	// cumSizes[i] is the total size of shards[:i].
+	cumSizes := make([]int, nShard+1)
+	for i := range shards {
+		cumSizes[i+1] = cumSizes[i] + shardBEDSize(&shards[i], headerRefs, bedUnion)
+	}
+	total := cumSizes[nShard]
+	bounds := make([]int, nJob+1)
+	bounds[nJob] = nShard
+	for jobIdx := 1; jobIdx < nJob; jobIdx++ {
+		var idx int
+		if total == 0 {
+			idx = (jobIdx * nShard) / nJob
+		} else {
+			goal := (total * jobIdx) / nJob
+			// Find the boundary closest to goal.
+			idx = bounds[jobIdx-1] + 1
+			for (idx < nShard) && (cumSizes[idx] < goal) {
+				idx++
+			}
+			if (idx > bounds[jobIdx-1]+1) && (goal-cumSizes[idx-1] < cumSizes[idx]-goal) {
+				idx--
+			}
+		}
+		// Leave at least one shard for each job.
+		if idx < bounds[jobIdx-1]+1 {
+			idx = bounds[jobIdx-1] + 1
+		}
+		if idx > nShard-(nJob-jobIdx) {
+			idx = nShard - (nJob - jobIdx)
+		}
+		bounds[jobIdx] = idx
+	}
+	return bounds
+}
+
+// skippedLen returns the total length of the skipped regions (N operations)
+// of a CIGAR.
+func skippedLen(cigar sam.Cigar) int {
+	n := 0
+	for _, co := range cigar {
+		if co.Type() == sam.CigarSkipped {
+			n += co.Len()
+		}
+	}
+	return n
+}
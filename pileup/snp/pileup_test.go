@@ -1,15 +1,25 @@
 package snp_test
 
 import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
 	"path/filepath"
+	"strconv"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/Schaudge/grailbase/file"
 	"github.com/Schaudge/grailbase/recordio"
 	"github.com/Schaudge/grailbase/vcontext"
 	gbam "github.com/Schaudge/grailbio/encoding/bam"
+	"github.com/Schaudge/grailbio/encoding/fasta"
+	"github.com/Schaudge/grailbio/encoding/pam"
 	"github.com/Schaudge/grailbio/pileup/snp"
 	"github.com/Schaudge/hts/bam"
+	"github.com/Schaudge/hts/bgzf"
 	"github.com/Schaudge/hts/sam"
 	"github.com/grailbio/testutil"
 	"github.com/grailbio/testutil/assert"
@@ -377,3 +387,969 @@ func TestPileup(t *testing.T) {
 		assert.NoError(t, err)
 	}
 }
+
+// writeTestBAM writes the given reads, and the corresponding .gbai, to
+// tmpdir.
+func writeTestBAM(t *testing.T, tmpdir, name string, samHeader *sam.Header, reads []sam.Record) (bampath, gbaipath string) {
+	ctx := vcontext.Background()
+	bampath = filepath.Join(tmpdir, name+".bam")
+	out, err := file.Create(ctx, bampath)
+	assert.NoError(t, err)
+	bamWriter, err := bam.NewWriter(out.Writer(ctx), samHeader, 1)
+	assert.NoError(t, err)
+	for _, r := range reads {
+		assert.NoError(t, bamWriter.Write(&r))
+	}
+	assert.NoError(t, bamWriter.Close())
+	assert.NoError(t, out.Close(ctx))
+
+	gbaipath = bampath + ".gbai"
+	inBam, err := file.Open(ctx, bampath)
+	assert.NoError(t, err)
+	gbai, err := file.Create(ctx, gbaipath)
+	assert.NoError(t, err)
+	assert.NoError(t, gbam.WriteGIndex(gbai.Writer(ctx), inBam.Reader(ctx), 1024, 1))
+	assert.NoError(t, gbai.Close(ctx))
+	assert.NoError(t, inBam.Close(ctx))
+	return
+}
+
+// testRefSeq is the chrT sequence used by most tests below.
+//
+// 0-based positions: 0123456789012345678901234567890123456789
+const testRefSeq = "ACGTTTTAGCAGCAGCTGACTGACCATGCATGCAAGTCCA"
+
+// writeTestBED writes a BED file with the given contents to tmpdir.
+func writeTestBED(t *testing.T, tmpdir, bed string) (bedpath string) {
+	bedpath = filepath.Join(tmpdir, "tmp.bed")
+	assert.NoError(t, ioutil.WriteFile(bedpath, []byte(bed), 0644))
+	return
+}
+
+// newTestReference returns the reference with the single sequence chrT =
+// refSeq, in the encoding expected by snp.Pileup(), and a SAM header for it.
+// Each call creates a new *sam.Reference, since a reference cannot be shared
+// by two headers.
+func newTestReference(t *testing.T, refSeq string) (fa fasta.Fasta, ref *sam.Reference, samHeader *sam.Header) {
+	fa, err := fasta.New(strings.NewReader(">chrT\n"+refSeq+"\n"), fasta.OptEncoding(snp.FaEncoding))
+	assert.NoError(t, err)
+	ref, err = sam.NewReference("chrT", "", "", len(refSeq), nil, nil)
+	assert.NoError(t, err)
+	samHeader, err = sam.NewHeader(nil, []*sam.Reference{ref})
+	assert.NoError(t, err)
+	return
+}
+
+// quals returns n base qualities equal to q.
+func quals(n int, q byte) []byte {
+	qual := make([]byte, n)
+	for i := range qual {
+		qual[i] = q
+	}
+	return qual
+}
+
+func TestPileupIndels(t *testing.T) {
+	tmpdir, cleanup := testutil.TempDir(t, "", "")
+	defer testutil.NoCleanupOnError(t, cleanup, tmpdir)
+
+	ctx := vcontext.Background()
+	bedpath := writeTestBED(t, tmpdir, "chrT\t0\t40\n")
+
+	fa, ref, samHeader := newTestReference(t, testRefSeq)
+
+	lowQual := quals(7, 30)
+	lowQual[1] = 10
+	reads := []sam.Record{
+		// + strand read-pair, where both ends have the same homopolymer deletion.
+		// It is counted once.
+		{
+			Name:    "pair1",
+			Ref:     ref,
+			Pos:     0,
+			MapQ:    60,
+			Cigar:   []sam.CigarOp{sam.NewCigarOp(sam.CigarMatch, 5), sam.NewCigarOp(sam.CigarDeletion, 1), sam.NewCigarOp(sam.CigarMatch, 4)},
+			Flags:   sam.Paired | sam.ProperPair | sam.MateReverse | sam.Read1,
+			MateRef: ref,
+			MatePos: 2,
+			Seq:     sam.NewSeq([]byte("ACGTTTAGC")),
+			Qual:    quals(9, 30),
+		},
+		// - strand read-pair, where the ends disagree about the deletion.  It is
+		// not counted.
+		{
+			Name:    "pair2",
+			Ref:     ref,
+			Pos:     1,
+			MapQ:    60,
+			Cigar:   []sam.CigarOp{sam.NewCigarOp(sam.CigarMatch, 4), sam.NewCigarOp(sam.CigarDeletion, 1), sam.NewCigarOp(sam.CigarMatch, 4)},
+			Flags:   sam.Paired | sam.ProperPair | sam.Reverse | sam.Read1,
+			MateRef: ref,
+			MatePos: 2,
+			Seq:     sam.NewSeq([]byte("CGTTTAGC")),
+			Qual:    quals(8, 30),
+		},
+		{
+			Name:    "pair1",
+			Ref:     ref,
+			Pos:     2,
+			MapQ:    60,
+			Cigar:   []sam.CigarOp{sam.NewCigarOp(sam.CigarMatch, 3), sam.NewCigarOp(sam.CigarDeletion, 1), sam.NewCigarOp(sam.CigarMatch, 6)},
+			Flags:   sam.Paired | sam.ProperPair | sam.Reverse | sam.Read2,
+			MateRef: ref,
+			MatePos: 0,
+			Seq:     sam.NewSeq([]byte("GTTTAGCAG")),
+			Qual:    quals(9, 30),
+		},
+		{
+			Name:    "pair2",
+			Ref:     ref,
+			Pos:     2,
+			MapQ:    60,
+			Cigar:   []sam.CigarOp{sam.NewCigarOp(sam.CigarMatch, 8)},
+			Flags:   sam.Paired | sam.ProperPair | sam.MateReverse | sam.Read2,
+			MateRef: ref,
+			MatePos: 1,
+			Seq:     sam.NewSeq([]byte("GTTTTAGC")),
+			Qual:    quals(8, 30),
+		},
+		// + strand reads with mates filtered out of the BAM.  The second one's
+		// deletion doesn't pass the base-quality threshold.
+		{
+			Name:    "read4",
+			Ref:     ref,
+			Pos:     10,
+			MapQ:    60,
+			Cigar:   []sam.CigarOp{sam.NewCigarOp(sam.CigarMatch, 2), sam.NewCigarOp(sam.CigarDeletion, 3), sam.NewCigarOp(sam.CigarMatch, 5)},
+			Flags:   sam.Paired | sam.ProperPair | sam.MateReverse | sam.Read1,
+			MateRef: ref,
+			MatePos: 39,
+			Seq:     sam.NewSeq([]byte("AGCTGAC")),
+			Qual:    quals(7, 30),
+		},
+		{
+			Name:    "read5",
+			Ref:     ref,
+			Pos:     10,
+			MapQ:    60,
+			Cigar:   []sam.CigarOp{sam.NewCigarOp(sam.CigarMatch, 2), sam.NewCigarOp(sam.CigarDeletion, 3), sam.NewCigarOp(sam.CigarMatch, 5)},
+			Flags:   sam.Paired | sam.ProperPair | sam.MateReverse | sam.Read1,
+			MateRef: ref,
+			MatePos: 39,
+			Seq:     sam.NewSeq([]byte("AGCTGAC")),
+			Qual:    lowQual,
+		},
+		// - strand read with an insertion.
+		{
+			Name:    "read3",
+			Ref:     ref,
+			Pos:     20,
+			MapQ:    60,
+			Cigar:   []sam.CigarOp{sam.NewCigarOp(sam.CigarMatch, 4), sam.NewCigarOp(sam.CigarInsertion, 2), sam.NewCigarOp(sam.CigarMatch, 4)},
+			Flags:   sam.Paired | sam.ProperPair | sam.Reverse | sam.Read1,
+			MateRef: ref,
+			MatePos: 35,
+			Seq:     sam.NewSeq([]byte("TGACCCCATG")),
+			Qual:    quals(10, 30),
+		},
+	}
+
+	bampath, gbaipath := writeTestBAM(t, tmpdir, "tmp", samHeader, reads)
+	opts := snp.DefaultOpts
+	opts.BedPath = bedpath
+	opts.BamIndexPath = gbaipath
+	opts.Cols = "+indels"
+	opts.MinBaseQual = 20
+	opts.Parallelism = 1
+	opts.Stitch = true
+	outPrefix := filepath.Join(tmpdir, "bio-pileup")
+	err := snp.Pileup(ctx, bampath, "", "basestrand-tsv", outPrefix, &opts, fa)
+	assert.NoError(t, err)
+
+	got, err := ioutil.ReadFile(outPrefix + ".indelstrand.tsv")
+	assert.NoError(t, err)
+	assert.EQ(t, string(got), `#CHROM	POS	REF	ALT	ALT+	ALT-
+chrT	3	GT	G	1	0
+chrT	11	AGCA	A	1	0
+chrT	23	A	ACC	0	1
+`)
+}
+
+func TestPileupVCF(t *testing.T) {
+	tmpdir, cleanup := testutil.TempDir(t, "", "")
+	defer testutil.NoCleanupOnError(t, cleanup, tmpdir)
+
+	ctx := vcontext.Background()
+	bedpath := writeTestBED(t, tmpdir, "chrT\t0\t40\n")
+
+	fa, ref, samHeader := newTestReference(t, testRefSeq)
+	rg, err := sam.NewReadGroup("rg1", "", "", "", "", "", "", "S1", "", "", time.Time{}, 0)
+	assert.NoError(t, err)
+	assert.NoError(t, samHeader.AddReadGroup(rg))
+
+	// All reads are single-ended, with mates which were filtered out of the
+	// BAM.
+	plusFlags := sam.Paired | sam.ProperPair | sam.MateReverse | sam.Read1
+	minusFlags := sam.Paired | sam.ProperPair | sam.Reverse | sam.Read1
+	reads := []sam.Record{
+		// T>A SNV at 0-based position 3.
+		{
+			Name:    "read1",
+			Ref:     ref,
+			Pos:     0,
+			MapQ:    60,
+			Cigar:   []sam.CigarOp{sam.NewCigarOp(sam.CigarMatch, 8)},
+			Flags:   plusFlags,
+			MateRef: ref,
+			MatePos: 39,
+			Seq:     sam.NewSeq([]byte("ACGATTTA")),
+			Qual:    quals(8, 30),
+		},
+		{
+			Name:    "read2",
+			Ref:     ref,
+			Pos:     0,
+			MapQ:    60,
+			Cigar:   []sam.CigarOp{sam.NewCigarOp(sam.CigarMatch, 8)},
+			Flags:   minusFlags,
+			MateRef: ref,
+			MatePos: 39,
+			Seq:     sam.NewSeq([]byte("ACGTTTTA")),
+			Qual:    quals(8, 35),
+		},
+		// G>C SNV at 0-based position 2.
+		{
+			Name:    "read3",
+			Ref:     ref,
+			Pos:     0,
+			MapQ:    60,
+			Cigar:   []sam.CigarOp{sam.NewCigarOp(sam.CigarMatch, 8)},
+			Flags:   plusFlags,
+			MateRef: ref,
+			MatePos: 39,
+			Seq:     sam.NewSeq([]byte("ACCTTTTA")),
+			Qual:    quals(8, 30),
+		},
+		// Homopolymer deletion, left-aligned to the same position.
+		{
+			Name:    "read4",
+			Ref:     ref,
+			Pos:     2,
+			MapQ:    60,
+			Cigar:   []sam.CigarOp{sam.NewCigarOp(sam.CigarMatch, 3), sam.NewCigarOp(sam.CigarDeletion, 1), sam.NewCigarOp(sam.CigarMatch, 4)},
+			Flags:   plusFlags,
+			MateRef: ref,
+			MatePos: 39,
+			Seq:     sam.NewSeq([]byte("GTTTAGC")),
+			Qual:    quals(7, 30),
+		},
+	}
+	bampath, gbaipath := writeTestBAM(t, tmpdir, "tmp", samHeader, reads)
+	opts := snp.DefaultOpts
+	opts.BedPath = bedpath
+	opts.BamIndexPath = gbaipath
+	opts.MinBaseQual = 20
+	opts.Parallelism = 1
+	outPrefix := filepath.Join(tmpdir, "bio-pileup")
+	err = snp.Pileup(ctx, bampath, "", "vcf-bgz", outPrefix, &opts, fa)
+	assert.NoError(t, err)
+
+	// The output must be BGZF-compressed, with an EOF marker, for tabix.
+	vcfPath := outPrefix + ".vcf.gz"
+	f, err := os.Open(vcfPath)
+	assert.NoError(t, err)
+	defer f.Close()
+	hasEOF, err := bgzf.HasEOF(f)
+	assert.NoError(t, err)
+	assert.True(t, hasEOF)
+	r, err := bgzf.NewReader(f, 1)
+	assert.NoError(t, err)
+	got, err := ioutil.ReadAll(r)
+	assert.NoError(t, err)
+	assert.EQ(t, string(got), `##fileformat=VCFv4.2
+##source=bio-pileup
+##contig=<ID=chrT,length=40>
+##INFO=<ID=DP,Number=1,Type=Integer,Description="Total read depth, including low-quality bases">
+##INFO=<ID=MBQ,Number=R,Type=Integer,Description="Mean base quality of the counted observations of each allele">
+##FORMAT=<ID=AD,Number=R,Type=Integer,Description="Read depths of the ref and alt alleles, counting only high-quality observations">
+##FORMAT=<ID=DP,Number=1,Type=Integer,Description="Total read depth, including low-quality bases">
+##FORMAT=<ID=SB,Number=.,Type=Integer,Description="Per-strand read depths: REF+,REF-,ALT1+,ALT1-,...">
+#CHROM	POS	ID	REF	ALT	QUAL	FILTER	INFO	FORMAT	S1
+chrT	3	.	GT	CT,G	.	.	DP=4;MBQ=32,30,30	AD:DP:SB	3,1,1:4:2,1,1,0,1,0
+chrT	4	.	T	A	.	.	DP=4;MBQ=32,30	AD:DP:SB	3,1:4:2,1,1,0
+`)
+
+	// -cols is rejected, since the VCF columns are fixed.
+	opts.Cols = "+indels"
+	assert.NotNil(t, snp.Pileup(ctx, bampath, "", "vcf", outPrefix, &opts, fa))
+}
+
+func TestPileupSamples(t *testing.T) {
+	tmpdir, cleanup := testutil.TempDir(t, "", "")
+	defer testutil.NoCleanupOnError(t, cleanup, tmpdir)
+
+	ctx := vcontext.Background()
+	bedpath := writeTestBED(t, tmpdir, "chrT\t2\t5\n")
+
+	fa, _, _ := newTestReference(t, testRefSeq)
+
+	plusFlags := sam.Paired | sam.ProperPair | sam.MateReverse | sam.Read1
+	newRead := func(ref *sam.Reference, name, seq string) sam.Record {
+		qual := quals(len(seq), 30)
+		return sam.Record{
+			Name:    name,
+			Ref:     ref,
+			Pos:     0,
+			MapQ:    60,
+			Cigar:   []sam.CigarOp{sam.NewCigarOp(sam.CigarMatch, len(seq))},
+			Flags:   plusFlags,
+			MateRef: ref,
+			MatePos: 39,
+			Seq:     sam.NewSeq([]byte(seq)),
+			Qual:    qual,
+		}
+	}
+	// Sample S1 has a T>A SNV at 0-based position 3, and sample S2 has a G>C
+	// SNV at position 2.
+	var bampaths, gbaipaths []string
+	for _, sample := range []struct {
+		name string
+		seqs []string
+	}{
+		{"S1", []string{"ACGATTTA", "ACGTTTTA"}},
+		{"S2", []string{"ACCTTTTA"}},
+	} {
+		// Each header needs its own reference.
+		_, ref, samHeader := newTestReference(t, testRefSeq)
+		rg, err := sam.NewReadGroup("rg1", "", "", "", "", "", "", sample.name, "", "", time.Time{}, 0)
+		assert.NoError(t, err)
+		assert.NoError(t, samHeader.AddReadGroup(rg))
+		var reads []sam.Record
+		for i, seq := range sample.seqs {
+			reads = append(reads, newRead(ref, sample.name+"_read"+strconv.Itoa(i), seq))
+		}
+		bampath, gbaipath := writeTestBAM(t, tmpdir, sample.name, samHeader, reads)
+		bampaths = append(bampaths, bampath)
+		gbaipaths = append(gbaipaths, gbaipath)
+	}
+
+	opts := snp.DefaultOpts
+	opts.BedPath = bedpath
+	opts.BamIndexPath = strings.Join(gbaipaths, ",")
+	opts.Parallelism = 1
+	outPrefix := filepath.Join(tmpdir, "bio-pileup")
+	err := snp.PileupSamples(ctx, bampaths, "", "tsv", outPrefix, &opts, fa)
+	assert.NoError(t, err)
+	// Every sample gets its own suffixed columns, and the .alt.tsv rows cover
+	// the ALT alleles of all samples.
+	got, err := ioutil.ReadFile(outPrefix + ".ref.tsv")
+	assert.NoError(t, err)
+	assert.EQ(t, string(got), `#CHROM	POS	REF	DP_S1	ref_depth_tier1_S1	ref_depth_tier2_S1	DP_S2	ref_depth_tier1_S2	ref_depth_tier2_S2
+chrT	3	G	2	2	0	1	0	0
+chrT	4	T	2	1	0	1	1	0
+chrT	5	T	2	2	0	1	1	0
+`)
+	got, err = ioutil.ReadFile(outPrefix + ".alt.tsv")
+	assert.NoError(t, err)
+	assert.EQ(t, string(got), `#CHROM	POS	REF	ALT	alt_depth_tier1_S1	alt_depth_tier2_S1	alt_depth_tier1_S2	alt_depth_tier2_S2
+chrT	3	G	C	0	0	1	0
+chrT	4	T	A	1	0	0	0
+`)
+
+	err = snp.PileupSamples(ctx, bampaths, "", "vcf", outPrefix, &opts, fa)
+	assert.NoError(t, err)
+	got, err = ioutil.ReadFile(outPrefix + ".vcf")
+	assert.NoError(t, err)
+	lines := strings.Split(string(got), "\n")
+	assert.EQ(t, lines[len(lines)-4:], []string{
+		"#CHROM\tPOS\tID\tREF\tALT\tQUAL\tFILTER\tINFO\tFORMAT\tS1\tS2",
+		"chrT\t3\t.\tG\tC\t.\t.\tDP=3;MBQ=30,30\tAD:DP:SB\t2,0:2:2,0,0,0\t0,1:1:0,0,1,0",
+		"chrT\t4\t.\tT\tA\t.\t.\tDP=3;MBQ=30,30\tAD:DP:SB\t1,1:2:1,0,1,0\t1,0:1:1,0,0,0",
+		"",
+	})
+
+	// Sample names must be distinct, and the references must match.
+	assert.NotNil(t, snp.PileupSamples(ctx, []string{bampaths[0], bampaths[0]}, "", "tsv", outPrefix, &opts, fa))
+	assert.NotNil(t, snp.PileupSamples(ctx, bampaths, "", "basestrand-rio", outPrefix, &opts, fa))
+}
+
+func TestPileupStream(t *testing.T) {
+	tmpdir, cleanup := testutil.TempDir(t, "", "")
+	defer testutil.NoCleanupOnError(t, cleanup, tmpdir)
+
+	bedpath := writeTestBED(t, tmpdir, "chrT\t2\t10\n")
+
+	fa, ref, samHeader := newTestReference(t, testRefSeq)
+	reads := []sam.Record{
+		// T>A SNV at 0-based position 3.
+		{
+			Name:    "read1",
+			Ref:     ref,
+			Pos:     0,
+			MapQ:    60,
+			Cigar:   []sam.CigarOp{sam.NewCigarOp(sam.CigarMatch, 8)},
+			Flags:   sam.Paired | sam.ProperPair | sam.MateReverse | sam.Read1,
+			MateRef: ref,
+			MatePos: 39,
+			Seq:     sam.NewSeq([]byte("ACGATTTA")),
+			Qual:    []byte{30, 30, 30, 30, 30, 30, 30, 30},
+		},
+	}
+	bampath, gbaipath := writeTestBAM(t, tmpdir, "tmp", samHeader, reads)
+	opts := snp.DefaultOpts
+	opts.BedPath = bedpath
+	opts.BamIndexPath = gbaipath
+
+	var rows []*snp.PileupRow
+	ctx := vcontext.Background()
+	err := snp.PileupStream(ctx, bampath, "", &opts, fa, func(pr *snp.PileupRow) error {
+		rows = append(rows, pr)
+		return nil
+	})
+	assert.NoError(t, err)
+	// One row per position in the region, including the zero-depth ones.
+	assert.EQ(t, len(rows), 8)
+	for i, pr := range rows {
+		assert.EQ(t, pr.Pos, uint32(2+i))
+		if pr.Pos < 8 {
+			assert.EQ(t, pr.Payload.Depth, uint32(1))
+		} else {
+			assert.EQ(t, pr.FieldsPresent, uint32(0))
+		}
+	}
+	// 0-based position 3 has an A instead of the reference T.
+	assert.EQ(t, rows[1].Payload.Counts[0], [2]uint32{1, 0})
+	assert.EQ(t, rows[1].Payload.QualSums[0], uint32(30))
+
+	// Callback errors stop the pileup.
+	nCall := 0
+	errStop := errors.New("stop")
+	err = snp.PileupStream(ctx, bampath, "", &opts, fa, func(pr *snp.PileupRow) error {
+		nCall++
+		return errStop
+	})
+	assert.EQ(t, err, errStop)
+	assert.EQ(t, nCall, 1)
+
+	// So does context cancellation.
+	cancelCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	err = snp.PileupStream(cancelCtx, bampath, "", &opts, fa, func(pr *snp.PileupRow) error {
+		return nil
+	})
+	assert.EQ(t, err, context.Canceled)
+}
+
+func TestPileupReferenceEncodedPAM(t *testing.T) {
+	tmpdir, cleanup := testutil.TempDir(t, "", "")
+	defer testutil.NoCleanupOnError(t, cleanup, tmpdir)
+
+	bedpath := writeTestBED(t, tmpdir, "chrT\t2\t10\n")
+	fa, ref, samHeader := newTestReference(t, testRefSeq)
+	fapath := filepath.Join(tmpdir, "ref.fa")
+	assert.NoError(t, ioutil.WriteFile(fapath, []byte(">chrT\n"+testRefSeq+"\n"), 0644))
+	asciiFa, err := fasta.New(strings.NewReader(">chrT\n" + testRefSeq + "\n"))
+	assert.NoError(t, err)
+	reads := []sam.Record{
+		// T>A SNV at 0-based position 3.
+		{
+			Name:  "read1",
+			Ref:   ref,
+			Pos:   0,
+			MapQ:  60,
+			Cigar: []sam.CigarOp{sam.NewCigarOp(sam.CigarMatch, 8)},
+			Seq:   sam.NewSeq([]byte("ACGATTTA")),
+			Qual:  quals(8, 30),
+		},
+		{
+			Name:  "read2",
+			Ref:   ref,
+			Pos:   2,
+			MapQ:  60,
+			Cigar: []sam.CigarOp{sam.NewCigarOp(sam.CigarMatch, 3), sam.NewCigarOp(sam.CigarInsertion, 1), sam.NewCigarOp(sam.CigarMatch, 4)},
+			Seq:   sam.NewSeq([]byte("GTTCTTAG")),
+			Qual:  quals(8, 35),
+		},
+	}
+	bampath, gbaipath := writeTestBAM(t, tmpdir, "tmp", samHeader, reads)
+	pampath := filepath.Join(tmpdir, "tmp.pam")
+	w := pam.NewWriter(pam.WriteOpts{Reference: asciiFa}, samHeader, pampath)
+	for i := range reads {
+		w.Write(&reads[i])
+	}
+	assert.NoError(t, w.Close())
+
+	ctx := vcontext.Background()
+	pileupRows := func(xampath, fapath string, opts snp.Opts, fa fasta.Fasta) ([]*snp.PileupRow, error) {
+		opts.BedPath = bedpath
+		var rows []*snp.PileupRow
+		err := snp.PileupStream(ctx, xampath, fapath, &opts, fa, func(pr *snp.PileupRow) error {
+			rows = append(rows, pr)
+			return nil
+		})
+		return rows, err
+	}
+	opts := snp.DefaultOpts
+	opts.BamIndexPath = gbaipath
+	expected, err := pileupRows(bampath, "", opts, fa)
+	assert.NoError(t, err)
+	assert.EQ(t, len(expected), 8)
+	assert.EQ(t, expected[1].Payload.Counts[0], [2]uint32{1, 0})
+
+	// The reference loaded from fapath decodes the PAM file.
+	rows, err := pileupRows(pampath, fapath, snp.DefaultOpts, nil)
+	assert.NoError(t, err)
+	assert.EQ(t, rows, expected)
+
+	// So does Opts.Reference, when the Seq8 reference is passed directly.
+	opts = snp.DefaultOpts
+	opts.Reference = asciiFa
+	rows, err = pileupRows(pampath, "", opts, fa)
+	assert.NoError(t, err)
+	assert.EQ(t, rows, expected)
+
+	// The Seq8 reference alone cannot decode it.
+	_, err = pileupRows(pampath, "", snp.DefaultOpts, fa)
+	assert.NotNil(t, err)
+}
+
+func TestPileupSpliced(t *testing.T) {
+	tmpdir, cleanup := testutil.TempDir(t, "", "")
+	defer testutil.NoCleanupOnError(t, cleanup, tmpdir)
+
+	// The BED covers the first exon, part of the intron, and the second exon.
+	bedpath := writeTestBED(t, tmpdir, "chrT\t0\t10\nchrT\t1000\t1002\nchrT\t3000\t3010\n")
+
+	refSeq := strings.Repeat("ACGT", 1000)
+	fa, ref, samHeader := newTestReference(t, refSeq)
+	newRead := func(name string, pos int, cigar sam.Cigar, seq string) sam.Record {
+		qual := quals(len(seq), 30)
+		return sam.Record{
+			Name:  name,
+			Ref:   ref,
+			Pos:   pos,
+			MapQ:  60,
+			Cigar: cigar,
+			Flags: 0,
+			Seq:   sam.NewSeq([]byte(seq)),
+			Qual:  qual,
+		}
+	}
+	reads := []sam.Record{
+		// Spliced read: 10 bases at [0, 10), and 10 bases at [3000, 3010), with
+		// a T>A SNV at 0-based position 3003.
+		newRead("spliced", 0, []sam.CigarOp{
+			sam.NewCigarOp(sam.CigarMatch, 10),
+			sam.NewCigarOp(sam.CigarSkipped, 2990),
+			sam.NewCigarOp(sam.CigarMatch, 10),
+		}, "ACGTACGTAC"+"ACGAACGTAC"),
+		// Unspliced read covering the second exon.  The spliced read's counts
+		// for [3000, 3010) are still in the overflow map at this point.
+		newRead("unspliced", 2995, []sam.CigarOp{sam.NewCigarOp(sam.CigarMatch, 15)}, "TACGTACGTACGTAC"),
+	}
+	bampath, gbaipath := writeTestBAM(t, tmpdir, "tmp", samHeader, reads)
+	opts := snp.DefaultOpts
+	opts.BedPath = bedpath
+	opts.BamIndexPath = gbaipath
+
+	// Without -max-spliced-span, the spliced read is rejected.
+	ctx := vcontext.Background()
+	err := snp.PileupStream(ctx, bampath, "", &opts, fa, func(pr *snp.PileupRow) error {
+		return nil
+	})
+	assert.NotNil(t, err)
+
+	opts.MaxSplicedSpan = 4000
+	depths := make(map[uint32]uint32)
+	var snvCounts [2]uint32
+	err = snp.PileupStream(ctx, bampath, "", &opts, fa, func(pr *snp.PileupRow) error {
+		depths[pr.Pos] = pr.Payload.Depth
+		if pr.Pos == 3003 {
+			snvCounts = pr.Payload.Counts[0]
+		}
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.EQ(t, len(depths), 22)
+	for pos, depth := range depths {
+		switch {
+		case pos < 10:
+			assert.EQ(t, depth, uint32(1), "pos %d", pos)
+		case pos < 3000:
+			// Skipped regions are not counted.
+			assert.EQ(t, depth, uint32(0), "pos %d", pos)
+		default:
+			assert.EQ(t, depth, uint32(2), "pos %d", pos)
+		}
+	}
+	assert.EQ(t, snvCounts, [2]uint32{1, 0})
+}
+
+func TestPileupBAQ(t *testing.T) {
+	tmpdir, cleanup := testutil.TempDir(t, "", "")
+	defer testutil.NoCleanupOnError(t, cleanup, tmpdir)
+
+	bedpath := writeTestBED(t, tmpdir, "chrT\t0\t41\n")
+
+	const left = "GATTACAGGCTTACCGATGA"
+	const right = "TGCAGTCAAGCTTGGAC"
+	refSeq := left + "AGTC" + right
+	fa, ref, samHeader := newTestReference(t, refSeq)
+	// The aligner missed a 4-base deletion, so the last 6 bases of the read look
+	// like mismatches at positions [20, 26).
+	seq := left + right[:6]
+	qual := quals(len(seq), 30)
+	reads := []sam.Record{{
+		Name:  "missed_deletion",
+		Ref:   ref,
+		Pos:   0,
+		MapQ:  60,
+		Cigar: []sam.CigarOp{sam.NewCigarOp(sam.CigarMatch, len(seq))},
+		Seq:   sam.NewSeq([]byte(seq)),
+		Qual:  qual,
+	}}
+	bampath, gbaipath := writeTestBAM(t, tmpdir, "tmp", samHeader, reads)
+
+	// pileup returns the total count and quality sum of the bases at each
+	// position.
+	pileup := func(opts snp.Opts) (counts, qualSums map[uint32]uint32) {
+		opts.BedPath = bedpath
+		opts.BamIndexPath = gbaipath
+		opts.MinBaseQual = 10
+		counts = make(map[uint32]uint32)
+		qualSums = make(map[uint32]uint32)
+		err := snp.PileupStream(vcontext.Background(), bampath, "", &opts, fa, func(pr *snp.PileupRow) error {
+			for b := range pr.Payload.Counts {
+				counts[pr.Pos] += pr.Payload.Counts[b][0] + pr.Payload.Counts[b][1]
+				qualSums[pr.Pos] += pr.Payload.QualSums[b]
+			}
+			return nil
+		})
+		assert.NoError(t, err)
+		return
+	}
+
+	opts := snp.DefaultOpts
+	counts, qualSums := pileup(opts)
+	for pos := uint32(0); pos < 26; pos++ {
+		assert.EQ(t, counts[pos], uint32(1), "pos %d", pos)
+		assert.EQ(t, qualSums[pos], uint32(30), "pos %d", pos)
+	}
+
+	// With BAQ, the bases after the missed deletion fall below -min-base-qual,
+	// and the qualities of the bases right before them are reduced a bit.
+	opts.BAQ = true
+	counts, qualSums = pileup(opts)
+	for pos := uint32(20); pos < 26; pos++ {
+		assert.EQ(t, counts[pos], uint32(0), "pos %d", pos)
+	}
+	assert.EQ(t, qualSums[17], uint32(30))
+	assert.EQ(t, qualSums[18], uint32(29))
+	assert.EQ(t, qualSums[19], uint32(28))
+
+	// BAQ is computed before -clip, so clipping doesn't change the qualities of
+	// the other bases.
+	opts.Clip = 3
+	counts, qualSums = pileup(opts)
+	for pos := uint32(0); pos < 3; pos++ {
+		assert.EQ(t, counts[pos], uint32(0), "pos %d", pos)
+	}
+	assert.EQ(t, qualSums[3], uint32(30))
+	assert.EQ(t, qualSums[18], uint32(29))
+	assert.EQ(t, qualSums[19], uint32(28))
+}
+
+func TestPileupOverlapPolicy(t *testing.T) {
+	tmpdir, cleanup := testutil.TempDir(t, "", "")
+	defer testutil.NoCleanupOnError(t, cleanup, tmpdir)
+
+	bedpath := writeTestBED(t, tmpdir, "chrT\t2\t10\n")
+
+	fa, ref, samHeader := newTestReference(t, testRefSeq)
+	// The two ends overlap at [2, 8).  At 0-based position 3, R1 has an A
+	// (Q40) while R2 has the reference T (Q30).
+	reads := []sam.Record{
+		{
+			Name:    "pair",
+			Ref:     ref,
+			Pos:     0,
+			MapQ:    60,
+			Cigar:   []sam.CigarOp{sam.NewCigarOp(sam.CigarMatch, 8)},
+			Flags:   sam.Paired | sam.ProperPair | sam.MateReverse | sam.Read1,
+			MateRef: ref,
+			MatePos: 2,
+			Seq:     sam.NewSeq([]byte("ACGATTTA")),
+			Qual:    quals(8, 40),
+		},
+		{
+			Name:    "pair",
+			Ref:     ref,
+			Pos:     2,
+			MapQ:    60,
+			Cigar:   []sam.CigarOp{sam.NewCigarOp(sam.CigarMatch, 8)},
+			Flags:   sam.Paired | sam.ProperPair | sam.Reverse | sam.Read2,
+			MateRef: ref,
+			MatePos: 0,
+			Seq:     sam.NewSeq([]byte("GTTTTAGC")),
+			Qual:    quals(8, 30),
+		},
+	}
+	bampath, gbaipath := writeTestBAM(t, tmpdir, "tmp", samHeader, reads)
+	opts := snp.DefaultOpts
+	opts.BedPath = bedpath
+	opts.BamIndexPath = gbaipath
+	opts.Stitch = true
+
+	const (
+		baseA = 0
+		baseT = 3
+		baseN = 4
+	)
+	tests := []struct {
+		policy string
+		// Base counted at the discordant position 3.
+		discordantBase int
+		// Quality of the discordant position's base, and of the concordant T at
+		// position 4.
+		discordantQual, concordantQual uint32
+	}{
+		{"agree", baseN, 0, 70},
+		{"max-qual", baseA, 40, 40},
+		{"sum-qual", baseN, 0, 60},
+		{"r1", baseA, 40, 40},
+	}
+	ctx := vcontext.Background()
+	for _, tt := range tests {
+		opts.OverlapPolicy = tt.policy
+		var rows []*snp.PileupRow
+		err := snp.PileupStream(ctx, bampath, "", &opts, fa, func(pr *snp.PileupRow) error {
+			rows = append(rows, pr)
+			return nil
+		})
+		assert.NoError(t, err, tt.policy)
+		assert.EQ(t, len(rows), 8, tt.policy)
+		assert.EQ(t, rows[1].Payload.Depth, uint32(1), tt.policy)
+		assert.EQ(t, rows[1].Payload.Counts[tt.discordantBase], [2]uint32{1, 0}, tt.policy)
+		assert.EQ(t, rows[1].Payload.QualSums[tt.discordantBase], tt.discordantQual, tt.policy)
+		assert.EQ(t, rows[1].Payload.Discordant, [2]uint32{1, 0}, tt.policy)
+		assert.EQ(t, rows[2].Payload.Counts[baseT], [2]uint32{1, 0}, tt.policy)
+		assert.EQ(t, rows[2].Payload.QualSums[baseT], tt.concordantQual, tt.policy)
+		assert.EQ(t, rows[2].Payload.Discordant, [2]uint32{0, 0}, tt.policy)
+	}
+
+	opts.OverlapPolicy = "coin-flip"
+	err := snp.PileupStream(ctx, bampath, "", &opts, fa, func(pr *snp.PileupRow) error {
+		return nil
+	})
+	assert.NotNil(t, err)
+
+	// The discordant column set reports the same counts in .ref.tsv.
+	opts.OverlapPolicy = ""
+	opts.Cols = "+discordant"
+	opts.Parallelism = 1
+	outPrefix := filepath.Join(tmpdir, "bio-pileup")
+	err = snp.Pileup(ctx, bampath, "", "tsv", outPrefix, &opts, fa)
+	assert.NoError(t, err)
+	got, err := ioutil.ReadFile(outPrefix + ".ref.tsv")
+	assert.NoError(t, err)
+	assert.EQ(t, string(got), `#CHROM	POS	REF	DP	ref_depth_tier1	ref_depth_tier2	DISCORDANT
+chrT	3	G	1	1	0	0
+chrT	4	T	1	0	0	1
+chrT	5	T	1	1	0	0
+chrT	6	T	1	1	0	0
+chrT	7	T	1	1	0	0
+chrT	8	A	1	1	0	0
+chrT	9	G	1	1	0	0
+chrT	10	C	1	1	0	0
+`)
+
+	// It requires stitching.
+	opts.Stitch = false
+	err = snp.Pileup(ctx, bampath, "", "tsv", outPrefix, &opts, fa)
+	assert.NotNil(t, err)
+}
+
+func TestPileupUMI(t *testing.T) {
+	tmpdir, cleanup := testutil.TempDir(t, "", "")
+	defer testutil.NoCleanupOnError(t, cleanup, tmpdir)
+
+	bedpath := writeTestBED(t, tmpdir, "chrT\t2\t10\n")
+
+	fa, ref, samHeader := newTestReference(t, testRefSeq)
+	// All read-pairs cover the same fragment, [0, 10); the ends overlap at
+	// [2, 8).
+	newPair := func(name, umi, seq string) []sam.Record {
+		aux, err := sam.NewAux(sam.NewTag("RX"), umi)
+		assert.NoError(t, err)
+		qual := quals(8, 30)
+		return []sam.Record{
+			{
+				Name:      name,
+				Ref:       ref,
+				Pos:       0,
+				MapQ:      60,
+				Cigar:     []sam.CigarOp{sam.NewCigarOp(sam.CigarMatch, 8)},
+				Flags:     sam.Paired | sam.ProperPair | sam.MateReverse | sam.Read1,
+				MateRef:   ref,
+				MatePos:   2,
+				Seq:       sam.NewSeq([]byte(seq[:8])),
+				Qual:      qual,
+				AuxFields: []sam.Aux{aux},
+			},
+			{
+				Name:      name,
+				Ref:       ref,
+				Pos:       2,
+				MapQ:      60,
+				Cigar:     []sam.CigarOp{sam.NewCigarOp(sam.CigarMatch, 8)},
+				Flags:     sam.Paired | sam.ProperPair | sam.Reverse | sam.Read2,
+				MateRef:   ref,
+				MatePos:   0,
+				Seq:       sam.NewSeq([]byte(seq[2:])),
+				Qual:      qual,
+				AuxFields: []sam.Aux{aux},
+			},
+		}
+	}
+	pairs := [][]sam.Record{
+		// Family A: a T>A SNV at 0-based position 3.  The second UMI has a
+		// sequencing error.
+		newPair("a1", "ACGT", "ACGATTTAGC"),
+		newPair("a2", "ACGA", "ACGATTTAGC"),
+		// Family B disagrees at 0-based position 4.
+		newPair("b1", "TTTT", "ACGTTTTAGC"),
+		newPair("b2", "TTTT", "ACGTCTTAGC"),
+		// Family C only has one read-pair.
+		newPair("c1", "GGGG", "ACGTTTTAGC"),
+	}
+	var reads []sam.Record
+	for _, pair := range pairs {
+		reads = append(reads, pair[0])
+	}
+	for _, pair := range pairs {
+		reads = append(reads, pair[1])
+	}
+	bampath, gbaipath := writeTestBAM(t, tmpdir, "tmp", samHeader, reads)
+	opts := snp.DefaultOpts
+	opts.BedPath = bedpath
+	opts.BamIndexPath = gbaipath
+	opts.Stitch = true
+	opts.UMITag = "RX"
+	opts.MinFamilySize = 2
+
+	const (
+		baseA = 0
+		baseC = 1
+		baseT = 3
+	)
+	var rows []*snp.PileupRow
+	ctx := vcontext.Background()
+	err := snp.PileupStream(ctx, bampath, "", &opts, fa, func(pr *snp.PileupRow) error {
+		rows = append(rows, pr)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.EQ(t, len(rows), 8)
+	for _, pr := range rows {
+		assert.EQ(t, pr.Payload.Depth, uint32(2), "pos %d", pr.Pos)
+	}
+	// Family A contributes one A, and family B one T, at position 3.
+	assert.EQ(t, rows[1].Payload.Counts[baseA], [2]uint32{1, 0})
+	assert.EQ(t, rows[1].Payload.Counts[baseT], [2]uint32{1, 0})
+	assert.EQ(t, rows[1].Payload.QualSums[baseA], uint32(95))
+	// Family B is dropped at position 4.
+	assert.EQ(t, rows[2].Payload.Counts[baseT], [2]uint32{1, 0})
+	assert.EQ(t, rows[2].Payload.Counts[baseC], [2]uint32{0, 0})
+
+	// Without error-tolerant matching, the two read-pairs of family A are
+	// dropped as singletons.
+	opts.UMIMaxMismatches = 0
+	rows = rows[:0]
+	err = snp.PileupStream(ctx, bampath, "", &opts, fa, func(pr *snp.PileupRow) error {
+		rows = append(rows, pr)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.EQ(t, rows[1].Payload.Depth, uint32(1))
+	assert.EQ(t, rows[1].Payload.Counts[baseA], [2]uint32{0, 0})
+
+	// UMI families require stitching.
+	opts.Stitch = false
+	err = snp.PileupStream(ctx, bampath, "", &opts, fa, func(pr *snp.PileupRow) error {
+		return nil
+	})
+	assert.NotNil(t, err)
+}
+
+func TestPileupMpileup(t *testing.T) {
+	tmpdir, cleanup := testutil.TempDir(t, "", "")
+	defer testutil.NoCleanupOnError(t, cleanup, tmpdir)
+
+	bedpath := writeTestBED(t, tmpdir, "chrT\t0\t20\n")
+
+	fa, ref, samHeader := newTestReference(t, testRefSeq)
+	reads := []sam.Record{
+		// + strand read with a T>A SNV at 0-based position 3, and a low-quality
+		// base at position 5.
+		{
+			Name:  "read1",
+			Ref:   ref,
+			Pos:   0,
+			MapQ:  60,
+			Cigar: []sam.CigarOp{sam.NewCigarOp(sam.CigarMatch, 8)},
+			Seq:   sam.NewSeq([]byte("ACGATTTA")),
+			Qual:  []byte{30, 30, 30, 30, 30, 10, 30, 30},
+		},
+		// - strand read with a deletion of positions 5 and 6.
+		{
+			Name:  "read2",
+			Ref:   ref,
+			Pos:   2,
+			MapQ:  40,
+			Cigar: []sam.CigarOp{sam.NewCigarOp(sam.CigarMatch, 3), sam.NewCigarOp(sam.CigarDeletion, 2), sam.NewCigarOp(sam.CigarMatch, 3)},
+			Flags: sam.Reverse,
+			Seq:   sam.NewSeq([]byte("GTTAGC")),
+			Qual:  quals(6, 30),
+		},
+		// + strand read with an insertion after position 5.
+		{
+			Name:  "read3",
+			Ref:   ref,
+			Pos:   4,
+			MapQ:  60,
+			Cigar: []sam.CigarOp{sam.NewCigarOp(sam.CigarMatch, 2), sam.NewCigarOp(sam.CigarInsertion, 2), sam.NewCigarOp(sam.CigarMatch, 3)},
+			Seq:   sam.NewSeq([]byte("TTGGTAG")),
+			Qual:  quals(7, 35),
+		},
+	}
+	bampath, gbaipath := writeTestBAM(t, tmpdir, "tmp", samHeader, reads)
+	opts := snp.DefaultOpts
+	opts.BedPath = bedpath
+	opts.BamIndexPath = gbaipath
+	opts.Mapq = 30
+	opts.MinBaseQual = 20
+	opts.Parallelism = 1
+	ctx := vcontext.Background()
+	outPrefix := filepath.Join(tmpdir, "bio-pileup")
+	err := snp.Pileup(ctx, bampath, "", "mpileup", outPrefix, &opts, fa)
+	assert.NoError(t, err)
+
+	got, err := ioutil.ReadFile(outPrefix + ".mpileup")
+	assert.NoError(t, err)
+	assert.EQ(t, string(got), `chrT	1	A	1	^].	?
+chrT	2	C	1	.	?
+chrT	3	G	2	.^I,	??
+chrT	4	T	2	A,	??
+chrT	5	T	3	.,-2tt^].	??D
+chrT	6	T	2	*.+2GG	?D
+chrT	7	T	3	.*.	??D
+chrT	8	A	3	.$,.	??D
+chrT	9	G	2	,.$	?D
+chrT	10	C	1	,$	?
+`)
+
+	// Read-pairs can't be stitched.
+	opts.Stitch = true
+	err = snp.Pileup(ctx, bampath, "", "mpileup", outPrefix, &opts, fa)
+	assert.NotNil(t, err)
+}
@@ -36,9 +36,27 @@ const (
 	FieldPerReadC
 	FieldPerReadG
 	FieldPerReadT
+	FieldIndels
+	FieldQualSums
+	FieldDiscordant
+	FieldReadBases
 	FieldPerReadAny = FieldPerReadA | FieldPerReadC | FieldPerReadG | FieldPerReadT
 )
 
+// IndelCounts contains the number of reads supporting a single indel allele,
+// anchored at the position preceding the inserted or deleted bases.
+type IndelCounts struct {
+	// Ins is the inserted sequence (ASCII).  It is empty for a deletion.
+	Ins string
+	// DelLen is the number of deleted reference bases.  It is zero for an
+	// insertion.
+	DelLen uint32
+	// Counts is indexed by strand, like PileupPayload.Counts.
+	Counts [2]uint32
+	// QualSum is the sum of the qualities of the counted indel observations.
+	QualSum uint32
+}
+
 // PileupPayload is a container for all types of pileup data which may be
 // associated with a single position.  It does not store the position itself,
 // or a tag indicating which parts of the container are used.
@@ -49,6 +67,17 @@ type PileupPayload struct {
 	Depth   uint32
 	Counts  [pileup.NBaseEnum][2]uint32
 	PerRead [pileup.NBase][]PerReadFeatures
+	Indels  []IndelCounts
+	// QualSums[b] is the sum of the base-qualities of the counted b bases, on
+	// both strands.  Stitched bases contribute their combined quality.
+	QualSums [pileup.NBaseEnum]uint32
+	// Discordant is the number of stitched read-pairs whose two ends have
+	// different bases here, indexed by strand like Counts.
+	Discordant [2]uint32
+	// ReadBases and ReadQuals are the read-bases and base-qualities columns of
+	// "samtools mpileup"; they are only filled in for mpileup output.
+	ReadBases []byte
+	ReadQuals []byte
 }
 
 // PileupRow contains all pileup data associated with a single position, along
@@ -98,6 +127,13 @@ func cutAndAdvance(offset *int, s []byte, pieceLen int) []byte {
 //   if perRead[pileup.baseA] present, length stored in next 4 bytes, then
 //     values stored in next 6*n bytes
 //   if perRead[pileup.baseC] present... etc.
+//   if indels present, number of alleles stored in next 4 bytes, then for each
+//     allele, DelLen and len(Ins) in 8 bytes, Ins, and Counts and QualSum in
+//     12 bytes
+//   if qual sums present, stored in next 20 bytes
+//   if discordant counts present, stored in next 8 bytes
+//   if read bases present, lengths of ReadBases and ReadQuals stored in next 8
+//     bytes, followed by their contents
 // This is essentially the simplest format that can support the variable-length
 // per-read feature arrays that are needed.  It is not difficult to decrease
 // the nominal size of these records by (i) using varints instead of uint32s,
@@ -108,8 +144,6 @@ func cutAndAdvance(offset *int, s []byte, pieceLen int) []byte {
 // in this function concerns (i) avoiding extra allocations and (ii) avoiding a
 // ridiculous number of spurious bounds-checks, in ways that make sense for a
 // wide variety of other serialization functions.)
-//
-// In the future, we may need to add indel support.
 func MarshalPileupRow(scratch []byte, p interface{}) ([]byte, error) {
 	pr := p.(*PileupRow)
 	fieldsPresent := pr.FieldsPresent
@@ -128,6 +162,21 @@ func MarshalPileupRow(scratch []byte, p interface{}) ([]byte, error) {
 			}
 		}
 	}
+	if fieldsPresent&FieldIndels != 0 {
+		bytesReq += 4
+		for _, c := range pr.Payload.Indels {
+			bytesReq += 20 + len(c.Ins)
+		}
+	}
+	if fieldsPresent&FieldQualSums != 0 {
+		bytesReq += 20
+	}
+	if fieldsPresent&FieldDiscordant != 0 {
+		bytesReq += 8
+	}
+	if fieldsPresent&FieldReadBases != 0 {
+		bytesReq += 8 + len(pr.Payload.ReadBases) + len(pr.Payload.ReadQuals)
+	}
 	t := scratch
 	if len(t) < bytesReq {
 		t = make([]byte, bytesReq)
@@ -171,6 +220,40 @@ func MarshalPileupRow(scratch []byte, p interface{}) ([]byte, error) {
 			}
 		}
 	}
+	if fieldsPresent&FieldIndels != 0 {
+		lenSlice := cutAndAdvance(&offset, t, 4)
+		binary.LittleEndian.PutUint32(lenSlice, uint32(len(pr.Payload.Indels)))
+		for _, c := range pr.Payload.Indels {
+			dst := cutAndAdvance(&offset, t, 8)
+			binary.LittleEndian.PutUint32(dst[:4], c.DelLen)
+			binary.LittleEndian.PutUint32(dst[4:8], uint32(len(c.Ins)))
+			copy(cutAndAdvance(&offset, t, len(c.Ins)), c.Ins)
+			dst = cutAndAdvance(&offset, t, 12)
+			binary.LittleEndian.PutUint32(dst[:4], c.Counts[0])
+			binary.LittleEndian.PutUint32(dst[4:8], c.Counts[1])
+			binary.LittleEndian.PutUint32(dst[8:12], c.QualSum)
+		}
+	}
+	if fieldsPresent&FieldQualSums != 0 {
+		tQualSums := cutAndAdvance(&offset, t, 20)
+		binary.LittleEndian.PutUint32(tQualSums[:4], pr.Payload.QualSums[pileup.BaseA])
+		binary.LittleEndian.PutUint32(tQualSums[4:8], pr.Payload.QualSums[pileup.BaseC])
+		binary.LittleEndian.PutUint32(tQualSums[8:12], pr.Payload.QualSums[pileup.BaseG])
+		binary.LittleEndian.PutUint32(tQualSums[12:16], pr.Payload.QualSums[pileup.BaseT])
+		binary.LittleEndian.PutUint32(tQualSums[16:20], pr.Payload.QualSums[pileup.BaseX])
+	}
+	if fieldsPresent&FieldDiscordant != 0 {
+		tDiscordant := cutAndAdvance(&offset, t, 8)
+		binary.LittleEndian.PutUint32(tDiscordant[:4], pr.Payload.Discordant[0])
+		binary.LittleEndian.PutUint32(tDiscordant[4:8], pr.Payload.Discordant[1])
+	}
+	if fieldsPresent&FieldReadBases != 0 {
+		lenSlice := cutAndAdvance(&offset, t, 8)
+		binary.LittleEndian.PutUint32(lenSlice[:4], uint32(len(pr.Payload.ReadBases)))
+		binary.LittleEndian.PutUint32(lenSlice[4:8], uint32(len(pr.Payload.ReadQuals)))
+		copy(cutAndAdvance(&offset, t, len(pr.Payload.ReadBases)), pr.Payload.ReadBases)
+		copy(cutAndAdvance(&offset, t, len(pr.Payload.ReadQuals)), pr.Payload.ReadQuals)
+	}
 	return t, nil
 }
 
@@ -223,5 +306,40 @@ func unmarshalPileupRow(in []byte) (out interface{}, err error) {
 			}
 		}
 	}
+	if pr.FieldsPresent&FieldIndels != 0 {
+		lenSlice := cutAndAdvance(&offset, in, 4)
+		indels := make([]IndelCounts, binary.LittleEndian.Uint32(lenSlice))
+		for i := range indels {
+			src := cutAndAdvance(&offset, in, 8)
+			indels[i].DelLen = binary.LittleEndian.Uint32(src[:4])
+			insLen := int(binary.LittleEndian.Uint32(src[4:8]))
+			indels[i].Ins = string(cutAndAdvance(&offset, in, insLen))
+			src = cutAndAdvance(&offset, in, 12)
+			indels[i].Counts[0] = binary.LittleEndian.Uint32(src[:4])
+			indels[i].Counts[1] = binary.LittleEndian.Uint32(src[4:8])
+			indels[i].QualSum = binary.LittleEndian.Uint32(src[8:12])
+		}
+		pr.Payload.Indels = indels
+	}
+	if pr.FieldsPresent&FieldQualSums != 0 {
+		inQualSums := cutAndAdvance(&offset, in, 20)
+		pr.Payload.QualSums[pileup.BaseA] = binary.LittleEndian.Uint32(inQualSums[:4])
+		pr.Payload.QualSums[pileup.BaseC] = binary.LittleEndian.Uint32(inQualSums[4:8])
+		pr.Payload.QualSums[pileup.BaseG] = binary.LittleEndian.Uint32(inQualSums[8:12])
+		pr.Payload.QualSums[pileup.BaseT] = binary.LittleEndian.Uint32(inQualSums[12:16])
+		pr.Payload.QualSums[pileup.BaseX] = binary.LittleEndian.Uint32(inQualSums[16:20])
+	}
+	if pr.FieldsPresent&FieldDiscordant != 0 {
+		inDiscordant := cutAndAdvance(&offset, in, 8)
+		pr.Payload.Discordant[0] = binary.LittleEndian.Uint32(inDiscordant[:4])
+		pr.Payload.Discordant[1] = binary.LittleEndian.Uint32(inDiscordant[4:8])
+	}
+	if pr.FieldsPresent&FieldReadBases != 0 {
+		lenSlice := cutAndAdvance(&offset, in, 8)
+		basesLen := int(binary.LittleEndian.Uint32(lenSlice[:4]))
+		qualsLen := int(binary.LittleEndian.Uint32(lenSlice[4:8]))
+		pr.Payload.ReadBases = append([]byte(nil), cutAndAdvance(&offset, in, basesLen)...)
+		pr.Payload.ReadQuals = append([]byte(nil), cutAndAdvance(&offset, in, qualsLen)...)
+	}
 	return pr, nil
 }
@@ -0,0 +1,224 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Schaudge/grailbase/recordio"
+	"github.com/Schaudge/grailbase/tsv"
+	"github.com/Schaudge/hts/sam"
+)
+
+// In a joint pileup, every sample is piled up separately, with its own
+// pileupMutable and per-job temporary files, but all samples share the
+// reference, the BED intervals and the shards.  Since every job writes one
+// PileupRow per BED position it covers, the i-th rows of all samples' files
+// for a given job always refer to the same position, and the final conversion
+// step can just read them in lockstep.
+
+// sampleName returns the name of the sample in the given BAM/PAM (or
+// comma-separated list of BAM/PAMs to merge): the SM of its read-groups if
+// they all agree, or the basename of the first file otherwise.
+func sampleName(header *sam.Header, xampath string) string {
+	name := readGroupSampleName(header)
+	if name == "" {
+		name = filepath.Base(strings.Split(xampath, ",")[0])
+		name = strings.TrimSuffix(name, filepath.Ext(name))
+	}
+	return name
+}
+
+// readGroupSampleName returns the SM of the read-groups of header if they all
+// agree, or "" otherwise.
+func readGroupSampleName(header *sam.Header) string {
+	smTag := sam.NewTag("SM")
+	name := ""
+	for _, rg := range header.RGs() {
+		sm := rg.Get(smTag)
+		if sm == "" {
+			continue
+		}
+		if (name != "") && (name != sm) {
+			return ""
+		}
+		name = sm
+	}
+	return name
+}
+
+// checkSameRefs verifies that two BAM/PAM headers have the same references,
+// in the same order.
+func checkSameRefs(header0, header *sam.Header) error {
+	refs0 := header0.Refs()
+	refs := header.Refs()
+	if len(refs0) != len(refs) {
+		return fmt.Errorf("checkSameRefs: inputs have different numbers of references (%d vs. %d)", len(refs0), len(refs))
+	}
+	for i, ref := range refs {
+		if (ref.Name() != refs0[i].Name()) || (ref.Len() != refs0[i].Len()) {
+			return fmt.Errorf("checkSameRefs: reference %d differs between inputs (%s:%d vs. %s:%d)", i, refs0[i].Name(), refs0[i].Len(), ref.Name(), ref.Len())
+		}
+	}
+	return nil
+}
+
+// writeHeaderCols appends the given tab-separated column names, each followed
+// by suffix.
+func writeHeaderCols(w *tsv.Writer, cols, suffix string) {
+	for _, col := range strings.Split(cols, "\t") {
+		w.WriteString(col + suffix)
+	}
+}
+
+// sampleColSuffixes returns the suffixes appended to the per-sample TSV
+// column names.  These are empty when there is only one sample, so that
+// single-sample output is unchanged.
+func sampleColSuffixes(sampleNames []string) []string {
+	suffixes := make([]string, len(sampleNames))
+	if len(sampleNames) > 1 {
+		for i, name := range sampleNames {
+			suffixes[i] = "_" + name
+		}
+	}
+	return suffixes
+}
+
+// sampleRowScanner reads the temporary PileupRow files of all samples in
+// lockstep, one job at a time.  tmpFiles is indexed by [sample][job].
+// Finished files are closed and removed.
+type sampleRowScanner struct {
+	tmpFiles [][]*os.File
+	jobIdx   int
+	scanners []recordio.Scanner
+	rows     []*PileupRow
+	err      error
+}
+
+func newSampleRowScanner(tmpFiles [][]*os.File) *sampleRowScanner {
+	return &sampleRowScanner{
+		tmpFiles: tmpFiles,
+		jobIdx:   -1,
+		scanners: make([]recordio.Scanner, len(tmpFiles)),
+		rows:     make([]*PileupRow, len(tmpFiles)),
+	}
+}
+
+// nextJob finishes the current job's files, and opens the next job's.  It
+// returns false when there are no jobs left, or on error.
+func (s *sampleRowScanner) nextJob() bool {
+	if s.jobIdx >= 0 {
+		for i, scanner := range s.scanners {
+			if s.err = scanner.Err(); s.err != nil {
+				return false
+			}
+			f := s.tmpFiles[i][s.jobIdx]
+			curPath := f.Name()
+			if s.err = f.Close(); s.err != nil {
+				return false
+			}
+			s.tmpFiles[i][s.jobIdx] = nil
+			// os.Remove returns an error if we try to remove a file that isn't
+			// there.
+			_ = os.Remove(curPath)
+		}
+	}
+	s.jobIdx++
+	if s.jobIdx == len(s.tmpFiles[0]) {
+		return false
+	}
+	for i := range s.scanners {
+		f := s.tmpFiles[i][s.jobIdx]
+		if _, s.err = f.Seek(0, 0); s.err != nil {
+			return false
+		}
+		s.scanners[i] = recordio.NewScanner(f, recordio.ScannerOpts{
+			Unmarshal: unmarshalPileupRow,
+		})
+	}
+	return true
+}
+
+// Scan advances to the next position.  It returns false at the end of the
+// files, or on error.
+func (s *sampleRowScanner) Scan() bool {
+	for {
+		if s.jobIdx >= 0 {
+			if s.scanners[0].Scan() {
+				break
+			}
+		}
+		if !s.nextJob() {
+			return false
+		}
+	}
+	s.rows[0] = s.scanners[0].Get().(*PileupRow)
+	for i := 1; i < len(s.scanners); i++ {
+		if !s.scanners[i].Scan() {
+			if s.err = s.scanners[i].Err(); s.err == nil {
+				s.err = fmt.Errorf("sampleRowScanner: sample %d pileup ended early", i)
+			}
+			return false
+		}
+		s.rows[i] = s.scanners[i].Get().(*PileupRow)
+		if (s.rows[i].RefID != s.rows[0].RefID) || (s.rows[i].Pos != s.rows[0].Pos) {
+			s.err = fmt.Errorf("sampleRowScanner: sample %d pileup out of sync", i)
+			return false
+		}
+	}
+	return true
+}
+
+// Rows returns the current position's PileupRows, indexed by sample.  The
+// returned slice is overwritten by the next Scan() call.
+func (s *sampleRowScanner) Rows() []*PileupRow {
+	return s.rows
+}
+
+// Err returns the first error encountered, if any.
+func (s *sampleRowScanner) Err() error {
+	return s.err
+}
+
+// unionIndelAlleles appends the distinct indel alleles of all rows to dst, in
+// order of first appearance.  Only the Ins and DelLen fields of the result
+// are meaningful.
+func unionIndelAlleles(dst []IndelCounts, rows []*PileupRow) []IndelCounts {
+	dst = dst[:0]
+	for _, pr := range rows {
+		for i := range pr.Payload.Indels {
+			if findIndelCounts(dst, &pr.Payload.Indels[i]) == nil {
+				dst = append(dst, IndelCounts{
+					Ins:    pr.Payload.Indels[i].Ins,
+					DelLen: pr.Payload.Indels[i].DelLen,
+				})
+			}
+		}
+	}
+	return dst
+}
+
+// findIndelCounts returns the element of indels with the same allele as c, or
+// nil if there is none.
+func findIndelCounts(indels []IndelCounts, c *IndelCounts) *IndelCounts {
+	for i := range indels {
+		if (indels[i].DelLen == c.DelLen) && (indels[i].Ins == c.Ins) {
+			return &indels[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/Schaudge/grailbio/encoding/fasta"
+	"github.com/Schaudge/grailbio/pileup"
+)
+
+// callbackRowWriter is a pileupRowWriter which passes the rows to a callback
+// instead of writing them to a file.  The first error, returned by the
+// callback or caused by context cancellation, is sticky: later rows are
+// dropped, and the pileup stops as soon as it calls Err().
+type callbackRowWriter struct {
+	ctx context.Context
+	fn  func(*PileupRow) error
+	err error
+}
+
+func (w *callbackRowWriter) Append(v interface{}) {
+	if w.err != nil {
+		return
+	}
+	if w.err = w.ctx.Err(); w.err != nil {
+		return
+	}
+	w.err = w.fn(v.(*PileupRow))
+}
+
+func (w *callbackRowWriter) Err() error {
+	return w.err
+}
+
+func (w *callbackRowWriter) Finish() error {
+	return w.err
+}
+
+// PileupStream piles up a single BAM/PAM (or comma-separated list of
+// BAM/PAMs) like Pileup(), but passes the PileupRows to fn as soon as they are
+// final, instead of writing any file.  This is intended for small regions:
+// everything runs in the calling goroutine, and rawOpts.Parallelism and
+// rawOpts.TempDir are ignored.
+//
+// fn is called once per BED position, in .bam header and position order; the
+// rows of zero-depth positions have FieldsPresent == 0.  RefID indexes the
+// BAM/PAM header's references.  The rows are computed as for the "tsv"
+// format: strands are not tracked, so Counts[b][1] is always zero, and
+// rawOpts.Cols determines whether per-read features and indels are filled in.
+// QualSums is always filled in.  fn may retain its argument.
+//
+// If fn returns an error, or ctx is canceled, the pileup stops and
+// PileupStream returns that error.
+func PileupStream(ctx context.Context, xampath, fapath string, rawOpts *Opts, fa fasta.Fasta, fn func(*PileupRow) error) (err error) {
+	if rawOpts.PerStrand {
+		return fmt.Errorf("PileupStream: PerStrand is not supported")
+	}
+	var opts pileupSNPOpts
+	defer opts.closeProviders(&err)
+	if err = initPileupSNPOpts(ctx, &opts, []string{xampath}, fapath, "tsv", "", rawOpts, fa); err != nil {
+		return
+	}
+	opts.qualSums = true
+	var qpt qualPassTable
+	if qpt, err = newQualPassTable(byte(opts.minBaseQual)); err != nil {
+		return
+	}
+	w := &callbackRowWriter{
+		ctx: ctx,
+		fn:  fn,
+	}
+	return runPileupJob(ctx, &opts, pileup.StrandNone, &qpt, opts.shards, []pileupRowWriter{w})
+}
@@ -0,0 +1,261 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"container/heap"
+	"sort"
+
+	"github.com/Schaudge/grailbio/pileup"
+	"github.com/Schaudge/hts/sam"
+)
+
+// UMI-family consensus is an alternative to -min-bag-depth for BAMs which
+// haven't been processed by doppelmark.  When Opts.UMITag is set, read-pairs
+// are grouped into families of reads from the same original molecule: they
+// must have the same fragment ends (leftmost and rightmost mapped positions of
+// the pair) and strand, and UMIs of the same length differing in at most
+// Opts.UMIMaxMismatches positions.  (Read-pairs are compared to the UMI of the
+// family's first read-pair; read-pairs without a UMI are skipped.)  Each
+// family then contributes a single consensus observation per position,
+// instead of one observation per read-pair:
+// - Families with fewer than Opts.MinFamilySize read-pairs are dropped.
+// - At each position, every read-pair votes with its base (combined according
+//   to the overlap policy where the two ends overlap); N bases and bases below
+//   -min-base-qual abstain.  If the votes agree, the base is counted once, with
+//   the combined quality of all votes.  If they disagree, the family is
+//   dropped at that position, though it still counts toward DP.
+//
+// All read-pairs of a family start at the same position, and a read-pair is
+// complete once the firstread-table no longer has entries before its start.
+// So, before flushing results up to a position, it is sufficient to finish
+// all families starting before it.
+
+// umiObs is a single read-pair's observation at a single position.
+type umiObs struct {
+	pos  PosType
+	base byte // pileup enum encoding
+	qual byte
+}
+
+// umiFamily contains the observations of all read-pairs of a family.
+type umiFamily struct {
+	umi     string
+	end     PosType
+	strand  pileup.StrandType
+	isMinus PosType
+	nMember int
+	obs     []umiObs
+}
+
+// posHeap is a min-heap of positions, for use with container/heap.
+type posHeap []PosType
+
+func (h posHeap) Len() int            { return len(h) }
+func (h posHeap) Less(i, j int) bool  { return h[i] < h[j] }
+func (h posHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *posHeap) Push(x interface{}) { *h = append(*h, x.(PosType)) }
+func (h *posHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
+
+// umiFamilyTable contains the families which may still gain read-pairs, keyed
+// by start position.
+type umiFamilyTable struct {
+	tag           sam.Tag
+	maxMismatches int
+	minSize       int
+	byStart       map[PosType][]*umiFamily
+	// starts contains the keys of byStart.
+	starts posHeap
+	obsBuf []umiObs
+}
+
+func newUMIFamilyTable(tag string, maxMismatches, minSize int) *umiFamilyTable {
+	return &umiFamilyTable{
+		tag:           sam.NewTag(tag),
+		maxMismatches: maxMismatches,
+		minSize:       minSize,
+		byStart:       make(map[PosType][]*umiFamily),
+	}
+}
+
+// umiMatches returns true iff UMIs a and b have the same length, and differ in
+// at most maxMismatches positions.
+func umiMatches(a, b string, maxMismatches int) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	nMismatch := 0
+	for i := 0; i < len(a); i++ {
+		if a[i] != b[i] {
+			nMismatch++
+			if nMismatch > maxMismatches {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// appendReadPairObs appends the observations of the given read or read-pair
+// to dst, in position order.  abb0 and abb1 are the reads' aligned bases, as
+// computed by alignRelevantBases.
+func appendReadPairObs(dst []umiObs, reads []readSNP, abb0, abb1 []alignedPos, policy overlapPolicy) []umiObs {
+	seq0 := reads[0].seq8
+	qual0 := reads[0].samr.Qual
+	if len(reads) == 1 {
+		abb1 = nil
+	}
+	idx0 := 0
+	idx1 := 0
+	for (idx0 != len(abb0)) || (idx1 != len(abb1)) {
+		if (idx1 == len(abb1)) || ((idx0 != len(abb0)) && (abb0[idx0].posInRef < abb1[idx1].posInRef)) {
+			posInRead := abb0[idx0].posInRead
+			dst = append(dst, umiObs{
+				pos:  abb0[idx0].posInRef,
+				base: pileup.Seq8ToEnumTable[seq0[posInRead]],
+				qual: qual0[posInRead],
+			})
+			idx0++
+			continue
+		}
+		seq1 := reads[1].seq8
+		qual1 := reads[1].samr.Qual
+		posInRead1 := abb1[idx1].posInRead
+		if (idx0 == len(abb0)) || (abb1[idx1].posInRef < abb0[idx0].posInRef) {
+			dst = append(dst, umiObs{
+				pos:  abb1[idx1].posInRef,
+				base: pileup.Seq8ToEnumTable[seq1[posInRead1]],
+				qual: qual1[posInRead1],
+			})
+			idx1++
+			continue
+		}
+		r1 := 0
+		if (reads[1].samr.Flags & sam.Read1) != 0 {
+			r1 = 1
+		}
+		posInRead0 := abb0[idx0].posInRead
+		base, qual := policy.stitchBase(seq0[posInRead0], qual0[posInRead0], seq1[posInRead1], qual1[posInRead1], r1)
+		dst = append(dst, umiObs{
+			pos:  abb0[idx0].posInRef,
+			base: base,
+			qual: qual,
+		})
+		idx0++
+		idx1++
+	}
+	return dst
+}
+
+// add assigns the given read or read-pair to a family.  Read-pairs without a
+// UMI are ignored.
+func (t *umiFamilyTable) add(reads []readSNP, isMinus PosType, abb0, abb1 []alignedPos, policy overlapPolicy) {
+	samr := reads[0].samr
+	aux := samr.AuxFields.Get(t.tag)
+	if aux == nil {
+		return
+	}
+	umi, ok := aux.Value().(string)
+	if !ok {
+		return
+	}
+	start := PosType(samr.Pos)
+	end := reads[0].mapEnd
+	if (len(reads) == 2) && (reads[1].mapEnd > end) {
+		end = reads[1].mapEnd
+	}
+	strand := pileup.GetStrand(samr)
+	t.obsBuf = appendReadPairObs(t.obsBuf[:0], reads, abb0, abb1, policy)
+
+	families, found := t.byStart[start]
+	for _, f := range families {
+		if (f.end == end) && (f.strand == strand) && umiMatches(f.umi, umi, t.maxMismatches) {
+			f.nMember++
+			f.obs = append(f.obs, t.obsBuf...)
+			return
+		}
+	}
+	t.byStart[start] = append(families, &umiFamily{
+		umi:     umi,
+		end:     end,
+		strand:  strand,
+		isMinus: isMinus,
+		nMember: 1,
+		obs:     append([]umiObs(nil), t.obsBuf...),
+	})
+	if !found {
+		heap.Push(&t.starts, start)
+	}
+}
+
+// flushFamilies adds the consensus observations of every family starting
+// before stopPos to the pileup.
+func (pm *pileupMutable) flushFamilies(pCtx *pileupContext, stopPos PosType) {
+	t := pm.families
+	if t == nil {
+		return
+	}
+	for (len(t.starts) != 0) && (t.starts[0] < stopPos) {
+		start := heap.Pop(&t.starts).(PosType)
+		for _, f := range t.byStart[start] {
+			if f.nMember >= t.minSize {
+				pm.addFamily(f, pCtx.minBaseQual)
+			}
+		}
+		delete(t.byStart, start)
+	}
+}
+
+// addFamily adds a family's consensus observations to the pileup.
+func (pm *pileupMutable) addFamily(f *umiFamily, minBaseQual byte) {
+	obs := f.obs
+	sort.SliceStable(obs, func(i, j int) bool {
+		return obs[i].pos < obs[j].pos
+	})
+	for i := 0; i != len(obs); {
+		pos := obs[i].pos
+		row := pm.rowAt(pos)
+		row.Depth++
+		base := byte(pileup.BaseX)
+		var qual byte
+		agree := true
+		for ; (i != len(obs)) && (obs[i].pos == pos); i++ {
+			o := &obs[i]
+			if (o.base == pileup.BaseX) || (o.qual < minBaseQual) {
+				continue
+			}
+			if base == pileup.BaseX {
+				base = o.base
+				qual = o.qual
+			} else if o.base == base {
+				qual = qualSumTable[qual][o.qual]
+			} else {
+				agree = false
+			}
+		}
+		if agree && (base != pileup.BaseX) {
+			row.Counts[base][f.isMinus]++
+			row.QualSums[base] += uint32(qual)
+		}
+		if pm.endMax <= pos {
+			pm.endMax = pos + 1
+		}
+	}
+}
@@ -0,0 +1,309 @@
+// Copyright 2020 Grail Inc.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//    http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package snp
+
+import (
+	"context"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/Schaudge/grailbase/file"
+	"github.com/Schaudge/grailbase/log"
+	"github.com/Schaudge/grailbase/tsv"
+	"github.com/Schaudge/grailbio/pileup"
+	"github.com/Schaudge/hts/bgzf"
+	"github.com/Schaudge/hts/sam"
+)
+
+// The VCF output contains one record per position with at least one observed
+// ALT allele (in any sample); a position may have SNV and indel ALT alleles at
+// the same time.  Nothing is genotyped: the sample columns only contain read
+// counts.
+// - AD and SB use the same counts as the TSV formats' highq columns: only
+//   bases (and indels) which pass -min-base-qual are counted.  DP is the total
+//   depth, including low-quality bases.
+// - MBQ is the mean base-quality of the counted observations of each allele,
+//   across all samples.  For stitched bases, this is the combined quality of
+//   the two read-ends.
+// - N is never reported as an ALT allele.
+// Records are written in .bam header order, so vcf-bgz output can be indexed
+// with "tabix -p vcf".
+
+// writeVCFHeader writes the VCF meta-information and header lines.
+func writeVCFHeader(w *tsv.Writer, header *sam.Header, fapath string, sampleNames []string) (err error) {
+	lines := []string{
+		"##fileformat=VCFv4.2",
+		"##source=bio-pileup",
+	}
+	if fapath != "" {
+		lines = append(lines, "##reference="+fapath)
+	}
+	for _, ref := range header.Refs() {
+		line := "##contig=<ID=" + ref.Name() + ",length=" + strconv.Itoa(ref.Len())
+		if assembly := ref.AssemblyID(); assembly != "" {
+			line += ",assembly=" + assembly
+		}
+		if md5 := ref.MD5(); md5 != nil {
+			line += ",md5=" + hex.EncodeToString(md5)
+		}
+		lines = append(lines, line+">")
+	}
+	lines = append(lines,
+		`##INFO=<ID=DP,Number=1,Type=Integer,Description="Total read depth, including low-quality bases">`,
+		`##INFO=<ID=MBQ,Number=R,Type=Integer,Description="Mean base quality of the counted observations of each allele">`,
+		`##FORMAT=<ID=AD,Number=R,Type=Integer,Description="Read depths of the ref and alt alleles, counting only high-quality observations">`,
+		`##FORMAT=<ID=DP,Number=1,Type=Integer,Description="Total read depth, including low-quality bases">`,
+		`##FORMAT=<ID=SB,Number=.,Type=Integer,Description="Per-strand read depths: REF+,REF-,ALT1+,ALT1-,...">`,
+		"#CHROM\tPOS\tID\tREF\tALT\tQUAL\tFILTER\tINFO\tFORMAT\t"+strings.Join(sampleNames, "\t"),
+	)
+	for _, line := range lines {
+		w.WriteString(line)
+		if err = w.EndLine(); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// vcfAllele is a single allele of a VCF record in a single sample, with its
+// per-strand counts and base-quality sum.
+type vcfAllele struct {
+	counts  [2]uint32
+	qualSum uint32
+}
+
+// vcfRecordBuilder renders the VCF record for a single position.  It is reused
+// across positions to avoid allocations.
+type vcfRecordBuilder struct {
+	refAllele []byte
+	alts      [][]byte
+	// alleles is indexed by [sample][allele], with the REF allele first.
+	alleles      [][]vcfAllele
+	indelAlleles []IndelCounts
+}
+
+// build computes the alleles of the given rows, one per sample.  It returns
+// false if no ALT allele was observed.
+func (b *vcfRecordBuilder) build(rows []*PileupRow, refSeq8 string) bool {
+	pos := rows[0].Pos
+	refBase := pileup.Seq8ToEnumTable[refSeq8[pos]]
+	if len(b.alleles) != len(rows) {
+		b.alleles = make([][]vcfAllele, len(rows))
+	}
+	for s, pr := range rows {
+		b.alleles[s] = append(b.alleles[s][:0], vcfAllele{
+			counts:  pr.Payload.Counts[refBase],
+			qualSum: pr.Payload.QualSums[refBase],
+		})
+	}
+	b.alts = b.alts[:0]
+	b.indelAlleles = unionIndelAlleles(b.indelAlleles, rows)
+	// When there are deletions, REF must cover the longest one, and the other
+	// alleles are padded with the same reference bases.
+	maxDelLen := uint32(0)
+	for _, c := range b.indelAlleles {
+		if c.DelLen > maxDelLen {
+			maxDelLen = c.DelLen
+		}
+	}
+	suffix := refSeq8[pos+1 : pos+1+maxDelLen]
+	b.refAllele = b.refAllele[:0]
+	for i := pos; i <= pos+maxDelLen; i++ {
+		b.refAllele = append(b.refAllele, pileup.Seq8ToASCIITable[refSeq8[i]])
+	}
+	for altBase := byte(0); altBase < pileup.NBase; altBase++ {
+		if altBase == refBase {
+			continue
+		}
+		altCount := uint32(0)
+		for _, pr := range rows {
+			altCount += pr.Payload.Counts[altBase][0] + pr.Payload.Counts[altBase][1]
+		}
+		if altCount == 0 {
+			continue
+		}
+		alt := b.nextAlt()
+		alt = append(alt, pileup.EnumToASCIITable[altBase])
+		b.alts[len(b.alts)-1] = appendSeq8AsASCII(alt, suffix)
+		for s, pr := range rows {
+			b.alleles[s] = append(b.alleles[s], vcfAllele{
+				counts:  pr.Payload.Counts[altBase],
+				qualSum: pr.Payload.QualSums[altBase],
+			})
+		}
+	}
+	for i := range b.indelAlleles {
+		allele := &b.indelAlleles[i]
+		alt := b.nextAlt()
+		alt = append(alt, b.refAllele[0])
+		alt = append(alt, allele.Ins...)
+		b.alts[len(b.alts)-1] = appendSeq8AsASCII(alt, suffix[allele.DelLen:])
+		for s, pr := range rows {
+			var a vcfAllele
+			if c := findIndelCounts(pr.Payload.Indels, allele); c != nil {
+				a.counts = c.Counts
+				a.qualSum = c.QualSum
+			}
+			b.alleles[s] = append(b.alleles[s], a)
+		}
+	}
+	return len(b.alts) != 0
+}
+
+// nextAlt appends an empty ALT allele to b.alts, reusing previously allocated
+// memory when possible, and returns it.
+func (b *vcfRecordBuilder) nextAlt() []byte {
+	n := len(b.alts)
+	if n < cap(b.alts) {
+		b.alts = b.alts[:n+1]
+		b.alts[n] = b.alts[n][:0]
+	} else {
+		b.alts = append(b.alts, nil)
+	}
+	return b.alts[n]
+}
+
+func appendSeq8AsASCII(dst []byte, seq8 string) []byte {
+	for i := 0; i < len(seq8); i++ {
+		dst = append(dst, pileup.Seq8ToASCIITable[seq8[i]])
+	}
+	return dst
+}
+
+// write appends the record built by the last build() call to w.
+func (b *vcfRecordBuilder) write(w *tsv.Writer, refName string, rows []*PileupRow) error {
+	w.WriteString(refName)
+	w.WriteUint32(rows[0].Pos + 1)
+	w.WriteByte('.') // ID
+	w.WriteBytes(b.refAllele)
+	for _, alt := range b.alts {
+		w.WritePartialBytes(alt)
+		w.WritePartialByte(',')
+	}
+	w.EndCsv()
+	w.WriteByte('.') // QUAL
+	w.WriteByte('.') // FILTER
+	totalDepth := uint32(0)
+	for _, pr := range rows {
+		totalDepth += pr.Payload.Depth
+	}
+	w.WritePartialString("DP=")
+	w.WritePartialUint32(totalDepth)
+	w.WritePartialString(";MBQ=")
+	for i := range b.alleles[0] {
+		n, qualSum := uint32(0), uint32(0)
+		for _, sampleAlleles := range b.alleles {
+			n += sampleAlleles[i].counts[0] + sampleAlleles[i].counts[1]
+			qualSum += sampleAlleles[i].qualSum
+		}
+		if n == 0 {
+			w.WriteCsvByte('.')
+		} else {
+			w.WriteCsvUint32((qualSum + n/2) / n)
+		}
+	}
+	w.EndCsv()
+	w.WriteString("AD:DP:SB")
+	for s, pr := range rows {
+		for i, a := range b.alleles[s] {
+			if i != 0 {
+				w.WritePartialByte(',')
+			}
+			w.WritePartialUint32(a.counts[0] + a.counts[1])
+		}
+		w.WritePartialByte(':')
+		w.WritePartialUint32(pr.Payload.Depth)
+		w.WritePartialByte(':')
+		for _, a := range b.alleles[s] {
+			w.WriteCsvUint32(a.counts[0])
+			w.WriteCsvUint32(a.counts[1])
+		}
+		w.EndCsv()
+	}
+	return w.EndLine()
+}
+
+// ConvertPileupRowsToVCF writes the .vcf file of a single sample.  The sample
+// is named by the SM of the read-groups in header if they all agree, or by the
+// basename of mainPath otherwise.  See ConvertPileupRowsToVCFSamples() for
+// details.
+func ConvertPileupRowsToVCF(ctx context.Context, tmpFiles []*os.File, mainPath string, bgzip bool, parallelism int, header *sam.Header, fapath string, refSeqs []string) (err error) {
+	name := readGroupSampleName(header)
+	if name == "" {
+		name = filepath.Base(mainPath)
+	}
+	return ConvertPileupRowsToVCFSamples(ctx, [][]*os.File{tmpFiles}, mainPath, bgzip, parallelism, header, fapath, refSeqs, []string{name})
+}
+
+// ConvertPileupRowsToVCFSamples writes the .vcf file.  tmpFiles is indexed by
+// [sample][job].
+func ConvertPileupRowsToVCFSamples(ctx context.Context, tmpFiles [][]*os.File, mainPath string, bgzip bool, parallelism int, header *sam.Header, fapath string, refSeqs []string, sampleNames []string) (err error) {
+	fullPath := mainPath + ".vcf"
+	if bgzip {
+		fullPath = fullPath + ".gz"
+	}
+	var dst file.File
+	if dst, err = file.Create(ctx, fullPath); err != nil {
+		return
+	}
+	defer file.CloseAndReport(ctx, dst, &err)
+
+	var w *tsv.Writer
+	if !bgzip {
+		w = tsv.NewWriter(dst.Writer(ctx))
+	} else {
+		bgzfWriter := bgzf.NewWriter(dst.Writer(ctx), parallelism)
+		w = tsv.NewWriter(bgzfWriter)
+		defer func() {
+			if e := bgzfWriter.Close(); e != nil && err == nil {
+				err = e
+			}
+		}()
+	}
+	if err = writeVCFHeader(w, header, fapath, sampleNames); err != nil {
+		return
+	}
+	refs := header.Refs()
+	lastRefID := uint32(0)
+	curRefName := refs[0].Name()
+	curRefSeq8 := refSeqs[0]
+	var builder vcfRecordBuilder
+	scanner := newSampleRowScanner(tmpFiles)
+	for scanner.Scan() {
+		rows := scanner.Rows()
+		refID := rows[0].RefID
+		if refID != lastRefID {
+			curRefName = refs[refID].Name()
+			curRefSeq8 = refSeqs[refID]
+			lastRefID = refID
+		}
+		if !builder.build(rows, curRefSeq8) {
+			continue
+		}
+		if err = builder.write(w, curRefName, rows); err != nil {
+			return
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return
+	}
+	if err = w.Flush(); err != nil {
+		return
+	}
+	log.Printf("ConvertPileupRowsToVCF: done, final results written to %s", fullPath)
+	return
+}